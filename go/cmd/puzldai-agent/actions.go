@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+)
+
+const (
+	defaultCITrigger = "/puzldai"
+	// maxSummaryPatch bounds the diff shown in the job summary; GitHub
+	// takes at most 1 MiB of summary per step.
+	maxSummaryPatch = 60_000
+	// minMaskedSecret is the shortest environment value masked in the log;
+	// shorter ones would mask common words.
+	minMaskedSecret = 6
+)
+
+// secretNameRe matches the names of environment variables whose values are
+// masked in the log.
+var secretNameRe = regexp.MustCompile(`(?i)(^|_)(KEY|TOKEN|SECRET|PASSWORD|PASSWD|CREDENTIALS?)($|_)`)
+
+// trustedAssociations are the author associations whose comments and issues
+// are taken as tasks unless -any-commenter is set.
+var trustedAssociations = map[string]bool{"OWNER": true, "MEMBER": true, "COLLABORATOR": true}
+
+// actionsEvent is the part of the workflow's triggering event
+// ($GITHUB_EVENT_PATH) that the task is read from.
+type actionsEvent struct {
+	Inputs  map[string]any `json:"inputs"`
+	Comment *struct {
+		Body              string     `json:"body"`
+		AuthorAssociation string     `json:"author_association"`
+		User              actionUser `json:"user"`
+	} `json:"comment"`
+	Issue       *actionsIssue `json:"issue"`
+	PullRequest *actionsIssue `json:"pull_request"`
+}
+
+type actionsIssue struct {
+	Number            int        `json:"number"`
+	Title             string     `json:"title"`
+	Body              string     `json:"body"`
+	AuthorAssociation string     `json:"author_association"`
+	User              actionUser `json:"user"`
+	// PullRequest is set on the issue of a comment on a pull request.
+	PullRequest *struct{} `json:"pull_request"`
+}
+
+type actionUser struct {
+	Login string `json:"login"`
+}
+
+// ciFile is a file the run changed.
+type ciFile struct {
+	path      string
+	change    string // added, modified, or deleted
+	additions int
+	deletions int
+}
+
+const ciUsage = "usage: puzldai-agent ci [-cwd dir] [-task text] [-trigger prefix] [-any-commenter] [-patch-out file] [-- agent flags]"
+
+// runCI implements the ci subcommand for GitHub Actions: the task comes
+// from the workflow, the agent runs in -ci mode on the checked-out
+// workspace, and the result is reported the way later steps and the job
+// page read it: log groups, step outputs, a patch file, and a job summary.
+func runCI(args []string) int {
+	fs := newFlagSet("ci")
+	cwdFlag := fs.String("cwd", "", "Workspace (default: the current directory)")
+	taskFlag := fs.String("task", "", "Task text (default: INPUT_TASK, a workflow_dispatch task input, or the comment or issue that triggered the workflow)")
+	triggerFlag := fs.String("trigger", defaultCITrigger, "Prefix a comment must start with to be taken as a task; the rest of the comment is the task")
+	anyCommenterFlag := fs.Bool("any-commenter", false, "Take tasks from comments and issues by anyone, not just owners, members, and collaborators")
+	patchOutFlag := fs.String("patch-out", "", "Write the patch here, for an artifact (default: $RUNNER_TEMP/puzldai.patch)")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, ciUsage)
+		return exitUsage
+	}
+	secrets := maskSecrets()
+
+	task, skip, err := ciTask(*taskFlag, *triggerFlag, *anyCommenterFlag)
+	if err != nil {
+		fmt.Printf("::error::%s\n", escapeWorkflowData("ci: "+err.Error()))
+		return exitUsage
+	}
+	if skip != "" {
+		fmt.Printf("::notice::%s\n", escapeWorkflowData("nothing to do: "+skip))
+		if err := setStepOutputs([][2]string{{"status", "skipped"}}); err != nil {
+			fmt.Fprintln(os.Stderr, "ci:", err)
+			return exitError
+		}
+		return exitOK
+	}
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ci:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	fail := func(err error) int {
+		fmt.Printf("::error::%s\n", escapeWorkflowData("ci: "+err.Error()))
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		return exitError
+	}
+	root, err := gitRoot(ctx, cwd)
+	if err != nil {
+		return fail(err)
+	}
+	base, err := snapshotWorktree(ctx, root, "puzldai ci baseline")
+	if err != nil {
+		return fail(err)
+	}
+	work, err := os.MkdirTemp("", "puzldai-ci-")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(work)
+	taskFile := filepath.Join(work, "task.md")
+	if err := os.WriteFile(taskFile, []byte(task), 0o600); err != nil {
+		return fail(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Println("::group::Task")
+	fmt.Println(task)
+	fmt.Println("::endgroup::")
+	fmt.Println("::group::Agent run")
+	c := &childRun{label: "agent", dir: root, cwd: cwd, outcomeFile: filepath.Join(work, "outcome.json")}
+	c.run(ctx, exe, append(slices.Clone(agentArgs), "-ci", "-cwd", cwd, "-task-file", taskFile, "-outcome-out", c.outcomeFile), &sync.Mutex{})
+	fmt.Println("::endgroup::")
+	if ctx.Err() != nil {
+		return fail(ctx.Err())
+	}
+
+	current, err := snapshotWorktree(ctx, root, "puzldai ci result")
+	if err != nil {
+		return fail(err)
+	}
+	patch, err := runGit(ctx, root, "diff", "--binary", base, current)
+	if err != nil {
+		return fail(err)
+	}
+	files, err := ciChangedFiles(ctx, root, base, current)
+	if err != nil {
+		return fail(err)
+	}
+	patchOut := firstNonEmpty(*patchOutFlag, filepath.Join(firstNonEmpty(os.Getenv("RUNNER_TEMP"), os.TempDir()), "puzldai.patch"))
+	if err := os.WriteFile(patchOut, []byte(patch), 0o644); err != nil {
+		return fail(err)
+	}
+	if patch != "" {
+		fmt.Println("::group::Patch")
+		fmt.Print(patch)
+		fmt.Println("::endgroup::")
+	}
+	if answer := strings.TrimSpace(c.answer); answer != "" {
+		fmt.Println(answer)
+	}
+
+	status := firstNonEmpty(c.outcome.Status, outcomeError)
+	summary := firstNonEmpty(c.outcome.Summary, strings.TrimSpace(c.answer))
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.path
+	}
+	outputs := [][2]string{
+		{"status", status},
+		{"exit_code", strconv.Itoa(c.exitCode)},
+		{"changed_files", strings.Join(paths, "\n")},
+		{"changed_count", strconv.Itoa(len(files))},
+		{"summary", redactSecrets(summary, secrets)},
+	}
+	if patch != "" {
+		outputs = append(outputs, [2]string{"patch", patchOut})
+	}
+	if err := setStepOutputs(outputs); err != nil {
+		return fail(err)
+	}
+	if err := writeJobSummary(redactSecrets(ciSummary(status, summary, files, patch), secrets)); err != nil {
+		return fail(err)
+	}
+	if c.exitCode != exitOK {
+		fmt.Printf("::error::%s\n", escapeWorkflowData(fmt.Sprintf("the agent run ended with status %s (exit code %d)", status, c.exitCode)))
+	}
+	return c.exitCode
+}
+
+// ciTask returns the task, or why there is nothing to do: a comment without
+// the trigger, or a comment or issue by someone who is not trusted.
+func ciTask(task, trigger string, anyCommenter bool) (string, string, error) {
+	if strings.TrimSpace(task) != "" {
+		return task, "", nil
+	}
+	if task := strings.TrimSpace(os.Getenv("INPUT_TASK")); task != "" {
+		return task, "", nil
+	}
+	path := os.Getenv("GITHUB_EVENT_PATH")
+	if path == "" {
+		return "", "", errors.New("no task: pass -task, or run in a workflow triggered by a comment, an issue, or workflow_dispatch with a task input")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	var ev actionsEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", "", fmt.Errorf("%s: %w", path, err)
+	}
+	if task, ok := ev.Inputs["task"].(string); ok && strings.TrimSpace(task) != "" {
+		return strings.TrimSpace(task), "", nil
+	}
+	subject, kind := ev.Issue, "Issue"
+	if subject == nil {
+		subject = ev.PullRequest
+	}
+	if subject != nil && (subject == ev.PullRequest || subject.PullRequest != nil) {
+		kind = "Pull request"
+	}
+	if ev.Comment != nil {
+		request, ok := cutTrigger(ev.Comment.Body, trigger)
+		if !ok {
+			return "", fmt.Sprintf("the comment does not start with %s", trigger), nil
+		}
+		if !anyCommenter && !trustedAssociations[ev.Comment.AuthorAssociation] {
+			return "", fmt.Sprintf("%s is not an owner, member, or collaborator (-any-commenter takes tasks from anyone)", ev.Comment.User.Login), nil
+		}
+		switch {
+		case subject == nil && request == "":
+			return "", "", errors.New("the comment has no task after " + trigger)
+		case subject == nil:
+			return request, "", nil
+		case request == "":
+			request = fmt.Sprintf("Resolve %s #%d below.", strings.ToLower(kind), subject.Number)
+		}
+		return request + "\n\nThe request was made in a comment on the following " + strings.ToLower(kind) + ".\n\n" + issueText(kind, subject), "", nil
+	}
+	if subject == nil {
+		return "", "", errors.New("the event has no comment, issue, or task input to take the task from")
+	}
+	if !anyCommenter && !trustedAssociations[subject.AuthorAssociation] {
+		return "", fmt.Sprintf("%s is not an owner, member, or collaborator (-any-commenter takes tasks from anyone)", subject.User.Login), nil
+	}
+	return issueText(kind, subject), "", nil
+}
+
+// cutTrigger returns the request after trigger in a comment, and whether
+// the comment starts with it as a word of its own.
+func cutTrigger(comment, trigger string) (string, bool) {
+	request, ok := strings.CutPrefix(strings.TrimSpace(comment), trigger)
+	if !ok || (request != "" && !unicode.IsSpace(rune(request[0]))) {
+		return "", false
+	}
+	return strings.TrimSpace(request), true
+}
+
+// issueText is the issue or pull request as the agent sees it.
+func issueText(kind string, s *actionsIssue) string {
+	return subjectText(kind, s.Number, s.Title, s.Body, s.User.Login, trustedAssociations[s.AuthorAssociation])
+}
+
+// subjectText is an issue, pull request, or merge request as the agent sees
+// it. A body by someone outside the project is marked untrusted.
+func subjectText(kind string, number int, title, body, author string, trusted bool) string {
+	text := fmt.Sprintf("%s #%d: %s\n\n%s", kind, number, title, strings.TrimSpace(body))
+	if !trusted {
+		return wrapUntrusted(fmt.Sprintf("%s #%d by %s", strings.ToLower(kind), number, author), text)
+	}
+	return text
+}
+
+// ciChangedFiles lists the files that differ between two commits, with
+// their added and deleted lines; binary files have none.
+func ciChangedFiles(ctx context.Context, root, from, to string) ([]ciFile, error) {
+	status, err := runGit(ctx, root, "diff", "--name-status", "--no-renames", "-z", from, to)
+	if err != nil {
+		return nil, err
+	}
+	numstat, err := runGit(ctx, root, "diff", "--numstat", "--no-renames", "-z", from, to)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string][2]int{}
+	for _, rec := range strings.Split(numstat, "\x00") {
+		fields := strings.SplitN(rec, "\t", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		added, _ := strconv.Atoi(fields[0])
+		deleted, _ := strconv.Atoi(fields[1])
+		counts[fields[2]] = [2]int{added, deleted}
+	}
+	changes := map[string]string{"A": "added", "D": "deleted"}
+	var files []ciFile
+	fields := strings.Split(strings.TrimSuffix(status, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		path := fields[i+1]
+		files = append(files, ciFile{path: path, change: firstNonEmpty(changes[fields[i]], "modified"), additions: counts[path][0], deletions: counts[path][1]})
+	}
+	return files, nil
+}
+
+// ciSummary is the job summary in markdown.
+func ciSummary(status, summary string, files []ciFile, patch string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "## puzldai-agent: %s\n\n", status)
+	if summary != "" {
+		sb.WriteString(summary + "\n\n")
+	}
+	if len(files) == 0 {
+		sb.WriteString("No files changed.\n")
+		return sb.String()
+	}
+	sb.WriteString("| File | Change | + | - |\n| --- | --- | ---: | ---: |\n")
+	for _, f := range files {
+		fmt.Fprintf(&sb, "| `%s` | %s | %d | %d |\n", strings.ReplaceAll(f.path, "|", `\|`), f.change, f.additions, f.deletions)
+	}
+	shown := truncateOutput(patch, maxSummaryPatch)
+	// A fence longer than any backtick run in the patch cannot be closed by it.
+	fence := "```"
+	for strings.Contains(shown, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(&sb, "\n<details><summary>Patch</summary>\n\n%sdiff\n%s\n%s\n\n</details>\n", fence, strings.TrimRight(shown, "\n"), fence)
+	return sb.String()
+}
+
+// maskSecrets asks the runner to mask the secret values of the
+// environment, and returns them for the files it does not mask.
+func maskSecrets() []string {
+	secrets := secretValues()
+	for _, s := range secrets {
+		fmt.Printf("::add-mask::%s\n", escapeWorkflowData(s))
+	}
+	return secrets
+}
+
+// secretValues returns the values of the environment variables named like
+// secrets, line by line.
+func secretValues() []string {
+	var secrets []string
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if !secretNameRe.MatchString(name) {
+			continue
+		}
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); len(line) >= minMaskedSecret {
+				secrets = append(secrets, line)
+			}
+		}
+	}
+	return secrets
+}
+
+func redactSecrets(text string, secrets []string) string {
+	for _, s := range secrets {
+		text = strings.ReplaceAll(text, s, "***")
+	}
+	return text
+}
+
+// escapeWorkflowData escapes the data of a workflow command so it stays on
+// one line.
+func escapeWorkflowData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// setStepOutputs appends the outputs to $GITHUB_OUTPUT in its multi-line
+// form. Outside Actions there is no such file and nothing is written.
+func setStepOutputs(outputs [][2]string) error {
+	path := os.Getenv("GITHUB_OUTPUT")
+	if path == "" {
+		return nil
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	delimiter := "puzldai_" + hex.EncodeToString(id[:])
+	var sb strings.Builder
+	for _, kv := range outputs {
+		fmt.Fprintf(&sb, "%s<<%s\n%s\n%s\n", kv[0], delimiter, kv[1], delimiter)
+	}
+	return appendFile(path, sb.String())
+}
+
+// writeJobSummary appends markdown to $GITHUB_STEP_SUMMARY, or prints it on
+// stderr outside Actions.
+func writeJobSummary(markdown string) error {
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if path == "" {
+		fmt.Fprint(os.Stderr, "\n"+markdown)
+		return nil
+	}
+	return appendFile(path, markdown)
+}
+
+func appendFile(path, data string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
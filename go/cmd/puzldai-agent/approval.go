@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	approvalPrompt = "prompt"
+	approvalAuto   = "auto"
+	approvalDeny   = "deny"
+)
+
+// approver asks the operator to confirm sensitive actions. Stdin carries the
+// task, so prompts are read from the controlling terminal instead.
+type approver struct {
+	mode string
+	mu   sync.Mutex
+	// ui, when set, answers prompts in place of the terminal (-tui).
+	ui *tui
+	// status, when set, is hidden while the terminal prompts.
+	status *statusLine
+	// notify announces prompts to an operator away from the terminal.
+	notify *notifier
+}
+
+func newApprover(mode string) (*approver, error) {
+	switch mode {
+	case "":
+		mode = approvalPrompt
+	case approvalPrompt, approvalAuto, approvalDeny:
+	default:
+		return nil, fmt.Errorf("invalid approval mode %q (prompt, auto, deny)", mode)
+	}
+	return &approver{mode: mode}, nil
+}
+
+// approve reports whether the action described by summary may proceed.
+// Explicit actions always require a human answer, even in auto mode.
+func (a *approver) approve(summary string, explicit bool) (bool, string) {
+	switch {
+	case a.mode == approvalDeny:
+		return false, "approval denied by policy (-approval deny)"
+	case a.mode == approvalAuto && !explicit:
+		return true, ""
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.ui != nil {
+		a.notify.approval(summary)
+		return a.ui.approve(summary)
+	}
+	in, out, err := openTTY()
+	if err != nil {
+		return false, "approval required but no terminal is available"
+	}
+	defer a.status.hold()()
+	defer in.Close()
+	a.notify.approval(summary)
+
+	fmt.Fprintf(out, "\n%s\nApprove? [y/N] ", summary)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		return false, "approval required but no answer was read"
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, ""
+	default:
+		return false, "action rejected by the operator"
+	}
+}
+
+// openTTY returns the terminal input and the writer prompts should go to.
+// In -ci mode there is never a terminal to prompt on.
+func openTTY() (io.ReadCloser, io.Writer, error) {
+	if ciMode {
+		return nil, nil, errors.New("interactive prompts are disabled (-ci)")
+	}
+	if runtime.GOOS == "windows" {
+		in, err := os.Open("CONIN$")
+		return in, os.Stderr, err
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	return tty, tty, err
+}
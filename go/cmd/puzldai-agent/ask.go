@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stopError ends the agent loop from inside a tool with the given outcome.
+type stopError struct {
+	outcome agentOutcome
+}
+
+func (e *stopError) Error() string {
+	return "stopped: " + e.outcome.Summary
+}
+
+// askUserTool lets the model ask the operator a clarifying question on the
+// controlling terminal. Without a terminal (or with -no-input) it answers
+// with fallback, or stops the run with status needs_input when there is none.
+func askUserTool(a *approver, fallback string, noInput bool) toolDef {
+	return toolDef{
+		name:        "ask_user",
+		description: "Ask the user a clarifying question when requirements are ambiguous; returns their answer",
+		params: []toolParam{
+			required("question", "string", ""),
+			optional("choices", "array", "suggested answers"),
+		},
+		fn: func(_ context.Context, _ string, args map[string]any) (string, error) {
+			question, ok := argString(args, "question")
+			if !ok || strings.TrimSpace(question) == "" {
+				return "", errors.New("ask_user: missing question")
+			}
+			var choices []string
+			for _, c := range asSlice(args["choices"]) {
+				if s, ok := c.(string); ok && s != "" {
+					choices = append(choices, s)
+				}
+			}
+
+			if !noInput {
+				answer, err := a.ask(question, choices)
+				if err == nil {
+					return answer, nil
+				}
+			}
+			if fallback != "" {
+				return "No user is available to answer; proceed with this default: " + fallback, nil
+			}
+			return "", &stopError{outcome: agentOutcome{Status: outcomeNeedsInput, Summary: question}}
+		},
+	}
+}
+
+// ask prompts on the terminal, or in the TUI with -tui. A numeric answer
+// selects from choices.
+func (a *approver) ask(question string, choices []string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var answer string
+	var err error
+	if a.ui != nil {
+		a.notify.question(question)
+		answer, err = a.ui.ask(question, choices)
+	} else {
+		resume := a.status.hold()
+		answer, err = askTTY(question, choices, a.notify)
+		resume()
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		if err != nil {
+			return "", err
+		}
+		return "(no answer; use your best judgement)", nil
+	}
+	if n, convErr := strconv.Atoi(answer); convErr == nil && n >= 1 && n <= len(choices) {
+		return choices[n-1], nil
+	}
+	return answer, nil
+}
+
+func askTTY(question string, choices []string, notify *notifier) (string, error) {
+	in, out, err := openTTY()
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	notify.question(question)
+
+	fmt.Fprintf(out, "\nThe agent asks: %s\n", question)
+	for i, c := range choices {
+		fmt.Fprintf(out, "  %d) %s\n", i+1, c)
+	}
+	fmt.Fprint(out, "> ")
+	return bufio.NewReader(in).ReadString('\n')
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// goModule is the type-checked source of the Go module holding a
+// workspace, enough to find every reference to a symbol declared in it.
+// The standard library is imported from export data; other modules are not
+// loaded, so a reference reached only through their types can be missed.
+type goModule struct {
+	fsys workspaceFS
+	root string
+	path string
+	fset *token.FileSet
+	src  map[string][]byte
+	// libs are the importable packages by import path; units adds the test
+	// variants. A file can be checked in two units, so objects are matched
+	// by their declaring position rather than identity.
+	libs  map[string]*goUnit
+	units []*goUnit
+	std   types.Importer
+	// skipped are files left out by build constraints.
+	skipped []string
+}
+
+type goUnit struct {
+	path     string
+	files    []*ast.File
+	pkg      *types.Package
+	info     *types.Info
+	checking bool
+}
+
+func loadGoModule(ctx context.Context, dir string) (*goModule, error) {
+	fsys := workspaceFSFrom(ctx)
+	root, modPath, err := findGoModule(ctx, fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &goModule{fsys: fsys, root: root, path: modPath, fset: token.NewFileSet(), src: map[string][]byte{}, libs: map[string]*goUnit{}, std: importer.Default()}
+	var dirs []string
+	goFiles := map[string][]string{}
+	err = fsys.Walk(ctx, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if !d.IsDir() {
+			if strings.HasSuffix(name, ".go") {
+				goFiles[filepath.Dir(path)] = append(goFiles[filepath.Dir(path)], name)
+			}
+			return nil
+		}
+		if path != root {
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "vendor" || name == "testdata" {
+				return filepath.SkipDir
+			}
+			if _, err := fsys.Stat(ctx, filepath.Join(path, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if err := m.parseDir(ctx, dir, goFiles[dir]); err != nil {
+			return nil, err
+		}
+	}
+	paths := make([]string, 0, len(m.libs))
+	for p := range m.libs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		m.check(m.libs[p])
+	}
+	for _, u := range m.units {
+		m.check(u)
+	}
+	return m, nil
+}
+
+// findGoModule returns the directory holding the go.mod above dir and the
+// module path it declares.
+func findGoModule(ctx context.Context, fsys workspaceFS, dir string) (string, string, error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		f, err := fsys.Open(ctx, filepath.Join(d, "go.mod"))
+		if err == nil {
+			defer f.Close()
+			sc := bufio.NewScanner(f)
+			for sc.Scan() {
+				if rest, ok := strings.CutPrefix(strings.TrimSpace(sc.Text()), "module"); ok {
+					return d, strings.Trim(strings.TrimSpace(rest), `"`), nil
+				}
+			}
+			return "", "", fmt.Errorf("%s: no module line", filepath.Join(d, "go.mod"))
+		}
+		if filepath.Dir(d) == d {
+			return "", "", fmt.Errorf("%s is not inside a Go module", dir)
+		}
+	}
+}
+
+// parseDir adds the package of the Go files names in dir: the importable
+// package, and units for its internal and external tests when it has them.
+func (m *goModule) parseDir(ctx context.Context, dir string, names []string) error {
+	// Build constraints are read through the workspace file system too.
+	bctx := build.Default
+	bctx.OpenFile = func(path string) (io.ReadCloser, error) { return m.fsys.Open(ctx, path) }
+	var lib, internal, external []*ast.File
+	for _, name := range names {
+		full := filepath.Join(dir, name)
+		if ok, err := bctx.MatchFile(dir, name); err != nil || !ok {
+			m.skipped = append(m.skipped, full)
+			continue
+		}
+		src, err := m.fsys.ReadFile(ctx, full)
+		if err != nil {
+			return err
+		}
+		file, err := parser.ParseFile(m.fset, full, src, parser.ParseComments)
+		if err != nil {
+			return fmt.Errorf("%s: %w", displayPath(m.root, full), err)
+		}
+		m.src[full] = src
+		switch {
+		case !strings.HasSuffix(name, "_test.go"):
+			lib = append(lib, file)
+		case strings.HasSuffix(file.Name.Name, "_test"):
+			external = append(external, file)
+		default:
+			internal = append(internal, file)
+		}
+	}
+	rel, err := filepath.Rel(m.root, dir)
+	if err != nil {
+		return err
+	}
+	path := m.path
+	if rel != "." {
+		path += "/" + filepath.ToSlash(rel)
+	}
+	if len(lib) > 0 {
+		m.libs[path] = &goUnit{path: path, files: lib}
+	}
+	if len(internal) > 0 {
+		m.units = append(m.units, &goUnit{path: path, files: append(slices.Clone(lib), internal...)})
+	}
+	if len(external) > 0 {
+		m.units = append(m.units, &goUnit{path: path + "_test", files: external})
+	}
+	return nil
+}
+
+// check type-checks u, ignoring errors: code mid-refactor rarely compiles,
+// and what does resolve is still useful.
+func (m *goModule) check(u *goUnit) {
+	if u.pkg != nil || u.checking {
+		return
+	}
+	u.checking = true
+	defer func() { u.checking = false }()
+	u.info = &types.Info{
+		Types: map[ast.Expr]types.TypeAndValue{},
+		Defs:  map[*ast.Ident]types.Object{},
+		Uses:  map[*ast.Ident]types.Object{},
+	}
+	conf := types.Config{Importer: m, Error: func(error) {}, FakeImportC: true}
+	u.pkg, _ = conf.Check(u.path, m.fset, u.files, u.info)
+}
+
+// Import resolves the module's own packages from source, the standard
+// library from export data, and anything else to an empty package.
+func (m *goModule) Import(path string) (*types.Package, error) {
+	if u, ok := m.libs[path]; ok {
+		m.check(u)
+		if u.pkg != nil {
+			return u.pkg, nil
+		}
+	} else if isStdImport(path) {
+		if pkg, err := m.std.Import(path); err == nil {
+			return pkg, nil
+		}
+	}
+	name := path[strings.LastIndex(path, "/")+1:]
+	if strings.HasPrefix(name, "v") && strings.Contains(path, "/") {
+		if _, err := strconv.Atoi(name[1:]); err == nil {
+			prev := strings.TrimSuffix(path, "/"+name)
+			name = prev[strings.LastIndex(prev, "/")+1:]
+		}
+	}
+	name, _, _ = strings.Cut(name, ".")
+	pkg := types.NewPackage(path, strings.TrimPrefix(strings.ReplaceAll(name, "-", "_"), "go_"))
+	pkg.MarkComplete()
+	return pkg, nil
+}
+
+// unitFor returns the importable package in dir.
+func (m *goModule) unitFor(dir string) (*goUnit, error) {
+	rel, err := filepath.Rel(m.root, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("%s is outside module %s", dir, m.path)
+	}
+	path := m.path
+	if rel != "." {
+		path += "/" + filepath.ToSlash(rel)
+	}
+	u, ok := m.libs[path]
+	if !ok || u.pkg == nil {
+		return nil, fmt.Errorf("no Go package in %s", dir)
+	}
+	return u, nil
+}
+
+// lookup finds a package-level symbol, or Type.Member for a field or
+// method.
+func (m *goModule) lookup(u *goUnit, symbol string) (types.Object, error) {
+	name, member, isMember := strings.Cut(symbol, ".")
+	obj := u.pkg.Scope().Lookup(name)
+	if obj == nil {
+		return nil, fmt.Errorf("%s is not declared in package %s", name, u.path)
+	}
+	if !isMember {
+		return obj, nil
+	}
+	if _, ok := obj.(*types.TypeName); !ok {
+		return nil, fmt.Errorf("%s is not a type", name)
+	}
+	sel, _, _ := types.LookupFieldOrMethod(obj.Type(), true, u.pkg, member)
+	if sel == nil {
+		return nil, fmt.Errorf("%s has no field or method %s", name, member)
+	}
+	return sel, nil
+}
+
+// same reports whether a and b are the same declaration, possibly seen
+// from different units.
+func same(a, b types.Object) bool {
+	return a != nil && b != nil && a.Pos() == b.Pos() && a.Name() == b.Name()
+}
+
+// refs returns every identifier in the module that declares or uses obj.
+func (m *goModule) refs(obj types.Object) []*ast.Ident {
+	seen := map[token.Pos]bool{}
+	var out []*ast.Ident
+	for _, u := range m.allUnits() {
+		for _, idents := range []map[*ast.Ident]types.Object{u.info.Defs, u.info.Uses} {
+			for id, o := range idents {
+				if same(o, obj) && !seen[id.Pos()] {
+					seen[id.Pos()] = true
+					out = append(out, id)
+				}
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Pos() < out[j].Pos() })
+	return out
+}
+
+func (m *goModule) allUnits() []*goUnit {
+	units := make([]*goUnit, 0, len(m.libs)+len(m.units))
+	for _, u := range m.libs {
+		units = append(units, u)
+	}
+	return append(units, m.units...)
+}
+
+// decl returns the syntax declaring obj.
+func (m *goModule) decl(obj types.Object) (ast.Node, *ast.File) {
+	for _, u := range m.allUnits() {
+		for _, f := range u.files {
+			if obj.Pos() < f.Pos() || obj.Pos() > f.End() {
+				continue
+			}
+			var found ast.Node
+			ast.Inspect(f, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.FuncDecl:
+					if n.Name.Pos() == obj.Pos() {
+						found = n
+					}
+				case *ast.TypeSpec:
+					if n.Name.Pos() == obj.Pos() {
+						found = n
+					}
+				}
+				return found == nil
+			})
+			return found, f
+		}
+	}
+	return nil, nil
+}
+
+func (m *goModule) offset(pos token.Pos) int { return m.fset.Position(pos).Offset }
+
+func (m *goModule) where(pos token.Pos) string {
+	p := m.fset.Position(pos)
+	return fmt.Sprintf("%s:%d", displayPath(m.root, p.Filename), p.Line)
+}
+
+// sourceEdit replaces src[from:to] of file.
+type sourceEdit struct {
+	file     string
+	from, to int
+	text     string
+}
+
+// apply makes the edits, gofmt-ing each changed file, and returns the old
+// and new contents by file.
+func (m *goModule) apply(edits []sourceEdit) (map[string][2]string, error) {
+	byFile := map[string][]sourceEdit{}
+	for _, e := range edits {
+		byFile[e.file] = append(byFile[e.file], e)
+	}
+	out := map[string][2]string{}
+	for file, es := range byFile {
+		sort.Slice(es, func(i, j int) bool { return es[i].from > es[j].from })
+		src := m.src[file]
+		updated := slices.Clone(src)
+		for i, e := range es {
+			if i > 0 && e == es[i-1] {
+				continue
+			}
+			if i > 0 && e.to > es[i-1].from {
+				return nil, fmt.Errorf("overlapping edits in %s", displayPath(m.root, file))
+			}
+			updated = splice(updated, e.from, e.to, e.text)
+		}
+		formatted, err := format.Source(updated)
+		if err != nil {
+			return nil, fmt.Errorf("%s: the edit does not parse: %w", displayPath(m.root, file), err)
+		}
+		out[file] = [2]string{string(src), string(formatted)}
+	}
+	return out, nil
+}
+
+// astEditResult reports the files an edit changed and anything it could
+// not update.
+type astEditResult struct {
+	summary string
+	changes map[string][2]string
+	manual  []string
+}
+
+func toolASTEdit(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	op, _ := argString(args, "operation")
+	symbol, _ := argString(args, "symbol")
+	dir, _ := argString(args, "package")
+	m, err := loadGoModule(ctx, resolvePath(cwd, firstNonEmpty(dir, ".")))
+	if err != nil {
+		return "", fmt.Errorf("ast_edit: %w", err)
+	}
+	u, err := m.unitFor(resolvePath(cwd, firstNonEmpty(dir, ".")))
+	if err != nil {
+		return "", fmt.Errorf("ast_edit: %w", err)
+	}
+	obj, err := m.lookup(u, symbol)
+	if err != nil {
+		return "", fmt.Errorf("ast_edit: %w", err)
+	}
+
+	var res *astEditResult
+	switch op {
+	case "rename":
+		newName, _ := argString(args, "new_name")
+		res, err = m.rename(u, obj, newName)
+	case "add_param":
+		name, _ := argString(args, "name")
+		typ, _ := argString(args, "type")
+		value, _ := argString(args, "value")
+		index, ok := argInt(args, "index")
+		if !ok {
+			index = -1
+		}
+		res, err = m.addParam(obj, name, typ, value, index)
+	case "remove_param":
+		index, ok := argInt(args, "index")
+		if !ok {
+			return "", errors.New("ast_edit: remove_param needs index")
+		}
+		res, err = m.removeParam(obj, index)
+	case "add_field":
+		name, _ := argString(args, "name")
+		typ, _ := argString(args, "type")
+		tag, _ := argString(args, "tag")
+		res, err = m.addField(u, obj, name, typ, tag)
+	default:
+		err = fmt.Errorf("unknown operation %q", op)
+	}
+	if err != nil {
+		return "", fmt.Errorf("ast_edit: %w", err)
+	}
+	return m.write(ctx, cwd, res)
+}
+
+// write saves the changed files, refusing the whole edit when any of them
+// is outside the workspace or read-only, or a protected path that was not
+// approved.
+func (m *goModule) write(ctx context.Context, cwd string, res *astEditResult) (string, error) {
+	files := make([]string, 0, len(res.changes))
+	for file := range res.changes {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	ignore := ignoreRulesFrom(ctx)
+	fsys := workspaceFSFrom(ctx)
+	for _, file := range files {
+		if !fsys.Inside(ctx, cwd, file) {
+			return "", policyErrorf("ast_edit: %s is outside the workspace", file)
+		}
+		if ignore.mode(file, false) != visible {
+			return "", policyErrorf("ast_edit: %s cannot be written (%s)", displayPath(cwd, file), ignoreFileName)
+		}
+	}
+	if err := protectedPathsFrom(ctx).check("ast_edit", cwd, files); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(res.summary)
+	fmt.Fprintf(&sb, " (%d files)\n", len(files))
+	for _, file := range files {
+		change := res.changes[file]
+		if err := fsys.WriteFile(ctx, file, []byte(change[1])); err != nil {
+			return "", err
+		}
+		sb.WriteString(editReport(displayPath(cwd, file), "", change[0], change[1]))
+		sb.WriteString("\n")
+	}
+	if len(res.manual) > 0 {
+		sb.WriteString("\nNot updated, fix by hand:\n")
+		for _, line := range res.manual {
+			sb.WriteString("- " + line + "\n")
+		}
+	}
+	if len(m.skipped) > 0 {
+		fmt.Fprintf(&sb, "\n%d files excluded by build constraints were not checked; build for other platforms to verify.\n", len(m.skipped))
+	}
+	return strings.TrimRight(sb.String(), "\n"), nil
+}
+
+func (m *goModule) rename(u *goUnit, obj types.Object, newName string) (*astEditResult, error) {
+	old := obj.Name()
+	switch {
+	case !token.IsIdentifier(newName):
+		return nil, fmt.Errorf("invalid new name %q", newName)
+	case newName == old:
+		return nil, fmt.Errorf("%s already has that name", old)
+	}
+	if obj.Parent() == u.pkg.Scope() {
+		if u.pkg.Scope().Lookup(newName) != nil {
+			return nil, fmt.Errorf("%s is already declared in package %s", newName, u.path)
+		}
+	} else if recv := memberOf(u, obj); recv != nil {
+		if sel, _, _ := types.LookupFieldOrMethod(recv, true, u.pkg, newName); sel != nil {
+			return nil, fmt.Errorf("%s already has a field or method %s", recv, newName)
+		}
+	}
+
+	refs := m.refs(obj)
+	// An embedded type is also the name of its field.
+	if _, isType := obj.(*types.TypeName); isType {
+		for _, unit := range m.allUnits() {
+			for id, o := range unit.info.Uses {
+				if v, ok := o.(*types.Var); ok && v.Embedded() && v.Name() == old && embeds(v, obj) && !slices.Contains(refs, id) {
+					refs = append(refs, id)
+				}
+			}
+		}
+	}
+	var edits []sourceEdit
+	for _, id := range refs {
+		file := m.fset.Position(id.Pos()).Filename
+		if !token.IsExported(newName) && m.unitOf(file) != obj.Pkg().Path() {
+			return nil, fmt.Errorf("%s is used outside package %s (%s), so it must stay exported", old, obj.Pkg().Path(), m.where(id.Pos()))
+		}
+		edits = append(edits, sourceEdit{file: file, from: m.offset(id.Pos()), to: m.offset(id.End()), text: newName})
+	}
+	changes, err := m.apply(edits)
+	if err != nil {
+		return nil, err
+	}
+	res := &astEditResult{summary: fmt.Sprintf("renamed %s to %s: %d references", old, newName, len(refs)), changes: changes}
+	if fn, ok := obj.(*types.Func); ok && fn.Type().(*types.Signature).Recv() != nil {
+		res.manual = append(res.manual, "interfaces declaring "+old+", and other types implementing them, keep the old method name")
+	}
+	return res, nil
+}
+
+// memberOf returns the type declaring field or method obj.
+func memberOf(u *goUnit, obj types.Object) types.Type {
+	if fn, ok := obj.(*types.Func); ok {
+		if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+			return recv.Type()
+		}
+	}
+	for _, name := range u.pkg.Scope().Names() {
+		tn, ok := u.pkg.Scope().Lookup(name).(*types.TypeName)
+		if !ok {
+			continue
+		}
+		if st, ok := tn.Type().Underlying().(*types.Struct); ok {
+			for i := 0; i < st.NumFields(); i++ {
+				if st.Field(i) == obj {
+					return tn.Type()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// embeds reports whether embedded field v holds the type declared by obj.
+func embeds(v *types.Var, obj types.Object) bool {
+	t := v.Type()
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	named, ok := types.Unalias(t).(*types.Named)
+	return ok && same(named.Obj(), obj)
+}
+
+// unitOf returns the package path of the module file.
+func (m *goModule) unitOf(file string) string {
+	for _, u := range m.allUnits() {
+		for _, f := range u.files {
+			if m.fset.Position(f.Pos()).Filename == file {
+				return strings.TrimSuffix(u.path, "_test")
+			}
+		}
+	}
+	return ""
+}
+
+// paramGroup is one field of a parameter list: names sharing a type.
+type paramGroup struct {
+	names []string
+	typ   string
+}
+
+func (m *goModule) paramGroups(list *ast.FieldList) []paramGroup {
+	var groups []paramGroup
+	for _, f := range list.List {
+		file := m.fset.Position(f.Pos()).Filename
+		g := paramGroup{typ: string(m.src[file][m.offset(f.Type.Pos()):m.offset(f.Type.End())])}
+		for _, n := range f.Names {
+			g.names = append(g.names, n.Name)
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+func renderParamGroups(groups []paramGroup) string {
+	parts := make([]string, 0, len(groups))
+	for _, g := range groups {
+		if len(g.names) == 0 {
+			parts = append(parts, g.typ)
+			continue
+		}
+		parts = append(parts, strings.Join(g.names, ", ")+" "+g.typ)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// calls returns the calls of fn in the module, and the places it is used
+// other than by calling it.
+func (m *goModule) calls(fn types.Object) ([]*ast.CallExpr, []string) {
+	called := map[token.Pos]bool{}
+	var calls []*ast.CallExpr
+	for _, u := range m.allUnits() {
+		for _, f := range u.files {
+			ast.Inspect(f, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				fun := ast.Unparen(call.Fun)
+				switch x := fun.(type) {
+				case *ast.IndexExpr:
+					fun = x.X
+				case *ast.IndexListExpr:
+					fun = x.X
+				}
+				var id *ast.Ident
+				switch x := fun.(type) {
+				case *ast.Ident:
+					id = x
+				case *ast.SelectorExpr:
+					id = x.Sel
+				}
+				if id != nil && same(u.info.Uses[id], fn) && !called[id.Pos()] {
+					called[id.Pos()] = true
+					calls = append(calls, call)
+				}
+				return true
+			})
+		}
+	}
+	var other []string
+	for _, id := range m.refs(fn) {
+		if !called[id.Pos()] && id.Pos() != fn.Pos() {
+			other = append(other, m.where(id.Pos())+": "+fn.Name()+" used as a value")
+		}
+	}
+	return calls, other
+}
+
+func (m *goModule) funcDecl(obj types.Object) (*ast.FuncDecl, error) {
+	if _, ok := obj.(*types.Func); !ok {
+		return nil, fmt.Errorf("%s is not a function or method", obj.Name())
+	}
+	n, _ := m.decl(obj)
+	decl, ok := n.(*ast.FuncDecl)
+	if !ok {
+		return nil, fmt.Errorf("no declaration found for %s", obj.Name())
+	}
+	return decl, nil
+}
+
+func (m *goModule) addParam(obj types.Object, name, typ, value string, index int) (*astEditResult, error) {
+	decl, err := m.funcDecl(obj)
+	if err != nil {
+		return nil, err
+	}
+	if typ == "" {
+		return nil, errors.New("add_param needs type")
+	}
+	groups := m.paramGroups(decl.Type.Params)
+	count, named := 0, false
+	for _, g := range groups {
+		count += max(1, len(g.names))
+		named = named || len(g.names) > 0
+	}
+	if index < 0 || index > count {
+		index = count
+	}
+	switch {
+	case named && name == "":
+		return nil, errors.New("the other parameters are named, so add_param needs name")
+	case !named && count > 0 && name != "":
+		return nil, errors.New("the other parameters are unnamed; leave out name")
+	case count > 0 && index == count && strings.HasPrefix(groups[len(groups)-1].typ, "..."):
+		return nil, errors.New("a parameter cannot follow the variadic one")
+	}
+
+	// Insert at index, joining or splitting a group of names as needed.
+	var out []paramGroup
+	pos, inserted := 0, false
+	add := paramGroup{typ: typ}
+	if name != "" {
+		add.names = []string{name}
+	}
+	for _, g := range groups {
+		n := max(1, len(g.names))
+		switch {
+		case !inserted && index == pos:
+			out = append(out, add, g)
+			inserted = true
+		case !inserted && index < pos+n:
+			k := index - pos
+			out = append(out, paramGroup{names: g.names[:k], typ: g.typ}, add, paramGroup{names: g.names[k:], typ: g.typ})
+			inserted = true
+		default:
+			out = append(out, g)
+		}
+		pos += n
+	}
+	if !inserted {
+		out = append(out, add)
+	}
+	file := m.fset.Position(decl.Pos()).Filename
+	edits := []sourceEdit{{file: file, from: m.offset(decl.Type.Params.Opening) + 1, to: m.offset(decl.Type.Params.Closing), text: renderParamGroups(out)}}
+
+	calls, manual := m.calls(obj)
+	if len(calls) > 0 && value == "" {
+		return nil, fmt.Errorf("%s has %d callers; add_param needs value to pass at them", obj.Name(), len(calls))
+	}
+	updated := 0
+	for _, call := range calls {
+		cf := m.fset.Position(call.Pos()).Filename
+		switch {
+		case len(call.Args) == 1 && count > 1:
+			manual = append(manual, m.where(call.Pos())+": call passes a multi-value expression")
+		case call.Ellipsis.IsValid() && index >= len(call.Args):
+			manual = append(manual, m.where(call.Pos())+": call spreads a slice into the variadic parameter")
+		case index < len(call.Args):
+			at := m.offset(call.Args[index].Pos())
+			edits = append(edits, sourceEdit{file: cf, from: at, to: at, text: value + ", "})
+			updated++
+		case len(call.Args) == 0:
+			at := m.offset(call.Rparen)
+			edits = append(edits, sourceEdit{file: cf, from: at, to: at, text: value})
+			updated++
+		default:
+			at := m.offset(call.Args[len(call.Args)-1].End())
+			edits = append(edits, sourceEdit{file: cf, from: at, to: at, text: ", " + value})
+			updated++
+		}
+	}
+	changes, err := m.apply(edits)
+	if err != nil {
+		return nil, err
+	}
+	return &astEditResult{summary: fmt.Sprintf("added parameter %d to %s and updated %d calls", index, obj.Name(), updated), changes: changes, manual: append(manual, interfaceNote(obj)...)}, nil
+}
+
+func (m *goModule) removeParam(obj types.Object, index int) (*astEditResult, error) {
+	decl, err := m.funcDecl(obj)
+	if err != nil {
+		return nil, err
+	}
+	groups := m.paramGroups(decl.Type.Params)
+	count := 0
+	for _, g := range groups {
+		count += max(1, len(g.names))
+	}
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("%s has no parameter %d", obj.Name(), index)
+	}
+	var out []paramGroup
+	pos := 0
+	for gi, g := range groups {
+		n := max(1, len(g.names))
+		if index < pos || index >= pos+n {
+			out = append(out, g)
+			pos += n
+			continue
+		}
+		if len(g.names) > 0 {
+			k := index - pos
+			param := decl.Type.Params.List[gi].Names[k]
+			for _, id := range m.refs(m.defOf(param)) {
+				if id != param {
+					return nil, fmt.Errorf("parameter %s is still used at %s", param.Name, m.where(id.Pos()))
+				}
+			}
+			if rest := slices.Delete(slices.Clone(g.names), k, k+1); len(rest) > 0 {
+				out = append(out, paramGroup{names: rest, typ: g.typ})
+			}
+		}
+		pos += n
+	}
+	file := m.fset.Position(decl.Pos()).Filename
+	edits := []sourceEdit{{file: file, from: m.offset(decl.Type.Params.Opening) + 1, to: m.offset(decl.Type.Params.Closing), text: renderParamGroups(out)}}
+
+	calls, manual := m.calls(obj)
+	updated := 0
+	for _, call := range calls {
+		cf := m.fset.Position(call.Pos()).Filename
+		switch {
+		case len(call.Args) == 1 && count > 1:
+			manual = append(manual, m.where(call.Pos())+": call passes a multi-value expression")
+		case index >= len(call.Args):
+			// An empty variadic argument.
+		case len(call.Args) == 1:
+			edits = append(edits, sourceEdit{file: cf, from: m.offset(call.Args[0].Pos()), to: m.offset(call.Args[0].End())})
+			updated++
+		case index < len(call.Args)-1:
+			edits = append(edits, sourceEdit{file: cf, from: m.offset(call.Args[index].Pos()), to: m.offset(call.Args[index+1].Pos())})
+			updated++
+		default:
+			edits = append(edits, sourceEdit{file: cf, from: m.offset(call.Args[index-1].End()), to: m.offset(call.Args[index].End())})
+			updated++
+		}
+	}
+	changes, err := m.apply(edits)
+	if err != nil {
+		return nil, err
+	}
+	return &astEditResult{summary: fmt.Sprintf("removed parameter %d from %s and updated %d calls", index, obj.Name(), updated), changes: changes, manual: append(manual, interfaceNote(obj)...)}, nil
+}
+
+// defOf returns the object an identifier declares.
+func (m *goModule) defOf(id *ast.Ident) types.Object {
+	for _, u := range m.allUnits() {
+		if obj := u.info.Defs[id]; obj != nil {
+			return obj
+		}
+	}
+	return nil
+}
+
+func interfaceNote(obj types.Object) []string {
+	if fn, ok := obj.(*types.Func); ok && fn.Type().(*types.Signature).Recv() != nil {
+		return []string{"interfaces declaring " + obj.Name() + " keep the old signature"}
+	}
+	return nil
+}
+
+func (m *goModule) addField(u *goUnit, obj types.Object, name, typ, tag string) (*astEditResult, error) {
+	tn, ok := obj.(*types.TypeName)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a type", obj.Name())
+	}
+	n, _ := m.decl(obj)
+	spec, ok := n.(*ast.TypeSpec)
+	if !ok {
+		return nil, fmt.Errorf("no declaration found for %s", obj.Name())
+	}
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		return nil, fmt.Errorf("%s is not declared as a struct", obj.Name())
+	}
+	switch {
+	case !token.IsIdentifier(name):
+		return nil, fmt.Errorf("invalid field name %q", name)
+	case typ == "":
+		return nil, errors.New("add_field needs type")
+	}
+	if sel, _, _ := types.LookupFieldOrMethod(tn.Type(), true, u.pkg, name); sel != nil {
+		return nil, fmt.Errorf("%s already has a field or method %s", obj.Name(), name)
+	}
+	line := name + " " + typ
+	if tag != "" {
+		if strings.Contains(tag, "`") {
+			line += " " + strconv.Quote(tag)
+		} else {
+			line += " `" + tag + "`"
+		}
+	}
+	file := m.fset.Position(st.Pos()).Filename
+	src := m.src[file]
+	at := m.offset(st.Fields.Closing)
+	start := at
+	for start > 0 && (src[start-1] == ' ' || src[start-1] == '\t') {
+		start--
+	}
+	edit := sourceEdit{file: file, from: at, to: at, text: "\n" + line + "\n"}
+	if start > 0 && src[start-1] == '\n' {
+		edit = sourceEdit{file: file, from: start, to: start, text: line + "\n"}
+	}
+	changes, err := m.apply([]sourceEdit{edit})
+	if err != nil {
+		return nil, err
+	}
+
+	// Unkeyed literals stop compiling; list them rather than guess values.
+	var manual []string
+	seen := map[token.Pos]bool{}
+	for _, unit := range m.allUnits() {
+		for lit, tv := range unit.info.Types {
+			cl, ok := lit.(*ast.CompositeLit)
+			if !ok || len(cl.Elts) == 0 || seen[cl.Pos()] {
+				continue
+			}
+			if _, keyed := cl.Elts[0].(*ast.KeyValueExpr); keyed {
+				continue
+			}
+			if named, ok := types.Unalias(tv.Type).(*types.Named); ok && same(named.Obj(), obj) {
+				seen[cl.Pos()] = true
+				manual = append(manual, m.where(cl.Pos())+": unkeyed "+obj.Name()+" literal needs a value for "+name)
+			}
+		}
+	}
+	sort.Strings(manual)
+	return &astEditResult{summary: fmt.Sprintf("added field %s to %s", name, obj.Name()), changes: changes, manual: manual}, nil
+}
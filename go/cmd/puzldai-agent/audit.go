@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAuditListed bounds the undeclared changes printed at the end; the
+// -outcome-out JSON has them all.
+const maxAuditListed = 20
+
+// workspaceAudit catches changes the agent made without declaring them.
+// Before the first tool call that can change files, it records the content
+// hash of every file in the workspace, leaving out .git and hidden paths.
+// At the end it reports the files that changed although no file tool wrote
+// them: side effects of bash commands, generators, and the like.
+type workspaceAudit struct {
+	roots  []string
+	ignore *ignoreRules
+
+	once   sync.Once
+	before map[string]auditEntry
+	err    error
+
+	mu       sync.Mutex
+	declared map[string]bool
+}
+
+type auditEntry struct {
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+	hash    string
+}
+
+// auditChange is an undeclared change, in the -outcome-out JSON.
+type auditChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"` // added, modified, or deleted
+}
+
+func newWorkspaceAudit(roots []string, ignore *ignoreRules) *workspaceAudit {
+	return &workspaceAudit{roots: roots, ignore: ignore, declared: map[string]bool{}}
+}
+
+// apply takes the snapshot before the first call of a tool that is not a
+// read-only file tool. Calls wait for the snapshot, so none can change
+// files before it is taken.
+func (a *workspaceAudit) apply(tools []toolDef) []toolDef {
+	for i := range tools {
+		if spec, ok := pathArgs[tools[i].name]; ok && !spec.write {
+			continue
+		}
+		next := tools[i].fn
+		tools[i].fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			a.once.Do(func() { a.before, a.err = a.snapshot(ctx) })
+			return next(ctx, cwd, args)
+		}
+	}
+	return tools
+}
+
+// fs wraps the file system the tools write to disk through, so every path
+// they write is declared.
+func (a *workspaceAudit) fs(fsys workspaceFS) workspaceFS {
+	return auditFS{workspaceFS: fsys, audit: a}
+}
+
+type auditFS struct {
+	workspaceFS
+	audit *workspaceAudit
+}
+
+func (f auditFS) WriteFile(ctx context.Context, path string, data []byte) error {
+	f.audit.mu.Lock()
+	f.audit.declared[filepath.Clean(path)] = true
+	f.audit.mu.Unlock()
+	return f.workspaceFS.WriteFile(ctx, path, data)
+}
+
+func (a *workspaceAudit) isDeclared(path string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.declared[path]
+}
+
+// snapshot hashes the files of every root.
+func (a *workspaceAudit) snapshot(ctx context.Context) (map[string]auditEntry, error) {
+	files := map[string]auditEntry{}
+	err := a.walk(ctx, func(path string, info fs.FileInfo) error {
+		hash, err := hashPath(path, info)
+		if err != nil {
+			return nil
+		}
+		files[path] = auditEntry{size: info.Size(), modTime: info.ModTime(), mode: info.Mode(), hash: hash}
+		return nil
+	})
+	return files, err
+}
+
+// walk visits the regular files and symlinks of the roots, leaving out
+// .git and the paths the ignore rules hide.
+func (a *workspaceAudit) walk(ctx context.Context, fn func(path string, info fs.FileInfo) error) error {
+	for _, root := range a.roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if path != root && (d.Name() == ".git" || a.ignore.hidden(path, d.IsDir())) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || !(info.Mode().IsRegular() || info.Mode()&fs.ModeSymlink != 0) {
+				return nil
+			}
+			return fn(path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashPath hashes a file's content, or a symlink's target.
+func hashPath(path string, info fs.FileInfo) (string, error) {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		return sha256Hex([]byte(target)), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// changes compares the workspace with the snapshot and returns what changed
+// outside the declared paths. Files whose size, modification time, and mode
+// are unchanged are not hashed again.
+func (a *workspaceAudit) changes(ctx context.Context) ([]auditChange, error) {
+	if a.before == nil {
+		return nil, a.err
+	}
+	var changed []auditChange
+	seen := map[string]bool{}
+	err := a.walk(ctx, func(path string, info fs.FileInfo) error {
+		seen[path] = true
+		old, existed := a.before[path]
+		if existed && old.size == info.Size() && old.modTime.Equal(info.ModTime()) && old.mode == info.Mode() {
+			return nil
+		}
+		if a.isDeclared(path) {
+			return nil
+		}
+		switch hash, err := hashPath(path, info); {
+		case err != nil:
+		case !existed:
+			changed = append(changed, auditChange{Path: path, Change: "added"})
+		case hash != old.hash || old.mode != info.Mode():
+			changed = append(changed, auditChange{Path: path, Change: "modified"})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for path := range a.before {
+		if !seen[path] && !a.isDeclared(path) {
+			changed = append(changed, auditChange{Path: path, Change: "deleted"})
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Path < changed[j].Path })
+	return changed, nil
+}
+
+// report prints the undeclared changes on stderr, with paths relative to
+// cwd, and returns them for the outcome.
+func (a *workspaceAudit) report(cwd string) []auditChange {
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+	changed, err := a.changes(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "workspace audit failed:", err)
+		return nil
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\nWARNING: %d file(s) changed without a write or edit naming them (bash side effects or changes made outside the agent):\n", len(changed))
+	for i := range changed {
+		changed[i].Path = displayPath(cwd, changed[i].Path)
+		if i < maxAuditListed {
+			fmt.Fprintf(&sb, "  %-8s  %s\n", changed[i].Change, changed[i].Path)
+		}
+	}
+	if len(changed) > maxAuditListed {
+		fmt.Fprintf(&sb, "  ... %d more\n", len(changed)-maxAuditListed)
+	}
+	fmt.Fprint(os.Stderr, sb.String())
+	return changed
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+// keyringService namespaces stored provider keys in the OS keychain (macOS
+// Keychain, Windows Credential Manager, or the Secret Service on Linux).
+const keyringService = "puzldai"
+
+// providerAPIKey returns the key for a provider. The environment wins so CI
+// can inject keys without touching the keychain; a profile's own stored key
+// is preferred over the provider-wide one.
+func providerAPIKey(s providerSettings) string {
+	if key := os.Getenv(s.apiKeyEnv); key != "" {
+		return key
+	}
+	accounts := []string{s.name}
+	if s.profile != "" {
+		accounts = append([]string{keyringAccount(s.name, s.profile)}, accounts...)
+	}
+	for _, account := range accounts {
+		if key, err := keyring.Get(keyringService, account); err == nil {
+			return key
+		}
+	}
+	return ""
+}
+
+// keyringAccount names the keychain entry for a provider, optionally scoped
+// to a profile (e.g. "anthropic@work").
+func keyringAccount(provider, profile string) string {
+	if profile == "" {
+		return provider
+	}
+	return provider + "@" + profile
+}
+
+const authUsage = "usage: puzldai-agent auth login|status|logout [-provider name] [-profile name]\n       puzldai-agent auth session-key [-print]"
+
+func runAuth(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, authUsage)
+		return exitUsage
+	}
+	if args[0] == "session-key" {
+		return runSessionKey(args[1:])
+	}
+	fs := newFlagSet("auth " + args[0])
+	providerFlag := fs.String("provider", "anthropic", "Provider whose key to manage: "+providerNames())
+	profileFlag := fs.String("profile", "", "Store the key for this config profile only (default: PUZLDAI_PROFILE)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	*profileFlag = firstNonEmpty(*profileFlag, os.Getenv("PUZLDAI_PROFILE"))
+	if _, ok := providerPresets[*providerFlag]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown provider %q (available: %s)\n", *providerFlag, providerNames())
+		return exitUsage
+	}
+
+	account := keyringAccount(*providerFlag, *profileFlag)
+
+	var err error
+	switch args[0] {
+	case "login":
+		err = authLogin(*providerFlag, account)
+	case "status":
+		// The config may load .env files that set keys.
+		if wd, err := os.Getwd(); err == nil {
+			if _, err := loadConfig(wd, ""); err != nil {
+				fmt.Fprintln(os.Stderr, "auth status:", err)
+			}
+		}
+		authStatus(*profileFlag)
+	case "logout":
+		err = keyring.Delete(keyringService, account)
+		if errors.Is(err, keyring.ErrNotFound) {
+			err = fmt.Errorf("no stored key for %s", account)
+		} else if err == nil {
+			fmt.Fprintf(os.Stderr, "removed stored key for %s\n", account)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, authUsage)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "auth:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// authLogin reads a key without echo from the terminal, or from stdin when it
+// is piped, and stores it in the keychain.
+func authLogin(name, account string) error {
+	var key string
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "API key for %s: ", name)
+		raw, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		key = string(raw)
+	} else {
+		raw, err := io.ReadAll(io.LimitReader(os.Stdin, 64<<10))
+		if err != nil {
+			return err
+		}
+		key = string(raw)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return errors.New("no key entered")
+	}
+	if err := keyring.Set(keyringService, account, key); err != nil {
+		return fmt.Errorf("store key in OS keychain: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "stored key for %s in the OS keychain\n", account)
+	if env := providerPresets[name].apiKeyEnv; os.Getenv(env) != "" {
+		fmt.Fprintf(os.Stderr, "note: %s is set and takes precedence over the stored key\n", env)
+	}
+	return nil
+}
+
+func authStatus(profile string) {
+	names := make([]string, 0, len(providerPresets))
+	for name := range providerPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env := providerPresets[name].apiKeyEnv
+		source := "not configured"
+		_, profileErr := keyring.Get(keyringService, keyringAccount(name, profile))
+		_, err := keyring.Get(keyringService, name)
+		switch {
+		case dotenvVars[env] != "":
+			source = dotenvVars[env] + " (" + env + ")"
+		case os.Getenv(env) != "":
+			source = "environment (" + env + ")"
+		case profile != "" && profileErr == nil:
+			source = "OS keychain (profile " + profile + ")"
+		case err == nil:
+			source = "OS keychain"
+		case !errors.Is(err, keyring.ErrNotFound):
+			source = "keychain unavailable: " + err.Error()
+		}
+		fmt.Printf("%-12s %s\n", name, source)
+	}
+	encryption := "off (no session key)"
+	switch key, err := sessionKey(); {
+	case err != nil:
+		encryption = "error: " + err.Error()
+	case key != nil && os.Getenv(sessionKeyEnv) != "":
+		encryption = "on, key from the environment (" + sessionKeyEnv + ")"
+	case key != nil:
+		encryption = "on, key from the OS keychain"
+	}
+	fmt.Printf("%-12s %s\n", "encryption", encryption)
+}
+
+// runSessionKey generates a key for encrypting run data at rest and stores
+// it in the keychain, or prints it for PUZLDAI_SESSION_KEY.
+func runSessionKey(args []string) int {
+	fs := newFlagSet("auth session-key")
+	printFlag := fs.Bool("print", false, "Print a new key for "+sessionKeyEnv+" instead of storing it in the OS keychain")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: puzldai-agent auth session-key [-print]")
+		return exitUsage
+	}
+	key, err := newSessionKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "auth:", err)
+		return exitError
+	}
+	if *printFlag {
+		fmt.Println(key)
+		return exitOK
+	}
+	// Replacing the key would leave everything sealed with it unreadable.
+	if _, err := keyring.Get(keyringService, sessionKeyAccount); err == nil {
+		fmt.Fprintln(os.Stderr, "auth: a session key is already stored; data encrypted with it cannot be read without it")
+		return exitError
+	}
+	if err := keyring.Set(keyringService, sessionKeyAccount, key); err != nil {
+		fmt.Fprintln(os.Stderr, "auth: store key in OS keychain:", err)
+		return exitError
+	}
+	fmt.Fprintln(os.Stderr, "stored a new session key in the OS keychain; sessions, checkpoints, notes, the response cache, and the schedule history are now encrypted")
+	if os.Getenv(sessionKeyEnv) != "" {
+		fmt.Fprintf(os.Stderr, "note: %s is set and takes precedence over the stored key\n", sessionKeyEnv)
+	}
+	return exitOK
+}
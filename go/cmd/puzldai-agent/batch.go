@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	anthropic "github.com/anthropics/anthropic-sdk-go"
+)
+
+const defaultBatchPoll = 30 * time.Second
+
+// completeBatch submits one turn as a single-request message batch and
+// waits for it. Batches are billed at half the price of direct requests but
+// can take minutes to hours, so this suits unattended sweeps, not
+// interactive runs. Cancelling ctx cancels the batch.
+func (p *anthropicProvider) completeBatch(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+	const customID = "turn"
+	batch, err := p.client.Messages.Batches.New(ctx, anthropic.MessageBatchNewParams{
+		Requests: []anthropic.MessageBatchNewParamsRequest{{
+			CustomID: customID,
+			Params: anthropic.MessageBatchNewParamsRequestParams{
+				Model:       params.Model,
+				MaxTokens:   params.MaxTokens,
+				Messages:    params.Messages,
+				Temperature: params.Temperature,
+				TopP:        params.TopP,
+			},
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("submit batch: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "batch %s submitted; polling every %s\n", batch.ID, p.batchPoll)
+
+	for batch.ProcessingStatus != anthropic.MessageBatchProcessingStatusEnded {
+		select {
+		case <-ctx.Done():
+			cancelCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			p.client.Messages.Batches.Cancel(cancelCtx, batch.ID)
+			cancel()
+			return nil, ctx.Err()
+		case <-time.After(p.batchPoll):
+		}
+		if batch, err = p.client.Messages.Batches.Get(ctx, batch.ID); err != nil {
+			return nil, fmt.Errorf("poll batch: %w", err)
+		}
+	}
+
+	stream := p.client.Messages.Batches.ResultsStreaming(ctx, batch.ID)
+	defer stream.Close()
+	for stream.Next() {
+		res := stream.Current()
+		if res.CustomID != customID {
+			continue
+		}
+		switch res.Result.Type {
+		case "succeeded":
+			msg := res.Result.Message
+			return &msg, nil
+		case "errored":
+			return nil, fmt.Errorf("batch %s: %s: %s", batch.ID, res.Result.Error.Error.Type, res.Result.Error.Error.Message)
+		default:
+			return nil, fmt.Errorf("batch %s: request %s", batch.ID, res.Result.Type)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, fmt.Errorf("batch %s results: %w", batch.ID, err)
+	}
+	return nil, errors.New("batch " + batch.ID + " returned no result")
+}
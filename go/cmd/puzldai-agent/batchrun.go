@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// batchFile is a batch run's task list: [[task]] entries in TOML.
+type batchFile struct {
+	Tasks []batchTask `toml:"task"`
+}
+
+type batchTask struct {
+	Name string `toml:"name"`
+	// Repo is a directory in a git repository, relative to the task file;
+	// the default is the file's directory.
+	Repo string `toml:"repo"`
+	Task string `toml:"task"`
+	// Args are agent flags for this task, after the batch's own.
+	Args []string `toml:"args"`
+}
+
+var remoteURLRe = regexp.MustCompile(`^(?:[a-z+]+://)?(?:[^@/]+@)?([^/:]+)(?::\d+)?[:/](.+?)(?:\.git)?/?$`)
+
+const batchUsage = "usage: puzldai-agent batch [-parallel n] [-branch-prefix p] [-push] [-report file] [-report-webhook url] [-email addrs] <tasks.toml> [-- agent flags]"
+
+// runBatch implements the batch subcommand: each task of the file runs in
+// its own worktree of its repository's HEAD, its changes are committed to a
+// new branch, and a digest of all of them is written and delivered.
+func runBatch(args []string) int {
+	fs := newFlagSet("batch")
+	parallelFlag := fs.Int("parallel", 1, "Tasks to run at a time")
+	prefixFlag := fs.String("branch-prefix", "", "Prefix of the tasks' branches (default: puzldai/batch-<time>/)")
+	pushFlag := fs.Bool("push", false, "Push the branches to origin, and link to opening a pull or merge request in the report")
+	reportFlag := fs.String("report", "", "Write the report to this file, as HTML for .html and markdown otherwise (default: markdown on stdout)")
+	webhookFlag := fs.String("report-webhook", "", "POST the report as JSON to this URL (default: config [report] webhook_url)")
+	emailFlag := fs.String("email", "", "Comma-separated addresses to email the report to (default: config [report] email_to)")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || *parallelFlag < 1 {
+		fmt.Fprintln(os.Stderr, batchUsage)
+		return exitUsage
+	}
+	file, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "batch:", err)
+		return exitError
+	}
+	tasks, err := loadBatchFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "batch:", err)
+		return exitUsage
+	}
+	cfg, err := loadConfig(filepath.Dir(file), "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "batch: failed to load config:", err)
+		return exitError
+	}
+	if err := cfg.Commit.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "batch:", err)
+		return exitError
+	}
+	webhook := firstNonEmpty(*webhookFlag, cfg.Report.WebhookURL)
+	emailTo := cfg.Report.EmailTo
+	if *emailFlag != "" {
+		emailTo = splitList(*emailFlag)
+	}
+	policy, err := loadOrgPolicy()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "batch:", err)
+		return exitError
+	}
+	if err := policy.checkDigest(cfg.Report, webhook, emailTo); err != nil {
+		fmt.Fprintln(os.Stderr, "batch:", err)
+		return exitPolicy
+	}
+
+	started := time.Now()
+	prefix := *prefixFlag
+	if prefix == "" {
+		prefix = "puzldai/batch-" + started.Format("20060102-150405") + "/"
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	b := &batchRun{dir: filepath.Dir(file), prefix: prefix, push: *pushFlag, agentArgs: agentArgs, commit: &cfg.Commit, workspaces: map[string]*childWorkspace{}}
+	d := &digest{Started: started, Tasks: make([]digestTask, len(tasks))}
+	slots := make(chan struct{}, *parallelFlag)
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			d.Tasks[i] = b.run(ctx, t)
+			fmt.Fprintf(os.Stderr, "%s: %s\n", t.Name, d.Tasks[i].Status)
+		}()
+	}
+	wg.Wait()
+	d.Finished = time.Now()
+	b.cleanup()
+
+	code := exitOK
+	if err := writeDigest(*reportFlag, d); err != nil {
+		fmt.Fprintln(os.Stderr, "batch: report:", err)
+		code = exitError
+	}
+	if err := deliverDigest(cfg.Report, webhook, emailTo, d); err != nil {
+		fmt.Fprintln(os.Stderr, "batch:", err)
+		code = exitError
+	}
+	switch {
+	case ctx.Err() != nil:
+		return exitCancelled
+	case slices.ContainsFunc(d.Tasks, func(t digestTask) bool { return t.Status != outcomeSuccess }):
+		return exitError
+	}
+	return code
+}
+
+func loadBatchFile(path string) ([]batchTask, error) {
+	var f batchFile
+	if _, err := toml.DecodeFile(path, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Tasks) == 0 {
+		return nil, fmt.Errorf("%s: no [[task]] entries", path)
+	}
+	seen := map[string]bool{}
+	for i, t := range f.Tasks {
+		switch {
+		case t.Name == "" || branchUnsafeRe.MatchString(t.Name) || strings.HasPrefix(t.Name, "."):
+			return nil, fmt.Errorf("%s: task %d: name must be set and use only letters, digits, '.', '_', and '-'", path, i+1)
+		case seen[t.Name]:
+			return nil, fmt.Errorf("%s: task %q appears twice", path, t.Name)
+		case strings.TrimSpace(t.Task) == "":
+			return nil, fmt.Errorf("%s: task %q has no task text", path, t.Name)
+		}
+		seen[t.Name] = true
+	}
+	return f.Tasks, nil
+}
+
+// batchRun holds what the tasks of a batch share.
+type batchRun struct {
+	// dir is where the tasks' repo paths are relative to.
+	dir       string
+	prefix    string
+	push      bool
+	agentArgs []string
+	commit    *commitConfig
+	// env, when set, is the whole environment of the agent runs.
+	env []string
+
+	// mu guards workspaces and serializes git commands on the shared
+	// repositories; out serializes the tasks' prefixed stderr.
+	mu         sync.Mutex
+	out        sync.Mutex
+	workspaces map[string]*childWorkspace
+	children   []*childRun
+}
+
+// run runs one task and describes its result. Failures to set the task up
+// or to record its changes become the task's status and summary.
+func (b *batchRun) run(ctx context.Context, t batchTask) digestTask {
+	start := time.Now()
+	r := digestTask{Name: t.Name, Repo: t.Repo, Files: []digestFile{}}
+	fail := func(err error) digestTask {
+		r.Status, r.Summary = outcomeError, err.Error()
+		if ctx.Err() != nil {
+			r.Status = outcomeCancelled
+		}
+		r.Duration = time.Since(start).Seconds()
+		return r
+	}
+	dir := filepath.Join(b.dir, t.Repo)
+	ws, head, c, err := b.setUp(ctx, dir, t.Name)
+	if err != nil {
+		return fail(err)
+	}
+	r.Repo = filepath.Base(ws.root)
+	if ws.rel != "." {
+		r.Repo += "/" + filepath.ToSlash(ws.rel)
+	}
+	if err := ws.runAgent(ctx, c, t.Name, t.Task, append(slices.Clone(b.agentArgs), t.Args...), &b.out); err != nil {
+		return fail(err)
+	}
+	r.Status = firstNonEmpty(c.outcome.Status, outcomeError)
+	r.Summary = firstNonEmpty(c.outcome.Summary, strings.TrimSpace(c.answer))
+	if r.Summary == "" && c.exitCode != 0 {
+		r.Summary = fmt.Sprintf("The agent exited with code %d before reporting an outcome.", c.exitCode)
+	}
+	r.CostUSD = c.outcome.CostUSD
+	if err := b.record(ctx, ws, c, head, &r); err != nil {
+		return fail(err)
+	}
+	secrets := secretValues()
+	r.Summary, r.Patch = redactSecrets(r.Summary, secrets), redactSecrets(r.Patch, secrets)
+	r.Duration = time.Since(start).Seconds()
+	return r
+}
+
+// setUp checks out HEAD of the repository holding dir in a new worktree.
+// The repository is snapshotted once, for all of its tasks.
+func (b *batchRun) setUp(ctx context.Context, dir, name string) (*childWorkspace, string, *childRun, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ws := b.workspaces[dir]
+	if ws == nil {
+		var err error
+		if ws, err = newChildWorkspace(ctx, dir, "batch"); err != nil {
+			return nil, "", nil, err
+		}
+		b.workspaces[dir] = ws
+	}
+	head, err := runGit(ctx, ws.root, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	head = strings.TrimSpace(head)
+	if _, err := runGit(ctx, ws.root, "rev-parse", "--verify", "--quiet", "refs/heads/"+b.prefix+name); err == nil {
+		return nil, "", nil, fmt.Errorf("branch %s already exists; pass -branch-prefix", b.prefix+name)
+	}
+	// The branch starts from HEAD: uncommitted changes stay out of it.
+	c, err := ws.newChild(ctx, len(b.children)+1, name, name, "", head)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	// Runs are booked to the repository rather than to their worktree.
+	c.env = b.env
+	if c.env == nil {
+		c.env = os.Environ()
+	}
+	if !slices.ContainsFunc(c.env, func(kv string) bool { return strings.HasPrefix(kv, projectEnv+"=") }) {
+		c.env = append(slices.Clone(c.env), projectEnv+"="+projectName(ws.root))
+	}
+	b.children = append(b.children, c)
+	return ws, head, c, nil
+}
+
+// record commits the task's changes to its branch, pushing it with -push,
+// and adds them to the result.
+func (b *batchRun) record(ctx context.Context, ws *childWorkspace, c *childRun, head string, r *digestTask) error {
+	c.collect(ctx, head, "")
+	if c.patch == "" {
+		return nil
+	}
+	r.Patch = c.patch
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	branch := b.prefix + r.Name
+	message := b.commit.message(fmt.Sprintf("puzldai batch: %s\n\n%s", r.Name, firstLine(r.Summary)), "")
+	if _, err := runGit(ctx, c.dir, "checkout", "-q", "-b", branch); err != nil {
+		return err
+	}
+	if _, err := gitWithEnv(ctx, c.dir, b.commit.env(), "commit", "-q", "-m", message); err != nil {
+		return err
+	}
+	r.Branch = branch
+	files, err := ciChangedFiles(ctx, c.dir, head, "HEAD")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		r.Files = append(r.Files, digestFile{Path: f.path, Change: f.change, Additions: f.additions, Deletions: f.deletions})
+	}
+	if !b.push {
+		return nil
+	}
+	if _, err := runGit(ctx, c.dir, "push", "-q", "origin", branch); err != nil {
+		// The changes are safe on the local branch; the report says so.
+		r.Summary = strings.TrimSpace(r.Summary + "\n\nThe branch was not pushed: " + err.Error())
+		return nil
+	}
+	remote, _ := runGit(ctx, ws.root, "remote", "get-url", "origin")
+	base, _ := runGit(ctx, ws.root, "symbolic-ref", "-q", "--short", "HEAD")
+	r.Link = reviewLink(strings.TrimSpace(remote), strings.TrimSpace(base), branch)
+	return nil
+}
+
+// cleanup removes the tasks' worktrees; their branches stay.
+func (b *batchRun) cleanup() {
+	for _, ws := range b.workspaces {
+		ws.removeWorktrees(slices.DeleteFunc(slices.Clone(b.children), func(c *childRun) bool { return !strings.HasPrefix(c.dir, ws.work) }))
+		os.RemoveAll(ws.work)
+	}
+}
+
+// reviewLink is the page that opens a pull request (GitHub) or merge
+// request (GitLab) for branch, or "" for other remotes.
+func reviewLink(remote, base, branch string) string {
+	m := remoteURLRe.FindStringSubmatch(remote)
+	if m == nil {
+		return ""
+	}
+	project := "https://" + m[1] + "/" + m[2]
+	ref := func(name string) string { return strings.ReplaceAll(url.PathEscape(name), "%2F", "/") }
+	switch {
+	case strings.Contains(m[1], "github"):
+		if base != "" {
+			return project + "/compare/" + ref(base) + "..." + ref(branch) + "?expand=1"
+		}
+		return project + "/compare/" + ref(branch) + "?expand=1"
+	case strings.Contains(m[1], "gitlab"):
+		return project + "/-/merge_requests/new?" + url.Values{"merge_request[source_branch]": {branch}}.Encode()
+	}
+	return ""
+}
+
+// writeDigest writes the report to path, or markdown to stdout when path
+// is empty.
+func writeDigest(path string, d *digest) error {
+	if path == "" {
+		fmt.Fprint(answerOut, d.markdown())
+		return nil
+	}
+	text := d.markdown()
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".html" || ext == ".htm" {
+		text = d.html()
+	}
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "report written to %s\n", path)
+	return nil
+}
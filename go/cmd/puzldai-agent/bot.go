@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBotTrigger = "/puzld"
+	botAPITimeout     = 30 * time.Second
+	maxWebhookBody    = 5 << 20
+	// maxReplyPatch bounds the diff in a reply; GitHub comments hold at
+	// most 65536 characters.
+	maxReplyPatch = 40_000
+	// gitlabDeveloper is the lowest GitLab access level that may run
+	// commands.
+	gitlabDeveloper = 30
+)
+
+// botEnvSecrets are the bot's own credentials, which agent runs do not
+// inherit: a task comes from a comment, and its run must not be able to
+// reach them.
+var botEnvSecrets = []string{"PUZLDAI_GITHUB_WEBHOOK_SECRET", "PUZLDAI_GITLAB_WEBHOOK_TOKEN", "GITHUB_TOKEN", "GITLAB_TOKEN"}
+
+const botHelp = "Commands:\n\n" +
+	"- `%[1]s fix [notes]`: fix what this issue or request asks for, or its review feedback\n" +
+	"- `%[1]s <task>`: run the task on this issue's default branch, or on the request's head\n" +
+	"- `%[1]s help`: show this list\n\n" +
+	"Changes are not pushed; the reply holds the patch."
+
+// commentBot answers commands in comments on GitHub issues and pull
+// requests and GitLab issues and merge requests. Each command runs the
+// agent in a fresh shallow checkout of the commented ref, and the result
+// is posted as a reply.
+type commentBot struct {
+	server  *server
+	trigger string
+	client  *http.Client
+	mu      sync.Mutex // serializes the runs' prefixed stderr
+
+	githubSecret, githubToken, githubAPI string
+	gitlabSecret, gitlabToken, gitlabAPI string
+	// secrets are redacted from replies.
+	secrets []string
+}
+
+// botRequest is a command found in a comment, with what its run needs.
+type botRequest struct {
+	repo     string // owner/name or group/project
+	cloneURL string
+	// ref is fetched and checked out: a branch, or a pull or merge
+	// request's head ref.
+	ref string
+	// auth is the Authorization header git sends to the forge.
+	auth string
+
+	kind        string // Issue, Pull request, or Merge request
+	number      int
+	title, body string
+	author      string
+	trustedBody bool
+
+	requester string
+	command   string
+	reply     func(ctx context.Context, body string) error
+}
+
+// newCommentBot returns nil when no webhook secret is set.
+func newCommentBot(s *server, trigger string) (*commentBot, error) {
+	b := &commentBot{
+		server:       s,
+		trigger:      trigger,
+		client:       &http.Client{Timeout: botAPITimeout},
+		githubSecret: os.Getenv("PUZLDAI_GITHUB_WEBHOOK_SECRET"),
+		githubToken:  os.Getenv("GITHUB_TOKEN"),
+		githubAPI:    strings.TrimSuffix(firstNonEmpty(os.Getenv("GITHUB_API_URL"), "https://api.github.com"), "/"),
+		gitlabSecret: os.Getenv("PUZLDAI_GITLAB_WEBHOOK_TOKEN"),
+		gitlabToken:  os.Getenv("GITLAB_TOKEN"),
+		gitlabAPI:    strings.TrimSuffix(os.Getenv("GITLAB_API_URL"), "/"),
+		secrets:      secretValues(),
+	}
+	switch {
+	case b.githubSecret == "" && b.gitlabSecret == "":
+		return nil, nil
+	case b.githubSecret != "" && b.githubToken == "":
+		return nil, errors.New("GITHUB_TOKEN is needed to check out repositories and reply")
+	case b.gitlabSecret != "" && b.gitlabToken == "":
+		return nil, errors.New("GITLAB_TOKEN is needed to check out projects, check permissions, and reply")
+	}
+	return b, nil
+}
+
+// register adds the webhook endpoints of the forges with a secret set.
+func (b *commentBot) register(mux *http.ServeMux) {
+	if b.githubSecret != "" {
+		mux.HandleFunc("POST /webhooks/github", b.github)
+	}
+	if b.gitlabSecret != "" {
+		mux.HandleFunc("POST /webhooks/gitlab", b.gitlab)
+	}
+}
+
+// github handles issue_comment events, which cover comments on issues and
+// on pull requests. Comments by anyone but owners, members, and
+// collaborators are ignored.
+func (b *commentBot) github(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validGitHubSignature(b.githubSecret, payload, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-GitHub-Event") != "issue_comment" {
+		fmt.Fprintln(w, "ignored")
+		return
+	}
+	var ev struct {
+		Action  string `json:"action"`
+		Comment struct {
+			Body              string     `json:"body"`
+			AuthorAssociation string     `json:"author_association"`
+			User              actionUser `json:"user"`
+		} `json:"comment"`
+		Issue      actionsIssue `json:"issue"`
+		Repository struct {
+			FullName      string `json:"full_name"`
+			CloneURL      string `json:"clone_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	command, ok := cutTrigger(ev.Comment.Body, b.trigger)
+	if ev.Action != "created" || !ok {
+		fmt.Fprintln(w, "ignored")
+		return
+	}
+	if !trustedAssociations[ev.Comment.AuthorAssociation] {
+		fmt.Fprintf(os.Stderr, "%s#%d: ignored %s from %s (%s)\n", ev.Repository.FullName, ev.Issue.Number, b.trigger, ev.Comment.User.Login, strings.ToLower(ev.Comment.AuthorAssociation))
+		fmt.Fprintln(w, "ignored")
+		return
+	}
+	req := &botRequest{
+		repo:        ev.Repository.FullName,
+		cloneURL:    ev.Repository.CloneURL,
+		ref:         ev.Repository.DefaultBranch,
+		auth:        "Basic " + base64.StdEncoding.EncodeToString([]byte("x-access-token:"+b.githubToken)),
+		kind:        "Issue",
+		number:      ev.Issue.Number,
+		title:       ev.Issue.Title,
+		body:        ev.Issue.Body,
+		author:      ev.Issue.User.Login,
+		trustedBody: trustedAssociations[ev.Issue.AuthorAssociation],
+		requester:   ev.Comment.User.Login,
+		command:     command,
+	}
+	if ev.Issue.PullRequest != nil {
+		req.kind, req.ref = "Pull request", fmt.Sprintf("pull/%d/head", ev.Issue.Number)
+	}
+	target := fmt.Sprintf("%s/repos/%s/issues/%d/comments", b.githubAPI, ev.Repository.FullName, ev.Issue.Number)
+	req.reply = func(ctx context.Context, body string) error {
+		_, err := callJSON(ctx, b.client, http.MethodPost, target, map[string]string{"Authorization": "Bearer " + b.githubToken, "Accept": "application/vnd.github+json"}, map[string]string{"body": body}, nil)
+		return err
+	}
+	b.server.start(fmt.Sprintf("%s#%d", req.repo, req.number), func(ctx context.Context) error { return b.handle(ctx, req) })
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// gitlab handles note events on issues and merge requests. Only members
+// with at least Developer access may run commands, which takes an API call,
+// so the check happens in the background.
+func (b *commentBot) gitlab(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(b.gitlabSecret)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-Gitlab-Event") != "Note Hook" {
+		fmt.Fprintln(w, "ignored")
+		return
+	}
+	type subject struct {
+		IID         int    `json:"iid"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		AuthorID    int    `json:"author_id"`
+	}
+	var ev struct {
+		User struct {
+			ID       int    `json:"id"`
+			Username string `json:"username"`
+		} `json:"user"`
+		Project struct {
+			ID                int    `json:"id"`
+			PathWithNamespace string `json:"path_with_namespace"`
+			GitHTTPURL        string `json:"git_http_url"`
+			DefaultBranch     string `json:"default_branch"`
+			WebURL            string `json:"web_url"`
+		} `json:"project"`
+		ObjectAttributes struct {
+			Note         string `json:"note"`
+			NoteableType string `json:"noteable_type"`
+		} `json:"object_attributes"`
+		Issue        *subject `json:"issue"`
+		MergeRequest *subject `json:"merge_request"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxWebhookBody)).Decode(&ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	command, ok := cutTrigger(ev.ObjectAttributes.Note, b.trigger)
+	if !ok {
+		fmt.Fprintln(w, "ignored")
+		return
+	}
+	req := &botRequest{
+		repo:      ev.Project.PathWithNamespace,
+		cloneURL:  ev.Project.GitHTTPURL,
+		ref:       ev.Project.DefaultBranch,
+		auth:      "Basic " + base64.StdEncoding.EncodeToString([]byte("oauth2:"+b.gitlabToken)),
+		requester: ev.User.Username,
+		command:   command,
+	}
+	var s *subject
+	var notes string
+	switch {
+	case ev.ObjectAttributes.NoteableType == "Issue" && ev.Issue != nil:
+		s, req.kind, notes = ev.Issue, "Issue", "issues"
+	case ev.ObjectAttributes.NoteableType == "MergeRequest" && ev.MergeRequest != nil:
+		s, req.kind, notes = ev.MergeRequest, "Merge request", "merge_requests"
+		req.ref = fmt.Sprintf("merge-requests/%d/head", ev.MergeRequest.IID)
+	default:
+		fmt.Fprintln(w, "ignored")
+		return
+	}
+	req.number, req.title, req.body, req.author = s.IID, s.Title, s.Description, fmt.Sprintf("user %d", s.AuthorID)
+	api := b.gitlabAPI
+	if api == "" {
+		u, err := url.Parse(ev.Project.WebURL)
+		if err != nil || u.Host == "" {
+			http.Error(w, "cannot tell the GitLab API URL; set GITLAB_API_URL", http.StatusBadRequest)
+			return
+		}
+		api = u.Scheme + "://" + u.Host + "/api/v4"
+	}
+	headers := map[string]string{"PRIVATE-TOKEN": b.gitlabToken}
+	project := fmt.Sprintf("%s/projects/%d", api, ev.Project.ID)
+	req.reply = func(ctx context.Context, body string) error {
+		_, err := callJSON(ctx, b.client, http.MethodPost, fmt.Sprintf("%s/%s/%d/notes", project, notes, s.IID), headers, map[string]string{"body": body}, nil)
+		return err
+	}
+	b.server.start(fmt.Sprintf("%s#%d", req.repo, req.number), func(ctx context.Context) error {
+		allowed, err := b.gitlabDeveloper(ctx, project, ev.User.ID)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			fmt.Fprintf(os.Stderr, "%s#%d: ignored %s from %s (below Developer)\n", req.repo, req.number, b.trigger, ev.User.Username)
+			return nil
+		}
+		req.trustedBody, _ = b.gitlabDeveloper(ctx, project, s.AuthorID)
+		return b.handle(ctx, req)
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// gitlabDeveloper reports whether the user has at least Developer access
+// to the project, directly or through a group.
+func (b *commentBot) gitlabDeveloper(ctx context.Context, project string, user int) (bool, error) {
+	var member struct {
+		AccessLevel int `json:"access_level"`
+	}
+	status, err := callJSON(ctx, b.client, http.MethodGet, fmt.Sprintf("%s/members/all/%d", project, user), map[string]string{"PRIVATE-TOKEN": b.gitlabToken}, nil, &member)
+	if status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return member.AccessLevel >= gitlabDeveloper, nil
+}
+
+// handle runs a command and replies with its result, or with why it could
+// not run.
+func (b *commentBot) handle(ctx context.Context, r *botRequest) error {
+	if r.command == "help" {
+		return r.reply(ctx, fmt.Sprintf(botHelp, b.trigger))
+	}
+	body, err := b.execute(ctx, r)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		body = fmt.Sprintf("@%s `%s` could not run: %v", r.requester, b.trigger+" "+firstLine(r.command), err)
+	}
+	if replyErr := r.reply(ctx, redactSecrets(body, b.secrets)); replyErr != nil {
+		return errors.Join(err, fmt.Errorf("reply: %w", replyErr))
+	}
+	return err
+}
+
+// execute checks out the ref in a temporary directory, runs the agent
+// there, and returns the reply.
+func (b *commentBot) execute(ctx context.Context, r *botRequest) (string, error) {
+	work, err := os.MkdirTemp("", "puzldai-bot-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(work)
+	dir := filepath.Join(work, "checkout")
+	if _, err := runGit(ctx, work, "init", "-q", dir); err != nil {
+		return "", err
+	}
+	// The token goes in the environment, not on the command line or in
+	// the checkout's config.
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	auth := []string{
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=http.extraHeader", n), fmt.Sprintf("GIT_CONFIG_VALUE_%d=Authorization: %s", n, r.auth),
+		"GIT_CONFIG_COUNT=" + strconv.Itoa(n+1), "GIT_TERMINAL_PROMPT=0",
+	}
+	if _, err := gitWithEnv(ctx, dir, auth, "fetch", "-q", "--depth", "1", "--no-tags", r.cloneURL, r.ref); err != nil {
+		return "", fmt.Errorf("fetching %s %s: %w", r.repo, r.ref, err)
+	}
+	if _, err := runGit(ctx, dir, "checkout", "-q", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	head, err := runGit(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	taskFile := filepath.Join(work, "task.md")
+	if err := os.WriteFile(taskFile, []byte(r.task()), 0o600); err != nil {
+		return "", err
+	}
+
+	c := &childRun{label: fmt.Sprintf("%s#%d", r.repo, r.number), dir: dir, cwd: dir, outcomeFile: filepath.Join(work, "outcome.json"), env: botChildEnv()}
+	c.run(ctx, b.server.exe, append(slices.Clone(b.server.agentArgs), "-ci", "-cwd", dir, "-task-file", taskFile, "-outcome-out", c.outcomeFile), &b.mu)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	current, err := snapshotWorktree(ctx, dir, "puzldai bot result")
+	if err != nil {
+		return "", err
+	}
+	patch, err := runGit(ctx, dir, "diff", "--binary", "HEAD", current)
+	if err != nil {
+		return "", err
+	}
+	files, err := ciChangedFiles(ctx, dir, "HEAD", current)
+	if err != nil {
+		return "", err
+	}
+	status := firstNonEmpty(c.outcome.Status, outcomeError)
+	summary := firstNonEmpty(c.outcome.Summary, strings.TrimSpace(c.answer))
+	header := fmt.Sprintf("@%s `%s` on `%s` (`%.12s`)\n\n", r.requester, b.trigger+" "+firstLine(r.command), r.ref, strings.TrimSpace(head))
+	return header + ciSummary(status, summary, files, truncateOutput(patch, maxReplyPatch)), nil
+}
+
+// task is the agent's task for the command: fix works on the issue or
+// request itself, with any notes after it; anything else is the task.
+func (r *botRequest) task() string {
+	kind := strings.ToLower(r.kind)
+	request := r.command
+	if verb, notes, _ := strings.Cut(r.command, " "); verb == "fix" || r.command == "" {
+		request = fmt.Sprintf("Do what %s #%d below asks for", kind, r.number)
+		if kind != "issue" {
+			request += ", or address its review feedback"
+		}
+		request += ". Check the result with the project's build and tests."
+		if notes = strings.TrimSpace(notes); notes != "" {
+			request += "\n\n" + notes
+		}
+	}
+	return request + "\n\nThe request was made in a comment on the following " + kind + ".\n\n" +
+		subjectText(r.kind, r.number, r.title, r.body, r.author, r.trustedBody)
+}
+
+// botChildEnv is the environment of agent runs: the bot's own, without its
+// credentials.
+func botChildEnv() []string {
+	env := os.Environ()
+	return slices.DeleteFunc(env, func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return slices.Contains(botEnvSecrets, name)
+	})
+}
+
+// validGitHubSignature checks the X-Hub-Signature-256 header of a webhook
+// delivery against the shared secret.
+func validGitHubSignature(secret string, payload []byte, header string) bool {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), want)
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	buildGo    = "go"
+	buildBazel = "bazel"
+	// targetsPlaceholder in a verify command is replaced by the affected
+	// targets.
+	targetsPlaceholder = "{targets}"
+	// graphTimeout bounds a go list or bazel query run.
+	graphTimeout = 5 * time.Minute
+	// maxScopeDirs bounds the directories listed in the system prompt.
+	maxScopeDirs = 40
+)
+
+// buildGraph answers which packages or targets a change affects, from the
+// Go module graph or a Bazel workspace.
+type buildGraph struct {
+	root   string
+	system string
+}
+
+// buildTarget is an affected Go package or Bazel target.
+type buildTarget struct {
+	name string // import path or label
+	arg  string // as passed to go test or bazel test
+}
+
+// goPackage is a package from go list; dirs are relative to the graph's
+// root, slash-separated.
+type goPackage struct {
+	path   string
+	dir    string
+	module string
+	// deps are the imports of the package itself, and testDeps those of
+	// its tests.
+	deps     []string
+	testDeps []string
+}
+
+// detectBuildGraph finds the build system at root: Bazel when root is a
+// Bazel workspace, otherwise Go when it holds or is inside Go modules. It
+// returns nil for neither.
+func detectBuildGraph(root string) *buildGraph {
+	for _, name := range []string{"MODULE.bazel", "WORKSPACE", "WORKSPACE.bazel"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			return &buildGraph{root: root, system: buildBazel}
+		}
+	}
+	if inGoModule(context.Background(), diskFS{}, root) || len(goModuleDirs(root)) > 0 {
+		return &buildGraph{root: root, system: buildGo}
+	}
+	return nil
+}
+
+// everything is the pattern for the whole tree.
+func (g *buildGraph) everything() string {
+	if g.system == buildBazel {
+		return "//..."
+	}
+	return "./..."
+}
+
+// slice returns the directories, relative to the root, of the packages or
+// targets matching patterns and of everything they depend on in the tree.
+func (g *buildGraph) slice(ctx context.Context, patterns []string) ([]string, error) {
+	if g.system == buildBazel {
+		out, err := g.bazelQuery(ctx, "package", "deps(set("+quoteQuery(patterns)+"))")
+		if err != nil {
+			return nil, err
+		}
+		var dirs []string
+		for _, pkg := range strings.Fields(out) {
+			if !strings.HasPrefix(pkg, "@") {
+				dirs = append(dirs, firstNonEmpty(strings.TrimPrefix(pkg, "//"), "."))
+			}
+		}
+		if len(dirs) == 0 {
+			return nil, fmt.Errorf("-scope %s matches no targets", strings.Join(patterns, ","))
+		}
+		return dirs, nil
+	}
+
+	pkgs, err := g.goPackages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byPath := map[string]*goPackage{}
+	for _, p := range pkgs {
+		byPath[p.path] = p
+	}
+	seen := map[string]bool{}
+	var visit func(p *goPackage, tests bool)
+	visit = func(p *goPackage, tests bool) {
+		if seen[p.path] && !tests {
+			return
+		}
+		seen[p.path] = true
+		deps := p.deps
+		if tests {
+			deps = append(slices.Clone(deps), p.testDeps...)
+		}
+		for _, d := range deps {
+			if dep, ok := byPath[d]; ok {
+				visit(dep, false)
+			}
+		}
+	}
+	for _, pattern := range patterns {
+		matched := false
+		for _, p := range pkgs {
+			if matchGoPattern(pattern, p) {
+				visit(p, true)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("-scope %s matches no packages", pattern)
+		}
+	}
+	var dirs []string
+	for _, p := range pkgs {
+		if seen[p.path] {
+			dirs = append(dirs, p.dir)
+		}
+	}
+	return dirs, nil
+}
+
+// affected returns the packages or targets that changed files, relative to
+// the root, affect: the ones holding them and everything depending on
+// those, tests included.
+func (g *buildGraph) affected(ctx context.Context, changed []string) ([]buildTarget, error) {
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	if g.system == buildBazel {
+		return g.bazelAffected(ctx, changed)
+	}
+	pkgs, err := g.goPackages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hit := map[string]bool{}
+	for _, file := range changed {
+		dir, name := path.Split(file)
+		dir = firstNonEmpty(strings.TrimSuffix(dir, "/"), ".")
+		for _, p := range pkgs {
+			switch {
+			case name == "go.work",
+				(name == "go.mod" || name == "go.sum") && p.module == dir:
+				hit[p.path] = true
+			case p.dir == dir, isUnder(dir, path.Join(p.dir, "testdata")):
+				// Files under testdata belong to the package above.
+				hit[p.path] = true
+			}
+		}
+	}
+	// Importers of an affected package are affected, and so are the tests
+	// of packages importing one; those importers' importers are not.
+	for grew := true; grew; {
+		grew = false
+		for _, p := range pkgs {
+			if !hit[p.path] && slices.ContainsFunc(p.deps, func(d string) bool { return hit[d] }) {
+				hit[p.path], grew = true, true
+			}
+		}
+	}
+	var out []buildTarget
+	for _, p := range pkgs {
+		if hit[p.path] || slices.ContainsFunc(p.testDeps, func(d string) bool { return hit[d] }) {
+			out = append(out, buildTarget{name: p.path, arg: goDirArg(p.dir)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+func (g *buildGraph) bazelAffected(ctx context.Context, changed []string) ([]buildTarget, error) {
+	var set []string
+	for _, file := range changed {
+		dir, name := path.Split(file)
+		switch {
+		case name == "MODULE.bazel", name == "WORKSPACE", name == "WORKSPACE.bazel", strings.HasSuffix(name, ".bzl"):
+			// Rules and external dependencies can change any target.
+			return []buildTarget{{name: "//...", arg: "//..."}}, nil
+		case name == "BUILD", name == "BUILD.bazel":
+			set = append(set, "//"+strings.TrimSuffix(dir, "/")+":all")
+		default:
+			set = append(set, file)
+		}
+	}
+	out, err := g.bazelQuery(ctx, "label", "kind(rule, rdeps(//..., set("+quoteQuery(set)+")))")
+	if err != nil {
+		return nil, err
+	}
+	var targets []buildTarget
+	for _, label := range strings.Fields(out) {
+		targets = append(targets, buildTarget{name: label, arg: label})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name < targets[j].name })
+	return targets, nil
+}
+
+// bazelQuery runs bazel query with --keep_going, so that files deleted by
+// the change do not fail the query, and accepts its partial results.
+func (g *buildGraph) bazelQuery(ctx context.Context, output, query string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, graphTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "bazel", "query", "--keep_going", "--noshow_progress", "--output="+output, query)
+	cmd.Dir = g.root
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	// Exit code 3: the query succeeded partially.
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 3) {
+		return "", fmt.Errorf("bazel query: %v: %s", err, truncateOutput(strings.TrimSpace(stderr.String()), maxVerifyOutput))
+	}
+	return string(out), nil
+}
+
+// goPackages lists the packages of every Go module under the root, or of
+// the module holding it.
+func (g *buildGraph) goPackages(ctx context.Context) ([]*goPackage, error) {
+	modules := goModuleDirs(g.root)
+	if len(modules) == 0 {
+		modules = []string{"."}
+	}
+	const format = `{{.ImportPath}}{{"\t"}}{{.Dir}}{{"\t"}}{{join .Imports " "}}{{"\t"}}{{join .TestImports " "}} {{join .XTestImports " "}}`
+	var pkgs []*goPackage
+	for _, module := range modules {
+		ctx, cancel := context.WithTimeout(ctx, graphTimeout)
+		cmd := exec.CommandContext(ctx, "go", "list", "-e", "-f", format, "./...")
+		cmd.Dir = filepath.Join(g.root, module)
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("go list in %s: %v: %s", module, err, truncateOutput(strings.TrimSpace(stderr.String()), maxVerifyOutput))
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			// Trailing fields are empty for a package without imports.
+			fields := strings.Split(line, "\t")
+			if len(fields) != 4 {
+				continue
+			}
+			dir, err := filepath.Rel(g.root, fields[1])
+			if err != nil {
+				continue
+			}
+			pkgs = append(pkgs, &goPackage{
+				path:     fields[0],
+				dir:      filepath.ToSlash(dir),
+				module:   module,
+				deps:     strings.Fields(fields[2]),
+				testDeps: strings.Fields(fields[3]),
+			})
+		}
+	}
+	return pkgs, nil
+}
+
+// goModuleDirs lists the directories under root, relative to it, that hold
+// a go.mod, skipping hidden, vendored, and testdata directories.
+func goModuleDirs(root string) []string {
+	var dirs []string
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			name := d.Name()
+			if p != root && (strings.HasPrefix(name, ".") || name == "testdata" || repoMapSkipDirs[name]) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == "go.mod" {
+			rel, _ := filepath.Rel(root, filepath.Dir(p))
+			dirs = append(dirs, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return dirs
+}
+
+// matchGoPattern matches a -scope pattern against a package: ./dir and
+// ./dir/... by directory from the root, others by import path, where a
+// trailing /... also matches everything below.
+func matchGoPattern(pattern string, p *goPackage) bool {
+	name := p.path
+	if pattern == "." || pattern == "./..." || strings.HasPrefix(pattern, "./") {
+		name, pattern = p.dir, path.Clean(strings.TrimPrefix(pattern, "./"))
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/..."); ok {
+		return name == prefix || strings.HasPrefix(name, prefix+"/")
+	}
+	if pattern == "..." {
+		return true
+	}
+	return name == pattern
+}
+
+// isUnder reports whether the slash-separated path is dir or below it.
+func isUnder(p, dir string) bool {
+	return dir == "." || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+func goDirArg(dir string) string {
+	if dir == "." {
+		return "."
+	}
+	return "./" + dir
+}
+
+func quoteQuery(items []string) string {
+	quoted := make([]string, len(items))
+	for i, s := range items {
+		quoted[i] = `"` + s + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// changedFiles lists the files changed in the working tree at dir since
+// rev, staged or not, and the untracked ones, relative to dir.
+func changedFiles(ctx context.Context, dir, rev string) ([]string, error) {
+	diff, err := runGit(ctx, dir, "diff", "--name-only", "--no-renames", "--relative", rev)
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := runGit(ctx, dir, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range strings.Split(diff+"\n"+untracked, "\n") {
+		if f = strings.TrimSpace(f); f != "" && !slices.Contains(files, f) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// affectedSince returns the targets that the changes in dir since rev
+// affect; the graph is nil when dir has no build system this understands.
+func affectedSince(ctx context.Context, dir, rev string) (*buildGraph, []buildTarget, error) {
+	g := detectBuildGraph(dir)
+	if g == nil {
+		return nil, nil, nil
+	}
+	changed, err := changedFiles(ctx, dir, rev)
+	if err != nil {
+		return g, nil, err
+	}
+	targets, err := g.affected(ctx, changed)
+	return g, targets, err
+}
+
+// scopeVerify fills in the {targets} placeholder of a verify command run in
+// dir with the targets the changes since base affect. It reports false when
+// the changes affect no targets, so there is nothing to verify. When they
+// cannot be worked out, the whole tree is verified.
+func scopeVerify(ctx context.Context, dir, base, verify string) (string, bool) {
+	if !strings.Contains(verify, targetsPlaceholder) {
+		return verify, true
+	}
+	g, targets, err := affectedSince(ctx, dir, base)
+	switch {
+	case g == nil:
+		fmt.Fprintln(os.Stderr, "no Go module or Bazel workspace to find the affected targets in; verifying ./...")
+		return strings.ReplaceAll(verify, targetsPlaceholder, "./..."), true
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "cannot tell the affected targets, verifying %s: %v\n", g.everything(), err)
+		return strings.ReplaceAll(verify, targetsPlaceholder, g.everything()), true
+	case len(targets) == 0:
+		return "", false
+	}
+	args := make([]string, len(targets))
+	for i, t := range targets {
+		args[i] = t.arg
+	}
+	return strings.ReplaceAll(verify, targetsPlaceholder, strings.Join(args, " ")), true
+}
+
+// buildScope is the slice of a monorepo a run is scoped to with -scope: the
+// directories of the matching packages or targets and of their
+// dependencies. Everything else is hidden from the tools.
+type buildScope struct {
+	graph    *buildGraph
+	patterns []string
+	dirs     []string
+}
+
+func loadBuildScope(ctx context.Context, root string, patterns []string) (*buildScope, error) {
+	g := detectBuildGraph(root)
+	if g == nil {
+		return nil, fmt.Errorf("-scope needs a Go module or a Bazel workspace in %s", root)
+	}
+	dirs, err := g.slice(ctx, patterns)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	return &buildScope{graph: g, patterns: patterns, dirs: slices.Compact(dirs)}, nil
+}
+
+// contains reports whether the absolute path is in the slice: in one of its
+// directories, a directory above one (to reach it), or a file directly in
+// such a directory, like a go.mod or a root README. Paths outside the root
+// are left to the other rules.
+func (s *buildScope) contains(p string, isDir bool) bool {
+	rel, err := filepath.Rel(s.graph.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return true
+	}
+	rel = filepath.ToSlash(rel)
+	parent := rel
+	if !isDir {
+		parent = path.Dir(rel)
+	}
+	for _, d := range s.dirs {
+		if isUnder(rel, d) || isUnder(d, parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrict hides the paths outside the slice.
+func (s *buildScope) restrict(rules *ignoreRules) *ignoreRules {
+	if s == nil {
+		return rules
+	}
+	if rules == nil {
+		rules = &ignoreRules{}
+	}
+	rules.scope = s
+	return rules
+}
+
+func (s *buildScope) instructions() string {
+	if s == nil {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n\n## Scope\n\nThis run is scoped to " + strings.Join(s.patterns, ", ") + " of a larger repository. ")
+	sb.WriteString("Only these directories and what they depend on are visible:\n")
+	for _, d := range s.dirs[:min(len(s.dirs), maxScopeDirs)] {
+		sb.WriteString("- " + d + "\n")
+	}
+	if len(s.dirs) > maxScopeDirs {
+		fmt.Fprintf(&sb, "- ... %d more\n", len(s.dirs)-maxScopeDirs)
+	}
+	sb.WriteString("\nVerifying the whole repository is too slow: build and test only the packages you change and their dependents, ")
+	if s.graph.system == buildBazel {
+		sb.WriteString("e.g. bazel test with their targets, never //....\n")
+	} else {
+		sb.WriteString("e.g. go test with their directories, never ./... from the root.\n")
+	}
+	return sb.String()
+}
+
+// reportAffected prints the targets that the changes in dir since HEAD
+// affect, for the run summary, and returns their names.
+func (s *buildScope) reportAffected(dir string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), graphTimeout)
+	defer cancel()
+	if _, err := runGit(ctx, dir, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		return nil
+	}
+	_, targets, err := affectedSince(ctx, dir, "HEAD")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot tell the affected targets:", err)
+		return nil
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.name
+	}
+	fmt.Fprintf(os.Stderr, "affected targets (%d): %s\n", len(names), strings.Join(names, " "))
+	return names
+}
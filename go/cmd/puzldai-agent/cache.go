@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultCacheTTL = 24 * time.Hour
+
+// cachingProvider replays stored responses for requests it has seen before,
+// so re-running a failed pipeline or attempt does not pay again for the
+// turns that came out the same. Entries are keyed by a hash of everything
+// sent to the provider and expire after ttl.
+type cachingProvider struct {
+	next  provider
+	scope string
+	dir   string
+	ttl   time.Duration
+}
+
+type cachedCompletion struct {
+	Created   time.Time       `json:"created"`
+	Text      string          `json:"text"`
+	ToolCalls []savedToolCall `json:"tool_calls,omitempty"`
+	Usage     [2]int64        `json:"usage"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+// newCachingProvider caches next's responses in dir. scope separates
+// providers and endpoints that share a model name.
+func newCachingProvider(next provider, scope, dir string, ttl time.Duration) (*cachingProvider, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cache dir: %w", err)
+	}
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	return &cachingProvider{next: next, scope: scope, dir: dir, ttl: ttl}, nil
+}
+
+func (p *cachingProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	key, err := p.key(req)
+	if err != nil {
+		return p.next.complete(ctx, req)
+	}
+	path := filepath.Join(p.dir, key[:2], key+".json")
+	if resp, ok := p.load(path); ok {
+		return resp, nil
+	}
+
+	resp, err := p.next.complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	p.store(path, resp)
+	return resp, nil
+}
+
+// key hashes the request as the provider sees it. Tools are identified by
+// name and parameters; their implementations do not reach the model.
+func (p *cachingProvider) key(req completionRequest) (string, error) {
+	type toolKey struct {
+		Name   string
+		Params string
+	}
+	tools := make([]toolKey, 0, len(req.tools))
+	for _, t := range req.tools {
+		tools = append(tools, toolKey{t.name, renderParams(t.params)})
+	}
+	type imageKey struct {
+		Label string
+		Data  []byte
+	}
+	var images []imageKey
+	for _, img := range req.images {
+		images = append(images, imageKey{img.label, img.data})
+	}
+	data, err := json.Marshal(struct {
+		Scope       string
+		Model       string
+		System      string
+		Messages    []savedMessage
+		Tools       []toolKey
+		Images      []imageKey `json:",omitempty"`
+		MaxTokens   int
+		Temperature *float64
+		TopP        *float64
+	}{p.scope, req.model, req.system, normalizeCallIDs(saveMessages(req.messages)), tools, images, req.maxTokens, req.temperature, req.topP})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// normalizeCallIDs replaces tool call ids with their order of appearance,
+// also where results quote them, as the unchanged notes of view do. The ids
+// differ between runs of the same conversation: the text protocol makes
+// them from the time, and providers make random ones.
+func normalizeCallIDs(messages []savedMessage) []savedMessage {
+	ids := map[string]string{}
+	var olds []string
+	number := func(id string) string {
+		if id == "" {
+			return ""
+		}
+		if n, ok := ids[id]; ok {
+			return n
+		}
+		n := fmt.Sprintf("call_%d", len(ids)+1)
+		ids[id] = n
+		olds = append(olds, id)
+		return n
+	}
+	for i, m := range messages {
+		for j := range m.ToolCalls {
+			m.ToolCalls[j].ID = number(m.ToolCalls[j].ID)
+		}
+		for j := range m.ToolResults {
+			m.ToolResults[j].ID = number(m.ToolResults[j].ID)
+		}
+		messages[i] = m
+	}
+	if len(olds) == 0 {
+		return messages
+	}
+	// A longer id goes first, so one that another starts with does not
+	// replace part of it.
+	sort.Slice(olds, func(i, j int) bool { return len(olds[i]) > len(olds[j]) })
+	var pairs []string
+	for _, id := range olds {
+		pairs = append(pairs, id, ids[id])
+	}
+	quoted := strings.NewReplacer(pairs...)
+	for _, m := range messages {
+		for j := range m.ToolResults {
+			m.ToolResults[j].Content = quoted.Replace(m.ToolResults[j].Content)
+		}
+	}
+	return messages
+}
+
+// load returns a cached response that has not expired. A hit reports no
+// token usage, since nothing was billed for it.
+func (p *cachingProvider) load(path string) (*completion, bool) {
+	// An entry sealed with another key is a miss, but is left for the
+	// runs that have that key.
+	data, err := readPrivate(path)
+	if err != nil {
+		return nil, false
+	}
+	var c cachedCompletion
+	if json.Unmarshal(data, &c) != nil || time.Since(c.Created) > p.ttl {
+		os.Remove(path)
+		return nil, false
+	}
+	resp := &completion{text: c.Text, truncated: c.Truncated}
+	for _, tc := range c.ToolCalls {
+		resp.toolCalls = append(resp.toolCalls, toolCall{id: tc.ID, name: tc.Name, arguments: tc.Arguments})
+	}
+	return resp, true
+}
+
+// store writes resp best-effort; a cache that cannot be written only costs
+// the next run a request.
+func (p *cachingProvider) store(path string, resp *completion) {
+	c := cachedCompletion{
+		Created:   time.Now().UTC(),
+		Text:      resp.text,
+		Usage:     [2]int64{resp.usage.inputTokens, resp.usage.outputTokens},
+		Truncated: resp.truncated,
+	}
+	for _, tc := range resp.toolCalls {
+		c.ToolCalls = append(c.ToolCalls, savedToolCall{ID: tc.id, Name: tc.name, Arguments: tc.arguments})
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if writePrivate(tmp, data) == nil {
+		os.Rename(tmp, path)
+	}
+}
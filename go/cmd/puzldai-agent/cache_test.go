@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// cacheTranscript is one tool round trip with the given call id, whose
+// result quotes the id the way view's unchanged notes do.
+func cacheTranscript(id, result string) []agentMessage {
+	return []agentMessage{
+		{role: "user", content: "fix the bug"},
+		{role: "assistant", toolCalls: []toolCall{{id: id, name: "view", arguments: map[string]any{"path": "main.go"}}}},
+		{role: "user", toolResults: []toolResult{{id: id, name: "view", content: result + " (unchanged since " + id + ")"}}},
+	}
+}
+
+type countingProvider struct{ calls int }
+
+func (p *countingProvider) complete(context.Context, completionRequest) (*completion, error) {
+	p.calls++
+	return &completion{text: "done", usage: tokenUsage{inputTokens: 10, outputTokens: 2}}, nil
+}
+
+func TestCachingProviderKey(t *testing.T) {
+	p := &cachingProvider{scope: "test"}
+	base := completionRequest{model: "m", system: "s", messages: cacheTranscript("toolu_01AbC", "package main")}
+	baseKey, err := p.key(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  completionRequest
+		hit  bool
+	}{
+		{"other call ids", completionRequest{model: "m", system: "s", messages: cacheTranscript("call_1718000000", "package main")}, true},
+		{"changed tool result", completionRequest{model: "m", system: "s", messages: cacheTranscript("toolu_01AbC", "package other")}, false},
+		{"other model", completionRequest{model: "m2", system: "s", messages: cacheTranscript("toolu_01AbC", "package main")}, false},
+		{"other system prompt", completionRequest{model: "m", system: "s2", messages: cacheTranscript("toolu_01AbC", "package main")}, false},
+		{"other max tokens", completionRequest{model: "m", system: "s", maxTokens: 100, messages: cacheTranscript("toolu_01AbC", "package main")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := p.key(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (key == baseKey) != tt.hit {
+				t.Fatalf("same key = %v, want %v", key == baseKey, tt.hit)
+			}
+		})
+	}
+}
+
+func TestNormalizeCallIDsPrefix(t *testing.T) {
+	// One id starting with another must not have its start replaced.
+	msgs := normalizeCallIDs(saveMessages([]agentMessage{
+		{role: "assistant", toolCalls: []toolCall{{id: "t1", name: "view"}, {id: "t10", name: "view"}}},
+		{role: "user", toolResults: []toolResult{{id: "t1", content: "see t10"}, {id: "t10", content: "see t1"}}},
+	}))
+	if got := msgs[1].ToolResults[0].Content; got != "see call_2" {
+		t.Errorf("got %q, want %q", got, "see call_2")
+	}
+	if got := msgs[1].ToolResults[1].Content; got != "see call_1" {
+		t.Errorf("got %q, want %q", got, "see call_1")
+	}
+}
+
+func TestCachingProviderComplete(t *testing.T) {
+	next := &countingProvider{}
+	p, err := newCachingProvider(next, "test", t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	requests := []struct {
+		req       completionRequest
+		wantCalls int
+	}{
+		{completionRequest{model: "m", messages: cacheTranscript("toolu_A", "v1")}, 1},
+		{completionRequest{model: "m", messages: cacheTranscript("toolu_B", "v1")}, 1},
+		{completionRequest{model: "m", messages: cacheTranscript("toolu_B", "v2")}, 2},
+	}
+	for i, r := range requests {
+		resp, err := p.complete(ctx, r.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.text != "done" || next.calls != r.wantCalls {
+			t.Fatalf("request %d: text %q after %d provider calls, want %d", i, resp.text, next.calls, r.wantCalls)
+		}
+		if i == 1 && resp.usage.inputTokens != 0 {
+			t.Errorf("request %d: a hit reports %d input tokens, want 0", i, resp.usage.inputTokens)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// changeLimits stops a run whose changes grow past -max-files-changed or
+// -max-diff-lines. After every tool call that can change files, the
+// workspace is compared with a baseline taken before the first one. When a
+// limit is crossed the operator is asked whether to go on, even under
+// -approval auto; without an answer the run stops with status
+// change_limit_exceeded. Once approved, the limits no longer apply.
+type changeLimits struct {
+	maxFiles int
+	maxLines int
+	approver *approver
+	roots    []string
+	overlay  *overlay // set in -emit patch runs, which count the patch
+
+	mu        sync.Mutex
+	baselines []*changeBaseline
+	started   bool
+	lifted    bool
+}
+
+func newChangeLimits(maxFiles, maxLines int, approver *approver, roots []string, emit *overlay) *changeLimits {
+	return &changeLimits{maxFiles: maxFiles, maxLines: maxLines, approver: approver, roots: roots, overlay: emit}
+}
+
+// apply checks the limits after each call of a tool that is not a
+// read-only file tool.
+func (l *changeLimits) apply(sess *session, tools []toolDef) []toolDef {
+	sess.onClose(l.close)
+	for i := range tools {
+		if spec, ok := pathArgs[tools[i].name]; ok && !spec.write {
+			continue
+		}
+		next := tools[i].fn
+		tools[i].fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			if err := l.start(ctx); err != nil {
+				return "", fmt.Errorf("change limits: %w", err)
+			}
+			out, err := next(ctx, cwd, args)
+			if stop := l.check(ctx); stop != nil {
+				return out, stop
+			}
+			return out, err
+		}
+	}
+	return tools
+}
+
+// start takes the baselines before the first change.
+func (l *changeLimits) start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.started || l.overlay != nil {
+		return nil
+	}
+	for _, root := range l.roots {
+		b, err := newChangeBaseline(ctx, root)
+		if err != nil {
+			return err
+		}
+		l.baselines = append(l.baselines, b)
+	}
+	l.started = true
+	return nil
+}
+
+// check measures the changes and, past a limit, asks for approval. It
+// returns the error that stops the run when none is given.
+func (l *changeLimits) check(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lifted {
+		return nil
+	}
+	files, lines, err := l.measure(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot measure the changes:", err)
+		return nil
+	}
+	var crossed []string
+	if l.maxFiles > 0 && files > l.maxFiles {
+		crossed = append(crossed, fmt.Sprintf("%d files changed (-max-files-changed %d)", files, l.maxFiles))
+	}
+	if l.maxLines > 0 && lines > l.maxLines {
+		crossed = append(crossed, fmt.Sprintf("%d diff lines (-max-diff-lines %d)", lines, l.maxLines))
+	}
+	if len(crossed) == 0 {
+		return nil
+	}
+	summary := "change limit exceeded: " + strings.Join(crossed, ", ")
+	ok, reason := l.approver.approve(summary+"; continue without limits?", true)
+	if ok {
+		l.lifted = true
+		return nil
+	}
+	summary += " (" + reason + ")"
+	fmt.Fprintln(os.Stderr, "aborting:", summary)
+	return &stopError{outcome: agentOutcome{Status: outcomeChangeLimit, Summary: summary}}
+}
+
+// measure counts the changed files and the added plus deleted lines.
+func (l *changeLimits) measure(ctx context.Context) (files, lines int, err error) {
+	if l.overlay != nil {
+		_, changed, err := l.overlay.patch(ctx)
+		for _, f := range changed {
+			lines += f.Additions + f.Deletions
+		}
+		return len(changed), lines, err
+	}
+	for _, b := range l.baselines {
+		f, n, err := b.count(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		files += f
+		lines += n
+	}
+	return files, lines, nil
+}
+
+func (l *changeLimits) close() {
+	for _, b := range l.baselines {
+		b.cleanup()
+	}
+}
+
+// changeBaseline snapshots a directory into a private index, with the
+// objects in its repository or, outside one, in a throwaway repository, so
+// HEAD, branches, and the real index are left alone. Only the directory is
+// staged, and files ignored by git are not counted.
+type changeBaseline struct {
+	dir     string
+	env     []string
+	tree    string
+	cleanup func()
+}
+
+func newChangeBaseline(ctx context.Context, dir string) (*changeBaseline, error) {
+	tmp, err := os.MkdirTemp("", "puzldai-limits-")
+	if err != nil {
+		return nil, err
+	}
+	b := &changeBaseline{dir: dir, env: []string{"GIT_INDEX_FILE=" + filepath.Join(tmp, "index")}, cleanup: func() { os.RemoveAll(tmp) }}
+	if _, err := gitRoot(ctx, dir); err != nil {
+		gitDir := filepath.Join(tmp, "git")
+		if out, err := exec.CommandContext(ctx, "git", "init", "-q", "--bare", gitDir).CombinedOutput(); err != nil {
+			b.cleanup()
+			return nil, fmt.Errorf("git init: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		b.env = append(b.env, "GIT_DIR="+gitDir, "GIT_WORK_TREE="+dir)
+	}
+	if _, err := b.git(ctx, "add", "-A", "--", "."); err != nil {
+		b.cleanup()
+		return nil, err
+	}
+	tree, err := b.git(ctx, "write-tree")
+	if err != nil {
+		b.cleanup()
+		return nil, err
+	}
+	b.tree = strings.TrimSpace(tree)
+	return b, nil
+}
+
+func (b *changeBaseline) git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = b.dir
+	cmd.Env = append(os.Environ(), b.env...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// count stages the directory as it is now and counts the files and lines
+// that differ from the baseline; a binary file counts as a file only.
+func (b *changeBaseline) count(ctx context.Context) (files, lines int, err error) {
+	if _, err := b.git(ctx, "add", "-A", "--", "."); err != nil {
+		return 0, 0, err
+	}
+	out, err := b.git(ctx, "diff", "--cached", "--numstat", "--no-renames", b.tree, "--", ".")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		files++
+		added, _ := strconv.Atoi(fields[0])
+		deleted, _ := strconv.Atoi(fields[1])
+		lines += added + deleted
+	}
+	return files, lines, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkpoint is a named copy of a session's transcript and notes plus a git
+// commit of its workspace (tracked and untracked files, minus ignored ones),
+// so a new session can be forked from that point with -fork id@name.
+type checkpoint struct {
+	Name       string       `json:"name"`
+	Session    string       `json:"session"`
+	Created    time.Time    `json:"created"`
+	Root       string       `json:"root"`
+	Commit     string       `json:"commit"`
+	Notes      string       `json:"notes,omitempty"`
+	Transcript savedSession `json:"transcript"`
+}
+
+func checkpointPath(id, name string) (string, error) {
+	if !sessionIDRe.MatchString(name) {
+		return "", fmt.Errorf("invalid checkpoint name %q (letters, digits, - and _)", name)
+	}
+	path, err := sessionPath(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(strings.TrimSuffix(path, ".json")+".checkpoints", name+".json"), nil
+}
+
+const checkpointUsage = "usage: puzldai-agent checkpoint save|list <session-id> [name]"
+
+func runCheckpoint(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, checkpointUsage)
+		return exitUsage
+	}
+	fs := newFlagSet("checkpoint " + args[0])
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	id := fs.Arg(0)
+
+	var err error
+	switch {
+	case args[0] == "save" && fs.NArg() == 2:
+		var cp *checkpoint
+		cp, err = saveCheckpoint(id, fs.Arg(1))
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "checkpoint %s saved (workspace %s at %.12s); fork with -fork %s@%s\n", cp.Name, cp.Root, cp.Commit, id, cp.Name)
+		}
+	case args[0] == "list" && fs.NArg() == 1:
+		err = listCheckpoints(id)
+	default:
+		fmt.Fprintln(os.Stderr, checkpointUsage)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "checkpoint:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// saveCheckpoint records the session as it was last saved, together with
+// the current state of its workspace.
+func saveCheckpoint(id, name string) (*checkpoint, error) {
+	path, err := checkpointPath(id, name)
+	if err != nil {
+		return nil, err
+	}
+	saved, err := loadSession(id)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	root, err := gitRoot(ctx, saved.Cwd)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig(saved.Cwd, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Commit.validate(); err != nil {
+		return nil, err
+	}
+	commit, err := commitWorktree(ctx, root, cfg.Commit.message("puzldai checkpoint "+id+"@"+name, id), &cfg.Commit)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the commit reachable so git gc does not collect it.
+	if _, err := runGit(ctx, root, "update-ref", "refs/puzldai/checkpoints/"+id+"/"+name, commit); err != nil {
+		return nil, err
+	}
+
+	cp := &checkpoint{Name: name, Session: id, Created: time.Now().UTC(), Root: root, Commit: commit, Transcript: *saved}
+	if notes, err := notesPath(id); err == nil {
+		if data, err := readPrivate(notes); err == nil {
+			cp.Notes = string(data)
+		}
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return cp, writePrivate(path, data)
+}
+
+func loadCheckpoint(ref string) (*checkpoint, error) {
+	id, name, ok := strings.Cut(ref, "@")
+	if !ok {
+		return nil, fmt.Errorf("checkpoint %q must be session-id@name", ref)
+	}
+	path, err := checkpointPath(id, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readPrivate(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no checkpoint %q for session %s", name, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+func listCheckpoints(id string) error {
+	path, err := checkpointPath(id, "x")
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && len(entries) == 0) {
+		fmt.Fprintf(os.Stderr, "no checkpoints for session %s\n", id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".json")
+		cp, err := loadCheckpoint(id + "@" + name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\t%d messages\t%.12s\n", cp.Name, cp.Created.Local().Format(time.DateTime), len(cp.Transcript.Messages), cp.Commit)
+	}
+	return nil
+}
+
+// restoreCheckpoint resets the checkpoint's workspace to its snapshot: files
+// are rewritten and files created since are removed. The current state is
+// snapshotted first and kept by a ref, refs/puzldai/checkpoints/<session>/
+// pre-fork-<name>, so nothing is lost; its reflog keeps the states of earlier
+// forks from the checkpoint. It returns the ref.
+func restoreCheckpoint(cp *checkpoint) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	current, err := snapshotWorktree(ctx, cp.Root, "puzldai state before fork from "+cp.Session+"@"+cp.Name)
+	if err != nil {
+		return "", err
+	}
+	ref := "refs/puzldai/checkpoints/" + cp.Session + "/pre-fork-" + cp.Name
+	if _, err := runGit(ctx, cp.Root, "update-ref", "--create-reflog", "-m", "fork from "+cp.Session+"@"+cp.Name, ref, current); err != nil {
+		return "", err
+	}
+	added, err := runGit(ctx, cp.Root, "diff", "--name-only", "-z", "--no-renames", "--diff-filter=A", cp.Commit, current)
+	if err != nil {
+		return "", err
+	}
+	for _, rel := range strings.Split(added, "\x00") {
+		if rel != "" {
+			if err := os.Remove(filepath.Join(cp.Root, filepath.FromSlash(rel))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+	index, cleanup, err := tempIndex()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	if _, err := gitWithIndex(ctx, cp.Root, index, "read-tree", cp.Commit); err != nil {
+		return "", err
+	}
+	if _, err := gitWithIndex(ctx, cp.Root, index, "checkout-index", "-a", "-f"); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+func gitRoot(ctx context.Context, dir string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", errors.New("checkpoints require git")
+	}
+	out, err := runGit(ctx, dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("checkpoints need the workspace to be in a git repository: %w", err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// snapshotWorktree commits the working tree through a temporary index, so
+// the repository's own index, HEAD, and branches are left untouched.
+func snapshotWorktree(ctx context.Context, root, message string) (string, error) {
+	return commitWorktree(ctx, root, message, nil)
+}
+
+// commitWorktree is snapshotWorktree for a commit that is kept: it is made
+// with the identity, signature, and trailers of commit when set.
+func commitWorktree(ctx context.Context, root, message string, commit *commitConfig) (string, error) {
+	index, cleanup, err := tempIndex()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	if _, err := gitWithIndex(ctx, root, index, "add", "-A"); err != nil {
+		return "", err
+	}
+	tree, err := gitWithIndex(ctx, root, index, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"commit-tree", strings.TrimSpace(tree), "-m", message}
+	env := append([]string{"GIT_INDEX_FILE=" + index}, snapshotIdentity...)
+	if commit != nil {
+		args = append(append([]string{"commit-tree"}, commit.signArgs()...), args[1:]...)
+		env = append(env, commit.env()...)
+	}
+	id, err := gitWithEnv(ctx, root, env, args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(id), nil
+}
+
+func tempIndex() (string, func(), error) {
+	dir, err := os.MkdirTemp("", "puzldai-index-")
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Join(dir, "index"), func() { os.RemoveAll(dir) }, nil
+}
+
+// snapshotIdentity is who the snapshots through a temporary index are
+// committed as, unless the [commit] section names someone else.
+var snapshotIdentity = []string{
+	"GIT_AUTHOR_NAME=puzldai", "GIT_AUTHOR_EMAIL=puzldai@localhost",
+	"GIT_COMMITTER_NAME=puzldai", "GIT_COMMITTER_EMAIL=puzldai@localhost",
+}
+
+func gitWithIndex(ctx context.Context, dir, index string, args ...string) (string, error) {
+	return gitWithEnv(ctx, dir, append([]string{"GIT_INDEX_FILE=" + index}, snapshotIdentity...), args...)
+}
+
+// gitWithEnv runs git with env added to the environment.
+func gitWithEnv(ctx context.Context, dir string, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("git: %s", msg)
+	}
+	return string(out), nil
+}
+
+// forkNotes seeds the new session's scratchpad with the checkpoint's notes.
+func forkNotes(cp *checkpoint, id string) error {
+	if cp.Notes == "" {
+		return nil
+	}
+	path, err := notesPath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return writePrivate(path, []byte(cp.Notes))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ciMode is set by -ci: nothing prompts on the terminal, commands run
+// without color, each turn reports one progress line on stderr, and only
+// the final answer reaches stdout.
+var ciMode bool
+
+// answerOut receives the final answer. In -ci mode os.Stdout is pointed at
+// stderr for the rest of the run, so no stray write can end up next to it.
+var answerOut io.Writer = os.Stdout
+
+// ciCommandEnv turns off color and pagers in the commands tools run.
+var ciCommandEnv = []string{"NO_COLOR=1", "TERM=dumb", "PAGER=cat", "GIT_PAGER=cat"}
+
+func enableCIMode() {
+	ciMode = true
+	answerOut = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+// reportProgress writes the per-turn line of -ci mode in key=value form.
+func reportProgress(iter, toolCalls, tokens int, elapsed time.Duration) {
+	if !ciMode {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "progress iteration=%d tools=%d tokens=%d elapsed=%s\n", iter, toolCalls, tokens, elapsed.Round(100*time.Millisecond))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const cliUsage = "usage: puzldai-agent [global flags] <command> [args]\n       puzldai-agent [global flags] [run] [flags] < task"
+
+const taskUsage = "usage: puzldai-agent [run] [flags] < task"
+
+const helpUsage = "usage: puzldai-agent help [command]"
+
+// command is a subcommand of puzldai-agent, such as sessions or serve.
+type command struct {
+	name    string
+	summary string
+	// usage is the usage message the command prints on bad arguments.
+	usage string
+	// verbs are the command's own subcommands, e.g. sessions list.
+	verbs []string
+	run   func(args []string) int
+}
+
+// commands are the subcommands, in the order help and completion list them.
+// They are set in init, as help, completion, and man refer back to them.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "run", summary: "Run the agent on a task; the default command", usage: taskUsage, run: runTask},
+		{name: "auth", summary: "Store, check, or remove provider API keys and the session encryption key", usage: authUsage, verbs: []string{"login", "status", "logout", "session-key"}, run: runAuth},
+		{name: "init", summary: "Write a starter .puzldai.toml, .puzldaiignore, and PUZLD.md for the workspace", usage: initUsage, run: runInit},
+		{name: "doctor", summary: "Check the config, git, the shell, the provider's key and network path, and the sandbox", usage: doctorUsage, run: runDoctor},
+		{name: "sessions", summary: "List, show, delete, and purge saved sessions", usage: sessionsUsage, verbs: []string{"list", "show", "delete", "purge"}, run: runSessions},
+		{name: "checkpoint", summary: "Save or list checkpoints of a session and its workspace", usage: checkpointUsage, verbs: []string{"save", "list"}, run: runCheckpoint},
+		{name: "usage", summary: "Summarize tokens and cost from the usage ledger", usage: usageUsage, run: runUsage},
+		{name: "replay", summary: "Step through a saved session, optionally re-running its tool calls", usage: replayUsage, run: runReplay},
+		{name: "refactor", summary: "Plan a refactoring, apply it in parallel, and verify the result", usage: refactorUsage, run: runRefactor},
+		{name: "gen-tests", summary: "Write Go tests for a package until they build, pass, and reach a coverage target", usage: genTestsUsage, run: runGenTests},
+		{name: "upgrade", summary: "Upgrade a dependency and fix the code it breaks", usage: upgradeUsage, run: runUpgrade},
+		{name: "triage", summary: "Triage and fix the findings of a SARIF, semgrep, or gosec report", usage: triageUsage, run: runTriage},
+		{name: "fix-crash", summary: "Fix the crash in a stack trace read from stdin, checked by a repro command", usage: fixCrashUsage, run: runFixCrash},
+		{name: "perf", summary: "Make a change without regressing benchmarks", usage: perfUsage, run: runPerf},
+		{name: "ci", summary: "Run as a GitHub Actions step on the task of the triggering event", usage: ciUsage, run: runCI},
+		{name: "serve", summary: "Serve the comment bot, scheduled runs, and tenants over HTTP", usage: serveUsage, run: runServe},
+		{name: "batch", summary: "Run a file of tasks, each on its own branch, and report on them", usage: batchUsage, run: runBatch},
+		{name: "completion", summary: "Print a shell completion script for bash, zsh, fish, or powershell", usage: completionUsage, verbs: completionShells, run: runCompletion},
+		{name: "man", summary: "Write the man pages", usage: manUsage, run: runMan},
+		{name: "help", summary: "Show the commands, or a command's usage and flags", usage: helpUsage, run: runHelp},
+	}
+	help := lookupCommand("help")
+	for _, cmd := range commands {
+		help.verbs = append(help.verbs, cmd.name)
+	}
+}
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// synopsis is the usage message without its "usage: " prefix, one line
+// per form.
+func synopsis(usage string) []string {
+	var lines []string
+	for _, line := range strings.Split(usage, "\n") {
+		lines = append(lines, strings.TrimPrefix(strings.TrimSpace(line), "usage: "))
+	}
+	return lines
+}
+
+// runCommand dispatches the command line: global flags, then a command and
+// its arguments, or without a command, the flags of run.
+func runCommand(args []string) int {
+	args, err := parseGlobalFlags(newGlobalFlags(), args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	cmd := lookupCommand("run")
+	if len(args) > 0 {
+		if c := lookupCommand(args[0]); c != nil {
+			cmd, args = c, args[1:]
+		} else if wantsHelp(args) {
+			printOverview(os.Stdout)
+			return exitOK
+		}
+	}
+	if cmd.name != "help" && wantsHelp(args) {
+		printHelp(os.Stdout, cmd)
+		return exitOK
+	}
+	return cmd.run(args)
+}
+
+// wantsHelp reports whether args ask for help: -h, -help, or --help before
+// any "--".
+func wantsHelp(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--":
+			return false
+		case "-h", "-help", "--h", "--help":
+			return true
+		}
+	}
+	return false
+}
+
+// newGlobalFlags defines the flags accepted before any command. Each sets
+// the environment variable every command, and every agent run that serve,
+// batch, and the others start, already reads.
+func newGlobalFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("puzldai-agent", flag.ContinueOnError)
+	setenv := func(name string) func(string) error {
+		return func(value string) error { return os.Setenv(name, value) }
+	}
+	fs.Func("config", "Config `file` (sets PUZLDAI_CONFIG; default: <cwd>/.puzldai.toml)", setenv("PUZLDAI_CONFIG"))
+	fs.Func("profile", "Config `profile` to use (sets PUZLDAI_PROFILE)", setenv("PUZLDAI_PROFILE"))
+	fs.Func("home", "State `directory` for sessions, the usage ledger, and caches (sets PUZLDAI_HOME; default: ~/.puzldai)", setenv("PUZLDAI_HOME"))
+	setenvBool := func(name string) func(string) error {
+		return func(value string) error {
+			on, err := strconv.ParseBool(value)
+			if err != nil || !on {
+				return err
+			}
+			return os.Setenv(name, "1")
+		}
+	}
+	fs.BoolFunc("no-color", "Plain output without colors (sets NO_COLOR)", setenvBool("NO_COLOR"))
+	fs.BoolFunc("no-dotenv", "Do not load .env files, even with dotenv set in the config (sets "+noDotenvEnv+")", setenvBool(noDotenvEnv))
+	return fs
+}
+
+// parseGlobalFlags applies the global flags at the front of args and
+// returns the rest. It stops at the first argument that is not one, so
+// the flags of run may follow without a command.
+func parseGlobalFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "--" {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(args[0], "-"), "-"), "=")
+		f := fs.Lookup(name)
+		if f == nil {
+			break
+		}
+		n := 1
+		switch {
+		case hasValue:
+		case isBoolFlag(f):
+			value = "true"
+		case len(args) < 2:
+			return nil, fmt.Errorf("flag needs an argument: -%s", name)
+		default:
+			value, n = args[1], 2
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for flag -%s: %v", value, name, err)
+		}
+		args = args[n:]
+	}
+	return args, nil
+}
+
+// runHelp implements the help command.
+func runHelp(args []string) int {
+	fs := newFlagSet("help")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, helpUsage)
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		printOverview(os.Stdout)
+		return exitOK
+	}
+	cmd := lookupCommand(fs.Arg(0))
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "help: unknown command %q\n", fs.Arg(0))
+		printOverview(os.Stderr)
+		return exitUsage
+	}
+	printHelp(os.Stdout, cmd)
+	return exitOK
+}
+
+// printOverview writes the commands and global flags.
+func printOverview(w io.Writer) {
+	fmt.Fprintf(w, "%s\n\nCommands:\n", cliUsage)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nGlobal flags:")
+	printFlags(w, globalFlagList())
+	fmt.Fprintln(w, "\nRun 'puzldai-agent help <command>' for a command's usage and flags.")
+}
+
+// printHelp writes a command's summary, usage, and flags.
+func printHelp(w io.Writer, cmd *command) {
+	fmt.Fprintf(w, "puzldai-agent %s: %s\n\n%s\n", cmd.name, cmd.summary, cmd.usage)
+	if flags := commandFlags(cmd); len(flags) > 0 {
+		fmt.Fprintln(w, "\nFlags:")
+		printFlags(w, flags)
+	}
+	if strings.Contains(cmd.usage, "-- agent flags") {
+		fmt.Fprintln(w, "\nFlags after -- are passed to the agent runs; see 'puzldai-agent help run'.")
+	}
+}
+
+func printFlags(w io.Writer, flags []*flag.Flag) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	for _, f := range flags {
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+func globalFlagList() []*flag.Flag {
+	var flags []*flag.Flag
+	newGlobalFlags().VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+// flagSetHook, when set, is called with each flag set a command creates
+// before parsing it; see commandFlags.
+var flagSetHook func(*flag.FlagSet)
+
+// newFlagSet creates a subcommand's flag set.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	hookFlagSet(fs)
+	return fs
+}
+
+func hookFlagSet(fs *flag.FlagSet) {
+	if flagSetHook != nil {
+		flagSetHook(fs)
+	}
+}
+
+// commandFlags lists the flags of a command by running it with -h, which
+// every command handles by returning right after it parses its flags. For
+// a command with verbs, each verb is run and their flags are merged.
+// Stderr is discarded meanwhile.
+//
+// run defines its flags on flag.CommandLine, so they can be listed only
+// once per process.
+func commandFlags(cmd *command) []*flag.Flag {
+	var sets []*flag.FlagSet
+	flagSetHook = func(fs *flag.FlagSet) { sets = append(sets, fs) }
+	stderr := os.Stderr
+	if null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stderr = null
+		defer null.Close()
+	}
+	defer func() {
+		flagSetHook = nil
+		os.Stderr = stderr
+	}()
+
+	if len(cmd.verbs) == 0 {
+		cmd.run([]string{"-h"})
+	}
+	for _, verb := range cmd.verbs {
+		cmd.run([]string{verb, "-h"})
+	}
+	var flags []*flag.Flag
+	for _, fs := range sets {
+		fs.VisitAll(func(f *flag.Flag) {
+			if !slices.ContainsFunc(flags, func(g *flag.Flag) bool { return g.Name == f.Name }) {
+				flags = append(flags, f)
+			}
+		})
+	}
+	return flags
+}
+
+// isBoolFlag reports whether f takes no value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagSummary is f's usage without its "(default: ...)" note, for the
+// short descriptions of completion menus.
+func flagSummary(f *flag.Flag) string {
+	_, usage := flag.UnquoteUsage(f)
+	if i := strings.Index(usage, " (default"); i > 0 {
+		usage = usage[:i]
+	}
+	return usage
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const clipboardTimeout = 10 * time.Second
+
+// copyAnswer is set by -copy-result: the final answer is also copied to
+// the clipboard.
+var copyAnswer bool
+
+// clipboardCommands are the programs that read and write the clipboard on
+// this platform, in the order they are tried.
+func clipboardCommands(write bool) [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		if write {
+			return [][]string{{"pbcopy"}}
+		}
+		return [][]string{{"pbpaste"}}
+	case "windows":
+		if write {
+			return [][]string{{"powershell", "-NoProfile", "-Command", "$input | Set-Clipboard"}, {"clip"}}
+		}
+		return [][]string{{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"}}
+	}
+	var cmds [][]string
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if write {
+			cmds = append(cmds, []string{"wl-copy"})
+		} else {
+			cmds = append(cmds, []string{"wl-paste", "--no-newline"})
+		}
+	}
+	if write {
+		return append(cmds, []string{"xclip", "-selection", "clipboard"}, []string{"xsel", "--clipboard", "--input"})
+	}
+	return append(cmds, []string{"xclip", "-selection", "clipboard", "-o"}, []string{"xsel", "--clipboard", "--output"})
+}
+
+// readClipboard returns the clipboard's text.
+func readClipboard() (string, error) {
+	for _, args := range clipboardCommands(false) {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), clipboardTimeout)
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		cancel()
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", args[0], firstNonEmpty(strings.TrimSpace(stderr.String()), err.Error()))
+		}
+		if runtime.GOOS == "windows" {
+			out = bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n"))
+		}
+		return string(out), nil
+	}
+	return "", errors.New(clipboardMissing(false))
+}
+
+// writeClipboard puts text on the clipboard. Without a clipboard program,
+// a terminal that supports OSC 52, including over SSH, is asked to do it.
+func writeClipboard(text string) error {
+	for _, args := range clipboardCommands(true) {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), clipboardTimeout)
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %s", args[0], firstNonEmpty(strings.TrimSpace(stderr.String()), err.Error()))
+		}
+		return nil
+	}
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		defer tty.Close()
+		if !ciMode {
+			_, err = fmt.Fprintf(tty, "\033]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+			return err
+		}
+	}
+	return errors.New(clipboardMissing(true))
+}
+
+func clipboardMissing(write bool) string {
+	var names []string
+	for _, args := range clipboardCommands(write) {
+		names = append(names, args[0])
+	}
+	return "no clipboard program found (install " + strings.Join(names, " or ") + ")"
+}
+
+// copyResult copies the final answer when -copy-result is set.
+func copyResult(text string) {
+	if !copyAnswer {
+		return
+	}
+	if err := writeClipboard(strings.TrimSuffix(text, "\n")); err != nil {
+		fmt.Fprintln(os.Stderr, "copy-result:", err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "answer copied to the clipboard")
+}
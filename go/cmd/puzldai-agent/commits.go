@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sessionTrailer names the session that made a commit.
+const sessionTrailer = "Puzld-Agent-Session"
+
+// commitConfig is the [commit] section: the identity, signature, and
+// trailers of commits the agent makes, so they can be told apart from a
+// person's and audited. Unset fields leave git's own settings in place.
+type commitConfig struct {
+	AuthorName  string `toml:"author_name"`
+	AuthorEmail string `toml:"author_email"`
+	// CommitterName and CommitterEmail default to the author's.
+	CommitterName  string `toml:"committer_name"`
+	CommitterEmail string `toml:"committer_email"`
+	// Sign is gpg, ssh, or x509; SigningKey is passed as user.signingkey,
+	// and git's own is used when it is empty.
+	Sign       string `toml:"sign"`
+	SigningKey string `toml:"signing_key"`
+	// Trailers are "Key: value" lines added to every commit message, such
+	// as "Co-authored-by: Jane Doe <jane@example.com>".
+	Trailers []string `toml:"trailers"`
+}
+
+var trailerRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*: \S`)
+
+var signFormats = map[string]string{"gpg": "openpgp", "ssh": "ssh", "x509": "x509"}
+
+func (c commitConfig) validate() error {
+	if _, ok := signFormats[c.Sign]; c.Sign != "" && !ok {
+		return fmt.Errorf("commit: invalid sign %q (gpg, ssh, x509)", c.Sign)
+	}
+	for _, t := range c.Trailers {
+		if !trailerRe.MatchString(t) {
+			return fmt.Errorf("commit: invalid trailer %q (want \"Key: value\")", t)
+		}
+	}
+	return nil
+}
+
+// env returns the variables that make git use the identity and signing
+// settings. Signing goes through GIT_CONFIG_COUNT, after any entries
+// already in the environment.
+func (c commitConfig) env() []string {
+	var env []string
+	if c.AuthorName != "" {
+		env = append(env, "GIT_AUTHOR_NAME="+c.AuthorName)
+	}
+	if c.AuthorEmail != "" {
+		env = append(env, "GIT_AUTHOR_EMAIL="+c.AuthorEmail)
+	}
+	if name := firstNonEmpty(c.CommitterName, c.AuthorName); name != "" {
+		env = append(env, "GIT_COMMITTER_NAME="+name)
+	}
+	if email := firstNonEmpty(c.CommitterEmail, c.AuthorEmail); email != "" {
+		env = append(env, "GIT_COMMITTER_EMAIL="+email)
+	}
+	if c.Sign == "" {
+		return env
+	}
+	settings := [][2]string{{"commit.gpgsign", "true"}, {"gpg.format", signFormats[c.Sign]}}
+	if c.SigningKey != "" {
+		settings = append(settings, [2]string{"user.signingkey", c.SigningKey})
+	}
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	for _, kv := range settings {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", n, kv[0]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", n, kv[1]))
+		n++
+	}
+	return append(env, "GIT_CONFIG_COUNT="+strconv.Itoa(n))
+}
+
+// signArgs returns the flag that signs a commit made with commit-tree,
+// which does not read commit.gpgsign.
+func (c commitConfig) signArgs() []string {
+	if c.Sign == "" {
+		return nil
+	}
+	return []string{"-S"}
+}
+
+// message appends the trailers, and the session's when it is known, to a
+// commit message.
+func (c commitConfig) message(msg, session string) string {
+	trailers := c.Trailers
+	if session != "" {
+		trailers = append(trailers[:len(trailers):len(trailers)], sessionTrailer+": "+session)
+	}
+	if len(trailers) == 0 {
+		return msg
+	}
+	return strings.TrimRight(msg, "\n") + "\n\n" + strings.Join(trailers, "\n") + "\n"
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const completionUsage = "usage: puzldai-agent completion bash|zsh|fish|powershell"
+
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// runCompletion implements the completion subcommand: it prints a script
+// that completes the commands, verbs, and flags of this binary in a shell.
+// Flag values and other arguments complete as file names.
+func runCompletion(args []string) int {
+	fs := newFlagSet("completion")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || !slices.Contains(completionShells, fs.Arg(0)) {
+		fmt.Fprintln(os.Stderr, completionUsage)
+		return exitUsage
+	}
+	c := newShellCompletion()
+	var script string
+	switch fs.Arg(0) {
+	case "bash":
+		script = c.bash()
+	case "zsh":
+		script = c.zsh()
+	case "fish":
+		script = c.fish()
+	case "powershell":
+		script = c.powershell()
+	}
+	fmt.Print(script)
+	return exitOK
+}
+
+// shellCompletion holds what the scripts complete: the commands with their
+// flags, and without a command, the global flags and those of run. After
+// "--", these complete again, as the commands that start agent runs pass
+// them on.
+type shellCompletion struct {
+	flags    []*flag.Flag
+	commands []*command
+	cmdFlags map[string][]*flag.Flag
+}
+
+func newShellCompletion() *shellCompletion {
+	c := &shellCompletion{commands: commands, cmdFlags: map[string][]*flag.Flag{}}
+	for _, cmd := range commands {
+		c.cmdFlags[cmd.name] = commandFlags(cmd)
+	}
+	c.flags = append(globalFlagList(), c.cmdFlags["run"]...)
+	return c
+}
+
+// flagNames lists flags as -name, and with values only those that take one.
+func flagNames(flags []*flag.Flag, values bool) string {
+	var names []string
+	for _, f := range flags {
+		if !values || !isBoolFlag(f) {
+			names = append(names, "-"+f.Name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func (c *shellCompletion) bash() string {
+	var b strings.Builder
+	b.WriteString(`# bash completion for puzldai-agent; generated by puzldai-agent completion bash
+
+_puzldai_agent() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	local cmd= i
+	if ((COMP_CWORD > 1)); then
+		cmd=${COMP_WORDS[1]}
+	fi
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		if [[ ${COMP_WORDS[i]} == -- ]]; then
+			cmd=
+		fi
+	done
+
+	local flags values verbs=
+	case $cmd in
+`)
+	for _, cmd := range c.commands {
+		flags := c.cmdFlags[cmd.name]
+		fmt.Fprintf(&b, "\t%s)\n\t\tflags=%q\n\t\tvalues=%q\n", cmd.name, flagNames(flags, false), " "+flagNames(flags, true)+" ")
+		if len(cmd.verbs) > 0 {
+			fmt.Fprintf(&b, "\t\tverbs=%q\n", strings.Join(cmd.verbs, " "))
+		}
+		b.WriteString("\t\t;;\n")
+	}
+	fmt.Fprintf(&b, "\t*)\n\t\tflags=%q\n\t\tvalues=%q\n\t\tcmd=\n\t\t;;\n\tesac\n", flagNames(c.flags, false), " "+flagNames(c.flags, true)+" ")
+	var names []string
+	for _, cmd := range c.commands {
+		names = append(names, cmd.name)
+	}
+	fmt.Fprintf(&b, `
+	if [[ $values == *" $prev "* ]]; then
+		return
+	fi
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	elif ((COMP_CWORD == 1)); then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	elif [[ -n $verbs ]] && ((COMP_CWORD == 2)); then
+		COMPREPLY=($(compgen -W "$verbs" -- "$cur"))
+	fi
+}
+
+complete -o default -F _puzldai_agent puzldai-agent
+`, strings.Join(names, " "))
+	return b.String()
+}
+
+// zshSpecs are the _arguments specs of flags.
+func zshSpecs(flags []*flag.Flag) string {
+	var specs []string
+	for _, f := range flags {
+		desc := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "'", `'\''`).Replace(flagSummary(f))
+		spec := "-" + f.Name + "[" + desc + "]"
+		if _, ok := f.Value.(*stringList); ok {
+			spec = "*" + spec
+		}
+		if !isBoolFlag(f) {
+			name, _ := flag.UnquoteUsage(f)
+			spec += ":" + firstNonEmpty(name, "value") + ":_files"
+		}
+		specs = append(specs, "'"+spec+"'")
+	}
+	return strings.Join(specs, " \\\n\t\t\t")
+}
+
+func (c *shellCompletion) zsh() string {
+	var b strings.Builder
+	b.WriteString(`#compdef puzldai-agent
+# zsh completion for puzldai-agent; generated by puzldai-agent completion zsh
+
+_puzldai_agent() {
+	local -a commands
+	commands=(
+`)
+	for _, cmd := range c.commands {
+		fmt.Fprintf(&b, "\t\t%s\n", zshQuote(cmd.name+":"+cmd.summary))
+	}
+	b.WriteString(`	)
+	local dash=${words[(I)--]}
+	if ((dash > 1 && dash < CURRENT)); then
+		shift $dash words
+		((CURRENT -= dash))
+		words=(puzldai-agent $words)
+		((CURRENT++))
+	elif ((CURRENT > 2)); then
+		case $words[2] in
+`)
+	for _, cmd := range c.commands {
+		fmt.Fprintf(&b, "\t\t%s)\n\t\t\tshift words\n\t\t\t((CURRENT--))\n", cmd.name)
+		if len(cmd.verbs) > 0 {
+			fmt.Fprintf(&b, "\t\t\tif ((CURRENT == 2)); then\n\t\t\t\tcompadd -- %s\n\t\t\t\treturn\n\t\t\tfi\n", strings.Join(cmd.verbs, " "))
+		}
+		if flags := c.cmdFlags[cmd.name]; len(flags) > 0 {
+			fmt.Fprintf(&b, "\t\t\t_arguments \\\n\t\t\t%s \\\n\t\t\t'*:file:_files'\n", zshSpecs(flags))
+		} else {
+			b.WriteString("\t\t\t_files\n")
+		}
+		b.WriteString("\t\t\treturn\n\t\t\t;;\n")
+	}
+	fmt.Fprintf(&b, `		esac
+	elif [[ $PREFIX != -* ]]; then
+		_describe -t commands 'puzldai-agent command' commands
+		return
+	fi
+	_arguments \
+			%s
+}
+
+_puzldai_agent "$@"
+`, zshSpecs(c.flags))
+	return b.String()
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// fishFlags are the complete lines of flags, in the context the condition
+// tests.
+func fishFlags(b *strings.Builder, cond string, flags []*flag.Flag) {
+	for _, f := range flags {
+		fmt.Fprintf(b, "complete -c puzldai-agent -n %s -o %s", fishQuote(cond), f.Name)
+		if !isBoolFlag(f) {
+			b.WriteString(" -r")
+		}
+		fmt.Fprintf(b, " -d %s\n", fishQuote(flagSummary(f)))
+	}
+}
+
+func (c *shellCompletion) fish() string {
+	var b strings.Builder
+	var names []string
+	for _, cmd := range c.commands {
+		names = append(names, cmd.name)
+	}
+	fmt.Fprintf(&b, `# fish completion for puzldai-agent; generated by puzldai-agent completion fish
+
+# __puzldai_agent_in succeeds when the command being completed is cmd, or
+# with no argument, when it is the agent run itself, also after "--".
+function __puzldai_agent_in
+	set -l words (commandline -opc)
+	set -l cmd
+	if not contains -- -- $words; and set -q words[2]; and contains -- $words[2] %s
+		set cmd $words[2]
+	end
+	test "$cmd" = "$argv[1]"
+end
+
+`, strings.Join(names, " "))
+	for _, cmd := range c.commands {
+		fmt.Fprintf(&b, "complete -c puzldai-agent -n 'test (count (commandline -opc)) -eq 1' -a %s -d %s\n", cmd.name, fishQuote(cmd.summary))
+	}
+	b.WriteString("\n")
+	fishFlags(&b, "__puzldai_agent_in", c.flags)
+	for _, cmd := range c.commands {
+		b.WriteString("\n")
+		if len(cmd.verbs) > 0 {
+			fmt.Fprintf(&b, "complete -c puzldai-agent -n '__puzldai_agent_in %s; and test (count (commandline -opc)) -eq 2' -a %s\n", cmd.name, fishQuote(strings.Join(cmd.verbs, " ")))
+		}
+		fishFlags(&b, "__puzldai_agent_in "+cmd.name, c.cmdFlags[cmd.name])
+	}
+	return b.String()
+}
+
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// psFlags is a PowerShell hashtable of flags and their descriptions.
+func psFlags(flags []*flag.Flag) string {
+	var b strings.Builder
+	b.WriteString("@{")
+	for _, f := range flags {
+		fmt.Fprintf(&b, "\n\t\t\t%s = %s", psQuote("-"+f.Name), psQuote(firstNonEmpty(flagSummary(f), f.Name)))
+	}
+	b.WriteString("\n\t\t}")
+	return b.String()
+}
+
+func (c *shellCompletion) powershell() string {
+	var b strings.Builder
+	b.WriteString(`# PowerShell completion for puzldai-agent; generated by puzldai-agent completion powershell
+
+Register-ArgumentCompleter -Native -CommandName puzldai-agent -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+
+	$commands = [ordered]@{
+`)
+	for _, cmd := range c.commands {
+		fmt.Fprintf(&b, "\t\t%s = %s\n", psQuote(cmd.name), psQuote(cmd.summary))
+	}
+	b.WriteString("\t}\n\t$verbs = @{\n")
+	for _, cmd := range c.commands {
+		if len(cmd.verbs) > 0 {
+			var verbs []string
+			for _, v := range cmd.verbs {
+				verbs = append(verbs, psQuote(v))
+			}
+			fmt.Fprintf(&b, "\t\t%s = @(%s)\n", psQuote(cmd.name), strings.Join(verbs, ", "))
+		}
+	}
+	fmt.Fprintf(&b, "\t}\n\t$flags = @{\n\t\t'' = %s\n", psFlags(c.flags))
+	for _, cmd := range c.commands {
+		fmt.Fprintf(&b, "\t\t%s = %s\n", psQuote(cmd.name), psFlags(c.cmdFlags[cmd.name]))
+	}
+	b.WriteString(`	}
+
+	$words = @($commandAst.CommandElements | Select-Object -Skip 1 |
+		Where-Object { $_.Extent.EndOffset -lt $cursorPosition } | ForEach-Object { $_.ToString() })
+	$cmd = ''
+	if ($words.Count -gt 0 -and $commands.Contains($words[0]) -and $words -notcontains '--') {
+		$cmd = $words[0]
+	}
+
+	$candidates = @{}
+	if ($wordToComplete -like '-*') {
+		$candidates = $flags[$cmd]
+	} elseif ($words.Count -eq 0) {
+		$candidates = $commands
+	} elseif ($cmd -and $verbs.ContainsKey($cmd) -and $words.Count -eq 1) {
+		foreach ($verb in $verbs[$cmd]) {
+			$candidates[$verb] = $verb
+		}
+	}
+	foreach ($name in $candidates.Keys | Where-Object { $_ -like "$wordToComplete*" } | Sort-Object) {
+		[System.Management.Automation.CompletionResult]::new($name, $name, 'ParameterValue', $candidates[$name])
+	}
+}
+`)
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const defaultConfigName = ".puzldai.toml"
+
+type agentConfig struct {
+	Provider  string `toml:"provider"`
+	Model     string `toml:"model"`
+	BaseURL   string `toml:"base_url"`
+	APIKeyEnv string `toml:"api_key_env"`
+
+	MaxOutputTokens int           `toml:"max_output_tokens"`
+	Temperature     *float64      `toml:"temperature"`
+	TopP            *float64      `toml:"top_p"`
+	TokenBudget     int           `toml:"token_budget"`
+	Deadline        time.Duration `toml:"deadline"`
+	TurnTimeout     time.Duration `toml:"turn_timeout"`
+
+	Proxy          string        `toml:"proxy"`
+	CACert         string        `toml:"ca_cert"`
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+	RequestTimeout time.Duration `toml:"request_timeout"`
+	CacheDir       string        `toml:"cache_dir"`
+	CacheTTL       time.Duration `toml:"cache_ttl"`
+	BatchAPI       bool          `toml:"batch_api"`
+	BatchPoll      time.Duration `toml:"batch_poll"`
+
+	Approval           string                   `toml:"approval"`
+	Permissions        string                   `toml:"permissions"`
+	CompletionContract string                   `toml:"completion_contract"`
+	AskDefault         string                   `toml:"ask_default"`
+	StallThreshold     int                      `toml:"stall_threshold"`
+	RepoMapTokens      int                      `toml:"repo_map_tokens"`
+	Watch              bool                     `toml:"watch"`
+	Audit              bool                     `toml:"audit"`
+	EncryptSessions    bool                     `toml:"encrypt_sessions"`
+	MaxFilesChanged    int                      `toml:"max_files_changed"`
+	MaxDiffLines       int                      `toml:"max_diff_lines"`
+	ReviewModel        string                   `toml:"review_model"`
+	ReviewRounds       int                      `toml:"review_rounds"`
+	VisualReview       bool                     `toml:"visual_review"`
+	Browser            string                   `toml:"browser"`
+	Verify             string                   `toml:"verify"`
+	Repro              string                   `toml:"repro"`
+	Coverage           float64                  `toml:"coverage"`
+	Scope              []string                 `toml:"scope"`
+	ProtectedPaths     []string                 `toml:"protected_paths"`
+	Bootstrap          bool                     `toml:"bootstrap"`
+	Dotenv             bool                     `toml:"dotenv"`
+	JudgeModel         string                   `toml:"judge_model"`
+	DefaultProfile     string                   `toml:"default_profile"`
+	Profiles           map[string]profileConfig `toml:"profile"`
+
+	Format     map[string]string          `toml:"format"`
+	History    historyConfig              `toml:"history"`
+	Pipeline   pipelineConfig             `toml:"pipeline"`
+	Egress     egressConfig               `toml:"egress"`
+	RateLimits map[string]rateLimitConfig `toml:"rate_limit"`
+	SQL        map[string]sqlConnConfig   `toml:"sql"`
+	Kubernetes kubeConfig                 `toml:"kubernetes"`
+	Docker     dockerConfig               `toml:"docker"`
+	OpenAPI    openAPIConfig              `toml:"openapi"`
+	Commit     commitConfig               `toml:"commit"`
+	Jira       jiraConfig                 `toml:"jira"`
+	Linear     linearConfig               `toml:"linear"`
+	Report     reportConfig               `toml:"report"`
+	Schedules  map[string]scheduleConfig  `toml:"schedule"`
+	Serve      serveConfig                `toml:"serve"`
+	Tenants    map[string]tenantConfig    `toml:"tenant"`
+	Sessions   sessionsConfig             `toml:"sessions"`
+}
+
+// profileConfig is a named bundle of provider and policy settings; the
+// selected profile overrides the matching top-level values.
+type profileConfig struct {
+	Provider           string        `toml:"provider"`
+	Model              string        `toml:"model"`
+	BaseURL            string        `toml:"base_url"`
+	APIKeyEnv          string        `toml:"api_key_env"`
+	MaxOutputTokens    int           `toml:"max_output_tokens"`
+	Temperature        *float64      `toml:"temperature"`
+	TopP               *float64      `toml:"top_p"`
+	Proxy              string        `toml:"proxy"`
+	CACert             string        `toml:"ca_cert"`
+	ConnectTimeout     time.Duration `toml:"connect_timeout"`
+	RequestTimeout     time.Duration `toml:"request_timeout"`
+	Approval           string        `toml:"approval"`
+	Permissions        string        `toml:"permissions"`
+	AllowClusterWrites bool          `toml:"allow_cluster_writes"`
+}
+
+// loadConfig reads the agent config from path, or from PUZLDAI_CONFIG or
+// <cwd>/.puzldai.toml when path is empty. A missing default file is not an error.
+// With dotenv set, it also loads the .env files of cwd; see loadDotenv.
+func loadConfig(cwd, path string) (*agentConfig, error) {
+	cfg := &agentConfig{}
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv("PUZLDAI_CONFIG")
+		explicit = path != ""
+	}
+	if path == "" {
+		path = filepath.Join(cwd, defaultConfigName)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if _, err := toml.Decode(string(data), cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Dotenv {
+		if _, err := loadDotenv(cwd); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// applyProfile overlays the named profile onto the top-level settings.
+func (c *agentConfig) applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("unknown profile %q (no [profile.*] sections in config)", name)
+		}
+		return fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	c.Provider = firstNonEmpty(p.Provider, c.Provider)
+	c.Model = firstNonEmpty(p.Model, c.Model)
+	c.BaseURL = firstNonEmpty(p.BaseURL, c.BaseURL)
+	c.APIKeyEnv = firstNonEmpty(p.APIKeyEnv, c.APIKeyEnv)
+	if p.MaxOutputTokens > 0 {
+		c.MaxOutputTokens = p.MaxOutputTokens
+	}
+	if p.Temperature != nil {
+		c.Temperature = p.Temperature
+	}
+	if p.TopP != nil {
+		c.TopP = p.TopP
+	}
+	c.Proxy = firstNonEmpty(p.Proxy, c.Proxy)
+	c.CACert = firstNonEmpty(p.CACert, c.CACert)
+	c.ConnectTimeout = firstPositive(p.ConnectTimeout, c.ConnectTimeout)
+	c.RequestTimeout = firstPositive(p.RequestTimeout, c.RequestTimeout)
+	c.Approval = firstNonEmpty(p.Approval, c.Approval)
+	c.Permissions = firstNonEmpty(p.Permissions, c.Permissions)
+	if p.AllowClusterWrites {
+		c.Kubernetes.AllowWrites = true
+	}
+	return nil
+}
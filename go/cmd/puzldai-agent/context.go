@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxContextBytes is the total budget for -context attachments.
+const maxContextBytes = 100_000
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// contextAttachments renders the -context files for the first user message.
+// Files share a budget of budget bytes in the order given; a file that does
+// not fit is truncated and later ones are listed by name only, so the agent
+// can view them itself.
+func contextAttachments(cwd string, paths []string, budget int) (string, error) {
+	if len(paths) == 0 {
+		return "", nil
+	}
+	var sb strings.Builder
+	sb.WriteString("\n\n## Context files\n")
+	var omitted []string
+	for _, p := range paths {
+		full := resolvePath(cwd, p)
+		data, err := os.ReadFile(full)
+		if err != nil {
+			return "", fmt.Errorf("context file: %w", err)
+		}
+		name := displayPath(cwd, full)
+		if bytes.IndexByte(data, 0) >= 0 {
+			omitted = append(omitted, name+" (binary)")
+			continue
+		}
+		if budget <= 0 {
+			omitted = append(omitted, name)
+			continue
+		}
+		content := truncateOutput(string(data), budget)
+		budget -= len(data)
+		fence := "```"
+		for strings.Contains(content, fence) {
+			fence += "`"
+		}
+		block := fence + strings.TrimPrefix(filepath.Ext(name), ".") + "\n" + content
+		if !strings.HasSuffix(content, "\n") {
+			block += "\n"
+		}
+		block += fence
+		if outsideWorkspace(cwd, full) {
+			block = wrapUntrusted("context "+name, block)
+		}
+		sb.WriteString("\n### " + name + "\n" + block + "\n")
+	}
+	if len(omitted) > 0 {
+		sb.WriteString("\nNot included (over the size budget or binary; use view if needed): " + strings.Join(omitted, ", ") + "\n")
+	}
+	return sb.String(), nil
+}
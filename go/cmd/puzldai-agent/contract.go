@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Completion contracts: how the model must signal that it is done.
+const (
+	contractNone   = "none"
+	contractResult = "result"
+	contractFinish = "finish"
+)
+
+// Outcome statuses. The first three are chosen by the model; the rest are
+// set by the loop itself.
+const (
+	outcomeSuccess        = "success"
+	outcomeBlocked        = "blocked"
+	outcomeNeedsInput     = "needs_input"
+	outcomeUnknown        = "unknown"
+	outcomeMaxIterations  = "max_iterations"
+	outcomeStalled        = "stalled"
+	outcomeBudgetExceeded = "budget_exceeded"
+	outcomeCancelled      = "cancelled"
+	outcomeTimedOut       = "timed_out"
+	outcomeChangeLimit    = "change_limit_exceeded"
+	outcomeError          = "error"
+)
+
+var modelOutcomes = []string{outcomeSuccess, outcomeBlocked, outcomeNeedsInput}
+
+// agentOutcome is the machine-readable result written by -outcome-out.
+type agentOutcome struct {
+	Status     string `json:"status"`
+	Summary    string `json:"summary"`
+	Iterations int    `json:"iterations"`
+	// Error is the code of the failure kind of a run that did not finish
+	// (see agent.Code); with it, a blocked run that a guard refused can be
+	// told apart from one the model gave up on.
+	Error string `json:"error,omitempty"`
+	// AffectedTargets are the build targets the run's changes affect, with
+	// -scope.
+	AffectedTargets []string `json:"affected_targets,omitempty"`
+	// UndeclaredChanges are the files changed outside the file tools,
+	// with -audit.
+	UndeclaredChanges []auditChange `json:"undeclared_changes,omitempty"`
+	// CostUSD is the estimated cost of the run's own model requests; it is
+	// missing when a model's price is unknown.
+	CostUSD *float64 `json:"cost_usd,omitempty"`
+}
+
+type completionContract struct {
+	mode string
+	// reminded is set once the model has been told it skipped the contract;
+	// a second miss is accepted with status "unknown" rather than looping.
+	reminded bool
+}
+
+func newContract(mode string) (*completionContract, error) {
+	switch mode {
+	case "", contractNone:
+		return &completionContract{mode: contractNone}, nil
+	case contractResult, contractFinish:
+		return &completionContract{mode: mode}, nil
+	default:
+		return nil, fmt.Errorf("invalid -contract %q (want none, result, or finish)", mode)
+	}
+}
+
+func (c *completionContract) instructions() string {
+	statuses := strings.Join(modelOutcomes, ", ")
+	switch c.mode {
+	case contractResult:
+		return "\n# Finishing\n\nEnd your final reply with a `## Result` section. Its first line must be " +
+			"`Status: <" + strings.Join(modelOutcomes, "|") + ">`, followed by a short summary of what was done or what is blocking you.\n"
+	case contractFinish:
+		return "\n# Finishing\n\nWhen you are done, call the finish tool exactly once with a status (" + statuses +
+			") and a summary. Do not end with a plain reply.\n"
+	}
+	return ""
+}
+
+func (c *completionContract) tools() []toolDef {
+	if c.mode != contractFinish {
+		return nil
+	}
+	return []toolDef{{
+		name:        "finish",
+		description: "End the task and report the outcome",
+		params: []toolParam{
+			required("status", "string", "").oneOf(modelOutcomes...),
+			required("summary", "string", "what was done, or what is blocking"),
+		},
+		fn: func(_ context.Context, _ string, args map[string]any) (string, error) {
+			_, err := finishOutcome(args)
+			if err != nil {
+				return "", err
+			}
+			return "finished", nil
+		},
+	}}
+}
+
+func finishOutcome(args map[string]any) (agentOutcome, error) {
+	status, _ := argString(args, "status")
+	summary, _ := argString(args, "summary")
+	if !isModelOutcome(status) {
+		return agentOutcome{}, fmt.Errorf("finish: status must be one of %s", strings.Join(modelOutcomes, ", "))
+	}
+	return agentOutcome{Status: status, Summary: strings.TrimSpace(summary)}, nil
+}
+
+func isModelOutcome(status string) bool {
+	for _, s := range modelOutcomes {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// finished returns the outcome of a successful finish call, if any.
+func (c *completionContract) finished(calls []toolCall, results []toolResult) (agentOutcome, bool) {
+	if c.mode != contractFinish {
+		return agentOutcome{}, false
+	}
+	for i, call := range calls {
+		if call.name != "finish" || i >= len(results) || results[i].isError {
+			continue
+		}
+		if outcome, err := finishOutcome(call.arguments); err == nil {
+			return outcome, true
+		}
+	}
+	return agentOutcome{}, false
+}
+
+// final interprets a reply without tool calls. It returns a reminder to send
+// back to the model when the reply does not satisfy the contract yet.
+func (c *completionContract) final(text string) (agentOutcome, string) {
+	switch c.mode {
+	case contractResult:
+		if outcome, err := parseResultSection(text); err == nil {
+			return outcome, ""
+		} else if !c.reminded {
+			c.reminded = true
+			return agentOutcome{}, "Contract not met: " + err.Error() + ". End your reply with a `## Result` section starting with a Status line."
+		}
+	case contractFinish:
+		if !c.reminded {
+			c.reminded = true
+			return agentOutcome{}, "You ended without calling the finish tool. Call finish with a status and a summary."
+		}
+	default:
+		return agentOutcome{Status: outcomeSuccess, Summary: strings.TrimSpace(text)}, ""
+	}
+	return agentOutcome{Status: outcomeUnknown, Summary: strings.TrimSpace(text)}, ""
+}
+
+var (
+	resultHeadingRe = regexp.MustCompile(`(?im)^#{1,3}\s*Result\s*$`)
+	nextHeadingRe   = regexp.MustCompile(`(?m)^#{1,3}\s`)
+	statusLineRe    = regexp.MustCompile(`(?im)^\s*\**status\**\s*:\s*\**\s*([a-z_]+)`)
+)
+
+func parseResultSection(text string) (agentOutcome, error) {
+	loc := resultHeadingRe.FindStringIndex(text)
+	if loc == nil {
+		return agentOutcome{}, errors.New("the reply has no ## Result section")
+	}
+	section := text[loc[1]:]
+	if next := nextHeadingRe.FindStringIndex(section); next != nil {
+		section = section[:next[0]]
+	}
+	m := statusLineRe.FindStringSubmatchIndex(section)
+	if m == nil {
+		return agentOutcome{}, errors.New("the ## Result section has no Status line")
+	}
+	status := strings.ToLower(section[m[2]:m[3]])
+	if !isModelOutcome(status) {
+		return agentOutcome{}, fmt.Errorf("status %q is not one of %s", status, strings.Join(modelOutcomes, ", "))
+	}
+	summary := ""
+	if lineEnd := strings.IndexByte(section[m[1]:], '\n'); lineEnd >= 0 {
+		summary = section[m[1]+lineEnd:]
+	}
+	return agentOutcome{Status: status, Summary: strings.TrimSpace(summary)}, nil
+}
+
+func writeOutcome(path string, outcome agentOutcome) {
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(outcome, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to write outcome:", err)
+	}
+}
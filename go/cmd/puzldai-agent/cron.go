@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a five-field cron expression: minute, hour, day of month,
+// month, and day of week, each a set of allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// When both day fields are restricted, a day matching either runs, as
+	// in cron.
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+var cronMacros = map[string]string{
+	"@yearly": "0 0 1 1 *", "@annually": "0 0 1 1 *", "@monthly": "0 0 1 * *",
+	"@weekly": "0 0 * * 0", "@daily": "0 0 * * *", "@midnight": "0 0 * * *", "@hourly": "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses expr in loc. Fields take *, numbers, ranges (1-5),
+// steps (*/15, 0-30/10), lists of those, and month and day names; the
+// @hourly, @daily, @weekly, @monthly, and @yearly macros are accepted too.
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if m, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron %q: want 5 fields (minute hour day month weekday)", expr)
+	}
+	c := &cronSchedule{loc: loc, domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*")}
+	var err error
+	parse := func(field string, min, max int, names []string) uint64 {
+		var bits uint64
+		if err != nil {
+			return 0
+		}
+		bits, err = parseCronField(field, min, max, names)
+		if err != nil {
+			err = fmt.Errorf("invalid cron %q: %w", expr, err)
+		}
+		return bits
+	}
+	c.minute = parse(fields[0], 0, 59, nil)
+	c.hour = parse(fields[1], 0, 23, nil)
+	c.dom = parse(fields[2], 1, 31, nil)
+	c.month = parse(fields[3], 1, 12, cronMonths)
+	c.dow = parse(fields[4], 0, 7, cronDays)
+	if err != nil {
+		return nil, err
+	}
+	// 7 is Sunday too.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid cron %q: it never runs", expr)
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, n := range names {
+			if strings.EqualFold(s, n) {
+				// Month names start at 1, day names at 0.
+				return i + min, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("%q is not in %d-%d", s, min, max)
+		}
+		return v, nil
+	}
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after t that the schedule runs, or the zero
+// time when it does not run within five years.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		switch {
+		case c.month&(1<<uint(mo)) == 0:
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, mo, d, t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
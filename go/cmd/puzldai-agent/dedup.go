@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// unchangedPrefix starts the note that replaces a repeated view.
+const unchangedPrefix = "[unchanged since "
+
+// viewDedup remembers what each view returned, so re-reading a file that
+// has not changed costs a line instead of the whole file again. A nil
+// dedup passes results through.
+//
+// A dedup belongs to one transcript: the notes point at calls the model
+// must be able to find in it. The reviewer and other loops that run tools
+// on their own transcript install their own.
+type viewDedup struct {
+	mu    sync.Mutex
+	views map[string]seenView
+	// inTranscript reports whether a call's result is in the transcript;
+	// a note only points at one that is.
+	inTranscript func(id string) bool
+}
+
+type seenView struct {
+	hash [sha256.Size]byte
+	id   string
+}
+
+func newViewDedup(inTranscript func(id string) bool) *viewDedup {
+	return &viewDedup{views: map[string]seenView{}, inTranscript: inTranscript}
+}
+
+// resultsIn returns whether the transcript *messages holds the result of a
+// call, for newViewDedup. It reads the slice when called, so the transcript
+// may grow meanwhile.
+func resultsIn(messages *[]agentMessage) func(id string) bool {
+	return func(id string) bool {
+		for _, m := range *messages {
+			for _, r := range m.toolResults {
+				if r.id == id {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+type viewDedupKey struct{}
+
+func withViewDedup(ctx context.Context, d *viewDedup) context.Context {
+	return context.WithValue(ctx, viewDedupKey{}, d)
+}
+
+func viewDedupFrom(ctx context.Context) *viewDedup {
+	d, _ := ctx.Value(viewDedupKey{}).(*viewDedup)
+	return d
+}
+
+// result returns content, or a note pointing at the earlier call when the
+// file at full gave the same content before. path is the name the model
+// used.
+func (d *viewDedup) result(full, path, id, content string) string {
+	if d == nil {
+		return content
+	}
+	hash := sha256.Sum256([]byte(content))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if seen, ok := d.views[full]; ok && seen.hash == hash && (d.inTranscript == nil || d.inTranscript(seen.id)) {
+		return unchangedNote(seen.id, path)
+	}
+	d.views[full] = seenView{hash: hash, id: id}
+	return content
+}
+
+func unchangedNote(id, path string) string {
+	return fmt.Sprintf("%s%s: %s has the same content as that view returned]", unchangedPrefix, id, path)
+}
+
+// unchangedSince returns the call id a note from result points at.
+func unchangedSince(content string) (string, bool) {
+	rest, ok := strings.CutPrefix(content, unchangedPrefix)
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, ": ")
+	return id, ok
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+)
+
+// debugMux serves the runtime's profiles and counters: /debug/pprof/ for
+// go tool pprof, and /debug/vars with memory statistics as JSON.
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// startDebugServer serves debugMux on addr for the rest of the process.
+// The endpoints expose command lines and memory contents, so addr should be
+// a loopback address.
+func startDebugServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "diagnostics on http://%s/debug/pprof/\n", ln.Addr())
+	srv := &http.Server{Handler: debugMux(), ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	return nil
+}
+
+// startProfiles begins the profiles named in kinds (cpu, mem, or both,
+// comma-separated) and returns a function that writes them. Profiles are
+// written to dir as puzldai-<kind>.pprof.
+func startProfiles(kinds, dir string) (func(), error) {
+	var cpu, mem bool
+	for _, kind := range splitList(kinds) {
+		switch kind {
+		case "cpu":
+			cpu = true
+		case "mem":
+			mem = true
+		default:
+			return nil, fmt.Errorf("invalid -pprof %q (cpu, mem)", kind)
+		}
+	}
+	if !cpu && !mem {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(firstNonEmpty(dir, "."), 0o755); err != nil {
+		return nil, err
+	}
+	path := func(kind string) string {
+		return filepath.Join(firstNonEmpty(dir, "."), "puzldai-"+kind+".pprof")
+	}
+
+	var cpuFile *os.File
+	if cpu {
+		f, err := os.Create(path("cpu"))
+		if err != nil {
+			return nil, err
+		}
+		if err := runtimepprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		cpuFile = f
+	}
+	return func() {
+		var errs []error
+		if cpuFile != nil {
+			runtimepprof.StopCPUProfile()
+			errs = append(errs, cpuFile.Close())
+			fmt.Fprintln(os.Stderr, "cpu profile written to", cpuFile.Name())
+		}
+		if mem {
+			// An up-to-date heap profile needs a collection first.
+			runtime.GC()
+			f, err := os.Create(path("mem"))
+			if err == nil {
+				err = runtimepprof.WriteHeapProfile(f)
+				errs = append(errs, f.Close())
+			}
+			errs = append(errs, err)
+			if err == nil {
+				var ms runtime.MemStats
+				runtime.ReadMemStats(&ms)
+				fmt.Fprintf(os.Stderr, "mem profile written to %s (heap in use %s of %s reserved, %s allocated in total, %d GCs)\n",
+					f.Name(), formatSize(int64(ms.HeapInuse)), formatSize(int64(ms.HeapSys)), formatSize(int64(ms.TotalAlloc)), ms.NumGC)
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			fmt.Fprintln(os.Stderr, "pprof:", err)
+		}
+	}, nil
+}
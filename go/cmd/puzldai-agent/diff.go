@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	diffContext  = 3
+	maxDiffBytes = 8_000
+	// maxDiffCells bounds the LCS table; larger changed regions are shown as
+	// a plain delete-then-insert instead.
+	maxDiffCells = 4_000_000
+)
+
+type diffOp struct {
+	kind byte // ' ', '-', '+'
+	text string
+}
+
+// unifiedDiff renders the change from before to after as a unified diff with
+// diffContext lines of context, truncated to maxDiffBytes. An empty before
+// is shown as a new file.
+func unifiedDiff(name, before, after string) string {
+	if before == after {
+		return ""
+	}
+	ops := diffLines(splitDiffLines(before), splitDiffLines(after))
+
+	var sb strings.Builder
+	if before == "" {
+		sb.WriteString("--- /dev/null\n")
+	} else {
+		sb.WriteString("--- a/" + name + "\n")
+	}
+	sb.WriteString("+++ b/" + name + "\n")
+
+	for start := 0; start < len(ops); {
+		// Find the next change and extend the hunk while changes are within
+		// two context windows of each other.
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for i := first; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				if i-last > 2*diffContext {
+					break
+				}
+				last = i
+			}
+		}
+		lo := max(first-diffContext, start)
+		hi := min(last+diffContext+1, len(ops))
+
+		aLine, bLine := 1, 1
+		for _, op := range ops[:lo] {
+			if op.kind != '+' {
+				aLine++
+			}
+			if op.kind != '-' {
+				bLine++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, op := range ops[lo:hi] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		if aCount == 0 {
+			aLine--
+		}
+		if bCount == 0 {
+			bLine--
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aLine, aCount, bLine, bCount)
+		for _, op := range ops[lo:hi] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.text)
+			sb.WriteByte('\n')
+		}
+		start = hi
+	}
+	return truncateOutput(sb.String(), maxDiffBytes)
+}
+
+func splitDiffLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines trims the common prefix and suffix, then aligns the middle with
+// a longest-common-subsequence table.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, l := range a[:prefix] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(ma)*len(mb) > maxDiffCells {
+		for _, l := range ma {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range mb {
+			ops = append(ops, diffOp{'+', l})
+		}
+	} else {
+		ops = append(ops, lcsDiff(ma, mb)...)
+	}
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
+
+func lcsDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	// lcs[i][j] is the LCS length of a[i:] and b[j:].
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	ops := make([]diffOp, 0, n+m)
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// editReport is the result of write and edit: "ok", any note about how the
+// edit matched, and a bounded diff so the change can be checked in place.
+func editReport(name, note, before, after string) string {
+	var sb strings.Builder
+	sb.WriteString("ok")
+	if note != "" {
+		sb.WriteString(" (" + note + ")")
+	}
+	diff := unifiedDiff(strings.TrimPrefix(name, "/"), before, after)
+	if diff == "" {
+		sb.WriteString(" (no changes)")
+	} else {
+		sb.WriteString("\n" + diff)
+	}
+	return sb.String()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxDigestPatch bounds each task's diff in a report.
+	maxDigestPatch   = 20_000
+	defaultSMTPPass  = "PUZLDAI_SMTP_PASSWORD"
+	digestTimeout    = 30 * time.Second
+	digestTimeFormat = "2006-01-02 15:04 MST"
+)
+
+// reportConfig is the [report] section: where batch reports are delivered
+// besides -report.
+type reportConfig struct {
+	WebhookURL string   `toml:"webhook_url"`
+	EmailTo    []string `toml:"email_to"`
+	// SMTPAddr is host:port; the connection is upgraded with STARTTLS when
+	// the server offers it.
+	SMTPAddr        string `toml:"smtp_addr"`
+	SMTPFrom        string `toml:"smtp_from"`
+	SMTPUser        string `toml:"smtp_user"`
+	SMTPPasswordEnv string `toml:"smtp_password_env"`
+}
+
+// digest is the consolidated report of a batch run. It is also the JSON
+// posted to the report webhook, with the markdown as text.
+type digest struct {
+	// Label names the run in the title; the default is "puzldai batch".
+	Label    string       `json:"label,omitempty"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Tasks    []digestTask `json:"tasks"`
+}
+
+type digestTask struct {
+	Name    string   `json:"name"`
+	Repo    string   `json:"repo"`
+	Status  string   `json:"status"`
+	Summary string   `json:"summary"`
+	CostUSD *float64 `json:"cost_usd,omitempty"`
+	// Duration is in seconds.
+	Duration float64 `json:"duration"`
+	// Branch holds the changes; it is empty when nothing changed. Link
+	// opens a pull or merge request for it, once pushed.
+	Branch string       `json:"branch,omitempty"`
+	Link   string       `json:"link,omitempty"`
+	Files  []digestFile `json:"files"`
+	Patch  string       `json:"-"`
+}
+
+type digestFile struct {
+	Path      string `json:"path"`
+	Change    string `json:"change"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// title sums up the run in a line, for headings and email subjects.
+func (d *digest) title() string {
+	counts := map[string]int{}
+	for _, t := range d.Tasks {
+		counts[t.Status]++
+	}
+	statuses := make([]string, 0, len(counts))
+	for s := range counts {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	parts := make([]string, len(statuses))
+	for i, s := range statuses {
+		parts[i] = fmt.Sprintf("%d %s", counts[s], s)
+	}
+	return fmt.Sprintf("%s: %d of %d tasks succeeded (%s)", firstNonEmpty(d.Label, "puzldai batch"), counts[outcomeSuccess], len(d.Tasks), strings.Join(parts, ", "))
+}
+
+// cost is the total estimate; it is nil when any task's is unknown.
+func (d *digest) cost() *float64 {
+	var total float64
+	for _, t := range d.Tasks {
+		if t.CostUSD == nil {
+			return nil
+		}
+		total += *t.CostUSD
+	}
+	return &total
+}
+
+func (d *digest) overview() string {
+	return fmt.Sprintf("Started %s, took %s. Estimated cost: %s.", d.Started.Format(digestTimeFormat), d.Finished.Sub(d.Started).Round(time.Second), formatCost(d.cost()))
+}
+
+func (t *digestTask) changes() string {
+	if len(t.Files) == 0 {
+		return "none"
+	}
+	var added, deleted int
+	for _, f := range t.Files {
+		added += f.Additions
+		deleted += f.Deletions
+	}
+	return fmt.Sprintf("%d files, +%d -%d", len(t.Files), added, deleted)
+}
+
+func formatCost(cost *float64) string {
+	if cost == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("$%.2f", *cost)
+}
+
+// markdown renders the report: a table of the tasks, then each task's
+// summary and diff.
+func (d *digest) markdown() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s\n\n%s\n\n", d.title(), d.overview())
+	sb.WriteString("| Task | Repository | Status | Changes | Cost | Branch |\n| --- | --- | --- | --- | ---: | --- |\n")
+	cell := strings.NewReplacer("|", `\|`, "\n", " ").Replace
+	for _, t := range d.Tasks {
+		branch := "-"
+		switch {
+		case t.Link != "":
+			branch = fmt.Sprintf("[`%s`](%s)", t.Branch, t.Link)
+		case t.Branch != "":
+			branch = "`" + t.Branch + "`"
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s | %s | %s | %s |\n", cell(t.Name), cell(t.Repo), t.Status, t.changes(), formatCost(t.CostUSD), branch)
+	}
+	for _, t := range d.Tasks {
+		fmt.Fprintf(&sb, "\n## %s: %s\n\n", t.Name, t.Status)
+		if summary := strings.TrimSpace(t.Summary); summary != "" {
+			sb.WriteString(summary + "\n")
+		}
+		if t.Patch == "" {
+			continue
+		}
+		shown := truncateOutput(t.Patch, maxDigestPatch)
+		fence := "```"
+		for strings.Contains(shown, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(&sb, "\n<details><summary>Diff (%s)</summary>\n\n%sdiff\n%s\n%s\n\n</details>\n", t.changes(), fence, strings.TrimRight(shown, "\n"), fence)
+	}
+	return sb.String()
+}
+
+// html renders the report as a standalone page, for email and browsers.
+func (d *digest) html() string {
+	e := html.EscapeString
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title>\n", e(d.title()))
+	sb.WriteString("<style>body{font-family:sans-serif;max-width:60em}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}pre{background:#f6f8fa;padding:8px;overflow-x:auto}</style>\n</head><body>\n")
+	fmt.Fprintf(&sb, "<h1>%s</h1>\n<p>%s</p>\n", e(d.title()), e(d.overview()))
+	sb.WriteString("<table>\n<tr><th>Task</th><th>Repository</th><th>Status</th><th>Changes</th><th>Cost</th><th>Branch</th></tr>\n")
+	for _, t := range d.Tasks {
+		branch := "-"
+		switch {
+		case t.Link != "":
+			branch = fmt.Sprintf("<a href=\"%s\"><code>%s</code></a>", e(t.Link), e(t.Branch))
+		case t.Branch != "":
+			branch = "<code>" + e(t.Branch) + "</code>"
+		}
+		fmt.Fprintf(&sb, "<tr><td><a href=\"#%s\">%s</a></td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			e(t.Name), e(t.Name), e(t.Repo), e(t.Status), e(t.changes()), formatCost(t.CostUSD), branch)
+	}
+	sb.WriteString("</table>\n")
+	for _, t := range d.Tasks {
+		fmt.Fprintf(&sb, "<h2 id=\"%s\">%s: %s</h2>\n", e(t.Name), e(t.Name), e(t.Status))
+		if summary := strings.TrimSpace(t.Summary); summary != "" {
+			fmt.Fprintf(&sb, "<pre>%s</pre>\n", e(summary))
+		}
+		if t.Patch != "" {
+			fmt.Fprintf(&sb, "<details><summary>Diff (%s)</summary>\n<pre>%s</pre>\n</details>\n", e(t.changes()), e(truncateOutput(t.Patch, maxDigestPatch)))
+		}
+	}
+	sb.WriteString("</body></html>\n")
+	return sb.String()
+}
+
+// deliverDigest posts and emails the report where asked to, and returns
+// the failures.
+func deliverDigest(cfg reportConfig, webhook string, to []string, d *digest) error {
+	var errs []error
+	if webhook != "" {
+		if err := postDigest(context.Background(), webhook, d); err != nil {
+			errs = append(errs, fmt.Errorf("report webhook: %w", err))
+		}
+	}
+	if len(to) > 0 {
+		if err := emailDigest(cfg, to, d); err != nil {
+			errs = append(errs, fmt.Errorf("email: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkDigest refuses report destinations the policy does not allow run
+// data to be sent to.
+func (p *orgPolicy) checkDigest(cfg reportConfig, webhook string, to []string) error {
+	if err := p.checkEndpoint(webhook); err != nil {
+		return err
+	}
+	if len(to) > 0 {
+		return p.checkEndpoint("smtp://" + cfg.SMTPAddr)
+	}
+	return nil
+}
+
+// postDigest sends the report to a webhook as JSON. The markdown goes in
+// text, which chat webhooks such as Slack's display.
+func postDigest(ctx context.Context, target string, d *digest) error {
+	ctx, cancel := context.WithTimeout(ctx, digestTimeout)
+	defer cancel()
+	payload := struct {
+		Event string `json:"event"`
+		Text  string `json:"text"`
+		*digest
+	}{"batch", d.markdown(), d}
+	_, err := callJSON(ctx, &http.Client{Timeout: digestTimeout}, http.MethodPost, target, nil, payload, nil)
+	return err
+}
+
+// emailDigest sends the HTML report to the recipients over SMTP.
+func emailDigest(cfg reportConfig, to []string, d *digest) error {
+	if cfg.SMTPAddr == "" || cfg.SMTPFrom == "" {
+		return fmt.Errorf("set smtp_addr and smtp_from in the [report] config section")
+	}
+	host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return fmt.Errorf("invalid smtp_addr %q: %w", cfg.SMTPAddr, err)
+	}
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		passwordEnv := firstNonEmpty(cfg.SMTPPasswordEnv, defaultSMTPPass)
+		password := os.Getenv(passwordEnv)
+		if password == "" {
+			return fmt.Errorf("%s is not set", passwordEnv)
+		}
+		auth = smtp.PlainAuth("", cfg.SMTPUser, password, host)
+	}
+	header := strings.NewReplacer("\r", "", "\n", " ").Replace
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", header(cfg.SMTPFrom), header(strings.Join(to, ", ")), header(d.title()), time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(d.html(), "\n", "\r\n"))
+	return smtp.SendMail(cfg.SMTPAddr, auth, cfg.SMTPFrom, to, []byte(msg.String()))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dockerBuildTimeout = 10 * time.Minute
+const dockerDefaultRunTimeout = 120 * time.Second
+const dockerMaxRunTimeout = 10 * time.Minute
+const dockerOutputLines = 100
+const dockerSessionLabel = "puzldai.session"
+
+type dockerConfig struct {
+	Memory        string  `toml:"memory"`
+	CPUs          float64 `toml:"cpus"`
+	PidsLimit     int     `toml:"pids_limit"`
+	AllowNetwork  bool    `toml:"allow_network"`
+	KeepArtifacts bool    `toml:"keep_artifacts"`
+}
+
+// dockerToolset tracks the images and containers created during a session so
+// they can be removed when the session ends.
+type dockerToolset struct {
+	cfg dockerConfig
+	// fsys is where docker runs. Only docker_build reads the workspace,
+	// so it alone goes through the tool call's file system.
+	fsys       workspaceFS
+	sessionID  string
+	mu         sync.Mutex
+	seq        int
+	images     []string
+	containers []string
+}
+
+func dockerTools(cfg *agentConfig, sess *session) []toolDef {
+	fsys, _ := sess.workspace()
+	if err := fsys.LookPath(context.Background(), "docker"); err != nil {
+		return nil
+	}
+	dt := &dockerToolset{cfg: cfg.Docker, fsys: fsys, sessionID: sess.id}
+	if dt.cfg.Memory == "" {
+		dt.cfg.Memory = "512m"
+	}
+	if dt.cfg.CPUs <= 0 {
+		dt.cfg.CPUs = 1
+	}
+	if dt.cfg.PidsLimit <= 0 {
+		dt.cfg.PidsLimit = 256
+	}
+	if !dt.cfg.KeepArtifacts {
+		sess.onClose(dt.cleanup)
+	}
+
+	network := "network disabled"
+	if dt.cfg.AllowNetwork {
+		network = "network allowed on request"
+	}
+	return []toolDef{
+		{
+			name:        "docker_build",
+			description: "Build a Docker image (tagged and removed at session end)",
+			params: []toolParam{
+				optional("context", "string", "build context directory").withDefault("."),
+				optional("dockerfile", "string", "Dockerfile path"),
+				optional("target", "string", "build stage"),
+			},
+			fn: dt.build,
+		},
+		{
+			name:        "docker_run",
+			description: fmt.Sprintf("Run a container with resource limits (memory %s, %.1f cpus, %s)", dt.cfg.Memory, dt.cfg.CPUs, network),
+			params: []toolParam{
+				required("image", "string", ""),
+				optional("command", "string", "run with sh -c"),
+				optional("mount_workspace", "boolean", "mount the working directory read-only at /workspace"),
+				optional("network", "boolean", ""),
+				optional("detach", "boolean", "return the container name instead of waiting"),
+				optional("timeout", "integer", "seconds").withDefault(120),
+			},
+			fn: dt.run,
+		},
+		{
+			name:        "docker_logs",
+			description: "Fetch logs from a container",
+			params: []toolParam{
+				required("container", "string", "name or id"),
+				optional("tail", "integer", "").withDefault(200),
+			},
+			fn: dt.logs,
+		},
+	}
+}
+
+func (dt *dockerToolset) nextName(kind string) string {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.seq++
+	return fmt.Sprintf("puzldai-%s-%s-%d", kind, dt.sessionID, dt.seq)
+}
+
+func (dt *dockerToolset) build(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	buildCtx := cwd
+	if dir, _ := argString(args, "context"); dir != "" {
+		buildCtx = resolvePath(cwd, dir)
+	}
+	tag := dt.nextName("image")
+	cmdArgs := []string{"build", "--label", dockerSessionLabel + "=" + dt.sessionID, "--tag", tag}
+	if dockerfile, _ := argString(args, "dockerfile"); dockerfile != "" {
+		cmdArgs = append(cmdArgs, "--file", commandPath(cwd, resolvePath(cwd, dockerfile)))
+	}
+	if target, _ := argString(args, "target"); target != "" {
+		if strings.HasPrefix(target, "-") {
+			return "", fmt.Errorf("docker_build: invalid target %q", target)
+		}
+		cmdArgs = append(cmdArgs, "--target", target)
+	}
+	cmdArgs = append(cmdArgs, commandPath(cwd, buildCtx))
+
+	ctx, cancel := context.WithTimeout(ctx, dockerBuildTimeout)
+	defer cancel()
+	out, err := runDocker(ctx, workspaceFSFrom(ctx), cwd, cmdArgs)
+	if err != nil {
+		return "", fmt.Errorf("docker_build: %s", tailLines(out, dockerOutputLines))
+	}
+
+	dt.mu.Lock()
+	dt.images = append(dt.images, tag)
+	dt.mu.Unlock()
+	return fmt.Sprintf("built image %s\n\n%s", tag, tailLines(out, dockerOutputLines)), nil
+}
+
+func (dt *dockerToolset) run(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	image, _ := argString(args, "image")
+	if image == "" || strings.HasPrefix(image, "-") {
+		return "", errors.New("docker_run: missing image")
+	}
+	name := dt.nextName("run")
+	cmdArgs := []string{
+		"run",
+		"--name", name,
+		"--label", dockerSessionLabel + "=" + dt.sessionID,
+		"--memory", dt.cfg.Memory,
+		"--cpus", strconv.FormatFloat(dt.cfg.CPUs, 'f', -1, 64),
+		"--pids-limit", strconv.Itoa(dt.cfg.PidsLimit),
+	}
+	if argBool(args, "network") {
+		if !dt.cfg.AllowNetwork {
+			return "", errors.New("docker_run: network access is disabled (set [docker] allow_network = true)")
+		}
+	} else {
+		cmdArgs = append(cmdArgs, "--network", "none")
+	}
+	if argBool(args, "mount_workspace") {
+		cmdArgs = append(cmdArgs, "--volume", cwd+":/workspace:ro", "--workdir", "/workspace")
+	}
+	detach := argBool(args, "detach")
+	if detach {
+		cmdArgs = append(cmdArgs, "--detach")
+	}
+	cmdArgs = append(cmdArgs, image)
+	if command, _ := argString(args, "command"); command != "" {
+		cmdArgs = append(cmdArgs, "sh", "-c", command)
+	}
+
+	timeout := dockerDefaultRunTimeout
+	if n, ok := argInt(args, "timeout"); ok && n > 0 {
+		timeout = min(time.Duration(n)*time.Second, dockerMaxRunTimeout)
+	}
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dt.mu.Lock()
+	dt.containers = append(dt.containers, name)
+	dt.mu.Unlock()
+
+	out, err := runDocker(runCtx, dt.fsys, cwd, cmdArgs)
+	if runCtx.Err() == context.DeadlineExceeded {
+		runDocker(context.Background(), dt.fsys, cwd, []string{"kill", name})
+		return "", fmt.Errorf("docker_run: timed out after %s (container %s killed)\n%s", timeout, name, tailLines(out, dockerOutputLines))
+	}
+	if detach && err == nil {
+		return "started container " + name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("docker_run: %v (container %s)\n%s", err, name, tailLines(out, dockerOutputLines))
+	}
+	return tailLines(out, dockerOutputLines), nil
+}
+
+func (dt *dockerToolset) logs(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	container, _ := argString(args, "container")
+	if container == "" || strings.HasPrefix(container, "-") {
+		return "", errors.New("docker_logs: missing container")
+	}
+	tail := 200
+	if n, ok := argInt(args, "tail"); ok && n > 0 {
+		tail = n
+	}
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	out, err := runDocker(ctx, dt.fsys, cwd, []string{"logs", "--tail", strconv.Itoa(tail), container})
+	if err != nil {
+		return "", fmt.Errorf("docker_logs: %s", strings.TrimSpace(out))
+	}
+	return truncateOutput(collapseRepeatedLines(out), maxFileBytes), nil
+}
+
+// cleanup removes every container and image created during the session.
+func (dt *dockerToolset) cleanup() {
+	dt.mu.Lock()
+	containers, images := dt.containers, dt.images
+	dt.containers, dt.images = nil, nil
+	dt.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if len(containers) > 0 {
+		if out, err := runDocker(ctx, dt.fsys, "", append([]string{"rm", "--force"}, containers...)); err != nil {
+			fmt.Fprintln(os.Stderr, "docker cleanup:", strings.TrimSpace(out))
+		}
+	}
+	if len(images) > 0 {
+		if out, err := runDocker(ctx, dt.fsys, "", append([]string{"rmi", "--force"}, images...)); err != nil {
+			fmt.Fprintln(os.Stderr, "docker cleanup:", strings.TrimSpace(out))
+		}
+	}
+}
+
+func runDocker(ctx context.Context, fsys workspaceFS, cwd string, args []string) (string, error) {
+	cmd, err := fsys.Command(ctx, cwd, "docker", args...)
+	if err != nil {
+		return "", err
+	}
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+func tailLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) <= n {
+		return strings.Join(lines, "\n")
+	}
+	return fmt.Sprintf("... (%d lines omitted)\n%s", len(lines)-n, strings.Join(lines[len(lines)-n:], "\n"))
+}
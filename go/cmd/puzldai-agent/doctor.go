@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const doctorUsage = "usage: puzldai-agent doctor [-cwd dir] [-provider name] [-offline]"
+
+const (
+	doctorTimeout = 15 * time.Second
+	// slowShellStart is how long a login shell may take to start before
+	// doctor warns: every bash tool call pays it.
+	slowShellStart = 2 * time.Second
+)
+
+// doctorResult is the outcome of one check; fix says what to do about a
+// warning or failure.
+type doctorResult struct {
+	status string // ok, warn, or fail
+	check  string
+	detail string
+	fix    string
+}
+
+type doctor struct {
+	policy  *orgPolicy
+	results []doctorResult
+}
+
+func (d *doctor) ok(check, detail string) {
+	d.results = append(d.results, doctorResult{"ok", check, detail, ""})
+}
+
+func (d *doctor) warn(check, detail, fix string) {
+	d.results = append(d.results, doctorResult{"warn", check, detail, fix})
+}
+
+func (d *doctor) fail(check, detail, fix string) {
+	d.results = append(d.results, doctorResult{"fail", check, detail, fix})
+}
+
+// runDoctor implements the doctor subcommand: it checks the environment a
+// run depends on, the config, git, the shell, the provider's key and
+// network path, and the sandbox, and says how to fix what it finds.
+func runDoctor(args []string) int {
+	fs := newFlagSet("doctor")
+	cwdFlag := fs.String("cwd", "", "Workspace whose config and repository to check (default: the current directory)")
+	providerFlag := fs.String("provider", "", "Provider to check: "+providerNames()+" (default: config or anthropic)")
+	offlineFlag := fs.Bool("offline", false, "Skip the checks that contact the provider")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, doctorUsage)
+		return exitUsage
+	}
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "doctor:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+
+	var d doctor
+	cfg, profile := d.config(cwd)
+	d.git(cwd)
+	d.shell()
+	if s, ok := d.provider(cfg, profile, *providerFlag); ok {
+		key := d.apiKey(s)
+		if !*offlineFlag {
+			d.reach(s, key)
+		}
+	}
+	d.sandbox(cfg)
+	return d.report(os.Stdout)
+}
+
+// config loads the config and the profile the way a run does, and the
+// organization policy.
+func (d *doctor) config(cwd string) (*agentConfig, string) {
+	path := firstNonEmpty(os.Getenv("PUZLDAI_CONFIG"), filepath.Join(cwd, defaultConfigName))
+	cfg, err := loadConfig(cwd, "")
+	if err != nil {
+		d.fail("config", err.Error(), "fix the file, or point -config or PUZLDAI_CONFIG at another one")
+		return &agentConfig{}, ""
+	}
+	detail := path
+	if !fileExists(path) {
+		detail = "no " + path + "; using the defaults"
+	}
+	profile := firstNonEmpty(os.Getenv("PUZLDAI_PROFILE"), cfg.DefaultProfile)
+	if err := cfg.applyProfile(profile); err != nil {
+		d.fail("config", err.Error(), "set -profile, PUZLDAI_PROFILE, or default_profile to a [profile.*] section of the config")
+		return cfg, ""
+	}
+	if profile != "" {
+		detail += " (profile " + profile + ")"
+	}
+	_, retentionErr := newRetention(cfg.Sessions, time.Now())
+	problems := 0
+	for _, err := range []error{cfg.Commit.validate(), retentionErr} {
+		if err != nil {
+			d.fail("config", err.Error(), "correct the setting in "+path)
+			problems++
+		}
+	}
+	if err := checkSessionKey(cfg.EncryptSessions); err != nil {
+		d.fail("config", err.Error(), "run puzldai-agent auth session-key, or set "+sessionKeyEnv)
+		problems++
+	}
+	if problems == 0 {
+		d.ok("config", detail)
+	}
+	if cfg.Dotenv {
+		// A file that does not parse already failed loadConfig.
+		switch files, _ := loadDotenv(cwd); {
+		case os.Getenv(noDotenvEnv) != "":
+			d.ok("dotenv", "off (-no-dotenv)")
+		case len(files) == 0:
+			d.warn("dotenv", "dotenv is set, but "+cwd+" has no .env or .env.local", "create .env, or remove dotenv from "+path)
+		default:
+			d.ok("dotenv", strings.Join(files, ", "))
+		}
+	}
+
+	switch d.policy, err = loadOrgPolicy(); {
+	case err != nil:
+		d.fail("policy", err.Error(), "ask whoever manages the organization policy to fix it")
+	case d.policy != nil:
+		d.ok("policy", d.policy.path)
+	}
+	return cfg, profile
+}
+
+func (d *doctor) git(cwd string) {
+	out, err := exec.Command("git", "--version").Output()
+	if err != nil {
+		d.fail("git", "git is not on PATH", "install git; checkpoints, -attempts, reviews, and most subcommands need it")
+		return
+	}
+	version := strings.TrimPrefix(strings.TrimSpace(string(out)), "git version ")
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	root, err := gitRoot(ctx, cwd)
+	if err != nil {
+		d.warn("git", "git "+version+"; "+cwd+" is not in a git repository", "run git init, or run in a repository: checkpoints, -attempts, reviews, and most subcommands need one")
+		return
+	}
+	d.ok("git", "git "+version+"; repository "+root)
+}
+
+// shell checks the shell the bash tool runs commands with: that it starts
+// as a login shell, quickly and without printing anything.
+func (d *doctor) shell() {
+	name, args := "bash", []string{"-lc"}
+	if runtime.GOOS == "windows" {
+		name, args = "powershell", []string{"-NoProfile", "-Command"}
+	}
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		d.fail("shell", name+" is not on PATH; the bash tool runs commands with it", "install "+name)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	const marker = "puzldai-doctor"
+	start := time.Now()
+	out, err := exec.CommandContext(ctx, bin, append(args, "echo "+marker)...).CombinedOutput()
+	took := time.Since(start)
+	if err != nil {
+		d.fail("shell", fmt.Sprintf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, firstLine(strings.TrimSpace(string(out)))),
+			"fix the errors in your login profile (~/.bash_profile, ~/.profile)")
+		return
+	}
+	if extra := strings.TrimSpace(strings.Replace(string(out), marker, "", 1)); extra != "" {
+		d.warn("shell", "the login profile prints output, which ends up in every bash result: "+firstLine(extra),
+			"print only in interactive shells, e.g. behind [[ $- == *i* ]]")
+		return
+	}
+	if took > slowShellStart {
+		d.warn("shell", fmt.Sprintf("%s takes %s to start as a login shell; every bash call pays it", bin, took.Round(100*time.Millisecond)),
+			"move slow setup in your login profile to interactive shells only")
+		return
+	}
+	d.ok("shell", bin)
+}
+
+// provider resolves the provider settings the way a run does.
+func (d *doctor) provider(cfg *agentConfig, profile, name string) (providerSettings, bool) {
+	s := providerSettings{
+		name:      firstNonEmpty(name, cfg.Provider, "anthropic"),
+		baseURL:   cfg.BaseURL,
+		apiKeyEnv: cfg.APIKeyEnv,
+		profile:   profile,
+		transport: transportSettings{
+			proxy:          cfg.Proxy,
+			caCert:         cfg.CACert,
+			connectTimeout: cfg.ConnectTimeout,
+			requestTimeout: doctorTimeout,
+		},
+	}
+	preset, ok := providerPresets[s.name]
+	if !ok {
+		d.fail("provider", fmt.Sprintf("unknown provider %q", s.name), "use one of "+providerNames())
+		return s, false
+	}
+	s.baseURL = firstNonEmpty(s.baseURL, preset.baseURL)
+	s.apiKeyEnv = firstNonEmpty(s.apiKeyEnv, preset.apiKeyEnv)
+	s.model = firstNonEmpty(os.Getenv("PUZLDAI_MODEL"), cfg.Model, preset.defaultModel)
+	if err := d.policy.checkModel(s.name, s.model); err != nil {
+		d.fail("provider", err.Error(), "choose an allowed provider and model in the config")
+		return s, true
+	}
+	d.ok("provider", s.name+", model "+s.model)
+	return s, true
+}
+
+// apiKey reports where the provider's key comes from.
+func (d *doctor) apiKey(s providerSettings) string {
+	key := providerAPIKey(s)
+	switch {
+	case key == "":
+		d.fail("api key", "no key for "+s.name, fmt.Sprintf("export %s, or run puzldai-agent auth login -provider %s", s.apiKeyEnv, s.name))
+	case dotenvVars[s.apiKeyEnv] != "":
+		d.ok("api key", "from "+dotenvVars[s.apiKeyEnv]+" ("+s.apiKeyEnv+")")
+	case os.Getenv(s.apiKeyEnv) != "":
+		d.ok("api key", "from the environment ("+s.apiKeyEnv+")")
+	default:
+		d.ok("api key", "from the OS keychain")
+	}
+	return key
+}
+
+// reach lists the provider's models, which needs the network path to the
+// API, through the configured proxy and certificates, and a valid key.
+func (d *doctor) reach(s providerSettings, key string) {
+	client, err := newHTTPClient(s.transport)
+	if err != nil {
+		d.fail("network", err.Error(), "fix proxy or ca_cert in the config")
+		return
+	}
+	preset := providerPresets[s.name]
+	base := strings.TrimSuffix(s.baseURL, "/")
+	var endpoint string
+	header := http.Header{}
+	switch preset.kind {
+	case "anthropic":
+		endpoint = firstNonEmpty(base, "https://api.anthropic.com") + "/v1/models"
+		header.Set("x-api-key", key)
+		header.Set("anthropic-version", "2023-06-01")
+	case "gemini":
+		endpoint = base + "/models"
+		header.Set("x-goog-api-key", key)
+	default:
+		endpoint = base + "/models"
+		header.Set("Authorization", "Bearer "+key)
+		for k, v := range preset.headers {
+			header.Set(k, v)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		d.fail("network", err.Error(), "fix base_url in the config")
+		return
+	}
+	req.Header = header
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		d.fail("network", err.Error(), networkFix(err))
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	d.ok("network", fmt.Sprintf("%s reachable (%s)", req.URL.Host, time.Since(start).Round(time.Millisecond)))
+	if key == "" {
+		return
+	}
+	switch {
+	case resp.StatusCode < 300:
+		d.ok("api key", "accepted by "+s.name)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		d.fail("api key", fmt.Sprintf("rejected by %s: %s: %s", s.name, resp.Status, firstLine(strings.TrimSpace(string(body)))),
+			fmt.Sprintf("create a new key, then export %s or run puzldai-agent auth login -provider %s", s.apiKeyEnv, s.name))
+	default:
+		d.warn("api key", fmt.Sprintf("could not be checked: %s answered %s", s.name, resp.Status), "")
+	}
+}
+
+// networkFix suggests what to do about a failed request.
+func networkFix(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var verify *tls.CertificateVerificationError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &unknownAuthority) || errors.As(err, &verify):
+		return "a TLS-inspecting proxy? pass its root certificate with -ca-cert or ca_cert"
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &urlErr) && urlErr.Timeout():
+		return "check the connection and firewall; behind a proxy, set HTTPS_PROXY, -proxy, or proxy"
+	}
+	return "check the connection, DNS, and base_url; behind a proxy, set HTTPS_PROXY, -proxy, or proxy"
+}
+
+// sandbox checks what -bootstrap and the docker tools need.
+func (d *doctor) sandbox(cfg *agentConfig) {
+	switch {
+	case inSandbox():
+		d.ok("sandbox", "a container or "+sandboxEnv+"=1; -bootstrap may install tools")
+	case cfg.Bootstrap:
+		d.warn("sandbox", "bootstrap is set, but this is not a sandbox, so nothing is installed",
+			"run in a container, or set "+sandboxEnv+"=1 in a disposable environment")
+	default:
+		d.ok("sandbox", "not a container; -bootstrap is off")
+	}
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		d.ok("docker", "not installed; the docker_build and docker_run tools are off")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", "version", "--format", "{{.Server.Version}}").CombinedOutput()
+	if err != nil {
+		d.warn("docker", "the daemon is not reachable: "+firstLine(strings.TrimSpace(string(out))),
+			"start Docker, or give your user access to its socket; the docker tools fail until then")
+		return
+	}
+	d.ok("docker", "server "+strings.TrimSpace(string(out)))
+}
+
+// report prints the results, and fails when a check did.
+func (d *doctor) report(w io.Writer) int {
+	var warnings, failures int
+	for _, r := range d.results {
+		fmt.Fprintf(w, "%-4s  %-8s  %s\n", r.status, r.check, r.detail)
+		if r.fix != "" {
+			fmt.Fprintf(w, "%16sfix: %s\n", "", r.fix)
+		}
+		switch r.status {
+		case "warn":
+			warnings++
+		case "fail":
+			failures++
+		}
+	}
+	switch {
+	case failures > 0:
+		fmt.Fprintf(w, "\n%d problem(s), %d warning(s)\n", failures, warnings)
+		return exitError
+	case warnings > 0:
+		fmt.Fprintf(w, "\nno problems, %d warning(s)\n", warnings)
+	default:
+		fmt.Fprintln(w, "\nno problems found")
+	}
+	return exitOK
+}
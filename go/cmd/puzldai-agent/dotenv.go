@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// noDotenvEnv, set by -no-dotenv, turns off loading .env files even when
+// the config enables it.
+const noDotenvEnv = "PUZLDAI_NO_DOTENV"
+
+// dotenvFiles are the files config dotenv loads from the workspace, the
+// ones that win first.
+var dotenvFiles = []string{".env.local", ".env"}
+
+// dotenvVars records, for each variable a .env file set, the file's path,
+// so doctor can tell where a key came from.
+var dotenvVars = map[string]string{}
+
+var dotenvNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadDotenv sets the variables of <cwd>/.env.local and <cwd>/.env in the
+// environment, where provider keys are looked up and which tools inherit.
+// A variable already in the environment keeps its value, and .env.local
+// wins over .env. Missing files are skipped. It returns the files loaded.
+func loadDotenv(cwd string) ([]string, error) {
+	if os.Getenv(noDotenvEnv) != "" {
+		return nil, nil
+	}
+	var loaded []string
+	for _, name := range dotenvFiles {
+		path := filepath.Join(cwd, name)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return loaded, err
+		}
+		vars, err := parseDotenv(data)
+		if err != nil {
+			return loaded, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, v := range vars {
+			if _, ok := os.LookupEnv(v[0]); ok {
+				continue
+			}
+			if err := os.Setenv(v[0], v[1]); err != nil {
+				return loaded, fmt.Errorf("%s: %w", path, err)
+			}
+			dotenvVars[v[0]] = path
+		}
+		loaded = append(loaded, path)
+	}
+	return loaded, nil
+}
+
+// parseDotenv reads NAME=value lines, optionally prefixed with "export".
+// Blank lines and lines starting with # are skipped. A value in single
+// quotes is taken as is; one in double quotes may use \n, \t, \", and \\.
+// An unquoted value ends at " #". There is no variable expansion.
+func parseDotenv(data []byte) ([][2]string, error) {
+	var vars [][2]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !dotenvNameRe.MatchString(name) {
+			return nil, fmt.Errorf("line %d: want NAME=value", n)
+		}
+		value, err := dotenvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		vars = append(vars, [2]string{name, value})
+	}
+	return vars, scanner.Err()
+}
+
+func dotenvValue(s string) (string, error) {
+	if s == "" || (s[0] != '\'' && s[0] != '"') {
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = strings.TrimSpace(s[:i])
+		}
+		return s, nil
+	}
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			if rest := strings.TrimSpace(s[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected %q after the closing quote", rest)
+			}
+			return b.String(), nil
+		case c == '\\' && quote == '"' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("missing closing quote")
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// applyEdit replaces search with replace in text. An exact match replaces
+// every occurrence, as before. Otherwise it retries with smart quotes and
+// non-breaking spaces normalized, then line by line ignoring indentation,
+// trailing whitespace, and line endings; fuzzy matches must be unique. The
+// returned note says which normalization made the match.
+func applyEdit(text, search, replace string) (updated, note string, err error) {
+	if search == "" {
+		return "", "", errors.New("edit: search text is empty")
+	}
+	if strings.Contains(text, search) {
+		return strings.ReplaceAll(text, search, replace), "", nil
+	}
+	updated, ok, err := replaceNormalizedRunes(text, search, replace)
+	if err != nil {
+		return "", "", err
+	}
+	if ok {
+		return updated, "exact match failed; matched after normalizing smart quotes, dashes, and non-breaking spaces", nil
+	}
+	return replaceNormalizedLines(text, search, replace)
+}
+
+func normalizeRune(r rune) rune {
+	switch r {
+	case '‘', '’', '‚':
+		return '\''
+	case '“', '”', '„':
+		return '"'
+	case '\u00a0', '\u2007', '\u202f':
+		return ' '
+	case '–', '—':
+		return '-'
+	}
+	return r
+}
+
+func normalizeText(s string) string {
+	return strings.Map(normalizeRune, s)
+}
+
+// replaceNormalizedRunes matches on a rune-for-rune normalized copy, so rune
+// positions map straight back onto the original text.
+func replaceNormalizedRunes(text, search, replace string) (string, bool, error) {
+	normText, normSearch := normalizeText(text), normalizeText(search)
+	var matches []int
+	for off := 0; ; {
+		i := strings.Index(normText[off:], normSearch)
+		if i < 0 {
+			break
+		}
+		matches = append(matches, off+i)
+		off += i + len(normSearch)
+	}
+	switch len(matches) {
+	case 0:
+		return "", false, nil
+	case 1:
+		runes := []rune(text)
+		start := utf8.RuneCountInString(normText[:matches[0]])
+		end := start + utf8.RuneCountInString(normSearch)
+		return string(runes[:start]) + replace + string(runes[end:]), true, nil
+	default:
+		return "", false, fmt.Errorf("edit: search text not found exactly, and it matches %d places after normalizing quotes; include more surrounding text", len(matches))
+	}
+}
+
+func replaceNormalizedLines(text, search, replace string) (string, string, error) {
+	lines := strings.Split(text, "\n")
+	want := splitEditLines(search)
+	if len(want) == 0 {
+		return "", "", errors.New("edit: search text not found")
+	}
+	key := func(s string) string {
+		return strings.TrimSpace(normalizeText(strings.TrimSuffix(s, "\r")))
+	}
+
+	var matches []int
+	for i := 0; i+len(want) <= len(lines); i++ {
+		same := true
+		for j, w := range want {
+			if key(lines[i+j]) != key(w) {
+				same = false
+				break
+			}
+		}
+		if same {
+			matches = append(matches, i)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", "", errors.New("edit: search text not found (also tried ignoring indentation, trailing whitespace, line endings, and smart quotes); view the file and copy the exact text")
+	case 1:
+	default:
+		return "", "", fmt.Errorf("edit: search text not found exactly, and it matches %d places after normalizing whitespace; include more surrounding lines", len(matches))
+	}
+	start := matches[0]
+	matched := lines[start : start+len(want)]
+
+	crlf := strings.HasSuffix(matched[0], "\r")
+	repl := reindent(splitEditLines(replace), want, matched)
+	if crlf {
+		for i := range repl {
+			repl[i] += "\r"
+		}
+	}
+
+	out := make([]string, 0, len(lines)-len(want)+len(repl))
+	out = append(out, lines[:start]...)
+	out = append(out, repl...)
+	out = append(out, lines[start+len(want):]...)
+
+	note := fmt.Sprintf("exact match failed; applied to lines %d-%d after normalizing %s",
+		start+1, start+len(want), strings.Join(describeNormalization(matched, want), ", "))
+	return strings.Join(out, "\n"), note, nil
+}
+
+// splitEditLines splits on newlines, dropping carriage returns and the empty
+// element after a trailing newline.
+func splitEditLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func describeNormalization(got, want []string) []string {
+	var kinds []string
+	add := func(kind string) {
+		for _, k := range kinds {
+			if k == kind {
+				return
+			}
+		}
+		kinds = append(kinds, kind)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if strings.HasSuffix(g, "\r") {
+			add("line endings")
+			g = strings.TrimSuffix(g, "\r")
+		}
+		if leadingWhitespace(g) != leadingWhitespace(w) {
+			add("indentation")
+		}
+		if g[len(strings.TrimRight(g, " \t")):] != w[len(strings.TrimRight(w, " \t")):] {
+			add("trailing whitespace")
+		}
+		// The lines are equal once trimmed and normalized, so any remaining
+		// difference comes from rune normalization.
+		if strings.TrimSpace(g) != strings.TrimSpace(w) {
+			add("smart quotes")
+		}
+	}
+	if len(kinds) == 0 {
+		kinds = append(kinds, "whitespace")
+	}
+	return kinds
+}
+
+func leadingWhitespace(s string) string {
+	return s[:len(s)-len(strings.TrimLeft(s, " \t"))]
+}
+
+// reindent rewrites the replacement in the file's indentation. Each indent
+// seen in the search text maps to the file's indent on the matching line;
+// when one search indent maps to several file indents the line at the same
+// position decides, and unseen indents are converted between tabs and spaces.
+func reindent(repl, want, matched []string) []string {
+	mapping := map[string]string{}
+	ambiguous := map[string]bool{}
+	for i, w := range want {
+		if strings.TrimSpace(w) == "" {
+			continue
+		}
+		from, to := leadingWhitespace(w), leadingWhitespace(strings.TrimSuffix(matched[i], "\r"))
+		if prev, ok := mapping[from]; ok && prev != to {
+			ambiguous[from] = true
+		} else if !ok {
+			mapping[from] = to
+		}
+	}
+
+	out := make([]string, 0, len(repl))
+	for i, l := range repl {
+		if strings.TrimSpace(l) == "" {
+			out = append(out, l)
+			continue
+		}
+		indent := leadingWhitespace(l)
+		body := l[len(indent):]
+		mapped, known := mapping[indent]
+		switch {
+		case ambiguous[indent] && i < len(matched):
+			indent = leadingWhitespace(strings.TrimSuffix(matched[i], "\r"))
+		case known:
+			indent = mapped
+		default:
+			indent = convertIndent(indent, mapping)
+		}
+		out = append(out, indent+body)
+	}
+	return out
+}
+
+// convertIndent maps the longest known prefix of indent and converts the rest
+// using the tab width implied by the mapping (e.g. "    " -> "\t"). When
+// the mapping implies several widths, the shortest search indent decides.
+func convertIndent(indent string, mapping map[string]string) string {
+	froms := make([]string, 0, len(mapping))
+	for from := range mapping {
+		froms = append(froms, from)
+	}
+	sort.Slice(froms, func(i, j int) bool {
+		if len(froms[i]) != len(froms[j]) {
+			return len(froms[i]) < len(froms[j])
+		}
+		return froms[i] < froms[j]
+	})
+
+	best := ""
+	for _, from := range froms {
+		if strings.HasPrefix(indent, from) {
+			best = from
+		}
+	}
+	rest := indent[len(best):]
+	width := 0
+	for _, from := range froms {
+		to := mapping[from]
+		fromSpaces, toTabs := strings.Trim(from, " ") == "", strings.Trim(to, "\t") == ""
+		fromTabs, toSpaces := strings.Trim(from, "\t") == "", strings.Trim(to, " ") == ""
+		switch {
+		case from == "" || to == "":
+			continue
+		case fromSpaces && toTabs && len(from)%len(to) == 0:
+			width = len(from) / len(to)
+		case fromTabs && toSpaces && len(to)%len(from) == 0:
+			width = -len(to) / len(from)
+		default:
+			continue
+		}
+		break
+	}
+	switch {
+	case width > 0 && strings.Trim(rest, " ") == "":
+		rest = strings.Repeat("\t", len(rest)/width) + strings.Repeat(" ", len(rest)%width)
+	case width < 0 && strings.Trim(rest, "\t") == "":
+		rest = strings.Repeat(" ", len(rest)*-width)
+	}
+	return mapping[best] + rest
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyEdit(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		search   string
+		replace  string
+		want     string
+		wantNote string // substring of the note; "" for an exact match
+		wantErr  string // substring of the error
+	}{
+		{
+			name:    "exact replaces every occurrence",
+			text:    "a := 1\nb := 1\n",
+			search:  ":= 1",
+			replace: ":= 2",
+			want:    "a := 2\nb := 2\n",
+		},
+		{
+			name:     "smart quotes",
+			text:     "msg := “hello”\n",
+			search:   `msg := "hello"`,
+			replace:  `msg := "bye"`,
+			want:     "msg := \"bye\"\n",
+			wantNote: "smart quotes",
+		},
+		{
+			name:     "non-breaking space and dash",
+			text:     "x – y\n",
+			search:   "x - y",
+			replace:  "x + y",
+			want:     "x + y\n",
+			wantNote: "non-breaking spaces",
+		},
+		{
+			name:     "CRLF kept",
+			text:     "one\r\ntwo  \r\nthree\r\n",
+			search:   "one\ntwo\n",
+			replace:  "uno\ndos\n",
+			want:     "uno\r\ndos\r\nthree\r\n",
+			wantNote: "line endings, trailing whitespace",
+		},
+		{
+			name:     "spaces reindented to tabs",
+			text:     "func f() {\n\tif x {\n\t\treturn\n\t}\n}\n",
+			search:   "    if x {\n        return\n    }",
+			replace:  "    if x {\n        y()\n            z()\n        return\n    }",
+			want:     "func f() {\n\tif x {\n\t\ty()\n\t\t\tz()\n\t\treturn\n\t}\n}\n",
+			wantNote: "applied to lines 2-4 after normalizing indentation",
+		},
+		{
+			name:     "tabs reindented to spaces",
+			text:     "if x {\n  y()\n}\n",
+			search:   "if x {\n\ty()\n}",
+			replace:  "if x {\n\ty()\n\t\tz()\n}",
+			want:     "if x {\n  y()\n    z()\n}\n",
+			wantNote: "indentation",
+		},
+		{
+			name:    "ambiguous after quote normalization",
+			text:    "a = ‘x’\nb = ’x‘\n",
+			search:  "'x'",
+			replace: "'y'",
+			wantErr: "matches 2 places after normalizing quotes",
+		},
+		{
+			name:    "ambiguous after whitespace normalization",
+			text:    "\treturn nil\n}\n  return nil\n",
+			search:  "return nil \n",
+			replace: "return err\n",
+			wantErr: "matches 2 places after normalizing whitespace",
+		},
+		{
+			name:    "not found",
+			text:    "a\nb\n",
+			search:  "c",
+			replace: "d",
+			wantErr: "search text not found",
+		},
+		{
+			name:    "empty search",
+			text:    "a",
+			replace: "b",
+			wantErr: "search text is empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, note, err := applyEdit(tt.text, tt.search, tt.replace)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.wantNote == "" && note != "" || !strings.Contains(note, tt.wantNote) {
+				t.Errorf("note %q, want %q", note, tt.wantNote)
+			}
+		})
+	}
+}
+
+func TestConvertIndentDeterministic(t *testing.T) {
+	// Two and four spaces both map to one tab, implying widths 2 and 4; the
+	// shortest search indent decides, on every run.
+	mapping := map[string]string{"  ": "\t", "    ": "\t", "": ""}
+	for range 50 {
+		if got := convertIndent("      ", mapping); got != "\t\t" {
+			t.Fatalf("convertIndent = %q, want %q", got, "\t\t")
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Egress policies.
+const (
+	egressAllow = "allow"
+	egressDeny  = "deny"
+)
+
+// egressConfig is the [egress] config section.
+type egressConfig struct {
+	Policy     string   `toml:"policy"`
+	AllowHosts []string `toml:"allow_hosts"`
+	AllowTools []string `toml:"allow_tools"`
+}
+
+// rawNetworkCommandRe matches clients that ignore proxy settings, so the
+// proxy cannot police them.
+var rawNetworkCommandRe = regexp.MustCompile(`(?:^|[\s;&|(` + "`" + `])(?:ssh|scp|sftp|nc|ncat|netcat|telnet|ftp|socat)\b`)
+
+// egressPolicy limits what tools can reach under the deny policy: bash runs
+// with proxy variables pointing at a local filtering proxy, api_call checks
+// its target host, and other networked tools are only offered when listed
+// in allow_tools. Programs that bypass proxy settings are not contained;
+// this guards against casual exfiltration, it is not a firewall.
+type egressPolicy struct {
+	hosts    []string
+	tools    map[string]bool
+	proxyURL string
+	mu       sync.Mutex
+	blocked  map[string]bool
+}
+
+// newEgressPolicy returns nil when the policy allows all traffic. Without an
+// explicit policy, CI runs default to deny.
+func newEgressPolicy(policy string, hosts, tools []string) (*egressPolicy, error) {
+	if policy == "" {
+		policy = egressAllow
+		if runningInCI() {
+			policy = egressDeny
+		}
+	}
+	switch policy {
+	case egressAllow:
+		return nil, nil
+	case egressDeny:
+	default:
+		return nil, fmt.Errorf("invalid egress policy %q (allow, deny)", policy)
+	}
+	e := &egressPolicy{tools: map[string]bool{}, blocked: map[string]bool{}}
+	for _, h := range hosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			e.hosts = append(e.hosts, h)
+		}
+	}
+	for _, t := range tools {
+		e.tools[t] = true
+	}
+	return e, nil
+}
+
+// runningInCI reports whether the agent runs under a CI system or with -ci.
+func runningInCI() bool {
+	return ciMode || os.Getenv("CI") != ""
+}
+
+// allowed matches host against the allowlist: exact names, or "*.example.com"
+// for any subdomain. Loopback is always reachable.
+func (e *egressPolicy) allowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, h := range e.hosts {
+		if suffix, ok := strings.CutPrefix(h, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	e.mu.Lock()
+	if !e.blocked[host] {
+		e.blocked[host] = true
+		fmt.Fprintf(os.Stderr, "egress: blocked %s (add it with -allow-host)\n", host)
+	}
+	e.mu.Unlock()
+	return false
+}
+
+// apply starts the filtering proxy and restricts tools.
+func (e *egressPolicy) apply(sess *session, tools []toolDef) ([]toolDef, error) {
+	if err := e.start(sess); err != nil {
+		return nil, err
+	}
+	out := make([]toolDef, 0, len(tools))
+	for _, t := range tools {
+		switch {
+		case t.name == "bash" && sess.remote == nil:
+			t.fn = e.guardBash(t.fn)
+		case t.name == "api_call":
+			// Checked per request by the client's transport.
+		case networkTools[t.name] && !e.tools[t.name]:
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (e *egressPolicy) guardBash(next toolFunc) toolFunc {
+	return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+		command, _ := argString(args, "command")
+		if rawNetworkCommandRe.MatchString(command) {
+			return "", policyErrorf("bash: direct network clients (ssh, nc, ...) are blocked by the egress policy; HTTP(S) to allowed hosts works through the proxy")
+		}
+		return next(withCommandEnv(ctx, e.env()), cwd, args)
+	}
+}
+
+// env points common proxy variables at the filtering proxy.
+func (e *egressPolicy) env() []string {
+	var env []string
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY"} {
+		env = append(env, name+"="+e.proxyURL, strings.ToLower(name)+"="+e.proxyURL)
+	}
+	return append(env, "NO_PROXY=localhost,127.0.0.1,::1", "no_proxy=localhost,127.0.0.1,::1")
+}
+
+func (e *egressPolicy) start(sess *session) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("egress proxy: %w", err)
+	}
+	srv := &http.Server{Handler: e, ReadHeaderTimeout: 30 * time.Second}
+	go srv.Serve(ln)
+	sess.onClose(func() { srv.Close() })
+	e.proxyURL = "http://" + ln.Addr().String()
+	return nil
+}
+
+// ServeHTTP is the filtering proxy: CONNECT tunnels and plain HTTP requests
+// go through only for allowed hosts.
+func (e *egressPolicy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Hostname()
+	if r.Method == http.MethodConnect {
+		host, _, _ = net.SplitHostPort(r.Host)
+	}
+	if !e.allowed(host) {
+		http.Error(w, "blocked by puzldai egress policy: "+host, http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		e.tunnel(w, r)
+		return
+	}
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Connection")
+	r.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (e *egressPolicy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	go func() {
+		io.Copy(upstream, buf)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+// egressTransport refuses requests to hosts the policy does not allow.
+type egressTransport struct {
+	policy *egressPolicy
+	next   http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.policy.allowed(req.URL.Hostname()) {
+		return nil, fmt.Errorf("host %s is not allowed by the egress policy (add it with -allow-host)", req.URL.Hostname())
+	}
+	return t.next.RoundTrip(req)
+}
+
+type commandEnvKey struct{}
+
+// withCommandEnv attaches extra environment variables for commands that
+// tools start under ctx, after any attached further out.
+func withCommandEnv(ctx context.Context, env []string) context.Context {
+	outer := commandEnv(ctx)
+	return context.WithValue(ctx, commandEnvKey{}, append(outer[:len(outer):len(outer)], env...))
+}
+
+func commandEnv(ctx context.Context) []string {
+	env, _ := ctx.Value(commandEnvKey{}).([]string)
+	return env
+}
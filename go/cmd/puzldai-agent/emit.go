@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emitPatchInstructions tells the model its changes stay in memory.
+const emitPatchInstructions = `
+
+# Patch Output
+
+This run does not change the workspace: what you write and edit is kept in
+memory and handed over as a patch when you finish. view, glob, and grep see
+your changes. bash runs in a scratch copy of the workspace with your changes
+applied; anything bash itself changes there is discarded, so make every
+change with write or edit (run formatters or generators only to see their
+result, then write it). ast_edit and go_add_import change the patch like
+write does. terraform_apply is not available.`
+
+// overlay holds the file changes of an -emit patch run in memory, so the
+// workspace on disk is never written. bash runs in a scratch worktree that
+// is reset to the workspace plus the overlay before each command.
+type overlay struct {
+	mu    sync.Mutex
+	root  string // the workspace; patch paths are relative to it
+	files map[string]overlayFile
+	lower workspaceFS // what the files are read from until written
+
+	// The scratch worktree, created by the first bash command, and the
+	// files bash changed in it.
+	gitRoot   string
+	base      string
+	scratch   string
+	discarded []string
+}
+
+type overlayFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// emitManifest describes the patch of an -emit patch run.
+type emitManifest struct {
+	Status  string     `json:"status"`
+	Summary string     `json:"summary,omitempty"`
+	Files   []emitFile `json:"files"`
+	// Base is the commit checked out in the workspace; the patch applies
+	// to the workspace as it was, uncommitted changes included.
+	Base   string     `json:"base,omitempty"`
+	Totals emitCounts `json:"totals"`
+	// Discarded are files bash changed in the scratch copy, which are not
+	// part of the patch.
+	Discarded []string `json:"discarded_bash_changes,omitempty"`
+}
+
+type emitFile struct {
+	Path       string `json:"path"`
+	Change     string `json:"change"` // added or modified
+	Additions  int    `json:"additions"`
+	Deletions  int    `json:"deletions"`
+	SHA256     string `json:"sha256"`
+	BaseSHA256 string `json:"base_sha256,omitempty"`
+}
+
+type emitCounts struct {
+	Files     int `json:"files"`
+	Additions int `json:"additions"`
+	Deletions int `json:"deletions"`
+}
+
+func newOverlay(root string) *overlay {
+	return &overlay{root: root, files: map[string]overlayFile{}, lower: diskFS{}}
+}
+
+func (o *overlay) lookup(path string) (overlayFile, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, ok := o.files[filepath.Clean(path)]
+	return f, ok
+}
+
+func (o *overlay) write(path string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.files[filepath.Clean(path)] = overlayFile{data: append([]byte(nil), data...), modTime: time.Now()}
+}
+
+// under lists the overlay's files inside dir, sorted.
+func (o *overlay) under(dir string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var paths []string
+	for p := range o.files {
+		if within(dir, p) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// within reports whether path is dir or below it, comparing the paths
+// only: overlay files need not exist on disk.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// The overlay is a workspaceFS: reads see its files over the layer below,
+// and writes stay in memory.
+
+func (o *overlay) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	if f, ok := o.lookup(path); ok {
+		return f.data, nil
+	}
+	return o.lower.ReadFile(ctx, path)
+}
+
+func (o *overlay) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	if f, ok := o.lookup(path); ok {
+		return memFile{bytes.NewReader(f.data)}, nil
+	}
+	return o.lower.Open(ctx, path)
+}
+
+func (o *overlay) WriteFile(_ context.Context, path string, data []byte) error {
+	o.write(path, data)
+	return nil
+}
+
+// Stat describes overlay files with the mode they have below, and
+// directories that hold only overlay files as directories.
+func (o *overlay) Stat(ctx context.Context, path string) (fs.FileInfo, error) {
+	info, err := o.lower.Stat(ctx, path)
+	if f, ok := o.lookup(path); ok {
+		mode := fs.FileMode(0o644)
+		if err == nil {
+			mode = info.Mode()
+		}
+		return fileInfo{name: filepath.Base(path), size: int64(len(f.data)), mode: mode, modTime: f.modTime}, nil
+	}
+	if err != nil && len(o.under(path)) > 0 {
+		return fileInfo{name: filepath.Base(path), mode: fs.ModeDir | 0o755, modTime: time.Now()}, nil
+	}
+	return info, err
+}
+
+// Walk walks the layer below, showing the overlay's version of its files,
+// and then the files that exist only in the overlay, each after the new
+// directories that hold it.
+func (o *overlay) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	if _, ok := o.lookup(root); ok {
+		info, err := o.Stat(ctx, root)
+		if err != nil {
+			return err
+		}
+		return fn(root, fs.FileInfoToDirEntry(info), nil)
+	}
+	pending := o.under(root)
+	var skipped []string
+	stopped := false
+	err := o.lower.Walk(ctx, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && errors.Is(err, fs.ErrNotExist) && len(pending) > 0 {
+				return nil
+			}
+			return fn(path, d, err)
+		}
+		if !d.IsDir() {
+			if _, ok := o.lookup(path); ok {
+				if info, err := o.Stat(ctx, path); err == nil {
+					d = fs.FileInfoToDirEntry(info)
+				}
+			}
+		}
+		err = fn(path, d, nil)
+		switch {
+		case err == fs.SkipDir && d.IsDir():
+			skipped = append(skipped, path)
+		case err == fs.SkipAll:
+			stopped = true
+		}
+		return err
+	})
+	if err != nil || stopped {
+		return err
+	}
+	visited := map[string]bool{}
+	inSkipped := func(path string) bool {
+		return slices.ContainsFunc(skipped, func(dir string) bool { return within(dir, path) })
+	}
+next:
+	for _, path := range pending {
+		if _, err := o.lower.Stat(ctx, path); err == nil || inSkipped(path) {
+			continue
+		}
+		// The directories from root down to the file that exist only
+		// in the overlay.
+		rel, _ := filepath.Rel(root, filepath.Dir(path))
+		dir := root
+		for _, part := range append([]string{""}, strings.Split(rel, string(filepath.Separator))...) {
+			if part != "" && part != "." {
+				dir = filepath.Join(dir, part)
+			}
+			if visited[dir] {
+				continue
+			}
+			visited[dir] = true
+			if _, err := o.lower.Stat(ctx, dir); err == nil {
+				continue
+			}
+			info, _ := o.Stat(ctx, dir)
+			switch err := fn(dir, fs.FileInfoToDirEntry(info), nil); err {
+			case nil:
+			case fs.SkipDir:
+				skipped = append(skipped, dir)
+				continue next
+			case fs.SkipAll:
+				return nil
+			default:
+				return err
+			}
+		}
+		info, err := o.Stat(ctx, path)
+		if err != nil {
+			return err
+		}
+		switch err := fn(path, fs.FileInfoToDirEntry(info), nil); err {
+		case nil, fs.SkipDir:
+		case fs.SkipAll:
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *overlay) Inside(ctx context.Context, dir, path string) bool {
+	return o.lower.Inside(ctx, dir, path)
+}
+
+// Command runs name in the scratch worktree, reset to the workspace plus
+// the overlay, in the directory matching dir.
+func (o *overlay) Command(ctx context.Context, dir, name string, args ...string) (*exec.Cmd, error) {
+	scratch, err := o.prepareScratch(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("scratch copy of the workspace: %w", err)
+	}
+	return o.lower.Command(ctx, scratch, name, args...)
+}
+
+func (o *overlay) Shell(ctx context.Context, dir, command string) (*exec.Cmd, error) {
+	scratch, err := o.prepareScratch(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("scratch copy of the workspace: %w", err)
+	}
+	return o.lower.Shell(ctx, scratch, command)
+}
+
+func (o *overlay) LookPath(ctx context.Context, name string) error {
+	return o.lower.LookPath(ctx, name)
+}
+
+func (o *overlay) MkdirTemp(ctx context.Context, pattern string) (string, error) {
+	return o.lower.MkdirTemp(ctx, pattern)
+}
+
+func (o *overlay) RemoveAll(ctx context.Context, path string) error {
+	return o.lower.RemoveAll(ctx, path)
+}
+
+// apply adapts the tools to the overlay: bash reports what it changed in
+// the scratch worktree, docker_run mounts the scratch worktree instead of
+// the workspace, and terraform_apply, whose state would be left behind in
+// the scratch worktree, is refused.
+func (o *overlay) apply(tools []toolDef) []toolDef {
+	for i, t := range tools {
+		next := t.fn
+		switch t.name {
+		case "bash":
+			tools[i].fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+				out, err := next(ctx, cwd, args)
+				if dropped := o.scratchChanges(ctx); len(dropped) > 0 {
+					out += fmt.Sprintf("\n[patch output: bash changed %s in the scratch copy; these changes are discarded, make them with write or edit]", strings.Join(dropped, ", "))
+				}
+				return out, err
+			}
+		case "docker_run":
+			tools[i].fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+				if !argBool(args, "mount_workspace") {
+					return next(ctx, cwd, args)
+				}
+				scratch, err := o.prepareScratch(ctx, cwd)
+				if err != nil {
+					return "", fmt.Errorf("docker_run: scratch copy of the workspace: %w", err)
+				}
+				return next(ctx, scratch, args)
+			}
+		case "terraform_apply":
+			tools[i].fn = func(context.Context, string, map[string]any) (string, error) {
+				return "", policyErrorf("terraform_apply: not available with -emit patch, which only produces a patch")
+			}
+		}
+	}
+	return tools
+}
+
+// prepareScratch returns the directory matching cwd in the scratch
+// worktree, reset to the workspace as it was at the start plus the overlay.
+func (o *overlay) prepareScratch(ctx context.Context, cwd string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.scratch == "" {
+		root, err := gitRoot(ctx, o.root)
+		if err != nil {
+			return "", err
+		}
+		base, err := snapshotWorktree(ctx, root, "puzldai emit baseline")
+		if err != nil {
+			return "", err
+		}
+		dir, err := os.MkdirTemp("", "puzldai-emit-")
+		if err != nil {
+			return "", err
+		}
+		scratch := filepath.Join(dir, "worktree")
+		if _, err := runGit(ctx, root, "worktree", "add", "--detach", scratch, base); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		o.gitRoot, o.base, o.scratch = root, base, scratch
+	} else {
+		if _, err := runGit(ctx, o.scratch, "reset", "-q", "--hard", o.base); err != nil {
+			return "", err
+		}
+		if _, err := runGit(ctx, o.scratch, "clean", "-q", "-f", "-d"); err != nil {
+			return "", err
+		}
+	}
+	for path, f := range o.files {
+		target, ok := o.scratchPath(path)
+		if !ok {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(target, f.data, 0o644); err != nil {
+			return "", err
+		}
+	}
+	dir, ok := o.scratchPath(cwd)
+	if !ok {
+		return "", fmt.Errorf("%s is outside the repository", cwd)
+	}
+	return dir, nil
+}
+
+// scratchPath maps a path in the repository to the scratch worktree.
+func (o *overlay) scratchPath(path string) (string, bool) {
+	rel, err := filepath.Rel(o.gitRoot, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.Join(o.scratch, rel), true
+}
+
+// scratchChanges lists the files bash changed in the scratch worktree:
+// those that differ from the baseline and are not the overlay's content.
+func (o *overlay) scratchChanges(ctx context.Context) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.scratch == "" {
+		return nil
+	}
+	out, err := runGit(ctx, o.scratch, "status", "--porcelain", "-z", "--untracked-files=all", "--no-renames")
+	if err != nil {
+		return nil
+	}
+	var changed []string
+	for _, entry := range strings.Split(out, "\x00") {
+		if len(entry) < 4 {
+			continue
+		}
+		rel := entry[3:]
+		data, err := os.ReadFile(filepath.Join(o.scratch, rel))
+		if f, ok := o.files[filepath.Join(o.gitRoot, rel)]; ok && err == nil && bytes.Equal(f.data, data) {
+			continue
+		}
+		changed = append(changed, filepath.ToSlash(rel))
+		if !slices.Contains(o.discarded, filepath.ToSlash(rel)) {
+			o.discarded = append(o.discarded, filepath.ToSlash(rel))
+		}
+	}
+	return changed
+}
+
+// close removes the scratch worktree.
+func (o *overlay) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.scratch == "" {
+		return
+	}
+	_, _ = runGit(context.Background(), o.gitRoot, "worktree", "remove", "--force", o.scratch)
+	os.RemoveAll(filepath.Dir(o.scratch))
+	o.scratch = ""
+}
+
+// patch renders the overlay as a git-applyable patch against the
+// workspace, with paths relative to it, and describes it in a manifest.
+// Files written back to their original content are left out.
+func (o *overlay) patch(ctx context.Context) (string, []emitFile, error) {
+	tmp, err := os.MkdirTemp("", "puzldai-patch-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(tmp)
+	var files []emitFile
+	for _, path := range o.under(o.root) {
+		f, _ := o.lookup(path)
+		rel, _ := filepath.Rel(o.root, path)
+		e := emitFile{Path: filepath.ToSlash(rel), Change: "added", SHA256: sha256Hex(f.data)}
+		mode := fs.FileMode(0o644)
+		before, err := o.lower.ReadFile(ctx, path)
+		switch {
+		case err == nil:
+			if bytes.Equal(before, f.data) {
+				continue
+			}
+			e.Change, e.BaseSHA256 = "modified", sha256Hex(before)
+			if info, err := o.lower.Stat(ctx, path); err == nil {
+				mode = info.Mode().Perm()
+			}
+			if err := writeTreeFile(filepath.Join(tmp, "a", rel), before, mode); err != nil {
+				return "", nil, err
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return "", nil, err
+		}
+		if err := writeTreeFile(filepath.Join(tmp, "b", rel), f.data, mode); err != nil {
+			return "", nil, err
+		}
+		for _, op := range diffLines(splitDiffLines(string(before)), splitDiffLines(string(f.data))) {
+			switch op.kind {
+			case '+':
+				e.Additions++
+			case '-':
+				e.Deletions++
+			}
+		}
+		files = append(files, e)
+	}
+	if len(files) == 0 {
+		return "", nil, nil
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "a"), 0o755); err != nil {
+		return "", nil, err
+	}
+	// With the trees named a and b, the paths come out as a/<path> and
+	// b/<path>, as in any git diff.
+	cmd := exec.CommandContext(ctx, "git", "diff", "--no-index", "--binary", "--no-prefix", "--no-color", "a", "b")
+	cmd.Dir = tmp
+	var out, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return "", nil, fmt.Errorf("git diff: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.String(), files, nil
+}
+
+func writeTreeFile(path string, data []byte, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, mode)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// emit writes the patch to out and the manifest to manifestOut, or to
+// stderr when no file is given.
+func (o *overlay) emit(ctx context.Context, out io.Writer, manifestOut string, outcome agentOutcome) error {
+	patch, files, err := o.patch(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, patch); err != nil {
+		return err
+	}
+	m := emitManifest{Status: outcome.Status, Summary: outcome.Summary, Files: files, Totals: emitCounts{Files: len(files)}}
+	if m.Files == nil {
+		m.Files = []emitFile{}
+	}
+	for _, f := range files {
+		m.Totals.Additions += f.Additions
+		m.Totals.Deletions += f.Deletions
+	}
+	if head, err := runGit(ctx, o.root, "rev-parse", "HEAD"); err == nil {
+		m.Base = strings.TrimSpace(head)
+	}
+	o.mu.Lock()
+	m.Discarded = append([]string(nil), o.discarded...)
+	o.mu.Unlock()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if manifestOut == "" {
+		_, err = fmt.Fprintf(os.Stderr, "%s\n", data)
+		return err
+	}
+	return os.WriteFile(manifestOut, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	verifyTimeout       = 10 * time.Minute
+	childStopDelay      = 10 * time.Second
+	maxJudgeDiffBytes   = 20_000
+	maxJudgeAnswerBytes = 2_000
+	maxVerifyOutput     = 2_000
+)
+
+var winnerRe = regexp.MustCompile(`(?im)^\s*\**WINNER:?\**:?\s*#?(\d+)`)
+
+// ensembleFlags are consumed by the parent and never passed to children;
+// the task flags are replaced by a task file holding the resolved task.
+var ensembleFlags = map[string]bool{
+	"attempts": true, "pipeline": true, "attempt-models": true, "attempt-temperatures": true,
+	"verify": true, "judge-model": true, "cwd": true, "outcome-out": true,
+	"task": true, "task-file": true, "task-from": true, "no-ticket-comment": true, "context": true, "model": true, "temperature": true,
+	"notify": true, "webhook-url": true, "pprof": true, "pprof-out": true, "debug-addr": true,
+}
+
+type ensembleOptions struct {
+	attempts     int
+	models       []string
+	temperatures []string
+	verify       string
+	judgeModel   string
+	parallel     bool
+	cwd          string
+	task         string
+	// finish records the final outcome.
+	finish func(agentOutcome)
+}
+
+// childRun is one run of this binary in its own worktree, as used by
+// -attempts and -pipeline.
+type childRun struct {
+	n           int
+	label       string
+	model       string
+	dir         string
+	cwd         string
+	outcomeFile string
+	exitCode    int
+	answer      string
+	outcome     agentOutcome
+	patch       string
+	verified    *bool
+	verifyLog   string
+	// env, when set, is the child's whole environment.
+	env []string
+}
+
+// childWorkspace is the shared setup for child runs: a snapshot of the
+// workspace to branch worktrees from and a scratch directory for their
+// tasks, outcomes, and patches.
+type childWorkspace struct {
+	root string
+	base string
+	rel  string
+	exe  string
+	work string
+}
+
+func newChildWorkspace(ctx context.Context, cwd, purpose string) (*childWorkspace, error) {
+	root, err := gitRoot(ctx, cwd)
+	if err != nil {
+		return nil, err
+	}
+	base, err := snapshotWorktree(ctx, root, "puzldai "+purpose+" baseline")
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(root, cwd)
+	if err != nil {
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	work, err := os.MkdirTemp("", "puzldai-"+purpose+"-")
+	if err != nil {
+		return nil, err
+	}
+	return &childWorkspace{root: root, base: base, rel: rel, exe: exe, work: work}, nil
+}
+
+// newChild checks out a worktree at commit for a child run named name.
+func (w *childWorkspace) newChild(ctx context.Context, n int, name, label, model, commit string) (*childRun, error) {
+	c := &childRun{n: n, label: label, model: model, dir: filepath.Join(w.work, name), outcomeFile: filepath.Join(w.work, name+".json")}
+	c.cwd = filepath.Join(c.dir, w.rel)
+	if _, err := runGit(ctx, w.root, "worktree", "add", "--detach", c.dir, commit); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// removeWorktrees deletes the children's worktrees, keeping the scratch
+// directory with their patches.
+func (w *childWorkspace) removeWorktrees(children []*childRun) {
+	for _, c := range children {
+		if c != nil {
+			_, _ = runGit(context.Background(), w.root, "worktree", "remove", "--force", c.dir)
+		}
+	}
+}
+
+// writeTask stores a child's task in the scratch directory.
+func (w *childWorkspace) writeTask(name, task string) (string, error) {
+	path := filepath.Join(w.work, name+".task.md")
+	return path, os.WriteFile(path, []byte(task), 0o600)
+}
+
+// args is the child's command line: the inherited flags plus its task,
+// workspace, outcome file, and model.
+func (c *childRun) args(taskFile string) []string {
+	return append(inheritedArgs(), "-cwd", c.cwd, "-task-file", taskFile, "-no-input",
+		"-outcome-out", c.outcomeFile, "-model", c.model)
+}
+
+// runEnsemble runs the task opts.attempts times, each in its own git
+// worktree of a snapshot of the workspace, by re-running this binary with
+// the same flags. Attempts that pass -verify are preferred, a judge model
+// picks among the rest, and the winning patch is applied to the workspace.
+func runEnsemble(opts ensembleOptions, llm provider, model string, maxTokens int) int {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ws, err := newChildWorkspace(ctx, opts.cwd, "attempts")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-attempts:", err)
+		return exitError
+	}
+	taskFile, err := ws.writeTask("task", opts.task)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-attempts:", err)
+		return exitError
+	}
+
+	attempts := make([]*childRun, opts.attempts)
+	// A cancelled run keeps its worktrees so the attempts can be inspected.
+	keepWorktrees := false
+	defer func() {
+		if !keepWorktrees {
+			ws.removeWorktrees(attempts)
+		}
+	}()
+	for i := range attempts {
+		attemptModel := model
+		if len(opts.models) > 0 {
+			attemptModel = opts.models[i%len(opts.models)]
+		}
+		name := fmt.Sprintf("attempt-%d", i+1)
+		attempts[i], err = ws.newChild(ctx, i+1, name, "attempt "+strconv.Itoa(i+1), attemptModel, ws.base)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "-attempts:", err)
+			return exitError
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, a := range attempts {
+		args := a.args(taskFile)
+		if len(opts.temperatures) > 0 {
+			args = append(args, "-temperature", opts.temperatures[i%len(opts.temperatures)])
+		} else if f := flag.Lookup("temperature"); f != nil && f.Value.String() != "" {
+			args = append(args, "-temperature", f.Value.String())
+		}
+		run := func(a *childRun, args []string) {
+			defer wg.Done()
+			a.run(ctx, ws.exe, args, &mu)
+			a.collect(ctx, ws.base, opts.verify)
+		}
+		wg.Add(1)
+		if opts.parallel {
+			go run(a, args)
+		} else {
+			run(a, args)
+		}
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		keepWorktrees = true
+		fmt.Fprintln(os.Stderr, "cancelled; attempt worktrees are in", ws.work)
+		opts.finish(agentOutcome{Status: outcomeCancelled, Summary: "cancelled"})
+		return exitCancelled
+	}
+
+	var candidates, passing []*childRun
+	for _, a := range attempts {
+		status := a.outcome.Status
+		if status == "" {
+			status = "exit " + strconv.Itoa(a.exitCode)
+		}
+		verified := "not verified"
+		if a.verified != nil {
+			verified = map[bool]string{true: "verify passed", false: "verify failed"}[*a.verified]
+		}
+		patchFile := filepath.Join(ws.work, fmt.Sprintf("attempt-%d.patch", a.n))
+		_ = os.WriteFile(patchFile, []byte(a.patch), 0o644)
+		fmt.Fprintf(os.Stderr, "attempt %d (%s): %s, %s, %d-byte patch %s\n", a.n, a.model, status, verified, len(a.patch), patchFile)
+		if a.patch == "" {
+			continue
+		}
+		candidates = append(candidates, a)
+		if a.verified != nil && *a.verified {
+			passing = append(passing, a)
+		}
+	}
+	if len(candidates) == 0 {
+		fmt.Fprintln(os.Stderr, "no attempt changed any files")
+		opts.finish(agentOutcome{Status: outcomeError, Summary: "no attempt produced changes"})
+		printAnswer(attempts[0].answer)
+		return exitError
+	}
+	pool := candidates
+	if len(passing) > 0 {
+		pool = passing
+	}
+	winner := pool[0]
+	if len(pool) > 1 {
+		winner = judgeAttempts(ctx, llm, firstNonEmpty(opts.judgeModel, model), maxTokens, opts.task, pool)
+	}
+
+	patchFile := filepath.Join(ws.work, fmt.Sprintf("attempt-%d.patch", winner.n))
+	if _, err := runGit(ctx, ws.root, "apply", "--binary", "--whitespace=nowarn", patchFile); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to apply the winning patch %s: %v\n", patchFile, err)
+		opts.finish(agentOutcome{Status: outcomeError, Summary: "failed to apply the winning patch: " + err.Error()})
+		return exitError
+	}
+	fmt.Fprintf(os.Stderr, "applied attempt %d to %s; all patches are in %s\n", winner.n, ws.root, ws.work)
+	opts.finish(winner.outcome)
+	printAnswer(winner.answer)
+	return winner.exitCode
+}
+
+// inheritedArgs rebuilds the flags given on the command line, minus the
+// ones the ensemble sets per attempt.
+func inheritedArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if !ensembleFlags[f.Name] {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
+
+func (a *childRun) run(ctx context.Context, exe string, args []string, mu *sync.Mutex) {
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Env = a.env
+	// Let a cancelled child save its session before it is killed.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = childStopDelay
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &prefixWriter{w: os.Stderr, prefix: "[" + a.label + "] ", mu: mu}
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		a.exitCode = exitErr.ExitCode()
+	case err != nil:
+		a.exitCode = exitError
+		fmt.Fprintf(os.Stderr, "[%s] %v\n", a.label, err)
+	}
+	a.answer = stdout.String()
+	if data, err := os.ReadFile(a.outcomeFile); err == nil {
+		_ = json.Unmarshal(data, &a.outcome)
+	}
+}
+
+// collect records the attempt's patch against base and runs the verify
+// command in its worktree, with {targets} standing for the build targets the
+// patch affects.
+func (a *childRun) collect(ctx context.Context, base, verify string) {
+	if _, err := runGit(ctx, a.dir, "add", "-A"); err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] %v\n", a.label, err)
+		return
+	}
+	patch, err := runGit(ctx, a.dir, "diff", "--cached", "--binary", base)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] %v\n", a.label, err)
+		return
+	}
+	a.patch = patch
+	if verify == "" || patch == "" {
+		return
+	}
+	verify, affected := scopeVerify(ctx, a.cwd, base, verify)
+	if !affected {
+		passed := true
+		a.verified = &passed
+		a.verifyLog = "the changes affect no build targets"
+		return
+	}
+	vctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(vctx, "sh", "-c", verify)
+	cmd.Dir = a.cwd
+	out, err := cmd.CombinedOutput()
+	ok := err == nil
+	a.verified = &ok
+	a.verifyLog = string(out)
+	if len(a.verifyLog) > maxVerifyOutput {
+		a.verifyLog = "..." + a.verifyLog[len(a.verifyLog)-maxVerifyOutput:]
+	}
+}
+
+// judgeAttempts asks a model to pick the best candidate; without a usable
+// answer the first candidate wins.
+func judgeAttempts(ctx context.Context, llm provider, model string, maxTokens int, task string, pool []*childRun) *childRun {
+	var sb strings.Builder
+	sb.WriteString("## Task\n\n" + task + "\n\n")
+	for _, a := range pool {
+		fmt.Fprintf(&sb, "## Candidate %d\n\nStatus: %s\n", a.n, firstNonEmpty(a.outcome.Status, "unknown"))
+		if a.verified != nil {
+			fmt.Fprintf(&sb, "Verification: passed=%t\n```\n%s\n```\n", *a.verified, strings.TrimSpace(a.verifyLog))
+		}
+		sb.WriteString("\nFinal answer:\n" + truncateOutput(strings.TrimSpace(a.answer), maxJudgeAnswerBytes) + "\n\n")
+		sb.WriteString("```diff\n" + strings.TrimRight(truncateOutput(a.patch, maxJudgeDiffBytes), "\n") + "\n```\n\n")
+	}
+	resp, err := llm.complete(ctx, completionRequest{
+		model: model,
+		system: "You compare candidate solutions to a coding task. Judge correctness first, then completeness, " +
+			"then how small and focused the change is. Explain briefly, then end with one line: WINNER: <candidate number>",
+		messages:  []agentMessage{{role: "user", content: sb.String()}},
+		maxTokens: maxTokens,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "judge error, taking the first candidate:", err)
+		return pool[0]
+	}
+	if m := winnerRe.FindStringSubmatch(resp.text); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		for _, a := range pool {
+			if a.n == n {
+				fmt.Fprintf(os.Stderr, "judge picked attempt %d\n", n)
+				return a
+			}
+		}
+	}
+	fmt.Fprintln(os.Stderr, "judge gave no valid winner, taking the first candidate")
+	return pool[0]
+}
+
+// prefixWriter prefixes each complete line, so output from parallel
+// attempts stays readable.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		p.mu.Lock()
+		_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf[:i])
+		p.mu.Unlock()
+		p.buf = p.buf[i+1:]
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"puzldai/pkg/agent"
+)
+
+// Exit codes. Scripts and CI can branch on why a run stopped without
+// parsing output; the -outcome-out status carries the same information.
+const (
+	exitOK            = 0
+	exitError         = 1 // configuration, I/O, and other failures
+	exitMaxIterations = 2
+	exitBudget        = 3
+	exitProvider      = 4
+	exitPolicy        = 5
+	exitCancelled     = 6
+	// exitNeedsInput is returned when the run stopped for a question nobody
+	// could answer; the question is printed on stdout.
+	exitNeedsInput = 7
+	// exitStalled is returned when the loop detector aborted the run.
+	exitStalled = 8
+	// exitTimeout is returned when -deadline or -turn-timeout cut the run
+	// off.
+	exitTimeout = 9
+	// exitUsage is returned for invalid flags and subcommand arguments
+	// (EX_USAGE from sysexits.h, out of the way of the outcome codes).
+	exitUsage = 64
+)
+
+// policyError is returned by a tool when a permission preset, the egress
+// policy, the ignore file, or an approval gate refused the call. The model
+// sees it like any tool error; a run that then ends blocked exits with
+// exitPolicy.
+type policyError struct {
+	msg string
+}
+
+func (e *policyError) Error() string {
+	return e.msg
+}
+
+func (e *policyError) Unwrap() error {
+	return agent.ErrPolicyViolation
+}
+
+func policyErrorf(format string, args ...any) error {
+	return &policyError{msg: fmt.Sprintf(format, args...)}
+}
+
+// outcomeKinds are the failure kinds of the statuses the loop sets.
+var outcomeKinds = map[string]error{
+	outcomeMaxIterations:  agent.ErrMaxIterations,
+	outcomeBudgetExceeded: agent.ErrBudgetExceeded,
+	outcomeCancelled:      agent.ErrCancelled,
+	outcomeNeedsInput:     agent.ErrNeedsInput,
+	outcomeStalled:        agent.ErrStalled,
+	outcomeTimedOut:       agent.ErrTimedOut,
+	outcomeChangeLimit:    agent.ErrPolicyViolation,
+}
+
+// runFailure classifies how a run ended; it is nil for a finished run. A
+// blocked run only counts as a policy violation when a guard refused a call.
+func runFailure(outcome agentOutcome, policyRefusals int, cause error) error {
+	kind := outcomeKinds[outcome.Status]
+	if outcome.Status == outcomeBlocked && policyRefusals > 0 {
+		kind = agent.ErrPolicyViolation
+	}
+	if kind == nil {
+		return nil
+	}
+	return &agent.RunError{Kind: kind, Status: outcome.Status, Summary: outcome.Summary, Iterations: outcome.Iterations, Err: cause}
+}
+
+// exitCode maps a run's failure to the process exit code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, agent.ErrPolicyViolation):
+		return exitPolicy
+	case errors.Is(err, agent.ErrMaxIterations):
+		return exitMaxIterations
+	case errors.Is(err, agent.ErrBudgetExceeded):
+		return exitBudget
+	case errors.Is(err, agent.ErrProviderUnavailable):
+		return exitProvider
+	case errors.Is(err, agent.ErrCancelled):
+		return exitCancelled
+	case errors.Is(err, agent.ErrNeedsInput):
+		return exitNeedsInput
+	case errors.Is(err, agent.ErrStalled):
+		return exitStalled
+	case errors.Is(err, agent.ErrTimedOut):
+		return exitTimeout
+	}
+	return exitError
+}
+
+// exitForOutcome maps a finished run's outcome to its exit code.
+func exitForOutcome(outcome agentOutcome, policyRefusals int) int {
+	return exitCode(runFailure(outcome, policyRefusals, nil))
+}
+
+// providerFailure ends a run whose model request failed: cancellation by a
+// signal or a time limit is reported as such, anything else as a provider
+// error.
+func providerFailure(ctx context.Context, err error) (agentOutcome, int) {
+	if ctx.Err() != nil {
+		return interrupted(ctx)
+	}
+	outcome := agentOutcome{Status: outcomeError, Summary: err.Error(), Error: agent.Code(agent.ErrProviderUnavailable)}
+	return outcome, exitCode(&agent.RunError{Kind: agent.ErrProviderUnavailable, Status: outcome.Status, Summary: outcome.Summary, Err: err})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCachedFileBytes leaves large files to the disk cache of the OS.
+	maxCachedFileBytes = 4 << 20
+	// maxFileCacheBytes bounds the whole cache; least recently used files
+	// are dropped first.
+	maxFileCacheBytes = 64 << 20
+)
+
+// fileCacheStats is published at /debug/vars (-debug-addr) as file_cache.
+var fileCacheStats = expvar.NewMap("file_cache")
+
+// fileCache keeps the contents of files the session read or wrote, so the
+// view/edit/view cycles of a session do not re-read them. An entry is used
+// only while the file's size and modification time are unchanged, which
+// also catches changes made outside the agent. A nil cache reads from disk.
+type fileCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int
+}
+
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	data    []byte
+}
+
+func newFileCache() *fileCache {
+	return &fileCache{entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+type fileCacheKey struct{}
+
+func withFileCache(ctx context.Context, c *fileCache) context.Context {
+	return context.WithValue(ctx, fileCacheKey{}, c)
+}
+
+func fileCacheFrom(ctx context.Context) *fileCache {
+	c, _ := ctx.Value(fileCacheKey{}).(*fileCache)
+	return c
+}
+
+// read returns the file's contents. Callers must not modify them.
+func (c *fileCache) read(path string) ([]byte, error) {
+	if c == nil {
+		return os.ReadFile(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[path]; ok {
+		f := el.Value.(*cachedFile)
+		if f.size == info.Size() && f.modTime.Equal(info.ModTime()) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			fileCacheStats.Add("hits", 1)
+			return f.data, nil
+		}
+	}
+	c.mu.Unlock()
+	fileCacheStats.Add("misses", 1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c.put(path, info, data)
+	return data, nil
+}
+
+// wrote records what the agent just wrote to path, so the next read is a
+// hit.
+func (c *fileCache) wrote(path string, data []byte) {
+	if c == nil {
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		c.put(path, info, data)
+	}
+}
+
+func (c *fileCache) put(path string, info os.FileInfo, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.remove(el)
+	}
+	// The size check keeps a file that changed while it was read from
+	// being cached under the wrong key.
+	if len(data) > maxCachedFileBytes || int64(len(data)) != info.Size() {
+		return
+	}
+	c.entries[path] = c.lru.PushFront(&cachedFile{path: path, size: info.Size(), modTime: info.ModTime(), data: data})
+	c.bytes += len(data)
+	for c.bytes > maxFileCacheBytes {
+		c.remove(c.lru.Back())
+		fileCacheStats.Add("evictions", 1)
+	}
+	fileCacheStats.Set("bytes", intVar(c.bytes))
+	fileCacheStats.Set("files", intVar(len(c.entries)))
+}
+
+func (c *fileCache) remove(el *list.Element) {
+	f := c.lru.Remove(el).(*cachedFile)
+	delete(c.entries, f.path)
+	c.bytes -= len(f.data)
+}
+
+func intVar(n int) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(int64(n))
+	return v
+}
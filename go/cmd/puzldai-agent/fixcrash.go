@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	defaultFixCrashRounds = 2
+	// maxTrace bounds the stack trace sent to the agent; the head and tail
+	// are kept, as the panic and the exception sit at either end.
+	maxTrace = 16_000
+	// maxCrashFrames bounds the workspace frames shown with their code.
+	maxCrashFrames = 8
+	crashExcerpt   = 5
+)
+
+var (
+	// File "app/views.py", line 12, in handler
+	pyFrameRe = regexp.MustCompile(`File "([^"]+)", line (\d+), in (\S+)`)
+	// at com.example.Foo.bar(Foo.java:12)
+	javaFrameRe = regexp.MustCompile(`at ([\w$.<>]+)\(([\w$]+\.\w+):(\d+)\)`)
+	// at handler (/srv/app/src/x.js:12:5), at /srv/app/src/x.js:12:5
+	jsFrameRe = regexp.MustCompile(`at (?:(?:async )?([^\s(]+) \()?(?:file://)?([^\s()]+?):(\d+):\d+\)?\s*$`)
+	// /home/me/app/main.go:12 +0x1d, src/main.rs:12:5, and the like
+	fileLineRe = regexp.MustCompile(`([\w.@/\\-]*[\w-]\.[A-Za-z]{1,5}):(\d+)`)
+)
+
+const fixCrashInstructions = `You are fixing a crash. The stack trace is below, with the code of the
+frames that are in this repository. Find the root cause: follow the values
+involved back from the crashing line instead of guarding the symptom at the
+top frame. Fix it with a minimal change, and add a regression test where the
+project has tests. Do not make unrelated changes.
+
+Finish with a short summary: the cause, the fix, and how it was checked.`
+
+// crashFrame is one frame of a stack trace.
+type crashFrame struct {
+	function string
+	file     string // as in the trace
+	line     int
+	// rel is the file in the workspace, when found.
+	rel string
+	// defs are the files defining function, from the symbol index, when
+	// the file itself was not found.
+	defs []string
+}
+
+const fixCrashUsage = "usage: puzldai-agent fix-crash [-cwd dir] [-repro cmd] [-verify cmd] [-rounds n] [-apply] [-patch-out file] < trace [-- agent flags]"
+
+// runFixCrash implements the fix-crash subcommand: the stack trace on stdin
+// is mapped to the workspace's code, the repro command confirms the crash,
+// an agent fixes it in a worktree of a snapshot of the workspace, and the
+// repro runs again to verify the fix, which is shown as a diff to apply or
+// leave.
+func runFixCrash(args []string) int {
+	fs := newFlagSet("fix-crash")
+	cwdFlag := fs.String("cwd", "", "Workspace (default: the current directory)")
+	reproFlag := fs.String("repro", "", "Shell command that reproduces the crash (exit 0 = fixed) (default: config repro)")
+	verifyFlag := fs.String("verify", "", "Shell command that must also pass after the fix (default: config verify)")
+	roundsFlag := fs.Int("rounds", defaultFixCrashRounds, "Times the agent may retry while the repro still fails")
+	applyFlag := fs.Bool("apply", false, "Apply the fix without asking if it is verified")
+	patchOutFlag := fs.String("patch-out", "", "Also write the diff to this file")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, fixCrashUsage)
+		return exitUsage
+	}
+	noColor = os.Getenv("NO_COLOR") != ""
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fix-crash: failed to read stdin:", err)
+		return exitError
+	}
+	trace := strings.TrimSpace(string(data))
+	if trace == "" {
+		fmt.Fprintln(os.Stderr, "fix-crash: no stack trace on stdin")
+		fmt.Fprintln(os.Stderr, fixCrashUsage)
+		return exitUsage
+	}
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fix-crash:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+	cfg, err := loadConfig(cwd, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fix-crash: failed to load config:", err)
+		return exitError
+	}
+	repro := firstNonEmpty(*reproFlag, cfg.Repro)
+	verify := firstNonEmpty(*verifyFlag, cfg.Verify)
+	check := joinChecks(repro, verify)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ws, err := newChildWorkspace(ctx, cwd, "fix-crash")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fix-crash:", err)
+		return exitError
+	}
+	// The run happens in a temporary worktree; book it to this project.
+	os.Setenv(projectEnv, projectName(cwd))
+	var children []*childRun
+	defer func() { ws.removeWorktrees(children) }()
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "fix-crash:", err)
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		return exitError
+	}
+
+	fixer, err := ws.newChild(ctx, 1, "fix", "fix", "", ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	children = append(children, fixer)
+
+	frames := locateFrames(fixer.cwd, parseStackTrace(trace))
+	if len(frames) == 0 {
+		fmt.Fprintln(os.Stderr, "no frame of the trace points into the workspace")
+	} else {
+		fmt.Fprintln(os.Stderr, "implicated code:")
+		for _, f := range frames {
+			fmt.Fprintln(os.Stderr, "  "+f.String())
+		}
+	}
+
+	var reproLog string
+	reproduced := false
+	if repro != "" {
+		ok, out := runCheck(ctx, fixer.cwd, repro)
+		reproLog = out
+		reproduced = !ok
+		if reproduced {
+			fmt.Fprintf(os.Stderr, "reproduced: %s fails\n", repro)
+		} else {
+			fmt.Fprintf(os.Stderr, "not reproduced: %s passes before the fix\n", repro)
+		}
+	}
+
+	var mu sync.Mutex
+	task := fixCrashTask(trace, frames, fixer.cwd, repro, reproLog, reproduced, verify)
+	if err := ws.runAgent(ctx, fixer, "fix", task, agentArgs, &mu); err != nil {
+		return fail(err)
+	}
+	fixer.collect(ctx, ws.base, check)
+	for round := 1; round <= *roundsFlag && fixer.verified != nil && !*fixer.verified; round++ {
+		fmt.Fprintf(os.Stderr, "the fix does not pass; round %d of %d\n", round, *roundsFlag)
+		if err := ws.runAgent(ctx, fixer, fmt.Sprintf("fix-%d", round), fixCrashRetryTask(trace, check, fixer.verifyLog), agentArgs, &mu); err != nil {
+			return fail(err)
+		}
+		fixer.collect(ctx, ws.base, check)
+	}
+	if fixer.patch == "" {
+		printAnswer(fixer.answer)
+		return fail(fmt.Errorf("the agent changed no files"))
+	}
+
+	patchFile := filepath.Join(ws.work, "fix-crash.patch")
+	if err := os.WriteFile(patchFile, []byte(fixer.patch), 0o644); err != nil {
+		return fail(err)
+	}
+	if *patchOutFlag != "" {
+		if err := os.WriteFile(*patchOutFlag, []byte(fixer.patch), 0o644); err != nil {
+			return fail(err)
+		}
+	}
+	if summary := strings.TrimSpace(fixer.answer); summary != "" {
+		fmt.Fprintf(os.Stderr, "summary:\n%s\n\n", summary)
+	}
+	printPatch(fixer.patch)
+	fmt.Fprintln(os.Stderr)
+	passed := fixer.verified == nil || *fixer.verified
+	switch {
+	case fixer.verified == nil:
+		fmt.Fprintln(os.Stderr, "not verified (no -repro or -verify command, or config repro or verify)")
+	case passed && repro != "" && !reproduced:
+		fmt.Fprintf(os.Stderr, "checks pass, but the repro passed before the fix too: %s\n", check)
+	case passed:
+		fmt.Fprintf(os.Stderr, "verified: %s\n", check)
+	default:
+		fmt.Fprintf(os.Stderr, "still failing: %s\n%s\n", check, strings.TrimSpace(fixer.verifyLog))
+	}
+
+	applied, err := offerPatch(ctx, ws.root, patchFile, "fix", passed, *applyFlag)
+	if err != nil {
+		return fail(err)
+	}
+	if !applied {
+		fmt.Fprintf(os.Stderr, "not applied; the patch is %s (git apply it from %s)\n", patchFile, ws.root)
+	}
+	if !passed {
+		return exitError
+	}
+	return exitOK
+}
+
+// joinChecks chains the non-empty commands, stopping at the first failure.
+func joinChecks(cmds ...string) string {
+	var parts []string
+	for _, c := range cmds {
+		if c != "" {
+			parts = append(parts, c)
+		}
+	}
+	if len(parts) < 2 {
+		return strings.Join(parts, "")
+	}
+	for i, c := range parts {
+		parts[i] = "(" + c + ")"
+	}
+	return strings.Join(parts, " && ")
+}
+
+// runCheck runs a shell command in dir and returns whether it passed, with
+// the tail of its output.
+func runCheck(ctx context.Context, dir, command string) (bool, string) {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	log := string(out)
+	if len(log) > maxVerifyOutput {
+		log = "..." + log[len(log)-maxVerifyOutput:]
+	}
+	return err == nil, log
+}
+
+// parseStackTrace finds the frames in a Go, Python, JavaScript, or Java
+// stack trace, innermost first as the trace lists them; other traces give
+// their file:line locations without function names.
+func parseStackTrace(trace string) []crashFrame {
+	var frames []crashFrame
+	lines := strings.Split(trace, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if m := pyFrameRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			frames = append(frames, crashFrame{function: m[3], file: m[1], line: n})
+			continue
+		}
+		if m := javaFrameRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[3])
+			// The class's package gives the file's directory.
+			file := m[2]
+			if parts := strings.Split(m[1], "."); len(parts) > 2 {
+				file = strings.Join(parts[:len(parts)-2], "/") + "/" + file
+			}
+			frames = append(frames, crashFrame{function: m[1], file: file, line: n})
+			continue
+		}
+		if m := jsFrameRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[3])
+			frames = append(frames, crashFrame{function: m[1], file: m[2], line: n})
+			continue
+		}
+		if m := fileLineRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			f := crashFrame{file: m[1], line: n}
+			// In a Go trace the function is on the line above its location:
+			//	main.(*server).handle(0xc000010000, ...)
+			//		/home/me/app/server.go:42 +0x1d
+			if strings.HasPrefix(line, "\t") && strings.HasSuffix(m[1], ".go") && i > 0 {
+				prev := strings.TrimSpace(lines[i-1])
+				if j := strings.LastIndex(prev, "("); j > 0 && !strings.HasPrefix(lines[i-1], "\t") {
+					f.function = prev[:j]
+				}
+			}
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// locateFrames maps the frames to files in the workspace at root. A file is
+// matched by the longest tail of its path, which must cover its directory
+// and name, or the whole path in the workspace, so that a library's
+// util/strings.go does not match the project's pkg/strings.go. Frames whose file is not found are looked up by function
+// name in the symbol index. Frames outside the workspace are dropped.
+func locateFrames(root string, frames []crashFrame) []crashFrame {
+	index := newRepoMap(root, 0, nil)
+	ignore, err := loadIgnoreRules([]string{root})
+	if err == nil {
+		index.ignore = ignore
+	}
+	files, _ := index.scan()
+	byName := map[string][]string{}
+	for _, f := range files {
+		byName[path.Base(f)] = append(byName[path.Base(f)], f)
+	}
+
+	var out []crashFrame
+	seen := map[string]bool{}
+	for _, f := range frames {
+		f.rel = matchTracePath(root, f.file, byName)
+		if f.rel == "" {
+			for _, name := range symbolCandidates(f.function) {
+				if f.defs = sameLanguage(index.definitions(name), f.file); len(f.defs) > 0 {
+					break
+				}
+			}
+		}
+		if f.rel == "" && len(f.defs) == 0 {
+			continue
+		}
+		key := f.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, f)
+		if len(out) == maxCrashFrames {
+			break
+		}
+	}
+	return out
+}
+
+// sameLanguage keeps the files with the extension of the trace's file, if
+// it has one, so that a JavaScript handler is not found in a Python file.
+func sameLanguage(files []string, traced string) []string {
+	ext := path.Ext(traced)
+	if ext == "" {
+		return files
+	}
+	var out []string
+	for _, f := range files {
+		if path.Ext(f) == ext {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func matchTracePath(root, file string, byName map[string][]string) string {
+	file = filepath.ToSlash(strings.TrimPrefix(file, "file://"))
+	if filepath.IsAbs(file) {
+		if rel, err := filepath.Rel(root, file); err == nil && !strings.HasPrefix(rel, "..") {
+			if _, err := os.Stat(file); err == nil {
+				return filepath.ToSlash(rel)
+			}
+		}
+	}
+	parts := strings.Split(strings.TrimPrefix(file, "./"), "/")
+	need := min(2, len(parts))
+	best, bestLen := "", 0
+	for _, cand := range byName[parts[len(parts)-1]] {
+		cparts := strings.Split(cand, "/")
+		n := 0
+		for n < len(parts) && n < len(cparts) && parts[len(parts)-1-n] == cparts[len(cparts)-1-n] {
+			n++
+		}
+		// A relative path in the trace must match whole.
+		if n > bestLen && (n >= need || n == len(cparts)) && (filepath.IsAbs(file) || n == len(parts)) {
+			best, bestLen = cand, n
+		}
+	}
+	return best
+}
+
+// symbolCandidates turns a trace's function name into the names the symbol
+// index may know it by: main.(*Server).Handle gives Server.Handle, then
+// Handle, then Server.
+func symbolCandidates(function string) []string {
+	if function == "" {
+		return nil
+	}
+	name := function
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.NewReplacer("(*", "", "(", "", ")", "", "[...]", "").Replace(name)
+	parts := strings.Split(name, ".")
+	// Drop the package or module.
+	if len(parts) > 1 {
+		parts = parts[1:]
+	}
+	var out []string
+	if len(parts) >= 2 {
+		out = append(out, strings.Join(parts[len(parts)-2:], "."))
+	}
+	out = append(out, parts[len(parts)-1])
+	if len(parts) >= 2 {
+		out = append(out, parts[len(parts)-2])
+	}
+	return out
+}
+
+func (f crashFrame) String() string {
+	fn := firstNonEmpty(f.function, "?")
+	if f.rel != "" {
+		return fmt.Sprintf("%s:%d (%s)", f.rel, f.line, fn)
+	}
+	return fmt.Sprintf("%s, defined in %s (from the symbol index)", fn, strings.Join(f.defs, ", "))
+}
+
+// excerpt returns the lines around the frame's line, numbered, with the
+// frame's line marked.
+func (f crashFrame) excerpt(root string) string {
+	data, err := os.ReadFile(filepath.Join(root, f.rel))
+	if err != nil || f.line < 1 {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if f.line > len(lines) {
+		return ""
+	}
+	var sb strings.Builder
+	for n := max(1, f.line-crashExcerpt); n <= min(len(lines), f.line+crashExcerpt); n++ {
+		mark := "  "
+		if n == f.line {
+			mark = "> "
+		}
+		fmt.Fprintf(&sb, "%s%d\t%s\n", mark, n, lines[n-1])
+	}
+	return sb.String()
+}
+
+func fixCrashTask(trace string, frames []crashFrame, root, repro, reproLog string, reproduced bool, verify string) string {
+	var sb strings.Builder
+	sb.WriteString(fixCrashInstructions + "\n\n## Stack trace\n\n```\n" + headTail(trace, maxTrace) + "\n```\n")
+	if len(frames) > 0 {
+		sb.WriteString("\n## Implicated code\n")
+		for _, f := range frames {
+			sb.WriteString("\n" + f.String() + "\n")
+			if x := f.excerpt(root); x != "" {
+				sb.WriteString("```\n" + x + "```\n")
+			}
+		}
+	}
+	switch {
+	case repro != "" && reproduced:
+		sb.WriteString("\n## Reproduction\n\n`" + repro + "` reproduces the crash; it must pass after the fix. Its output:\n```\n" + strings.TrimSpace(reproLog) + "\n```\n")
+	case repro != "":
+		sb.WriteString("\n## Reproduction\n\n`" + repro + "` is meant to reproduce the crash but passes as is, so the crash depends on something it does not cover. ")
+		sb.WriteString("Work from the trace, and reproduce it with a test if you can. The command must still pass after the fix.\n")
+	default:
+		sb.WriteString("\n## Reproduction\n\nThere is no repro command. Reproduce the crash with a test first if you can, and check that the fix makes it pass.\n")
+	}
+	if verify != "" {
+		sb.WriteString("\n## Verification\n\nThe result must also pass: `" + verify + "`\n")
+	}
+	return sb.String()
+}
+
+// fixCrashRetryTask sends the agent back while the checks still fail. Its
+// changes so far are staged in the worktree.
+func fixCrashRetryTask(trace, check, log string) string {
+	var sb strings.Builder
+	sb.WriteString("You are fixing a crash. A fix has been made, and its changes are staged (`git diff --cached` shows them), ")
+	sb.WriteString("but the checks still fail. Find out why and complete the fix; do not weaken the checks or change unrelated code. ")
+	sb.WriteString("Finish with a short summary: the cause, the fix, and how it was checked.\n\n")
+	sb.WriteString("## Stack trace\n\n```\n" + headTail(trace, maxTrace) + "\n```\n\n")
+	sb.WriteString("## Checks\n\n`" + check + "` failed:\n```\n" + strings.TrimSpace(log) + "\n```\n")
+	return sb.String()
+}
+
+// headTail shortens s to about limit bytes, keeping its start and end.
+func headTail(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	half := limit / 2
+	return s[:half] + "\n...\n" + s[len(s)-half:]
+}
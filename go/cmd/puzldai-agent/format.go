@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// formatTimeout bounds one formatter run.
+	formatTimeout = 30 * time.Second
+	// maxFormatOutput bounds the formatter output returned to the model.
+	maxFormatOutput = 4_000
+)
+
+// formatters maps file extensions to the commands that format them after
+// write and edit, from the [format] config section:
+//
+//	[format]
+//	".go" = "gofmt -w"
+//	".ts" = "prettier --write"
+//	".py" = "black -q"
+//
+// The file's path is appended to the command, which must rewrite the file
+// in place. Go files default to goimports when it is installed where the
+// workspace's commands run, which also adds missing imports and drops
+// unused ones; an empty command turns a formatter off. A nil formatters
+// formats nothing.
+type formatters map[string][]string
+
+func newFormatters(ctx context.Context, fsys workspaceFS, cfg map[string]string) (formatters, error) {
+	f := formatters{}
+	if err := fsys.LookPath(ctx, "goimports"); err == nil {
+		f[".go"] = []string{"goimports", "-w"}
+	}
+	for ext, command := range cfg {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		ext = strings.ToLower(ext)
+		if strings.TrimSpace(command) == "" {
+			delete(f, ext)
+			continue
+		}
+		f[ext] = strings.Fields(command)
+	}
+	if len(f) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+type formattersKey struct{}
+
+func withFormatters(ctx context.Context, f formatters) context.Context {
+	return context.WithValue(ctx, formattersKey{}, f)
+}
+
+func formattersFrom(ctx context.Context) formatters {
+	f, _ := ctx.Value(formattersKey{}).(formatters)
+	return f
+}
+
+// format runs the formatter for path, if any, and returns the file's
+// contents afterwards and the formatter's name. A formatter that fails
+// leaves the file as written and returns its output as the error.
+func (f formatters) format(ctx context.Context, cwd, path string, content []byte) ([]byte, string, error) {
+	args, ok := f[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return content, "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, formatTimeout)
+	defer cancel()
+	fsys := workspaceFSFrom(ctx)
+	cmd, err := fsys.Command(ctx, cwd, args[0], append(args[1:], commandPath(cwd, path))...)
+	if err != nil {
+		return content, "", err
+	}
+	if env := commandEnv(ctx); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	name := filepath.Base(args[0])
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(out.String())
+		if msg == "" || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			msg = err.Error()
+		}
+		return content, name, fmt.Errorf("%s failed; the file was saved unformatted:\n%s", name, truncateOutput(msg, maxFormatOutput))
+	}
+	formatted, err := fsys.ReadFile(ctx, path)
+	if err != nil {
+		return content, name, err
+	}
+	return formatted, name, nil
+}
+
+// writeReport formats a file that write or edit just saved and reports the
+// change from before, including what the formatter did.
+func writeReport(ctx context.Context, cwd, full, note, before string, written []byte) (string, error) {
+	// Formatters work on disk; -emit patch runs keep files as written.
+	if _, inMemory := workspaceFSFrom(ctx).(*overlay); inMemory {
+		return editReport(displayPath(cwd, full), note, before, string(written)), nil
+	}
+	after, formatter, err := formattersFrom(ctx).format(ctx, cwd, full, written)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(after, written) {
+		note = strings.TrimPrefix(note+"; formatted with "+formatter, "; ")
+	}
+	return editReport(displayPath(cwd, full), note, before, string(after)), nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// geminiProvider talks to the Gemini generateContent API. Unlike the
+// flattened providers it sends the system prompt as systemInstruction,
+// declares tools as functions, and replays native calls as functionCall and
+// functionResponse parts.
+type geminiProvider struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     []byte `json:"data"`
+}
+
+type geminiFunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiFunctionDecl struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type geminiRequest struct {
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	Contents          []geminiContent `json:"contents"`
+	Tools             []struct {
+		FunctionDeclarations []geminiFunctionDecl `json:"functionDeclarations"`
+	} `json:"tools,omitempty"`
+	GenerationConfig struct {
+		MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+		Temperature     *float64 `json:"temperature,omitempty"`
+		TopP            *float64 `json:"topP,omitempty"`
+	} `json:"generationConfig"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int64 `json:"promptTokenCount"`
+		CandidatesTokenCount int64 `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *geminiProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	var body geminiRequest
+	body.SystemInstruction = &geminiContent{Parts: []geminiPart{{Text: req.system}}}
+	body.Contents = geminiContents(req.messages)
+	if len(req.images) > 0 {
+		parts := make([]geminiPart, 0, 2*len(req.images))
+		for _, img := range req.images {
+			parts = append(parts, geminiPart{Text: img.label}, geminiPart{InlineData: &geminiBlob{MimeType: img.mediaType, Data: img.data}})
+		}
+		if last := len(body.Contents) - 1; last >= 0 && body.Contents[last].Role == "user" {
+			body.Contents[last].Parts = append(body.Contents[last].Parts, parts...)
+		} else {
+			body.Contents = append(body.Contents, geminiContent{Role: "user", Parts: parts})
+		}
+	}
+	body.GenerationConfig.MaxOutputTokens = req.maxTokens
+	body.GenerationConfig.Temperature = req.temperature
+	body.GenerationConfig.TopP = req.topP
+	if len(req.tools) > 0 {
+		decls := make([]geminiFunctionDecl, 0, len(req.tools))
+		for _, tool := range req.tools {
+			decls = append(decls, geminiFunctionDecl{
+				Name:        tool.name,
+				Description: tool.description,
+				Parameters:  jsonSchema(tool.params),
+			})
+		}
+		body.Tools = append(body.Tools, struct {
+			FunctionDeclarations []geminiFunctionDecl `json:"functionDeclarations"`
+		}{decls})
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/models/%s:generateContent", p.baseURL, url.PathEscape(req.model))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-goog-api-key", p.apiKey)
+
+	resp, err := p.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	if err != nil {
+		return nil, err
+	}
+	var out geminiResponse
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+	if out.Error != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Status, out.Error.Message)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, errors.New(resp.Status)
+	}
+	if len(out.Candidates) == 0 {
+		return nil, errors.New("response contained no candidates")
+	}
+
+	result := &completion{
+		usage: tokenUsage{
+			inputTokens:  out.UsageMetadata.PromptTokenCount,
+			outputTokens: out.UsageMetadata.CandidatesTokenCount,
+		},
+		truncated: out.Candidates[0].FinishReason == "MAX_TOKENS",
+	}
+	var text strings.Builder
+	for i, part := range out.Candidates[0].Content.Parts {
+		if part.FunctionCall != nil {
+			result.toolCalls = append(result.toolCalls, toolCall{
+				id:        fmt.Sprintf("call_%d_%d", len(req.messages), i),
+				name:      part.FunctionCall.Name,
+				arguments: part.FunctionCall.Args,
+			})
+			continue
+		}
+		text.WriteString(part.Text)
+	}
+	result.text = text.String()
+	return result, nil
+}
+
+// geminiContents maps the transcript onto Gemini roles. Native calls are
+// replayed as functionCall/functionResponse pairs; text-protocol tool results
+// are sent as user text, matching the flattened prompt format.
+func geminiContents(messages []agentMessage) []geminiContent {
+	var contents []geminiContent
+	native := false
+	for _, msg := range messages {
+		switch msg.role {
+		case "user":
+			contents = append(contents, geminiContent{Role: "user", Parts: []geminiPart{{Text: msg.content}}})
+		case "assistant":
+			var parts []geminiPart
+			if msg.content != "" {
+				parts = append(parts, geminiPart{Text: msg.content})
+			}
+			for _, call := range msg.toolCalls {
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{Name: call.name, Args: call.arguments}})
+			}
+			if len(parts) == 0 {
+				parts = append(parts, geminiPart{Text: ""})
+			}
+			native = len(msg.toolCalls) > 0
+			contents = append(contents, geminiContent{Role: "model", Parts: parts})
+		case "tool":
+			if native {
+				parts := make([]geminiPart, 0, len(msg.toolResults))
+				for _, result := range msg.toolResults {
+					key := "output"
+					if result.isError {
+						key = "error"
+					}
+					parts = append(parts, geminiPart{FunctionResponse: &geminiFunctionResponse{
+						Name:     result.name,
+						Response: map[string]any{key: result.content},
+					}})
+				}
+				contents = append(contents, geminiContent{Role: "user", Parts: parts})
+				continue
+			}
+			var sb strings.Builder
+			writeToolResults(&sb, msg.toolResults)
+			contents = append(contents, geminiContent{Role: "user", Parts: []geminiPart{{Text: sb.String()}}})
+		}
+	}
+	return contents
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const defaultGenTestsRounds = 3
+
+// maxTestOutput bounds the go test output sent back to the test writer.
+const maxTestOutput = 8_000
+
+var (
+	coverageRe = regexp.MustCompile(`coverage: ([\d.]+)% of statements`)
+	// pkg/foo/bar.go:12.34,15.2 3 0
+	coverBlockRe = regexp.MustCompile(`^(.+):(\d+)\.\d+,(\d+)\.\d+ \d+ (\d+)$`)
+)
+
+const genTestsInstructions = `You are writing tests for a Go package. Read its code and any existing
+tests first. Then add table-driven tests in _test.go files next to the code,
+covering the exported API, edge cases, and error paths. Follow the style of
+the existing tests and their package (internal or _test); use only the
+standard library and modules the project already requires. Do not change
+non-test files: only test files and testdata are kept.
+
+Run go test -cover in the package directory until the tests compile and pass.
+When a test shows that the code really misbehaves, do not change the code or
+weaken the test: keep the test and skip it with t.Skip("BUG: what is wrong").
+Finish with a short summary of what the tests cover.`
+
+// testRun is the outcome of go test on the target package.
+type testRun struct {
+	passed   bool
+	coverage float64
+	covered  bool
+	output   string
+	// bugs are the tests skipped with a "BUG:" reason.
+	bugs []string
+	// uncovered are the statement blocks no test ran, by file and line.
+	uncovered []uncoveredBlock
+}
+
+// uncoveredBlock is a range of lines of a file in the package that holds
+// statements no test ran.
+type uncoveredBlock struct {
+	file       string
+	start, end int
+}
+
+const genTestsUsage = "usage: puzldai-agent gen-tests [-path dir] [-cwd dir] [-rounds n] [-coverage percent] [-apply] [-patch-out file] [-- agent flags]"
+
+// runGenTests implements the gen-tests subcommand: a test writer adds tests
+// for a Go package in a worktree of a snapshot of the workspace, the tests
+// are run and sent back until they compile and pass, or with -coverage until
+// they cover enough of the package, and the new test files are shown as a
+// diff to apply or leave, with the coverage they add.
+func runGenTests(args []string) int {
+	fs := newFlagSet("gen-tests")
+	pathFlag := fs.String("path", ".", "Directory of the Go package to test, relative to -cwd")
+	cwdFlag := fs.String("cwd", "", "Workspace (default: the current directory)")
+	roundsFlag := fs.Int("rounds", defaultGenTestsRounds, "Times the test writer may fix tests that fail to build or pass, or add tests to reach -coverage")
+	coverageFlag := fs.Float64("coverage", 0, "Statement coverage percentage to reach; the test writer adds tests for uncovered lines until it does (default: config coverage, or none)")
+	applyFlag := fs.Bool("apply", false, "Apply the new tests without asking if they pass")
+	patchOutFlag := fs.String("patch-out", "", "Also write the diff to this file")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, genTestsUsage)
+		return exitUsage
+	}
+	noColor = os.Getenv("NO_COLOR") != ""
+
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gen-tests:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+	cfg, err := loadConfig(cwd, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gen-tests: failed to load config:", err)
+		return exitError
+	}
+	target := *coverageFlag
+	if target == 0 {
+		target = cfg.Coverage
+	}
+	if target < 0 || target > 100 {
+		fmt.Fprintf(os.Stderr, "gen-tests: coverage %g is not a percentage between 0 and 100\n", target)
+		return exitUsage
+	}
+	pkg := filepath.Clean(*pathFlag)
+	if !hasGoSources(filepath.Join(cwd, pkg)) || !inGoModule(context.Background(), diskFS{}, filepath.Join(cwd, pkg)) {
+		fmt.Fprintf(os.Stderr, "gen-tests: %s is not a Go package in a module; only Go is supported\n", pkg)
+		return exitError
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ws, err := newChildWorkspace(ctx, cwd, "gen-tests")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gen-tests:", err)
+		return exitError
+	}
+	// The run happens in a temporary worktree; book it to this project.
+	os.Setenv(projectEnv, projectName(cwd))
+	var children []*childRun
+	defer func() { ws.removeWorktrees(children) }()
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "gen-tests:", err)
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		return exitError
+	}
+
+	writer, err := ws.newChild(ctx, 1, "tests", "tests", "", ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	children = append(children, writer)
+	dir := filepath.Join(writer.cwd, pkg)
+	before := goTest(ctx, dir)
+	if !before.passed {
+		fmt.Fprintln(os.Stderr, "the package's existing tests fail; the coverage before may be off")
+	}
+
+	var mu sync.Mutex
+	task := genTestsInstructions + "\n\n## Package\n\n" + filepath.ToSlash(pkg) + "\n"
+	if target > 0 {
+		task += fmt.Sprintf("\n## Coverage target\n\nAdd tests until go test -cover reports at least %.1f%% of statements.\n", target)
+	}
+	if before.covered && len(before.uncovered) > 0 {
+		task += fmt.Sprintf("\n## Uncovered code\n\nThe existing tests cover %.1f%% of statements. These lines are not run by any test:\n\n", before.coverage)
+		task += uncoveredReport(dir, before.uncovered, maxTestOutput)
+	}
+	if err := ws.runAgent(ctx, writer, "tests", task, agentArgs, &mu); err != nil {
+		return fail(err)
+	}
+	after := goTest(ctx, dir)
+	for round := 1; round <= *roundsFlag; round++ {
+		var label string
+		switch {
+		case !after.passed:
+			fmt.Fprintf(os.Stderr, "tests fail; fix round %d of %d\n", round, *roundsFlag)
+			label, task = fmt.Sprintf("fix-%d", round), genTestsFixTask(pkg, after.output)
+		case belowTarget(after, target):
+			fmt.Fprintf(os.Stderr, "coverage %.1f%% is below %.1f%%; coverage round %d of %d\n", after.coverage, target, round, *roundsFlag)
+			label, task = fmt.Sprintf("cover-%d", round), genTestsCoverageTask(pkg, after, target, uncoveredReport(dir, after.uncovered, maxTestOutput))
+		}
+		if label == "" {
+			break
+		}
+		if err := ws.runAgent(ctx, writer, label, task, agentArgs, &mu); err != nil {
+			return fail(err)
+		}
+		previous := after
+		after = goTest(ctx, dir)
+		if previous.passed && after.passed && after.coverage <= previous.coverage {
+			fmt.Fprintln(os.Stderr, "coverage did not improve; stopping")
+			break
+		}
+	}
+
+	// Only tests are kept; the writer was asked not to touch the code.
+	dropped, err := dropNonTestChanges(ctx, writer.dir, ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	if len(dropped) > 0 {
+		fmt.Fprintf(os.Stderr, "changes outside test files were dropped: %s\n", strings.Join(dropped, ", "))
+		after = goTest(ctx, dir)
+	}
+	patch, err := runGit(ctx, writer.dir, "diff", "--cached", "--binary", ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	if patch == "" {
+		printAnswer(writer.answer)
+		return fail(fmt.Errorf("no tests were written"))
+	}
+	patchFile := filepath.Join(ws.work, "gen-tests.patch")
+	if err := os.WriteFile(patchFile, []byte(patch), 0o644); err != nil {
+		return fail(err)
+	}
+	if *patchOutFlag != "" {
+		if err := os.WriteFile(*patchOutFlag, []byte(patch), 0o644); err != nil {
+			return fail(err)
+		}
+	}
+
+	if summary := strings.TrimSpace(writer.answer); summary != "" {
+		fmt.Fprintf(os.Stderr, "summary:\n%s\n\n", summary)
+	}
+	printPatch(patch)
+	fmt.Fprintln(os.Stderr)
+	if after.passed {
+		fmt.Fprintln(os.Stderr, "tests pass")
+	} else {
+		fmt.Fprintf(os.Stderr, "tests fail:\n%s\n", truncateOutput(strings.TrimSpace(after.output), maxVerifyOutput))
+	}
+	coverage := coverageDelta(before, after)
+	if target > 0 {
+		if belowTarget(after, target) || !after.covered {
+			coverage += fmt.Sprintf("; target %.1f%% not met", target)
+		} else {
+			coverage += fmt.Sprintf("; target %.1f%% met", target)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "coverage of %s: %s\n", filepath.ToSlash(pkg), coverage)
+	if len(after.bugs) > 0 {
+		fmt.Fprintln(os.Stderr, "failing behaviors, skipped as BUG:")
+		for _, bug := range after.bugs {
+			fmt.Fprintln(os.Stderr, "- "+bug)
+		}
+	}
+
+	applied, err := offerPatch(ctx, ws.root, patchFile, "tests", after.passed, *applyFlag)
+	if err != nil {
+		return fail(err)
+	}
+	if !applied {
+		fmt.Fprintf(os.Stderr, "not applied; the patch is %s (git apply it from %s)\n", patchFile, ws.root)
+	}
+	if !after.passed {
+		return exitError
+	}
+	return exitOK
+}
+
+// dropNonTestChanges stages the changes in the worktree at dir, then undoes
+// those outside test files and testdata, returning their paths.
+func dropNonTestChanges(ctx context.Context, dir, base string) ([]string, error) {
+	if _, err := runGit(ctx, dir, "add", "-A"); err != nil {
+		return nil, err
+	}
+	code := []string{"--", ".", ":(exclude,glob)**/*_test.go", ":(exclude,glob)**/testdata/**"}
+	changed, err := runGit(ctx, dir, append([]string{"diff", "--cached", "--name-only", base}, code...)...)
+	if err != nil || strings.TrimSpace(changed) == "" {
+		return nil, err
+	}
+	added, err := runGit(ctx, dir, append([]string{"diff", "--cached", "--name-only", "--diff-filter=A", base}, code...)...)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range strings.Fields(added) {
+		if _, err := runGit(ctx, dir, "rm", "-q", "-f", "--", path); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := runGit(ctx, dir, append([]string{"checkout", base}, code...)...); err != nil {
+		return nil, err
+	}
+	return strings.Fields(changed), nil
+}
+
+// hasGoSources reports whether dir holds non-test Go files.
+func hasGoSources(dir string) bool {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, m := range matches {
+		if !strings.HasSuffix(m, "_test.go") {
+			return true
+		}
+	}
+	return false
+}
+
+// goTest runs the package's tests verbosely with coverage.
+func goTest(ctx context.Context, dir string) testRun {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	args := []string{"test", "-count=1", "-cover", "-v"}
+	profile := ""
+	if f, err := os.CreateTemp("", "puzldai-cover-*.out"); err == nil {
+		profile = f.Name()
+		f.Close()
+		defer os.Remove(profile)
+		args = append(args, "-coverprofile="+profile)
+	}
+	cmd := exec.CommandContext(ctx, "go", append(args, ".")...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	r := testRun{passed: err == nil, output: string(out), bugs: skippedBugs(string(out))}
+	if m := coverageRe.FindAllStringSubmatch(r.output, -1); m != nil {
+		r.coverage, _ = strconv.ParseFloat(m[len(m)-1][1], 64)
+		r.covered = true
+	}
+	if profile != "" {
+		r.uncovered = uncoveredBlocks(profile)
+	}
+	return r
+}
+
+// uncoveredBlocks reads a cover profile and returns the blocks no test ran,
+// merged into line ranges per file and sorted. Files are named by base name,
+// since the profile covers a single package.
+func uncoveredBlocks(profile string) []uncoveredBlock {
+	data, err := os.ReadFile(profile)
+	if err != nil {
+		return nil
+	}
+	// A block is listed once per test binary; it is covered if any ran it.
+	covered := map[uncoveredBlock]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		m := coverBlockRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		start, _ := strconv.Atoi(m[2])
+		end, _ := strconv.Atoi(m[3])
+		b := uncoveredBlock{file: path.Base(m[1]), start: start, end: end}
+		covered[b] = covered[b] || m[4] != "0"
+	}
+	var blocks []uncoveredBlock
+	for b, ran := range covered {
+		if !ran {
+			blocks = append(blocks, b)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].file != blocks[j].file {
+			return blocks[i].file < blocks[j].file
+		}
+		return blocks[i].start < blocks[j].start
+	})
+	var merged []uncoveredBlock
+	for _, b := range blocks {
+		if n := len(merged); n > 0 && merged[n-1].file == b.file && b.start <= merged[n-1].end+1 {
+			merged[n-1].end = max(merged[n-1].end, b.end)
+			continue
+		}
+		merged = append(merged, b)
+	}
+	return merged
+}
+
+// uncoveredReport shows the uncovered line ranges with their source, up to
+// about limit bytes.
+func uncoveredReport(dir string, blocks []uncoveredBlock, limit int) string {
+	var sb strings.Builder
+	var lines []string
+	file := ""
+	for i, b := range blocks {
+		if sb.Len() > limit {
+			fmt.Fprintf(&sb, "... and %d more uncovered ranges\n", len(blocks)-i)
+			break
+		}
+		if b.file != file {
+			file = b.file
+			data, _ := os.ReadFile(filepath.Join(dir, file))
+			lines = strings.Split(string(data), "\n")
+		}
+		fmt.Fprintf(&sb, "%s:%d-%d\n```go\n", b.file, b.start, b.end)
+		for n := b.start; n <= b.end && n <= len(lines); n++ {
+			sb.WriteString(lines[n-1] + "\n")
+		}
+		sb.WriteString("```\n")
+	}
+	return sb.String()
+}
+
+// belowTarget reports whether a passing run's coverage is known and short of
+// the target percentage; a zero target is no target.
+func belowTarget(r testRun, target float64) bool {
+	return target > 0 && r.covered && r.coverage < target
+}
+
+// skippedBugs lists the tests go test -v reports as skipped after logging
+// a reason starting with "BUG:".
+func skippedBugs(output string) []string {
+	var bugs []string
+	reasons := map[string]string{}
+	var current string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, "=== RUN"); ok {
+			current = strings.TrimSpace(name)
+		} else if name, ok := strings.CutPrefix(line, "=== CONT"); ok {
+			current = strings.TrimSpace(name)
+		} else if name, ok := strings.CutPrefix(line, "--- SKIP: "); ok {
+			name, _, _ = strings.Cut(name, " ")
+			if reason, ok := reasons[name]; ok {
+				bugs = append(bugs, name+": "+reason)
+			}
+		} else if _, reason, ok := strings.Cut(line, ": BUG:"); ok && current != "" {
+			// x_test.go:12: BUG: what is wrong
+			reasons[current] = strings.TrimSpace(reason)
+		}
+	}
+	return bugs
+}
+
+func coverageDelta(before, after testRun) string {
+	switch {
+	case !after.covered:
+		return "unknown"
+	case !before.covered:
+		return fmt.Sprintf("%.1f%%", after.coverage)
+	}
+	return fmt.Sprintf("%.1f%% -> %.1f%% (%+.1f points)", before.coverage, after.coverage, after.coverage-before.coverage)
+}
+
+func genTestsCoverageTask(pkg string, run testRun, target float64, report string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "You are extending tests for a Go package; the tests in the workspace pass but cover %.1f%% of statements, short of the %.1f%% target. ", run.coverage, target)
+	sb.WriteString("Add tests that run the uncovered lines below, without changing non-test files; lines that cannot sensibly be reached from a test may stay uncovered. ")
+	sb.WriteString("Run go test -cover in the package directory until the tests pass. Finish with a short summary of what the tests cover.\n\n")
+	sb.WriteString("## Package\n\n" + filepath.ToSlash(pkg) + "\n\n")
+	sb.WriteString("## Uncovered code\n\n" + report)
+	return sb.String()
+}
+
+func genTestsFixTask(pkg, output string) string {
+	if len(output) > maxTestOutput {
+		output = "..." + output[len(output)-maxTestOutput:]
+	}
+	var sb strings.Builder
+	sb.WriteString("You are finishing tests for a Go package; the tests written so far are in the workspace, but go test fails. ")
+	sb.WriteString("Make them compile and pass without changing non-test files. When a test shows that the code really misbehaves, ")
+	sb.WriteString("keep it and skip it with t.Skip(\"BUG: what is wrong\"). Finish with a short summary of what the tests cover.\n\n")
+	sb.WriteString("## Package\n\n" + filepath.ToSlash(pkg) + "\n\n")
+	sb.WriteString("## go test -cover -v output\n\n```\n" + strings.TrimSpace(output) + "\n```\n")
+	return sb.String()
+}
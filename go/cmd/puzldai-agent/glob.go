@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// globEntry is one glob match. modTime is zero when the workspace could not
+// report it.
+type globEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// globWalk matches pattern against the paths below base in fsys, leaving
+// out what hidden reports. Only directories on the way to the pattern's
+// literal prefix are entered, and unless the pattern has a **, none deeper
+// than it has segments.
+func globWalk(ctx context.Context, fsys workspaceFS, base, pattern string, hidden func(path string, dir bool) bool) ([]globEntry, error) {
+	prefix, _ := doublestar.SplitPattern(pattern)
+	depth := -1
+	if !strings.Contains(pattern, "**") {
+		depth = strings.Count(pattern, "/") + 1
+	}
+	var entries []globEntry
+	err := fsys.Walk(ctx, base, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Unreadable entries are left out, as a missing base is; a base
+		// that cannot be listed is an error.
+		if err != nil {
+			if path == base && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		rel := filepath.ToSlash(strings.TrimLeft(strings.TrimPrefix(path, base), `/\`))
+		if rel == "" {
+			return nil
+		}
+		skip := func() error {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if prefix != "." && rel != prefix && !strings.HasPrefix(rel, prefix+"/") && !strings.HasPrefix(prefix, rel+"/") {
+			return skip()
+		}
+		level := strings.Count(rel, "/") + 1
+		if depth >= 0 && level > depth || hidden(path, d.IsDir()) {
+			return skip()
+		}
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			e := globEntry{path: rel, dir: d.IsDir()}
+			if info, err := d.Info(); err == nil {
+				e.size, e.modTime = info.Size(), info.ModTime()
+			}
+			entries = append(entries, e)
+		}
+		if level == depth {
+			return skip()
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// formatGlob sorts entries by name (ascending), mtime (newest first), or
+// size (largest first), keeps the first limit (0 for all), and lists each
+// with its size and modification time.
+func formatGlob(entries []globEntry, sortBy string, limit int) string {
+	if len(entries) == 0 {
+		return "(no matches)"
+	}
+	switch sortBy {
+	case "mtime":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].modTime.After(entries[j].modTime) })
+	case "size":
+		// Directory sizes are filesystem block counts, not content; list
+		// them after files.
+		size := func(e globEntry) int64 {
+			if e.dir {
+				return -1
+			}
+			return e.size
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return size(entries[i]) > size(entries[j]) })
+	default:
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	}
+	total := len(entries)
+	if limit > 0 && limit < total {
+		entries = entries[:limit]
+	}
+
+	width := 0
+	for _, e := range entries {
+		width = max(width, len(e.path)+1)
+	}
+	var sb strings.Builder
+	if len(entries) < total {
+		fmt.Fprintf(&sb, "showing %d of %d matches (sorted by %s)\n", len(entries), total, firstNonEmpty(sortBy, "name"))
+	}
+	for _, e := range entries {
+		name := e.path
+		if e.dir {
+			name += "/"
+		}
+		switch {
+		case e.modTime.IsZero():
+			sb.WriteString(name)
+		case e.dir:
+			fmt.Fprintf(&sb, "%-*s  %8s  %s", width, name, "-", e.modTime.Local().Format("2006-01-02 15:04"))
+		default:
+			fmt.Fprintf(&sb, "%-*s  %8s  %s", width, name, formatSize(e.size), e.modTime.Local().Format("2006-01-02 15:04"))
+		}
+		sb.WriteByte('\n')
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
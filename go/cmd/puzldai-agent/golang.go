@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// goTools are the Go-aware editing and testing tools, offered when the
+// workspace is in a Go module.
+func goTools(sess *session) []toolDef {
+	if fsys, dir := sess.workspace(); !inGoModule(context.Background(), fsys, dir) {
+		return nil
+	}
+	return []toolDef{
+		{
+			name:        "go_add_import",
+			description: "Add an import to a Go file, in the right group, instead of editing the import block by hand; add it once the code using it is in place",
+			params: []toolParam{
+				required("path", "string", "Go file"),
+				required("import", "string", "import path, e.g. net/http"),
+				optional("name", "string", "import name, for a renamed, _ or . import"),
+			},
+			fn: toolGoAddImport,
+		},
+		{
+			name:        "ast_edit",
+			description: "Refactor Go code structurally across the module: rename a symbol with all its references, add or remove a function parameter at every call, or add a struct field",
+			params: []toolParam{
+				required("operation", "string", "").oneOf("rename", "add_param", "remove_param", "add_field"),
+				required("symbol", "string", "package-level name, or Type.Method / Type.Field; the struct type for add_field"),
+				optional("package", "string", "directory of the package declaring symbol").withDefault("."),
+				optional("new_name", "string", "rename: the new name"),
+				optional("name", "string", "add_param, add_field: name of the new parameter or field"),
+				optional("type", "string", "add_param, add_field: its type"),
+				optional("tag", "string", "add_field: struct tag, without backquotes"),
+				optional("index", "integer", "add_param, remove_param: parameter position from 0; add_param appends by default"),
+				optional("value", "string", "add_param: argument to pass at existing calls"),
+			},
+			fn: toolASTEdit,
+		},
+		{
+			name:        "retest",
+			description: "Rerun a Go test many times, optionally with the race detector and in shuffled order, and report how often it fails and the distinct failure outputs; use it to reproduce a flaky test and to confirm a fix",
+			params: []toolParam{
+				required("test", "string", "test name such as TestFoo or TestFoo/case, matched exactly; or a -run regexp"),
+				optional("package", "string", "directory of the package").withDefault("."),
+				optional("count", "integer", fmt.Sprintf("runs, at most %d", maxRetestRuns)).withDefault(defaultRetestRuns),
+				optional("race", "boolean", "build with the race detector"),
+				optional("shuffle", "boolean", "shuffle test order, with a new seed each run"),
+			},
+			fn: toolRetest,
+		},
+	}
+}
+
+// inGoModule reports whether dir is inside a directory with a go.mod.
+func inGoModule(ctx context.Context, fsys workspaceFS, dir string) bool {
+	for {
+		if _, err := fsys.Stat(ctx, filepath.Join(dir, "go.mod")); err == nil {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+func toolGoAddImport(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	path, _ := argString(args, "path")
+	importPath, _ := argString(args, "import")
+	name, _ := argString(args, "name")
+	if strings.Trim(importPath, `"`) == "" {
+		return "", errors.New("go_add_import: empty import path")
+	}
+	importPath = strings.Trim(importPath, `"`)
+	full := resolvePath(cwd, path)
+	before, err := workspaceFSFrom(ctx).ReadFile(ctx, full)
+	if err != nil {
+		return "", err
+	}
+	updated, err := addGoImport(before, name, importPath)
+	if err != nil {
+		return "", fmt.Errorf("go_add_import: %s: %w", displayPath(cwd, full), err)
+	}
+	if updated == nil {
+		return fmt.Sprintf("ok (%s already imports %q)", displayPath(cwd, full), importPath), nil
+	}
+	if err := workspaceFSFrom(ctx).WriteFile(ctx, full, updated); err != nil {
+		return "", err
+	}
+	return editReport(displayPath(cwd, full), "", string(before), string(updated)), nil
+}
+
+// addGoImport returns src with the import added and formatted, or nil when
+// the file already has it. Standard library imports join the first group
+// and others the last, so existing grouping is kept.
+func addGoImport(src []byte, name, importPath string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range file.Imports {
+		if p, _ := strconv.Unquote(spec.Path.Value); p == importPath && identName(spec.Name) == name {
+			return nil, nil
+		}
+	}
+	line := strconv.Quote(importPath)
+	if name != "" {
+		line = name + " " + line
+	}
+	std := isStdImport(importPath)
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+
+	var decl *ast.GenDecl
+	for _, d := range file.Decls {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			decl = gd
+			break
+		}
+	}
+	var out []byte
+	switch {
+	case decl == nil:
+		at := lineEnd(src, offset(file.Name.End()))
+		out = splice(src, at, at, "\n\nimport "+line)
+	case !decl.Lparen.IsValid():
+		// import "fmt" becomes a block.
+		existing := string(src[offset(decl.Specs[0].Pos()):offset(decl.End())])
+		specs := []string{existing, line}
+		if std != isStdImport(importSpecPath(decl.Specs[0])) {
+			specs = []string{existing, "", line}
+			if std {
+				specs = []string{line, "", existing}
+			}
+		}
+		out = splice(src, offset(decl.Pos()), offset(decl.End()), "import (\n\t"+strings.Join(specs, "\n\t")+"\n)")
+	default:
+		// After the last import of the same kind; failing that, as a group
+		// of its own at the start (standard library) or the end.
+		var last ast.Spec
+		for _, spec := range decl.Specs {
+			if isStdImport(importSpecPath(spec)) == std {
+				last = spec
+			}
+		}
+		switch {
+		case last != nil:
+			at := lineEnd(src, offset(last.End()))
+			out = splice(src, at, at, "\n\t"+line)
+		case std && len(decl.Specs) > 0:
+			at := offset(decl.Lparen) + 1
+			out = splice(src, at, at, "\n\t"+line+"\n")
+		case len(decl.Specs) > 0:
+			at := lineEnd(src, offset(decl.Specs[len(decl.Specs)-1].End()))
+			out = splice(src, at, at, "\n\n\t"+line)
+		default:
+			at := offset(decl.Lparen) + 1
+			out = splice(src, at, at, "\n\t"+line)
+		}
+	}
+	return format.Source(out)
+}
+
+func identName(id *ast.Ident) string {
+	if id == nil {
+		return ""
+	}
+	return id.Name
+}
+
+func importSpecPath(spec ast.Spec) string {
+	p, _ := strconv.Unquote(spec.(*ast.ImportSpec).Path.Value)
+	return p
+}
+
+// isStdImport reports whether path looks like a standard library package:
+// its first element has no dot, as every module path outside it does.
+func isStdImport(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return !strings.Contains(first, ".")
+}
+
+// lineEnd returns the offset of the end of the line holding offset, so
+// insertions go after a trailing comment.
+func lineEnd(src []byte, offset int) int {
+	if i := bytes.IndexByte(src[offset:], '\n'); i >= 0 {
+		return offset + i
+	}
+	return len(src)
+}
+
+func splice(src []byte, from, to int, text string) []byte {
+	out := make([]byte, 0, len(src)+len(text))
+	out = append(out, src[:from]...)
+	out = append(out, text...)
+	return append(out, src[to:]...)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultGrepPerFile = 5
+	// defaultGrepMaxResults stops a broad search early; the model cannot use
+	// more matches than this anyway.
+	defaultGrepMaxResults = 1000
+	maxGrepWorkers        = 16
+	maxGrepFiles          = 50
+	maxGrepLineBytes      = 200
+	// maxGrepFileBytes skips build artifacts, dumps, and other large files;
+	// they are listed in the result so the model can search them with bash.
+	maxGrepFileBytes = 10 << 20
+	// grepBufferBytes bounds what is held of one line: longer lines are
+	// matched on their first grepBufferBytes.
+	grepBufferBytes = 64 << 10
+	// binarySniffBytes is how much of a file is checked for a NUL byte.
+	binarySniffBytes = 8000
+)
+
+// grepFile collects the matches in one file. modTime is zero when unknown,
+// as on remote hosts without GNU find. Only the first few matches are kept;
+// total counts them all.
+type grepFile struct {
+	path    string
+	lines   int
+	modTime time.Time
+	matches []grepMatch
+	total   int
+}
+
+// add counts a match and keeps it if fewer than keep are kept already. The
+// text is cut just past what formatGrep shows.
+func (f *grepFile) add(m grepMatch, keep int) {
+	f.total++
+	if len(f.matches) >= keep {
+		return
+	}
+	if len(m.text) > maxGrepLineBytes+utf8.UTFMax {
+		m.text = m.text[:maxGrepLineBytes+utf8.UTFMax]
+	}
+	f.matches = append(f.matches, m)
+}
+
+// grepResult is what a search found. partial is set when it stopped at
+// max_results, so not every file was searched.
+type grepResult struct {
+	files   []*grepFile
+	skipped []string
+	partial bool
+}
+
+// grepLocal searches base, a file or a directory tree of the workspace
+// file system. One goroutine walks the tree while a pool of workers scans
+// files, and the walk stops once maxResults matches are found. Dot-files,
+// hidden paths, and anything but regular files (after following symlinks)
+// are left out.
+func grepLocal(ctx context.Context, base string, pattern []byte, perFile, maxResults int) (grepResult, error) {
+	fsys := workspaceFSFrom(ctx)
+	info, err := fsys.Stat(ctx, base)
+	if err != nil {
+		return grepResult{}, err
+	}
+	ignore := ignoreRulesFrom(ctx)
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	type job struct {
+		path, name string
+		modTime    time.Time
+	}
+	var (
+		res   grepResult
+		mu    sync.Mutex
+		found int
+		wg    sync.WaitGroup
+		jobs  = make(chan job)
+	)
+	search := func(j job) {
+		f, err := searchFile(ctx, fsys, j.path, j.name, j.modTime, pattern, perFile)
+		if err != nil || f.total == 0 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if found >= maxResults {
+			return
+		}
+		res.files = append(res.files, f)
+		if found += f.total; found >= maxResults {
+			res.partial = true
+			stop()
+		}
+	}
+	workers := min(2*runtime.GOMAXPROCS(0), maxGrepWorkers)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				search(j)
+			}
+		}()
+	}
+	// queue filters a file and hands it to the workers. It reports false
+	// once the search has stopped.
+	queue := func(path, name string, fi fs.FileInfo) bool {
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if fi, err = fsys.Stat(ctx, path); err != nil {
+				return true
+			}
+		}
+		if ignore.hidden(path, false) || !fi.Mode().IsRegular() {
+			return true
+		}
+		name = filepath.ToSlash(name)
+		if fi.Size() > maxGrepFileBytes {
+			mu.Lock()
+			res.skipped = append(res.skipped, name)
+			mu.Unlock()
+			return true
+		}
+		select {
+		case jobs <- job{path, name, fi.ModTime()}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if info.IsDir() {
+		err = fsys.Walk(ctx, base, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return fs.SkipAll
+			}
+			if path != base && (strings.HasPrefix(d.Name(), ".") || ignore.hidden(path, d.IsDir())) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(base, path)
+			if !queue(path, rel, fi) {
+				return fs.SkipAll
+			}
+			return nil
+		})
+	} else {
+		queue(base, filepath.Base(base), info)
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return grepResult{}, err
+	}
+	// A cancelled run is an error; stopping at maxResults is not.
+	if !res.partial {
+		if err := ctx.Err(); err != nil {
+			return grepResult{}, err
+		}
+	}
+	return res, nil
+}
+
+// searchFile scans a file line by line, so memory stays bounded by the
+// buffer and the kept matches whatever the file's size. Binary files yield
+// no matches.
+func searchFile(ctx context.Context, fsys workspaceFS, path, name string, modTime time.Time, pattern []byte, keep int) (*grepFile, error) {
+	fh, err := fsys.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return searchReader(fh, name, modTime, pattern, keep)
+}
+
+func searchReader(rd io.Reader, name string, modTime time.Time, pattern []byte, keep int) (*grepFile, error) {
+	r := bufio.NewReaderSize(rd, grepBufferBytes)
+	if head, _ := r.Peek(binarySniffBytes); bytes.IndexByte(head, 0) >= 0 {
+		return &grepFile{path: name}, nil
+	}
+
+	f := &grepFile{path: name, modTime: modTime}
+	var long []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			long = append(long[:0], line...)
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			line = long
+		}
+		if len(line) > 0 || err == nil {
+			f.lines++
+			if bytes.Contains(line, pattern) {
+				f.add(grepMatch{line: f.lines, text: string(bytes.TrimSpace(line))}, keep)
+			}
+		}
+		if err == io.EOF {
+			return f, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type grepMatch struct {
+	line int
+	text string
+}
+
+// density is matches per line, so a short file that is all about the
+// pattern outranks a long one that mentions it in passing.
+func (f *grepFile) density() float64 {
+	if f.lines <= 0 {
+		return float64(f.total)
+	}
+	return float64(f.total) / float64(f.lines)
+}
+
+// formatGrep renders matches grouped by file, densest and most recently
+// modified files first, with at most perFile matches each and a header of
+// totals, so a broad pattern costs a bounded amount of context. Files too
+// large to search are listed at the end.
+func formatGrep(res grepResult, perFile int) string {
+	files := res.files
+	if len(files) == 0 {
+		return "(no matches)" + formatSkipped(res.skipped)
+	}
+	if perFile <= 0 {
+		perFile = defaultGrepPerFile
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if di, dj := files[i].density(), files[j].density(); di != dj {
+			return di > dj
+		}
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.After(files[j].modTime)
+		}
+		return files[i].path < files[j].path
+	})
+
+	total := 0
+	for _, f := range files {
+		total += f.total
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d %s in %d %s", total, plural(total, "match", "matches"), len(files), plural(len(files), "file", "files"))
+	if total > len(files) {
+		fmt.Fprintf(&sb, " (up to %d per file)", perFile)
+	}
+	if res.partial {
+		sb.WriteString("; the search stopped there, so other files may match too; narrow the pattern or path, or raise max_results")
+	}
+	sb.WriteString("\n")
+
+	for i, f := range files {
+		if i == maxGrepFiles {
+			rest := 0
+			for _, f := range files[i:] {
+				rest += f.total
+			}
+			fmt.Fprintf(&sb, "\n... %d more %s with %d %s; narrow the pattern or path\n",
+				len(files)-i, plural(len(files)-i, "file", "files"), rest, plural(rest, "match", "matches"))
+			break
+		}
+		fmt.Fprintf(&sb, "\n%s (%d)\n", f.path, f.total)
+		for j, m := range f.matches {
+			if j == perFile {
+				break
+			}
+			text := m.text
+			if len(text) > maxGrepLineBytes {
+				cut := maxGrepLineBytes
+				for cut > 0 && !utf8.RuneStart(text[cut]) {
+					cut--
+				}
+				text = text[:cut] + "..."
+			}
+			fmt.Fprintf(&sb, "  %d: %s\n", m.line, text)
+		}
+		if f.total > perFile {
+			fmt.Fprintf(&sb, "  ... %d more\n", f.total-perFile)
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n") + formatSkipped(res.skipped)
+}
+
+func formatSkipped(skipped []string) string {
+	if len(skipped) == 0 {
+		return ""
+	}
+	shown := skipped
+	if len(shown) > 10 {
+		shown = shown[:10]
+	}
+	s := fmt.Sprintf("\n\nskipped %d %s over %s: %s", len(skipped), plural(len(skipped), "file", "files"), formatSize(maxGrepFileBytes), strings.Join(shown, ", "))
+	if len(skipped) > len(shown) {
+		s += ", ..."
+	}
+	return s + fmt.Sprintf(" (use bash to search %s)", plural(len(skipped), "it", "them"))
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const defaultHistoryKeepRecent = 6
+
+// defaultHistoryStrategies drop what is cheapest to get back first: stale
+// file contents, then old tool output, and only then whole turns.
+var defaultHistoryStrategies = []string{"file-views", "tool-results", "sliding-window"}
+
+// historyConfig is the [history] section: once the conversation grows past
+// max_tokens, the strategies run in order until it fits again.
+type historyConfig struct {
+	Strategies []string `toml:"strategies"`
+	MaxTokens  int      `toml:"max_tokens"`
+	// KeepRecent messages at the end are never pruned.
+	KeepRecent int `toml:"keep_recent"`
+}
+
+// pruneStrategy shrinks h toward target estimated tokens, stopping as soon
+// as h fits.
+type pruneStrategy func(h *prunedHistory, target int)
+
+var pruneStrategies = map[string]pruneStrategy{
+	"file-views":     pruneFileViews,
+	"tool-results":   pruneToolResults,
+	"relevance":      pruneByRelevance,
+	"sliding-window": pruneSlidingWindow,
+}
+
+// historyPruner decides what of the conversation is sent each turn. It
+// works on a copy: the session keeps the full transcript, so a resumed or
+// replayed session loses nothing. A nil pruner sends everything.
+type historyPruner struct {
+	strategies []string
+	maxTokens  int
+	keepRecent int
+	task       string
+	counter    *tokenCounter
+	reported   int
+}
+
+func newHistoryPruner(cfg historyConfig, counter *tokenCounter, task string) (*historyPruner, error) {
+	strategies := cfg.Strategies
+	if len(strategies) == 0 {
+		strategies = defaultHistoryStrategies
+	}
+	for _, s := range strategies {
+		if pruneStrategies[s] == nil {
+			names := make([]string, 0, len(pruneStrategies))
+			for n := range pruneStrategies {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("history: unknown strategy %q (%s)", s, strings.Join(names, ", "))
+		}
+	}
+	if cfg.KeepRecent < 0 {
+		return nil, fmt.Errorf("history: invalid keep_recent %d", cfg.KeepRecent)
+	}
+	if cfg.MaxTokens <= 0 {
+		return nil, nil
+	}
+	return &historyPruner{
+		strategies: strategies,
+		maxTokens:  cfg.MaxTokens,
+		keepRecent: firstNonZero(cfg.KeepRecent, defaultHistoryKeepRecent),
+		task:       task,
+		counter:    counter,
+	}, nil
+}
+
+// prune returns the messages to send with req.
+func (p *historyPruner) prune(ctx context.Context, req completionRequest) []agentMessage {
+	if p == nil {
+		return req.messages
+	}
+	counted, ok := p.counter.fits(ctx, req, p.maxTokens)
+	if ok {
+		return req.messages
+	}
+	h := newPrunedHistory(req.messages, p.keepRecent, p.task)
+	// The strategies work on estimates; scaling the target by how far the
+	// estimate is from the count keeps them honest for this conversation.
+	estimate := estimateTokens(req)
+	target := h.total - (estimate - int(float64(p.maxTokens)*float64(estimate)/float64(max(counted, 1))))
+	for _, s := range p.strategies {
+		if h.total <= target {
+			break
+		}
+		pruneStrategies[s](h, target)
+	}
+	h.relink(req.messages)
+	if h.pruned > p.reported {
+		fmt.Fprintf(os.Stderr, "history over %d tokens; pruned %d item(s) (%s)\n", p.maxTokens, h.pruned, strings.Join(p.strategies, ", "))
+		p.reported = h.pruned
+	}
+	return h.messages
+}
+
+// prunedHistory is a copy of the conversation that strategies cut down.
+type prunedHistory struct {
+	messages []agentMessage
+	// calls[i][j] is the call that produced messages[i].toolResults[j].
+	calls  [][]toolCall
+	tokens []int
+	total  int
+	// keep is the index of the first message no strategy may touch; the
+	// first message, the task, is kept as well.
+	keep   int
+	focus  string
+	pruned int
+}
+
+func newPrunedHistory(messages []agentMessage, keepRecent int, task string) *prunedHistory {
+	h := &prunedHistory{
+		messages: slices.Clone(messages),
+		calls:    make([][]toolCall, len(messages)),
+		tokens:   make([]int, len(messages)),
+		keep:     max(len(messages)-keepRecent, 1),
+	}
+	var calls []toolCall
+	for i, m := range h.messages {
+		switch m.role {
+		case "assistant":
+			calls = m.toolCalls
+			if len(calls) == 0 {
+				calls = parseToolCalls(m.content)
+			}
+		case "tool":
+			h.messages[i].toolResults = slices.Clone(m.toolResults)
+			// Results come back in call order; a run stopped by a tool has
+			// fewer results than calls.
+			if len(calls) >= len(m.toolResults) {
+				h.calls[i] = calls[:len(m.toolResults)]
+			}
+			calls = nil
+		}
+		h.tokens[i] = messageTokens(h.messages[i])
+		h.total += h.tokens[i]
+	}
+	h.focus = planFocus(messages, task)
+	return h
+}
+
+func messageTokens(m agentMessage) int {
+	n := messageOverheadTokens + estimateTextTokens(m.content)
+	for _, r := range m.toolResults {
+		n += estimateTextTokens(r.content)
+	}
+	return n
+}
+
+// call returns the call behind a tool result, if it is known.
+func (h *prunedHistory) call(i, j int) (toolCall, bool) {
+	if j < len(h.calls[i]) {
+		return h.calls[i][j], true
+	}
+	return toolCall{}, false
+}
+
+// stub replaces a tool result's content with a short note.
+func (h *prunedHistory) stub(i, j int, note string) {
+	h.set(i, j, note)
+	h.pruned++
+}
+
+func (h *prunedHistory) set(i, j int, content string) {
+	h.messages[i].toolResults[j].content = content
+	h.total -= h.tokens[i]
+	h.tokens[i] = messageTokens(h.messages[i])
+	h.total += h.tokens[i]
+}
+
+// stubbed reports whether a result is already a short note: one of ours,
+// or one of viewDedup's.
+func (h *prunedHistory) stubbed(i, j int) bool {
+	content := h.messages[i].toolResults[j].content
+	return strings.HasPrefix(content, "[omitted") || strings.HasPrefix(content, unchangedPrefix)
+}
+
+// relink keeps the notes viewDedup left for repeated views meaningful: when
+// the view a note refers to was pruned, the first note gets its content
+// back and later notes refer to that one instead. Notes about a file that
+// changed since are summarized like a superseded view.
+func (h *prunedHistory) relink(original []agentMessage) {
+	last := h.lastTouched()
+	contents := map[string]string{}
+	for _, m := range original {
+		for _, r := range m.toolResults {
+			contents[r.id] = r.content
+		}
+	}
+	present := map[string]bool{}
+	for i, m := range h.messages {
+		for j, r := range m.toolResults {
+			if !h.stubbed(i, j) {
+				present[r.id] = true
+			}
+		}
+	}
+	moved := map[string]string{}
+	for i, m := range h.messages {
+		for j, r := range m.toolResults {
+			id, ok := unchangedSince(r.content)
+			if !ok || present[id] {
+				continue
+			}
+			if c, ok := h.call(i, j); ok {
+				if p, _ := argString(c.arguments, "path"); last[p] > i {
+					h.set(i, j, fmt.Sprintf("[omitted: view of %s; the file was viewed or changed again later]", p))
+					continue
+				}
+			}
+			if to, ok := moved[id]; ok {
+				h.set(i, j, strings.Replace(r.content, id, to, 1))
+				continue
+			}
+			if content, ok := contents[id]; ok {
+				h.set(i, j, content)
+				moved[id] = r.id
+			}
+		}
+	}
+}
+
+// pruneFileViews keeps only a summary of file views a later view, edit, or
+// write of the same file superseded, oldest first.
+func pruneFileViews(h *prunedHistory, target int) {
+	last := h.lastTouched()
+	for i := 1; i < h.keep && h.total > target; i++ {
+		for j, r := range h.messages[i].toolResults {
+			c, ok := h.call(i, j)
+			if !ok || c.name != "view" || r.isError || h.stubbed(i, j) {
+				continue
+			}
+			if p, _ := argString(c.arguments, "path"); last[p] > i {
+				lines := strings.Count(r.content, "\n") + 1
+				h.stub(i, j, fmt.Sprintf("[omitted: view of %s, %d lines; the file was viewed or changed again later]", p, lines))
+			}
+		}
+	}
+}
+
+// lastTouched maps each path to the last message that viewed, edited, or
+// wrote it.
+func (h *prunedHistory) lastTouched() map[string]int {
+	last := map[string]int{}
+	for i := range h.messages {
+		for j := range h.messages[i].toolResults {
+			if _, ok := unchangedSince(h.messages[i].toolResults[j].content); ok {
+				// A repeated view left the earlier one current.
+				continue
+			}
+			if c, ok := h.call(i, j); ok && (c.name == "view" || c.name == "edit" || c.name == "write") {
+				if p, _ := argString(c.arguments, "path"); p != "" {
+					last[p] = i
+				}
+			}
+		}
+	}
+	return last
+}
+
+// pruneToolResults drops the output of old tool calls, oldest first. The
+// calls themselves stay, so the model knows what it ran and can rerun it.
+func pruneToolResults(h *prunedHistory, target int) {
+	for i := 1; i < h.keep && h.total > target; i++ {
+		for j := range h.messages[i].toolResults {
+			if h.total <= target {
+				return
+			}
+			if !h.stubbed(i, j) {
+				h.stub(i, j, h.omittedNote(i, j))
+			}
+		}
+	}
+}
+
+func (h *prunedHistory) omittedNote(i, j int) string {
+	name := h.messages[i].toolResults[j].name
+	if c, ok := h.call(i, j); ok {
+		name = describeCalls([]toolCall{c})
+	}
+	return fmt.Sprintf("[omitted to save context: output of %s; run it again if it is still needed]", truncateOutput(name, 200))
+}
+
+// pruneByRelevance drops the tool results that share the fewest terms with
+// the current plan step (the task and the latest assistant turns), so an
+// early result the work still builds on outlives later detours.
+func pruneByRelevance(h *prunedHistory, target int) {
+	type candidate struct {
+		i, j  int
+		score float64
+	}
+	focus := termSet(h.focus)
+	var candidates []candidate
+	for i := 1; i < h.keep; i++ {
+		for j, r := range h.messages[i].toolResults {
+			if h.stubbed(i, j) {
+				continue
+			}
+			terms := termSet(r.content)
+			args := map[string]bool{}
+			if c, ok := h.call(i, j); ok {
+				args = termSet(describeCalls([]toolCall{c}))
+			}
+			score := 2*overlap(args, focus) + overlap(terms, focus)/math.Sqrt(float64(len(terms)+1))
+			// Among equally unrelated results the older one goes first.
+			score += float64(i) / float64(len(h.messages)) * 0.01
+			candidates = append(candidates, candidate{i, j, score})
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool { return candidates[a].score < candidates[b].score })
+	for _, c := range candidates {
+		if h.total <= target {
+			return
+		}
+		h.stub(c.i, c.j, h.omittedNote(c.i, c.j))
+	}
+}
+
+// pruneSlidingWindow drops whole turns after the task, oldest first. A cut
+// always lands on an assistant message, so tool calls keep their results.
+func pruneSlidingWindow(h *prunedHistory, target int) {
+	cut := 1
+	dropped := 0
+	for cut < h.keep && h.total-dropped > target {
+		dropped += h.tokens[cut]
+		cut++
+		for cut < h.keep && h.messages[cut].role != "assistant" {
+			dropped += h.tokens[cut]
+			cut++
+		}
+	}
+	for cut > 1 && h.messages[cut].role != "assistant" {
+		cut--
+	}
+	if cut <= 1 {
+		return
+	}
+	first := h.messages[0]
+	first.content += fmt.Sprintf("\n\n[%d earlier messages were omitted to save context]", cut-1)
+	h.messages = append([]agentMessage{first}, h.messages[cut:]...)
+	h.calls = append(h.calls[:1], h.calls[cut:]...)
+	h.tokens = append([]int{messageTokens(first)}, h.tokens[cut:]...)
+	h.keep -= cut - 1
+	h.pruned += cut - 1
+	h.total = 0
+	for _, n := range h.tokens {
+		h.total += n
+	}
+}
+
+// planFocus is the text the current step is about: the task and the last
+// two assistant turns, with the calls they made.
+func planFocus(messages []agentMessage, task string) string {
+	parts := []string{task}
+	for i, turns := len(messages)-1, 0; i >= 0 && turns < 2; i-- {
+		if m := messages[i]; m.role == "assistant" {
+			parts = append(parts, m.content, describeCalls(m.toolCalls))
+			turns++
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// termSet collects the identifier-like words of s, lowercased.
+func termSet(s string) map[string]bool {
+	terms := map[string]bool{}
+	for _, w := range strings.FieldsFunc(s, func(r rune) bool { return r >= 0x80 || !isWordByte(byte(r)) }) {
+		if len(w) >= 3 {
+			terms[strings.ToLower(w)] = true
+		}
+	}
+	return terms
+}
+
+func overlap(a, b map[string]bool) float64 {
+	n := 0
+	for t := range a {
+		if b[t] {
+			n++
+		}
+	}
+	return float64(n)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+const ignoreFileName = ".puzldaiignore"
+
+// ignoreMode is what a .puzldaiignore rule does to the paths it matches.
+type ignoreMode int
+
+const (
+	visible ignoreMode = iota
+	// readOnly paths can be read and searched but not written.
+	readOnly
+	// hidden paths are left out of glob, grep, and the repository map, and
+	// cannot be viewed or written.
+	hidden
+	// banned paths are hidden by the organization policy.
+	banned
+)
+
+// ignoreRule is one line of a .puzldaiignore file. Unlike .gitignore there
+// is no negation: rules only ever restrict, and the most restrictive
+// matching rule applies.
+type ignoreRule struct {
+	pattern string
+	dirOnly bool
+	mode    ignoreMode
+}
+
+// ignoreRules holds the rules of each workspace root.
+type ignoreRules struct {
+	roots []ignoreRoot
+	// scope, when set, hides what is outside a -scope slice.
+	scope *buildScope
+}
+
+type ignoreRoot struct {
+	dir   string
+	rules []ignoreRule
+}
+
+// loadIgnoreRules reads .puzldaiignore from each root. It returns nil when
+// no root has one.
+//
+// Each line is a doublestar pattern relative to the root, optionally
+// prefixed with "readonly:" (the default mode is "hidden:"). A pattern
+// without a slash matches at any depth, a trailing slash matches a
+// directory and everything below it, and # starts a comment.
+func loadIgnoreRules(roots []string) (*ignoreRules, error) {
+	var rules ignoreRules
+	for _, dir := range roots {
+		path := filepath.Join(dir, ignoreFileName)
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		root := ignoreRoot{dir: dir}
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			rule := ignoreRule{mode: hidden}
+			if mode, rest, ok := strings.Cut(line, ":"); ok {
+				switch strings.TrimSpace(mode) {
+				case "readonly":
+					rule.mode, line = readOnly, strings.TrimSpace(rest)
+				case "hidden":
+					line = strings.TrimSpace(rest)
+				}
+			}
+			rule.dirOnly = strings.HasSuffix(line, "/")
+			line = strings.Trim(line, "/")
+			if !strings.Contains(line, "/") {
+				line = "**/" + line
+			}
+			if !doublestar.ValidatePattern(line) {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: invalid pattern %q", path, n, line)
+			}
+			rule.pattern = line
+			root.rules = append(root.rules, rule)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		if len(root.rules) > 0 {
+			rules.roots = append(rules.roots, root)
+		}
+	}
+	if len(rules.roots) == 0 {
+		return nil, nil
+	}
+	return &rules, nil
+}
+
+// mode reports how the rules treat the absolute path: the most restrictive
+// rule of any root holding it applies. Paths outside every root with rules
+// are visible. The ignore file itself is at least read-only, so the agent
+// cannot lift its own restrictions.
+func (r *ignoreRules) mode(path string, isDir bool) ignoreMode {
+	if r == nil {
+		return visible
+	}
+	mode := visible
+	for _, root := range r.roots {
+		rel, err := filepath.Rel(root.dir, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ignoreFileName && mode < readOnly {
+			mode = readOnly
+		}
+		for _, rule := range root.rules {
+			if rule.mode > mode && rule.matches(rel, isDir) {
+				mode = rule.mode
+			}
+		}
+	}
+	if mode < hidden && r.scope != nil && !r.scope.contains(path, isDir) {
+		mode = hidden
+	}
+	return mode
+}
+
+// matches reports whether the rule covers rel or one of its parent
+// directories.
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	for prefix := rel; prefix != "."; prefix = filepath.ToSlash(filepath.Dir(prefix)) {
+		if ok, _ := doublestar.Match(r.pattern, prefix); ok && (!r.dirOnly || prefix != rel || isDir) {
+			return true
+		}
+		if !strings.Contains(prefix, "/") {
+			break
+		}
+	}
+	return false
+}
+
+func (r *ignoreRules) hidden(path string, isDir bool) bool {
+	return r.mode(path, isDir) >= hidden
+}
+
+type ignoreRulesKey struct{}
+
+// withIgnoreRules lets glob and grep filter what they list.
+func withIgnoreRules(ctx context.Context, r *ignoreRules) context.Context {
+	return context.WithValue(ctx, ignoreRulesKey{}, r)
+}
+
+func ignoreRulesFrom(ctx context.Context) *ignoreRules {
+	r, _ := ctx.Value(ignoreRulesKey{}).(*ignoreRules)
+	return r
+}
+
+// apply enforces the rules on the local file tools: view refuses hidden
+// paths, write and edit refuse hidden and read-only ones, and glob and grep
+// skip hidden entries. bash is not restricted.
+func (r *ignoreRules) apply(tools []toolDef) []toolDef {
+	for i := range tools {
+		spec, ok := pathArgs[tools[i].name]
+		if !ok {
+			continue
+		}
+		next, name := tools[i].fn, tools[i].name
+		tools[i].fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			if path, ok := argString(args, spec.arg); ok && path != "" && name != "glob" && name != "grep" {
+				full := resolvePath(cwd, path)
+				info, err := workspaceFSFrom(ctx).Stat(ctx, full)
+				isDir := err == nil && info.IsDir()
+				switch mode := r.mode(full, isDir); {
+				case mode == banned:
+					return "", policyErrorf("%s: %s is banned by the organization policy", name, path)
+				case mode == hidden && r.scope != nil && !r.scope.contains(full, isDir):
+					return "", policyErrorf("%s: %s is outside -scope %s", name, path, strings.Join(r.scope.patterns, ","))
+				case mode == hidden:
+					return "", policyErrorf("%s: %s is hidden by %s", name, path, ignoreFileName)
+				case mode == readOnly && spec.write:
+					return "", policyErrorf("%s: %s is read-only (%s)", name, path, ignoreFileName)
+				}
+			}
+			return next(withIgnoreRules(ctx, r), cwd, args)
+		}
+	}
+	return tools
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const initUsage = "usage: puzldai-agent init [-cwd dir] [-yes] [-force]"
+
+// instructionsFileName is the file of project instructions every run adds
+// to the system prompt.
+const instructionsFileName = "PUZLD.md"
+
+// maxInstructionsBytes caps how much of PUZLD.md goes into the prompt.
+const maxInstructionsBytes = 32 << 10
+
+// runInit implements the init subcommand: it inspects the workspace and
+// writes a starter .puzldai.toml, .puzldaiignore, and PUZLD.md, asking on
+// the terminal about the provider, the verify command, and the rest, and
+// before writing each file. Existing files are kept unless -force is given.
+func runInit(args []string) int {
+	fs := newFlagSet("init")
+	cwdFlag := fs.String("cwd", "", "Workspace to set up (default: the current directory)")
+	yesFlag := fs.Bool("yes", false, "Take the suggested answers without asking, and write the files")
+	forceFlag := fs.Bool("force", false, "Overwrite files that already exist")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, initUsage)
+		return exitUsage
+	}
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "init:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+
+	var p *initPrompt
+	if !*yesFlag {
+		in, out, err := openTTY()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "init: no terminal to ask on (%v); run with -yes to write the suggested files\n", err)
+			return exitUsage
+		}
+		defer in.Close()
+		p = &initPrompt{in: bufio.NewReader(in), out: out}
+	}
+
+	s := suggestInit(cwd)
+	for _, r := range s.runtimes {
+		fmt.Fprintf(os.Stderr, "found %s project in %s\n", r.language, filepath.ToSlash(filepath.Join(r.dir, r.manifest)))
+	}
+	if len(s.runtimes) == 0 {
+		fmt.Fprintln(os.Stderr, "found no Go, Node.js, or Python project; the verify command is left empty")
+	}
+	s.provider = p.choose("Provider", s.provider, strings.Split(providerNames(), ", "))
+	s.model = p.ask("Model", providerPresets[s.provider].defaultModel)
+	s.verify = p.ask("Verify command, which checks a change (- for none)", s.verify)
+	s.approval = p.choose("Approval mode for gated actions", s.approval, []string{approvalPrompt, approvalAuto, approvalDeny})
+	s.protected = splitList(p.ask("Protected paths, comma-separated (- for none)", strings.Join(s.protected, ", ")))
+	if s.dotenv {
+		s.dotenv = p.confirm("Load .env.local and .env into the environment of runs?")
+	}
+
+	files := []struct{ name, content string }{
+		{defaultConfigName, s.config()},
+		{ignoreFileName, s.ignoreFile()},
+		{instructionsFileName, s.instructions()},
+	}
+	status := exitOK
+	for _, f := range files {
+		path := filepath.Join(cwd, f.name)
+		if fileExists(path) && !*forceFlag {
+			fmt.Fprintf(os.Stderr, "kept the existing %s; -force overwrites it\n", f.name)
+			continue
+		}
+		if p != nil {
+			fmt.Fprintf(p.out, "\n--- %s\n%s", f.name, f.content)
+			if !p.confirm("Write " + f.name + "?") {
+				continue
+			}
+		}
+		if err := os.WriteFile(path, []byte(f.content), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "init:", err)
+			status = exitError
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "wrote %s\n", path)
+	}
+	return status
+}
+
+// initPrompt asks the questions of init on the terminal. A nil prompt
+// takes the suggested answers.
+type initPrompt struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask returns the answer to question, or def on an empty answer. "-" is an
+// empty answer that does not take the default.
+func (p *initPrompt) ask(question, def string) string {
+	if p == nil {
+		return def
+	}
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	answer, err := p.in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	switch {
+	case answer == "-":
+		return ""
+	case answer == "" || err != nil && !errors.Is(err, io.EOF):
+		return def
+	}
+	return answer
+}
+
+// choose asks until the answer is one of choices.
+func (p *initPrompt) choose(question, def string, choices []string) string {
+	for {
+		answer := p.ask(question+" ("+strings.Join(choices, ", ")+")", def)
+		if p == nil || slices.Contains(choices, answer) {
+			return answer
+		}
+		fmt.Fprintf(p.out, "%q is not one of %s\n", answer, strings.Join(choices, ", "))
+	}
+}
+
+// confirm asks a yes/no question whose default is yes.
+func (p *initPrompt) confirm(question string) bool {
+	switch strings.ToLower(p.ask(question+" [Y/n]", "")) {
+	case "", "y", "yes":
+		return true
+	}
+	return false
+}
+
+// initSuggestion is what init found in the workspace and suggests for it.
+type initSuggestion struct {
+	runtimes  []*projectRuntime
+	provider  string
+	model     string
+	verify    string
+	approval  string
+	protected []string
+	// dotenv is set when the workspace has .env files.
+	dotenv bool
+	// hidden and readOnly are the .puzldaiignore rules.
+	hidden   []string
+	readOnly []string
+}
+
+// protectedCandidates are the paths init suggests protecting when the
+// workspace has them: CI definitions, migrations that have shipped, and
+// lock files, which only package managers should write.
+var protectedCandidates = []string{
+	".github/workflows/", ".gitlab-ci.yml", "migrations/", "db/migrations/",
+	"go.sum", "package-lock.json", "yarn.lock", "pnpm-lock.yaml", "bun.lockb", "poetry.lock", "uv.lock", "Cargo.lock",
+}
+
+// hiddenCandidates are files with secrets, which init suggests hiding.
+// .env files are always hidden.
+var hiddenCandidates = []string{"*.pem", "*.key", "secrets/"}
+
+// readOnlyCandidates are vendored and generated trees, which the agent may
+// read but should not edit.
+var readOnlyCandidates = []string{"vendor/", "third_party/", "dist/", "build/"}
+
+func suggestInit(cwd string) *initSuggestion {
+	s := &initSuggestion{runtimes: detectRuntimes(cwd), provider: "anthropic", approval: approvalPrompt}
+	// Suggest the provider whose key is already set, preferring the
+	// default one.
+	if os.Getenv(providerPresets[s.provider].apiKeyEnv) == "" {
+		for _, name := range strings.Split(providerNames(), ", ") {
+			if env := providerPresets[name].apiKeyEnv; env != "" && os.Getenv(env) != "" {
+				s.provider = name
+				break
+			}
+		}
+	}
+	s.model = providerPresets[s.provider].defaultModel
+
+	dirs := []string{"."}
+	var steps []string
+	for _, r := range s.runtimes {
+		if !slices.Contains(dirs, r.dir) {
+			dirs = append(dirs, r.dir)
+		}
+		var commands []string
+		for _, kind := range []string{"build", "typecheck", "test"} {
+			for _, c := range r.commands {
+				if c.kind == kind {
+					commands = append(commands, c.command)
+					break
+				}
+			}
+		}
+		if len(commands) == 0 {
+			continue
+		}
+		step := strings.Join(commands, " && ")
+		if r.dir != "." {
+			step = "(cd " + filepath.ToSlash(r.dir) + " && " + step + ")"
+		}
+		steps = append(steps, step)
+	}
+	s.verify = strings.Join(steps, " && ")
+
+	s.protected = existing(cwd, dirs, protectedCandidates)
+	s.dotenv = len(existing(cwd, []string{"."}, dotenvFiles)) > 0
+	s.hidden = existing(cwd, dirs, hiddenCandidates)
+	s.readOnly = existing(cwd, dirs, readOnlyCandidates)
+	return s
+}
+
+// existing returns the patterns that match something in cwd or in one of
+// the project directories below it.
+func existing(cwd string, dirs, patterns []string) []string {
+	var found []string
+	for _, pattern := range patterns {
+		for _, dir := range dirs {
+			matches, _ := filepath.Glob(filepath.Join(cwd, dir, filepath.FromSlash(strings.TrimSuffix(pattern, "/"))))
+			if len(matches) > 0 {
+				found = append(found, pattern)
+				break
+			}
+		}
+	}
+	return found
+}
+
+var tomlEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+
+func tomlQuote(s string) string {
+	return `"` + tomlEscaper.Replace(s) + `"`
+}
+
+func (s *initSuggestion) config() string {
+	var b strings.Builder
+	b.WriteString("# puzldai-agent settings for this workspace; written by puzldai-agent init.\n")
+	b.WriteString("# Flags override these. See the README for the other settings.\n\n")
+	fmt.Fprintf(&b, "provider = %s\n", tomlQuote(s.provider))
+	if s.model != "" {
+		fmt.Fprintf(&b, "model = %s\n", tomlQuote(s.model))
+	}
+	if env := providerPresets[s.provider].apiKeyEnv; env != "" {
+		fmt.Fprintf(&b, "# The API key is read from %s, or from the OS keychain after\n# puzldai-agent auth login -provider %s.\n", env, s.provider)
+	}
+	fmt.Fprintf(&b, "\n# Approval mode for gated actions: prompt, auto, or deny.\napproval = %s\n", tomlQuote(s.approval))
+	b.WriteString("\n# Load .env.local and .env into the environment, for provider keys and\n# tools; variables already set keep their values.\n")
+	if s.dotenv {
+		b.WriteString("dotenv = true\n")
+	} else {
+		b.WriteString("# dotenv = true\n")
+	}
+	b.WriteString("\n# Checks a change; exit status 0 means it passed. Used by -attempts, the\n# pipeline, refactor, upgrade, triage, fix-crash, and perf.\n")
+	if s.verify != "" {
+		fmt.Fprintf(&b, "verify = %s\n", tomlQuote(s.verify))
+	} else {
+		b.WriteString("# verify = \"make test\"\n")
+	}
+	b.WriteString("\n# Writing these paths needs an explicit approval, even with approval = \"auto\".\n")
+	b.WriteString("# Files the agent must not see or edit at all go in .puzldaiignore.\n")
+	if len(s.protected) > 0 {
+		b.WriteString("protected_paths = [\n")
+		for _, path := range s.protected {
+			fmt.Fprintf(&b, "  %s,\n", tomlQuote(path))
+		}
+		b.WriteString("]\n")
+	} else {
+		b.WriteString("# protected_paths = [\"migrations/\"]\n")
+	}
+	return b.String()
+}
+
+func (s *initSuggestion) ignoreFile() string {
+	var b strings.Builder
+	b.WriteString("# Paths the agent cannot see, one doublestar pattern per line; written by\n")
+	b.WriteString("# puzldai-agent init. A pattern without a slash matches at any depth, and a\n")
+	b.WriteString("# trailing slash matches a directory. \"readonly:\" lets the agent read but not\n# write.\n")
+	for _, pattern := range append([]string{".env", ".env.*"}, s.hidden...) {
+		b.WriteString(pattern + "\n")
+	}
+	for _, pattern := range s.readOnly {
+		b.WriteString("readonly: " + pattern + "\n")
+	}
+	return b.String()
+}
+
+func (s *initSuggestion) instructions() string {
+	var b strings.Builder
+	b.WriteString("# Project instructions\n\n")
+	b.WriteString("<!-- puzldai-agent adds this file to the instructions of every run in this\n")
+	b.WriteString("workspace. Comments like this one are left out. Keep it short and specific:\n")
+	b.WriteString("what a new contributor would need to be told. -->\n\n")
+	b.WriteString("## Overview\n\n<!-- What the project is, and how the code is laid out. -->\n\n")
+	b.WriteString("## Commands\n\n")
+	if len(s.runtimes) == 0 {
+		b.WriteString("<!-- How to build, test, and lint. -->\n")
+	}
+	for _, r := range s.runtimes {
+		where := ""
+		if r.dir != "." {
+			where = " in " + filepath.ToSlash(r.dir)
+		}
+		for _, c := range r.commands {
+			fmt.Fprintf(&b, "- %s%s: `%s`\n", c.kind, where, c.command)
+		}
+	}
+	b.WriteString("\n## Conventions\n\n<!-- Style, naming, error handling, and how tests are written. -->\n\n")
+	b.WriteString("## Off limits\n\n")
+	if len(s.protected) == 0 {
+		b.WriteString("<!-- What to leave alone, or change only when the task asks for it. -->\n")
+	}
+	for _, path := range s.protected {
+		fmt.Fprintf(&b, "- `%s`: change only when the task asks for it.\n", path)
+	}
+	return b.String()
+}
+
+var htmlCommentRe = regexp.MustCompile(`(?s)<!--.*?-->`)
+
+// projectInstructions is the system prompt section of the workspace's
+// PUZLD.md, without its HTML comments, or "" when there is none.
+func projectInstructions(cwd string) string {
+	data, err := os.ReadFile(filepath.Join(cwd, instructionsFileName))
+	if err != nil {
+		return ""
+	}
+	text := strings.TrimSpace(htmlCommentRe.ReplaceAllString(string(data), ""))
+	if text == "" {
+		return ""
+	}
+	if len(text) > maxInstructionsBytes {
+		text = text[:maxInstructionsBytes] + "\n\n[truncated]"
+	}
+	return "\n\n# Project Instructions\n\nFrom " + instructionsFileName + " in the workspace, written by its maintainers; follow them unless the task says otherwise.\n\n" + text
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const kubeMaxTableRows = 50
+const kubeDefaultLogLines = 200
+const kubeMaxEvents = 20
+
+type kubeConfig struct {
+	Kubeconfig  string `toml:"kubeconfig"`
+	Context     string `toml:"context"`
+	Namespace   string `toml:"namespace"`
+	AllowWrites bool   `toml:"allow_writes"`
+}
+
+func kubeTools(cfg *agentConfig) []toolDef {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return nil
+	}
+	kc := cfg.Kubernetes
+	tools := []toolDef{
+		{
+			name:        "kubectl_get",
+			description: "List Kubernetes resources (summarized table)",
+			params: []toolParam{
+				required("resource", "string", "e.g. pods, deployments, svc"),
+				optional("name", "string", ""),
+				optional("namespace", "string", ""),
+				optional("selector", "string", "label selector"),
+				optional("all_namespaces", "boolean", ""),
+				optional("output", "string", "").oneOf("wide", "yaml", "json", "name"),
+			},
+			fn: kc.get,
+		},
+		{
+			name:        "kubectl_logs",
+			description: "Fetch container logs (tail, repeated lines collapsed)",
+			params: []toolParam{
+				required("pod", "string", "pod name or type/name"),
+				optional("namespace", "string", ""),
+				optional("container", "string", ""),
+				optional("tail", "integer", "").withDefault(200),
+				optional("since", "string", "duration, e.g. 10m"),
+				optional("previous", "boolean", ""),
+			},
+			fn: kc.logs,
+		},
+		{
+			name:        "kubectl_describe",
+			description: "Describe a Kubernetes resource (events trimmed to the most recent)",
+			params: []toolParam{
+				required("resource", "string", ""),
+				optional("name", "string", ""),
+				optional("namespace", "string", ""),
+				optional("selector", "string", ""),
+			},
+			fn: kc.describe,
+		},
+	}
+	if kc.AllowWrites {
+		tools = append(tools, toolDef{
+			name:        "kubectl_apply",
+			description: "Apply a manifest file to the cluster (cluster writes enabled)",
+			params: []toolParam{
+				required("path", "string", "manifest file or directory"),
+				optional("namespace", "string", ""),
+				optional("dry_run", "boolean", "server-side dry run"),
+			},
+			fn: kc.apply,
+		})
+	}
+	return tools
+}
+
+// kubectlWriteRe matches kubectl commands that change the cluster: the
+// subcommand, after any global flags, is a mutating one.
+var kubectlWriteRe = regexp.MustCompile(`\bkubectl(?:\s+--?[\w-]+(?:=\S*|\s+[^-\s]\S*)?)*\s+(?:apply|create|delete|edit|patch|replace|scale|autoscale|set|label|annotate|cordon|uncordon|drain|taint|expose|run|rollout\s+(?:restart|undo|pause|resume))\b`)
+
+// guardKubectlBash asks for explicit approval of shell commands that
+// plainly run a mutating kubectl command while cluster writes are off. It is
+// a best-effort check on the command's text, not an enforcement: read-only
+// mode is guaranteed for the kubectl tools only.
+func guardKubectlBash(sess *session, next toolFunc) toolFunc {
+	return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+		command, _ := argString(args, "command")
+		if kubectlWriteRe.MatchString(command) {
+			approved, reason := sess.approver.approve("bash (cluster writes are off): "+command, true)
+			if !approved {
+				return "", policyErrorf("bash: %s", reason)
+			}
+		}
+		return next(ctx, cwd, args)
+	}
+}
+
+func (kc kubeConfig) baseArgs(args map[string]any) ([]string, error) {
+	var out []string
+	if kc.Kubeconfig != "" {
+		out = append(out, "--kubeconfig", kc.Kubeconfig)
+	}
+	if kc.Context != "" {
+		out = append(out, "--context", kc.Context)
+	}
+	if ns, _ := argString(args, "namespace"); ns != "" {
+		if err := kubeSafeArg("namespace", ns); err != nil {
+			return nil, err
+		}
+		out = append(out, "--namespace", ns)
+	} else if kc.Namespace != "" {
+		out = append(out, "--namespace", kc.Namespace)
+	}
+	return out, nil
+}
+
+func kubeSafeArg(key, value string) error {
+	if strings.HasPrefix(value, "-") || strings.ContainsAny(value, " \t\n") {
+		return fmt.Errorf("kubectl: invalid %s %q", key, value)
+	}
+	return nil
+}
+
+// kubeTarget appends the resource, optional name and selector arguments.
+func kubeTarget(cmdArgs []string, args map[string]any) ([]string, error) {
+	resource, _ := argString(args, "resource")
+	if resource == "" {
+		return nil, errors.New("kubectl: missing resource")
+	}
+	if err := kubeSafeArg("resource", resource); err != nil {
+		return nil, err
+	}
+	cmdArgs = append(cmdArgs, resource)
+	if name, _ := argString(args, "name"); name != "" {
+		if err := kubeSafeArg("name", name); err != nil {
+			return nil, err
+		}
+		cmdArgs = append(cmdArgs, name)
+	}
+	if selector, _ := argString(args, "selector"); selector != "" {
+		if strings.HasPrefix(selector, "-") {
+			return nil, fmt.Errorf("kubectl: invalid selector %q", selector)
+		}
+		cmdArgs = append(cmdArgs, "--selector", selector)
+	}
+	return cmdArgs, nil
+}
+
+func (kc kubeConfig) get(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	cmdArgs, err := kc.baseArgs(args)
+	if err != nil {
+		return "", err
+	}
+	cmdArgs, err = kubeTarget(append(cmdArgs, "get"), args)
+	if err != nil {
+		return "", err
+	}
+	if argBool(args, "all_namespaces") {
+		cmdArgs = append(cmdArgs, "--all-namespaces")
+	}
+	output, _ := argString(args, "output")
+	switch output {
+	case "", "wide", "yaml", "json", "name":
+		if output != "" {
+			cmdArgs = append(cmdArgs, "--output", output)
+		}
+	default:
+		return "", fmt.Errorf("kubectl_get: unsupported output %q", output)
+	}
+
+	out, err := runKubectl(ctx, diskFS{}, cwd, cmdArgs)
+	if err != nil {
+		return "", err
+	}
+	if output == "" || output == "wide" {
+		return summarizeKubeTable(out), nil
+	}
+	return truncateOutput(out, maxFileBytes), nil
+}
+
+func (kc kubeConfig) logs(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	pod, _ := argString(args, "pod")
+	if pod == "" {
+		return "", errors.New("kubectl_logs: missing pod")
+	}
+	if err := kubeSafeArg("pod", pod); err != nil {
+		return "", err
+	}
+	cmdArgs, err := kc.baseArgs(args)
+	if err != nil {
+		return "", err
+	}
+	cmdArgs = append(cmdArgs, "logs", pod)
+	if container, _ := argString(args, "container"); container != "" {
+		if err := kubeSafeArg("container", container); err != nil {
+			return "", err
+		}
+		cmdArgs = append(cmdArgs, "--container", container)
+	}
+	tail := kubeDefaultLogLines
+	if n, ok := argInt(args, "tail"); ok && n > 0 {
+		tail = n
+	}
+	cmdArgs = append(cmdArgs, "--tail", strconv.Itoa(tail))
+	if since, _ := argString(args, "since"); since != "" {
+		if _, err := time.ParseDuration(since); err != nil {
+			return "", fmt.Errorf("kubectl_logs: invalid since %q", since)
+		}
+		cmdArgs = append(cmdArgs, "--since", since)
+	}
+	if argBool(args, "previous") {
+		cmdArgs = append(cmdArgs, "--previous")
+	}
+
+	out, err := runKubectl(ctx, diskFS{}, cwd, cmdArgs)
+	if err != nil {
+		return "", err
+	}
+	return truncateOutput(collapseRepeatedLines(out), maxFileBytes), nil
+}
+
+func (kc kubeConfig) describe(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	cmdArgs, err := kc.baseArgs(args)
+	if err != nil {
+		return "", err
+	}
+	cmdArgs, err = kubeTarget(append(cmdArgs, "describe"), args)
+	if err != nil {
+		return "", err
+	}
+	out, err := runKubectl(ctx, diskFS{}, cwd, cmdArgs)
+	if err != nil {
+		return "", err
+	}
+	return truncateOutput(trimKubeEvents(out), maxFileBytes), nil
+}
+
+func (kc kubeConfig) apply(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	path, ok := argString(args, "path")
+	if !ok || path == "" {
+		return "", errors.New("kubectl_apply: missing path")
+	}
+	cmdArgs, err := kc.baseArgs(args)
+	if err != nil {
+		return "", err
+	}
+	cmdArgs = append(cmdArgs, "apply", "--filename", commandPath(cwd, resolvePath(cwd, path)))
+	if argBool(args, "dry_run") {
+		cmdArgs = append(cmdArgs, "--dry-run=server")
+	}
+	// The manifest is read through the tool call's file system, so an
+	// -emit patch run applies the files as it changed them.
+	return runKubectl(ctx, workspaceFSFrom(ctx), cwd, cmdArgs)
+}
+
+func runKubectl(ctx context.Context, fsys workspaceFS, cwd string, args []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	cmd, err := fsys.Command(ctx, cwd, "kubectl", args...)
+	if err != nil {
+		return "", fmt.Errorf("kubectl: %w", err)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("kubectl: %s", msg)
+	}
+	return string(output), nil
+}
+
+// summarizeKubeTable keeps the header and the first rows of a kubectl table
+// and appends a count of rows per STATUS value when rows were dropped.
+func summarizeKubeTable(out string) string {
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) <= kubeMaxTableRows+1 {
+		return out
+	}
+	header := lines[0]
+	rows := lines[1:]
+	statusCol := -1
+	for i, field := range strings.Fields(header) {
+		if field == "STATUS" {
+			statusCol = i
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(strings.Join(lines[:kubeMaxTableRows+1], "\n"))
+	fmt.Fprintf(&sb, "\n... %d more rows (%d total)\n", len(rows)-kubeMaxTableRows, len(rows))
+	if statusCol >= 0 {
+		counts := map[string]int{}
+		for _, row := range rows {
+			fields := strings.Fields(row)
+			if statusCol < len(fields) {
+				counts[fields[statusCol]]++
+			}
+		}
+		statuses := make([]string, 0, len(counts))
+		for status := range counts {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		sb.WriteString("Status counts:")
+		for _, status := range statuses {
+			fmt.Fprintf(&sb, " %s=%d", status, counts[status])
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func collapseRepeatedLines(out string) string {
+	lines := strings.Split(out, "\n")
+	var sb strings.Builder
+	for i := 0; i < len(lines); {
+		j := i + 1
+		for j < len(lines) && lines[j] == lines[i] {
+			j++
+		}
+		sb.WriteString(lines[i])
+		if j-i > 1 {
+			fmt.Fprintf(&sb, "  (repeated %d times)", j-i)
+		}
+		if j < len(lines) {
+			sb.WriteString("\n")
+		}
+		i = j
+	}
+	return sb.String()
+}
+
+// trimKubeEvents keeps only the most recent entries of each Events section.
+func trimKubeEvents(out string) string {
+	lines := strings.Split(out, "\n")
+	var kept []string
+	for i := 0; i < len(lines); i++ {
+		kept = append(kept, lines[i])
+		if !strings.HasPrefix(lines[i], "Events:") {
+			continue
+		}
+		j := i + 1
+		for j < len(lines) && (strings.HasPrefix(lines[j], " ") || lines[j] == "") {
+			j++
+		}
+		section := lines[i+1 : j]
+		// The first two lines are the column header and its underline.
+		if len(section) > kubeMaxEvents+2 {
+			kept = append(kept, section[:2]...)
+			kept = append(kept, fmt.Sprintf("  ... %d older events omitted ...", len(section)-kubeMaxEvents-2))
+			section = section[len(section)-kubeMaxEvents:]
+		}
+		kept = append(kept, section...)
+		i = j - 1
+	}
+	return strings.Join(kept, "\n")
+}
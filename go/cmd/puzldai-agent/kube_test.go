@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestKubectlGetOutputs checks that the schema offers every output the
+// handler supports, and that each reaches kubectl.
+func TestKubectlGetOutputs(t *testing.T) {
+	bin := t.TempDir()
+	fake := "#!/bin/sh\necho \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "kubectl"), []byte(fake), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	get, ok := findTool(kubeTools(&agentConfig{}), "kubectl_get")
+	if !ok {
+		t.Fatal("kubectl_get not offered")
+	}
+	for _, output := range []string{"wide", "yaml", "json", "name"} {
+		args, err := validateArgs(get.params, map[string]any{"resource": "pods", "output": output})
+		if err != nil {
+			t.Errorf("%s: %v", output, err)
+			continue
+		}
+		out, err := get.fn(context.Background(), t.TempDir(), args)
+		if err != nil {
+			t.Errorf("%s: %v", output, err)
+		} else if output != "wide" && !strings.Contains(out, "--output "+output) {
+			t.Errorf("%s: ran %q", output, out)
+		}
+	}
+}
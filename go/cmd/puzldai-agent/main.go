@@ -1,28 +1,36 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	anthropic "github.com/anthropics/anthropic-sdk-go"
-	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/term"
+
+	"puzldai/pkg/agent"
 )
 
 type agentMessage struct {
-	role        string
-	content     string
+	role    string
+	content string
+	// toolCalls holds calls the provider returned natively so they can be
+	// replayed in its own format; text-protocol calls live in content.
+	toolCalls   []toolCall
 	toolResults []toolResult
 }
 
@@ -34,118 +42,1160 @@ type toolCall struct {
 
 type toolResult struct {
 	id      string
+	name    string
 	content string
 	isError bool
+	// stop is set when the tool ended the run (see stopError).
+	stop *agentOutcome
+	// policy is set when a guard refused the call (see policyError).
+	policy bool
 }
 
+// toolFunc runs one tool call with its validated arguments in the working
+// directory cwd and returns the output shown to the model.
 type toolFunc func(ctx context.Context, cwd string, args map[string]any) (string, error)
 
 type toolDef struct {
 	name        string
 	description string
-	params      string
+	params      []toolParam
 	fn          toolFunc
 }
 
 const defaultMaxIters = 20
+const defaultMaxOutputTokens = 8192
 const maxFileBytes = 200_000
 
+const wrapUpNote = "You have reached the iteration limit. Do not call any tools. Reply with: " +
+	"1) a summary of the progress so far, 2) the work that is still incomplete, and " +
+	"3) your best partial result."
+
+const resumeNote = "Continue the task from where you stopped; finish the incomplete work from your last summary."
+
+const truncatedReplyNote = "Your previous reply was cut off at the output token limit and was not executed. " +
+	"Repeat it more concisely; split large file contents across several write or edit calls."
+
 var toolBlockRe = regexp.MustCompile("```tool\\s*([\\s\\S]*?)```")
 
 func main() {
-	modelFlag := flag.String("model", "", "Anthropic model")
+	os.Exit(run())
+}
+
+func run() int {
+	return runCommand(os.Args[1:])
+}
+
+// runTask implements the run command, the default: it runs the agent on
+// one task.
+func runTask(args []string) int {
+	modelFlag := flag.String("model", "", "Model name (default: PUZLDAI_MODEL, config, or the provider's default)")
+	providerFlag := flag.String("provider", "", "Model provider: "+providerNames()+" (default: anthropic)")
+	baseURLFlag := flag.String("base-url", "", "Override the provider API base URL (gateways, proxies)")
+	apiKeyEnvFlag := flag.String("api-key-env", "", "Environment variable holding the provider API key")
+	proxyFlag := flag.String("proxy", "", "Proxy URL for provider requests (default: HTTPS_PROXY/HTTP_PROXY)")
+	caCertFlag := flag.String("ca-cert", "", "PEM file with extra root certificates (e.g. a corporate TLS proxy)")
+	connectTimeoutFlag := flag.Duration("connect-timeout", 0, "Provider connect and TLS handshake timeout (default 30s)")
+	requestTimeoutFlag := flag.Duration("request-timeout", 0, "Timeout for a single provider request (default 10m)")
+	maxOutputTokensFlag := flag.Int("max-output-tokens", 0, "Maximum tokens per model response (default: config or 8192)")
+	var temperatureFlag, topPFlag optionalFloat
+	flag.Var(&temperatureFlag, "temperature", "Sampling temperature (default: provider default)")
+	flag.Var(&topPFlag, "top-p", "Nucleus sampling probability mass (default: provider default)")
 	maxItersFlag := flag.Int("max-iters", defaultMaxIters, "Maximum tool loop iterations")
-	cwdFlag := flag.String("cwd", "", "Working directory")
-	flag.Parse()
+	cwdFlag := flag.String("cwd", "", "Working directory, or several roots as alias=dir,alias=dir or a workspace file (the first root is primary)")
+	allowClusterWritesFlag := flag.Bool("allow-cluster-writes", false, "Expose cluster-mutating kubectl tools")
+	approvalFlag := flag.String("approval", "", "Approval mode for gated actions: prompt, auto, deny (default: config or prompt)")
+	permissionsFlag := flag.String("permissions", "", "Permission preset: "+permissionNames()+" (default: config; otherwise individual flags apply)")
+	egressFlag := flag.String("egress", "", "Network egress policy for tools: allow, deny (default: config; deny when CI is set)")
+	var allowHostFlag stringList
+	flag.Var(&allowHostFlag, "allow-host", "Host tools may reach under -egress deny (repeatable; *.example.com for subdomains)")
+	remoteFlag := flag.String("remote", "", "Run file and bash tools on a remote host (ssh://user@host/path)")
+	syncFromFlag := flag.String("sync-from", "", "Copy this directory or ssh:// tree into a temporary workspace and export changes as a patch")
+	patchOutFlag := flag.String("patch-out", "", "Patch file written in -sync-from mode (default: a file in the temp directory)")
+	emitFlag := flag.String("emit", "files", "How changes are delivered: files (written to the workspace) or patch (kept in memory; a git-applyable patch on stdout, the answer on stderr)")
+	manifestOutFlag := flag.String("manifest-out", "", "Write the JSON manifest of -emit patch to this file (default: stderr)")
+	askDefaultFlag := flag.String("ask-default", "", "Answer given to ask_user when no terminal is available (default: config; otherwise the run stops with needs_input)")
+	noInputFlag := flag.Bool("no-input", false, "Never prompt for ask_user answers, even on a terminal")
+	noColorFlag := flag.Bool("no-color", false, "Print answers as plain text and keep the TUI monochrome (also NO_COLOR)")
+	noStatusFlag := flag.Bool("no-status", false, "Do not show the live status line (iteration, tool, elapsed time, tokens, cost) on a terminal's stderr")
+	tuiFlag := flag.Bool("tui", false, "Full-screen terminal UI with streaming output, a tool-call log, the running diff, and token/cost counters")
+	ciFlag := flag.Bool("ci", false, "Unattended mode: no prompts, no color, one progress line per turn on stderr, only the final answer on stdout")
+	contractFlag := flag.String("contract", "", "Completion contract: none, result (## Result section), finish (finish tool) (default: config or none)")
+	outcomeOutFlag := flag.String("outcome-out", "", "Write the machine-readable outcome (status, summary) as JSON to this file")
+	configFlag := flag.String("config", "", "Config file (default: PUZLDAI_CONFIG or <cwd>/.puzldai.toml)")
+	profileFlag := flag.String("profile", "", "Config profile to use (default: PUZLDAI_PROFILE or default_profile)")
+	stallThresholdFlag := flag.Int("stall-threshold", 0, "Identical tool-call turns before the loop detector intervenes; 1 disables (default: config or 3)")
+	resumeFlag := flag.String("resume", "", "Continue a saved session by id; stdin may add instructions")
+	forkFlag := flag.String("fork", "", "Start a new session from a checkpoint (id@name), restoring its files")
+	whatIfFlag := flag.String("what-if", "", "Branch a new session from an entry of a saved one (id@entry, as numbered by replay), with the task text as the entry's new content")
+	whatIfRepliesFlag := flag.String("what-if-replies", "live", "Model replies after the edited entry in -what-if: live, or recorded (reuse the session's replies, then go live)")
+	historyFlag := flag.String("history", "", "Start a new session from a conversation exported elsewhere (JSON: puzldai session, OpenAI chat, or Anthropic messages)")
+	taskFlag := flag.String("task", "", "Task text (instead of stdin)")
+	taskFileFlag := flag.String("task-file", "", "Read the task from this file instead of stdin (- for stdin)")
+	taskFromClipboardFlag := flag.Bool("task-from-clipboard", false, "Read the task from the clipboard instead of stdin")
+	copyResultFlag := flag.Bool("copy-result", false, "Also copy the final answer to the clipboard")
+	taskFromFlag := flag.String("task-from", "", "Take the task from a tracker ticket, jira:PROJ-123 or linear:ENG-456, and comment the outcome on it (credentials: config [jira], [linear])")
+	noTicketCommentFlag := flag.Bool("no-ticket-comment", false, "Do not comment the outcome on the -task-from ticket")
+	repoMapTokensFlag := flag.Int("repo-map-tokens", 0, "Token budget for the repository map in the system prompt; -1 disables (default: config or 1024)")
+	reviewModelFlag := flag.String("review-model", "", "Have this model review the changes after the agent finishes (default: config; off when empty)")
+	reviewRoundsFlag := flag.Int("review-rounds", 0, "Maximum revision rounds requested by the reviewer (default: config or 2)")
+	visualReviewFlag := flag.Bool("visual-review", false, "Screenshot changed HTML, CSS, and markdown pages before and after in a headless browser and have the model check them for visual regressions (also config visual_review)")
+	attemptsFlag := flag.Int("attempts", 1, "Run the task this many times in separate git worktrees and apply the best result")
+	attemptModelsFlag := flag.String("attempt-models", "", "Comma-separated models to rotate through across -attempts")
+	attemptTemperaturesFlag := flag.String("attempt-temperatures", "", "Comma-separated temperatures to rotate through across -attempts")
+	verifyFlag := flag.String("verify", "", "Shell command that checks an attempt (exit 0 = pass), e.g. \"go test ./...\"; {targets} stands for the affected packages or targets (default: config)")
+	bootstrapFlag := flag.Bool("bootstrap", false, "Install missing toolchains, tools, and dependencies of the detected projects before the run; only in a sandbox (a container, or PUZLDAI_SANDBOX=1) (default: config bootstrap)")
+	scopeFlag := flag.String("scope", "", "Comma-separated Go package patterns (./services/api/...) or Bazel targets (//services/api/...) to scope the run to (default: config scope)")
+	judgeModelFlag := flag.String("judge-model", "", "Model that picks the best of several -attempts (default: the main model)")
+	pipelineFlag := flag.Bool("pipeline", false, "Run an architect, parallel coders, and a tester on the task (models: config [pipeline])")
+	outputSchemaFlag := flag.String("output-schema", "", "JSON Schema file; the run ends with a conforming JSON value on stdout instead of prose")
+	watchFlag := flag.Bool("watch", false, "Watch the workspace and tell the model about files changed outside the agent")
+	keepScratchFlag := flag.Bool("keep-scratch", false, "Keep the session's scratch directory ($PUZLDAI_SCRATCH) instead of deleting it when the run ends")
+	maxFilesChangedFlag := flag.Int("max-files-changed", 0, "Stop for approval, or end the run with status change_limit_exceeded, once more files than this have changed (default: config max_files_changed; 0 for no limit)")
+	maxDiffLinesFlag := flag.Int("max-diff-lines", 0, "Same for the added plus deleted lines of the changes (default: config max_diff_lines; 0 for no limit)")
+	auditFlag := flag.Bool("audit", false, "Hash the workspace before the first change and report files changed at the end that no file tool wrote (default: config audit)")
+	batchAPIFlag := flag.Bool("batch-api", false, "Send anthropic turns through the Message Batches API: half price, results can take minutes or hours (default: config batch_api)")
+	batchPollFlag := flag.Duration("batch-poll", 0, "How often to poll a pending batch (default: config or 30s)")
+	cacheDirFlag := flag.String("cache-dir", "", "Reuse provider responses for identical requests from this directory (default: config; off when empty)")
+	cacheTTLFlag := flag.Duration("cache-ttl", 0, "How long cached provider responses stay valid (default: config or 24h)")
+	notifyFlag := flag.Bool("notify", false, "Show a desktop notification when the run finishes or waits for an approval or an answer")
+	webhookURLFlag := flag.String("webhook-url", "", "POST a JSON summary to this URL when the run finishes or waits for an approval or an answer")
+	telemetryFlag := flag.Bool("telemetry", false, "Opt in to sending anonymous run statistics (no prompts or code) to -telemetry-endpoint (also PUZLDAI_TELEMETRY=1)")
+	telemetryEndpointFlag := flag.String("telemetry-endpoint", "", "URL that -telemetry statistics are POSTed to (default: PUZLDAI_TELEMETRY_ENDPOINT)")
+	pprofFlag := flag.String("pprof", "", "Write Go runtime profiles when the process exits: cpu, mem, or cpu,mem")
+	pprofOutFlag := flag.String("pprof-out", "", "Directory -pprof profiles are written to (default: the current directory)")
+	debugAddrFlag := flag.String("debug-addr", "", "Serve /debug/pprof and /debug/vars on this address during the run, e.g. localhost:6060")
+	tokenBudgetFlag := flag.Int("token-budget", 0, "Stop the run once input plus output tokens reach this total (default: config; unlimited when 0)")
+	deadlineFlag := flag.Duration("deadline", 0, "Stop the run once it has taken this long, e.g. 30m (default: config; unlimited when 0)")
+	turnTimeoutFlag := flag.Duration("turn-timeout", 0, "Stop the run when one turn (model request and tool calls) takes longer than this (default: config; unlimited when 0)")
+	var contextFlag stringList
+	flag.Var(&contextFlag, "context", "Attach a file to the task (repeatable; paths relative to -cwd)")
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\nRun 'puzldai-agent help run' for the flags.\n", taskUsage)
+	}
+	hookFlagSet(flag.CommandLine)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *ciFlag {
+		enableCIMode()
+	}
+	noColor = *noColorFlag || os.Getenv("NO_COLOR") != ""
+	copyAnswer = *copyResultFlag
+	stopProfiles, err := startProfiles(*pprofFlag, *pprofOutFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer stopProfiles()
+	if *debugAddrFlag != "" {
+		if err := startDebugServer(*debugAddrFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "-debug-addr:", err)
+			return exitError
+		}
+	}
+	policy, err := loadOrgPolicy()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load policy:", err)
+		return exitError
+	}
+
+	var resumed *savedSession
+	if *resumeFlag != "" {
+		var err error
+		resumed, err = loadSession(*resumeFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		if resumed.Scrubbed {
+			fmt.Fprintf(os.Stderr, "session %s was scrubbed and cannot be resumed\n", resumed.ID)
+			return exitError
+		}
+		if !resumed.Resumable {
+			fmt.Fprintf(os.Stderr, "session %s ended with status %s and cannot be resumed\n", resumed.ID, resumed.Status)
+			return exitError
+		}
+	}
+	var forked *checkpoint
+	if *forkFlag != "" {
+		if resumed != nil {
+			fmt.Fprintln(os.Stderr, "-fork and -resume cannot be combined")
+			return exitError
+		}
+		var err error
+		forked, err = loadCheckpoint(*forkFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		resumed = &forked.Transcript
+	}
+	var imported []agentMessage
+	if *historyFlag != "" {
+		if resumed != nil {
+			fmt.Fprintln(os.Stderr, "-history cannot be combined with -resume or -fork")
+			return exitError
+		}
+		var err error
+		if imported, err = loadTranscript(*historyFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "history:", err)
+			return exitError
+		}
+	}
+	var whatIfEntry int
+	if *whatIfFlag != "" {
+		if resumed != nil || imported != nil {
+			fmt.Fprintln(os.Stderr, "-what-if cannot be combined with -resume, -fork, or -history")
+			return exitError
+		}
+		if *whatIfRepliesFlag != "live" && *whatIfRepliesFlag != "recorded" {
+			fmt.Fprintf(os.Stderr, "invalid -what-if-replies %q (live, recorded)\n", *whatIfRepliesFlag)
+			return exitError
+		}
+		var err error
+		if resumed, whatIfEntry, err = loadWhatIfSource(*whatIfFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
 
 	cwd := *cwdFlag
+	if cwd == "" && resumed != nil {
+		cwd = firstNonEmpty(resumed.Roots, resumed.Cwd)
+		if _, err := os.Stat(resumed.Cwd); err != nil {
+			fmt.Fprintf(os.Stderr, "workspace of session %s is gone (%v); pass -cwd\n", resumed.ID, err)
+			return exitError
+		}
+	}
+	ws, err := parseWorkspace(cwd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if ws != nil {
+		cwd = ws.primary()
+		if len(ws.roots) == 1 {
+			ws = nil
+		}
+	}
 	if cwd == "" {
 		wd, err := os.Getwd()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "failed to get cwd:", err)
-			os.Exit(1)
+			return exitError
 		}
 		cwd = wd
 	}
 
-	input, err := readAll(os.Stdin)
+	cfg, err := loadConfig(cwd, *configFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load config:", err)
+		return exitError
+	}
+	profile := firstNonEmpty(*profileFlag, os.Getenv("PUZLDAI_PROFILE"), cfg.DefaultProfile)
+	if err := cfg.applyProfile(profile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if *allowClusterWritesFlag {
+		cfg.Kubernetes.AllowWrites = true
+	}
+	if err := cfg.Commit.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := checkSessionKey(cfg.EncryptSessions); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if _, err := newRetention(cfg.Sessions, time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	var keep string
+	if resumed != nil {
+		keep = resumed.ID
+	}
+	applyRetention(cfg.Sessions, keep)
+
+	var tk *ticket
+	if *taskFromFlag != "" {
+		if *taskFlag != "" || *taskFileFlag != "" || resumed != nil || imported != nil || *whatIfFlag != "" {
+			fmt.Fprintln(os.Stderr, "-task-from cannot be combined with -task, -task-file, -resume, -fork, -what-if, or -history")
+			return exitError
+		}
+		if tk, err = fetchTicket(context.Background(), *taskFromFlag, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		*taskFlag = tk.task()
+		if *noTicketCommentFlag {
+			tk = nil
+		}
+	}
+	if *taskFromClipboardFlag {
+		if *taskFlag != "" || *taskFileFlag != "" || *taskFromFlag != "" {
+			fmt.Fprintln(os.Stderr, "-task-from-clipboard cannot be combined with -task, -task-file, or -task-from")
+			return exitError
+		}
+		text, err := readClipboard()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to read the clipboard:", err)
+			return exitError
+		}
+		if strings.TrimSpace(text) == "" {
+			fmt.Fprintln(os.Stderr, "the clipboard is empty")
+			return exitError
+		}
+		*taskFlag = text
+	}
+	input, err := readTask(*taskFlag, *taskFileFlag, resumed != nil || imported != nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	task := input
+	if strings.TrimSpace(task) == "" {
+		switch {
+		case *whatIfFlag != "":
+			fmt.Fprintln(os.Stderr, "-what-if needs the entry's new text (use stdin, -task, or -task-file)")
+			return exitError
+		case imported != nil && imported[len(imported)-1].role == "user":
+			// The conversation ends with a request nobody answered yet.
+			task = imported[len(imported)-1].content
+			imported = imported[:len(imported)-1]
+		case resumed == nil && imported == nil:
+			fmt.Fprintln(os.Stderr, "no task provided (use stdin, -task, or -task-file)")
+			return exitError
+		default:
+			task = resumeNote
+		}
+	}
+	var whatIf *whatIfBranch
+	if *whatIfFlag != "" {
+		if whatIf, err = branchSession(resumed, whatIfEntry, task); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		task = whatIf.task
+	}
+	if ws != nil {
+		for i, p := range contextFlag {
+			contextFlag[i] = ws.resolve(p)
+		}
+	}
+	attachments, err := contextAttachments(cwd, contextFlag, maxContextBytes)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "failed to read stdin:", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
 	}
-	task := strings.TrimSpace(input)
-	if task == "" {
-		fmt.Fprintln(os.Stderr, "no task provided on stdin")
-		os.Exit(1)
+	task += attachments
+
+	var resumedProvider, resumedModel string
+	if resumed != nil {
+		resumedProvider, resumedModel = resumed.Provider, resumed.Model
+	}
+	settings := providerSettings{
+		name:      firstNonEmpty(*providerFlag, resumedProvider, cfg.Provider),
+		model:     firstNonEmpty(*modelFlag, os.Getenv("PUZLDAI_MODEL"), resumedModel, cfg.Model),
+		baseURL:   firstNonEmpty(*baseURLFlag, cfg.BaseURL),
+		apiKeyEnv: firstNonEmpty(*apiKeyEnvFlag, cfg.APIKeyEnv),
+		profile:   profile,
+		transport: transportSettings{
+			proxy:          firstNonEmpty(*proxyFlag, cfg.Proxy),
+			caCert:         firstNonEmpty(*caCertFlag, cfg.CACert),
+			connectTimeout: firstPositive(*connectTimeoutFlag, cfg.ConnectTimeout),
+			requestTimeout: firstPositive(*requestTimeoutFlag, cfg.RequestTimeout),
+		},
+	}
+	if *batchAPIFlag || cfg.BatchAPI {
+		settings.batchPoll = firstPositive(*batchPollFlag, cfg.BatchPoll, defaultBatchPoll)
+	}
+	llm, model, err := newProvider(settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitProvider
+	}
+	counter := newTokenCounter(llm, model)
+	pruner, err := newHistoryPruner(cfg.History, counter, task)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := policy.checkModel(firstNonEmpty(settings.name, "anthropic"), model); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitPolicy
+	}
+	if name := firstNonEmpty(settings.name, "anthropic"); cfg.RateLimits[name].enabled() {
+		if llm, err = newRateLimiter(llm, name, cfg.RateLimits[name]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
+	meter := newUsageMeter(llm, firstNonEmpty(settings.name, "anthropic"), cwd, settings.batchPoll > 0)
+	llm = meter
+	if dir := firstNonEmpty(*cacheDirFlag, cfg.CacheDir); dir != "" {
+		scope := firstNonEmpty(settings.name, "anthropic") + " " + settings.baseURL
+		if llm, err = newCachingProvider(llm, scope, dir, firstPositive(*cacheTTLFlag, cfg.CacheTTL)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
+	llm = policy.guardProvider(llm, firstNonEmpty(settings.name, "anthropic"))
+	var telem *telemetry
+	if telemetryConsent(*telemetryFlag) {
+		endpoint := firstNonEmpty(*telemetryEndpointFlag, os.Getenv("PUZLDAI_TELEMETRY_ENDPOINT"))
+		if endpoint == "" {
+			fmt.Fprintln(os.Stderr, "-telemetry needs an endpoint (-telemetry-endpoint or PUZLDAI_TELEMETRY_ENDPOINT)")
+			return exitUsage
+		}
+		if err := policy.checkEndpoint(endpoint); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitPolicy
+		}
+		telem = newTelemetry(endpoint, firstNonEmpty(settings.name, "anthropic"), model)
+		llm = telem.wrap(llm)
+	}
+	maxTokens := *maxOutputTokensFlag
+	if maxTokens <= 0 {
+		maxTokens = cfg.MaxOutputTokens
+	}
+	if maxTokens <= 0 {
+		maxTokens = defaultMaxOutputTokens
+	}
+	temperature := temperatureFlag.or(cfg.Temperature)
+	topP := topPFlag.or(cfg.TopP)
+	if temperature != nil && (*temperature < 0 || *temperature > 2) {
+		fmt.Fprintln(os.Stderr, "temperature must be between 0 and 2")
+		return exitError
+	}
+	if topP != nil && (*topP <= 0 || *topP > 1) {
+		fmt.Fprintln(os.Stderr, "top-p must be in (0, 1]")
+		return exitError
+	}
+
+	contract, err := newContract(firstNonEmpty(*contractFlag, cfg.CompletionContract))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	perms, err := lookupPermissions(firstNonEmpty(*permissionsFlag, cfg.Permissions))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	var permsApproval string
+	if perms != nil {
+		permsApproval = perms.approval
+	}
+	approver, err := newApprover(firstNonEmpty(*approvalFlag, permsApproval, cfg.Approval, approvalPrompt))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if ws != nil && (*attemptsFlag > 1 || *pipelineFlag || *remoteFlag != "" || *syncFromFlag != "") {
+		fmt.Fprintln(os.Stderr, "multiple workspace roots cannot be combined with -attempts, -pipeline, -remote, or -sync-from")
+		return exitError
+	}
+	if *tuiFlag && (*ciFlag || *attemptsFlag > 1 || *pipelineFlag) {
+		fmt.Fprintln(os.Stderr, "-tui cannot be combined with -ci, -attempts, or -pipeline")
+		return exitError
+	}
+	if (*attemptsFlag > 1 || *pipelineFlag) && (*resumeFlag != "" || *forkFlag != "" || *whatIfFlag != "" || *remoteFlag != "" || *syncFromFlag != "") {
+		fmt.Fprintln(os.Stderr, "-attempts and -pipeline cannot be combined with -resume, -fork, -what-if, -remote, or -sync-from")
+		return exitError
+	}
+	var emit *overlay
+	patchOut := answerOut
+	switch *emitFlag {
+	case "files":
+	case "patch":
+		if ws != nil || *attemptsFlag > 1 || *pipelineFlag || *remoteFlag != "" || *syncFromFlag != "" || *forkFlag != "" || *tuiFlag {
+			fmt.Fprintln(os.Stderr, "-emit patch cannot be combined with multiple workspace roots, -attempts, -pipeline, -remote, -sync-from, -fork, or -tui")
+			return exitError
+		}
+		emit = newOverlay(cwd)
+		// The patch goes to patchOut; the answer goes to stderr instead.
+		answerOut = os.Stderr
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -emit %q (files, patch)\n", *emitFlag)
+		return exitUsage
+	}
+	if *attemptsFlag > 1 || *pipelineFlag {
+		// Children run in temporary worktrees; book them to this project.
+		os.Setenv(projectEnv, meter.project)
+	}
+	if err := policy.checkEndpoint(*webhookURLFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitPolicy
+	}
+	notify := newNotifier(*notifyFlag, *webhookURLFlag, "", cwd, task)
+	// finish records how the run ended: the -outcome-out file, notifications,
+	// and the usage ledger.
+	finish := func(outcome agentOutcome, session string) {
+		outcome.CostUSD = meter.cost()
+		outcome.Error = firstNonEmpty(outcome.Error, agent.Code(runFailure(outcome, 0, nil)))
+		writeOutcome(*outcomeOutFlag, outcome)
+		notify.finished(outcome)
+		tk.reply(outcome)
+		meter.record(session, outcome.Status)
+	}
+	if *pipelineFlag {
+		if *attemptsFlag > 1 {
+			fmt.Fprintln(os.Stderr, "-pipeline and -attempts cannot be combined")
+			return exitError
+		}
+		return runPipeline(pipelineOptions{
+			config:   cfg.Pipeline,
+			verify:   firstNonEmpty(*verifyFlag, cfg.Verify),
+			parallel: approver.mode != approvalPrompt,
+			cwd:      cwd,
+			task:     task,
+			finish:   func(outcome agentOutcome) { finish(outcome, "") },
+		}, model)
+	}
+	if *attemptsFlag > 1 {
+		for _, t := range splitList(*attemptTemperaturesFlag) {
+			if v, err := strconv.ParseFloat(t, 64); err != nil || v < 0 || v > 2 {
+				fmt.Fprintf(os.Stderr, "invalid attempt temperature %q\n", t)
+				return exitError
+			}
+		}
+		return runEnsemble(ensembleOptions{
+			attempts:     *attemptsFlag,
+			models:       splitList(*attemptModelsFlag),
+			temperatures: splitList(*attemptTemperaturesFlag),
+			verify:       firstNonEmpty(*verifyFlag, cfg.Verify),
+			judgeModel:   firstNonEmpty(*judgeModelFlag, cfg.JudgeModel),
+			parallel:     approver.mode != approvalPrompt,
+			cwd:          cwd,
+			task:         task,
+			finish:       func(outcome agentOutcome) { finish(outcome, "") },
+		}, llm, model, maxTokens)
+	}
+
+	sess := newSession(cwd, approver)
+	defer sess.close()
+	sess.transport = settings.transport
+	sess.egress, err = newEgressPolicy(firstNonEmpty(*egressFlag, cfg.Egress.Policy),
+		append(cfg.Egress.AllowHosts, allowHostFlag...), cfg.Egress.AllowTools)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if forked != nil {
+		previous, err := restoreCheckpoint(forked)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to restore checkpoint files:", err)
+			return exitError
+		}
+		fmt.Fprintf(os.Stderr, "restored %s to checkpoint %s; the previous state is kept as %s\n", forked.Root, *forkFlag, previous)
+		if err := forkNotes(forked, sess.id); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to copy checkpoint notes:", err)
+		}
+	} else if whatIf != nil {
+		fmt.Fprintf(os.Stderr, "branched session %s at entry %d into %s\n", whatIf.from.ID, whatIf.entry, sess.id)
+	} else if resumed != nil {
+		sess.id = resumed.ID
+	}
+	notify = newNotifier(*notifyFlag, *webhookURLFlag, sess.id, cwd, task)
+	approver.notify = notify
+	if *remoteFlag != "" {
+		remote, err := parseRemote(*remoteFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		if err := remote.open(sess); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to connect to remote:", err)
+			return exitError
+		}
+		sess.remote = remote
+	}
+	if *syncFromFlag != "" {
+		if sess.remote != nil {
+			fmt.Fprintln(os.Stderr, "-sync-from and -remote cannot be combined")
+			return exitError
+		}
+		dir, err := syncWorkspace(sess, *syncFromFlag, *patchOutFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		cwd = dir
+		sess.cwd = dir
+	}
+
+	fsys, _ := sess.workspace()
+	formatters, err := newFormatters(context.Background(), fsys, cfg.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	// Commands run on the remote host cannot use a local directory.
+	var scratch string
+	if sess.remote == nil {
+		if scratch, err = newScratchDir(sess, *keepScratchFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to create the scratch directory:", err)
+			return exitError
+		}
+	}
+	tools := append(defaultTools(cfg, sess), askUserTool(approver, firstNonEmpty(*askDefaultFlag, cfg.AskDefault), *noInputFlag || ciMode))
+	tools = append(tools, noteTool(sess))
+	tools = append(tools, contract.tools()...)
+	if emit != nil {
+		tools = emit.apply(tools)
+		sess.onClose(emit.close)
+	}
+	roots := []string{cwd}
+	if ws != nil {
+		roots = ws.dirs()
+	}
+	// The protected-path check runs after the permission, policy, and ignore
+	// checks, so nothing they refuse is put to the operator.
+	protectedRoots := roots
+	if sess.remote != nil {
+		protectedRoots = []string{sess.remote.root}
+	}
+	protected, err := newProtectedPaths(cfg.ProtectedPaths, protectedRoots, approver, sess.remote)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if protected != nil {
+		tools = protected.apply(tools)
+	}
+	if perms != nil {
+		jailRoots := roots
+		if scratch != "" {
+			jailRoots = append(roots[:len(roots):len(roots)], scratch)
+		}
+		tools = perms.apply(sess, jailRoots, tools)
+	}
+	tools = policy.apply(sess, tools)
+	var ignore *ignoreRules
+	if sess.remote == nil {
+		if ignore, err = loadIgnoreRules(roots); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		ignore = policy.restrict(ignore, roots)
+	}
+	var scope *buildScope
+	patterns := splitList(*scopeFlag)
+	if len(patterns) == 0 {
+		patterns = cfg.Scope
+	}
+	if len(patterns) > 0 {
+		if sess.remote != nil {
+			fmt.Fprintln(os.Stderr, "-scope cannot be combined with -remote")
+			return exitError
+		}
+		if scope, err = loadBuildScope(context.Background(), cwd, patterns); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		ignore = scope.restrict(ignore)
+	}
+	if ignore != nil {
+		tools = ignore.apply(tools)
+	}
+	if maxFiles, maxLines := firstNonZero(*maxFilesChangedFlag, cfg.MaxFilesChanged), firstNonZero(*maxDiffLinesFlag, cfg.MaxDiffLines); maxFiles > 0 || maxLines > 0 {
+		if sess.remote != nil {
+			fmt.Fprintln(os.Stderr, "-max-files-changed and -max-diff-lines cannot be combined with -remote")
+			return exitError
+		}
+		if _, err := exec.LookPath("git"); err != nil {
+			fmt.Fprintln(os.Stderr, "-max-files-changed and -max-diff-lines need git to measure the changes")
+			return exitError
+		}
+		tools = newChangeLimits(maxFiles, maxLines, approver, roots, emit).apply(sess, tools)
+	}
+	// The audit hashes the local tree, so remote sessions go without.
+	var audit *workspaceAudit
+	if (*auditFlag || cfg.Audit) && sess.remote == nil {
+		audit = newWorkspaceAudit(roots, ignore)
+		tools = audit.apply(tools)
+	}
+	if ws != nil {
+		tools = ws.apply(tools)
+	}
+	if sess.egress != nil {
+		if tools, err = sess.egress.apply(sess, tools); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
+	tools = useMiddleware(tools, telem.middleware())
+	// The projects are detected, and PUZLD.md read, in the local tree, so
+	// remote sessions go without.
+	var runtimes []*projectRuntime
+	var instructions string
+	if sess.remote == nil {
+		instructions = projectInstructions(cwd)
+		runtimes = detectRuntimes(cwd)
+		if *bootstrapFlag || cfg.Bootstrap {
+			if inSandbox() {
+				runtimes = bootstrapRuntimes(context.Background(), cwd, runtimes)
+			} else {
+				fmt.Fprintf(os.Stderr, "-bootstrap only installs tools in a sandbox (a container, or %s=1); skipped\n", sandboxEnv)
+			}
+		}
+		warnMissing(runtimes)
+	}
+	basePrompt := buildSystemPrompt(cwd, tools) + instructions + runtimeInstructions(runtimes) + notesInstructions(sess.id) + untrustedInstructions + contract.instructions() + scope.instructions()
+	if ws != nil {
+		basePrompt += ws.instructions()
+	}
+	if emit != nil {
+		basePrompt += emitPatchInstructions
+	}
+	if scratch != "" {
+		basePrompt += scratchInstructions(scratch)
+	}
+	schema, err := loadOutputSchema(*outputSchemaFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if schema != nil {
+		basePrompt += schema.instructions()
+	}
+	systemPrompt := basePrompt
+	// The map is built from the local tree, so remote sessions go without.
+	var repo *repoMap
+	if tokens := firstNonZero(*repoMapTokensFlag, cfg.RepoMapTokens, defaultRepoMapTokens); tokens > 0 && sess.remote == nil {
+		repo = newRepoMap(cwd, tokens, ignore)
+		if text, _ := repo.refresh(); text != "" {
+			systemPrompt = basePrompt + "\n\n" + text
+		}
+	}
+	if whatIf != nil && whatIf.system != "" {
+		// The edited prompt holds the repository map it was recorded with.
+		basePrompt, systemPrompt, repo = whatIf.system, whatIf.system, nil
+	}
+
+	record := &savedSession{ID: sess.id, Cwd: cwd, Provider: settings.name, Model: model}
+	if ws != nil {
+		record.Roots = ws.spec()
+	}
+	var messages []agentMessage
+	if resumed != nil && whatIf == nil {
+		if forked == nil {
+			record.Created = resumed.Created
+		}
+		messages = resumed.agentMessages()
+	}
+	if n := len(imported); n > 0 && imported[n-1].role == "user" && imported[n-1].content == task {
+		// -attempts children get the task the parent took from the history.
+		imported = imported[:n-1]
+	}
+	messages = append(messages, imported...)
+	if whatIf != nil {
+		messages = whatIf.messages
+	} else {
+		messages = append(messages, agentMessage{role: "user", content: task})
+	}
+
+	// end records the outcome and the transcript; resumable runs can be
+	// continued later with -resume.
+	var ui *tui
+	var status *statusLine
+	var policyRefusals int
+	end := func(outcome agentOutcome, resumable bool) {
+		status.stop()
+		outcome.Error = firstNonEmpty(outcome.Error, agent.Code(runFailure(outcome, policyRefusals, nil)))
+		if scope != nil {
+			outcome.AffectedTargets = scope.reportAffected(cwd)
+		}
+		if audit != nil {
+			outcome.UndeclaredChanges = audit.report(cwd)
+		}
+		if emit != nil {
+			if err := emit.emit(context.Background(), patchOut, *manifestOutFlag, outcome); err != nil {
+				fmt.Fprintln(os.Stderr, "failed to write the patch:", err)
+			}
+		}
+		ui.finish(outcome)
+		finish(outcome, sess.id)
+		telem.finished(outcome)
+		record.Status = outcome.Status
+		record.Resumable = resumable
+		record.System = systemPrompt
+		if err := record.save(messages); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to save session:", err)
+		} else if resumable {
+			fmt.Fprintf(os.Stderr, "session %s saved; continue with -resume %s\n", sess.id, sess.id)
+		}
 	}
 
-	model := *modelFlag
-	if model == "" {
-		model = os.Getenv("PUZLDAI_MODEL")
+	var critic *reviewer
+	if reviewModel := firstNonEmpty(*reviewModelFlag, cfg.ReviewModel); reviewModel != "" {
+		rounds := firstNonZero(*reviewRoundsFlag, cfg.ReviewRounds, defaultReviewRounds)
+		critic = newReviewer(llm, reviewModel, tools, maxTokens, rounds, cwd, sess.remote == nil)
+		critic.overlay = emit
 	}
-	if model == "" {
-		model = "claude-3-5-sonnet-latest"
+	var visual *visualReviewer
+	if *visualReviewFlag || cfg.VisualReview {
+		if sess.remote != nil || emit != nil {
+			fmt.Fprintln(os.Stderr, "visual review disabled: it needs the changes in a local workspace, not -remote or -emit patch")
+		} else {
+			visual = newVisualReviewer(llm, model, maxTokens, cfg.Browser, cwd)
+		}
+	}
+	if whatIf != nil && *whatIfRepliesFlag == "recorded" {
+		// After the reviewers, which keep asking the live provider.
+		llm = newReplayProvider(llm, whatIf.replies)
 	}
 
-	client := anthropic.NewClient()
-	tools := defaultTools()
-	systemPrompt := buildSystemPrompt(cwd, tools)
+	var watcher *workspaceWatcher
+	if (*watchFlag || cfg.Watch) && sess.remote == nil {
+		watcher, err = newWorkspaceWatcher(cwd)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "file watcher disabled:", err)
+		} else {
+			sess.onClose(watcher.close)
+		}
+	}
 
-	messages := []agentMessage{{role: "user", content: task}}
+	stallThreshold := *stallThresholdFlag
+	if stallThreshold <= 0 {
+		stallThreshold = cfg.StallThreshold
+	}
+	if stallThreshold <= 0 {
+		stallThreshold = defaultStallThreshold
+	}
+	stalls := newStallDetector(stallThreshold)
 
-	ctx := context.Background()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if ciMode {
+		ctx = withCommandEnv(ctx, ciCommandEnv)
+	}
+	if scratch != "" {
+		ctx = withCommandEnv(ctx, scratchCommandEnv(scratch))
+	}
+	// Commits the model makes through bash get the [commit] identity and
+	// signing settings, though not its trailers.
+	ctx = withCommandEnv(ctx, cfg.Commit.env())
+	ctx = withFileCache(ctx, newFileCache())
+	if audit != nil {
+		ctx = withWorkspaceFS(ctx, audit.fs(workspaceFSFrom(ctx)))
+	}
+	if emit != nil {
+		emit.lower = workspaceFSFrom(ctx)
+		ctx = withWorkspaceFS(ctx, emit)
+	}
+	ctx = withTokenCounter(ctx, counter)
+	ctx = withViewDedup(ctx, newViewDedup(resultsIn(&messages)))
+	ctx = withFormatters(ctx, formatters)
+	ctx, turns, stopLimits := withRunLimits(ctx, firstPositive(*deadlineFlag, cfg.Deadline), firstPositive(*turnTimeoutFlag, cfg.TurnTimeout))
+	defer stopLimits()
+	if *tuiFlag {
+		if ui, err = newTUI(model, cwd, sess.remote == nil, cancel); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		approver.ui = ui
+		tools = useMiddleware(tools, ui.middleware())
+	} else if !*noStatusFlag && !ciMode {
+		status = newStatusLine(meter, *maxItersFlag)
+		defer status.stop()
+		approver.status = status
+		tools = useMiddleware(tools, status.middleware())
+	}
 	start := time.Now()
 	var last string
+	tokenBudget := firstNonZero(*tokenBudgetFlag, cfg.TokenBudget)
+	var tokensUsed int
 
 	for iter := 0; iter < *maxItersFlag; iter++ {
-		prompt := buildPrompt(systemPrompt, messages)
-
-		msg, err := client.Messages.New(ctx, anthropic.MessageNewParams{
-			Model:     anthropic.Model(model),
-			MaxTokens: int64(2048),
-			Messages: []anthropic.MessageParam{{
-				Role: anthropic.MessageParamRoleUser,
-				Content: []anthropic.ContentBlockParamUnion{{
-					OfText: &anthropic.TextBlockParam{Text: prompt},
-				}},
-			}},
-		})
+		ui.turn(iter + 1)
+		status.turn(iter + 1)
+		turns.start()
+		req := completionRequest{
+			model:       model,
+			system:      systemPrompt,
+			messages:    messages,
+			tools:       tools,
+			maxTokens:   maxTokens,
+			temperature: temperature,
+			topP:        topP,
+			onText:      ui.stream(),
+		}
+		req.messages = pruner.prune(ctx, req)
+		// Refuse a turn whose input alone would overrun the budget instead
+		// of paying for it and stopping afterwards.
+		if tokenBudget > 0 {
+			if input, ok := counter.fits(ctx, req, tokenBudget-tokensUsed); !ok {
+				summary := fmt.Sprintf("token budget exhausted (the next request needs about %d input tokens; %d of %d used)", input, tokensUsed, tokenBudget)
+				fmt.Fprintln(os.Stderr, summary)
+				end(agentOutcome{Status: outcomeBudgetExceeded, Summary: summary, Iterations: iter}, true)
+				return exitBudget
+			}
+		}
+		resp, err := llm.complete(ctx, req)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "anthropic error:", err)
-			os.Exit(1)
+			outcome, code := providerFailure(ctx, err)
+			switch code {
+			case exitProvider:
+				fmt.Fprintln(os.Stderr, "provider error:", err)
+			case exitTimeout:
+				fmt.Fprintln(os.Stderr, outcome.Summary)
+			}
+			outcome.Iterations = iter + 1
+			end(outcome, true)
+			return code
 		}
 
-		text := renderMessageText(msg)
+		text := resp.text
 		last = text
+		tokensUsed += int(resp.usage.inputTokens + resp.usage.outputTokens)
+		ui.reply(text, resp.usage)
 
-		toolCalls := parseToolCalls(text)
+		toolCalls := resp.toolCalls
 		if len(toolCalls) == 0 {
-			fmt.Fprintln(os.Stdout, text)
-			return
+			toolCalls = parseToolCalls(text)
+		}
+		reportProgress(iter+1, len(toolCalls), tokensUsed, time.Since(start))
+		if resp.truncated {
+			fmt.Fprintf(os.Stderr, "response truncated at %d output tokens (raise -max-output-tokens)\n", maxTokens)
+		}
+		if len(toolCalls) == 0 && resp.truncated {
+			// A cut-off reply is not a final answer, and a half-written tool
+			// block must not be mistaken for one either; ask for a retry.
+			messages = append(messages,
+				agentMessage{role: "assistant", content: text},
+				agentMessage{role: "user", content: truncatedReplyNote},
+			)
+			continue
+		}
+		if len(toolCalls) == 0 && schema != nil && schema.pending != nil {
+			result, note, err := schema.check(text)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				end(agentOutcome{Status: outcomeError, Summary: err.Error(), Iterations: iter + 1}, false)
+				return exitError
+			}
+			messages = append(messages, agentMessage{role: "assistant", content: text})
+			if note != "" {
+				messages = append(messages, agentMessage{role: "user", content: note})
+				continue
+			}
+			outcome := *schema.pending
+			outcome.Summary, outcome.Iterations = result, iter+1
+			end(outcome, false)
+			fmt.Fprintln(answerOut, result)
+			copyResult(result)
+			return exitForOutcome(outcome, policyRefusals)
+		}
+		if len(toolCalls) == 0 {
+			outcome, reminder := contract.final(text)
+			if reminder != "" {
+				messages = append(messages,
+					agentMessage{role: "assistant", content: text},
+					agentMessage{role: "user", content: reminder},
+				)
+				continue
+			}
+			if critic != nil && reviewable(outcome) {
+				if objections := critic.review(ctx, cwd, task, text); objections != "" {
+					messages = append(messages,
+						agentMessage{role: "assistant", content: text},
+						agentMessage{role: "user", content: objections},
+					)
+					continue
+				}
+			}
+			if visual != nil && reviewable(outcome) {
+				if problems := visual.review(ctx, task); problems != "" {
+					messages = append(messages,
+						agentMessage{role: "assistant", content: text},
+						agentMessage{role: "user", content: problems},
+					)
+					continue
+				}
+			}
+			messages = append(messages, agentMessage{role: "assistant", content: text})
+			if schema != nil {
+				result, err := schema.validate(text)
+				if err != nil {
+					messages = append(messages, agentMessage{role: "user", content: schema.request(outcome)})
+					continue
+				}
+				outcome.Summary, text = result, result
+			}
+			outcome.Iterations = iter + 1
+			end(outcome, false)
+			printAnswer(text)
+			return exitForOutcome(outcome, policyRefusals)
 		}
 
-		messages = append(messages, agentMessage{role: "assistant", content: text})
+		messages = append(messages, agentMessage{role: "assistant", content: text, toolCalls: resp.toolCalls})
 
+		if watcher != nil {
+			watcher.toolsStarted()
+		}
 		results := runTools(ctx, cwd, tools, toolCalls)
 		messages = append(messages, agentMessage{role: "tool", toolResults: results})
+		ui.refreshDiff(ctx)
+		for _, result := range results {
+			if result.policy {
+				policyRefusals++
+			}
+		}
+		var changedNote string
+		if watcher != nil {
+			watcher.toolsDone(cwd, toolCalls)
+			changedNote = watcher.notice()
+		}
+		if repo != nil {
+			repo.touch(toolCalls, changedNote != "")
+			if text, changed := repo.update(); changed {
+				systemPrompt = basePrompt + "\n\n" + text
+			}
+		}
+
+		for _, result := range results {
+			if result.stop != nil {
+				outcome := *result.stop
+				outcome.Iterations = iter + 1
+				end(outcome, true)
+				printAnswer(outcome.Summary)
+				return exitForOutcome(outcome, policyRefusals)
+			}
+		}
+		if outcome, ok := contract.finished(toolCalls, results); ok {
+			if critic != nil && reviewable(outcome) {
+				if objections := critic.review(ctx, cwd, task, outcome.Summary); objections != "" {
+					messages = append(messages, agentMessage{role: "user", content: objections})
+					continue
+				}
+			}
+			if visual != nil && reviewable(outcome) {
+				if problems := visual.review(ctx, task); problems != "" {
+					messages = append(messages, agentMessage{role: "user", content: problems})
+					continue
+				}
+			}
+			if schema != nil {
+				messages = append(messages, agentMessage{role: "user", content: schema.request(outcome)})
+				continue
+			}
+			outcome.Iterations = iter + 1
+			end(outcome, false)
+			printAnswer(outcome.Summary)
+			return exitForOutcome(outcome, policyRefusals)
+		}
+
+		note, abort := stalls.observe(toolCalls, results)
+		if abort {
+			summary := "stalled repeating: " + describeCalls(toolCalls)
+			fmt.Fprintln(os.Stderr, "aborting: the model kept repeating the same tool calls")
+			end(agentOutcome{Status: outcomeStalled, Summary: summary, Iterations: iter + 1}, true)
+			fmt.Fprintln(answerOut, summary)
+			return exitStalled
+		}
+		if ctx.Err() != nil {
+			outcome, code := interrupted(ctx)
+			fmt.Fprintln(os.Stderr, outcome.Summary)
+			outcome.Iterations = iter + 1
+			end(outcome, true)
+			return code
+		}
+		if tokenBudget > 0 && tokensUsed >= tokenBudget {
+			summary := fmt.Sprintf("token budget exhausted (%d of %d tokens)", tokensUsed, tokenBudget)
+			fmt.Fprintln(os.Stderr, summary)
+			end(agentOutcome{Status: outcomeBudgetExceeded, Summary: summary, Iterations: iter + 1}, true)
+			return exitBudget
+		}
+		if note != "" {
+			fmt.Fprintln(os.Stderr, "loop detected; sending a corrective note")
+			messages = append(messages, agentMessage{role: "user", content: note})
+		}
+		if changedNote != "" {
+			messages = append(messages, agentMessage{role: "user", content: changedNote})
+		}
+
+		record.Status, record.Resumable = "running", true
+		record.System = systemPrompt
+		if err := record.save(messages); err != nil && iter == 0 {
+			fmt.Fprintln(os.Stderr, "failed to save session:", err)
+		}
 	}
 
 	elapsed := time.Since(start)
-	fmt.Fprintf(os.Stderr, "max iterations reached after %s\n", elapsed.Round(time.Millisecond))
-	fmt.Fprintln(os.Stdout, last)
+	fmt.Fprintf(os.Stderr, "max iterations reached after %s; asking for a wrap-up\n", elapsed.Round(time.Millisecond))
+
+	// One last turn without tools so the model can hand over what it has
+	// instead of the run ending mid-thought.
+	summary := last
+	messages = append(messages, agentMessage{role: "user", content: wrapUpNote})
+	ui.turn(*maxItersFlag + 1)
+	status.turn(*maxItersFlag + 1)
+	turns.start()
+	req := completionRequest{
+		model:       model,
+		system:      systemPrompt,
+		messages:    messages,
+		maxTokens:   maxTokens,
+		temperature: temperature,
+		topP:        topP,
+		onText:      ui.stream(),
+	}
+	req.messages = pruner.prune(ctx, req)
+	resp, err := llm.complete(ctx, req)
+	if err != nil && ctx.Err() != nil {
+		outcome, code := interrupted(ctx)
+		fmt.Fprintln(os.Stderr, outcome.Summary)
+		outcome.Iterations = *maxItersFlag
+		end(outcome, true)
+		return code
+	}
+	if err != nil || strings.TrimSpace(resp.text) == "" {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "wrap-up failed:", err)
+		}
+		messages = messages[:len(messages)-1]
+	} else {
+		summary = resp.text
+		messages = append(messages, agentMessage{role: "assistant", content: summary})
+		tokensUsed += int(resp.usage.inputTokens + resp.usage.outputTokens)
+		ui.reply(resp.text, resp.usage)
+		reportProgress(*maxItersFlag+1, 0, tokensUsed, time.Since(start))
+	}
+	end(agentOutcome{Status: outcomeMaxIterations, Summary: strings.TrimSpace(summary), Iterations: *maxItersFlag}, true)
+	printAnswer(summary)
+	return exitMaxIterations
 }
 
-func readAll(r io.Reader) (string, error) {
-	var sb strings.Builder
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		sb.WriteString(scanner.Text())
-		sb.WriteByte('\n')
+// readTask returns the task from -task, -task-file, or stdin, byte for byte.
+// A resumed session on a terminal reads nothing, so stdin stays optional.
+func readTask(text, file string, resuming bool) (string, error) {
+	switch {
+	case text != "" && file != "":
+		return "", errors.New("use either -task or -task-file, not both")
+	case text != "":
+		return text, nil
+	case file != "" && file != "-":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read task file: %w", err)
+		}
+		return string(data), nil
+	case resuming && file == "" && term.IsTerminal(int(os.Stdin.Fd())):
+		return "", nil
 	}
-	if err := scanner.Err(); err != nil {
-		return "", err
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to read stdin: %w", err)
 	}
-	return sb.String(), nil
+	return string(data), nil
 }
 
 func renderMessageText(msg *anthropic.Message) string {
@@ -176,7 +1226,7 @@ func buildSystemPrompt(cwd string, tools []toolDef) string {
 		sb.WriteString("\n")
 		sb.WriteString(tool.description)
 		sb.WriteString("\n\nParameters:\n")
-		sb.WriteString(tool.params)
+		sb.WriteString(renderParams(tool.params))
 		sb.WriteString("\n\n---\n\n")
 	}
 
@@ -204,20 +1254,7 @@ func buildPrompt(systemPrompt string, messages []agentMessage) string {
 			sb.WriteString(msg.content)
 			sb.WriteString("\n\n")
 		case "tool":
-			sb.WriteString("Tool Results:\n")
-			for _, result := range msg.toolResults {
-				status := "SUCCESS"
-				if result.isError {
-					status = "ERROR"
-				}
-				sb.WriteString("[")
-				sb.WriteString(status)
-				sb.WriteString("] ")
-				sb.WriteString(result.id)
-				sb.WriteString(":\n")
-				sb.WriteString(result.content)
-				sb.WriteString("\n\n")
-			}
+			writeToolResults(&sb, msg.toolResults)
 		}
 	}
 
@@ -225,6 +1262,23 @@ func buildPrompt(systemPrompt string, messages []agentMessage) string {
 	return sb.String()
 }
 
+func writeToolResults(sb *strings.Builder, results []toolResult) {
+	sb.WriteString("Tool Results:\n")
+	for _, result := range results {
+		status := "SUCCESS"
+		if result.isError {
+			status = "ERROR"
+		}
+		sb.WriteString("[")
+		sb.WriteString(status)
+		sb.WriteString("] ")
+		sb.WriteString(result.id)
+		sb.WriteString(":\n")
+		sb.WriteString(result.content)
+		sb.WriteString("\n\n")
+	}
+}
+
 func parseToolCalls(content string) []toolCall {
 	matches := toolBlockRe.FindAllStringSubmatch(content, -1)
 	if len(matches) == 0 {
@@ -259,19 +1313,66 @@ func runTools(ctx context.Context, cwd string, tools []toolDef, calls []toolCall
 	for _, call := range calls {
 		def, ok := findTool(tools, call.name)
 		if !ok {
-			results = append(results, toolResult{id: call.id, content: "Unknown tool: " + call.name, isError: true})
+			results = append(results, toolResult{id: call.id, name: call.name, content: "Unknown tool: " + call.name, isError: true})
+			continue
+		}
+		args, err := validateArgs(def.params, call.arguments)
+		if err != nil {
+			results = append(results, toolResult{id: call.id, name: call.name, content: call.name + ": " + err.Error(), isError: true})
 			continue
 		}
-		output, err := def.fn(ctx, cwd, call.arguments)
+		output, err := def.fn(withToolCall(ctx, call), cwd, args)
+		var stop *stopError
+		if errors.As(err, &stop) {
+			results = append(results, toolResult{id: call.id, name: call.name, content: err.Error(), isError: true, stop: &stop.outcome})
+			break
+		}
 		if err != nil {
-			results = append(results, toolResult{id: call.id, content: err.Error(), isError: true})
+			var refused *policyError
+			results = append(results, toolResult{id: call.id, name: call.name, content: err.Error(), isError: true, policy: errors.As(err, &refused)})
 			continue
 		}
-		results = append(results, toolResult{id: call.id, content: output, isError: false})
+		output = tokenCounterFrom(ctx).truncateTokens(ctx, output, maxToolResultTokens)
+		content := screenOutput(cwd, call, args, output)
+		if call.name == "view" {
+			path, _ := argString(args, "path")
+			content = viewDedupFrom(ctx).result(resolvePath(cwd, path), path, call.id, content)
+		}
+		results = append(results, toolResult{id: call.id, name: call.name, content: content, isError: false})
 	}
 	return results
 }
 
+// toolMiddleware wraps a tool for logging, metrics, or the like without
+// touching the tool itself. The call being run is available through
+// toolCallFrom.
+type toolMiddleware func(next toolFunc) toolFunc
+
+// useMiddleware wraps every tool in mw, the first outermost. Nil entries
+// are skipped.
+func useMiddleware(tools []toolDef, mw ...toolMiddleware) []toolDef {
+	for i := range tools {
+		for j := len(mw) - 1; j >= 0; j-- {
+			if mw[j] != nil {
+				tools[i].fn = mw[j](tools[i].fn)
+			}
+		}
+	}
+	return tools
+}
+
+type toolCallKey struct{}
+
+func withToolCall(ctx context.Context, call toolCall) context.Context {
+	return context.WithValue(ctx, toolCallKey{}, call)
+}
+
+// toolCallFrom returns the tool call being run.
+func toolCallFrom(ctx context.Context) (toolCall, bool) {
+	call, ok := ctx.Value(toolCallKey{}).(toolCall)
+	return call, ok
+}
+
 func findTool(tools []toolDef, name string) (toolDef, bool) {
 	for _, tool := range tools {
 		if tool.name == name {
@@ -281,54 +1382,147 @@ func findTool(tools []toolDef, name string) (toolDef, bool) {
 	return toolDef{}, false
 }
 
-func defaultTools() []toolDef {
-	return []toolDef{
+// defaultTools returns the built-in tools. They work on the workspace
+// through workspaceFS, so the same tools serve local and -remote sessions.
+func defaultTools(cfg *agentConfig, sess *session) []toolDef {
+	tools := []toolDef{
 		{
 			name:        "view",
 			description: "Read file contents",
-			params:      "  - path: string (file path)",
-			fn:          toolView,
+			params: []toolParam{
+				required("path", "string", "file path"),
+			},
+			fn: toolView,
 		},
 		{
 			name:        "glob",
-			description: "List files by glob pattern",
-			params:      "  - pattern: string (glob pattern)\n  - path: string (optional base directory)",
-			fn:          toolGlob,
+			description: "List files by glob pattern, with size and modification time",
+			params: []toolParam{
+				required("pattern", "string", "glob pattern"),
+				optional("path", "string", "base directory"),
+				optional("sort", "string", "mtime and size sort newest and largest first").oneOf("name", "mtime", "size").withDefault("name"),
+				optional("limit", "integer", "maximum results; 0 for all"),
+			},
+			fn: toolGlob,
 		},
 		{
 			name:        "grep",
-			description: "Search file contents for a string",
-			params:      "  - pattern: string (substring)\n  - path: string (optional file or directory)",
-			fn:          toolGrep,
+			description: "Search file contents for a string; matches are grouped by file, densest files first",
+			params: []toolParam{
+				required("pattern", "string", "substring"),
+				optional("path", "string", "file or directory"),
+				optional("max_per_file", "integer", "matches shown per file").withDefault(defaultGrepPerFile),
+				optional("max_results", "integer", "stop searching after this many matches in total").withDefault(defaultGrepMaxResults),
+			},
+			fn: toolGrep,
+		},
+		{
+			name:        "tabular_preview",
+			description: "Preview a CSV, TSV, or Parquet file: schema, row count, and first/last rows",
+			params: []toolParam{
+				required("path", "string", "file path"),
+				optional("rows", "integer", "rows to show from each end").withDefault(5),
+				optional("format", "string", "inferred from extension").oneOf("csv", "tsv", "parquet"),
+			},
+			fn: toolTabularPreview,
+		},
+		{
+			name:        "tasks",
+			description: "List the project's Makefile targets, justfile recipes, package.json scripts, and Taskfile tasks with their descriptions",
+			params: []toolParam{
+				optional("path", "string", "directory holding the task files"),
+			},
+			fn: toolTasks,
 		},
 		{
 			name:        "write",
 			description: "Create or overwrite a file",
-			params:      "  - path: string (file path)\n  - content: string",
-			fn:          toolWrite,
+			params: []toolParam{
+				required("path", "string", "file path"),
+				required("content", "string", ""),
+			},
+			fn: toolWrite,
 		},
 		{
 			name:        "edit",
 			description: "Edit a file by replacing text",
-			params:      "  - path: string (file path)\n  - search: string\n  - replace: string",
-			fn:          toolEdit,
+			params: []toolParam{
+				required("path", "string", "file path"),
+				required("search", "string", ""),
+				required("replace", "string", ""),
+			},
+			fn: toolEdit,
 		},
 		{
 			name:        "bash",
 			description: "Run a shell command",
-			params:      "  - command: string",
-			fn:          toolBash,
+			params: []toolParam{
+				required("command", "string", ""),
+			},
+			fn: toolBash,
 		},
 	}
+
+	tools = append(tools, dockerTools(cfg, sess)...)
+	tools = append(tools, terraformTools(sess)...)
+	tools = append(tools, goTools(sess)...)
+	if sess.remote != nil {
+		tools = sess.remote.bind(tools)
+	}
+	tools = append(tools, serviceTools(cfg, sess)...)
+	return withBashGuards(cfg, sess, tools)
 }
 
-func toolView(_ context.Context, cwd string, args map[string]any) (string, error) {
+// serviceTools returns tools that talk to external services rather than the
+// workspace, so they are available for local and remote sessions alike.
+func serviceTools(cfg *agentConfig, sess *session) []toolDef {
+	var tools []toolDef
+	tools = append(tools, kubeTools(cfg)...)
+	tools = append(tools, openAPITools(cfg, sess)...)
+
+	if conns := sqlConnections(cfg); len(conns) > 0 {
+		names := make([]string, 0, len(conns))
+		for name := range conns {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tools = append(tools, toolDef{
+			name:        "sql_query",
+			description: "Run a SQL query against a configured database (read-only unless configured otherwise). Connections: " + strings.Join(names, ", "),
+			params: []toolParam{
+				required("query", "string", "SQL statement"),
+				optional("connection", "string", "connection name"),
+				optional("max_rows", "integer", "row cap"),
+			},
+			fn: newSQLTool(cfg),
+		})
+	}
+
+	return tools
+}
+
+func withBashGuards(cfg *agentConfig, sess *session, tools []toolDef) []toolDef {
+	_, terraform := findTool(tools, "terraform_apply")
+	for i := range tools {
+		if tools[i].name == "bash" {
+			if terraform {
+				tools[i].fn = guardTerraformBash(sess, tools[i].fn)
+			}
+			if !cfg.Kubernetes.AllowWrites {
+				tools[i].fn = guardKubectlBash(sess, tools[i].fn)
+			}
+		}
+	}
+	return tools
+}
+
+func toolView(ctx context.Context, cwd string, args map[string]any) (string, error) {
 	path, ok := argString(args, "path")
 	if !ok {
 		return "", errors.New("view: missing path")
 	}
 	full := resolvePath(cwd, path)
-	data, err := os.ReadFile(full)
+	data, err := workspaceFSFrom(ctx).ReadFile(ctx, full)
 	if err != nil {
 		return "", err
 	}
@@ -338,7 +1532,7 @@ func toolView(_ context.Context, cwd string, args map[string]any) (string, error
 	return string(data), nil
 }
 
-func toolGlob(_ context.Context, cwd string, args map[string]any) (string, error) {
+func toolGlob(ctx context.Context, cwd string, args map[string]any) (string, error) {
 	pattern, ok := argString(args, "pattern")
 	if !ok {
 		return "", errors.New("glob: missing pattern")
@@ -348,17 +1542,16 @@ func toolGlob(_ context.Context, cwd string, args map[string]any) (string, error
 		base = resolvePath(cwd, path)
 	}
 
-	matches, err := doublestar.Glob(os.DirFS(base), pattern)
+	entries, err := globWalk(ctx, workspaceFSFrom(ctx), base, pattern, ignoreRulesFrom(ctx).hidden)
 	if err != nil {
 		return "", err
 	}
-	if len(matches) == 0 {
-		return "(no matches)", nil
-	}
-	return strings.Join(matches, "\n"), nil
+	sortBy, _ := argString(args, "sort")
+	limit, _ := argInt(args, "limit")
+	return formatGlob(entries, sortBy, limit), nil
 }
 
-func toolGrep(_ context.Context, cwd string, args map[string]any) (string, error) {
+func toolGrep(ctx context.Context, cwd string, args map[string]any) (string, error) {
 	pattern, ok := argString(args, "pattern")
 	if !ok {
 		return "", errors.New("grep: missing pattern")
@@ -367,64 +1560,23 @@ func toolGrep(_ context.Context, cwd string, args map[string]any) (string, error
 	if path, ok := argString(args, "path"); ok && path != "" {
 		base = resolvePath(cwd, path)
 	}
-
-	info, err := os.Stat(base)
-	if err != nil {
-		return "", err
+	perFile, _ := argInt(args, "max_per_file")
+	if perFile <= 0 {
+		perFile = defaultGrepPerFile
 	}
-
-	var results []string
-	if info.IsDir() {
-		err = filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if d.IsDir() {
-				return nil
-			}
-			if strings.HasPrefix(d.Name(), ".") {
-				return nil
-			}
-			content, err := os.ReadFile(path)
-			if err != nil {
-				return nil
-			}
-			if len(content) > maxFileBytes {
-				content = content[:maxFileBytes]
-			}
-			for i, line := range strings.Split(string(content), "\n") {
-				if strings.Contains(line, pattern) {
-					rel, _ := filepath.Rel(base, path)
-					results = append(results, fmt.Sprintf("%s:%d:%s", rel, i+1, strings.TrimSpace(line)))
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			return "", err
-		}
-	} else {
-		content, err := os.ReadFile(base)
-		if err != nil {
-			return "", err
-		}
-		if len(content) > maxFileBytes {
-			content = content[:maxFileBytes]
-		}
-		for i, line := range strings.Split(string(content), "\n") {
-			if strings.Contains(line, pattern) {
-				results = append(results, fmt.Sprintf("%s:%d:%s", filepath.Base(base), i+1, strings.TrimSpace(line)))
-			}
-		}
+	maxResults, _ := argInt(args, "max_results")
+	if maxResults <= 0 {
+		maxResults = defaultGrepMaxResults
 	}
 
-	if len(results) == 0 {
-		return "(no matches)", nil
+	res, err := grepLocal(ctx, base, []byte(pattern), perFile, maxResults)
+	if err != nil {
+		return "", err
 	}
-	return strings.Join(results, "\n"), nil
+	return formatGrep(res, perFile), nil
 }
 
-func toolWrite(_ context.Context, cwd string, args map[string]any) (string, error) {
+func toolWrite(ctx context.Context, cwd string, args map[string]any) (string, error) {
 	path, ok := argString(args, "path")
 	if !ok {
 		return "", errors.New("write: missing path")
@@ -434,16 +1586,17 @@ func toolWrite(_ context.Context, cwd string, args map[string]any) (string, erro
 		return "", errors.New("write: missing content")
 	}
 	full := resolvePath(cwd, path)
-	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+	before, err := workspaceFSFrom(ctx).ReadFile(ctx, full)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return "", err
 	}
-	if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+	if err := workspaceFSFrom(ctx).WriteFile(ctx, full, []byte(content)); err != nil {
 		return "", err
 	}
-	return "ok", nil
+	return writeReport(ctx, cwd, full, "", string(before), []byte(content))
 }
 
-func toolEdit(_ context.Context, cwd string, args map[string]any) (string, error) {
+func toolEdit(ctx context.Context, cwd string, args map[string]any) (string, error) {
 	path, ok := argString(args, "path")
 	if !ok {
 		return "", errors.New("edit: missing path")
@@ -457,19 +1610,18 @@ func toolEdit(_ context.Context, cwd string, args map[string]any) (string, error
 		return "", errors.New("edit: missing replace")
 	}
 	full := resolvePath(cwd, path)
-	content, err := os.ReadFile(full)
+	content, err := workspaceFSFrom(ctx).ReadFile(ctx, full)
 	if err != nil {
 		return "", err
 	}
-	text := string(content)
-	if !strings.Contains(text, search) {
-		return "", errors.New("edit: search text not found")
+	updated, note, err := applyEdit(string(content), search, replace)
+	if err != nil {
+		return "", err
 	}
-	updated := strings.ReplaceAll(text, search, replace)
-	if err := os.WriteFile(full, []byte(updated), 0o644); err != nil {
+	if err := workspaceFSFrom(ctx).WriteFile(ctx, full, []byte(updated)); err != nil {
 		return "", err
 	}
-	return "ok", nil
+	return writeReport(ctx, cwd, full, note, string(content), []byte(updated))
 }
 
 func toolBash(ctx context.Context, cwd string, args map[string]any) (string, error) {
@@ -480,13 +1632,13 @@ func toolBash(ctx context.Context, cwd string, args map[string]any) (string, err
 	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
 
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-Command", command)
-	} else {
-		cmd = exec.CommandContext(ctx, "bash", "-lc", command)
+	cmd, err := workspaceFSFrom(ctx).Shell(ctx, cwd, command)
+	if err != nil {
+		return "", err
+	}
+	if env := commandEnv(ctx); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
-	cmd.Dir = cwd
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return string(output), err
@@ -494,19 +1646,103 @@ func toolBash(ctx context.Context, cwd string, args map[string]any) (string, err
 	return string(output), nil
 }
 
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// optionalFloat is a float flag that distinguishes "not set" from zero.
+type optionalFloat struct {
+	value float64
+	set   bool
+}
+
+func (f *optionalFloat) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return strconv.FormatFloat(f.value, 'g', -1, 64)
+}
+
+func (f *optionalFloat) Set(s string) error {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	f.value, f.set = v, true
+	return nil
+}
+
+// or returns the flag value if set, otherwise fallback.
+func (f *optionalFloat) or(fallback *float64) *float64 {
+	if f.set {
+		v := f.value
+		return &v
+	}
+	return fallback
+}
+
+func firstNonZero(values ...int) int {
+	for _, v := range values {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+func firstPositive(values ...time.Duration) time.Duration {
+	for _, v := range values {
+		if v > 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+func truncateOutput(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return s[:limit] + fmt.Sprintf("\n... (truncated, %d bytes total)", len(s))
+}
+
 func argString(args map[string]any, key string) (string, bool) {
+	v, ok := args[key].(string)
+	return v, ok
+}
+
+func argBool(args map[string]any, key string) bool {
+	v, _ := args[key].(bool)
+	return v
+}
+
+func argInt(args map[string]any, key string) (int, bool) {
 	val, ok := args[key]
 	if !ok {
-		return "", false
+		return 0, false
 	}
 	switch v := val.(type) {
-	case string:
+	case float64:
+		return int(v), true
+	case int:
 		return v, true
-	case fmt.Stringer:
-		return v.String(), true
 	default:
-		return fmt.Sprintf("%v", v), true
+		return 0, false
+	}
+}
+
+// displayPath shows full relative to cwd when it lies inside it.
+func displayPath(cwd, full string) string {
+	rel, err := filepath.Rel(cwd, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(full)
 	}
+	return filepath.ToSlash(rel)
 }
 
 func resolvePath(cwd, path string) string {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"puzldai/pkg/agent"
+)
+
+func TestUseMiddlewareOrderAndCall(t *testing.T) {
+	var order []string
+	tag := func(name string) toolMiddleware {
+		return func(next toolFunc) toolFunc {
+			return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+				call, _ := toolCallFrom(ctx)
+				order = append(order, name+":"+call.name+"/"+call.id)
+				return next(ctx, cwd, args)
+			}
+		}
+	}
+	tools := useMiddleware([]toolDef{{
+		name: "echo",
+		params: []toolParam{
+			required("text", "string", ""),
+		},
+		fn: func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			text, _ := argString(args, "text")
+			order = append(order, "tool")
+			return text, nil
+		},
+	}}, tag("outer"), nil, tag("inner"))
+
+	results := runTools(context.Background(), t.TempDir(), tools, []toolCall{{id: "c1", name: "echo", arguments: map[string]any{"text": "hi"}}})
+	if len(results) != 1 || results[0].isError || !strings.Contains(results[0].content, "hi") {
+		t.Fatalf("results = %+v", results)
+	}
+	if got, want := strings.Join(order, " "), "outer:echo/c1 inner:echo/c1 tool"; got != want {
+		t.Errorf("order = %q, want %q", got, want)
+	}
+}
+
+func TestOutcomeErrorCode(t *testing.T) {
+	tests := []struct {
+		outcome  agentOutcome
+		refusals int
+		want     string
+	}{
+		{agentOutcome{Status: outcomeSuccess}, 0, ""},
+		{agentOutcome{Status: outcomeBlocked}, 0, ""},
+		{agentOutcome{Status: outcomeBlocked}, 1, "policy_violation"},
+		{agentOutcome{Status: outcomeChangeLimit}, 0, "policy_violation"},
+		{agentOutcome{Status: outcomeStalled}, 0, "stalled"},
+	}
+	for _, tt := range tests {
+		if got := agent.Code(runFailure(tt.outcome, tt.refusals, nil)); got != tt.want {
+			t.Errorf("%s with %d refusals: code %q, want %q", tt.outcome.Status, tt.refusals, got, tt.want)
+		}
+	}
+	outcome, _ := providerFailure(context.Background(), errors.New("connection refused"))
+	if outcome.Error != "provider_unavailable" {
+		t.Errorf("provider failure code = %q", outcome.Error)
+	}
+}
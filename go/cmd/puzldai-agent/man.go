@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const manUsage = "usage: puzldai-agent man [-dir dir]"
+
+const manDescription = `puzldai-agent works on a task, read from stdin or given by -task or
+-task-file, with a language model that calls tools to read, search, edit,
+and run code in the working directory, and prints its final answer. This is
+the run command, which is also the default; the other commands build on it
+or manage its state.`
+
+// runMan implements the man subcommand: it prints the puzldai-agent(1) man
+// page, or with -dir, writes it and a page per command, puzldai-agent-<command>(1).
+func runMan(args []string) int {
+	fs := newFlagSet("man")
+	dirFlag := fs.String("dir", "", "Write puzldai-agent.1 and a puzldai-agent-<command>.1 page per command to this directory instead of puzldai-agent.1 to stdout")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, manUsage)
+		return exitUsage
+	}
+	page := manPage(nil, globalFlagList())
+	if *dirFlag == "" {
+		fmt.Print(page)
+		return exitOK
+	}
+	if err := os.MkdirAll(*dirFlag, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, "man:", err)
+		return exitError
+	}
+	pages := map[string]string{"puzldai-agent.1": page}
+	for _, cmd := range commands {
+		pages["puzldai-agent-"+cmd.name+".1"] = manPage(cmd, commandFlags(cmd))
+	}
+	for name, page := range pages {
+		if err := os.WriteFile(filepath.Join(*dirFlag, name), []byte(page), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "man:", err)
+			return exitError
+		}
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d man pages to %s\n", len(pages), *dirFlag)
+	return exitOK
+}
+
+// roff escapes text for a man page.
+func roff(text string) string {
+	text = strings.ReplaceAll(text, `\`, `\e`)
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[i] = `\&` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// manPage is the page of cmd, or of puzldai-agent itself, with the global
+// flags, when cmd is nil.
+func manPage(cmd *command, flags []*flag.Flag) string {
+	name, summary, lines := "puzldai-agent", "run a coding agent on a task", synopsis(cliUsage)
+	if cmd != nil {
+		name, summary, lines = "puzldai-agent-"+cmd.name, cmd.summary, synopsis(cmd.usage)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, ".TH %s 1 \"\" puzldai-agent \"User Commands\"\n", strings.ToUpper(name))
+	fmt.Fprintf(&b, ".SH NAME\n%s \\- %s\n", name, roff(summary))
+	b.WriteString(".SH SYNOPSIS\n.nf\n")
+	for _, line := range lines {
+		b.WriteString(roff(strings.TrimSpace(line)) + "\n")
+	}
+	b.WriteString(".fi\n")
+	if cmd == nil {
+		fmt.Fprintf(&b, ".SH DESCRIPTION\n%s\n", roff(manDescription))
+		b.WriteString(".SH COMMANDS\n")
+		for _, c := range commands {
+			fmt.Fprintf(&b, ".TP\n.B %s\n%s.\n", c.name, roff(c.summary))
+		}
+	}
+	if len(flags) > 0 {
+		if cmd == nil {
+			b.WriteString(".SH GLOBAL OPTIONS\nThese come before the command, and set the environment variables named.\n")
+		} else {
+			b.WriteString(".SH OPTIONS\n")
+		}
+		for _, f := range flags {
+			value, usage := flag.UnquoteUsage(f)
+			fmt.Fprintf(&b, ".TP\n\\fB\\-%s\\fR", f.Name)
+			if value != "" {
+				fmt.Fprintf(&b, " \\fI%s\\fR", value)
+			}
+			b.WriteString("\n" + roff(usage))
+			if !slices.Contains([]string{"", "0", "0s", "false", "[]"}, f.DefValue) && !strings.Contains(usage, "(default") {
+				fmt.Fprintf(&b, " (default %s)", roff(f.DefValue))
+			}
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString(".SH SEE ALSO\n")
+	if cmd == nil {
+		var refs []string
+		for _, c := range commands {
+			refs = append(refs, "\\fBpuzldai-agent-"+c.name+"\\fR(1)")
+		}
+		b.WriteString(strings.Join(refs, ",\n") + "\n")
+	} else {
+		b.WriteString("\\fBpuzldai-agent\\fR(1)\n")
+	}
+	return b.String()
+}
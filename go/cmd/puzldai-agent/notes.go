@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxNotesBytes = 50_000
+
+// notesPath is the session's scratchpad, kept next to its transcript so it
+// survives -resume.
+func notesPath(id string) (string, error) {
+	path, err := sessionPath(id)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(path, ".json") + ".notes.md", nil
+}
+
+// noteTool gives the model a scratchpad outside the transcript. Notes are
+// only sent when the model reads them, so they cost nothing per turn.
+func noteTool(sess *session) toolDef {
+	return toolDef{
+		name:        "note",
+		description: "Session scratchpad for findings, plans, and facts worth keeping; persists for the whole session and across resumes",
+		params: []toolParam{
+			required("action", "string", "").oneOf("append", "read", "replace"),
+			optional("text", "string", "note text for append, or the full new scratchpad for replace"),
+		},
+		fn: func(_ context.Context, _ string, args map[string]any) (string, error) {
+			path, err := notesPath(sess.id)
+			if err != nil {
+				return "", err
+			}
+			action, _ := argString(args, "action")
+			text, _ := argString(args, "text")
+			current, err := readPrivate(path)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+
+			switch action {
+			case "read":
+				if len(current) == 0 {
+					return "(no notes yet)", nil
+				}
+				return string(current), nil
+			case "append":
+				if strings.TrimSpace(text) == "" {
+					return "", errors.New("note: append needs text")
+				}
+				text = strings.TrimRight(string(current)+strings.TrimSpace(text), "\n") + "\n\n"
+			case "replace":
+				text = strings.TrimSpace(text) + "\n"
+			}
+			if len(text) > maxNotesBytes {
+				return "", fmt.Errorf("note: scratchpad would be %d bytes (limit %d); read it and replace it with a condensed version", len(text), maxNotesBytes)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+				return "", err
+			}
+			if err := writePrivate(path, []byte(text)); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("ok (%d bytes of notes)", len(text)), nil
+		},
+	}
+}
+
+// notesInstructions points the model at the scratchpad, and at any notes
+// left by an earlier run of a resumed session.
+func notesInstructions(id string) string {
+	var sb strings.Builder
+	sb.WriteString("\n\n# Notes\n\nUse the note tool to record findings, decisions, and open questions as you go. ")
+	sb.WriteString("Notes are kept outside the conversation and survive when older turns are dropped; read them back when you need them.")
+	if path, err := notesPath(id); err == nil {
+		if data, err := readPrivate(path); err == nil && len(data) > 0 {
+			fmt.Fprintf(&sb, " The scratchpad already holds %d bytes of notes from earlier in this session; read them before starting.", len(data))
+		}
+	}
+	return sb.String()
+}
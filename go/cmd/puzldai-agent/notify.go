@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	notifyTimeout       = 10 * time.Second
+	maxNotifyTaskBytes  = 200
+	maxNotifySummary    = 4000
+	maxNotifyBodyLength = 200
+)
+
+// notifier tells an operator who is not watching the terminal that the run
+// finished or is waiting for an approval or an answer: with a desktop
+// notification (-notify) and a JSON POST to a webhook (-webhook-url). A nil
+// notifier does nothing. Failures are reported on stderr and never affect
+// the run.
+type notifier struct {
+	desktop bool
+	webhook string
+	session string
+	cwd     string
+	task    string
+	client  *http.Client
+}
+
+// notifyEvent is the webhook payload.
+type notifyEvent struct {
+	// Event is finished, approval, or question.
+	Event      string    `json:"event"`
+	Session    string    `json:"session,omitempty"`
+	Cwd        string    `json:"cwd"`
+	Task       string    `json:"task"`
+	Status     string    `json:"status,omitempty"`
+	Summary    string    `json:"summary"`
+	Iterations int       `json:"iterations,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+func newNotifier(desktop bool, webhook, session, cwd, task string) *notifier {
+	if !desktop && webhook == "" {
+		return nil
+	}
+	task, _, _ = strings.Cut(strings.TrimSpace(task), "\n")
+	return &notifier{
+		desktop: desktop,
+		webhook: webhook,
+		session: session,
+		cwd:     cwd,
+		task:    truncateOutput(task, maxNotifyTaskBytes),
+		client:  &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+func (n *notifier) finished(outcome agentOutcome) {
+	n.send(notifyEvent{Event: "finished", Status: outcome.Status, Summary: outcome.Summary, Iterations: outcome.Iterations},
+		"puzldai: "+outcome.Status)
+}
+
+func (n *notifier) approval(summary string) {
+	n.send(notifyEvent{Event: "approval", Summary: summary}, "puzldai needs approval")
+}
+
+func (n *notifier) question(question string) {
+	n.send(notifyEvent{Event: "question", Summary: question}, "puzldai has a question")
+}
+
+func (n *notifier) send(ev notifyEvent, title string) {
+	if n == nil {
+		return
+	}
+	ev.Session, ev.Cwd, ev.Task, ev.Time = n.session, n.cwd, n.task, time.Now().UTC()
+	ev.Summary = truncateOutput(strings.TrimSpace(ev.Summary), maxNotifySummary)
+	if n.desktop {
+		body, _, _ := strings.Cut(ev.Summary, "\n")
+		if len(body) > maxNotifyBodyLength {
+			body = body[:maxNotifyBodyLength] + "..."
+		}
+		if err := desktopNotify(title, firstNonEmpty(body, n.task)); err != nil {
+			fmt.Fprintln(os.Stderr, "notify:", err)
+		}
+	}
+	if n.webhook != "" {
+		if err := n.post(ev); err != nil {
+			fmt.Fprintln(os.Stderr, "webhook:", err)
+		}
+	}
+}
+
+func (n *notifier) post(ev notifyEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", n.webhook, resp.Status)
+	}
+	return nil
+}
+
+// desktopNotify shows a notification with the platform's own tooling:
+// osascript on macOS, a tray balloon through PowerShell on Windows, and
+// notify-send elsewhere. Title and body are passed as arguments or
+// environment, never spliced into a script.
+func desktopNotify(title, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.CommandContext(ctx, "osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title, body).Run()
+	case "windows":
+		// The balloon disappears with the PowerShell process, so it is
+		// started detached instead of waited for.
+		cmd := exec.Command("powershell", "-NoProfile", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; $n = New-Object System.Windows.Forms.NotifyIcon; "+
+				"$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; "+
+				"$n.ShowBalloonTip(10000, $env:PUZLDAI_NOTIFY_TITLE, $env:PUZLDAI_NOTIFY_BODY, 'Info'); "+
+				"Start-Sleep -Seconds 10; $n.Dispose()")
+		cmd.Env = append(os.Environ(), "PUZLDAI_NOTIFY_TITLE="+title, "PUZLDAI_NOTIFY_BODY="+body)
+		return cmd.Start()
+	default:
+		return exec.CommandContext(ctx, "notify-send", "--app-name=puzldai", title, body).Run()
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcTimeout = 15 * time.Second
+	// oidcKeyTTL is how long the issuer's signing keys are cached; a token
+	// signed with an unknown key refetches them, at most every
+	// oidcRefetchDelay.
+	oidcKeyTTL       = time.Hour
+	oidcRefetchDelay = time.Minute
+	oidcClockSkew    = time.Minute
+)
+
+// oidcVerifier checks ID tokens from one OpenID Connect issuer, such as
+// GitHub Actions (https://token.actions.githubusercontent.com) or a
+// company's identity provider, against the issuer's published keys.
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// oidcClaims are the claims serve checks and maps to tenants.
+type oidcClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	Expires   int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+func newOIDCVerifier(issuer, audience string) *oidcVerifier {
+	return &oidcVerifier{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		client:   &http.Client{Timeout: oidcTimeout},
+	}
+}
+
+// looksLikeJWT tells ID tokens from opaque bearer tokens.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// verify checks the token's signature, issuer, audience, and lifetime, and
+// returns its subject.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("token signature: %w", err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+
+	var claims oidcClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("token claims: %w", err)
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != v.issuer:
+		return "", fmt.Errorf("token issued by %q, not %q", claims.Issuer, v.issuer)
+	case !claims.hasAudience(v.audience):
+		return "", fmt.Errorf("token is not for audience %q", v.audience)
+	case claims.Expires == 0:
+		return "", errors.New("token has no expiry")
+	case now.Add(-oidcClockSkew).Unix() >= claims.Expires:
+		return "", errors.New("token expired")
+	case claims.NotBefore != 0 && now.Add(oidcClockSkew).Unix() < claims.NotBefore:
+		return "", errors.New("token not valid yet")
+	case claims.Subject == "":
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// hasAudience reports whether aud, a string or a list, names audience.
+func (c *oidcClaims) hasAudience(audience string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	return json.Unmarshal(c.Audience, &many) == nil && slices.Contains(many, audience)
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+			return errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		// The signature is r and s, each the size of the curve.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size ||
+			!ecdsa.Verify(key, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return errors.New("invalid token signature")
+	}
+	return nil
+}
+
+// key returns the issuer's signing key kid, fetching the key set when it
+// is stale or does not hold kid.
+func (v *oidcVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetched) > oidcKeyTTL
+	if ok && !stale {
+		return key, nil
+	}
+	if stale || time.Since(v.fetched) > oidcRefetchDelay {
+		keys, err := v.fetchKeys(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fetching the keys of %s: %w", v.issuer, err)
+		}
+		v.keys, v.fetched = keys, time.Now()
+	}
+	if key, ok = v.keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys reads the issuer's JWKS through its discovery document.
+func (v *oidcVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if _, err := callJSON(ctx, v.client, http.MethodGet, v.issuer+"/.well-known/openid-configuration", nil, nil, &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("no jwks_uri in the discovery document")
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if _, err := callJSON(ctx, v.client, http.MethodGet, discovery.JWKSURI, nil, nil, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	num := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, e := num(k.N), num(k.E)
+			if n != nil && e != nil && e.IsInt64() {
+				keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+			}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			x, y := num(k.X), num(k.Y)
+			if curve, ok := curves[k.Crv]; ok && x != nil && y != nil {
+				keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
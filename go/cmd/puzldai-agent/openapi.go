@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const apiCallTimeout = 30 * time.Second
+const maxAPIResponseBytes = 50_000
+const maxListedOperations = 60
+
+type openAPIConfig struct {
+	Spec          string            `toml:"spec"`
+	BaseURL       string            `toml:"base_url"`
+	Headers       map[string]string `toml:"headers"`
+	AuthHeaderEnv string            `toml:"auth_header_env"`
+}
+
+type apiOperation struct {
+	method   string
+	template string
+	pattern  *regexp.Regexp
+	names    []string
+	op       map[string]any
+	params   []map[string]any
+}
+
+type apiClient struct {
+	cfg        openAPIConfig
+	spec       map[string]any
+	baseURL    string
+	operations []apiOperation
+	approver   *approver
+	http       *http.Client
+}
+
+var pathParamRe = regexp.MustCompile(`\{([^}/]+)\}`)
+
+func openAPITools(cfg *agentConfig, sess *session) []toolDef {
+	if cfg.OpenAPI.Spec == "" {
+		return nil
+	}
+	spec := cfg.OpenAPI
+	if !strings.Contains(spec.Spec, "://") {
+		spec.Spec = resolvePath(sess.cwd, spec.Spec)
+	}
+	client, err := newAPIClient(spec, sess)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "api_call disabled:", err)
+		return nil
+	}
+
+	var ops strings.Builder
+	for i, op := range client.operations {
+		if i == maxListedOperations {
+			fmt.Fprintf(&ops, "\n  ... %d more operations", len(client.operations)-i)
+			break
+		}
+		fmt.Fprintf(&ops, "\n  %s %s", strings.ToUpper(op.method), op.template)
+		if summary, _ := op.op["summary"].(string); summary != "" {
+			ops.WriteString(" - " + summary)
+		}
+	}
+	return []toolDef{{
+		name:        "api_call",
+		description: "Call the configured HTTP API at " + client.baseURL + ". Requests are validated against the OpenAPI spec before sending; POST, PUT, PATCH, and DELETE always require explicit operator approval. Operations:" + ops.String(),
+		params: []toolParam{
+			required("method", "string", "GET, POST, ..."),
+			required("path", "string", "concrete path, e.g. /users/42"),
+			optional("query", "object", "query parameters"),
+			optional("headers", "object", "extra headers"),
+			optional("body", "", "JSON body"),
+		},
+		fn: client.call,
+	}}
+}
+
+func newAPIClient(cfg openAPIConfig, sess *session) (*apiClient, error) {
+	client, err := newAPIHTTPClient(sess)
+	if err != nil {
+		return nil, err
+	}
+	data, err := loadSpecSource(client, cfg.Spec)
+	if err != nil {
+		return nil, err
+	}
+	var spec map[string]any
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", cfg.Spec, err)
+	}
+
+	c := &apiClient{cfg: cfg, spec: spec, approver: sess.approver, http: client}
+	c.baseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if c.baseURL == "" {
+		c.baseURL = specBaseURL(spec)
+	}
+	if c.baseURL == "" {
+		return nil, errors.New("no base_url configured and the spec declares no server")
+	}
+
+	paths, _ := spec["paths"].(map[string]any)
+	templates := make([]string, 0, len(paths))
+	for template := range paths {
+		templates = append(templates, template)
+	}
+	sort.Strings(templates)
+	for _, template := range templates {
+		item, _ := paths[template].(map[string]any)
+		shared := asMapSlice(item["parameters"])
+		pattern, names := compilePathTemplate(template)
+		for _, method := range []string{"get", "put", "post", "delete", "options", "head", "patch"} {
+			op, ok := item[method].(map[string]any)
+			if !ok {
+				continue
+			}
+			params := append(append([]map[string]any{}, shared...), asMapSlice(op["parameters"])...)
+			for i, p := range params {
+				if resolved, ok := c.resolve(p).(map[string]any); ok {
+					params[i] = resolved
+				}
+			}
+			c.operations = append(c.operations, apiOperation{
+				method: method, template: template, pattern: pattern, names: names, op: op, params: params,
+			})
+		}
+	}
+	return c, nil
+}
+
+// newAPIHTTPClient returns the client for the spec and the API calls. It
+// goes through the session's proxy and CA settings, and the egress policy
+// when one is set.
+func newAPIHTTPClient(sess *session) (*http.Client, error) {
+	settings := sess.transport
+	settings.requestTimeout = apiCallTimeout
+	client, err := newHTTPClient(settings)
+	if err != nil {
+		return nil, err
+	}
+	if sess.egress != nil {
+		client.Transport = &egressTransport{policy: sess.egress, next: client.Transport}
+	}
+	return client, nil
+}
+
+func loadSpecSource(client *http.Client, source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetch %s: %s", source, resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	}
+	return os.ReadFile(source)
+}
+
+// specBaseURL derives the base URL from OpenAPI 3 servers or Swagger 2 host/basePath.
+func specBaseURL(spec map[string]any) string {
+	if servers := asMapSlice(spec["servers"]); len(servers) > 0 {
+		if u, _ := servers[0]["url"].(string); u != "" {
+			return strings.TrimRight(u, "/")
+		}
+	}
+	host, _ := spec["host"].(string)
+	if host == "" {
+		return ""
+	}
+	scheme := "https"
+	if schemes, ok := spec["schemes"].([]any); ok && len(schemes) > 0 {
+		if s, ok := schemes[0].(string); ok {
+			scheme = s
+		}
+	}
+	basePath, _ := spec["basePath"].(string)
+	return strings.TrimRight(scheme+"://"+host+basePath, "/")
+}
+
+func compilePathTemplate(template string) (*regexp.Regexp, []string) {
+	var names []string
+	var sb strings.Builder
+	sb.WriteString("^")
+	last := 0
+	for _, loc := range pathParamRe.FindAllStringSubmatchIndex(template, -1) {
+		sb.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		sb.WriteString("([^/]+)")
+		names = append(names, template[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(template[last:]))
+	sb.WriteString("/?$")
+	return regexp.MustCompile(sb.String()), names
+}
+
+// expandPathTemplate fills in the parameters of a path template, escaped
+// so that each stays one segment.
+func expandPathTemplate(template string, values map[string]string) string {
+	return pathParamRe.ReplaceAllStringFunc(template, func(param string) string {
+		return url.PathEscape(values[param[1:len(param)-1]])
+	})
+}
+
+func (c *apiClient) call(ctx context.Context, _ string, args map[string]any) (string, error) {
+	method, _ := argString(args, "method")
+	method = strings.ToLower(method)
+	if method == "" {
+		method = "get"
+	}
+	path, _ := argString(args, "path")
+	if path == "" {
+		return "", errors.New("api_call: missing path")
+	}
+	query, _ := args["query"].(map[string]any)
+	headers, _ := args["headers"].(map[string]any)
+	body, hasBody := args["body"]
+
+	op, pathValues, err := c.match(method, path)
+	if err != nil {
+		return "", err
+	}
+	if errs := c.validate(op, pathValues, query, headers, body, hasBody); len(errs) > 0 {
+		return "", fmt.Errorf("api_call: request does not match the spec for %s %s:\n- %s",
+			strings.ToUpper(op.method), op.template, strings.Join(errs, "\n- "))
+	}
+
+	// The request goes to the operation's own path, so a parameter cannot
+	// reach another one.
+	path = expandPathTemplate(op.template, pathValues)
+	if method != "get" && method != "head" && method != "options" {
+		approved, reason := c.approver.approve(fmt.Sprintf("api_call: %s %s%s", strings.ToUpper(method), c.baseURL, path), true)
+		if !approved {
+			return "", policyErrorf("api_call: %s", reason)
+		}
+	}
+	return c.send(ctx, method, path, query, headers, body, hasBody)
+}
+
+func (c *apiClient) match(method, path string) (apiOperation, map[string]string, error) {
+	var allowed []string
+	for _, op := range c.operations {
+		m := op.pattern.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		if op.method != method {
+			allowed = append(allowed, strings.ToUpper(op.method))
+			continue
+		}
+		values := make(map[string]string, len(op.names))
+		for i, name := range op.names {
+			v, err := url.PathUnescape(m[i+1])
+			if err != nil {
+				v = m[i+1]
+			}
+			if v == "." || v == ".." {
+				return apiOperation{}, nil, fmt.Errorf("api_call: path parameter %q may not be %q", name, v)
+			}
+			values[name] = v
+		}
+		return op, values, nil
+	}
+	if len(allowed) > 0 {
+		return apiOperation{}, nil, fmt.Errorf("api_call: %s not allowed on %s (spec allows %s)", strings.ToUpper(method), path, strings.Join(allowed, ", "))
+	}
+	return apiOperation{}, nil, fmt.Errorf("api_call: no operation in the spec matches path %s", path)
+}
+
+func (c *apiClient) validate(op apiOperation, pathValues map[string]string, query, headers map[string]any, body any, hasBody bool) []string {
+	var errs []string
+	known := map[string]bool{}
+	for _, p := range op.params {
+		name, _ := p["name"].(string)
+		in, _ := p["in"].(string)
+		required, _ := p["required"].(bool)
+		schema := c.paramSchema(p)
+
+		var value any
+		var present bool
+		switch in {
+		case "path":
+			var s string
+			s, present = pathValues[name]
+			value = s
+		case "query":
+			known[name] = true
+			value, present = query[name]
+		case "header":
+			value, present = lookupHeader(headers, name)
+		case "body":
+			if required && !hasBody {
+				errs = append(errs, "body is required")
+			}
+			if hasBody {
+				c.validateSchema(schema, body, "body", &errs)
+			}
+			continue
+		default:
+			continue
+		}
+		if !present {
+			if required {
+				errs = append(errs, fmt.Sprintf("missing required %s parameter %q", in, name))
+			}
+			continue
+		}
+		if s, ok := value.(string); ok {
+			value = coerceParam(schema, s)
+		}
+		c.validateSchema(schema, value, in+" parameter "+name, &errs)
+	}
+	for name := range query {
+		if !known[name] {
+			errs = append(errs, fmt.Sprintf("unknown query parameter %q", name))
+		}
+	}
+
+	if rb, ok := c.resolve(op.op["requestBody"]).(map[string]any); ok {
+		required, _ := rb["required"].(bool)
+		if required && !hasBody {
+			errs = append(errs, "request body is required")
+		}
+		if hasBody {
+			content, _ := rb["content"].(map[string]any)
+			if media, ok := content["application/json"].(map[string]any); ok {
+				c.validateSchema(media["schema"], body, "body", &errs)
+			}
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+func (c *apiClient) paramSchema(p map[string]any) any {
+	if schema, ok := p["schema"]; ok {
+		return schema
+	}
+	// Swagger 2 puts the type directly on non-body parameters.
+	return p
+}
+
+func lookupHeader(headers map[string]any, name string) (any, bool) {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// coerceParam converts a string path/header value to the schema's scalar type
+// so it can be validated like a JSON value.
+func coerceParam(schema any, value string) any {
+	s, _ := schema.(map[string]any)
+	switch s["type"] {
+	case "integer":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return float64(n)
+		}
+	case "number":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+func (c *apiClient) resolve(v any) any {
+	return schemaValidator{c.spec}.resolve(v)
+}
+
+func (c *apiClient) validateSchema(schema, value any, at string, errs *[]string) {
+	schemaValidator{c.spec}.validate(schema, value, at, errs)
+}
+
+func (c *apiClient) send(ctx context.Context, method, path string, query, headers map[string]any, body any, hasBody bool) (string, error) {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		values := url.Values{}
+		for k, v := range query {
+			if list, ok := v.([]any); ok {
+				for _, item := range list {
+					values.Add(k, fmt.Sprint(item))
+				}
+				continue
+			}
+			values.Set(k, fmt.Sprint(v))
+		}
+		target += "?" + values.Encode()
+	}
+
+	var reader io.Reader
+	if hasBody {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return "", fmt.Errorf("api_call: encode body: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), target, reader)
+	if err != nil {
+		return "", fmt.Errorf("api_call: %w", err)
+	}
+	if hasBody {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range c.cfg.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	if c.cfg.AuthHeaderEnv != "" {
+		if token := os.Getenv(c.cfg.AuthHeaderEnv); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	for k, v := range headers {
+		req.Header.Set(k, fmt.Sprint(v))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("api_call: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIResponseBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("api_call: read response: %w", err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s\n", resp.Proto, resp.Status)
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		fmt.Fprintf(&sb, "Content-Type: %s\n", ct)
+	}
+	sb.WriteString("\n")
+	if len(data) > maxAPIResponseBytes {
+		sb.Write(data[:maxAPIResponseBytes])
+		sb.WriteString("\n... (response truncated)")
+	} else {
+		sb.Write(data)
+	}
+	if resp.StatusCode >= 400 {
+		return "", errors.New(sb.String())
+	}
+	return sb.String(), nil
+}
+
+func asSlice(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
+
+func asMapSlice(v any) []map[string]any {
+	var out []map[string]any
+	for _, item := range asSlice(v) {
+		if m, ok := item.(map[string]any); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
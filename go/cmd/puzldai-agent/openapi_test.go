@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testSpec = `openapi: 3.0.0
+paths:
+  /items:
+    get:
+      summary: list items
+    post:
+      summary: create an item
+`
+
+func TestAPIClientUsesProxyAndApproval(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/spec.yaml" {
+			io.WriteString(w, testSpec)
+			return
+		}
+		io.WriteString(w, `{"method": "`+r.Method+`"}`)
+	}))
+	defer api.Close()
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		req, _ := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), r.Body)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer proxy.Close()
+
+	// Auto approval still asks for writes, and -ci leaves nobody to answer.
+	ciMode = true
+	defer func() { ciMode = false }()
+	approver, _ := newApprover(approvalAuto)
+	sess := newSession(t.TempDir(), approver)
+	sess.transport = transportSettings{proxy: proxy.URL}
+	client, err := newAPIClient(openAPIConfig{Spec: api.URL + "/spec.yaml", BaseURL: api.URL}, sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := client.call(context.Background(), "", map[string]any{"method": "GET", "path": "/items"})
+	if err != nil || !strings.Contains(out, "GET") {
+		t.Fatalf("GET /items = %q, %v", out, err)
+	}
+	_, err = client.call(context.Background(), "", map[string]any{"method": "POST", "path": "/items"})
+	var refused *policyError
+	if !errors.As(err, &refused) {
+		t.Fatalf("POST /items under -approval auto: err = %v, want a refusal", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := strings.Join(proxied, ", "), "GET /spec.yaml, GET /items"; got != want {
+		t.Errorf("proxied %q, want %q", got, want)
+	}
+}
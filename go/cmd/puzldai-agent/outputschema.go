@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// outputSchema makes the run end with a JSON value that conforms to a
+// caller-supplied JSON Schema, printed on stdout instead of prose. Once the
+// task is done the model gets one turn to produce the value and one retry
+// with the validation errors.
+// Validation uses the same JSON Schema subset as api_call.
+type outputSchema struct {
+	text    string
+	root    map[string]any
+	pending *agentOutcome
+	retried bool
+}
+
+func loadOutputSchema(path string) (*outputSchema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("output schema: %w", err)
+	}
+	var root map[string]any
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("output schema %s: %w", path, err)
+	}
+	var compact bytes.Buffer
+	if err := json.Indent(&compact, data, "", "  "); err != nil {
+		return nil, err
+	}
+	return &outputSchema{text: compact.String(), root: root}, nil
+}
+
+func (s *outputSchema) instructions() string {
+	return "\n\n# Output Schema\n\nThe caller needs a machine-readable result. When the task is complete, your last reply must be only a JSON value " +
+		"(no prose, no code fence) that conforms to this JSON Schema. If the finishing rules ask for a Result section or a finish call, " +
+		"do that first; you will then be asked for the JSON value.\n\n```json\n" + s.text + "\n```\n"
+}
+
+// request is sent once the loop has an outcome but the reply was not a
+// conforming value yet.
+func (s *outputSchema) request(outcome agentOutcome) string {
+	s.pending = &outcome
+	return "The task is complete. Reply now with only the JSON value for the result, conforming to the output schema in the system prompt. Do not call tools."
+}
+
+// check validates a reply and returns the compacted JSON. On a violation
+// it returns a note for the model while the retry is unused, and an error
+// once it is spent.
+func (s *outputSchema) check(text string) (string, string, error) {
+	result, err := s.validate(text)
+	if err == nil {
+		return result, "", nil
+	}
+	if s.retried {
+		return "", "", fmt.Errorf("final answer does not match the output schema: %w", err)
+	}
+	s.retried = true
+	return "", "Your reply does not conform to the output schema: " + err.Error() + ". Reply with only the corrected JSON value.", nil
+}
+
+func (s *outputSchema) validate(text string) (string, error) {
+	raw, err := extractJSON(text)
+	if err != nil {
+		return "", err
+	}
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", err
+	}
+	var problems []string
+	schemaValidator{s.root}.validate(s.root, value, "result", &problems)
+	if len(problems) > 0 {
+		return "", errors.New(strings.Join(problems, "; "))
+	}
+	var out bytes.Buffer
+	if err := json.Compact(&out, raw); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+var jsonFenceRe = regexp.MustCompile("(?s)^```[a-zA-Z]*\\s*\n(.*?)\n?```$")
+
+// extractJSON takes the JSON value out of a reply, tolerating a code fence
+// or a sentence around it.
+func extractJSON(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if m := jsonFenceRe.FindStringSubmatch(text); m != nil {
+		text = strings.TrimSpace(m[1])
+	}
+	if json.Valid([]byte(text)) {
+		return []byte(text), nil
+	}
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return nil, errors.New("the reply contains no JSON value")
+	}
+	dec := json.NewDecoder(strings.NewReader(text[start:]))
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return raw, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const parquetMagic = "PAR1"
+const maxParquetFooter = 64 << 20
+
+type parquetColumn struct {
+	name          string
+	physicalType  int
+	convertedType int
+	repetition    int
+}
+
+type parquetMeta struct {
+	numRows int64
+	columns []parquetColumn
+}
+
+var parquetPhysicalTypes = []string{"boolean", "int32", "int64", "int96", "float", "double", "binary", "fixed_len_byte_array"}
+
+var parquetConvertedTypes = map[int]string{
+	0: "utf8", 4: "enum", 5: "decimal", 6: "date", 7: "time_millis", 8: "time_micros",
+	9: "timestamp_millis", 10: "timestamp_micros", 11: "uint8", 12: "uint16", 13: "uint32",
+	14: "uint64", 15: "int8", 16: "int16", 17: "int32", 18: "int64", 19: "json", 20: "bson",
+	21: "interval",
+}
+
+func (c parquetColumn) typeName() string {
+	name := "group"
+	if c.physicalType >= 0 && c.physicalType < len(parquetPhysicalTypes) {
+		name = parquetPhysicalTypes[c.physicalType]
+	}
+	if conv, ok := parquetConvertedTypes[c.convertedType]; ok {
+		name += " (" + conv + ")"
+	}
+	switch c.repetition {
+	case 1:
+		name += " nullable"
+	case 2:
+		name += " repeated"
+	}
+	return name
+}
+
+// readParquetFile reads the metadata of a parquet file in the workspace.
+func readParquetFile(ctx context.Context, path string) (*parquetMeta, error) {
+	fsys := workspaceFSFrom(ctx)
+	info, err := fsys.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	return readParquetMeta(r, info.Size())
+}
+
+// readParquetMeta decodes the Thrift-compact FileMetaData footer of a file
+// of size bytes, keeping only the row count and the leaf columns of the
+// schema.
+func readParquetMeta(f io.ReaderAt, size int64) (*parquetMeta, error) {
+	if size < 12 {
+		return nil, errors.New("not a parquet file (too small)")
+	}
+	trailer := make([]byte, 8)
+	if _, err := f.ReadAt(trailer, size-8); err != nil {
+		return nil, err
+	}
+	if string(trailer[4:]) != parquetMagic {
+		return nil, errors.New("not a parquet file (missing PAR1 trailer)")
+	}
+	footerLen := int64(binary.LittleEndian.Uint32(trailer[:4]))
+	if footerLen <= 0 || footerLen > maxParquetFooter || footerLen > size-12 {
+		return nil, fmt.Errorf("invalid parquet footer length %d", footerLen)
+	}
+	footer := make([]byte, footerLen)
+	if _, err := f.ReadAt(footer, size-8-footerLen); err != nil {
+		return nil, err
+	}
+
+	d := &thriftDecoder{buf: footer}
+	fields, err := d.readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("decode parquet footer: %w", err)
+	}
+
+	meta := &parquetMeta{}
+	if v, ok := fields[3].(int64); ok {
+		meta.numRows = v
+	}
+	elems, _ := fields[2].([]any)
+	for i, elem := range elems {
+		el, ok := elem.(map[int16]any)
+		if !ok {
+			continue
+		}
+		// The first element is the schema root; groups carry num_children.
+		if i == 0 || el[5] != nil {
+			continue
+		}
+		col := parquetColumn{physicalType: -1, convertedType: -1}
+		if name, ok := el[4].([]byte); ok {
+			col.name = string(name)
+		}
+		if v, ok := el[1].(int64); ok {
+			col.physicalType = int(v)
+		}
+		if v, ok := el[3].(int64); ok {
+			col.repetition = int(v)
+		}
+		if v, ok := el[6].(int64); ok {
+			col.convertedType = int(v)
+		}
+		meta.columns = append(meta.columns, col)
+	}
+	return meta, nil
+}
+
+// thriftDecoder is a minimal Thrift compact-protocol reader producing generic
+// values: structs as map[int16]any, lists as []any, integers as int64.
+type thriftDecoder struct {
+	buf   []byte
+	pos   int
+	depth int
+}
+
+const (
+	thriftStop      = 0
+	thriftTrue      = 1
+	thriftFalse     = 2
+	thriftByte      = 3
+	thriftI16       = 4
+	thriftI32       = 5
+	thriftI64       = 6
+	thriftDouble    = 7
+	thriftBinary    = 8
+	thriftList      = 9
+	thriftSet       = 10
+	thriftMap       = 11
+	thriftStruct    = 12
+	maxThriftDepth  = 64
+	maxThriftLength = 1 << 26
+)
+
+func (d *thriftDecoder) readByte() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *thriftDecoder) readVarint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	d.pos += n
+	return v, nil
+}
+
+func (d *thriftDecoder) readZigzag() (int64, error) {
+	v, err := d.readVarint()
+	if err != nil {
+		return 0, err
+	}
+	return int64(v>>1) ^ -int64(v&1), nil
+}
+
+func (d *thriftDecoder) readStruct() (map[int16]any, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxThriftDepth {
+		return nil, errors.New("thrift nesting too deep")
+	}
+
+	fields := make(map[int16]any)
+	var lastID int16
+	for {
+		header, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		typ := header & 0x0f
+		if typ == thriftStop {
+			return fields, nil
+		}
+		id := lastID + int16(header>>4)
+		if header>>4 == 0 {
+			v, err := d.readZigzag()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		lastID = id
+
+		var val any
+		switch typ {
+		case thriftTrue:
+			val = true
+		case thriftFalse:
+			val = false
+		default:
+			val, err = d.readValue(typ)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fields[id] = val
+	}
+}
+
+func (d *thriftDecoder) readValue(typ byte) (any, error) {
+	switch typ {
+	case thriftTrue, thriftFalse:
+		b, err := d.readByte()
+		return b == thriftTrue, err
+	case thriftByte:
+		b, err := d.readByte()
+		return int64(int8(b)), err
+	case thriftI16, thriftI32, thriftI64:
+		return d.readZigzag()
+	case thriftDouble:
+		if d.pos+8 > len(d.buf) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(d.buf[d.pos:]))
+		d.pos += 8
+		return v, nil
+	case thriftBinary:
+		n, err := d.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		if n > maxThriftLength || d.pos+int(n) > len(d.buf) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := d.buf[d.pos : d.pos+int(n)]
+		d.pos += int(n)
+		return v, nil
+	case thriftList, thriftSet:
+		header, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = d.readVarint(); err != nil {
+				return nil, err
+			}
+		}
+		if size > maxThriftLength {
+			return nil, errors.New("thrift list too large")
+		}
+		items := make([]any, 0, min(size, 1024))
+		for i := uint64(0); i < size; i++ {
+			item, err := d.readValue(header & 0x0f)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case thriftMap:
+		size, err := d.readVarint()
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		types, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < size; i++ {
+			if _, err := d.readValue(types >> 4); err != nil {
+				return nil, err
+			}
+			if _, err := d.readValue(types & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case thriftStruct:
+		return d.readStruct()
+	default:
+		return nil, fmt.Errorf("unknown thrift type %d", typ)
+	}
+}
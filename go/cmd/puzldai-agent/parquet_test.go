@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parquetFooter is the Thrift-compact FileMetaData of a three-row file with
+// a required int32 "id" and a nullable utf8 "name".
+var parquetFooter = []byte{
+	0x15, 0x02, // version: 1
+	0x19, 0x3c, // schema: list of 3 structs
+	0x48, 0x06, 's', 'c', 'h', 'e', 'm', 'a', 0x15, 0x04, 0x00, // root, 2 children
+	0x15, 0x02, 0x25, 0x00, 0x18, 0x02, 'i', 'd', 0x00, // int32 required "id"
+	0x15, 0x0c, 0x25, 0x02, 0x18, 0x04, 'n', 'a', 'm', 'e', 0x25, 0x00, 0x00, // binary optional utf8 "name"
+	0x16, 0x06, // num_rows: 3
+	0x00,
+}
+
+// parquetFile wraps footer in a file with the given footer length field.
+func parquetFile(footer []byte, length uint32) []byte {
+	data := []byte(parquetMagic)
+	data = append(data, footer...)
+	data = binary.LittleEndian.AppendUint32(data, length)
+	return append(data, parquetMagic...)
+}
+
+func TestReadParquetMeta(t *testing.T) {
+	data := parquetFile(parquetFooter, uint32(len(parquetFooter)))
+	meta, err := readParquetMeta(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.numRows != 3 {
+		t.Errorf("numRows = %d, want 3", meta.numRows)
+	}
+	var got []string
+	for _, c := range meta.columns {
+		got = append(got, c.name+": "+c.typeName())
+	}
+	if want := "id: int32, name: binary (utf8) nullable"; strings.Join(got, ", ") != want {
+		t.Errorf("columns = %q, want %q", strings.Join(got, ", "), want)
+	}
+}
+
+func TestReadParquetMetaInvalid(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x1c}, maxThriftDepth+1) // field 1: struct, again and again
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"too small", []byte("PAR1PAR1"), "too small"},
+		{"no trailer", append(parquetFile(parquetFooter, uint32(len(parquetFooter)))[:len(parquetFooter)+8], "PAR2"...), "missing PAR1 trailer"},
+		{"zero footer length", parquetFile(parquetFooter, 0), "invalid parquet footer length 0"},
+		{"footer longer than file", parquetFile(parquetFooter, uint32(len(parquetFooter)+5)), "invalid parquet footer length"},
+		{"footer over the cap", parquetFile(parquetFooter, 0xffffffff), "invalid parquet footer length"},
+		{"truncated footer", parquetFile(parquetFooter[:10], 10), "unexpected EOF"},
+		{"missing stop", parquetFile(parquetFooter[:len(parquetFooter)-1], uint32(len(parquetFooter)-1)), "unexpected EOF"},
+		{"unknown type", parquetFile([]byte{0x1d, 0x00}, 2), "unknown thrift type 13"},
+		{"oversized binary", parquetFile([]byte{0x18, 0x80, 0x80, 0x80, 0x40, 0x00}, 6), "unexpected EOF"},
+		{"binary past the end", parquetFile([]byte{0x18, 0x10, 'x', 0x00}, 4), "unexpected EOF"},
+		{"oversized list", parquetFile([]byte{0x19, 0xf5, 0x80, 0x80, 0x80, 0x80, 0x08, 0x00}, 8), "thrift list too large"},
+		{"nesting too deep", parquetFile(nested, uint32(len(nested))), "thrift nesting too deep"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := readParquetMeta(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got %v, %v; want an error containing %q", meta, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadParquetFileOverlay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.parquet")
+	o := newOverlay(dir)
+	ctx := withWorkspaceFS(context.Background(), o)
+	if err := o.WriteFile(ctx, path, parquetFile(parquetFooter, uint32(len(parquetFooter)))); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := readParquetFile(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.numRows != 3 || len(meta.columns) != 2 {
+		t.Fatalf("got %d rows and %d columns, want 3 and 2", meta.numRows, len(meta.columns))
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+)
+
+const (
+	defaultPerfRounds        = 2
+	defaultBenchCount        = 6
+	defaultMaxRegressionPerc = 5.0
+	// maxBenchOutput bounds the benchmark output sent to the agent when the
+	// benchmarks fail to run.
+	maxBenchOutput = 4_000
+)
+
+// BenchmarkParse-8   	  100000	     10234 ns/op	  512 B/op	  4 allocs/op
+var benchLineRe = regexp.MustCompile(`^(Benchmark\S+)\s+\d+\s+(.+)$`)
+
+const perfInstructions = `You are making a performance change to a Go project. Benchmarks guard it:
+they ran before you start, and run again after you finish, and the change is
+rejected if any benchmark metric (time, bytes, or allocations per op) gets
+worse by more than the allowed regression. Keep the behavior the same and
+the tests passing; do not change or remove the benchmarks themselves.
+
+Measure before and after optimizing with the benchmark command below, and
+profile where it is not clear what is slow, keeping the profiles and test
+binaries out of the workspace (go test -cpuprofile /tmp/cpu.out -o /tmp/x.test).
+Finish with a short summary of what changed and the effect you measured.`
+
+// benchResults holds the samples of each benchmark metric, keyed by
+// "package benchmark" and then by unit.
+type benchResults map[string]map[string][]float64
+
+// benchDelta compares the median of one metric before and after a change.
+type benchDelta struct {
+	name, unit    string
+	before, after float64
+	// change is the relative change in percent, positive when worse.
+	change    float64
+	missing   bool
+	regressed bool
+}
+
+const perfUsage = `usage: puzldai-agent perf -bench regexp [-pkg packages] [-count n] [-max-regression percent] [-verify cmd] [-rounds n] [-apply] [-patch-out file] "task" [-- agent flags]`
+
+// runPerf implements the perf subcommand: the benchmarks run on a snapshot
+// of the workspace, an agent makes the change in a worktree of it, and the
+// benchmarks run again. Metrics that regress beyond -max-regression are sent
+// back to the agent, and the change is shown as a diff with the comparison
+// table to apply or leave.
+func runPerf(args []string) int {
+	fs := newFlagSet("perf")
+	cwdFlag := fs.String("cwd", "", "Workspace (default: the current directory)")
+	benchFlag := fs.String("bench", "", "Benchmarks to run, as a go test -bench regexp (required)")
+	pkgFlag := fs.String("pkg", "./...", "Packages holding the benchmarks, space-separated")
+	countFlag := fs.Int("count", defaultBenchCount, "Runs of each benchmark; the medians are compared")
+	maxRegressionFlag := fs.Float64("max-regression", defaultMaxRegressionPerc, "Largest allowed regression of any benchmark metric, in percent")
+	verifyFlag := fs.String("verify", "", "Shell command that must also pass after the change (default: config verify)")
+	roundsFlag := fs.Int("rounds", defaultPerfRounds, "Times the agent may retry while a benchmark regresses or the checks fail")
+	applyFlag := fs.Bool("apply", false, "Apply the change without asking if no benchmark regresses and the checks pass")
+	patchOutFlag := fs.String("patch-out", "", "Also write the diff to this file")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintln(os.Stderr, perfUsage)
+		return exitUsage
+	}
+	task := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if task == "" || *benchFlag == "" || *countFlag < 1 || *maxRegressionFlag < 0 {
+		fmt.Fprintln(os.Stderr, perfUsage)
+		return exitUsage
+	}
+	noColor = os.Getenv("NO_COLOR") != ""
+
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "perf:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+	if !inGoModule(context.Background(), diskFS{}, cwd) {
+		fmt.Fprintln(os.Stderr, "perf: the workspace is not in a Go module; only go test benchmarks are supported")
+		return exitError
+	}
+	cfg, err := loadConfig(cwd, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "perf: failed to load config:", err)
+		return exitError
+	}
+	verify := firstNonEmpty(*verifyFlag, cfg.Verify)
+	bench := benchCommand(*benchFlag, strings.Fields(*pkgFlag), *countFlag)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ws, err := newChildWorkspace(ctx, cwd, "perf")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "perf:", err)
+		return exitError
+	}
+	// The run happens in a temporary worktree; book it to this project.
+	os.Setenv(projectEnv, projectName(cwd))
+	var children []*childRun
+	defer func() { ws.removeWorktrees(children) }()
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "perf:", err)
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		return exitError
+	}
+
+	agent, err := ws.newChild(ctx, 1, "perf", "perf", "", ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	children = append(children, agent)
+
+	fmt.Fprintf(os.Stderr, "baseline: %s\n", bench)
+	beforeFile := filepath.Join(ws.work, "bench-before.txt")
+	before, out, err := runBenchmarks(ctx, agent.cwd, bench, beforeFile)
+	if err != nil {
+		return fail(fmt.Errorf("the benchmarks fail before any change: %w\n%s", err, out))
+	}
+	if len(before) == 0 {
+		return fail(fmt.Errorf("-bench %q matched no benchmarks in %s", *benchFlag, *pkgFlag))
+	}
+
+	var mu sync.Mutex
+	if err := ws.runAgent(ctx, agent, "perf", perfTask(task, bench, *maxRegressionFlag, before, verify), agentArgs, &mu); err != nil {
+		return fail(err)
+	}
+	afterFile := filepath.Join(ws.work, "bench-after.txt")
+	var deltas []benchDelta
+	var benchErr error
+	measure := func() {
+		agent.collect(ctx, ws.base, verify)
+		if agent.patch == "" {
+			return
+		}
+		var after benchResults
+		after, out, benchErr = runBenchmarks(ctx, agent.cwd, bench, afterFile)
+		deltas = compareBenchmarks(before, after, *maxRegressionFlag)
+	}
+	measure()
+	for round := 1; round <= *roundsFlag && agent.patch != ""; round++ {
+		checksFailed := agent.verified != nil && !*agent.verified
+		if benchErr == nil && !checksFailed && !anyRegressed(deltas) {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "benchmarks regress or checks fail; round %d of %d\n", round, *roundsFlag)
+		retry := perfRetryTask(task, bench, *maxRegressionFlag, deltas, benchErr, out, verify, agent)
+		if err := ws.runAgent(ctx, agent, fmt.Sprintf("perf-%d", round), retry, agentArgs, &mu); err != nil {
+			return fail(err)
+		}
+		measure()
+	}
+	if agent.patch == "" {
+		printAnswer(agent.answer)
+		return fail(fmt.Errorf("the agent changed no files"))
+	}
+
+	patchFile := filepath.Join(ws.work, "perf.patch")
+	if err := os.WriteFile(patchFile, []byte(agent.patch), 0o644); err != nil {
+		return fail(err)
+	}
+	if *patchOutFlag != "" {
+		if err := os.WriteFile(*patchOutFlag, []byte(agent.patch), 0o644); err != nil {
+			return fail(err)
+		}
+	}
+	if summary := strings.TrimSpace(agent.answer); summary != "" {
+		fmt.Fprintf(os.Stderr, "summary:\n%s\n\n", summary)
+	}
+	printPatch(agent.patch)
+	fmt.Fprintln(os.Stderr)
+
+	passed := benchErr == nil && !anyRegressed(deltas)
+	if benchErr != nil {
+		fmt.Fprintf(os.Stderr, "the benchmarks fail after the change: %v\n%s\n", benchErr, truncateOutput(strings.TrimSpace(out), maxVerifyOutput))
+	} else {
+		fmt.Fprint(os.Stderr, benchTable(deltas))
+		if table := benchstat(ctx, beforeFile, afterFile); table != "" {
+			fmt.Fprintf(os.Stderr, "\nbenchstat:\n%s", table)
+		}
+		if passed {
+			fmt.Fprintf(os.Stderr, "\nno metric regresses by more than %.1f%%\n", *maxRegressionFlag)
+		} else {
+			fmt.Fprintf(os.Stderr, "\nregressions beyond %.1f%%: %s\n", *maxRegressionFlag, strings.Join(regressions(deltas), ", "))
+		}
+	}
+	switch {
+	case agent.verified == nil:
+	case *agent.verified:
+		fmt.Fprintf(os.Stderr, "verification passed: %s\n", verify)
+	default:
+		passed = false
+		fmt.Fprintf(os.Stderr, "verification failed: %s\n%s\n", verify, strings.TrimSpace(agent.verifyLog))
+	}
+	fmt.Fprintf(os.Stderr, "benchmark output: %s, %s\n", beforeFile, afterFile)
+
+	applied, err := offerPatch(ctx, ws.root, patchFile, "change", passed, *applyFlag)
+	if err != nil {
+		return fail(err)
+	}
+	if !applied {
+		fmt.Fprintf(os.Stderr, "not applied; the patch is %s (git apply it from %s)\n", patchFile, ws.root)
+	}
+	if !passed {
+		return exitError
+	}
+	return exitOK
+}
+
+// benchCommand is the go test invocation that runs only the benchmarks.
+func benchCommand(bench string, pkgs []string, count int) string {
+	if len(pkgs) == 0 {
+		pkgs = []string{"./..."}
+	}
+	return fmt.Sprintf("go test -run '^$' -bench %s -benchmem -count %d %s", shellQuote(bench), count, strings.Join(pkgs, " "))
+}
+
+// runBenchmarks runs the benchmark command in dir, saves its output to file
+// for benchstat, and parses the results.
+func runBenchmarks(ctx context.Context, dir, command, file string) (benchResults, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if werr := os.WriteFile(file, out, 0o644); werr != nil && err == nil {
+		err = werr
+	}
+	output := string(out)
+	if len(output) > maxBenchOutput {
+		output = "..." + output[len(output)-maxBenchOutput:]
+	}
+	if err != nil {
+		return nil, output, err
+	}
+	return parseBenchmarks(string(out)), output, nil
+}
+
+// parseBenchmarks reads go test -bench output. Benchmarks are keyed by
+// package, so equal names in two packages stay apart.
+func parseBenchmarks(output string) benchResults {
+	results := benchResults{}
+	pkg := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if p, ok := strings.CutPrefix(line, "pkg: "); ok {
+			pkg = p
+			continue
+		}
+		m := benchLineRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		name := strings.TrimPrefix(m[1], "Benchmark")
+		if pkg != "" {
+			name = pkg + " " + name
+		}
+		fields := strings.Fields(m[2])
+		for i := 0; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				break
+			}
+			if results[name] == nil {
+				results[name] = map[string][]float64{}
+			}
+			results[name][fields[i+1]] = append(results[name][fields[i+1]], v)
+		}
+	}
+	return results
+}
+
+// compareBenchmarks compares the medians of every metric measured before.
+// A metric missing afterwards counts as a regression, as it can no longer
+// be checked.
+func compareBenchmarks(before, after benchResults, maxRegression float64) []benchDelta {
+	var deltas []benchDelta
+	for name, metrics := range before {
+		for unit, samples := range metrics {
+			d := benchDelta{name: name, unit: unit, before: median(samples)}
+			if got := after[name][unit]; len(got) == 0 {
+				d.missing, d.regressed = true, true
+			} else {
+				d.after = median(got)
+				d.change = relativeChange(d.before, d.after, unit)
+				d.regressed = d.change > maxRegression
+			}
+			deltas = append(deltas, d)
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		if deltas[i].name != deltas[j].name {
+			return deltas[i].name < deltas[j].name
+		}
+		return deltas[i].unit < deltas[j].unit
+	})
+	return deltas
+}
+
+// relativeChange is the change from before to after in percent, positive
+// when worse: rates such as MB/s are better higher, the rest lower.
+func relativeChange(before, after float64, unit string) float64 {
+	if before == 0 {
+		if after == 0 {
+			return 0
+		}
+		if strings.HasSuffix(unit, "/s") {
+			return math.Inf(-1)
+		}
+		return math.Inf(1)
+	}
+	change := (after - before) / before * 100
+	if strings.HasSuffix(unit, "/s") {
+		return -change
+	}
+	return change
+}
+
+func median(samples []float64) float64 {
+	s := append([]float64(nil), samples...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+func anyRegressed(deltas []benchDelta) bool {
+	for _, d := range deltas {
+		if d.regressed {
+			return true
+		}
+	}
+	return false
+}
+
+func regressions(deltas []benchDelta) []string {
+	var names []string
+	for _, d := range deltas {
+		if d.regressed {
+			names = append(names, d.name+" "+d.unit)
+		}
+	}
+	return names
+}
+
+// benchTable renders the comparison of medians, marking regressions.
+func benchTable(deltas []benchDelta) string {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BENCHMARK\tMETRIC\tBEFORE\tAFTER\tCHANGE")
+	for _, d := range deltas {
+		after, change := "-", "missing"
+		if !d.missing {
+			after = strconv.FormatFloat(d.after, 'g', 6, 64)
+			// Shown as measured, so a faster time reads as a decrease.
+			change = fmt.Sprintf("%+.1f%%", d.change)
+			if strings.HasSuffix(d.unit, "/s") {
+				change = fmt.Sprintf("%+.1f%%", -d.change)
+			}
+		}
+		if d.regressed {
+			change += "  REGRESSION"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.name, d.unit, strconv.FormatFloat(d.before, 'g', 6, 64), after, change)
+	}
+	w.Flush()
+	return sb.String()
+}
+
+// benchstat compares the saved outputs with benchstat when it is installed;
+// it adds confidence intervals and significance to the medians.
+func benchstat(ctx context.Context, before, after string) string {
+	if _, err := exec.LookPath("benchstat"); err != nil {
+		return ""
+	}
+	out, err := exec.CommandContext(ctx, "benchstat", before, after).Output()
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+// baselineTable lists the medians measured before the change.
+func baselineTable(before benchResults) string {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	for _, d := range compareBenchmarks(before, before, 0) {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.name, d.unit, strconv.FormatFloat(d.before, 'g', 6, 64))
+	}
+	w.Flush()
+	return sb.String()
+}
+
+func perfTask(task, bench string, maxRegression float64, before benchResults, verify string) string {
+	var sb strings.Builder
+	sb.WriteString(perfInstructions + "\n\n## Task\n\n" + task + "\n\n")
+	fmt.Fprintf(&sb, "## Benchmarks\n\nCommand: `%s`\nAllowed regression of any metric: %.1f%%\n\nBaseline medians:\n```\n%s```\n", bench, maxRegression, baselineTable(before))
+	if verify != "" {
+		sb.WriteString("\n`" + verify + "` must also pass.\n")
+	}
+	return sb.String()
+}
+
+func perfRetryTask(task, bench string, maxRegression float64, deltas []benchDelta, benchErr error, out, verify string, c *childRun) string {
+	var sb strings.Builder
+	sb.WriteString("You are continuing a performance change; your edits so far are in the workspace. ")
+	sb.WriteString("Fix what is listed below, keeping the improvement where you can, then finish with a short summary of what changed and the effect measured.\n\n")
+	sb.WriteString("## Task\n\n" + task + "\n\n")
+	if benchErr != nil {
+		sb.WriteString("## Benchmarks fail\n\n`" + bench + "` fails:\n```\n" + strings.TrimSpace(out) + "\n```\n\n")
+	} else if anyRegressed(deltas) {
+		fmt.Fprintf(&sb, "## Regressions\n\nThese metrics are worse than the baseline by more than %.1f%% (`%s`):\n```\n%s```\n\n", maxRegression, bench, benchTable(deltas))
+	}
+	if c.verified != nil && !*c.verified {
+		sb.WriteString("## Failing check\n\n`" + verify + "` fails:\n```\n" + strings.TrimSpace(c.verifyLog) + "\n```\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Path jail levels.
+const (
+	jailOff    = "off"
+	jailWrites = "writes"
+	jailAll    = "all"
+)
+
+// Bash policies.
+const (
+	bashAllow   = "allow"
+	bashApprove = "approve"
+	bashDeny    = "deny"
+)
+
+// permissionProfile bundles the safety settings an operator would otherwise
+// have to combine by hand.
+type permissionProfile struct {
+	name     string
+	jail     string // which path arguments must stay inside the workspace
+	bash     string // whether shell commands run, need approval, or are unavailable
+	network  bool   // tools that reach other systems, and networked bash commands
+	approval string // default approval mode for gated actions
+}
+
+var permissionPresets = map[string]permissionProfile{
+	"trusted":   {name: "trusted", jail: jailOff, bash: bashAllow, network: true, approval: approvalAuto},
+	"default":   {name: "default", jail: jailWrites, bash: bashAllow, network: true, approval: approvalPrompt},
+	"untrusted": {name: "untrusted", jail: jailAll, bash: bashDeny, network: false, approval: approvalDeny},
+}
+
+// networkTools reach services outside the workspace.
+var networkTools = map[string]bool{
+	"api_call": true, "sql_query": true,
+	"kubectl_get": true, "kubectl_logs": true, "kubectl_describe": true, "kubectl_apply": true,
+	"docker_build": true, "docker_run": true, "docker_logs": true,
+	"terraform_plan": true, "terraform_apply": true,
+}
+
+// pathArgs lists the path-like arguments of each file tool, and whether the
+// tool writes through them.
+var pathArgs = map[string]struct {
+	arg   string
+	write bool
+}{
+	"view": {"path", false}, "glob": {"path", false}, "grep": {"path", false},
+	"tabular_preview": {"path", false}, "tasks": {"path", false}, "write": {"path", true}, "edit": {"path", true},
+	"go_add_import": {"path", true}, "ast_edit": {"package", true}, "retest": {"package", false},
+}
+
+// networkCommandRe spots common networked commands in bash. It is a
+// best-effort guard against accidental egress, not a sandbox.
+var networkCommandRe = regexp.MustCompile(`(?:^|[\s;&|(` + "`" + `])(?:curl|wget|ssh|scp|sftp|rsync|nc|ncat|telnet|ftp|git\s+(?:clone|fetch|pull|push|ls-remote)|(?:npm|pnpm|yarn|bun)\s+(?:install|add|i)\b|pip3?\s+install|go\s+(?:get|install|mod\s+download)|cargo\s+(?:install|fetch))\b`)
+
+func permissionNames() string {
+	names := make([]string, 0, len(permissionPresets))
+	for name := range permissionPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func lookupPermissions(name string) (*permissionProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := permissionPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown permissions %q (available: %s)", name, permissionNames())
+	}
+	return &p, nil
+}
+
+// apply filters and wraps tools according to the profile. Remote tools
+// already confine paths to the remote root.
+func (p *permissionProfile) apply(sess *session, roots []string, tools []toolDef) []toolDef {
+	out := make([]toolDef, 0, len(tools))
+	for _, t := range tools {
+		switch {
+		case !p.network && networkTools[t.name]:
+			continue
+		case t.name == "bash" && p.bash == bashDeny:
+			continue
+		case t.name == "bash":
+			t.fn = p.guardBash(sess, t.fn)
+		}
+		if spec, ok := pathArgs[t.name]; ok && sess.remote == nil &&
+			(p.jail == jailAll || (p.jail == jailWrites && spec.write)) {
+			t.fn = p.jailPath(roots, spec.arg, t.fn)
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+func (p *permissionProfile) guardBash(sess *session, next toolFunc) toolFunc {
+	return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+		command, _ := argString(args, "command")
+		if !p.network && networkCommandRe.MatchString(command) {
+			return "", policyErrorf("bash: network access is disabled (permissions: %s)", p.name)
+		}
+		if p.bash == bashApprove {
+			if ok, reason := sess.approver.approve("bash: "+command, true); !ok {
+				return "", policyErrorf("bash: %s", reason)
+			}
+		}
+		return next(ctx, cwd, args)
+	}
+}
+
+func (p *permissionProfile) jailPath(roots []string, arg string, next toolFunc) toolFunc {
+	return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+		if path, ok := argString(args, arg); ok && path != "" {
+			full := resolvePath(cwd, path)
+			inside := false
+			for _, root := range roots {
+				inside = inside || insideDir(root, full)
+			}
+			if !inside {
+				return "", policyErrorf("path %q is outside the workspace (permissions: %s)", path, p.name)
+			}
+		}
+		return next(ctx, cwd, args)
+	}
+}
+
+// insideDir reports whether path is dir or below it once symlinks are
+// resolved. A path that does not exist yet is checked through its nearest
+// existing parent.
+func insideDir(dir, path string) bool {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	resolved, rest := filepath.Clean(path), ""
+	for {
+		real, err := filepath.EvalSymlinks(resolved)
+		if err == nil {
+			resolved = filepath.Join(real, rest)
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return false
+		}
+		parent := filepath.Dir(resolved)
+		if parent == resolved {
+			return false
+		}
+		rest = filepath.Join(filepath.Base(resolved), rest)
+		resolved = parent
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
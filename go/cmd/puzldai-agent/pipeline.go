@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultMaxCoders = 4
+
+var jsonBlockRe = regexp.MustCompile("(?s)```json\\s*\\n(.*?)\\n```")
+
+// pipelineConfig selects a model per role; empty means the main model.
+type pipelineConfig struct {
+	ArchitectModel string `toml:"architect_model"`
+	CoderModel     string `toml:"coder_model"`
+	TesterModel    string `toml:"tester_model"`
+	MaxCoders      int    `toml:"max_coders"`
+}
+
+// pipelineState is the shared task state, rewritten to state.json in the
+// scratch directory after every stage and summarized into each role's task.
+type pipelineState struct {
+	Task     string         `json:"task"`
+	Stage    string         `json:"stage"`
+	Design   string         `json:"design,omitempty"`
+	Units    []pipelineUnit `json:"units,omitempty"`
+	Verified *bool          `json:"verified,omitempty"`
+	Result   string         `json:"result,omitempty"`
+	Updated  time.Time      `json:"updated"`
+}
+
+type pipelineUnit struct {
+	Name         string   `json:"name"`
+	Files        []string `json:"files,omitempty"`
+	Instructions string   `json:"instructions"`
+	Status       string   `json:"status,omitempty"`
+	Summary      string   `json:"summary,omitempty"`
+}
+
+type pipelineOptions struct {
+	config   pipelineConfig
+	verify   string
+	parallel bool
+	cwd      string
+	task     string
+	// finish records the final outcome.
+	finish func(agentOutcome)
+}
+
+const architectInstructions = `You are the architect in a team of agents. Do not modify any files.
+Explore the workspace, then design a solution to the task below and split the
+implementation into independent units that separate coders can build in
+parallel without touching the same files.
+
+End your reply with a JSON block in exactly this shape:
+` + "```json" + `
+{"design": "the design, for the coders and tester",
+ "units": [{"name": "short-name", "files": ["paths this unit owns"], "instructions": "what to build"}]}
+` + "```"
+
+// runPipeline coordinates an architect, parallel coders in separate
+// worktrees, and a tester that integrates and verifies their work; the
+// tested result is applied to the workspace.
+func runPipeline(opts pipelineOptions, model string) int {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ws, err := newChildWorkspace(ctx, opts.cwd, "pipeline")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-pipeline:", err)
+		return exitError
+	}
+	state := &pipelineState{Task: opts.task, Stage: "design"}
+	var children []*childRun
+	defer func() { ws.removeWorktrees(children) }()
+	var mu sync.Mutex
+
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "-pipeline:", err)
+		state.Stage, state.Result = "failed", err.Error()
+		ws.saveState(state)
+		outcome, code := agentOutcome{Status: outcomeError, Summary: err.Error()}, exitError
+		if ctx.Err() != nil {
+			outcome.Status, code = outcomeCancelled, exitCancelled
+		}
+		opts.finish(outcome)
+		return code
+	}
+
+	architect, err := ws.newChild(ctx, 0, "architect", "architect", firstNonEmpty(opts.config.ArchitectModel, model), ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	children = append(children, architect)
+	if err := ws.runChild(ctx, architect, architectInstructions+"\n\n## Task\n\n"+opts.task, &mu); err != nil {
+		return fail(err)
+	}
+	state.Design, state.Units = parseDesign(architect.answer, opts.task)
+	fmt.Fprintf(os.Stderr, "architect planned %d unit(s)\n", len(state.Units))
+	state.Stage = "implement"
+	ws.saveState(state)
+
+	maxCoders := opts.config.MaxCoders
+	if maxCoders <= 0 {
+		maxCoders = defaultMaxCoders
+	}
+	if !opts.parallel {
+		maxCoders = 1
+	}
+	coders := make([]*childRun, len(state.Units))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxCoders)
+	for i := range state.Units {
+		unit := &state.Units[i]
+		coder, err := ws.newChild(ctx, i+1, fmt.Sprintf("coder-%d", i+1), "coder "+unit.Name, firstNonEmpty(opts.config.CoderModel, model), ws.base)
+		if err != nil {
+			return fail(err)
+		}
+		children = append(children, coder)
+		coders[i] = coder
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := ws.runChild(ctx, coder, coderTask(state, unit), &mu); err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] %v\n", coder.label, err)
+			}
+			coder.collect(ctx, ws.base, "")
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return fail(ctx.Err())
+	}
+
+	// Integrate the coders' patches in plan order on a fresh worktree.
+	tester, err := ws.newChild(ctx, 0, "integration", "tester", firstNonEmpty(opts.config.TesterModel, model), ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	children = append(children, tester)
+	for i, coder := range coders {
+		unit := &state.Units[i]
+		unit.Summary = truncateOutput(strings.TrimSpace(coder.answer), maxJudgeAnswerBytes)
+		patchFile := filepath.Join(ws.work, fmt.Sprintf("coder-%d.patch", i+1))
+		switch {
+		case coder.patch == "":
+			unit.Status = "no changes"
+		case os.WriteFile(patchFile, []byte(coder.patch), 0o644) != nil:
+			unit.Status = "failed"
+		default:
+			if _, err := runGit(ctx, tester.dir, "apply", "--3way", "--whitespace=nowarn", patchFile); err != nil {
+				unit.Status = "conflict: " + err.Error()
+			} else {
+				unit.Status = "integrated"
+			}
+		}
+		fmt.Fprintf(os.Stderr, "unit %s: %s\n", unit.Name, unit.Status)
+	}
+	state.Stage = "test"
+	ws.saveState(state)
+
+	if err := ws.runChild(ctx, tester, testerTask(state, opts.verify), &mu); err != nil {
+		return fail(err)
+	}
+	tester.collect(ctx, ws.base, opts.verify)
+	state.Verified = tester.verified
+	state.Result = strings.TrimSpace(tester.answer)
+	state.Stage = "done"
+	ws.saveState(state)
+
+	if tester.verified != nil && !*tester.verified {
+		fmt.Fprintf(os.Stderr, "verification failed after testing:\n%s\n", tester.verifyLog)
+	}
+	if tester.patch != "" {
+		patchFile := filepath.Join(ws.work, "result.patch")
+		if err := os.WriteFile(patchFile, []byte(tester.patch), 0o644); err != nil {
+			return fail(err)
+		}
+		if _, err := runGit(ctx, ws.root, "apply", "--binary", "--whitespace=nowarn", patchFile); err != nil {
+			return fail(fmt.Errorf("applying %s: %w", patchFile, err))
+		}
+		fmt.Fprintf(os.Stderr, "applied the integrated result to %s; state and patches are in %s\n", ws.root, ws.work)
+	}
+	outcome := tester.outcome
+	if tester.verified != nil && !*tester.verified {
+		outcome.Status = outcomeBlocked
+	}
+	opts.finish(outcome)
+	printAnswer(tester.answer)
+	if tester.verified != nil && !*tester.verified {
+		return exitError
+	}
+	return tester.exitCode
+}
+
+// runChild writes the child's task and runs it to completion.
+func (w *childWorkspace) runChild(ctx context.Context, c *childRun, task string, mu *sync.Mutex) error {
+	name := strings.TrimSuffix(filepath.Base(c.outcomeFile), ".json")
+	taskFile, err := w.writeTask(name, task)
+	if err != nil {
+		return err
+	}
+	c.run(ctx, w.exe, c.args(taskFile), mu)
+	return nil
+}
+
+func (w *childWorkspace) saveState(state *pipelineState) {
+	state.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(w.work, "state.json"), data, 0o600)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to save pipeline state:", err)
+	}
+}
+
+// parseDesign reads the architect's JSON plan. Without a usable plan the
+// whole task becomes a single unit, with the architect's reply as design.
+func parseDesign(answer, task string) (string, []pipelineUnit) {
+	matches := jsonBlockRe.FindAllStringSubmatch(answer, -1)
+	if len(matches) > 0 {
+		var plan struct {
+			Design string         `json:"design"`
+			Units  []pipelineUnit `json:"units"`
+		}
+		if err := json.Unmarshal([]byte(matches[len(matches)-1][1]), &plan); err == nil && len(plan.Units) > 0 {
+			for i := range plan.Units {
+				if plan.Units[i].Name == "" {
+					plan.Units[i].Name = fmt.Sprintf("unit-%d", i+1)
+				}
+			}
+			return plan.Design, plan.Units
+		}
+	}
+	fmt.Fprintln(os.Stderr, "architect gave no usable plan; using a single unit")
+	return strings.TrimSpace(answer), []pipelineUnit{{Name: "all", Instructions: task}}
+}
+
+func coderTask(state *pipelineState, unit *pipelineUnit) string {
+	var sb strings.Builder
+	sb.WriteString("You are a coder in a team of agents. Implement only your unit of the design below; ")
+	sb.WriteString("other coders build the other units in parallel and a tester integrates the results.\n\n")
+	sb.WriteString("## Task\n\n" + state.Task + "\n\n## Design\n\n" + state.Design + "\n\n")
+	sb.WriteString("## Your unit: " + unit.Name + "\n\n" + unit.Instructions + "\n")
+	if len(unit.Files) > 0 {
+		sb.WriteString("\nFiles you own (change no others): " + strings.Join(unit.Files, ", ") + "\n")
+	}
+	sb.WriteString("\n## Other units\n\n")
+	for _, u := range state.Units {
+		if u.Name != unit.Name {
+			sb.WriteString("- " + u.Name + ": " + strings.Join(u.Files, ", ") + "\n")
+		}
+	}
+	return sb.String()
+}
+
+func testerTask(state *pipelineState, verify string) string {
+	var sb strings.Builder
+	sb.WriteString("You are the tester in a team of agents. The coders' work has been merged into this workspace. ")
+	sb.WriteString("Check it against the task and design, run the tests, and fix integration problems, ")
+	sb.WriteString("conflict markers, and failing tests with minimal changes. Finish with a summary of what was built and how it was verified.\n\n")
+	sb.WriteString("## Task\n\n" + state.Task + "\n\n## Design\n\n" + state.Design + "\n\n## Units\n\n")
+	for _, u := range state.Units {
+		fmt.Fprintf(&sb, "### %s (%s)\n\n%s\n\n", u.Name, u.Status, firstNonEmpty(u.Summary, "(no summary)"))
+	}
+	if verify != "" {
+		sb.WriteString("## Verification\n\nThe result must pass: `" + verify + "`\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// policyEnv points at a policy file that adds restrictions to the system
+// one; serve sets it for its tenants. It cannot lift any restriction of the
+// system file.
+const policyEnv = "PUZLDAI_POLICY"
+
+// orgPolicy holds controls an administrator sets for every run on a
+// machine. Flags, config files, profiles, and permission presets can only
+// tighten them: nothing a user passes loosens a policy setting.
+type orgPolicy struct {
+	path string
+
+	// Bash is approve (every command needs a human answer, even with
+	// -approval auto) or deny (the tool is removed).
+	Bash string `toml:"bash,omitempty"`
+	// BannedPaths are .puzldaiignore-style patterns hidden from the file
+	// tools. Relative patterns apply in every workspace root; absolute and
+	// ~/ patterns apply anywhere.
+	BannedPaths []string `toml:"banned_paths,omitempty"`
+	// AllowedProviders and AllowedModels, when set, list what may be used;
+	// models are glob patterns such as "claude-*".
+	AllowedProviders []string `toml:"allowed_providers,omitempty"`
+	AllowedModels    []string `toml:"allowed_models,omitempty"`
+	// TelemetryEndpoints, when set, are the URL prefixes run data may be
+	// sent to (-webhook-url, -telemetry); DisableTelemetry forbids sending
+	// it at all.
+	TelemetryEndpoints []string `toml:"telemetry_endpoints,omitempty"`
+	DisableTelemetry   bool     `toml:"disable_telemetry,omitempty"`
+}
+
+// defaultPolicyPath is /etc/puzldai/policy.toml, or
+// %ProgramData%\puzldai\policy.toml on Windows.
+func defaultPolicyPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(firstNonEmpty(os.Getenv("ProgramData"), `C:\ProgramData`), "puzldai", "policy.toml")
+	}
+	return "/etc/puzldai/policy.toml"
+}
+
+// loadOrgPolicy reads the system policy file, restricted further by the
+// PUZLDAI_POLICY file when that is set. It returns nil when there is
+// neither. The system file always applies, so a user cannot drop it by
+// pointing PUZLDAI_POLICY elsewhere.
+func loadOrgPolicy() (*orgPolicy, error) {
+	p, err := readPolicyFile(defaultPolicyPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		p, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	path := os.Getenv(policyEnv)
+	if path == "" {
+		return p, nil
+	}
+	extra, err := readPolicyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return extra, nil
+	}
+	return p.narrow(extra)
+}
+
+// readPolicyFile reads one policy file. Unknown keys are errors: a
+// misspelled control must not silently stop being enforced.
+func readPolicyFile(path string) (*orgPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &orgPolicy{path: path}
+	md, err := toml.Decode(string(data), p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		sort.Strings(keys)
+		return nil, fmt.Errorf("%s: unknown settings %s", path, strings.Join(keys, ", "))
+	}
+	switch p.Bash {
+	case "", bashApprove, bashDeny:
+	default:
+		return nil, fmt.Errorf("%s: invalid bash %q (approve, deny)", path, p.Bash)
+	}
+	for _, pattern := range append(append([]string{}, p.AllowedModels...), p.BannedPaths...) {
+		if !doublestar.ValidatePattern(strings.Trim(pattern, "/")) {
+			return nil, fmt.Errorf("%s: invalid pattern %q", path, pattern)
+		}
+	}
+	return p, nil
+}
+
+// checkModel refuses a provider or model the policy does not allow.
+func (p *orgPolicy) checkModel(providerName, model string) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.AllowedProviders) > 0 && !slices.Contains(p.AllowedProviders, providerName) {
+		return policyErrorf("provider %q is not allowed by %s (allowed: %s)", providerName, p.path, strings.Join(p.AllowedProviders, ", "))
+	}
+	if len(p.AllowedModels) == 0 {
+		return nil
+	}
+	for _, pattern := range p.AllowedModels {
+		if ok, _ := path.Match(pattern, model); ok {
+			return nil
+		}
+	}
+	return policyErrorf("model %q is not allowed by %s (allowed: %s)", model, p.path, strings.Join(p.AllowedModels, ", "))
+}
+
+// checkEndpoint refuses sending run data to url.
+func (p *orgPolicy) checkEndpoint(url string) error {
+	if p == nil || url == "" {
+		return nil
+	}
+	if p.DisableTelemetry {
+		return policyErrorf("sending run data to %s is disabled by %s", url, p.path)
+	}
+	if len(p.TelemetryEndpoints) == 0 {
+		return nil
+	}
+	for _, allowed := range p.TelemetryEndpoints {
+		if endpointAllowed(allowed, url) {
+			return nil
+		}
+	}
+	return policyErrorf("%s is not an allowed endpoint in %s (allowed: %s)", url, p.path, strings.Join(p.TelemetryEndpoints, ", "))
+}
+
+// policyProvider checks the model of every request, which covers the
+// reviewer, judge, and pipeline models as well as the main one.
+type policyProvider struct {
+	next   provider
+	name   string
+	policy *orgPolicy
+}
+
+func (p *orgPolicy) guardProvider(next provider, providerName string) provider {
+	if p == nil || (len(p.AllowedProviders) == 0 && len(p.AllowedModels) == 0) {
+		return next
+	}
+	return &policyProvider{next: next, name: providerName, policy: p}
+}
+
+func (g *policyProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	if err := g.policy.checkModel(g.name, req.model); err != nil {
+		return nil, err
+	}
+	return g.next.complete(ctx, req)
+}
+
+// apply removes bash or makes every command wait for an explicit approval.
+func (p *orgPolicy) apply(sess *session, tools []toolDef) []toolDef {
+	if p == nil || p.Bash == "" {
+		return tools
+	}
+	out := make([]toolDef, 0, len(tools))
+	for _, t := range tools {
+		if t.name == "bash" {
+			if p.Bash == bashDeny {
+				continue
+			}
+			next := t.fn
+			t.fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+				command, _ := argString(args, "command")
+				if ok, reason := sess.approver.approve("bash: "+command, true); !ok {
+					return "", policyErrorf("bash: %s (approval required by %s)", reason, p.path)
+				}
+				return next(ctx, cwd, args)
+			}
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// restrict adds the banned paths to the workspace's ignore rules.
+func (p *orgPolicy) restrict(rules *ignoreRules, roots []string) *ignoreRules {
+	if p == nil || len(p.BannedPaths) == 0 {
+		return rules
+	}
+	if rules == nil {
+		rules = &ignoreRules{}
+	}
+	home, _ := os.UserHomeDir()
+	var relative []ignoreRule
+	for _, pattern := range p.BannedPaths {
+		rule := ignoreRule{mode: banned, dirOnly: strings.HasSuffix(pattern, "/")}
+		if rest, ok := strings.CutPrefix(pattern, "~/"); ok && home != "" {
+			pattern = filepath.Join(home, rest)
+		}
+		if filepath.IsAbs(pattern) {
+			// Absolute patterns are matched from the top of the filesystem.
+			volume := filepath.VolumeName(pattern)
+			rule.pattern = strings.Trim(filepath.ToSlash(strings.TrimPrefix(pattern, volume)), "/")
+			rules.roots = append(rules.roots, ignoreRoot{dir: volume + string(filepath.Separator), rules: []ignoreRule{rule}})
+			continue
+		}
+		rule.pattern = strings.Trim(pattern, "/")
+		if !strings.Contains(rule.pattern, "/") {
+			rule.pattern = "**/" + rule.pattern
+		}
+		relative = append(relative, rule)
+	}
+	if len(relative) == 0 {
+		return rules
+	}
+roots:
+	for _, dir := range roots {
+		for i := range rules.roots {
+			if rules.roots[i].dir == dir {
+				rules.roots[i].rules = append(rules.roots[i].rules, relative...)
+				continue roots
+			}
+		}
+		rules.roots = append(rules.roots, ignoreRoot{dir: dir, rules: relative})
+	}
+	return rules
+}
+
+// endpointAllowed reports whether url is under the allowed endpoint: the
+// same scheme and host, and a path without dot segments at or below the
+// allowed one, compared by segment.
+func endpointAllowed(allowed, rawURL string) bool {
+	a, err := url.Parse(allowed)
+	if err != nil || a.Host == "" {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User != nil {
+		return false
+	}
+	if !strings.EqualFold(a.Scheme, u.Scheme) || !strings.EqualFold(a.Host, u.Host) {
+		return false
+	}
+	// The server resolves dot segments: /v1/../admin is not under /v1.
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg == "." || seg == ".." {
+			return false
+		}
+	}
+	prefix := strings.TrimSuffix(a.EscapedPath(), "/")
+	p := u.EscapedPath()
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// tighten returns the policy with a serve tenant's restrictions added.
+// p may be nil.
+func (p *orgPolicy) tighten(t tenantConfig) (*orgPolicy, error) {
+	out := &orgPolicy{}
+	if p != nil {
+		*out = *p
+	}
+	return out.narrow(&orgPolicy{path: out.path, Bash: t.Bash, BannedPaths: t.BannedPaths, AllowedModels: t.AllowedModels})
+}
+
+// narrow returns p with q's restrictions added: the stricter bash
+// setting, both sets of banned paths, and of q's providers, models, and
+// endpoints only those p allows. Nothing in q loosens p.
+func (p *orgPolicy) narrow(q *orgPolicy) (*orgPolicy, error) {
+	out := *p
+	if q.path != p.path {
+		out.path = p.path + " and " + q.path
+	}
+	if q.Bash == bashDeny || (q.Bash == bashApprove && out.Bash == "") {
+		out.Bash = q.Bash
+	}
+	out.BannedPaths = slices.Clone(p.BannedPaths)
+	for _, pattern := range q.BannedPaths {
+		if !slices.Contains(out.BannedPaths, pattern) {
+			out.BannedPaths = append(out.BannedPaths, pattern)
+		}
+	}
+	if len(q.AllowedProviders) > 0 {
+		providers := q.AllowedProviders
+		if len(p.AllowedProviders) > 0 {
+			providers = nil
+			for _, name := range q.AllowedProviders {
+				if slices.Contains(p.AllowedProviders, name) {
+					providers = append(providers, name)
+				}
+			}
+			if len(providers) == 0 {
+				return nil, policyErrorf("none of the providers %s are allowed by %s (allowed: %s)", strings.Join(q.AllowedProviders, ", "), p.path, strings.Join(p.AllowedProviders, ", "))
+			}
+		}
+		out.AllowedProviders = slices.Clone(providers)
+	}
+	if len(q.AllowedModels) > 0 {
+		models := q.AllowedModels
+		if len(p.AllowedModels) > 0 {
+			// A pattern of q is kept when one of p covers it as text:
+			// claude-* covers claude-sonnet-* and claude-sonnet-4.
+			models = nil
+			for _, m := range q.AllowedModels {
+				if slices.ContainsFunc(p.AllowedModels, func(pattern string) bool { ok, _ := path.Match(pattern, m); return ok }) {
+					models = append(models, m)
+				}
+			}
+			if len(models) == 0 {
+				return nil, policyErrorf("none of the models %s are allowed by %s (allowed: %s)", strings.Join(q.AllowedModels, ", "), p.path, strings.Join(p.AllowedModels, ", "))
+			}
+		}
+		out.AllowedModels = slices.Clone(models)
+	}
+	out.DisableTelemetry = p.DisableTelemetry || q.DisableTelemetry
+	if len(q.TelemetryEndpoints) > 0 {
+		endpoints := q.TelemetryEndpoints
+		if len(p.TelemetryEndpoints) > 0 {
+			endpoints = nil
+			for _, e := range q.TelemetryEndpoints {
+				if slices.ContainsFunc(p.TelemetryEndpoints, func(allowed string) bool { return endpointAllowed(allowed, e) }) {
+					endpoints = append(endpoints, e)
+				}
+			}
+			// No endpoint both allow means none may be used.
+			out.DisableTelemetry = out.DisableTelemetry || len(endpoints) == 0
+		}
+		out.TelemetryEndpoints = slices.Clone(endpoints)
+	}
+	return &out, nil
+}
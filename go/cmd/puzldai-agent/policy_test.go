@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEndpointAllowed(t *testing.T) {
+	const allowed = "https://api.x.com/v1"
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://api.x.com/v1", true},
+		{"https://api.x.com/v1/", true},
+		{"https://api.x.com/v1/runs?id=1", true},
+		{"https://API.X.COM/v1/runs", true},
+		{"https://api.x.com.evil/v1/runs", false},
+		{"https://api.x.com.evil", false},
+		{"https://evil.com/api.x.com/v1", false},
+		{"https://api.x.com@evil.com/v1", false},
+		{"https://user@api.x.com/v1", false},
+		{"http://api.x.com/v1", false},
+		{"https://api.x.com:8443/v1", false},
+		{"https://api.x.com/v1../", false},
+		{"https://api.x.com/v10", false},
+		{"https://api.x.com/v1/../admin", false},
+		{"https://api.x.com/v1/%2e%2e/admin", false},
+		{"https://api.x.com/v1/./runs", false},
+		{"https://api.x.com/", false},
+		{"://bad", false},
+	}
+	for _, tt := range tests {
+		if got := endpointAllowed(allowed, tt.url); got != tt.want {
+			t.Errorf("endpointAllowed(%q, %q) = %v, want %v", allowed, tt.url, got, tt.want)
+		}
+	}
+	if endpointAllowed("not a url", "https://api.x.com/v1") {
+		t.Error("an allowed entry without a host allows everything")
+	}
+}
+
+func TestPolicyNarrow(t *testing.T) {
+	system := &orgPolicy{
+		path:               "/etc/puzldai/policy.toml",
+		Bash:               bashApprove,
+		BannedPaths:        []string{"secrets/"},
+		AllowedProviders:   []string{"anthropic"},
+		AllowedModels:      []string{"claude-*"},
+		TelemetryEndpoints: []string{"https://t.x.com/v1"},
+	}
+	tests := []struct {
+		name    string
+		env     orgPolicy
+		check   func(t *testing.T, p *orgPolicy)
+		wantErr string
+	}{
+		{
+			name: "empty env file changes nothing",
+			check: func(t *testing.T, p *orgPolicy) {
+				if p.Bash != bashApprove || !slices.Equal(p.AllowedModels, system.AllowedModels) || p.DisableTelemetry {
+					t.Errorf("got %+v", p)
+				}
+			},
+		},
+		{
+			name: "bash can be denied, not allowed",
+			env:  orgPolicy{Bash: bashDeny},
+			check: func(t *testing.T, p *orgPolicy) {
+				if p.Bash != bashDeny {
+					t.Errorf("bash = %q, want deny", p.Bash)
+				}
+			},
+		},
+		{
+			name: "banned paths add up",
+			env:  orgPolicy{BannedPaths: []string{"*.pem", "secrets/"}},
+			check: func(t *testing.T, p *orgPolicy) {
+				if want := []string{"secrets/", "*.pem"}; !slices.Equal(p.BannedPaths, want) {
+					t.Errorf("banned paths = %v, want %v", p.BannedPaths, want)
+				}
+			},
+		},
+		{
+			name: "providers intersect",
+			env:  orgPolicy{AllowedProviders: []string{"openai", "anthropic"}},
+			check: func(t *testing.T, p *orgPolicy) {
+				if p.checkModel("openai", "claude-x") == nil || p.checkModel("anthropic", "claude-x") != nil {
+					t.Errorf("providers = %v", p.AllowedProviders)
+				}
+			},
+		},
+		{
+			name:    "no provider in common",
+			env:     orgPolicy{AllowedProviders: []string{"openai"}},
+			wantErr: "none of the providers openai are allowed",
+		},
+		{
+			name: "models only narrow",
+			env:  orgPolicy{AllowedModels: []string{"claude-sonnet-*", "gpt-4o"}},
+			check: func(t *testing.T, p *orgPolicy) {
+				if p.checkModel("anthropic", "claude-sonnet-4") != nil || p.checkModel("anthropic", "claude-opus-4") == nil || p.checkModel("anthropic", "gpt-4o") == nil {
+					t.Errorf("models = %v", p.AllowedModels)
+				}
+			},
+		},
+		{
+			name:    "a broader model pattern does not widen",
+			env:     orgPolicy{AllowedModels: []string{"*"}},
+			wantErr: "none of the models * are allowed",
+		},
+		{
+			name: "telemetry endpoints narrow",
+			env:  orgPolicy{TelemetryEndpoints: []string{"https://t.x.com/v1/runs", "https://evil.com"}},
+			check: func(t *testing.T, p *orgPolicy) {
+				if p.checkEndpoint("https://t.x.com/v1/runs/1") != nil || p.checkEndpoint("https://t.x.com/v1/other") == nil || p.checkEndpoint("https://evil.com") == nil {
+					t.Errorf("endpoints = %v", p.TelemetryEndpoints)
+				}
+			},
+		},
+		{
+			name: "no endpoint in common disables telemetry",
+			env:  orgPolicy{TelemetryEndpoints: []string{"https://evil.com"}},
+			check: func(t *testing.T, p *orgPolicy) {
+				if !p.DisableTelemetry || p.checkEndpoint("https://t.x.com/v1") == nil {
+					t.Errorf("telemetry still allowed: %+v", p)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env
+			env.path = "env.toml"
+			p, err := system.narrow(&env)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %+v, %v; want an error containing %q", p, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, p)
+			if !slices.Equal(system.BannedPaths, []string{"secrets/"}) {
+				t.Errorf("narrow changed the system policy: %v", system.BannedPaths)
+			}
+		})
+	}
+
+	t.Run("system telemetry ban stays", func(t *testing.T) {
+		p, err := (&orgPolicy{DisableTelemetry: true}).narrow(&orgPolicy{TelemetryEndpoints: []string{"https://t.x.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.checkEndpoint("https://t.x.com") == nil {
+			t.Error("the env file re-enabled telemetry")
+		}
+	})
+}
+
+func TestReadPolicyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		wantErr string
+	}{
+		{"valid", "bash = \"deny\"\nallowed_models = [\"claude-*\"]\n", ""},
+		{"unknown key", "bash = \"deny\"\nallow_bash = true\n", "unknown settings allow_bash"},
+		{"invalid bash", "bash = \"allow\"\n", `invalid bash "allow"`},
+		{"invalid pattern", "banned_paths = [\"[\"]\n", `invalid pattern "["`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.toml")
+			if err := os.WriteFile(path, []byte(tt.text), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readPolicyFile(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "strings"
+
+// modelPrice is a model's list price in USD per million tokens.
+type modelPrice struct {
+	input  float64
+	output float64
+}
+
+// modelPrices lists public prices by model name prefix; the longest
+// matching prefix wins, so dated and -latest names resolve to their family.
+// Gateways and discounts are not accounted for, so costs are estimates.
+var modelPrices = map[string]modelPrice{
+	"claude-3-haiku":    {0.25, 1.25},
+	"claude-3-5-haiku":  {0.80, 4},
+	"claude-haiku-4-5":  {1, 5},
+	"claude-3-5-sonnet": {3, 15},
+	"claude-3-7-sonnet": {3, 15},
+	"claude-sonnet-4":   {3, 15},
+	"claude-3-opus":     {15, 75},
+	"claude-opus-4":     {15, 75},
+	"claude-opus-4-5":   {5, 25},
+	"gpt-4o":            {2.50, 10},
+	"gpt-4o-mini":       {0.15, 0.60},
+	"gpt-4.1":           {2, 8},
+	"gpt-4.1-mini":      {0.40, 1.60},
+	"gpt-4.1-nano":      {0.10, 0.40},
+	"o3-mini":           {1.10, 4.40},
+	"o4-mini":           {1.10, 4.40},
+	"gemini-1.5-flash":  {0.075, 0.30},
+	"gemini-1.5-pro":    {1.25, 5},
+	"gemini-2.0-flash":  {0.10, 0.40},
+}
+
+// priceFor looks up model, ignoring an OpenRouter-style vendor prefix.
+func priceFor(model string) (modelPrice, bool) {
+	if _, name, ok := strings.Cut(model, "/"); ok {
+		model = name
+	}
+	var best string
+	for prefix := range modelPrices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return modelPrice{}, false
+	}
+	return modelPrices[best], true
+}
+
+func (p modelPrice) cost(u tokenUsage) float64 {
+	return (float64(u.inputTokens)*p.input + float64(u.outputTokens)*p.output) / 1e6
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// protectedPaths holds the protected_paths rules of the config. Writing a
+// matching file needs an explicit approval, even with -approval auto; a
+// refusal is fed back to the model as the tool's error.
+type protectedPaths struct {
+	roots    []string
+	rules    []ignoreRule
+	approver *approver
+	// remote, when set, resolves paths on the remote host.
+	remote *remoteTarget
+}
+
+// newProtectedPaths compiles the patterns, which are written like
+// .puzldaiignore lines and apply in every root. The config file itself is
+// protected too, so the agent cannot lift the rules. It returns nil when
+// there are no patterns.
+func newProtectedPaths(patterns, roots []string, approver *approver, remote *remoteTarget) (*protectedPaths, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	p := &protectedPaths{roots: roots, approver: approver, remote: remote}
+	for _, pattern := range patterns {
+		rule := ignoreRule{dirOnly: strings.HasSuffix(pattern, "/"), pattern: strings.Trim(pattern, "/")}
+		if !strings.Contains(rule.pattern, "/") {
+			rule.pattern = "**/" + rule.pattern
+		}
+		if !doublestar.ValidatePattern(rule.pattern) {
+			return nil, fmt.Errorf("protected_paths: invalid pattern %q", pattern)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	p.rules = append(p.rules, ignoreRule{pattern: defaultConfigName})
+	return p, nil
+}
+
+type protectedPathsKey struct{}
+
+// withProtectedPaths lets ast_edit check the files it is about to write.
+func withProtectedPaths(ctx context.Context, p *protectedPaths) context.Context {
+	return context.WithValue(ctx, protectedPathsKey{}, p)
+}
+
+func protectedPathsFrom(ctx context.Context) *protectedPaths {
+	p, _ := ctx.Value(protectedPathsKey{}).(*protectedPaths)
+	return p
+}
+
+// apply guards the tools that write files. ast_edit finds out which files
+// it changes only once it has worked out the edit, so it checks them itself
+// before writing any.
+func (p *protectedPaths) apply(tools []toolDef) []toolDef {
+	for i := range tools {
+		spec, ok := pathArgs[tools[i].name]
+		if !ok || !spec.write {
+			continue
+		}
+		next, name := tools[i].fn, tools[i].name
+		if name == "ast_edit" {
+			tools[i].fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+				return next(withProtectedPaths(ctx, p), cwd, args)
+			}
+			continue
+		}
+		tools[i].fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			if path, ok := argString(args, spec.arg); ok && path != "" {
+				full := resolvePath(cwd, path)
+				if p.remote != nil {
+					var err error
+					if full, err = p.remote.resolve(ctx, path); err != nil {
+						return next(ctx, cwd, args)
+					}
+				}
+				if err := p.check(name, cwd, []string{full}); err != nil {
+					return "", err
+				}
+			}
+			return next(ctx, cwd, args)
+		}
+	}
+	return tools
+}
+
+// check asks for an explicit approval when any of the files is protected,
+// and returns the refusal otherwise.
+func (p *protectedPaths) check(tool, cwd string, files []string) error {
+	if p == nil {
+		return nil
+	}
+	var hits, paths []string
+	for _, file := range files {
+		if pattern := p.match(file); pattern != "" {
+			display := p.display(cwd, file)
+			hits = append(hits, fmt.Sprintf("%s (protected by %s)", display, pattern))
+			paths = append(paths, display)
+		}
+	}
+	if len(hits) == 0 {
+		return nil
+	}
+	if ok, reason := p.approver.approve(tool+": write "+strings.Join(hits, ", "), true); !ok {
+		return policyErrorf("%s: %s is a protected path and was not written (%s); leave it unchanged, or ask the user to make the change", tool, strings.Join(paths, ", "), reason)
+	}
+	return nil
+}
+
+// match returns the pattern of the first rule protecting the absolute path,
+// or "" when none does.
+func (p *protectedPaths) match(path string) string {
+	for _, root := range p.roots {
+		rel, ok := p.rel(root, path)
+		if !ok {
+			continue
+		}
+		for _, rule := range p.rules {
+			if rule.matches(rel, false) {
+				return strings.TrimPrefix(rule.pattern, "**/")
+			}
+		}
+	}
+	return ""
+}
+
+// rel returns path relative to root with forward slashes, and whether it
+// is inside root.
+func (p *protectedPaths) rel(root, path string) (string, bool) {
+	if p.remote != nil {
+		rel, ok := strings.CutPrefix(path, strings.TrimSuffix(root, "/")+"/")
+		return rel, ok
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (p *protectedPaths) display(cwd, path string) string {
+	if p.remote != nil {
+		return p.remote.displayPath(path)
+	}
+	return displayPath(cwd, path)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	anthropic "github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// completionRequest is one model turn. Providers without native tool calling
+// receive the tool protocol through the system prompt and flattened messages.
+type completionRequest struct {
+	model     string
+	system    string
+	messages  []agentMessage
+	tools     []toolDef
+	maxTokens int
+	// temperature and topP are nil unless configured, leaving the provider's
+	// own defaults in place.
+	temperature *float64
+	topP        *float64
+	// onText, when set, receives reply text as it streams in. Providers
+	// that cannot stream ignore it.
+	onText func(string)
+	// images are attached after the prompt, each preceded by its label.
+	images []promptImage
+}
+
+// promptImage is an image sent to the model, such as a screenshot.
+type promptImage struct {
+	label     string
+	mediaType string
+	data      []byte
+}
+
+type completion struct {
+	text string
+	// toolCalls is set by providers that translate native function calls;
+	// otherwise the loop parses ```tool blocks out of text.
+	toolCalls []toolCall
+	usage     tokenUsage
+	// truncated reports that generation stopped at maxTokens.
+	truncated bool
+}
+
+type tokenUsage struct {
+	inputTokens  int64
+	outputTokens int64
+}
+
+type provider interface {
+	complete(ctx context.Context, req completionRequest) (*completion, error)
+}
+
+// providerSettings selects and configures a provider; flags override config.
+type providerSettings struct {
+	name      string
+	model     string
+	baseURL   string
+	apiKeyEnv string
+	profile   string
+	transport transportSettings
+	// batchPoll enables the Anthropic Message Batches API (see batch.go).
+	batchPoll time.Duration
+}
+
+type providerPreset struct {
+	kind         string
+	baseURL      string
+	apiKeyEnv    string
+	defaultModel string
+	headers      map[string]string
+}
+
+var providerPresets = map[string]providerPreset{
+	"anthropic": {
+		kind:         "anthropic",
+		apiKeyEnv:    "ANTHROPIC_API_KEY",
+		defaultModel: "claude-3-5-sonnet-latest",
+	},
+	"openai": {
+		kind:         "openai",
+		baseURL:      "https://api.openai.com/v1",
+		apiKeyEnv:    "OPENAI_API_KEY",
+		defaultModel: "gpt-4o",
+	},
+	"gemini": {
+		kind:         "gemini",
+		baseURL:      "https://generativelanguage.googleapis.com/v1beta",
+		apiKeyEnv:    "GEMINI_API_KEY",
+		defaultModel: "gemini-2.0-flash",
+	},
+	"openrouter": {
+		kind:         "openai",
+		baseURL:      "https://openrouter.ai/api/v1",
+		apiKeyEnv:    "OPENROUTER_API_KEY",
+		defaultModel: "anthropic/claude-3.5-sonnet",
+		headers: map[string]string{
+			"HTTP-Referer": "https://github.com/kingkillery/Puzld.ai",
+			"X-Title":      "puzldai-agent",
+		},
+	},
+}
+
+func providerNames() string {
+	names := make([]string, 0, len(providerPresets))
+	for name := range providerPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newProvider resolves the preset, fills in defaults, and returns the provider
+// together with the model to request.
+func newProvider(s providerSettings) (provider, string, error) {
+	if s.name == "" {
+		s.name = "anthropic"
+	}
+	preset, ok := providerPresets[s.name]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown provider %q (available: %s)", s.name, providerNames())
+	}
+	if s.baseURL == "" {
+		s.baseURL = preset.baseURL
+	}
+	if s.apiKeyEnv == "" {
+		s.apiKeyEnv = preset.apiKeyEnv
+	}
+	if s.model == "" {
+		s.model = preset.defaultModel
+	}
+	apiKey := providerAPIKey(s)
+	client, err := newHTTPClient(s.transport)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if s.batchPoll > 0 && preset.kind != "anthropic" {
+		return nil, "", fmt.Errorf("provider %s: -batch-api needs the anthropic provider", s.name)
+	}
+
+	switch preset.kind {
+	case "anthropic":
+		opts := []option.RequestOption{option.WithHTTPClient(client)}
+		if s.baseURL != "" {
+			opts = append(opts, option.WithBaseURL(s.baseURL))
+		}
+		if apiKey != "" {
+			opts = append(opts, option.WithAPIKey(apiKey))
+		}
+		for k, v := range preset.headers {
+			opts = append(opts, option.WithHeader(k, v))
+		}
+		return &anthropicProvider{client: anthropic.NewClient(opts...), batchPoll: s.batchPoll}, s.model, nil
+	case "openai":
+		if apiKey == "" {
+			return nil, "", missingKeyError(s)
+		}
+		return &openAIProvider{
+			baseURL: strings.TrimRight(s.baseURL, "/"),
+			apiKey:  apiKey,
+			headers: preset.headers,
+			http:    client,
+		}, s.model, nil
+	case "gemini":
+		if apiKey == "" {
+			return nil, "", missingKeyError(s)
+		}
+		return &geminiProvider{
+			baseURL: strings.TrimRight(s.baseURL, "/"),
+			apiKey:  apiKey,
+			http:    client,
+		}, s.model, nil
+	default:
+		return nil, "", fmt.Errorf("provider %s: unsupported kind %q", s.name, preset.kind)
+	}
+}
+
+func missingKeyError(s providerSettings) error {
+	login := "puzldai-agent auth login -provider " + s.name
+	if s.profile != "" {
+		login += " -profile " + s.profile
+	}
+	return fmt.Errorf("provider %s: %s is not set and no key is stored (run: %s)", s.name, s.apiKeyEnv, login)
+}
+
+type anthropicProvider struct {
+	client anthropic.Client
+	// batchPoll, when set, sends each turn through the Message Batches API
+	// and polls for the result at this interval.
+	batchPoll time.Duration
+}
+
+func (p *anthropicProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	content := []anthropic.ContentBlockParamUnion{anthropic.NewTextBlock(buildPrompt(req.system, req.messages))}
+	for _, img := range req.images {
+		content = append(content,
+			anthropic.NewTextBlock(img.label),
+			anthropic.NewImageBlockBase64(img.mediaType, base64.StdEncoding.EncodeToString(img.data)))
+	}
+	params := anthropic.MessageNewParams{
+		Model:     anthropic.Model(req.model),
+		MaxTokens: int64(req.maxTokens),
+		Messages: []anthropic.MessageParam{{
+			Role:    anthropic.MessageParamRoleUser,
+			Content: content,
+		}},
+	}
+	if req.temperature != nil {
+		params.Temperature = anthropic.Float(*req.temperature)
+	}
+	if req.topP != nil {
+		params.TopP = anthropic.Float(*req.topP)
+	}
+	var msg *anthropic.Message
+	var err error
+	switch {
+	case p.batchPoll > 0:
+		msg, err = p.completeBatch(ctx, params)
+	case req.onText != nil:
+		msg, err = p.completeStreaming(ctx, params, req.onText)
+	default:
+		msg, err = p.client.Messages.New(ctx, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &completion{
+		text:      renderMessageText(msg),
+		usage:     tokenUsage{inputTokens: msg.Usage.InputTokens, outputTokens: msg.Usage.OutputTokens},
+		truncated: msg.StopReason == anthropic.StopReasonMaxTokens,
+	}, nil
+}
+
+// completeStreaming streams the reply, passing text deltas to onText as they
+// arrive, and returns the accumulated message.
+func (p *anthropicProvider) completeStreaming(ctx context.Context, params anthropic.MessageNewParams, onText func(string)) (*anthropic.Message, error) {
+	stream := p.client.Messages.NewStreaming(ctx, params)
+	defer stream.Close()
+	var msg anthropic.Message
+	for stream.Next() {
+		event := stream.Current()
+		if err := msg.Accumulate(event); err != nil {
+			return nil, err
+		}
+		if delta, ok := event.AsAny().(anthropic.ContentBlockDeltaEvent); ok {
+			if text, ok := delta.Delta.AsAny().(anthropic.TextDelta); ok {
+				onText(text.Text)
+			}
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// openAIProvider speaks the OpenAI chat-completions protocol used by OpenAI,
+// OpenRouter, LiteLLM, and most self-hosted gateways.
+type openAIProvider struct {
+	baseURL string
+	apiKey  string
+	headers map[string]string
+	http    *http.Client
+}
+
+type openAIChatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+}
+
+type openAIMessage struct {
+	Role string `json:"role"`
+	// Content is a string, or a list of parts when images are attached.
+	Content any `json:"content"`
+}
+
+type openAIPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+// openAIContent is the prompt, followed by any images as data URLs.
+func openAIContent(prompt string, images []promptImage) any {
+	if len(images) == 0 {
+		return prompt
+	}
+	parts := []openAIPart{{Type: "text", Text: prompt}}
+	for _, img := range images {
+		image := openAIPart{Type: "image_url", ImageURL: &struct {
+			URL string `json:"url"`
+		}{"data:" + img.mediaType + ";base64," + base64.StdEncoding.EncodeToString(img.data)}}
+		parts = append(parts, openAIPart{Type: "text", Text: img.label}, image)
+	}
+	return parts
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *openAIProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	body, err := json.Marshal(openAIChatRequest{
+		Model:       req.model,
+		Messages:    []openAIMessage{{Role: "user", Content: openAIContent(buildPrompt(req.system, req.messages), req.images)}},
+		MaxTokens:   req.maxTokens,
+		Temperature: req.temperature,
+		TopP:        req.topP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	for k, v := range p.headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	resp, err := p.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var out openAIChatResponse
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out.Error != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Status, out.Error.Message)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, errors.New(resp.Status)
+	}
+	if len(out.Choices) == 0 {
+		return nil, errors.New("response contained no choices")
+	}
+	return &completion{
+		text:      out.Choices[0].Message.Content,
+		usage:     tokenUsage{inputTokens: out.Usage.PromptTokens, outputTokens: out.Usage.CompletionTokens},
+		truncated: out.Choices[0].FinishReason == "length",
+	}, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitConfig caps traffic to one provider ([rate_limit.<provider>]).
+// Zero fields are unlimited.
+type rateLimitConfig struct {
+	RequestsPerMinute int `toml:"requests_per_minute"`
+	TokensPerMinute   int `toml:"tokens_per_minute"`
+	MaxConcurrent     int `toml:"max_concurrent"`
+}
+
+func (c rateLimitConfig) enabled() bool {
+	return c.RequestsPerMinute > 0 || c.TokensPerMinute > 0 || c.MaxConcurrent > 0
+}
+
+const (
+	rateWindow = time.Minute
+	// staleLock and staleInflight bound how long a crashed process can hold
+	// the lock file or a concurrency slot.
+	staleLock     = 10 * time.Second
+	staleInflight = 15 * time.Minute
+)
+
+// rateLimiter wraps a provider with limits shared by every agent process
+// using the same PUZLDAI_HOME, so parallel attempts, pipeline coders, and
+// separate runs draw from one budget. The state lives in a small JSON file
+// guarded by an exclusive lock file, which works on any filesystem.
+type rateLimiter struct {
+	next   provider
+	name   string
+	limits rateLimitConfig
+	path   string
+	warned sync.Once
+}
+
+type rateState struct {
+	Requests []rateEntry `json:"requests"`
+	Inflight []rateEntry `json:"inflight"`
+}
+
+type rateEntry struct {
+	ID     string `json:"id"`
+	At     int64  `json:"at"`
+	Tokens int    `json:"tokens,omitempty"`
+}
+
+func newRateLimiter(next provider, name string, limits rateLimitConfig) (*rateLimiter, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(filepath.Dir(dir), "ratelimit")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &rateLimiter{next: next, name: name, limits: limits, path: filepath.Join(dir, name+".json")}, nil
+}
+
+func (l *rateLimiter) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	// The estimate reserves room up front; release replaces it with the
+	// reported usage.
+	id, err := l.acquire(ctx, estimateTokens(req))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := l.next.complete(ctx, req)
+	used := 0
+	if resp != nil {
+		used = int(resp.usage.inputTokens + resp.usage.outputTokens)
+	}
+	l.release(id, used)
+	return resp, err
+}
+
+// acquire waits until the request fits every limit, then records it.
+func (l *rateLimiter) acquire(ctx context.Context, tokens int) (string, error) {
+	id := strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	for {
+		var wait time.Duration
+		err := l.update(func(st *rateState, now time.Time) {
+			wait = l.delay(st, now, tokens)
+			if wait == 0 {
+				st.Requests = append(st.Requests, rateEntry{ID: id, At: now.UnixNano(), Tokens: tokens})
+				st.Inflight = append(st.Inflight, rateEntry{ID: id, At: now.UnixNano()})
+			}
+		})
+		if err != nil {
+			return "", err
+		}
+		if wait == 0 {
+			return id, nil
+		}
+		l.warned.Do(func() {
+			fmt.Fprintf(os.Stderr, "rate limit: waiting for %s capacity (%s)\n", l.name, l.path)
+		})
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// delay is how long to wait before a request of tokens fits, or 0.
+func (l *rateLimiter) delay(st *rateState, now time.Time, tokens int) time.Duration {
+	var wait time.Duration
+	expiry := func(e rateEntry) time.Duration {
+		return time.Unix(0, e.At).Add(rateWindow).Sub(now) + 10*time.Millisecond
+	}
+	if l.limits.MaxConcurrent > 0 && len(st.Inflight) >= l.limits.MaxConcurrent {
+		wait = 100 * time.Millisecond
+	}
+	if l.limits.RequestsPerMinute > 0 && len(st.Requests) >= l.limits.RequestsPerMinute {
+		wait = max(wait, expiry(st.Requests[len(st.Requests)-l.limits.RequestsPerMinute]))
+	}
+	if limit := l.limits.TokensPerMinute; limit > 0 {
+		// A request larger than the whole budget runs once the window is
+		// empty rather than waiting forever.
+		total := tokens
+		for _, e := range st.Requests {
+			total += e.Tokens
+		}
+		for i := 0; total > limit && i < len(st.Requests); i++ {
+			total -= st.Requests[i].Tokens
+			wait = max(wait, expiry(st.Requests[i]))
+		}
+	}
+	return wait
+}
+
+// release frees the concurrency slot and records the tokens actually used.
+func (l *rateLimiter) release(id string, used int) {
+	err := l.update(func(st *rateState, _ time.Time) {
+		for i, e := range st.Inflight {
+			if e.ID == id {
+				st.Inflight = append(st.Inflight[:i], st.Inflight[i+1:]...)
+				break
+			}
+		}
+		if used > 0 {
+			for i := range st.Requests {
+				if st.Requests[i].ID == id {
+					st.Requests[i].Tokens = used
+				}
+			}
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rate limit: %v\n", err)
+	}
+}
+
+// update applies fn to the shared state under the lock, after dropping
+// entries that have left the window.
+func (l *rateLimiter) update(fn func(st *rateState, now time.Time)) error {
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var st rateState
+	data, err := os.ReadFile(l.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 && json.Unmarshal(data, &st) != nil {
+		st = rateState{}
+	}
+	now := time.Now()
+	st.Requests = pruneEntries(st.Requests, now.Add(-rateWindow))
+	st.Inflight = pruneEntries(st.Inflight, now.Add(-staleInflight))
+	fn(&st, now)
+
+	data, err = json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+func pruneEntries(entries []rateEntry, cutoff time.Time) []rateEntry {
+	out := entries[:0]
+	for _, e := range entries {
+		if e.At > cutoff.UnixNano() {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// lock takes the state file's lock, breaking one left behind by a process
+// that died while holding it.
+func (l *rateLimiter) lock() (func(), error) {
+	path := l.path + ".lock"
+	deadline := time.Now().Add(2 * staleLock)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+const defaultRefactorFixRounds = 1
+
+const refactorPlanInstructions = `You are planning a refactor. Do not modify any files.
+Find everything the change below touches: search for the names involved with
+grep, and mind tests, docs, comments, configs, scripts, and generated code.
+
+Reply with the plan: the steps in order, each with the files it changes and
+how. Say which steps ast_edit can do (Go renames, parameter changes, struct
+fields) where that tool is available, and which need text edits. End with
+anything ambiguous, such as a name that also means something else, and how to
+treat it.`
+
+const refactorEditInstructions = `You are applying a refactor across this repository, following the plan
+below. Make exactly the change described: no unrelated edits, cleanups, or new
+features. Use ast_edit for renames and signature changes where it is
+available, as it updates every reference, then take care of anything it lists
+as not updated. Use edit for the rest: comments, docs, strings, configs, and
+other languages. When done, grep for leftovers of the old names, then finish
+with a short summary of what changed.`
+
+const refactorUsage = `usage: puzldai-agent refactor [-cwd dir] [-verify cmd] [-fix-rounds n] [-apply] [-patch-out file] "description" [-- agent flags]`
+
+// runRefactor implements the refactor subcommand: a planner maps out the
+// change, an editor applies it in a worktree of a snapshot of the workspace,
+// the verify command checks it, and the result is shown as a single diff to
+// apply or leave.
+func runRefactor(args []string) int {
+	fs := newFlagSet("refactor")
+	cwdFlag := fs.String("cwd", "", "Workspace to refactor (default: the current directory)")
+	verifyFlag := fs.String("verify", "", "Shell command that checks the result (exit 0 = pass) (default: config verify)")
+	fixRoundsFlag := fs.Int("fix-rounds", defaultRefactorFixRounds, "Times the editor may fix a failed verification")
+	applyFlag := fs.Bool("apply", false, "Apply the diff without asking if verification passes")
+	patchOutFlag := fs.String("patch-out", "", "Also write the diff to this file")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintln(os.Stderr, refactorUsage)
+		return exitUsage
+	}
+	description := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if description == "" {
+		fmt.Fprintln(os.Stderr, refactorUsage)
+		return exitUsage
+	}
+	noColor = os.Getenv("NO_COLOR") != ""
+
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "refactor:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+	cfg, err := loadConfig(cwd, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "refactor: failed to load config:", err)
+		return exitError
+	}
+	verify := firstNonEmpty(*verifyFlag, cfg.Verify)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ws, err := newChildWorkspace(ctx, cwd, "refactor")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "refactor:", err)
+		return exitError
+	}
+	// The runs happen in temporary worktrees; book them to this project.
+	os.Setenv(projectEnv, projectName(cwd))
+	var children []*childRun
+	defer func() { ws.removeWorktrees(children) }()
+	var mu sync.Mutex
+	run := func(c *childRun, name, task string) error {
+		return ws.runAgent(ctx, c, name, task, agentArgs, &mu)
+	}
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "refactor:", err)
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		return exitError
+	}
+
+	planner, err := ws.newChild(ctx, 0, "plan", "plan", "", ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	children = append(children, planner)
+	if err := run(planner, "plan", refactorPlanInstructions+"\n\n## Refactor\n\n"+description); err != nil {
+		return fail(err)
+	}
+	plan := strings.TrimSpace(planner.answer)
+	if plan == "" {
+		return fail(fmt.Errorf("the planner gave no plan (exit %d)", planner.exitCode))
+	}
+	fmt.Fprintf(os.Stderr, "plan:\n%s\n\n", plan)
+
+	editor, err := ws.newChild(ctx, 1, "edit", "edit", "", ws.base)
+	if err != nil {
+		return fail(err)
+	}
+	children = append(children, editor)
+	if err := run(editor, "edit", refactorEditTask(description, plan, verify)); err != nil {
+		return fail(err)
+	}
+	editor.collect(ctx, ws.base, verify)
+	for round := 1; round <= *fixRoundsFlag && editor.verified != nil && !*editor.verified; round++ {
+		fmt.Fprintf(os.Stderr, "verification failed; fix round %d of %d\n", round, *fixRoundsFlag)
+		if err := run(editor, fmt.Sprintf("fix-%d", round), refactorFixTask(description, plan, verify, editor.verifyLog)); err != nil {
+			return fail(err)
+		}
+		editor.collect(ctx, ws.base, verify)
+	}
+	if editor.patch == "" {
+		printAnswer(editor.answer)
+		return fail(fmt.Errorf("the refactor changed no files"))
+	}
+
+	patchFile := filepath.Join(ws.work, "refactor.patch")
+	if err := os.WriteFile(patchFile, []byte(editor.patch), 0o644); err != nil {
+		return fail(err)
+	}
+	if *patchOutFlag != "" {
+		if err := os.WriteFile(*patchOutFlag, []byte(editor.patch), 0o644); err != nil {
+			return fail(err)
+		}
+	}
+	if summary := strings.TrimSpace(editor.answer); summary != "" {
+		fmt.Fprintf(os.Stderr, "summary:\n%s\n\n", summary)
+	}
+	printPatch(editor.patch)
+	if stat, err := runGit(ctx, editor.dir, "diff", "--cached", "--stat", ws.base); err == nil {
+		fmt.Fprintf(os.Stderr, "\n%s", stat)
+	}
+	passed := editor.verified == nil || *editor.verified
+	switch {
+	case editor.verified == nil:
+		fmt.Fprintln(os.Stderr, "not verified (no -verify command or config verify)")
+	case passed:
+		fmt.Fprintf(os.Stderr, "verification passed: %s\n", verify)
+	default:
+		fmt.Fprintf(os.Stderr, "verification failed: %s\n%s\n", verify, strings.TrimSpace(editor.verifyLog))
+	}
+
+	applied, err := offerPatch(ctx, ws.root, patchFile, "refactor", passed, *applyFlag)
+	if err != nil {
+		return fail(err)
+	}
+	if !applied {
+		fmt.Fprintf(os.Stderr, "not applied; the patch is %s (git apply it from %s)\n", patchFile, ws.root)
+	}
+	if !passed {
+		return exitError
+	}
+	return exitOK
+}
+
+func refactorEditTask(description, plan, verify string) string {
+	var sb strings.Builder
+	sb.WriteString(refactorEditInstructions + "\n\n## Refactor\n\n" + description + "\n\n## Plan\n\n" + plan + "\n")
+	if verify != "" {
+		sb.WriteString("\n## Verification\n\nThe result must pass: `" + verify + "`\n")
+	}
+	return sb.String()
+}
+
+// refactorFixTask sends the editor back after verify failed. Its changes so
+// far are staged in the worktree.
+func refactorFixTask(description, plan, verify, log string) string {
+	var sb strings.Builder
+	sb.WriteString("You are finishing a refactor across this repository. It has been applied, and its changes are staged ")
+	sb.WriteString("(`git diff --cached` shows them), but verification fails. Fix the failures by completing the refactor; ")
+	sb.WriteString("do not revert it or change unrelated code. Finish with a short summary of the whole change.\n\n")
+	sb.WriteString("## Refactor\n\n" + description + "\n\n## Plan\n\n" + plan + "\n\n")
+	sb.WriteString("## Verification\n\n`" + verify + "` failed:\n```\n" + strings.TrimSpace(log) + "\n```\n")
+	return sb.String()
+}
+
+// printPatch writes the diff to stdout, colored on a terminal.
+func printPatch(patch string) {
+	f, ok := answerOut.(*os.File)
+	if ok && !noColor && term.IsTerminal(int(f.Fd())) {
+		patch = colorDiff(patch, math.MaxInt32)
+	}
+	fmt.Fprint(answerOut, patch)
+}
+
+// confirm asks a yes/no question on the terminal; without one the answer is
+// no.
+func confirm(question string) bool {
+	in, out, err := openTTY()
+	if err != nil {
+		return false
+	}
+	defer in.Close()
+	fmt.Fprintf(out, "\n%s [y/N] ", question)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// splitAgentArgs separates a subcommand's own arguments from the agent
+// flags after "--", which are passed on to its agent runs.
+func splitAgentArgs(args []string) ([]string, []string) {
+	if i := slices.Index(args, "--"); i >= 0 {
+		return args[:i], args[i+1:]
+	}
+	return args, nil
+}
+
+// runAgent runs c on task with the given agent flags, in place of the flags
+// of the parent's command line that runChild passes on.
+func (w *childWorkspace) runAgent(ctx context.Context, c *childRun, name, task string, agentArgs []string, mu *sync.Mutex) error {
+	taskFile, err := w.writeTask(name, task)
+	if err != nil {
+		return err
+	}
+	c.run(ctx, w.exe, append(slices.Clone(agentArgs), "-cwd", c.cwd, "-task-file", taskFile, "-no-input", "-outcome-out", c.outcomeFile), mu)
+	return ctx.Err()
+}
+
+// offerPatch applies patchFile to the workspace at root with -apply when
+// the result passed its checks, or when the user says so at the terminal.
+func offerPatch(ctx context.Context, root, patchFile, what string, passed, apply bool) (bool, error) {
+	switch {
+	case apply:
+		apply = passed
+	case passed:
+		apply = confirm("Apply this " + what + " to " + root + "?")
+	default:
+		apply = confirm("Verification failed. Apply anyway?")
+	}
+	if !apply {
+		return false, nil
+	}
+	if _, err := runGit(ctx, root, "apply", "--binary", "--whitespace=nowarn", patchFile); err != nil {
+		return false, fmt.Errorf("applying %s: %w", patchFile, err)
+	}
+	fmt.Fprintf(os.Stderr, "applied the %s to %s\n", what, root)
+	return true, nil
+}
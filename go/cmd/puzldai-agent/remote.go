@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const remoteCommandTimeout = 60 * time.Second
+const maxRemoteListing = 200_000
+
+// remoteTarget runs tool operations on another machine through the system ssh
+// client. A ControlMaster socket keeps one multiplexed connection open for the
+// whole session instead of reconnecting for every tool call.
+type remoteTarget struct {
+	dest        string
+	port        string
+	root        string
+	controlPath string
+	// realRoot is root with its symlinks resolved on the remote host, what
+	// resolved paths are checked against.
+	realRoot string
+
+	mu sync.Mutex
+	// temps are the directories MkdirTemp made, the only ones outside the
+	// root that RemoveAll removes.
+	temps map[string]bool
+}
+
+func parseRemote(spec string) (*remoteTarget, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote %q: %w", spec, err)
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid remote %q: expected ssh://[user@]host[:port]/path", spec)
+	}
+	root := path.Clean("/" + u.Path)
+	dest := u.Hostname()
+	if u.User != nil && u.User.Username() != "" {
+		dest = u.User.Username() + "@" + dest
+	}
+	return &remoteTarget{dest: dest, port: u.Port(), root: root, temps: map[string]bool{}}, nil
+}
+
+// open prepares the control socket directory and registers its teardown.
+func (r *remoteTarget) open(sess *session) error {
+	dir, err := os.MkdirTemp("", "puzldai-ssh-")
+	if err != nil {
+		return err
+	}
+	r.controlPath = filepath.Join(dir, "cm")
+	sess.onClose(func() {
+		exec.Command("ssh", append(r.sshArgs(), "-O", "exit", r.dest)...).Run()
+		os.RemoveAll(dir)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteCommandTimeout)
+	defer cancel()
+	out, err := r.run(ctx, "test -d "+shellQuote(r.root)+" && realpath -m -- "+shellQuote(r.root), nil)
+	if err != nil {
+		return fmt.Errorf("remote root %s is not reachable: %w", r.root, err)
+	}
+	r.realRoot = strings.TrimSpace(out)
+	return nil
+}
+
+func (r *remoteTarget) command(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ssh", append(r.sshArgs(), r.dest, command)...)
+}
+
+func (r *remoteTarget) sshArgs() []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if r.controlPath != "" {
+		args = append(args,
+			"-o", "ControlMaster=auto",
+			"-o", "ControlPath="+r.controlPath,
+			"-o", "ControlPersist=120",
+		)
+	}
+	if r.port != "" {
+		args = append(args, "-p", r.port)
+	}
+	return args
+}
+
+// run executes command in a remote shell and returns stdout; stderr is
+// folded into the error on failure.
+func (r *remoteTarget) run(ctx context.Context, command string, stdin []byte) (string, error) {
+	cmd := r.command(ctx, command)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return stdout.String(), errors.New(msg)
+	}
+	return stdout.String(), nil
+}
+
+// jail resolves p against the remote root and rejects paths that escape it
+// lexically. It is only the first check: a symlink in the root can still
+// point outside it, so every operation also runs jailScript on the remote.
+func (r *remoteTarget) jail(p string) (string, error) {
+	full := p
+	if !path.IsAbs(p) {
+		full = path.Join(r.root, p)
+	}
+	full = path.Clean(full)
+	if full != r.root && !strings.HasPrefix(full, strings.TrimSuffix(r.root, "/")+"/") {
+		return "", fmt.Errorf("path %s is outside the remote root %s", p, r.root)
+	}
+	return full, nil
+}
+
+// remoteOutside is what jailScript prints on stderr for a path that
+// resolves outside the root.
+const remoteOutside = "puzldai: outside the remote root"
+
+// jailScript starts a remote script: it resolves full with realpath -m, so
+// symlinks are followed even where the path does not exist yet, into
+// $puzldai_path, and exits unless the result is in the resolved root. The
+// operation that follows uses "$puzldai_path", the path that was checked.
+func (r *remoteTarget) jailScript(full string) string {
+	root := shellQuote(strings.TrimSuffix(r.realRoot, "/"))
+	return fmt.Sprintf(`puzldai_path=$(realpath -m -- %s) || exit 1; case "$puzldai_path" in %s|%s/*) ;; *) echo %s >&2; exit 1;; esac; `,
+		shellQuote(full), root, root, shellQuote(remoteOutside))
+}
+
+// resolve returns p as the remote host resolves it, refusing paths outside
+// the root. The result is under the root as given, not the resolved root,
+// so it matches patterns written against the root.
+func (r *remoteTarget) resolve(ctx context.Context, p string) (string, error) {
+	full, err := r.jail(p)
+	if err != nil {
+		return "", err
+	}
+	out, err := r.run(ctx, r.jailScript(full)+`printf '%s' "$puzldai_path"`, nil)
+	if err != nil {
+		return "", remotePathError("resolve", full, err)
+	}
+	if rel := strings.TrimPrefix(out, strings.TrimSuffix(r.realRoot, "/")+"/"); rel != out {
+		return path.Join(r.root, rel), nil
+	}
+	return r.root, nil
+}
+
+func (r *remoteTarget) displayPath(full string) string {
+	if rel := strings.TrimPrefix(full, strings.TrimSuffix(r.root, "/")+"/"); rel != full {
+		return rel
+	}
+	return full
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// bind points tools at the remote host: they work on its file system, in
+// the remote root.
+func (r *remoteTarget) bind(tools []toolDef) []toolDef {
+	where := " on " + r.dest + ":" + r.root
+	for i := range tools {
+		next := tools[i].fn
+		tools[i].description += where
+		tools[i].fn = func(ctx context.Context, _ string, args map[string]any) (string, error) {
+			return next(withWorkspaceFS(ctx, r), r.root, args)
+		}
+	}
+	return tools
+}
+
+// remoteMissing is what the file system scripts print on stderr for a
+// missing path, so it reads as fs.ErrNotExist.
+const remoteMissing = "puzldai: no such file or directory"
+
+// The remote host is a workspaceFS. Paths are jailed to the remote root,
+// lexically here and with symlinks resolved on the host by jailScript.
+
+func (r *remoteTarget) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	full, err := r.jail(p)
+	if err != nil {
+		return nil, err
+	}
+	out, err := r.run(ctx, r.jailScript(full)+fmt.Sprintf(`test -e "$puzldai_path" || { echo %s >&2; exit 1; }; cat -- "$puzldai_path"`, shellQuote(remoteMissing)), nil)
+	if err != nil {
+		return nil, remotePathError("open", full, err)
+	}
+	return []byte(out), nil
+}
+
+func (r *remoteTarget) Open(ctx context.Context, p string) (io.ReadCloser, error) {
+	data, err := r.ReadFile(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return memFile{bytes.NewReader(data)}, nil
+}
+
+func (r *remoteTarget) WriteFile(ctx context.Context, p string, data []byte) error {
+	full, err := r.jail(p)
+	if err != nil {
+		return err
+	}
+	_, err = r.run(ctx, r.jailScript(full)+`mkdir -p -- "$(dirname -- "$puzldai_path")" && cat > "$puzldai_path"`, data)
+	if err != nil {
+		return remotePathError("write", full, err)
+	}
+	return nil
+}
+
+func (r *remoteTarget) Stat(ctx context.Context, p string) (fs.FileInfo, error) {
+	full, err := r.jail(p)
+	if err != nil {
+		return nil, err
+	}
+	out, err := r.run(ctx, r.jailScript(full)+fmt.Sprintf(`test -e "$puzldai_path" || { echo %s >&2; exit 1; }; find -L "$puzldai_path" -maxdepth 0 -printf '%%s\t%%T@\t%%y\t%%m\n' 2>/dev/null || { test -d "$puzldai_path" && echo d || echo f; }`,
+		shellQuote(remoteMissing)), nil)
+	if err != nil {
+		return nil, remotePathError("stat", full, err)
+	}
+	info, _ := parseRemoteEntry(path.Base(full), strings.TrimSpace(out))
+	return info, nil
+}
+
+// Walk lists the tree with one find command and visits it in lexical
+// order. GNU find reports size, mtime, type, and mode; elsewhere only
+// directories are told from files.
+func (r *remoteTarget) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	full, err := r.jail(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	info, err := r.Stat(ctx, full)
+	if err != nil {
+		return fn(full, nil, err)
+	}
+	if err := fn(full, fs.FileInfoToDirEntry(info), nil); err != nil || !info.IsDir() {
+		if err == fs.SkipDir || err == fs.SkipAll {
+			return nil
+		}
+		return err
+	}
+	script := r.jailScript(full) + fmt.Sprintf(`cd "$puzldai_path" && { find . -mindepth 1 -printf '%%P\t%%s\t%%T@\t%%y\t%%m\n' 2>/dev/null || { find . -mindepth 1 -type d -exec printf '%%s\td\n' {} +; find . -mindepth 1 ! -type d; }; } | head -n %d`,
+		maxRemoteListing)
+	out, err := r.run(ctx, script, nil)
+	if err != nil {
+		return fn(full, fs.FileInfoToDirEntry(info), err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	sort.Strings(lines)
+	var skipped []string
+	for _, line := range lines {
+		rel, meta, _ := strings.Cut(line, "\t")
+		rel = strings.TrimPrefix(rel, "./")
+		if rel == "" || slices.ContainsFunc(skipped, func(dir string) bool { return strings.HasPrefix(rel, dir+"/") }) {
+			continue
+		}
+		info, _ := parseRemoteEntry(path.Base(rel), meta)
+		switch err := fn(path.Join(full, rel), fs.FileInfoToDirEntry(info), nil); {
+		case err == fs.SkipDir && info.IsDir():
+			skipped = append(skipped, rel)
+		case err == fs.SkipDir:
+			skipped = append(skipped, path.Dir(rel))
+		case err == fs.SkipAll:
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRemoteEntry reads a "size\tmtime\ttype\tmode" line from GNU find,
+// or a bare "d" or "f" type. It reports whether the metadata was complete.
+func parseRemoteEntry(name, meta string) (fileInfo, bool) {
+	info := fileInfo{name: name, mode: 0o644}
+	fields := strings.Split(meta, "\t")
+	kind := fields[len(fields)-1]
+	if len(fields) == 4 {
+		info.size, _ = strconv.ParseInt(fields[0], 10, 64)
+		if secs, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			info.modTime = time.Unix(0, int64(secs*float64(time.Second)))
+		}
+		if perm, err := strconv.ParseUint(fields[3], 8, 32); err == nil {
+			info.mode = fs.FileMode(perm)
+		}
+		kind = fields[2]
+	}
+	switch kind {
+	case "d":
+		info.mode |= fs.ModeDir
+	case "l":
+		info.mode |= fs.ModeSymlink
+	}
+	return info, len(fields) == 4
+}
+
+func remotePathError(op, path string, err error) error {
+	switch err.Error() {
+	case remoteMissing:
+		err = fs.ErrNotExist
+	case remoteOutside:
+		err = errors.New("outside the remote root")
+	}
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
+
+// Inside compares the paths as the remote host resolves them.
+func (r *remoteTarget) Inside(ctx context.Context, dir, p string) bool {
+	out, err := r.run(ctx, "realpath -m -- "+shellQuote(dir)+" "+shellQuote(p), nil)
+	if err != nil {
+		return false
+	}
+	resolved := strings.Split(strings.TrimSpace(out), "\n")
+	if len(resolved) != 2 {
+		return false
+	}
+	dir, p = resolved[0], resolved[1]
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+func (r *remoteTarget) Command(ctx context.Context, dir, name string, args ...string) (*exec.Cmd, error) {
+	quoted := make([]string, 0, len(args)+1)
+	for _, a := range append([]string{name}, args...) {
+		quoted = append(quoted, shellQuote(a))
+	}
+	return r.Shell(ctx, dir, "exec "+strings.Join(quoted, " "))
+}
+
+// Shell runs command in the remote user's login shell.
+func (r *remoteTarget) Shell(ctx context.Context, dir, command string) (*exec.Cmd, error) {
+	full, err := r.jail(dir)
+	if err != nil {
+		return nil, err
+	}
+	return r.command(ctx, r.jailScript(full)+`cd "$puzldai_path" && `+command), nil
+}
+
+func (r *remoteTarget) LookPath(ctx context.Context, name string) error {
+	if _, err := r.run(ctx, "command -v "+shellQuote(name), nil); err != nil {
+		return fmt.Errorf("%s is not installed on %s", name, r.dest)
+	}
+	return nil
+}
+
+func (r *remoteTarget) MkdirTemp(ctx context.Context, pattern string) (string, error) {
+	out, err := r.run(ctx, fmt.Sprintf(`mktemp -d "${TMPDIR:-/tmp}"/%s`, shellQuote(pattern+"XXXXXX")), nil)
+	if err != nil {
+		return "", err
+	}
+	dir := strings.TrimSpace(out)
+	r.mu.Lock()
+	r.temps[dir] = true
+	r.mu.Unlock()
+	return dir, nil
+}
+
+func (r *remoteTarget) RemoveAll(ctx context.Context, dir string) error {
+	r.mu.Lock()
+	ok := r.temps[dir]
+	delete(r.temps, dir)
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s was not made by this session", dir)
+	}
+	_, err := r.run(ctx, "rm -rf -- "+shellQuote(dir), nil)
+	return err
+}
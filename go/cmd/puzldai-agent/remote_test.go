@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoteJailScript(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "inner")); err != nil {
+		t.Fatal(err)
+	}
+	r := &remoteTarget{root: root, realRoot: root}
+
+	tests := []struct {
+		path string
+		want string // resolved path, or "" when refused
+	}{
+		{"file", filepath.Join(root, "file")},
+		{"new/dir/file", filepath.Join(root, "new/dir/file")},
+		{"inner/file", filepath.Join(root, "sub/file")},
+		{"link", ""},
+		{"link/file", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			full, err := r.jail(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := exec.Command("sh", "-c", r.jailScript(full)+`printf '%s' "$puzldai_path"`).CombinedOutput()
+			if tt.want == "" {
+				if err == nil || strings.TrimSpace(string(out)) != remoteOutside {
+					t.Fatalf("got %q, %v; want refused", out, err)
+				}
+				return
+			}
+			if err != nil || string(out) != tt.want {
+				t.Fatalf("got %q, %v; want %q", out, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteJailLexical(t *testing.T) {
+	r := &remoteTarget{root: "/srv/app"}
+	for _, p := range []string{"../etc/passwd", "/srv/app-other/x", "/etc", "a/../../b"} {
+		if full, err := r.jail(p); err == nil {
+			t.Errorf("jail(%q) = %q, want an error", p, full)
+		}
+	}
+	if full, err := r.jail("a/./b/../c"); err != nil || full != "/srv/app/a/c" {
+		t.Errorf("jail(a/./b/../c) = %q, %v", full, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/glamour"
+	"golang.org/x/term"
+)
+
+const maxRenderWidth = 120
+
+// noColor is set by -no-color or NO_COLOR: answers are printed as plain
+// text and the TUI is monochrome.
+var noColor bool
+
+// printAnswer writes the final answer to stdout. On a terminal the model's
+// markdown is rendered, with headings, lists, and syntax-highlighted code
+// fences; piped output, -ci, -no-color, and JSON answers pass through
+// byte for byte.
+func printAnswer(text string) {
+	defer copyResult(text)
+	if out, ok := renderMarkdown(text); ok {
+		fmt.Fprint(answerOut, out)
+		return
+	}
+	fmt.Fprintln(answerOut, strings.TrimSuffix(text, "\n"))
+}
+
+func renderMarkdown(text string) (string, bool) {
+	f, ok := answerOut.(*os.File)
+	if !ok || noColor || ciMode || !term.IsTerminal(int(f.Fd())) || json.Valid([]byte(text)) {
+		return "", false
+	}
+	width := maxRenderWidth
+	if w, _, err := term.GetSize(int(f.Fd())); err == nil && w > 0 {
+		width = min(w, maxRenderWidth)
+	}
+	// GLAMOUR_STYLE picks a style (dark, light, notty, or a JSON file); the
+	// default follows the terminal background.
+	r, err := glamour.NewTermRenderer(glamour.WithEnvironmentConfig(), glamour.WithWordWrap(width))
+	if err != nil {
+		return "", false
+	}
+	out, err := r.Render(text)
+	if err != nil {
+		return "", false
+	}
+	return out, true
+}
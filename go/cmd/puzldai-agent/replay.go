@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// replayPreview bounds each prompt, reply, and result printed by replay
+// unless -full is given.
+const replayPreview = 2_000
+
+// replayTurn is one model turn of a saved session: what was sent since the
+// previous reply, the reply, and the results of its tool calls.
+type replayTurn struct {
+	prompt  []agentMessage
+	reply   *agentMessage
+	calls   []toolCall
+	results []toolResult
+}
+
+func replayTurns(messages []agentMessage) []replayTurn {
+	var turns []replayTurn
+	var prompt []agentMessage
+	for i := 0; i < len(messages); i++ {
+		if messages[i].role != "assistant" {
+			prompt = append(prompt, messages[i])
+			continue
+		}
+		turn := replayTurn{prompt: prompt, reply: &messages[i], calls: messages[i].toolCalls}
+		prompt = nil
+		if i+1 < len(messages) && messages[i+1].role == "tool" {
+			turn.results = messages[i+1].toolResults
+			i++
+		}
+		if len(turn.calls) == 0 && len(turn.results) > 0 {
+			turn.calls = textProtocolCalls(turn.reply.content, turn.results)
+		}
+		turns = append(turns, turn)
+	}
+	if len(prompt) > 0 {
+		// Sent, but the run ended before the model answered.
+		turns = append(turns, replayTurn{prompt: prompt})
+	}
+	return turns
+}
+
+// textProtocolCalls recovers the calls of a reply that wrote them as tool
+// blocks; the session keeps only their results, which ran in order.
+func textProtocolCalls(content string, results []toolResult) []toolCall {
+	calls := parseToolCalls(content)
+	if len(calls) != len(results) {
+		return nil
+	}
+	for i := range calls {
+		if calls[i].name != results[i].name {
+			return nil
+		}
+		calls[i].id = results[i].id
+	}
+	return calls
+}
+
+// replayer prints a session and re-runs its tool calls on request.
+type replayer struct {
+	out   io.Writer
+	full  bool
+	cwd   string
+	tools []toolDef
+	// entry numbers the editable entries for -what-if.
+	entry int
+}
+
+const replayUsage = "usage: puzldai-agent replay [-exec] [-all] [-full] [-cwd dir] [-approval mode] <session-id>"
+
+func runReplay(args []string) int {
+	fs := newFlagSet("replay")
+	execFlag := fs.Bool("exec", false, "Re-run every tool call against the current workspace and show where the results differ")
+	allFlag := fs.Bool("all", false, "Print the whole session without pausing between turns")
+	fullFlag := fs.Bool("full", false, "Print prompts, replies, and results in full")
+	cwdFlag := fs.String("cwd", "", "Workspace to re-run tools in (default: the session's)")
+	approvalFlag := fs.String("approval", approvalPrompt, "Approval mode for re-run tools: prompt, auto, or deny")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, replayUsage)
+		return exitUsage
+	}
+	saved, err := loadSession(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return exitError
+	}
+	cwd := firstNonEmpty(*cwdFlag, saved.Cwd)
+	cfg, err := loadConfig(cwd, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay: failed to load config:", err)
+		return exitError
+	}
+	approver, err := newApprover(*approvalFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return exitUsage
+	}
+	sess := newSession(cwd, approver)
+	defer sess.close()
+	r := &replayer{out: os.Stdout, full: *fullFlag, cwd: cwd, tools: defaultTools(cfg, sess)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Fprintf(r.out, "session %s: %s, %s/%s, %s\n", saved.ID, saved.Cwd, saved.Provider, saved.Model, saved.Status)
+	switch {
+	case saved.System != "" && r.full:
+		r.section("[0] system prompt", saved.System)
+	case saved.System != "":
+		fmt.Fprintf(r.out, "[0] system prompt: %d bytes; -full shows it\n", len(saved.System))
+	}
+	turns := replayTurns(saved.agentMessages())
+	step := !*allFlag && term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+	in := bufio.NewReader(os.Stdin)
+	for i, turn := range turns {
+		fmt.Fprintf(r.out, "\n=== turn %d of %d ===\n", i+1, len(turns))
+		r.print(turn)
+		if *execFlag {
+			r.rerun(ctx, turn)
+		}
+		if !step || i == len(turns)-1 {
+			continue
+		}
+	prompt:
+		for {
+			fmt.Fprint(r.out, "\n[enter] next  [r] re-run tools  [c] continue  [q] quit: ")
+			line, err := in.ReadString('\n')
+			if err != nil {
+				return exitOK
+			}
+			switch strings.TrimSpace(line) {
+			case "":
+				break prompt
+			case "r":
+				r.rerun(ctx, turn)
+			case "c":
+				step = false
+				break prompt
+			case "q":
+				return exitOK
+			}
+		}
+	}
+	return exitOK
+}
+
+func (r *replayer) print(turn replayTurn) {
+	for _, m := range turn.prompt {
+		switch m.role {
+		case "tool":
+			// Results the model had not seen a reply to; normally they
+			// belong to the previous turn.
+			for _, res := range m.toolResults {
+				r.entry++
+				r.result(r.entry, res)
+			}
+		default:
+			r.entry++
+			r.section(fmt.Sprintf("[%d] %s", r.entry, m.role), m.content)
+		}
+	}
+	if turn.reply == nil {
+		fmt.Fprintln(r.out, "\n(no reply: the run ended here)")
+		return
+	}
+	if strings.TrimSpace(turn.reply.content) != "" {
+		r.section("model", turn.reply.content)
+	}
+	// Entries follow the order the results were saved in.
+	base := r.entry
+	r.entry += len(turn.results)
+	for _, call := range turn.calls {
+		fmt.Fprintf(r.out, "\n--- call %s: %s\n", call.id, describeCalls([]toolCall{call}))
+		if i := slices.IndexFunc(turn.results, func(res toolResult) bool { return res.id == call.id }); i >= 0 {
+			r.result(base+i+1, turn.results[i])
+		} else {
+			fmt.Fprintln(r.out, "(no result recorded)")
+		}
+	}
+	for i, res := range turn.results {
+		if !slices.ContainsFunc(turn.calls, func(c toolCall) bool { return c.id == res.id }) {
+			r.result(base+i+1, res)
+		}
+	}
+}
+
+func (r *replayer) result(entry int, res toolResult) {
+	label := fmt.Sprintf("[%d] result %s", entry, res.id)
+	if res.isError {
+		label += " (error)"
+	}
+	r.section(label, res.content)
+}
+
+func (r *replayer) section(label, text string) {
+	if !r.full {
+		text = truncateOutput(text, replayPreview)
+	}
+	fmt.Fprintf(r.out, "\n--- %s\n%s\n", label, strings.TrimRight(text, "\n"))
+}
+
+// rerun runs the turn's tool calls again in the replay workspace and shows
+// how each result differs from the recorded one. Writes and commands take
+// effect; they go through the approval mode like in a run.
+func (r *replayer) rerun(ctx context.Context, turn replayTurn) {
+	if turn.reply == nil || len(turn.calls) == 0 {
+		fmt.Fprintln(r.out, "\n(no tool calls to re-run)")
+		return
+	}
+	recorded := map[string]toolResult{}
+	for _, res := range turn.results {
+		recorded[res.id] = res
+	}
+	for _, call := range turn.calls {
+		if _, ok := findTool(r.tools, call.name); !ok {
+			fmt.Fprintf(r.out, "\n--- re-run %s: %s is only available during a run; skipped\n", call.id, call.name)
+			continue
+		}
+		fresh := runTools(ctx, r.cwd, r.tools, []toolCall{call})
+		if len(fresh) == 0 {
+			continue
+		}
+		before, ok := recorded[call.id]
+		switch {
+		case !ok:
+			r.section("re-run "+call.id+" (nothing recorded to compare)", fresh[0].content)
+		case before.content == fresh[0].content && before.isError == fresh[0].isError:
+			fmt.Fprintf(r.out, "\n--- re-run %s: same result as recorded\n", call.id)
+		case before.content == fresh[0].content:
+			fmt.Fprintf(r.out, "\n--- re-run %s: same output, but the error status changed\n", call.id)
+		default:
+			fmt.Fprintf(r.out, "\n--- re-run %s: result differs from the recording\n%s", call.id, unifiedDiff("result-"+call.id, before.content, fresh[0].content))
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRepoMapTokens = 1024
+	// repoMapMaxFiles bounds the walk so huge trees do not stall startup.
+	repoMapMaxFiles   = 20_000
+	repoMapMaxParse   = 512 << 10
+	repoMapMaxSymbols = 12
+	repoMapMaxDirs    = 15
+	repoMapMaxLoose   = 15
+	// repoMapRefreshEvery spaces out rescans, since each change to the
+	// system prompt invalidates the provider's prompt cache.
+	repoMapRefreshEvery = 30 * time.Second
+)
+
+// repoMapSkipDirs are dependency and build directories left out of the map.
+var repoMapSkipDirs = map[string]bool{
+	"node_modules": true, "vendor": true, "dist": true, "build": true,
+	"target": true, "__pycache__": true, "venv": true,
+}
+
+// symbolPatterns find exported top-level symbols in non-Go sources.
+var symbolPatterns = map[string]*regexp.Regexp{
+	".ts":   regexp.MustCompile(`(?m)^export\s+(?:default\s+)?(?:declare\s+)?(?:abstract\s+)?(?:async\s+)?(?:function\*?|class|const|let|var|interface|type|enum)\s+([A-Za-z_$][\w$]*)`),
+	".py":   regexp.MustCompile(`(?m)^(?:async\s+)?(?:def|class)\s+([A-Za-z]\w*)`),
+	".rs":   regexp.MustCompile(`(?m)^pub\s+(?:async\s+)?(?:fn|struct|enum|trait|type|const|static|mod)\s+(\w+)`),
+	".java": regexp.MustCompile(`(?m)^public\s+(?:abstract\s+|final\s+)*(?:class|interface|enum|record)\s+(\w+)`),
+}
+
+func init() {
+	for _, ext := range []string{".tsx", ".js", ".jsx", ".mjs"} {
+		symbolPatterns[ext] = symbolPatterns[".ts"]
+	}
+}
+
+// repoMap summarizes the workspace for the system prompt: top-level layout,
+// the packages with the most exported symbols, and symbols per file, cut to
+// a token budget. Symbols are cached by size and mtime, so refresh only
+// re-parses files that changed.
+type repoMap struct {
+	root   string
+	budget int // tokens, by estimateTextTokens
+	ignore *ignoreRules
+	cache  map[string]repoFile
+	stamp  string
+	text   string
+	// dirty is set by touch when a turn may have changed files; scanned is
+	// when the tree was last walked.
+	dirty   bool
+	scanned time.Time
+}
+
+type repoFile struct {
+	size    int64
+	mod     time.Time
+	symbols []string
+}
+
+func newRepoMap(root string, tokens int, ignore *ignoreRules) *repoMap {
+	return &repoMap{root: root, budget: tokens, ignore: ignore, cache: map[string]repoFile{}}
+}
+
+// refresh rescans the tree and reports whether the map changed.
+func (m *repoMap) refresh() (string, bool) {
+	files, stamp := m.scan()
+	m.dirty, m.scanned = false, time.Now()
+	if stamp == m.stamp {
+		return m.text, false
+	}
+	m.stamp = stamp
+	text := m.render(files)
+	if text == m.text {
+		return m.text, false
+	}
+	m.text = text
+	return m.text, true
+}
+
+// touch marks the map stale after a turn that may have changed files: one
+// that wrote through a file tool or ran bash, or one after which the
+// watcher saw changes from outside the agent.
+func (m *repoMap) touch(calls []toolCall, external bool) {
+	for _, c := range calls {
+		if c.name == "bash" || pathArgs[c.name].write {
+			external = true
+		}
+	}
+	m.dirty = m.dirty || external
+}
+
+// update refreshes a stale map, at most once per repoMapRefreshEvery; a map
+// left stale is refreshed on a later turn.
+func (m *repoMap) update() (string, bool) {
+	if !m.dirty || time.Since(m.scanned) < repoMapRefreshEvery {
+		return m.text, false
+	}
+	return m.refresh()
+}
+
+func (m *repoMap) scan() ([]string, string) {
+	var files []string
+	seen := map[string]bool{}
+	var total int64
+	var newest time.Time
+	_ = filepath.WalkDir(m.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if p != m.root && (strings.HasPrefix(name, ".") || repoMapSkipDirs[name] || m.ignore.hidden(p, true)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, ".") || !d.Type().IsRegular() || m.ignore.hidden(p, false) {
+			return nil
+		}
+		if len(files) >= repoMapMaxFiles {
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(m.root, p)
+		rel = filepath.ToSlash(rel)
+		files = append(files, rel)
+		seen[rel] = true
+		total += info.Size()
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		cached, ok := m.cache[rel]
+		if !ok || cached.size != info.Size() || !cached.mod.Equal(info.ModTime()) {
+			m.cache[rel] = repoFile{size: info.Size(), mod: info.ModTime(), symbols: fileSymbols(p, info.Size())}
+		}
+		return nil
+	})
+	for rel := range m.cache {
+		if !seen[rel] {
+			delete(m.cache, rel)
+		}
+	}
+	return files, fmt.Sprintf("%d/%d/%d", len(files), total, newest.UnixNano())
+}
+
+func (m *repoMap) render(files []string) string {
+	if len(files) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("# Repository Map\n\nLayout:\n")
+	top := map[string]int{}
+	var topNames []string
+	for _, f := range files {
+		name, _, isDir := strings.Cut(f, "/")
+		if isDir {
+			name += "/"
+		}
+		if _, ok := top[name]; !ok {
+			topNames = append(topNames, name)
+		}
+		top[name]++
+	}
+	sort.Strings(topNames)
+	looseFiles := 0
+	for _, name := range topNames {
+		switch {
+		case strings.HasSuffix(name, "/"):
+			fmt.Fprintf(&sb, "  %s (%d files)\n", name, top[name])
+		case looseFiles < repoMapMaxLoose:
+			fmt.Fprintf(&sb, "  %s\n", name)
+			looseFiles++
+		default:
+			looseFiles++
+		}
+	}
+	if looseFiles > repoMapMaxLoose {
+		fmt.Fprintf(&sb, "  ... %d more top-level files\n", looseFiles-repoMapMaxLoose)
+	}
+
+	withSymbols := make([]string, 0, len(files))
+	perDir := map[string]int{}
+	for _, f := range files {
+		if n := len(m.cache[f].symbols); n > 0 {
+			withSymbols = append(withSymbols, f)
+			perDir[path.Dir(f)] += n
+		}
+	}
+	if len(perDir) > 0 {
+		dirs := make([]string, 0, len(perDir))
+		for d := range perDir {
+			dirs = append(dirs, d)
+		}
+		sort.Slice(dirs, func(i, j int) bool {
+			if perDir[dirs[i]] != perDir[dirs[j]] {
+				return perDir[dirs[i]] > perDir[dirs[j]]
+			}
+			return dirs[i] < dirs[j]
+		})
+		sb.WriteString("\nKey packages (exported symbols):\n")
+		for _, d := range dirs[:min(len(dirs), repoMapMaxDirs)] {
+			fmt.Fprintf(&sb, "  %s (%d)\n", d, perDir[d])
+		}
+	}
+
+	// Shallow files first: entry points and package roots orient the model
+	// better than deeply nested helpers when the budget runs out.
+	sort.SliceStable(withSymbols, func(i, j int) bool {
+		return strings.Count(withSymbols[i], "/") < strings.Count(withSymbols[j], "/")
+	})
+	if len(withSymbols) > 0 {
+		sb.WriteString("\nSymbols:\n")
+	}
+	used := estimateTextTokens(sb.String())
+	for i, f := range withSymbols {
+		symbols := m.cache[f].symbols
+		line := "  " + f + ": " + strings.Join(symbols[:min(len(symbols), repoMapMaxSymbols)], ", ")
+		if len(symbols) > repoMapMaxSymbols {
+			line += fmt.Sprintf(", ... (+%d)", len(symbols)-repoMapMaxSymbols)
+		}
+		cost := estimateTextTokens(line) + 1
+		if used+cost > m.budget {
+			fmt.Fprintf(&sb, "  ... %d more files (use glob and grep to explore)\n", len(withSymbols)-i)
+			break
+		}
+		sb.WriteString(line + "\n")
+		used += cost
+	}
+	return sb.String()
+}
+
+// definitions lists the files, as of the last scan, whose exported symbols
+// include name.
+func (m *repoMap) definitions(name string) []string {
+	var out []string
+	for rel, f := range m.cache {
+		for _, s := range f.symbols {
+			if s == name {
+				out = append(out, rel)
+				break
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// fileSymbols lists the exported top-level symbols of a source file.
+func fileSymbols(p string, size int64) []string {
+	ext := filepath.Ext(p)
+	pattern := symbolPatterns[ext]
+	if (ext != ".go" && pattern == nil) || size > repoMapMaxParse {
+		return nil
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	if ext == ".go" {
+		return goSymbols(p, data)
+	}
+	var out []string
+	for _, m := range pattern.FindAllSubmatch(data, -1) {
+		name := string(m[1])
+		if ext == ".py" && strings.HasPrefix(name, "_") {
+			continue
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+func goSymbols(p string, data []byte) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), p, data, parser.SkipObjectResolution)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() {
+				continue
+			}
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				out = append(out, receiverName(d.Recv.List[0].Type)+"."+d.Name.Name)
+			} else {
+				out = append(out, d.Name.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if s.Name.IsExported() {
+						out = append(out, s.Name.Name)
+					}
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						if n.IsExported() {
+							out = append(out, n.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverName(t.X)
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return "?"
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetestRuns = 10
+	maxRetestRuns     = 100
+	// retestRunTimeout bounds one run of the test binary, so a deadlock
+	// shows as a failure instead of stalling the tool.
+	retestRunTimeout = 2 * time.Minute
+	// maxFailureShapes bounds the distinct failure outputs shown, and
+	// maxFailureOutput each of them.
+	maxFailureShapes = 4
+	maxFailureOutput = 2_000
+)
+
+var (
+	testNameRe     = regexp.MustCompile(`^[\w/]+$`)
+	testFailRe     = regexp.MustCompile(`^\s*--- FAIL: (\S+)`)
+	shuffleSeedRe  = regexp.MustCompile(`-test\.shuffle (\d+)`)
+	volatileTestRe = regexp.MustCompile(`\(\d+(?:\.\d+)?s\)|0x[0-9a-f]+|goroutine \d+|-test\.shuffle \d+|\d+(?:\.\d+)?(?:ns|µs|ms|s)\b`)
+)
+
+// retestFailure is one distinct failure output and the runs that gave it.
+type retestFailure struct {
+	output string
+	runs   []int
+	seeds  []string
+}
+
+// toolRetest reruns a Go test many times from one compiled test binary and
+// reports how often it failed, which subtests failed, and the distinct
+// failure outputs, so flaky tests are judged on more than one run.
+func toolRetest(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	test, _ := argString(args, "test")
+	if strings.TrimSpace(test) == "" {
+		return "", errors.New("retest: missing test")
+	}
+	dir := cwd
+	if pkg, ok := argString(args, "package"); ok && pkg != "" {
+		dir = resolvePath(cwd, pkg)
+	}
+	runs, _ := argInt(args, "count")
+	if runs < 1 {
+		runs = defaultRetestRuns
+	}
+	runs = min(runs, maxRetestRuns)
+	race, shuffle := argBool(args, "race"), argBool(args, "shuffle")
+
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	fsys := workspaceFSFrom(ctx)
+	tmp, err := fsys.MkdirTemp(ctx, "puzldai-retest-")
+	if err != nil {
+		return "", err
+	}
+	defer fsys.RemoveAll(context.Background(), tmp)
+	binary := filepath.Join(tmp, "pkg.test")
+	build := []string{"test", "-c", "-o", binary}
+	if race {
+		build = append(build, "-race")
+	}
+	cmd, err := fsys.Command(ctx, dir, "go", append(build, ".")...)
+	if err != nil {
+		return "", fmt.Errorf("retest: %w", err)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return string(out), fmt.Errorf("retest: building the tests failed: %w", err)
+	}
+	if _, err := fsys.Stat(ctx, binary); err != nil {
+		return "", fmt.Errorf("retest: %s has no test files", displayPath(cwd, dir))
+	}
+
+	pattern := retestPattern(test)
+	testArgs := []string{"-test.run", pattern, "-test.count", "1", "-test.v", "-test.timeout", retestRunTimeout.String()}
+	if shuffle {
+		testArgs = append(testArgs, "-test.shuffle", "on")
+	}
+	passed := 0
+	failedTests := map[string]int{}
+	var failures []*retestFailure
+	byShape := map[string]*retestFailure{}
+	for run := 1; run <= runs; run++ {
+		cmd, err := fsys.Command(ctx, dir, binary, testArgs...)
+		if err != nil {
+			return "", fmt.Errorf("retest: %w", err)
+		}
+		out, err := cmd.CombinedOutput()
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("retest: stopped after %d of %d runs: %w", run-1, runs, ctx.Err())
+		}
+		output := string(out)
+		if run == 1 && strings.Contains(output, "testing: warning: no tests to run") {
+			return "", fmt.Errorf("retest: no test in %s matches %s", displayPath(cwd, dir), pattern)
+		}
+		if err == nil {
+			passed++
+			continue
+		}
+		seen := map[string]bool{}
+		for _, line := range strings.Split(output, "\n") {
+			if m := testFailRe.FindStringSubmatch(line); m != nil && !seen[m[1]] {
+				seen[m[1]] = true
+				failedTests[m[1]]++
+			}
+		}
+		shape := volatileTestRe.ReplaceAllString(failureOutput(output), "_")
+		f := byShape[shape]
+		if f == nil {
+			f = &retestFailure{output: failureOutput(output)}
+			byShape[shape] = f
+			failures = append(failures, f)
+		}
+		f.runs = append(f.runs, run)
+		if m := shuffleSeedRe.FindStringSubmatch(output); m != nil {
+			f.seeds = append(f.seeds, m[1])
+		}
+	}
+
+	var sb strings.Builder
+	var mode []string
+	if race {
+		mode = append(mode, "-race")
+	}
+	if shuffle {
+		mode = append(mode, "shuffled order")
+	}
+	fmt.Fprintf(&sb, "%s in %s: %d of %d runs passed, %d failed", test, displayPath(cwd, dir), passed, runs, runs-passed)
+	if len(mode) > 0 {
+		fmt.Fprintf(&sb, " (%s)", strings.Join(mode, ", "))
+	}
+	sb.WriteString("\n")
+	if passed == runs {
+		return sb.String(), nil
+	}
+	if len(failedTests) > 0 {
+		names := make([]string, 0, len(failedTests))
+		for name := range failedTests {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if failedTests[names[i]] != failedTests[names[j]] {
+				return failedTests[names[i]] > failedTests[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		sb.WriteString("\nfailed tests:\n")
+		for _, name := range names {
+			fmt.Fprintf(&sb, "  %s: %d of %d runs\n", name, failedTests[name], runs)
+		}
+	}
+	sort.SliceStable(failures, func(i, j int) bool { return len(failures[i].runs) > len(failures[j].runs) })
+	fmt.Fprintf(&sb, "\n%d distinct failure output(s):\n", len(failures))
+	for i, f := range failures {
+		if i == maxFailureShapes {
+			fmt.Fprintf(&sb, "\n... %d more\n", len(failures)-i)
+			break
+		}
+		fmt.Fprintf(&sb, "\n[%d run(s): %s", len(f.runs), joinInts(f.runs))
+		if len(f.seeds) > 0 {
+			fmt.Fprintf(&sb, "; go test -shuffle %s repeats the first order", f.seeds[0])
+		}
+		sb.WriteString("]\n" + f.output + "\n")
+	}
+	return sb.String(), nil
+}
+
+// retestPattern anchors each level of a plain test name, so TestFoo does
+// not also run TestFooBar; anything else is used as a -run regexp as is.
+func retestPattern(test string) string {
+	if !testNameRe.MatchString(test) {
+		return test
+	}
+	parts := strings.Split(test, "/")
+	for i, p := range parts {
+		parts[i] = "^" + p + "$"
+	}
+	return strings.Join(parts, "/")
+}
+
+// failureOutput keeps what explains a failed run: the output without the
+// progress lines and the shuffle seed, capped from the start, where a panic
+// names its cause.
+func failureOutput(output string) string {
+	var kept []string
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "=== RUN") || strings.HasPrefix(trimmed, "=== PAUSE") ||
+			strings.HasPrefix(trimmed, "=== CONT") || strings.HasPrefix(trimmed, "--- PASS") ||
+			strings.HasPrefix(trimmed, "-test.shuffle") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	out := strings.TrimSpace(strings.Join(kept, "\n"))
+	if len(out) > maxFailureOutput {
+		out = out[:maxFailureOutput] + "\n..."
+	}
+	return out
+}
+
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprint(v)
+	}
+	return strings.Join(s, ", ")
+}
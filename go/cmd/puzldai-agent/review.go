@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultReviewRounds = 2
+	reviewMaxIters      = 8
+	maxReviewDiffBytes  = 60_000
+)
+
+var verdictRe = regexp.MustCompile(`(?im)^\s*\**VERDICT:?\**:?\s*(approve|revise)\b[\s:.-]*(.*)$`)
+
+const reviewInstructions = `
+
+# Review
+
+You are reviewing another agent's work. You may read files but not change them.
+Check the diff against the task: correctness, missed requirements, bugs, and
+edge cases. Ignore style preferences.
+
+End your reply with exactly one verdict line:
+VERDICT: approve
+or
+VERDICT: revise
+followed by a numbered list of concrete objections, each naming the file and
+what must change.`
+
+// reviewer runs a second model with read-only tools over the task and the
+// workspace diff after the primary agent finishes. Objections are sent back
+// into the loop, for at most rounds revisions.
+type reviewer struct {
+	llm       provider
+	model     string
+	tools     []toolDef
+	maxTokens int
+	rounds    int
+	used      int
+	root      string
+	baseline  string
+	// overlay holds the changes of an -emit patch run, which the
+	// workspace does not show.
+	overlay *overlay
+}
+
+// newReviewer snapshots the workspace so the review sees only this run's
+// changes. Outside a git repository the review gets the answer alone.
+func newReviewer(llm provider, model string, tools []toolDef, maxTokens, rounds int, cwd string, local bool) *reviewer {
+	r := &reviewer{llm: llm, model: model, maxTokens: maxTokens, rounds: rounds}
+	for _, t := range tools {
+		switch t.name {
+		case "view", "glob", "grep":
+			r.tools = append(r.tools, t)
+		}
+	}
+	if !local {
+		return r
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	root, err := gitRoot(ctx, cwd)
+	if err == nil {
+		r.baseline, err = snapshotWorktree(ctx, root, "puzldai review baseline")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "review: no diff available:", err)
+		return r
+	}
+	r.root = root
+	return r
+}
+
+// review returns the reviewer's objections, or "" when it approves, fails,
+// or the revision rounds are used up.
+func (r *reviewer) review(ctx context.Context, cwd, task, answer string) string {
+	if r.used >= r.rounds {
+		fmt.Fprintf(os.Stderr, "review: %d revision round(s) used; accepting the result\n", r.rounds)
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("## Task\n\n" + task + "\n\n## Agent's final answer\n\n" + answer + "\n\n## Diff\n\n")
+	diff, err := r.diff(ctx)
+	switch {
+	case err != nil:
+		sb.WriteString("(diff unavailable: " + err.Error() + "; inspect the files directly)\n")
+	case diff == "":
+		sb.WriteString("(no file changes)\n")
+	default:
+		sb.WriteString("```diff\n" + strings.TrimRight(truncateOutput(diff, maxReviewDiffBytes), "\n") + "\n```\n")
+	}
+
+	system := buildSystemPrompt(cwd, r.tools) + untrustedInstructions + reviewInstructions
+	messages := []agentMessage{{role: "user", content: sb.String()}}
+	// The reviewer's views are deduplicated within its own transcript;
+	// sharing the agent's would point each side at calls it never saw.
+	ctx = withViewDedup(ctx, newViewDedup(resultsIn(&messages)))
+	for i := 0; i < reviewMaxIters; i++ {
+		resp, err := r.llm.complete(ctx, completionRequest{
+			model:     r.model,
+			system:    system,
+			messages:  messages,
+			tools:     r.tools,
+			maxTokens: r.maxTokens,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "review: provider error, accepting the result:", err)
+			return ""
+		}
+		calls := resp.toolCalls
+		if len(calls) == 0 {
+			calls = parseToolCalls(resp.text)
+		}
+		if len(calls) == 0 {
+			return r.verdict(resp.text)
+		}
+		messages = append(messages,
+			agentMessage{role: "assistant", content: resp.text, toolCalls: resp.toolCalls},
+			agentMessage{role: "tool", toolResults: runTools(ctx, cwd, r.tools, calls)},
+		)
+	}
+	fmt.Fprintln(os.Stderr, "review: reviewer gave no verdict; accepting the result")
+	return ""
+}
+
+func (r *reviewer) verdict(text string) string {
+	m := verdictRe.FindStringSubmatchIndex(text)
+	if m == nil {
+		fmt.Fprintln(os.Stderr, "review: reviewer gave no verdict; accepting the result")
+		return ""
+	}
+	if strings.EqualFold(text[m[2]:m[3]], "approve") {
+		fmt.Fprintln(os.Stderr, "review: approved")
+		return ""
+	}
+	r.used++
+	objections := strings.TrimSpace(text[m[4]:])
+	if objections == "" {
+		objections = strings.TrimSpace(text[:m[0]])
+	}
+	fmt.Fprintf(os.Stderr, "review: revision requested (round %d of %d)\n", r.used, r.rounds)
+	return fmt.Sprintf("[reviewer] A reviewer (%s) checked your changes and requested revisions (round %d of %d):\n\n%s\n\n"+
+		"Address each objection, or explain why it does not apply, then give your final answer again.",
+		r.model, r.used, r.rounds, objections)
+}
+
+func (r *reviewer) diff(ctx context.Context) (string, error) {
+	if r.overlay != nil {
+		patch, _, err := r.overlay.patch(ctx)
+		return patch, err
+	}
+	if r.root == "" {
+		return "", fmt.Errorf("workspace is not a local git repository")
+	}
+	current, err := snapshotWorktree(ctx, r.root, "puzldai review")
+	if err != nil {
+		return "", err
+	}
+	return runGit(ctx, r.root, "diff", r.baseline, current)
+}
+
+// reviewable skips outcomes where the agent reported it could not finish.
+func reviewable(o agentOutcome) bool {
+	return o.Status != outcomeBlocked && o.Status != outcomeNeedsInput
+}
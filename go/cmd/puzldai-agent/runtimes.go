@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	// toolVersionTimeout bounds a --version probe.
+	toolVersionTimeout = 5 * time.Second
+	bootstrapTimeout   = 10 * time.Minute
+	// sandboxEnv marks the environment as disposable, so -bootstrap may
+	// install tools in it.
+	sandboxEnv = "PUZLDAI_SANDBOX"
+)
+
+var (
+	goDirectiveRe = regexp.MustCompile(`(?m)^go\s+(\d+(?:\.\d+){1,2})\s*$`)
+	versionRe     = regexp.MustCompile(`\d+(?:\.\d+)*`)
+)
+
+// projectRuntime is a project found at session start: its language, the
+// tools it needs, and the commands that build, test, and lint it.
+type projectRuntime struct {
+	language string
+	dir      string // relative to the workspace, "." for the root
+	manifest string
+	tools    []runtimeTool
+	commands []projectCommand
+	notes    []string
+}
+
+type projectCommand struct {
+	kind    string // build, test, lint, typecheck, format
+	command string
+}
+
+// runtimeTool is a program a project needs, with how to get it when it is
+// missing. install is empty when there is no safe way to.
+type runtimeTool struct {
+	name    string
+	why     string
+	version string
+	missing bool
+	install string
+}
+
+// detectRuntimes looks for Go, Node.js, and Python projects at the root of
+// the workspace, or in its top-level directories when the root has none.
+func detectRuntimes(root string) []*projectRuntime {
+	if found := detectRuntimesIn(root, "."); len(found) > 0 {
+		return found
+	}
+	var found []*projectRuntime
+	entries, _ := os.ReadDir(root)
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") && !repoMapSkipDirs[e.Name()] {
+			found = append(found, detectRuntimesIn(root, e.Name())...)
+		}
+	}
+	return found
+}
+
+func detectRuntimesIn(root, rel string) []*projectRuntime {
+	dir := filepath.Join(root, rel)
+	var found []*projectRuntime
+	if fileExists(filepath.Join(dir, "go.mod")) {
+		found = append(found, detectGoRuntime(dir, rel))
+	}
+	if fileExists(filepath.Join(dir, "package.json")) {
+		found = append(found, detectNodeRuntime(dir, rel))
+	}
+	for _, manifest := range []string{"pyproject.toml", "requirements.txt", "setup.py"} {
+		if fileExists(filepath.Join(dir, manifest)) {
+			found = append(found, detectPythonRuntime(dir, rel, manifest))
+			break
+		}
+	}
+	return found
+}
+
+func detectGoRuntime(dir, rel string) *projectRuntime {
+	r := &projectRuntime{language: "Go", dir: rel, manifest: "go.mod"}
+	goTool := probeTool("go", "the toolchain")
+	goTool.install = systemInstall("golang-go", "go")
+	if data, err := os.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+		if m := goDirectiveRe.FindSubmatch(data); m != nil {
+			goTool.why = "go.mod requires go " + string(m[1])
+			if !goTool.missing && versionBefore(goTool.version, string(m[1])) {
+				r.notes = append(r.notes, fmt.Sprintf("go.mod requires go %s but %s is installed; the go command downloads the newer toolchain unless GOTOOLCHAIN=local", m[1], goTool.version))
+			}
+		}
+	}
+	r.tools = append(r.tools, goTool)
+	r.commands = []projectCommand{
+		{"build", "go build ./..."},
+		{"test", "go test ./..."},
+		{"lint", "go vet ./..."},
+		{"format", "gofmt -l ."},
+	}
+	for _, name := range []string{".golangci.yml", ".golangci.yaml", ".golangci.toml", ".golangci.json"} {
+		if fileExists(filepath.Join(dir, name)) {
+			lint := probeTool("golangci-lint", "configured in "+name)
+			if lint.missing && !goTool.missing {
+				lint.install = "go install github.com/golangci/golangci-lint/cmd/golangci-lint@latest"
+			}
+			r.tools = append(r.tools, lint)
+			r.commands = append(r.commands, projectCommand{"lint", "golangci-lint run"})
+			break
+		}
+	}
+	return r
+}
+
+func detectNodeRuntime(dir, rel string) *projectRuntime {
+	r := &projectRuntime{language: "Node.js", dir: rel, manifest: "package.json"}
+	node := probeTool("node", "the runtime")
+	node.install = systemInstall("nodejs npm", "nodejs npm")
+	r.tools = append(r.tools, node)
+	pm := nodePackageManager(dir)
+	if pm != "npm" {
+		tool := probeTool(pm, "the lock file is "+pm+"'s")
+		if tool.missing && !node.missing {
+			tool.install = "corepack enable " + pm
+			if pm == "bun" {
+				tool.install = "npm install -g bun"
+			}
+		}
+		r.tools = append(r.tools, tool)
+	}
+	var pkg struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "package.json"))
+	_ = json.Unmarshal(data, &pkg)
+	for _, script := range []string{"build", "test", "lint", "typecheck", "format"} {
+		if _, ok := pkg.Scripts[script]; ok {
+			command := pm + " run " + script
+			if script == "test" {
+				command = pm + " test"
+			}
+			r.commands = append(r.commands, projectCommand{script, command})
+		}
+	}
+	if !fileExists(filepath.Join(dir, "node_modules")) {
+		install := pm + " install"
+		if pm == "npm" && fileExists(filepath.Join(dir, "package-lock.json")) {
+			install = "npm ci"
+		}
+		r.tools = append(r.tools, runtimeTool{name: "dependencies", why: "no node_modules; `" + install + "` installs them", missing: true, install: install})
+	}
+	return r
+}
+
+func detectPythonRuntime(dir, rel, manifest string) *projectRuntime {
+	r := &projectRuntime{language: "Python", dir: rel, manifest: manifest}
+	var pyproject struct {
+		Project struct {
+			RequiresPython string `toml:"requires-python"`
+		} `toml:"project"`
+		Tool map[string]any `toml:"tool"`
+	}
+	if manifest == "pyproject.toml" {
+		_, _ = toml.DecodeFile(filepath.Join(dir, manifest), &pyproject)
+	}
+	python := probeTool("python3", "the interpreter")
+	if python.missing {
+		if alt := probeTool("python", "the interpreter"); !alt.missing {
+			python = alt
+		}
+	}
+	python.install = systemInstall("python3 python3-venv python3-pip", "python3 py3-pip")
+	if v := pyproject.Project.RequiresPython; v != "" {
+		python.why = "requires-python " + v
+	}
+	r.tools = append(r.tools, python)
+
+	// Commands run through the project's environment manager, or its
+	// virtualenv when there is one.
+	run := python.name + " -m "
+	_, poetry := pyproject.Tool["poetry"]
+	switch {
+	case fileExists(filepath.Join(dir, "uv.lock")):
+		r.tools = append(r.tools, pythonTool("uv", "uv.lock", python))
+		run = "uv run "
+	case poetry:
+		r.tools = append(r.tools, pythonTool("poetry", "[tool.poetry] in pyproject.toml", python))
+		run = "poetry run "
+	case fileExists(filepath.Join(dir, ".venv", "bin", "python")):
+		run = ".venv/bin/python -m "
+	}
+
+	_, pytestConfig := pyproject.Tool["pytest"]
+	if pytestConfig || fileExists(filepath.Join(dir, "pytest.ini")) || fileExists(filepath.Join(dir, "tests")) || fileExists(filepath.Join(dir, "conftest.py")) {
+		r.commands = append(r.commands, projectCommand{"test", run + "pytest"})
+	}
+	_, ruff := pyproject.Tool["ruff"]
+	if ruff || fileExists(filepath.Join(dir, "ruff.toml")) || fileExists(filepath.Join(dir, ".ruff.toml")) {
+		r.commands = append(r.commands, projectCommand{"lint", run + "ruff check ."}, projectCommand{"format", run + "ruff format --check ."})
+	}
+	if _, mypy := pyproject.Tool["mypy"]; mypy || fileExists(filepath.Join(dir, "mypy.ini")) {
+		r.commands = append(r.commands, projectCommand{"typecheck", run + "mypy ."})
+	}
+	if _, black := pyproject.Tool["black"]; black && !ruff {
+		r.commands = append(r.commands, projectCommand{"format", run + "black --check ."})
+	}
+	if len(r.commands) > 0 && run == python.name+" -m " && !python.missing {
+		// Without an environment manager the modules must be importable.
+		var checked []string
+		for _, c := range r.commands {
+			module := strings.Fields(strings.TrimPrefix(c.command, run))[0]
+			if slices.Contains(checked, module) {
+				continue
+			}
+			checked = append(checked, module)
+			if !pythonHasModule(python.name, module) {
+				r.tools = append(r.tools, runtimeTool{name: module, why: "used by " + c.command, missing: true, install: python.name + " -m pip install " + module})
+			}
+		}
+	}
+	return r
+}
+
+// pythonTool probes an environment manager, installed with pip when missing.
+func pythonTool(name, why string, python runtimeTool) runtimeTool {
+	tool := probeTool(name, why)
+	if tool.missing && !python.missing {
+		tool.install = python.name + " -m pip install " + name
+	}
+	return tool
+}
+
+func pythonHasModule(python, module string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), toolVersionTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, python, "-c", "import importlib.util, sys; sys.exit(importlib.util.find_spec(sys.argv[1]) is None)", module).Run() == nil
+}
+
+// probeTool looks name up on PATH and reads its version.
+func probeTool(name, why string) runtimeTool {
+	tool := runtimeTool{name: name, why: why}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		tool.missing = true
+		return tool
+	}
+	args := []string{"--version"}
+	if name == "go" {
+		args = []string{"env", "GOVERSION"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), toolVersionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, args...).Output()
+	if err == nil {
+		line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		tool.version = strings.TrimSpace(line)
+	}
+	return tool
+}
+
+// systemInstall is the command that installs system packages with apt-get
+// or apk, whichever the system has.
+func systemInstall(apt, apk string) string {
+	if _, err := exec.LookPath("apt-get"); err == nil {
+		return "apt-get update -qq && apt-get install -y -qq " + apt
+	}
+	if _, err := exec.LookPath("apk"); err == nil {
+		return "apk add --no-cache " + apk
+	}
+	return ""
+}
+
+// versionBefore reports whether the version in installed, such as go1.21.5,
+// is older than the dotted version want.
+func versionBefore(installed, want string) bool {
+	m := versionRe.FindString(installed)
+	if m == "" {
+		return false
+	}
+	have, need := strings.Split(m, "."), strings.Split(want, ".")
+	for i := range need {
+		var h, n int
+		if i < len(have) {
+			fmt.Sscan(have[i], &h)
+		}
+		fmt.Sscan(need[i], &n)
+		if h != n {
+			return h < n
+		}
+	}
+	return false
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// inSandbox reports whether the agent runs somewhere disposable: a
+// container, or an environment marked with PUZLDAI_SANDBOX=1.
+func inSandbox() bool {
+	if os.Getenv(sandboxEnv) == "1" {
+		return true
+	}
+	return fileExists("/.dockerenv") || fileExists("/run/.containerenv")
+}
+
+// bootstrapRuntimes installs the missing tools that have an install
+// command, then detects the projects again.
+func bootstrapRuntimes(ctx context.Context, root string, found []*projectRuntime) []*projectRuntime {
+	var done []string
+	for _, r := range found {
+		for _, t := range r.tools {
+			if !t.missing || t.install == "" || slices.Contains(done, t.install) {
+				continue
+			}
+			done = append(done, t.install)
+			fmt.Fprintf(os.Stderr, "bootstrap: installing %s: %s\n", t.name, t.install)
+			ctx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+			cmd := exec.CommandContext(ctx, "sh", "-c", t.install)
+			cmd.Dir = filepath.Join(root, r.dir)
+			out, err := cmd.CombinedOutput()
+			cancel()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "bootstrap: %s failed: %v\n%s\n", t.install, err, truncateOutput(strings.TrimSpace(string(out)), maxVerifyOutput))
+			}
+		}
+	}
+	if len(done) == 0 {
+		return found
+	}
+	return detectRuntimes(root)
+}
+
+// warnMissing prints the missing tools at session start.
+func warnMissing(found []*projectRuntime) {
+	for _, r := range found {
+		for _, t := range r.tools {
+			if t.missing {
+				fmt.Fprintf(os.Stderr, "%s project in %s: %s is missing (%s)\n", r.language, r.dir, t.name, firstNonEmpty(t.why, "needed to build it"))
+			}
+		}
+		for _, note := range r.notes {
+			fmt.Fprintf(os.Stderr, "%s project in %s: %s\n", r.language, r.dir, note)
+		}
+	}
+}
+
+// runtimeInstructions tells the model what the projects are and how to
+// build, test, and lint them, so it need not guess commands.
+func runtimeInstructions(found []*projectRuntime) string {
+	if len(found) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n\n# Project Environment\n\nDetected at session start; use these commands instead of guessing.\n")
+	for _, r := range found {
+		fmt.Fprintf(&sb, "\n## %s (%s)\n\n", r.language, filepath.ToSlash(filepath.Join(r.dir, r.manifest)))
+		if r.dir != "." {
+			fmt.Fprintf(&sb, "Run commands from %s.\n", filepath.ToSlash(r.dir))
+		}
+		for _, t := range r.tools {
+			switch {
+			case t.missing:
+				fmt.Fprintf(&sb, "- %s: NOT INSTALLED (%s); do not run commands that need it\n", t.name, firstNonEmpty(t.why, "required"))
+			case t.version != "":
+				fmt.Fprintf(&sb, "- %s: %s\n", t.name, t.version)
+			}
+		}
+		for _, c := range r.commands {
+			fmt.Fprintf(&sb, "- %s: `%s`\n", c.kind, c.command)
+		}
+		for _, note := range r.notes {
+			sb.WriteString("- note: " + note + "\n")
+		}
+	}
+	return sb.String()
+}
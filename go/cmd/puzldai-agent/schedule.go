@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxScheduleHistory is how many past runs GET /schedules shows for each
+// schedule.
+const maxScheduleHistory = 10
+
+// scheduleConfig is a [schedule.<name>] section: a task that serve runs
+// on a cron schedule in each of its repositories.
+type scheduleConfig struct {
+	Cron string `toml:"cron"`
+	// Timezone is an IANA name; the default is the server's local time.
+	Timezone string `toml:"timezone"`
+	// Repos are directories in git repositories, relative to the config
+	// file.
+	Repos []string `toml:"repos"`
+	// Task may use {schedule}, {repo}, {date}, and {time}.
+	Task string   `toml:"task"`
+	Args []string `toml:"args"`
+	Push bool     `toml:"push"`
+}
+
+// schedule is a configured schedule as the server runs it.
+type schedule struct {
+	name string
+	scheduleConfig
+	cron *cronSchedule
+	// running is set from the time a run is due until it ends; a run due
+	// meanwhile is skipped rather than started alongside it.
+	running atomic.Bool
+}
+
+// scheduleRecord is one line of the schedule history: a run, or a skipped
+// one.
+type scheduleRecord struct {
+	Schedule string `json:"schedule"`
+	// Due is when the run was scheduled for.
+	Due time.Time `json:"due"`
+	// Status is success, failed (a task did not succeed), skipped (the
+	// previous run was still going), or cancelled.
+	Status   string       `json:"status"`
+	Duration float64      `json:"duration,omitempty"`
+	CostUSD  *float64     `json:"cost_usd,omitempty"`
+	Tasks    []digestTask `json:"tasks,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// scheduler runs the [schedule] entries of the server's config.
+type scheduler struct {
+	server    *server
+	cfg       *agentConfig
+	dir       string
+	schedules []*schedule
+}
+
+func newScheduler(s *server, cfg *agentConfig, dir string) (*scheduler, error) {
+	sc := &scheduler{server: s, cfg: cfg, dir: dir}
+	names := make([]string, 0, len(cfg.Schedules))
+	for name := range cfg.Schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := cfg.Schedules[name]
+		loc := time.Local
+		if c.Timezone != "" {
+			var err error
+			if loc, err = time.LoadLocation(c.Timezone); err != nil {
+				return nil, fmt.Errorf("schedule %s: %w", name, err)
+			}
+		}
+		cron, err := parseCron(c.Cron, loc)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("schedule %s: %w", name, err)
+		case branchUnsafeRe.MatchString(name):
+			return nil, fmt.Errorf("schedule %s: names use only letters, digits, '.', '_', and '-'", name)
+		case strings.TrimSpace(c.Task) == "":
+			return nil, fmt.Errorf("schedule %s: no task", name)
+		}
+		if len(c.Repos) == 0 {
+			c.Repos = []string{"."}
+		}
+		sc.schedules = append(sc.schedules, &schedule{name: name, scheduleConfig: c, cron: cron})
+	}
+	return sc, nil
+}
+
+// start runs each schedule until the server shuts down.
+func (sc *scheduler) start() {
+	for _, sch := range sc.schedules {
+		go sc.loop(sch)
+		fmt.Fprintf(os.Stderr, "schedule %s: next run %s\n", sch.name, sch.cron.next(time.Now()).Format(time.RFC3339))
+	}
+}
+
+func (sc *scheduler) loop(sch *schedule) {
+	ctx := sc.server.ctx
+	for {
+		due := sch.cron.next(time.Now())
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !sch.running.CompareAndSwap(false, true) {
+			fmt.Fprintf(os.Stderr, "schedule %s: skipped the %s run; the previous one is still going\n", sch.name, due.Format(time.RFC3339))
+			sc.record(scheduleRecord{Schedule: sch.name, Due: due, Status: "skipped"})
+			continue
+		}
+		sc.server.start("schedule "+sch.name, func(ctx context.Context) error {
+			defer sch.running.Store(false)
+			return sc.run(ctx, sch, due)
+		})
+	}
+}
+
+// run runs the schedule's task in each of its repositories as a batch,
+// records it in the history, and delivers the report where [report] says.
+func (sc *scheduler) run(ctx context.Context, sch *schedule, due time.Time) error {
+	local := due.In(sch.cron.loc)
+	b := &batchRun{
+		dir:        sc.dir,
+		prefix:     fmt.Sprintf("puzldai/%s-%s/", sch.name, local.Format("20060102-1504")),
+		push:       sch.Push,
+		agentArgs:  append(sc.server.agentArgs[:len(sc.server.agentArgs):len(sc.server.agentArgs)], sch.Args...),
+		commit:     &sc.cfg.Commit,
+		workspaces: map[string]*childWorkspace{},
+	}
+	d := &digest{Label: "puzldai schedule " + sch.name, Started: time.Now()}
+	seen := map[string]int{}
+	for _, repo := range sch.Repos {
+		name := strings.Trim(branchUnsafeRe.ReplaceAllString(filepath.Base(filepath.Join(sc.dir, repo)), "-"), "-.")
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, seen[name])
+		}
+		task := strings.NewReplacer("{schedule}", sch.name, "{repo}", repo, "{date}", local.Format(time.DateOnly), "{time}", local.Format("15:04")).Replace(sch.Task)
+		d.Tasks = append(d.Tasks, b.run(ctx, batchTask{Name: name, Repo: repo, Task: task}))
+	}
+	d.Finished = time.Now()
+	b.cleanup()
+
+	rec := scheduleRecord{Schedule: sch.name, Due: due, Status: outcomeSuccess, Duration: d.Finished.Sub(d.Started).Seconds(), CostUSD: d.cost(), Tasks: d.Tasks}
+	for _, t := range d.Tasks {
+		if t.Status != outcomeSuccess {
+			rec.Status = "failed"
+		}
+	}
+	if ctx.Err() != nil {
+		rec.Status = outcomeCancelled
+	}
+	var err error
+	if ctx.Err() == nil {
+		err = deliverDigest(sc.cfg.Report, sc.cfg.Report.WebhookURL, sc.cfg.Report.EmailTo, d)
+		if err != nil {
+			rec.Error = err.Error()
+		}
+	}
+	sc.record(rec)
+	if err == nil && rec.Status != outcomeSuccess {
+		err = fmt.Errorf("%s: %s", rec.Status, d.title())
+	}
+	return err
+}
+
+// historyPath is PUZLDAI_HOME/schedule-history.jsonl.
+func historyPath() (string, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dir), "schedule-history.jsonl"), nil
+}
+
+func (sc *scheduler) record(rec scheduleRecord) {
+	line, err := json.Marshal(rec)
+	if err == nil {
+		line, err = sealLine(line)
+	}
+	if err == nil {
+		var path string
+		if path, err = historyPath(); err == nil {
+			err = appendLines(path, string(line)+"\n")
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "schedule history:", err)
+	}
+}
+
+// history returns each schedule's latest records, oldest first.
+func (sc *scheduler) history() (map[string][]scheduleRecord, error) {
+	out := map[string][]scheduleRecord{}
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var rec scheduleRecord
+		line, err := unsealLine(scanner.Bytes())
+		if err != nil || json.Unmarshal(line, &rec) != nil {
+			continue
+		}
+		recs := append(out[rec.Schedule], rec)
+		if len(recs) > maxScheduleHistory {
+			recs = recs[1:]
+		}
+		out[rec.Schedule] = recs
+	}
+	return out, scanner.Err()
+}
+
+// list answers GET /schedules with each schedule, its next run, and its
+// recent history.
+func (sc *scheduler) list(w http.ResponseWriter, r *http.Request) {
+	history, err := sc.history()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type entry struct {
+		Name    string           `json:"name"`
+		Cron    string           `json:"cron"`
+		Repos   []string         `json:"repos"`
+		Next    time.Time        `json:"next"`
+		Running bool             `json:"running"`
+		History []scheduleRecord `json:"history"`
+	}
+	entries := []entry{}
+	now := time.Now()
+	for _, sch := range sc.schedules {
+		entries = append(entries, entry{Name: sch.name, Cron: sch.Cron, Repos: sch.Repos, Next: sch.cron.next(now), Running: sch.running.Load(), History: history[sch.name]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// toolParam describes one tool argument. The same schema renders the prompt
+// text, feeds native function declarations, and validates incoming calls.
+type toolParam struct {
+	name        string
+	typ         string // string, integer, number, boolean, array, object, or "" for any
+	description string
+	required    bool
+	enum        []string
+	def         any
+}
+
+func required(name, typ, description string) toolParam {
+	return toolParam{name: name, typ: typ, description: description, required: true}
+}
+
+func optional(name, typ, description string) toolParam {
+	return toolParam{name: name, typ: typ, description: description}
+}
+
+func (p toolParam) oneOf(values ...string) toolParam {
+	p.enum = values
+	return p
+}
+
+func (p toolParam) withDefault(v any) toolParam {
+	p.def = v
+	return p
+}
+
+// renderParams produces the parameter list shown in the system prompt.
+func renderParams(params []toolParam) string {
+	if len(params) == 0 {
+		return "  (none)"
+	}
+	lines := make([]string, 0, len(params))
+	for _, p := range params {
+		typ := p.typ
+		if typ == "" {
+			typ = "any"
+		}
+		var notes []string
+		if !p.required {
+			notes = append(notes, "optional")
+		}
+		if p.description != "" {
+			notes = append(notes, p.description)
+		}
+		if len(p.enum) > 0 {
+			notes = append(notes, "one of "+strings.Join(p.enum, ", "))
+		}
+		if p.def != nil {
+			notes = append(notes, fmt.Sprintf("default %v", p.def))
+		}
+		line := "  - " + p.name + ": " + typ
+		if len(notes) > 0 {
+			line += " (" + strings.Join(notes, "; ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// jsonSchema converts params to a JSON Schema object for native tool calling.
+func jsonSchema(params []toolParam) map[string]any {
+	props := map[string]any{}
+	var req []string
+	for _, p := range params {
+		prop := map[string]any{}
+		if p.typ != "" {
+			prop["type"] = p.typ
+		}
+		if p.typ == "array" {
+			prop["items"] = map[string]any{"type": "string"}
+		}
+		if p.description != "" {
+			prop["description"] = p.description
+		}
+		if len(p.enum) > 0 {
+			prop["enum"] = p.enum
+		}
+		props[p.name] = prop
+		if p.required {
+			req = append(req, p.name)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(req) > 0 {
+		schema["required"] = req
+	}
+	return schema
+}
+
+// validateArgs checks args against params and returns a copy with defaults
+// filled in. Errors name the offending parameter so the model can correct
+// the call.
+func validateArgs(params []toolParam, args map[string]any) (map[string]any, error) {
+	out := make(map[string]any, len(args)+len(params))
+	known := make(map[string]bool, len(params))
+	var problems []string
+	for _, p := range params {
+		known[p.name] = true
+		v, ok := args[p.name]
+		if !ok || v == nil {
+			if p.required {
+				problems = append(problems, fmt.Sprintf("missing required parameter %q (%s)", p.name, typeLabel(p.typ)))
+			} else if p.def != nil {
+				out[p.name] = p.def
+			}
+			continue
+		}
+		if err := checkParamType(p, v); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		out[p.name] = v
+	}
+	var unknown []string
+	for k := range args {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		names := make([]string, 0, len(params))
+		for _, p := range params {
+			names = append(names, p.name)
+		}
+		problems = append(problems, fmt.Sprintf("unknown parameter(s) %s (expected: %s)",
+			strings.Join(unknown, ", "), strings.Join(names, ", ")))
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid arguments: %s", strings.Join(problems, "; "))
+	}
+	return out, nil
+}
+
+func checkParamType(p toolParam, v any) error {
+	ok := true
+	switch p.typ {
+	case "string":
+		s, isString := v.(string)
+		ok = isString
+		if ok && len(p.enum) > 0 && !containsString(p.enum, s) {
+			return fmt.Errorf("parameter %q must be one of %s, got %q", p.name, strings.Join(p.enum, ", "), s)
+		}
+	case "integer":
+		switch n := v.(type) {
+		case float64:
+			ok = n == math.Trunc(n)
+		case int, int64:
+		default:
+			ok = false
+		}
+	case "number":
+		switch v.(type) {
+		case float64, int, int64:
+		default:
+			ok = false
+		}
+	case "boolean":
+		_, ok = v.(bool)
+	case "array":
+		_, ok = v.([]any)
+	case "object":
+		_, ok = v.(map[string]any)
+	}
+	if !ok {
+		return fmt.Errorf("parameter %q must be %s, got %s", p.name, typeLabel(p.typ), jsonTypeName(v))
+	}
+	return nil
+}
+
+func typeLabel(typ string) string {
+	switch typ {
+	case "":
+		return "any value"
+	case "integer", "array", "object":
+		return "an " + typ
+	default:
+		return "a " + typ
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateArgs(t *testing.T) {
+	params := []toolParam{
+		required("path", "string", ""),
+		optional("mode", "string", "").oneOf("fast", "full").withDefault("fast"),
+		optional("limit", "integer", "").withDefault(10),
+		optional("ratio", "number", ""),
+		optional("force", "boolean", ""),
+		optional("files", "array", ""),
+		optional("meta", "object", ""),
+		optional("extra", "", ""),
+	}
+
+	tests := []struct {
+		name    string
+		args    map[string]any
+		want    map[string]any
+		wantErr []string // substrings of the error; nil when valid
+	}{
+		{
+			name: "defaults filled in",
+			args: map[string]any{"path": "a.go"},
+			want: map[string]any{"path": "a.go", "mode": "fast", "limit": 10},
+		},
+		{
+			name: "null takes the default",
+			args: map[string]any{"path": "a.go", "limit": nil},
+			want: map[string]any{"path": "a.go", "mode": "fast", "limit": 10},
+		},
+		{
+			name: "given values kept",
+			args: map[string]any{"path": "a.go", "mode": "full", "limit": float64(3), "ratio": 0.5, "force": true,
+				"files": []any{"x"}, "meta": map[string]any{"k": "v"}, "extra": 1},
+			want: map[string]any{"path": "a.go", "mode": "full", "limit": float64(3), "ratio": 0.5, "force": true,
+				"files": []any{"x"}, "meta": map[string]any{"k": "v"}, "extra": 1},
+		},
+		{
+			name:    "missing required",
+			args:    map[string]any{},
+			wantErr: []string{`missing required parameter "path" (a string)`},
+		},
+		{
+			name:    "not in enum",
+			args:    map[string]any{"path": "a.go", "mode": "slow"},
+			wantErr: []string{`parameter "mode" must be one of fast, full, got "slow"`},
+		},
+		{
+			name:    "fractional integer",
+			args:    map[string]any{"path": "a.go", "limit": 2.5},
+			wantErr: []string{`parameter "limit" must be an integer`},
+		},
+		{
+			name: "wrong types",
+			args: map[string]any{"path": 1.0, "ratio": "x", "force": "yes", "files": "a", "meta": []any{}},
+			wantErr: []string{
+				`parameter "path" must be a string`,
+				`parameter "ratio" must be a number`,
+				`parameter "force" must be a boolean`,
+				`parameter "files" must be an array`,
+				`parameter "meta" must be an object`,
+			},
+		},
+		{
+			name:    "unknown keys listed sorted",
+			args:    map[string]any{"path": "a.go", "zeta": 1, "alpha": 2},
+			wantErr: []string{"unknown parameter(s) alpha, zeta (expected: path, mode, limit"},
+		},
+		{
+			name:    "problems combined",
+			args:    map[string]any{"mode": "slow", "bogus": true},
+			wantErr: []string{`missing required parameter "path"`, `"mode" must be one of`, "unknown parameter(s) bogus"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateArgs(params, tt.args)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got %v, want an error", got)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema := jsonSchema([]toolParam{
+		required("path", "string", "file path"),
+		optional("sort", "string", "").oneOf("name", "size"),
+		optional("files", "array", ""),
+	})
+	want := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"path":  map[string]any{"type": "string", "description": "file path"},
+			"sort":  map[string]any{"type": "string", "enum": []string{"name", "size"}},
+			"files": map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		},
+		"required": []string{"path"},
+	}
+	if !reflect.DeepEqual(schema, want) {
+		t.Fatalf("got %v, want %v", schema, want)
+	}
+}
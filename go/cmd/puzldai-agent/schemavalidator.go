@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// schemaValidator validates values against schemas inside root, which local
+// $ref pointers are resolved against: an OpenAPI document, or a standalone
+// schema file.
+type schemaValidator struct {
+	root map[string]any
+}
+
+// resolve follows local $ref pointers (#/components/... or #/definitions/...).
+func (s schemaValidator) resolve(v any) any {
+	for depth := 0; depth < 32; depth++ {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return v
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#/") {
+			return v
+		}
+		var cur any = s.root
+		for _, part := range strings.Split(ref[2:], "/") {
+			part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+			node, _ := cur.(map[string]any)
+			cur = node[part]
+		}
+		v = cur
+	}
+	return v
+}
+
+// validate checks value against the subset of JSON Schema used by OpenAPI
+// documents and -output-schema, appending human-readable errors prefixed
+// with at. Numbers in value must be float64, as encoding/json decodes them.
+func (s schemaValidator) validate(schemaVal any, value any, at string, errs *[]string) {
+	schema, ok := s.resolve(schemaVal).(map[string]any)
+	if !ok {
+		return
+	}
+	fail := func(format string, a ...any) {
+		*errs = append(*errs, at+": "+fmt.Sprintf(format, a...))
+	}
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable {
+			return
+		}
+	}
+	for _, sub := range asSlice(schema["allOf"]) {
+		s.validate(sub, value, at, errs)
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		alts := asSlice(schema[key])
+		if len(alts) == 0 {
+			continue
+		}
+		matched := false
+		for _, alt := range alts {
+			var altErrs []string
+			s.validate(alt, value, at, &altErrs)
+			if len(altErrs) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("does not match any %s alternative", key)
+		}
+	}
+	if enum := asSlice(schema["enum"]); len(enum) > 0 {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %v, got %v", enum, value)
+		}
+	}
+
+	typ, _ := schema["type"].(string)
+	switch typ {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			fail("must be an object, got %s", jsonTypeName(value))
+			return
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for _, r := range asSlice(schema["required"]) {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		for name, v := range obj {
+			if prop, ok := props[name]; ok {
+				s.validate(prop, v, at+"."+name, errs)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					fail("unknown property %q", name)
+				}
+			case map[string]any:
+				s.validate(extra, v, at+"."+name, errs)
+			}
+		}
+	case "array":
+		arr, ok := value.([]any)
+		if !ok {
+			fail("must be an array, got %s", jsonTypeName(value))
+			return
+		}
+		if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(arr)) < n {
+			fail("must have at least %v items", n)
+		}
+		if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(arr)) > n {
+			fail("must have at most %v items", n)
+		}
+		for i, item := range arr {
+			s.validate(schema["items"], item, fmt.Sprintf("%s[%d]", at, i), errs)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			fail("must be a string, got %s", jsonTypeName(value))
+			return
+		}
+		if n, ok := schemaNumber(schema, "minLength"); ok && float64(len([]rune(s))) < n {
+			fail("must be at least %v characters", n)
+		}
+		if n, ok := schemaNumber(schema, "maxLength"); ok && float64(len([]rune(s))) > n {
+			fail("must be at most %v characters", n)
+		}
+		if pattern, _ := schema["pattern"].(string); pattern != "" {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(s) {
+				fail("must match pattern %s", pattern)
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			fail("must be of type %s, got %s", typ, jsonTypeName(value))
+			return
+		}
+		if typ == "integer" && n != float64(int64(n)) {
+			fail("must be an integer, got %v", n)
+		}
+		if lo, ok := schemaNumber(schema, "minimum"); ok && n < lo {
+			fail("must be >= %v", lo)
+		}
+		if hi, ok := schemaNumber(schema, "maximum"); ok && n > hi {
+			fail("must be <= %v", hi)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be a boolean, got %s", jsonTypeName(value))
+		}
+	}
+}
+
+func schemaNumber(schema map[string]any, key string) (float64, bool) {
+	switch v := schema[key].(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
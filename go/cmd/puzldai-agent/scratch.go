@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// scratchEnv names the session's scratch directory in the environment
+	// of commands.
+	scratchEnv    = "PUZLDAI_SCRATCH"
+	scratchPrefix = "puzldai-scratch-"
+	// scratchKeptMarker marks a directory kept with -keep-scratch, so later
+	// sessions do not sweep it.
+	scratchKeptMarker = ".puzldai-kept"
+)
+
+// newScratchDir creates the session's scratch directory, for artifacts,
+// downloads, and build outputs that do not belong in the workspace. It is
+// removed when the session ends unless keep is set. The name carries the
+// process ID, so directories left by a process that was killed are swept
+// by the next session.
+func newScratchDir(sess *session, keep bool) (string, error) {
+	sweepScratchDirs()
+	dir, err := os.MkdirTemp("", scratchPrefix+strconv.Itoa(os.Getpid())+"-")
+	if err != nil {
+		return "", err
+	}
+	sess.onClose(func() {
+		if !keep {
+			os.RemoveAll(dir)
+			return
+		}
+		_ = os.WriteFile(filepath.Join(dir, scratchKeptMarker), nil, 0o644)
+		fmt.Fprintf(os.Stderr, "scratch directory kept: %s\n", dir)
+	})
+	return dir, nil
+}
+
+// sweepScratchDirs removes the scratch directories of processes that are
+// gone, except kept ones.
+func sweepScratchDirs() {
+	entries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		rest, ok := strings.CutPrefix(e.Name(), scratchPrefix)
+		if !ok || !e.IsDir() {
+			continue
+		}
+		pidText, _, _ := strings.Cut(rest, "-")
+		pid, err := strconv.Atoi(pidText)
+		dir := filepath.Join(os.TempDir(), e.Name())
+		if err != nil || processAlive(pid) || fileExists(filepath.Join(dir, scratchKeptMarker)) {
+			continue
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer p.Release()
+	// FindProcess fails for a missing process on Windows and always
+	// succeeds elsewhere, where signal 0 checks for it.
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// scratchCommandEnv points commands and their temporary files at the
+// scratch directory.
+func scratchCommandEnv(dir string) []string {
+	return []string{scratchEnv + "=" + dir, "TMPDIR=" + dir, "TMP=" + dir, "TEMP=" + dir}
+}
+
+func scratchInstructions(dir string) string {
+	return fmt.Sprintf(`
+
+# Scratch Directory
+
+%s (also $%s, and $TMPDIR in commands) is this session's scratch
+directory. Put generated artifacts, downloaded files, build outputs, and
+throwaway scripts there rather than in the workspace; it is deleted when the
+session ends.`, dir, scratchEnv)
+}
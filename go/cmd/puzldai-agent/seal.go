@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/zalando/go-keyring"
+)
+
+// sessionKeyEnv holds the key that encrypts run data at rest: sessions,
+// checkpoints, notes, the response cache, and the schedule history. It is
+// 32 bytes, base64- or hex-encoded. Without it, the key stored in the OS
+// keychain by auth session-key is used; without either, run data is
+// written in the clear.
+const sessionKeyEnv = "PUZLDAI_SESSION_KEY"
+
+// sessionKeyAccount is the keychain entry of the key.
+const sessionKeyAccount = "session-key"
+
+// Sealed files start with sealMagic, followed by the AES-GCM nonce and the
+// ciphertext. Sealed lines of JSON Lines files are sealLinePrefix and the
+// same in base64.
+var sealMagic = []byte("puzldai-sealed-v1\n")
+
+const sealLinePrefix = "sealed:"
+
+// sessionKey returns the key, or nil when none is configured. It is read
+// once per process.
+var sessionKey = sync.OnceValues(func() ([]byte, error) {
+	if text := strings.TrimSpace(os.Getenv(sessionKeyEnv)); text != "" {
+		key, err := decodeSessionKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sessionKeyEnv, err)
+		}
+		return key, nil
+	}
+	// A missing or unavailable keychain means no key, as for API keys.
+	text, err := keyring.Get(keyringService, sessionKeyAccount)
+	if err != nil {
+		return nil, nil
+	}
+	key, err := decodeSessionKey(text)
+	if err != nil {
+		return nil, fmt.Errorf("the session key in the OS keychain: %w", err)
+	}
+	return key, nil
+})
+
+func decodeSessionKey(text string) ([]byte, error) {
+	var key []byte
+	var err error
+	if len(text) == 64 {
+		key, err = hex.DecodeString(text)
+	} else {
+		key, err = base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			key, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(text, "="))
+		}
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("want 32 bytes, base64- or hex-encoded (generate one with puzldai-agent auth session-key -print)")
+	}
+	return key, nil
+}
+
+// newSessionKey returns a random key, base64-encoded.
+func newSessionKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func sessionAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with the session key, or returns it as is when there
+// is no key.
+func seal(data []byte) ([]byte, error) {
+	key, err := sessionKey()
+	if key == nil || err != nil {
+		return data, err
+	}
+	aead, err := sessionAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(sealMagic)+aead.NonceSize(), len(sealMagic)+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(out, sealMagic)
+	nonce := out[len(sealMagic):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, data, nil), nil
+}
+
+// unseal decrypts sealed data, and returns anything else as is, so files
+// written before a key was set stay readable.
+func unseal(data []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(data, sealMagic)
+	if !ok {
+		return data, nil
+	}
+	key, err := sessionKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("encrypted; set %s or store the key with puzldai-agent auth session-key", sessionKeyEnv)
+	}
+	aead, err := sessionAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("truncated encrypted data")
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt: wrong session key, or the data is corrupt")
+	}
+	return plain, nil
+}
+
+// writePrivate writes data to path, sealed, readable by the user only.
+func writePrivate(path string, data []byte) error {
+	sealed, err := seal(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, sealed, 0o600)
+}
+
+// readPrivate reads a file written by writePrivate, or in the clear.
+func readPrivate(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unseal(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plain, nil
+}
+
+// sealLine seals one line of a JSON Lines file; line has no newline.
+func sealLine(line []byte) ([]byte, error) {
+	if key, err := sessionKey(); key == nil || err != nil {
+		return line, err
+	}
+	sealed, err := seal(line)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sealLinePrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// unsealLine reverses sealLine, and returns lines in the clear as they are.
+func unsealLine(line []byte) ([]byte, error) {
+	encoded, ok := bytes.CutPrefix(line, []byte(sealLinePrefix))
+	if !ok {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, err
+	}
+	return unseal(sealed)
+}
+
+// checkSessionKey fails when encrypt_sessions is set and there is no key,
+// rather than writing run data in the clear.
+func checkSessionKey(required bool) error {
+	key, err := sessionKey()
+	if err != nil {
+		return err
+	}
+	if required && key == nil {
+		return fmt.Errorf("encrypt_sessions is set but there is no session key; set %s or run puzldai-agent auth session-key", sessionKeyEnv)
+	}
+	return nil
+}
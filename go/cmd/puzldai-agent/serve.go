@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultServeAddr = "localhost:8080"
+	defaultServeRuns = 2
+	// serveStopDelay is how long runs get to wrap up on shutdown.
+	serveStopDelay = 30 * time.Second
+)
+
+// server is serve mode: a long-running process that starts agent runs in
+// answer to HTTP requests, such as forge webhooks, and on schedules.
+type server struct {
+	exe       string
+	agentArgs []string
+	// runs bounds the agent runs in flight; further jobs wait their turn.
+	runs chan struct{}
+	wg   sync.WaitGroup
+	ctx  context.Context
+}
+
+const serveUsage = "usage: puzldai-agent serve [-addr host:port] [-max-runs n] [-trigger prefix] [-config file] [-- agent flags]"
+
+// runServe implements the serve subcommand.
+func runServe(args []string) int {
+	fs := newFlagSet("serve")
+	addrFlag := fs.String("addr", defaultServeAddr, "Address to listen on")
+	maxRunsFlag := fs.Int("max-runs", defaultServeRuns, "Agent runs at a time; further requests wait")
+	triggerFlag := fs.String("trigger", defaultBotTrigger, "Prefix of the comments the bot answers")
+	configFlag := fs.String("config", "", "Config file with [schedule] and [tenant] entries (default: PUZLDAI_CONFIG or ./.puzldai.toml)")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *maxRunsFlag < 1 {
+		fmt.Fprintln(os.Stderr, serveUsage)
+		return exitUsage
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	}
+	cfg, err := loadConfig(wd, *configFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve: failed to load config:", err)
+		return exitError
+	}
+	if err := cfg.Commit.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	}
+	policy, err := loadOrgPolicy()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	}
+	if err := policy.checkDigest(cfg.Report, cfg.Report.WebhookURL, cfg.Report.EmailTo); err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitPolicy
+	}
+	// Schedule and tenant repos are relative to the config file.
+	configDir, err := filepath.Abs(filepath.Dir(firstNonEmpty(*configFlag, os.Getenv("PUZLDAI_CONFIG"), filepath.Join(wd, defaultConfigName))))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	s := &server{exe: exe, agentArgs: agentArgs, runs: make(chan struct{}, *maxRunsFlag), ctx: ctx}
+	mux := http.NewServeMux()
+	bot, err := newCommentBot(s, *triggerFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	}
+	sched, err := newScheduler(s, cfg, configDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	}
+	api, err := newTenantAPI(s, cfg, configDir, policy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	}
+	if bot == nil && len(sched.schedules) == 0 && api == nil {
+		fmt.Fprintln(os.Stderr, "serve: nothing to serve; set PUZLDAI_GITHUB_WEBHOOK_SECRET or PUZLDAI_GITLAB_WEBHOOK_TOKEN for the comment bot, or add [schedule] or [tenant] entries to the config")
+		return exitError
+	}
+	if bot != nil {
+		bot.register(mux)
+	}
+	if api != nil {
+		defer api.close()
+		api.register(mux)
+		// With tenants, the schedules are only shown to them.
+		mux.HandleFunc("GET /schedules", api.authorized(func(w http.ResponseWriter, r *http.Request, _ *tenant) { sched.list(w, r) }))
+	} else {
+		mux.HandleFunc("GET /schedules", sched.list)
+	}
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	srv := &http.Server{Addr: *addrFlag, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	fmt.Fprintf(os.Stderr, "serving on %s\n", *addrFlag)
+	sched.start()
+	select {
+	case err := <-errc:
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		return exitError
+	case <-ctx.Done():
+	}
+	fmt.Fprintln(os.Stderr, "shutting down; stopping runs")
+	stopCtx, stop := context.WithTimeout(context.Background(), serveStopDelay)
+	defer stop()
+	if err := srv.Shutdown(stopCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+	}
+	s.wg.Wait()
+	return exitOK
+}
+
+// start runs job in the background once a run slot is free. The context
+// is cancelled when the server shuts down.
+func (s *server) start(name string, job func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		select {
+		case s.runs <- struct{}{}:
+		case <-s.ctx.Done():
+			return
+		}
+		defer func() { <-s.runs }()
+		fmt.Fprintf(os.Stderr, "%s: started\n", name)
+		if err := job(s.ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s: done\n", name)
+	}()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// session holds state scoped to a single agent run.
+type session struct {
+	id       string
+	cwd      string
+	approver *approver
+	remote   *remoteTarget
+	egress   *egressPolicy
+	// transport holds the proxy and CA settings tools that make HTTP
+	// requests share with the provider.
+	transport transportSettings
+	cleanups  []func()
+}
+
+func newSession(cwd string, approver *approver) *session {
+	return &session{id: newSessionID(), cwd: cwd, approver: approver}
+}
+
+func newSessionID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(buf)
+}
+
+// onClose registers fn to run when the session ends.
+func (s *session) onClose(fn func()) {
+	s.cleanups = append(s.cleanups, fn)
+}
+
+// close runs cleanup functions in reverse registration order.
+func (s *session) close() {
+	for i := len(s.cleanups) - 1; i >= 0; i-- {
+		s.cleanups[i]()
+	}
+	s.cleanups = nil
+}
+
+// workspace returns the file system the session's tools work on and the
+// workspace directory in it, for setting tools up outside a tool call.
+func (s *session) workspace() (workspaceFS, string) {
+	if s.remote != nil {
+		return s.remote, s.remote.root
+	}
+	return diskFS{}, s.cwd
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// retentionInterval is how often runs apply the [sessions] retention
+	// settings; sessions purge applies them on demand.
+	retentionInterval = time.Hour
+	retentionStamp    = ".retention"
+	// scrubKeep bounds the text of a task kept by scrubbing.
+	scrubKeep = 200
+)
+
+// sessionsConfig is the [sessions] section: how long saved sessions are
+// kept. Ages are a number of days or weeks (30d, 2w) or a duration (12h).
+type sessionsConfig struct {
+	MaxAge    string `toml:"max_age"`
+	MaxCount  int    `toml:"max_count"`
+	MaxSizeMB int    `toml:"max_size_mb"`
+	// ScrubAfter strips file contents from sessions older than this,
+	// keeping their metadata; see scrub.
+	ScrubAfter string `toml:"scrub_after"`
+}
+
+func (c sessionsConfig) empty() bool {
+	return c == sessionsConfig{}
+}
+
+// storedSession is a session's files in the sessions directory: its
+// transcript, notes, and checkpoints.
+type storedSession struct {
+	id      string
+	updated time.Time
+	size    int64
+}
+
+// scrubArgs are the tool arguments scrubbing keeps: they name what a call
+// worked on rather than holding contents.
+var scrubArgs = map[string]bool{"path": true, "package": true, "pattern": true, "action": true, "name": true, "url": true, "method": true}
+
+// listStoredSessions returns the saved sessions, newest first, by the time
+// their transcript was last written.
+func listStoredSessions() ([]storedSession, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []storedSession
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() || !sessionIDRe.MatchString(id) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		s := storedSession{id: id, updated: info.ModTime(), size: info.Size()}
+		for _, extra := range sessionExtras(dir, id) {
+			s.size += diskUsage(extra)
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].updated.After(out[j].updated) })
+	return out, nil
+}
+
+// sessionExtras are the files kept beside a session's transcript.
+func sessionExtras(dir, id string) []string {
+	return []string{filepath.Join(dir, id+".notes.md"), filepath.Join(dir, id+".checkpoints")}
+}
+
+func diskUsage(path string) int64 {
+	var total int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// deleteSession removes a session's files, and the git refs that keep its
+// checkpoints' commits alive.
+func deleteSession(id string) error {
+	path, err := sessionPath(id)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no saved session %q", id)
+	}
+	dropCheckpointRefs(id)
+	for _, extra := range sessionExtras(filepath.Dir(path), id) {
+		if err := os.RemoveAll(extra); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// dropCheckpointRefs deletes the session's checkpoint refs, best-effort:
+// a workspace that is gone, or a checkpoint that cannot be read, keeps its
+// ref.
+func dropCheckpointRefs(id string) {
+	path, err := checkpointPath(id, "x")
+	if err != nil {
+		return
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	for _, e := range entries {
+		cp, err := loadCheckpoint(id + "@" + strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+		runGit(ctx, cp.Root, "update-ref", "-d", "refs/puzldai/checkpoints/"+id+"/"+cp.Name)
+		cancel()
+	}
+}
+
+// scrub strips what a session holds of the workspace and keeps its
+// metadata: the system prompt, replies, tool results, and tool arguments
+// other than scrubArgs are replaced by their size, and a task by its first
+// line. Notes and checkpoints, which hold contents too, are deleted. A
+// scrubbed session cannot be resumed.
+func (s *savedSession) scrub() {
+	gone := func(text string) string {
+		if text == "" {
+			return ""
+		}
+		return fmt.Sprintf("[scrubbed: %d bytes]", len(text))
+	}
+	s.System = gone(s.System)
+	for i := range s.Messages {
+		m := &s.Messages[i]
+		if m.Role == "user" {
+			if line := firstLine(m.Content); line != m.Content {
+				m.Content = truncateOutput(line, scrubKeep) + " " + gone(m.Content)
+			}
+		} else {
+			m.Content = gone(m.Content)
+		}
+		for j := range m.ToolCalls {
+			for k, v := range m.ToolCalls[j].Arguments {
+				if text, ok := v.(string); !ok || !scrubArgs[k] {
+					data, _ := json.Marshal(v)
+					m.ToolCalls[j].Arguments[k] = gone(firstNonEmpty(text, string(data)))
+				}
+			}
+		}
+		for j := range m.ToolResults {
+			m.ToolResults[j].Content = gone(m.ToolResults[j].Content)
+		}
+	}
+	s.Resumable = false
+	s.Scrubbed = true
+}
+
+// scrubSession scrubs a saved session in place, keeping its timestamps,
+// and reports whether it was not scrubbed already.
+func scrubSession(id string) (bool, error) {
+	saved, err := loadSession(id)
+	if err != nil {
+		return false, err
+	}
+	path, err := sessionPath(id)
+	if err != nil {
+		return false, err
+	}
+	if saved.Scrubbed {
+		return false, nil
+	}
+	dropCheckpointRefs(id)
+	for _, extra := range sessionExtras(filepath.Dir(path), id) {
+		if err := os.RemoveAll(extra); err != nil {
+			return false, err
+		}
+	}
+	updated := saved.Updated
+	saved.scrub()
+	if err := saved.write(); err != nil {
+		return false, err
+	}
+	// Age-based retention goes by the file's time.
+	return true, os.Chtimes(path, updated, updated)
+}
+
+// retention selects the sessions to scrub and to delete: those older than
+// scrubAfter and maxAge, then the oldest beyond maxCount and maxBytes.
+// Sessions in keep are left alone.
+type retention struct {
+	scrubBefore  time.Time
+	deleteBefore time.Time
+	maxCount     int
+	maxBytes     int64
+	// scrubOnly scrubs the sessions selected for deletion instead.
+	scrubOnly bool
+}
+
+func newRetention(c sessionsConfig, now time.Time) (*retention, error) {
+	r := &retention{maxCount: c.MaxCount, maxBytes: int64(c.MaxSizeMB) << 20}
+	var err error
+	if c.MaxAge != "" {
+		if r.deleteBefore, err = parseSince(c.MaxAge, now); err != nil {
+			return nil, fmt.Errorf("[sessions] max_age: %w", err)
+		}
+	}
+	if c.ScrubAfter != "" {
+		if r.scrubBefore, err = parseSince(c.ScrubAfter, now); err != nil {
+			return nil, fmt.Errorf("[sessions] scrub_after: %w", err)
+		}
+	}
+	if c.MaxCount < 0 || c.MaxSizeMB < 0 {
+		return nil, errors.New("[sessions] max_count and max_size_mb must not be negative")
+	}
+	return r, nil
+}
+
+// plan splits sessions, newest first, into those to scrub and those to
+// delete.
+func (r *retention) plan(sessions []storedSession, keep map[string]bool) (scrub, remove []storedSession) {
+	var count int
+	var bytes int64
+	for _, s := range sessions {
+		if keep[s.id] {
+			count++
+			bytes += s.size
+			continue
+		}
+		switch {
+		case !r.deleteBefore.IsZero() && s.updated.Before(r.deleteBefore),
+			r.maxCount > 0 && count >= r.maxCount,
+			r.maxBytes > 0 && bytes+s.size > r.maxBytes:
+			remove = append(remove, s)
+			continue
+		case !r.scrubBefore.IsZero() && s.updated.Before(r.scrubBefore):
+			scrub = append(scrub, s)
+		}
+		count++
+		bytes += s.size
+	}
+	return scrub, remove
+}
+
+// apply scrubs and deletes what plan selects, and reports what it did on
+// stderr. With dryRun, it only reports.
+func (r *retention) apply(keep map[string]bool, dryRun bool) error {
+	sessions, err := listStoredSessions()
+	if err != nil {
+		return err
+	}
+	scrub, remove := r.plan(sessions, keep)
+	if r.scrubOnly {
+		scrub, remove = append(scrub, remove...), nil
+	}
+	verb := map[bool][2]string{false: {"scrubbed", "deleted"}, true: {"would scrub", "would delete"}}[dryRun]
+	var errs []error
+	for _, s := range scrub {
+		if dryRun {
+			if saved, err := loadSession(s.id); err == nil && saved.Scrubbed {
+				continue
+			}
+		} else if changed, err := scrubSession(s.id); err != nil {
+			errs = append(errs, fmt.Errorf("scrubbing %s: %w", s.id, err))
+			continue
+		} else if !changed {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s session %s (%s)\n", verb[0], s.id, s.updated.Local().Format(time.DateTime))
+	}
+	for _, s := range remove {
+		if !dryRun {
+			if err := deleteSession(s.id); err != nil {
+				errs = append(errs, fmt.Errorf("deleting %s: %w", s.id, err))
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s session %s (%s, %s)\n", verb[1], s.id, s.updated.Local().Format(time.DateTime), formatSize(s.size))
+	}
+	return errors.Join(errs...)
+}
+
+// applyRetention applies the [sessions] settings at most once per
+// retentionInterval, leaving the session keep alone. Failures are reported
+// and otherwise ignored: they must not stop a run.
+func applyRetention(c sessionsConfig, keep string) {
+	if c.empty() {
+		return
+	}
+	dir, err := sessionsDir()
+	if err != nil {
+		return
+	}
+	stamp := filepath.Join(dir, retentionStamp)
+	if info, err := os.Stat(stamp); err == nil && time.Since(info.ModTime()) < retentionInterval {
+		return
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil || os.WriteFile(stamp, nil, 0o600) != nil {
+		return
+	}
+	r, err := newRetention(c, time.Now())
+	if err == nil {
+		err = r.apply(map[string]bool{keep: true}, false)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "session retention:", err)
+	}
+}
+
+const sessionsUsage = "usage: puzldai-agent sessions list [-json]\n" +
+	"       puzldai-agent sessions show [-json] <session-id>\n" +
+	"       puzldai-agent sessions delete <session-id>...\n" +
+	"       puzldai-agent sessions purge [-older-than 30d] [-keep n] [-max-size-mb n] [-scrub] [-dry-run] [-config file]"
+
+// runSessions implements the sessions subcommand.
+func runSessions(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, sessionsUsage)
+		return exitUsage
+	}
+	fs := newFlagSet("sessions " + args[0])
+	jsonFlag := fs.Bool("json", false, "Print JSON")
+	olderFlag := fs.String("older-than", "", "Select sessions last written before this long ago (e.g. 30d, 2w, 12h) or a date")
+	keepFlag := fs.Int("keep", 0, "Select all but the newest n sessions")
+	sizeFlag := fs.Int("max-size-mb", 0, "Select the oldest sessions beyond this many megabytes in total")
+	scrubFlag := fs.Bool("scrub", false, "Scrub the selected sessions, keeping their metadata, instead of deleting them")
+	dryRunFlag := fs.Bool("dry-run", false, "Only report what would be scrubbed or deleted")
+	configFlag := fs.String("config", "", "Config file whose [sessions] settings purge applies when no selection flags are given (default: PUZLDAI_CONFIG or ./.puzldai.toml)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	var err error
+	switch {
+	case args[0] == "list" && fs.NArg() == 0:
+		err = listSessions(*jsonFlag)
+	case args[0] == "show" && fs.NArg() == 1:
+		err = showSession(fs.Arg(0), *jsonFlag)
+	case args[0] == "delete" && fs.NArg() > 0:
+		for _, id := range fs.Args() {
+			if err = deleteSession(id); err != nil {
+				break
+			}
+			fmt.Fprintf(os.Stderr, "deleted session %s\n", id)
+		}
+	case args[0] == "purge" && fs.NArg() == 0:
+		c := sessionsConfig{MaxAge: *olderFlag, MaxCount: *keepFlag, MaxSizeMB: *sizeFlag}
+		if _, err := parseSince(c.MaxAge, time.Now()); c.MaxAge != "" && err != nil {
+			fmt.Fprintln(os.Stderr, "sessions: -older-than:", err)
+			return exitUsage
+		}
+		if c.empty() {
+			var wd string
+			if wd, err = os.Getwd(); err != nil {
+				break
+			}
+			var cfg *agentConfig
+			if cfg, err = loadConfig(wd, *configFlag); err != nil {
+				break
+			}
+			if c = cfg.Sessions; c.empty() {
+				fmt.Fprintln(os.Stderr, "sessions: nothing to purge; pass -older-than, -keep, or -max-size-mb, or set [sessions] in the config")
+				return exitUsage
+			}
+		}
+		var r *retention
+		if r, err = newRetention(c, time.Now()); err == nil {
+			r.scrubOnly = *scrubFlag
+			err = r.apply(nil, *dryRunFlag)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, sessionsUsage)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sessions:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// sessionSummary is what sessions list and show print of a session.
+type sessionSummary struct {
+	ID          string    `json:"id"`
+	Cwd         string    `json:"cwd"`
+	Provider    string    `json:"provider,omitempty"`
+	Model       string    `json:"model"`
+	Status      string    `json:"status"`
+	Resumable   bool      `json:"resumable"`
+	Scrubbed    bool      `json:"scrubbed,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Task        string    `json:"task,omitempty"`
+	Messages    int       `json:"messages"`
+	ToolCalls   int       `json:"tool_calls"`
+	Size        int64     `json:"size"`
+	Notes       bool      `json:"notes,omitempty"`
+	Checkpoints []string  `json:"checkpoints,omitempty"`
+	// Error is why the session could not be read, such as a missing key.
+	Error string `json:"error,omitempty"`
+}
+
+func summarizeSession(s storedSession) sessionSummary {
+	sum := sessionSummary{ID: s.id, Updated: s.updated.UTC(), Size: s.size}
+	saved, err := loadSession(s.id)
+	if err != nil {
+		sum.Error = err.Error()
+		return sum
+	}
+	sum.Cwd, sum.Provider, sum.Model, sum.Status = saved.Cwd, saved.Provider, saved.Model, saved.Status
+	sum.Resumable, sum.Scrubbed, sum.Created, sum.Updated = saved.Resumable, saved.Scrubbed, saved.Created, saved.Updated
+	sum.Messages = len(saved.Messages)
+	for _, m := range saved.Messages {
+		if m.Role == "user" && sum.Task == "" {
+			sum.Task = firstLine(m.Content)
+		}
+		sum.ToolCalls += len(m.ToolResults)
+	}
+	dir, _ := sessionsDir()
+	if _, err := os.Stat(filepath.Join(dir, s.id+".notes.md")); err == nil {
+		sum.Notes = true
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, s.id+".checkpoints"))
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			sum.Checkpoints = append(sum.Checkpoints, name)
+		}
+	}
+	return sum
+}
+
+func listSessions(asJSON bool) error {
+	sessions, err := listStoredSessions()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		fmt.Fprintln(os.Stderr, "no saved sessions")
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !asJSON {
+		fmt.Fprintln(w, "ID\tUPDATED\tSTATUS\tMODEL\tMESSAGES\tSIZE\tDIRECTORY")
+	}
+	var total int64
+	for _, s := range sessions {
+		sum := summarizeSession(s)
+		total += sum.Size
+		if asJSON {
+			if err := enc.Encode(sum); err != nil {
+				return err
+			}
+			continue
+		}
+		status := sum.Status
+		switch {
+		case sum.Error != "":
+			status = "unreadable"
+		case sum.Scrubbed:
+			status += " (scrubbed)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", sum.ID, sum.Updated.Local().Format(time.DateTime), status, sum.Model, sum.Messages, formatSize(sum.Size), sum.Cwd)
+	}
+	if asJSON {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d sessions, %s\n", len(sessions), formatSize(total))
+	return nil
+}
+
+func showSession(id string, asJSON bool) error {
+	path, err := sessionPath(id)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no saved session %q", id)
+	}
+	if err != nil {
+		return err
+	}
+	s := storedSession{id: id, updated: info.ModTime(), size: info.Size()}
+	for _, extra := range sessionExtras(filepath.Dir(path), id) {
+		s.size += diskUsage(extra)
+	}
+	sum := summarizeSession(s)
+	if sum.Error != "" {
+		return errors.New(sum.Error)
+	}
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(sum)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "session:\t%s\n", sum.ID)
+	fmt.Fprintf(w, "directory:\t%s\n", sum.Cwd)
+	fmt.Fprintf(w, "model:\t%s\n", strings.TrimPrefix(sum.Provider+"/"+sum.Model, "/"))
+	status := sum.Status
+	if sum.Scrubbed {
+		status += ", scrubbed"
+	} else if sum.Resumable {
+		status += ", resumable"
+	}
+	fmt.Fprintf(w, "status:\t%s\n", status)
+	fmt.Fprintf(w, "created:\t%s\n", sum.Created.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "updated:\t%s\n", sum.Updated.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "task:\t%s\n", truncateOutput(sum.Task, scrubKeep))
+	fmt.Fprintf(w, "messages:\t%d (%d tool calls)\n", sum.Messages, sum.ToolCalls)
+	fmt.Fprintf(w, "size:\t%s\n", formatSize(sum.Size))
+	if sum.Notes {
+		fmt.Fprintf(w, "notes:\t%s\n", filepath.Join(filepath.Dir(path), id+".notes.md"))
+	}
+	if len(sum.Checkpoints) > 0 {
+		fmt.Fprintf(w, "checkpoints:\t%s\n", strings.Join(sum.Checkpoints, ", "))
+	}
+	return w.Flush()
+}
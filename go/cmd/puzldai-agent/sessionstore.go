@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// savedSession is the on-disk transcript of a run, written after every turn
+// so an interrupted or exhausted run can be continued with -resume.
+type savedSession struct {
+	ID       string `json:"id"`
+	Cwd      string `json:"cwd"`
+	Roots    string `json:"roots,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model"`
+	// System is the latest system prompt, kept for replay.
+	System    string `json:"system,omitempty"`
+	Status    string `json:"status"`
+	Resumable bool   `json:"resumable"`
+	// Scrubbed sessions keep their metadata only; see scrub.
+	Scrubbed bool           `json:"scrubbed,omitempty"`
+	Created  time.Time      `json:"created"`
+	Updated  time.Time      `json:"updated"`
+	Messages []savedMessage `json:"messages"`
+}
+
+type savedMessage struct {
+	Role        string            `json:"role"`
+	Content     string            `json:"content,omitempty"`
+	ToolCalls   []savedToolCall   `json:"tool_calls,omitempty"`
+	ToolResults []savedToolResult `json:"tool_results,omitempty"`
+}
+
+type savedToolCall struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments,omitempty"`
+}
+
+type savedToolResult struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content"`
+	IsError bool   `json:"is_error,omitempty"`
+}
+
+var sessionIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// sessionsDir is PUZLDAI_HOME/sessions, defaulting to ~/.puzldai/sessions.
+func sessionsDir() (string, error) {
+	home := os.Getenv("PUZLDAI_HOME")
+	if home == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		home = filepath.Join(userHome, ".puzldai")
+	}
+	return filepath.Join(home, "sessions"), nil
+}
+
+func sessionPath(id string) (string, error) {
+	if !sessionIDRe.MatchString(id) {
+		return "", fmt.Errorf("invalid session id %q", id)
+	}
+	dir, err := sessionsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+func loadSession(id string) (*savedSession, error) {
+	path, err := sessionPath(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readPrivate(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no saved session %q", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved savedSession
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &saved, nil
+}
+
+// save writes the transcript atomically; sessions may hold file contents,
+// so the file is private to the user, and encrypted with the session key.
+func (s *savedSession) save(messages []agentMessage) error {
+	s.Updated = time.Now().UTC()
+	if s.Created.IsZero() {
+		s.Created = s.Updated
+	}
+	s.Messages = saveMessages(messages)
+	return s.write()
+}
+
+func (s *savedSession) write() error {
+	path, err := sessionPath(s.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := writePrivate(tmp, data); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func saveMessages(messages []agentMessage) []savedMessage {
+	out := make([]savedMessage, 0, len(messages))
+	for _, msg := range messages {
+		sm := savedMessage{Role: msg.role, Content: msg.content}
+		for _, c := range msg.toolCalls {
+			sm.ToolCalls = append(sm.ToolCalls, savedToolCall{ID: c.id, Name: c.name, Arguments: c.arguments})
+		}
+		for _, r := range msg.toolResults {
+			sm.ToolResults = append(sm.ToolResults, savedToolResult{ID: r.id, Name: r.name, Content: r.content, IsError: r.isError})
+		}
+		out = append(out, sm)
+	}
+	return out
+}
+
+func (s *savedSession) agentMessages() []agentMessage {
+	out := make([]agentMessage, 0, len(s.Messages))
+	for _, sm := range s.Messages {
+		msg := agentMessage{role: sm.Role, content: sm.Content}
+		for _, c := range sm.ToolCalls {
+			msg.toolCalls = append(msg.toolCalls, toolCall{id: c.ID, name: c.Name, arguments: c.Arguments})
+		}
+		for _, r := range sm.ToolResults {
+			msg.toolResults = append(msg.toolResults, toolResult{id: r.ID, name: r.Name, content: r.Content, isError: r.IsError})
+		}
+		out = append(out, msg)
+	}
+	return out
+}
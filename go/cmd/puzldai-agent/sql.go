@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultSQLMaxRows = 200
+const defaultSQLMaxBytes = 50_000
+
+type sqlConnConfig struct {
+	Driver   string `toml:"driver"`
+	DSN      string `toml:"dsn"`
+	DSNEnv   string `toml:"dsn_env"`
+	ReadOnly *bool  `toml:"read_only"`
+	MaxRows  int    `toml:"max_rows"`
+	MaxBytes int    `toml:"max_bytes"`
+}
+
+// sqlConnections returns the configured connections, adding a "default"
+// connection from PUZLDAI_SQL_DSN when no connection uses that name.
+func sqlConnections(cfg *agentConfig) map[string]sqlConnConfig {
+	conns := make(map[string]sqlConnConfig, len(cfg.SQL)+1)
+	for name, conn := range cfg.SQL {
+		conns[name] = conn
+	}
+	if _, ok := conns["default"]; !ok {
+		if dsn := os.Getenv("PUZLDAI_SQL_DSN"); dsn != "" {
+			conns["default"] = sqlConnConfig{DSN: dsn}
+		}
+	}
+	return conns
+}
+
+func (c sqlConnConfig) dsn() string {
+	if c.DSNEnv != "" {
+		if dsn := os.Getenv(c.DSNEnv); dsn != "" {
+			return dsn
+		}
+	}
+	return c.DSN
+}
+
+func (c sqlConnConfig) driver() string {
+	if c.Driver != "" {
+		return c.Driver
+	}
+	dsn := c.dsn()
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+func (c sqlConnConfig) readOnly() bool {
+	return c.ReadOnly == nil || *c.ReadOnly
+}
+
+func newSQLTool(cfg *agentConfig) toolFunc {
+	conns := sqlConnections(cfg)
+	return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+		query, ok := argString(args, "query")
+		if !ok || strings.TrimSpace(query) == "" {
+			return "", errors.New("sql_query: missing query")
+		}
+		conn, err := pickSQLConnection(conns, args)
+		if err != nil {
+			return "", err
+		}
+		if conn.readOnly() && !isReadOnlySQL(query) {
+			return "", errors.New("sql_query: connection is read-only; only SELECT, WITH, EXPLAIN, PRAGMA, SHOW and VALUES statements are allowed")
+		}
+
+		maxRows := conn.MaxRows
+		if maxRows <= 0 {
+			maxRows = defaultSQLMaxRows
+		}
+		if n, ok := argInt(args, "max_rows"); ok && n > 0 && n < maxRows {
+			maxRows = n
+		}
+		maxBytes := conn.MaxBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultSQLMaxBytes
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		defer cancel()
+
+		cmd, err := sqlCommand(ctx, cwd, conn, query)
+		if err != nil {
+			return "", err
+		}
+		return runSQLCommand(cmd, maxRows, maxBytes)
+	}
+}
+
+func pickSQLConnection(conns map[string]sqlConnConfig, args map[string]any) (sqlConnConfig, error) {
+	if len(conns) == 0 {
+		return sqlConnConfig{}, errors.New("sql_query: no connections configured (set [sql.<name>] in config or PUZLDAI_SQL_DSN)")
+	}
+	name, _ := argString(args, "connection")
+	if name == "" {
+		if len(conns) == 1 {
+			for _, conn := range conns {
+				return conn, nil
+			}
+		}
+		name = "default"
+	}
+	conn, ok := conns[name]
+	if !ok {
+		names := make([]string, 0, len(conns))
+		for n := range conns {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return sqlConnConfig{}, fmt.Errorf("sql_query: unknown connection %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return conn, nil
+}
+
+func sqlCommand(ctx context.Context, cwd string, conn sqlConnConfig, query string) (*exec.Cmd, error) {
+	dsn := conn.dsn()
+	if dsn == "" {
+		return nil, errors.New("sql_query: connection has no DSN")
+	}
+
+	var cmd *exec.Cmd
+	switch conn.driver() {
+	case "sqlite", "sqlite3":
+		path := strings.TrimPrefix(strings.TrimPrefix(dsn, "sqlite://"), "sqlite:")
+		args := []string{"-header", "-csv", "-bail"}
+		// An -emit patch run leaves the disk as it was, databases included.
+		if _, patch := workspaceFSFrom(ctx).(*overlay); conn.readOnly() || patch {
+			args = append(args, "-readonly")
+		}
+		args = append(args, resolvePath(cwd, path), query)
+		cmd = exec.CommandContext(ctx, "sqlite3", args...)
+	case "postgres", "postgresql":
+		cmd = exec.CommandContext(ctx, "psql", dsn, "-X", "--csv", "-v", "ON_ERROR_STOP=1", "-c", query)
+		cmd.Env = os.Environ()
+		if conn.readOnly() {
+			cmd.Env = append(cmd.Env, "PGOPTIONS=-c default_transaction_read_only=on")
+		}
+	default:
+		return nil, fmt.Errorf("sql_query: unsupported driver %q", conn.Driver)
+	}
+	cmd.Dir = cwd
+	return cmd, nil
+}
+
+// runSQLCommand streams CSV output from cmd, stopping once maxRows data rows
+// have been read so large tables are never fully materialized.
+func runSQLCommand(cmd *exec.Cmd, maxRows, maxBytes int) (string, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	reader := csv.NewReader(stdout)
+	reader.FieldsPerRecord = -1
+	var out strings.Builder
+	writer := csv.NewWriter(&out)
+	rows := -1
+	truncated := false
+	// parseErr ends the result early; the rows before it are kept, with a
+	// note that says so.
+	var parseErr error
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			parseErr = err
+			break
+		}
+		if rows >= maxRows {
+			truncated = true
+			break
+		}
+		writer.Write(record)
+		rows++
+	}
+	writer.Flush()
+
+	stopped := truncated || parseErr != nil
+	if stopped {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		io.Copy(io.Discard, stdout)
+	}
+	waitErr := cmd.Wait()
+	if waitErr != nil && !stopped {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = waitErr.Error()
+		}
+		return "", fmt.Errorf("sql_query: %s", msg)
+	}
+
+	result := out.String()
+	if len(result) > maxBytes {
+		result = result[:maxBytes]
+		truncated = true
+	}
+	if rows < 0 {
+		if parseErr != nil {
+			return "", fmt.Errorf("sql_query: reading the result: %v", parseErr)
+		}
+		return "(no rows)", nil
+	}
+	if parseErr != nil {
+		result += fmt.Sprintf("\n(output truncated after %d rows: reading the result failed: %v)", rows, parseErr)
+	} else if truncated {
+		result += fmt.Sprintf("\n(truncated: row limit %d, byte limit %d)", maxRows, maxBytes)
+	}
+	return result, nil
+}
+
+var readOnlySQLKeywords = []string{"select", "with", "explain", "pragma", "show", "values"}
+
+func isReadOnlySQL(query string) bool {
+	q := strings.ToLower(strings.TrimSpace(query))
+	q = strings.TrimRight(q, "; \n\t")
+	if strings.Contains(q, ";") {
+		return false
+	}
+	for _, kw := range readOnlySQLKeywords {
+		if strings.HasPrefix(q, kw) {
+			return true
+		}
+	}
+	return false
+}
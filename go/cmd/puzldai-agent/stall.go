@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultStallThreshold = 3
+	stallResultPreview    = 1_000
+)
+
+// stallDetector watches the sequence of tool-call turns for a model that is
+// stuck: the same calls repeated threshold times in a row, or two turns
+// alternating. The first stall gets a corrective note; a second one aborts.
+type stallDetector struct {
+	threshold int
+	history   []string
+	results   map[string]string
+	warned    bool
+}
+
+func newStallDetector(threshold int) *stallDetector {
+	return &stallDetector{threshold: threshold, results: map[string]string{}}
+}
+
+// observe records one turn. It returns a note to send to the model, or
+// abort=true when the model stalled again after being warned.
+func (d *stallDetector) observe(calls []toolCall, results []toolResult) (note string, abort bool) {
+	if d.threshold <= 1 {
+		return "", false
+	}
+	sig := describeCalls(calls)
+	d.history = append(d.history, sig)
+	d.results[sig] = resultPreview(results)
+
+	n := len(d.history)
+	switch {
+	case d.repeated():
+		note = fmt.Sprintf("You already ran %s %d times in a row with identical arguments; the result was:\n%s\n\n"+
+			"Repeating it will not change the outcome. Try a different approach, or stop and report what is blocking you.",
+			describeCalls(calls), d.threshold, d.results[sig])
+	case d.alternating():
+		note = fmt.Sprintf("You are alternating between %s and %s without making progress. "+
+			"Step back, decide on one approach, or stop and report what is blocking you.",
+			d.history[n-2], d.history[n-1])
+	default:
+		return "", false
+	}
+	if d.warned {
+		return "", true
+	}
+	d.warned = true
+	d.history = d.history[:0]
+	return "[loop detector] " + note, false
+}
+
+func (d *stallDetector) repeated() bool {
+	n := len(d.history)
+	if n < d.threshold {
+		return false
+	}
+	for _, sig := range d.history[n-d.threshold:] {
+		if sig != d.history[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// alternating reports an A,B,A,B,... tail of length 2*(threshold-1).
+func (d *stallDetector) alternating() bool {
+	span := 2 * (d.threshold - 1)
+	n := len(d.history)
+	if n < span || span < 4 {
+		return false
+	}
+	tail := d.history[n-span:]
+	if tail[0] == tail[1] {
+		return false
+	}
+	for i := 2; i < len(tail); i++ {
+		if tail[i] != tail[i-2] {
+			return false
+		}
+	}
+	return true
+}
+
+// describeCalls renders a turn's calls canonically (json.Marshal sorts map
+// keys), so it doubles as the turn's signature.
+func describeCalls(calls []toolCall) string {
+	parts := make([]string, 0, len(calls))
+	for _, c := range calls {
+		args, _ := json.Marshal(c.arguments)
+		parts = append(parts, c.name+" "+string(args))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func resultPreview(results []toolResult) string {
+	parts := make([]string, 0, len(results))
+	for _, r := range results {
+		parts = append(parts, r.content)
+	}
+	return truncateOutput(strings.Join(parts, "\n"), stallResultPreview)
+}
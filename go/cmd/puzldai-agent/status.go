@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-runewidth"
+	"golang.org/x/term"
+)
+
+// statusInterval is how often the status line is redrawn, so the elapsed
+// times keep moving while the model or a tool is busy.
+const statusInterval = time.Second
+
+// statusLine keeps a line at the bottom of a terminal's stderr with the
+// run's iteration, current or last tool, elapsed time, tokens, and cost.
+// While it is shown, stderr goes through a pipe, and everything else
+// written there is printed above the line.
+type statusLine struct {
+	tty      *os.File
+	pipe     *os.File
+	meter    *usageMeter
+	maxIters int
+	start    time.Time
+	stopped  chan struct{}
+	copied   chan struct{}
+	once     sync.Once
+
+	mu        sync.Mutex
+	drawn     bool
+	partial   bool // the last output did not end its line, e.g. a prompt
+	held      int
+	iteration int
+	tool      string
+	running   int
+	toolStart time.Time
+	waiting   time.Time
+}
+
+// newStatusLine starts the status line when stderr is a terminal, and
+// returns nil otherwise. Its methods do nothing on nil.
+func newStatusLine(meter *usageMeter, maxIters int) *statusLine {
+	if !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil
+	}
+	s := &statusLine{
+		tty:      os.Stderr,
+		pipe:     w,
+		meter:    meter,
+		maxIters: maxIters,
+		start:    time.Now(),
+		stopped:  make(chan struct{}),
+		copied:   make(chan struct{}),
+	}
+	os.Stderr = w
+	go s.copy(r)
+	go s.tick()
+	return s
+}
+
+// copy prints what is written to stderr above the status line.
+func (s *statusLine) copy(r *os.File) {
+	defer close(s.copied)
+	defer r.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			s.erase()
+			s.tty.Write(buf[:n])
+			s.partial = !bytes.HasSuffix(buf[:n], []byte("\n"))
+			s.draw()
+			s.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *statusLine) tick() {
+	t := time.NewTicker(statusInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-t.C:
+			s.mu.Lock()
+			s.draw()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// stop removes the line and gives stderr back, once everything written
+// to it has been printed.
+func (s *statusLine) stop() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		close(s.stopped)
+		os.Stderr = s.tty
+		s.pipe.Close()
+		<-s.copied
+		s.mu.Lock()
+		s.erase()
+		s.mu.Unlock()
+	})
+}
+
+// hold removes the line while the terminal prompts, until the returned
+// function is called.
+func (s *statusLine) hold() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.mu.Lock()
+	s.held++
+	s.erase()
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.held--
+		// The answer ended the prompt's line.
+		s.partial = false
+		s.draw()
+		s.mu.Unlock()
+	}
+}
+
+// turn marks the start of an iteration, which waits for the model.
+func (s *statusLine) turn(iteration int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.iteration, s.waiting = iteration, time.Now()
+	s.draw()
+	s.mu.Unlock()
+}
+
+// middleware tracks the tool calls being run.
+func (s *statusLine) middleware() toolMiddleware {
+	if s == nil {
+		return nil
+	}
+	return func(next toolFunc) toolFunc {
+		return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			call, _ := toolCallFrom(ctx)
+			s.mu.Lock()
+			s.tool, s.toolStart, s.waiting = call.name, time.Now(), time.Time{}
+			s.running++
+			s.draw()
+			s.mu.Unlock()
+			defer func() {
+				s.mu.Lock()
+				s.running--
+				s.draw()
+				s.mu.Unlock()
+			}()
+			return next(ctx, cwd, args)
+		}
+	}
+}
+
+// line is the text of the status line.
+func (s *statusLine) line() string {
+	parts := []string{fmt.Sprintf("iteration %d/%d", s.iteration, s.maxIters)}
+	if s.iteration > s.maxIters {
+		parts[0] = "wrap-up"
+	}
+	switch {
+	case s.running > 1:
+		parts = append(parts, fmt.Sprintf("%s +%d %s", s.tool, s.running-1, time.Since(s.toolStart).Round(time.Second)))
+	case s.running == 1:
+		parts = append(parts, fmt.Sprintf("%s %s", s.tool, time.Since(s.toolStart).Round(time.Second)))
+	case !s.waiting.IsZero():
+		wait := fmt.Sprintf("model %s", time.Since(s.waiting).Round(time.Second))
+		if s.tool != "" {
+			wait += " (after " + s.tool + ")"
+		}
+		parts = append(parts, wait)
+	case s.tool != "":
+		parts = append(parts, s.tool+" done")
+	}
+	parts = append(parts, time.Since(s.start).Round(time.Second).String()+" total")
+	var tokens int64
+	for _, u := range s.meter.usage() {
+		tokens += u.inputTokens + u.outputTokens
+	}
+	parts = append(parts, formatCount(tokens)+" tokens")
+	if cost := s.meter.cost(); cost != nil {
+		parts = append(parts, fmt.Sprintf("~$%.4f", *cost))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// draw shows the line in place of the last one; the caller holds s.mu. It
+// waits while a prompt is on the screen.
+func (s *statusLine) draw() {
+	select {
+	case <-s.stopped:
+		return
+	default:
+	}
+	if s.partial || s.held > 0 {
+		return
+	}
+	width, _, err := term.GetSize(int(s.tty.Fd()))
+	if err != nil || width < 10 {
+		width = 80
+	}
+	// One column short, so the cursor never wraps to a new line.
+	line := runewidth.Truncate(s.line(), width-1, "...")
+	if !noColor {
+		line = "\033[2m" + line + "\033[0m"
+	}
+	io.WriteString(s.tty, "\r\033[2K"+line)
+	s.drawn = true
+}
+
+// erase clears the line; the caller holds s.mu.
+func (s *statusLine) erase() {
+	if s.drawn {
+		io.WriteString(s.tty, "\r\033[2K")
+		s.drawn = false
+	}
+}
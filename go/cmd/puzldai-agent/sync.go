@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const syncTimeout = 10 * time.Minute
+
+// syncWorkspace copies source (a local directory or ssh:// URL) into a
+// temporary directory tracked by a throwaway git repository, so the agent's
+// changes can be exported as a patch instead of touching the original tree.
+func syncWorkspace(sess *session, source, patchOut string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", errors.New("sync mode requires git to produce the patch")
+	}
+	dir, err := os.MkdirTemp("", "puzldai-sync-")
+	if err != nil {
+		return "", err
+	}
+	sess.onClose(func() { os.RemoveAll(dir) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	if strings.HasPrefix(source, "ssh://") {
+		remote, err := parseRemote(source)
+		if err != nil {
+			return "", err
+		}
+		err = pullRemoteTree(ctx, remote, dir)
+		if err != nil {
+			return "", fmt.Errorf("sync from %s: %w", source, err)
+		}
+	} else if err := copyTree(source, dir); err != nil {
+		return "", fmt.Errorf("sync from %s: %w", source, err)
+	}
+
+	if err := gitBaseline(ctx, dir); err != nil {
+		return "", err
+	}
+	if patchOut == "" {
+		patchOut = filepath.Join(os.TempDir(), "puzldai-"+sess.id+".patch")
+	}
+	sess.onClose(func() {
+		if err := writeSyncPatch(dir, patchOut); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to write patch:", err)
+		}
+	})
+	return dir, nil
+}
+
+// copyTree copies regular files, directories, and symlinks, skipping .git.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		default:
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm|0o200)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// pullRemoteTree streams a tar archive of the remote root over ssh and
+// unpacks it into dst.
+func pullRemoteTree(ctx context.Context, remote *remoteTarget, dst string) error {
+	cmd := remote.command(ctx, "tar -C "+shellQuote(remote.root)+" --exclude=./.git -cf - .")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	extractErr := extractTar(stdout, dst)
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return extractErr
+}
+
+func extractTar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if name == "." {
+			continue
+		}
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("unsafe path in archive: %s", hdr.Name)
+		}
+		target := filepath.Join(dst, name)
+		// Nothing is written through a symlink: an archive could otherwise
+		// link a directory out of dst and then write files into it.
+		if err := checkNoSymlink(dst, name, hdr.Typeflag == tar.TypeReg); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fs.FileMode(hdr.Mode).Perm()|0o200)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) || !resolvesInside(dst, filepath.Dir(name)+string(filepath.Separator)+filepath.FromSlash(hdr.Linkname)) {
+				return fmt.Errorf("unsafe symlink in archive: %s -> %s", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkNoSymlink refuses name when a directory on its way from dst, or with
+// final the file itself, is a symlink.
+func checkNoSymlink(dst, name string, final bool) error {
+	parts := strings.Split(name, string(filepath.Separator))
+	if !final {
+		parts = parts[:len(parts)-1]
+	}
+	p := dst
+	for _, part := range parts {
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("unsafe path in archive: %s goes through a symlink", name)
+		}
+	}
+	return nil
+}
+
+// resolvesInside reports whether rel, a path relative to dst, stays inside
+// dst when the symlinks extracted so far are followed. rel must not be
+// cleaned: "link/.." is not where filepath.Clean puts it.
+func resolvesInside(dst, rel string) bool {
+	parts := strings.Split(rel, string(filepath.Separator))
+	var cur []string
+	for hops := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(cur) == 0 {
+				return false
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		cur = append(cur, part)
+		p := filepath.Join(append([]string{dst}, cur...)...)
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		link, err := os.Readlink(p)
+		if hops++; err != nil || hops > 40 || filepath.IsAbs(link) {
+			return false
+		}
+		cur = cur[:len(cur)-1]
+		parts = append(strings.Split(link, string(filepath.Separator)), parts...)
+	}
+	return true
+}
+
+func gitBaseline(ctx context.Context, dir string) error {
+	steps := [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"-c", "user.name=puzldai", "-c", "user.email=puzldai@localhost", "-c", "commit.gpgsign=false", "commit", "-q", "--no-verify", "--allow-empty", "-m", "baseline"},
+	}
+	for _, args := range steps {
+		if _, err := runGit(ctx, dir, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSyncPatch(dir, patchOut string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := runGit(ctx, dir, "add", "-A"); err != nil {
+		return err
+	}
+	patch, err := runGit(ctx, dir, "diff", "--cached", "--binary", "HEAD")
+	if err != nil {
+		return err
+	}
+	if patch == "" {
+		fmt.Fprintln(os.Stderr, "no changes to export")
+		return nil
+	}
+	if err := os.WriteFile(patchOut, []byte(patch), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "patch written to %s (apply with: git apply %s)\n", patchOut, patchOut)
+	return nil
+}
+
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("git: %s", msg)
+	}
+	return string(out), nil
+}
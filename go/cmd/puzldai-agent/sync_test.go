@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name, link, body string
+	typ              byte
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.typ, Mode: 0o644, Size: int64(len(e.body))}
+		if e.typ != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typ == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	file := func(name, body string) tarEntry { return tarEntry{name: name, body: body, typ: tar.TypeReg} }
+	symlink := func(name, link string) tarEntry { return tarEntry{name: name, link: link, typ: tar.TypeSymlink} }
+
+	tests := []struct {
+		name    string
+		entries func(outside string) []tarEntry
+		// linkOut, when set, is a symlink to outside made in dst first.
+		linkOut string
+		wantErr string
+	}{
+		{
+			name: "plain tree",
+			entries: func(string) []tarEntry {
+				return []tarEntry{
+					{name: "dir/", typ: tar.TypeDir},
+					file("dir/a.txt", "a"),
+					symlink("dir/b.txt", "a.txt"),
+					symlink("up", "dir/.."),
+				}
+			},
+		},
+		{
+			name:    "absolute path",
+			entries: func(outside string) []tarEntry { return []tarEntry{file(filepath.Join(outside, "pwned"), "x")} },
+			wantErr: "unsafe path in archive",
+		},
+		{
+			name:    "parent entry",
+			entries: func(string) []tarEntry { return []tarEntry{file("../pwned", "x")} },
+			wantErr: "unsafe path in archive",
+		},
+		{
+			name:    "parent after clean",
+			entries: func(string) []tarEntry { return []tarEntry{file("dir/../../pwned", "x")} },
+			wantErr: "unsafe path in archive",
+		},
+		{
+			name:    "absolute symlink",
+			entries: func(outside string) []tarEntry { return []tarEntry{symlink("link", outside)} },
+			wantErr: "unsafe symlink",
+		},
+		{
+			name:    "relative symlink out",
+			entries: func(string) []tarEntry { return []tarEntry{symlink("dir/link", "../../x")} },
+			wantErr: "unsafe symlink",
+		},
+		{
+			name: "symlink out through another symlink",
+			entries: func(string) []tarEntry {
+				return []tarEntry{{name: "sub/", typ: tar.TypeDir}, symlink("s", "sub"), symlink("link", "s/../..")}
+			},
+			wantErr: "unsafe symlink",
+		},
+		{
+			name: "file written through an archive symlink",
+			entries: func(string) []tarEntry {
+				return []tarEntry{{name: "sub/", typ: tar.TypeDir}, symlink("link", "sub"), file("link/pwned", "x")}
+			},
+			wantErr: "goes through a symlink",
+		},
+		{
+			name:    "file written through a symlink out",
+			linkOut: "link",
+			entries: func(string) []tarEntry { return []tarEntry{file("link/pwned", "x")} },
+			wantErr: "goes through a symlink",
+		},
+		{
+			name:    "file replacing a symlink out",
+			linkOut: "pwned",
+			entries: func(string) []tarEntry { return []tarEntry{file("pwned", "x")} },
+			wantErr: "goes through a symlink",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, outside := t.TempDir(), t.TempDir()
+			if tt.linkOut != "" {
+				if err := os.Symlink(outside, filepath.Join(dst, tt.linkOut)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := extractTar(buildTar(t, tt.entries(outside)), dst)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+			if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+				t.Errorf("wrote %s outside the destination", entries[0].Name())
+			}
+			if _, err := os.Lstat(filepath.Join(filepath.Dir(dst), "pwned")); err == nil {
+				t.Errorf("wrote pwned next to the destination")
+			}
+		})
+	}
+
+	t.Run("contents", func(t *testing.T) {
+		dst := t.TempDir()
+		if err := extractTar(buildTar(t, []tarEntry{file("dir/a.txt", "hello"), symlink("dir/b.txt", "a.txt")}), dst); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dst, "dir", "b.txt"))
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("read through the symlink: %q, %v", data, err)
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPreviewRows = 5
+const maxPreviewRows = 50
+const maxPreviewCellWidth = 32
+const schemaSampleRows = 1000
+
+func toolTabularPreview(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	path, ok := argString(args, "path")
+	if !ok {
+		return "", errors.New("tabular_preview: missing path")
+	}
+	n := defaultPreviewRows
+	if v, ok := argInt(args, "rows"); ok && v > 0 {
+		n = min(v, maxPreviewRows)
+	}
+	full := resolvePath(cwd, path)
+
+	format, _ := argString(args, "format")
+	if format == "" {
+		format = tabularFormat(full)
+	}
+	switch format {
+	case "csv":
+		return previewDelimited(ctx, full, ',', n)
+	case "tsv":
+		return previewDelimited(ctx, full, '\t', n)
+	case "parquet":
+		return previewParquet(ctx, cwd, full, n)
+	default:
+		return "", fmt.Errorf("tabular_preview: unsupported format %q (csv, tsv, parquet)", format)
+	}
+}
+
+func tabularFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tsv", ".tab":
+		return "tsv"
+	case ".parquet", ".pq":
+		return "parquet"
+	default:
+		return "csv"
+	}
+}
+
+// previewDelimited streams the file once, keeping the first and last n rows
+// and sampling the leading rows to infer column types.
+func previewDelimited(ctx context.Context, path string, delim rune, n int) (string, error) {
+	f, err := workspaceFSFrom(ctx).Open(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(bufio.NewReaderSize(f, 1<<20))
+	reader.Comma = delim
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return "(empty file)", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	kinds := make([]columnKind, len(header))
+	var head [][]string
+	tail := make([][]string, 0, n)
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("tabular_preview: row %d: %w", count+2, err)
+		}
+		if count < schemaSampleRows {
+			for i := range kinds {
+				if i < len(record) {
+					kinds[i].observe(record[i])
+				}
+			}
+		}
+		if count < n {
+			head = append(head, record)
+		} else {
+			if len(tail) == n {
+				tail = tail[1:]
+			}
+			tail = append(tail, record)
+		}
+		count++
+	}
+
+	schema := make([]string, len(header))
+	for i, name := range header {
+		schema[i] = name + ": " + kinds[i].String()
+	}
+	return renderPreview(filepath.Base(path), schema, header, head, tail, count), nil
+}
+
+type columnKind struct {
+	seen    bool
+	nulls   int
+	notInt  bool
+	notNum  bool
+	notBool bool
+}
+
+func (k *columnKind) observe(value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		k.nulls++
+		return
+	}
+	k.seen = true
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+		k.notInt = true
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		k.notNum = true
+	}
+	if _, err := strconv.ParseBool(value); err != nil {
+		k.notBool = true
+	}
+}
+
+func (k columnKind) String() string {
+	kind := "string"
+	switch {
+	case !k.seen:
+		kind = "empty"
+	case !k.notInt:
+		kind = "int"
+	case !k.notNum:
+		kind = "float"
+	case !k.notBool:
+		kind = "bool"
+	}
+	if k.nulls > 0 {
+		kind += " (nullable)"
+	}
+	return kind
+}
+
+func renderPreview(name string, schema, header []string, head, tail [][]string, total int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s: %d rows, %d columns\n\nSchema:\n", name, total, len(schema))
+	for _, col := range schema {
+		sb.WriteString("  ")
+		sb.WriteString(col)
+		sb.WriteString("\n")
+	}
+	if len(head) == 0 {
+		return sb.String()
+	}
+
+	sb.WriteString("\nFirst rows:\n")
+	sb.WriteString(alignRows(header, head))
+	if len(tail) > 0 {
+		if skipped := total - len(head) - len(tail); skipped > 0 {
+			fmt.Fprintf(&sb, "... %d rows omitted ...\n", skipped)
+		}
+		sb.WriteString("\nLast rows:\n")
+		sb.WriteString(alignRows(header, tail))
+	}
+	return sb.String()
+}
+
+func alignRows(header []string, rows [][]string) string {
+	widths := make([]int, len(header))
+	cell := func(row []string, i int) string {
+		if i >= len(row) {
+			return ""
+		}
+		v := strings.ReplaceAll(row[i], "\n", " ")
+		if r := []rune(v); len(r) > maxPreviewCellWidth {
+			v = string(r[:maxPreviewCellWidth-1]) + "…"
+		}
+		return v
+	}
+	all := append([][]string{header}, rows...)
+	for _, row := range all {
+		for i := range widths {
+			widths[i] = max(widths[i], len([]rune(cell(row, i))))
+		}
+	}
+
+	var sb strings.Builder
+	for _, row := range all {
+		for i := range widths {
+			if i > 0 {
+				sb.WriteString(" | ")
+			}
+			v := cell(row, i)
+			sb.WriteString(v)
+			if i < len(widths)-1 {
+				sb.WriteString(strings.Repeat(" ", widths[i]-len([]rune(v))))
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// previewParquet reads schema and row count from the file footer directly;
+// sample rows require the duckdb CLI since decoding pages is out of scope.
+func previewParquet(ctx context.Context, cwd, path string, n int) (string, error) {
+	meta, err := readParquetFile(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("tabular_preview: %w", err)
+	}
+
+	header := make([]string, len(meta.columns))
+	schema := make([]string, len(meta.columns))
+	for i, col := range meta.columns {
+		header[i] = col.name
+		schema[i] = col.name + ": " + col.typeName()
+	}
+
+	fsys := workspaceFSFrom(ctx)
+	if err := fsys.LookPath(ctx, "duckdb"); err != nil {
+		out := renderPreview(filepath.Base(path), schema, header, nil, nil, int(meta.numRows))
+		return out + "\n(install the duckdb CLI to include sample rows)", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	source := "read_parquet('" + strings.ReplaceAll(commandPath(cwd, path), "'", "''") + "')"
+	head, err := duckdbRows(ctx, cwd, fmt.Sprintf("SELECT * FROM %s LIMIT %d", source, n))
+	if err != nil {
+		return "", err
+	}
+	var tail [][]string
+	if rest := int(meta.numRows) - n; rest > 0 {
+		tail, err = duckdbRows(ctx, cwd, fmt.Sprintf("SELECT * FROM %s OFFSET %d", source, max(n, rest)))
+		if err != nil {
+			return "", err
+		}
+	}
+	return renderPreview(filepath.Base(path), schema, header, head, tail, int(meta.numRows)), nil
+}
+
+func duckdbRows(ctx context.Context, cwd, query string) ([][]string, error) {
+	cmd, err := workspaceFSFrom(ctx).Command(ctx, cwd, "duckdb", "-csv", "-noheader", "-c", query)
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("tabular_preview: duckdb: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	reader := csv.NewReader(strings.NewReader(string(output)))
+	reader.FieldsPerRecord = -1
+	return reader.ReadAll()
+}
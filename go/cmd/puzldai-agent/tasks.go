@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxTaskDescription bounds a description, such as a script's command.
+const maxTaskDescription = 120
+
+var (
+	// build: deps ## Build the binary
+	makeTargetRe = regexp.MustCompile(`^([A-Za-z0-9_./-]+(?:\s+[A-Za-z0-9_./-]+)*)\s*:([^=].*)?$`)
+	// test filter="": build
+	justRecipeRe = regexp.MustCompile(`^@?([A-Za-z0-9_-]+)((?:\s+[+*$]?[A-Za-z0-9_-]+(?:=(?:"[^"]*"|'[^']*'|[^\s:]+))?)*)\s*:([^=].*)?$`)
+)
+
+// taskRunner is a file of project tasks and how its tasks are run.
+type taskRunner struct {
+	file  string
+	run   string // command prefix, e.g. "make"
+	tasks []projectTask
+}
+
+type projectTask struct {
+	name        string
+	params      string
+	description string
+}
+
+// toolTasks lists the targets of the Makefile, justfile, package.json
+// scripts, and Taskfile in a directory, so the model runs the project's own
+// entry points.
+func toolTasks(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	dir := cwd
+	if path, ok := argString(args, "path"); ok && path != "" {
+		dir = resolvePath(cwd, path)
+	}
+	info, err := workspaceFSFrom(ctx).Stat(ctx, dir)
+	if err != nil {
+		return "", fmt.Errorf("tasks: %w", err)
+	}
+	if !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	var runners []taskRunner
+	for _, find := range []func(context.Context, string) (*taskRunner, error){makeTasks, justTasks, npmTasks, taskfileTasks} {
+		r, err := find(ctx, dir)
+		if err != nil {
+			return "", fmt.Errorf("tasks: %w", err)
+		}
+		if r != nil && len(r.tasks) > 0 {
+			runners = append(runners, *r)
+		}
+	}
+	if len(runners) == 0 {
+		return "No Makefile, justfile, package.json scripts, or Taskfile in " + dir, nil
+	}
+	var sb strings.Builder
+	for i, r := range runners {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "%s (run: %s <name>)\n", r.file, r.run)
+		width := 0
+		for _, t := range r.tasks {
+			width = max(width, len(t.name+t.params))
+		}
+		for _, t := range r.tasks {
+			label := t.name + t.params
+			if t.description == "" {
+				fmt.Fprintf(&sb, "  %s\n", label)
+				continue
+			}
+			fmt.Fprintf(&sb, "  %-*s  %s\n", width, label, clipDescription(t.description))
+		}
+	}
+	return sb.String(), nil
+}
+
+// makeTasks reads the explicit targets of a Makefile. A target's
+// description is its "## text" comment, or the comment lines right above it.
+func makeTasks(ctx context.Context, dir string) (*taskRunner, error) {
+	file := firstExisting(ctx, dir, "GNUmakefile", "makefile", "Makefile")
+	if file == "" {
+		return nil, nil
+	}
+	f, err := workspaceFSFrom(ctx).Open(ctx, filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &taskRunner{file: file, run: "make"}
+	seen := map[string]bool{}
+	var comment []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if text, ok := strings.CutPrefix(line, "#"); ok {
+			comment = append(comment, strings.TrimSpace(strings.TrimLeft(text, "#")))
+			continue
+		}
+		m := makeTargetRe.FindStringSubmatch(line)
+		if m == nil || strings.HasPrefix(line, "\t") {
+			comment = nil
+			continue
+		}
+		description := strings.Join(comment, " ")
+		if _, text, ok := strings.Cut(m[2], "##"); ok {
+			description = strings.TrimSpace(text)
+		}
+		comment = nil
+		for _, name := range strings.Fields(m[1]) {
+			// Special targets (.PHONY), pattern rules, and files.
+			if strings.HasPrefix(name, ".") || strings.Contains(name, "%") || strings.Contains(name, "/") || seen[name] {
+				continue
+			}
+			seen[name] = true
+			r.tasks = append(r.tasks, projectTask{name: name, description: description})
+		}
+	}
+	return r, scanner.Err()
+}
+
+// justTasks reads the recipes of a justfile, with their parameters and the
+// comment above each as its description.
+func justTasks(ctx context.Context, dir string) (*taskRunner, error) {
+	file := firstExisting(ctx, dir, "justfile", "Justfile", ".justfile")
+	if file == "" {
+		return nil, nil
+	}
+	data, err := workspaceFSFrom(ctx).ReadFile(ctx, filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	r := &taskRunner{file: file, run: "just"}
+	var comment string
+	private := false
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#"):
+			comment = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			continue
+		case strings.HasPrefix(line, "[private]"):
+			private = true
+			continue
+		case strings.HasPrefix(line, "["):
+			// Other attributes keep the comment above them.
+			continue
+		}
+		m := justRecipeRe.FindStringSubmatch(line)
+		switch {
+		case m == nil || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"):
+		case m[1] == "set" || m[1] == "alias" || m[1] == "export" || m[1] == "import" || m[1] == "mod":
+		case private || strings.HasPrefix(m[1], "_"):
+		default:
+			r.tasks = append(r.tasks, projectTask{name: m[1], params: strings.TrimRight(m[2], " "), description: comment})
+		}
+		if strings.TrimSpace(line) != "" {
+			comment, private = "", false
+		}
+	}
+	return r, nil
+}
+
+// npmTasks reads the scripts of package.json; a script's command is its
+// description.
+func npmTasks(ctx context.Context, dir string) (*taskRunner, error) {
+	data, err := workspaceFSFrom(ctx).ReadFile(ctx, filepath.Join(dir, "package.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pkg struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return nil, fmt.Errorf("package.json: %w", err)
+	}
+	pm := "npm"
+	for _, lock := range nodeLockfiles {
+		if firstExisting(ctx, dir, lock.file) != "" {
+			pm = lock.pm
+			break
+		}
+	}
+	r := &taskRunner{file: "package.json scripts", run: pm + " run"}
+	for name, command := range pkg.Scripts {
+		r.tasks = append(r.tasks, projectTask{name: name, description: command})
+	}
+	sort.Slice(r.tasks, func(i, j int) bool { return r.tasks[i].name < r.tasks[j].name })
+	return r, nil
+}
+
+// taskfileTasks reads the tasks of a go-task Taskfile, leaving out internal
+// ones. A task's description is its desc, or else its summary or first
+// command.
+func taskfileTasks(ctx context.Context, dir string) (*taskRunner, error) {
+	file := firstExisting(ctx, dir, "Taskfile.yml", "taskfile.yml", "Taskfile.yaml", "taskfile.yaml", "Taskfile.dist.yml", "taskfile.dist.yml")
+	if file == "" {
+		return nil, nil
+	}
+	data, err := workspaceFSFrom(ctx).ReadFile(ctx, filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Tasks map[string]yaml.Node `yaml:"tasks"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	r := &taskRunner{file: file, run: "task"}
+	for name, node := range doc.Tasks {
+		var task struct {
+			Desc     string `yaml:"desc"`
+			Summary  string `yaml:"summary"`
+			Internal bool   `yaml:"internal"`
+			Cmds     []any  `yaml:"cmds"`
+		}
+		var cmds []any
+		switch node.Kind {
+		case yaml.MappingNode:
+			if err := node.Decode(&task); err != nil {
+				return nil, fmt.Errorf("%s: task %s: %w", file, name, err)
+			}
+			cmds = task.Cmds
+		case yaml.SequenceNode:
+			_ = node.Decode(&cmds)
+		case yaml.ScalarNode:
+			cmds = []any{node.Value}
+		}
+		if task.Internal {
+			continue
+		}
+		description := firstNonEmpty(task.Desc, firstLine(task.Summary))
+		if description == "" && len(cmds) > 0 {
+			if cmd, ok := cmds[0].(string); ok {
+				description = cmd
+			}
+		}
+		r.tasks = append(r.tasks, projectTask{name: name, description: description})
+	}
+	sort.Slice(r.tasks, func(i, j int) bool { return r.tasks[i].name < r.tasks[j].name })
+	return r, nil
+}
+
+func firstExisting(ctx context.Context, dir string, names ...string) string {
+	fsys := workspaceFSFrom(ctx)
+	for _, name := range names {
+		if _, err := fsys.Stat(ctx, filepath.Join(dir, name)); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+func clipDescription(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= maxTaskDescription {
+		return s
+	}
+	return s[:maxTaskDescription] + "..."
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
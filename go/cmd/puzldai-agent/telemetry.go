@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const telemetryTimeout = 5 * time.Second
+
+// telemetry collects anonymous statistics about one run and sends them to
+// an endpoint the operator chose, only after they opted in with -telemetry
+// or PUZLDAI_TELEMETRY=1. It records counts and classes, never prompts,
+// code, file names, commands, or tool output; the session id and the
+// workspace path are left out as well. A nil telemetry does nothing.
+type telemetry struct {
+	endpoint string
+	provider string
+	model    string
+	started  time.Time
+	client   *http.Client
+
+	mu            sync.Mutex
+	requests      int
+	providerFails int
+	lastFailed    bool
+	tokens        tokenUsage
+	tools         map[string]int
+	toolErrors    map[string]int
+	refusals      int
+}
+
+// telemetryEvent is the payload. Fields are added, never renamed, and
+// Schema is bumped when their meaning changes.
+type telemetryEvent struct {
+	Schema         int            `json:"schema"`
+	Run            string         `json:"run"`
+	OS             string         `json:"os"`
+	Arch           string         `json:"arch"`
+	GoVersion      string         `json:"go_version"`
+	Provider       string         `json:"provider"`
+	Model          string         `json:"model"`
+	Status         string         `json:"status"`
+	FailureClass   string         `json:"failure_class,omitempty"`
+	DurationMS     int64          `json:"duration_ms"`
+	Iterations     int            `json:"iterations"`
+	Requests       int            `json:"provider_requests"`
+	ProviderErrors int            `json:"provider_errors,omitempty"`
+	InputTokens    int64          `json:"input_tokens"`
+	OutputTokens   int64          `json:"output_tokens"`
+	Tools          map[string]int `json:"tools"`
+	ToolErrors     map[string]int `json:"tool_errors,omitempty"`
+	PolicyRefusals int            `json:"policy_refusals,omitempty"`
+}
+
+// telemetryConsent reports whether the operator opted in.
+func telemetryConsent(flag bool) bool {
+	return flag || os.Getenv("PUZLDAI_TELEMETRY") == "1"
+}
+
+func newTelemetry(endpoint, providerName, model string) *telemetry {
+	return &telemetry{
+		endpoint:   endpoint,
+		provider:   providerName,
+		model:      model,
+		started:    time.Now(),
+		client:     &http.Client{Timeout: telemetryTimeout},
+		tools:      map[string]int{},
+		toolErrors: map[string]int{},
+	}
+}
+
+// telemetryProvider counts requests, failures, and tokens.
+type telemetryProvider struct {
+	next provider
+	t    *telemetry
+}
+
+func (t *telemetry) wrap(next provider) provider {
+	if t == nil {
+		return next
+	}
+	return &telemetryProvider{next: next, t: t}
+}
+
+func (p *telemetryProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	resp, err := p.next.complete(ctx, req)
+	p.t.mu.Lock()
+	defer p.t.mu.Unlock()
+	p.t.requests++
+	p.t.lastFailed = err != nil
+	if err != nil {
+		p.t.providerFails++
+	}
+	if resp != nil {
+		p.t.tokens.inputTokens += resp.usage.inputTokens
+		p.t.tokens.outputTokens += resp.usage.outputTokens
+	}
+	return resp, err
+}
+
+// middleware counts calls and failures per tool. Tool names are the
+// agent's own, so the histogram cannot carry anything from the workspace.
+func (t *telemetry) middleware() toolMiddleware {
+	if t == nil {
+		return nil
+	}
+	return func(next toolFunc) toolFunc {
+		return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			out, err := next(ctx, cwd, args)
+			call, _ := toolCallFrom(ctx)
+			t.mu.Lock()
+			t.tools[call.name]++
+			if err != nil {
+				t.toolErrors[call.name]++
+				var refused *policyError
+				if errors.As(err, &refused) {
+					t.refusals++
+				}
+			}
+			t.mu.Unlock()
+			return out, err
+		}
+	}
+}
+
+// finished sends the run's statistics. Failures are reported on stderr and
+// never affect the run.
+func (t *telemetry) finished(outcome agentOutcome) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	ev := telemetryEvent{
+		Schema: 1, Run: newSessionID(), OS: runtime.GOOS, Arch: runtime.GOARCH, GoVersion: runtime.Version(),
+		Provider: t.provider, Model: t.model, Status: outcome.Status, FailureClass: t.failureClass(outcome),
+		DurationMS: time.Since(t.started).Milliseconds(), Iterations: outcome.Iterations,
+		Requests: t.requests, ProviderErrors: t.providerFails,
+		InputTokens: t.tokens.inputTokens, OutputTokens: t.tokens.outputTokens,
+		Tools: t.tools, ToolErrors: t.toolErrors, PolicyRefusals: t.refusals,
+	}
+	body, err := json.Marshal(ev)
+	t.mu.Unlock()
+	if err == nil {
+		err = t.post(body)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "telemetry:", err)
+	}
+}
+
+// failureClass refines the outcome status into where the run went wrong,
+// mirroring the exit codes.
+func (t *telemetry) failureClass(outcome agentOutcome) string {
+	switch {
+	case outcome.Status == outcomeSuccess:
+		return ""
+	case outcome.Status == outcomeError && t.lastFailed:
+		return "provider"
+	case outcome.Status == outcomeBlocked && t.refusals > 0:
+		return "policy"
+	default:
+		return outcome.Status
+	}
+}
+
+func (t *telemetry) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	// minTenantToken is the shortest bearer token serve accepts in config.
+	minTenantToken = 16
+	// maxAPIRuns is how many runs the server remembers; the oldest
+	// finished ones are forgotten first.
+	maxAPIRuns    = 500
+	maxRunRequest = 1 << 20
+	runQueued     = "queued"
+	runRunning    = "running"
+)
+
+// serveConfig is the [serve] section.
+type serveConfig struct {
+	// OIDCIssuer, when set, lets tenants authenticate with ID tokens from
+	// this OpenID Connect issuer; their aud claim must be OIDCAudience.
+	OIDCIssuer   string `toml:"oidc_issuer"`
+	OIDCAudience string `toml:"oidc_audience"`
+}
+
+// tenantConfig is a [tenant.<name>] section: a team that may start runs
+// through serve's API, and the limits those runs work within.
+type tenantConfig struct {
+	// TokenEnv names the variable holding the tenant's bearer token.
+	TokenEnv string `toml:"token_env"`
+	// OIDCSubjects are patterns of the sub claim of ID tokens that
+	// authenticate as the tenant; * matches any text.
+	OIDCSubjects []string `toml:"oidc_subjects"`
+	// Repos are the directories the tenant may run in, relative to the
+	// config file.
+	Repos []string `toml:"repos"`
+	// Permissions is a preset the tenant's runs use, whatever serve's own
+	// agent flags say.
+	Permissions string `toml:"permissions"`
+	// Bash, BannedPaths, and AllowedModels tighten the organization policy
+	// for the tenant's runs, as the policy file's settings of the same
+	// names would.
+	Bash          string   `toml:"bash"`
+	BannedPaths   []string `toml:"banned_paths"`
+	AllowedModels []string `toml:"allowed_models"`
+	// Args are agent flags for the tenant's runs, after serve's own.
+	Args []string `toml:"args"`
+	Push bool     `toml:"push"`
+	// MaxRuns bounds the tenant's queued and running runs; 0 is no bound
+	// beyond serve's -max-runs.
+	MaxRuns int `toml:"max_runs"`
+}
+
+// tenant is a configured tenant as the server serves it.
+type tenant struct {
+	name string
+	tenantConfig
+	tokenHash []byte
+	subjects  []*regexp.Regexp
+	// env is the whole environment of the tenant's agent runs.
+	env []string
+	// active counts queued and running runs; tenantAPI.mu guards it.
+	active int
+}
+
+// apiRun is a run started through the API.
+type apiRun struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+	Repo   string `json:"repo"`
+	Task   string `json:"task"`
+	// Status is queued, running, or the outcome's status.
+	Status  string      `json:"status"`
+	Created time.Time   `json:"created"`
+	Result  *digestTask `json:"result,omitempty"`
+}
+
+// tenantAPI lets authenticated tenants start runs in their repositories and
+// follow them. Each tenant's runs get its permission preset and a policy
+// file tightened by its settings, and their usage is booked to it.
+type tenantAPI struct {
+	server  *server
+	dir     string
+	commit  *commitConfig
+	tenants []*tenant
+	oidc    *oidcVerifier
+	// policyDir holds the tenants' policy files.
+	policyDir string
+
+	mu   sync.Mutex
+	runs []*apiRun
+}
+
+// newTenantAPI sets up the [tenant] entries of cfg, whose repos are
+// relative to dir. It returns nil when there are none.
+func newTenantAPI(s *server, cfg *agentConfig, dir string, policy *orgPolicy) (*tenantAPI, error) {
+	if len(cfg.Tenants) == 0 {
+		return nil, nil
+	}
+	a := &tenantAPI{server: s, dir: dir, commit: &cfg.Commit}
+	if cfg.Serve.OIDCIssuer != "" {
+		if cfg.Serve.OIDCAudience == "" {
+			return nil, errors.New("[serve] oidc_issuer needs oidc_audience")
+		}
+		a.oidc = newOIDCVerifier(cfg.Serve.OIDCIssuer, cfg.Serve.OIDCAudience)
+	}
+	names := make([]string, 0, len(cfg.Tenants))
+	var tokenEnvs []string
+	for name, c := range cfg.Tenants {
+		names = append(names, name)
+		if c.TokenEnv != "" {
+			tokenEnvs = append(tokenEnvs, c.TokenEnv)
+		}
+	}
+	sort.Strings(names)
+	// Runs do not inherit any tenant's token, nor the settings serve
+	// chooses for them.
+	base := slices.DeleteFunc(botChildEnv(), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return slices.Contains(tokenEnvs, name) || name == policyEnv || name == tenantEnv
+	})
+	var err error
+	if a.policyDir, err = os.MkdirTemp("", "puzldai-tenants-"); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		t, err := a.newTenant(name, cfg.Tenants[name], policy, base)
+		if err != nil {
+			a.close()
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
+		for _, other := range a.tenants {
+			if t.tokenHash != nil && subtle.ConstantTimeCompare(t.tokenHash, other.tokenHash) == 1 {
+				a.close()
+				return nil, fmt.Errorf("tenants %s and %s have the same token", other.name, name)
+			}
+		}
+		a.tenants = append(a.tenants, t)
+	}
+	return a, nil
+}
+
+func (a *tenantAPI) newTenant(name string, c tenantConfig, policy *orgPolicy, base []string) (*tenant, error) {
+	if branchUnsafeRe.MatchString(name) || strings.HasPrefix(name, ".") {
+		return nil, errors.New("names use only letters, digits, '.', '_', and '-'")
+	}
+	t := &tenant{name: name, tenantConfig: c}
+	if c.TokenEnv != "" {
+		token := os.Getenv(c.TokenEnv)
+		if len(token) < minTenantToken {
+			return nil, fmt.Errorf("%s must hold a token of at least %d characters", c.TokenEnv, minTenantToken)
+		}
+		sum := sha256.Sum256([]byte(token))
+		t.tokenHash = sum[:]
+	}
+	if len(c.OIDCSubjects) > 0 && a.oidc == nil {
+		return nil, errors.New("oidc_subjects needs [serve] oidc_issuer")
+	}
+	for _, pattern := range c.OIDCSubjects {
+		t.subjects = append(t.subjects, regexp.MustCompile("^"+strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")+"$"))
+	}
+	if t.tokenHash == nil && len(t.subjects) == 0 {
+		return nil, errors.New("set token_env or oidc_subjects")
+	}
+	if _, err := lookupPermissions(c.Permissions); err != nil {
+		return nil, err
+	}
+	switch c.Bash {
+	case "", bashApprove, bashDeny:
+	default:
+		return nil, fmt.Errorf("invalid bash %q (approve, deny)", c.Bash)
+	}
+	if c.MaxRuns < 0 {
+		return nil, errors.New("max_runs must not be negative")
+	}
+	if len(t.Repos) == 0 {
+		t.Repos = []string{"."}
+	}
+	t.Repos = slices.Clone(t.Repos)
+	for i, repo := range t.Repos {
+		t.Repos[i] = filepath.Clean(repo)
+	}
+
+	tightened, err := policy.tighten(c)
+	if err != nil {
+		return nil, err
+	}
+	policyFile := filepath.Join(a.policyDir, name+".toml")
+	f, err := os.OpenFile(policyFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = toml.NewEncoder(f).Encode(tightened)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.env = append(slices.Clone(base), policyEnv+"="+policyFile, tenantEnv+"="+name)
+	return t, nil
+}
+
+// close removes the tenants' policy files.
+func (a *tenantAPI) close() {
+	os.RemoveAll(a.policyDir)
+}
+
+func (a *tenantAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /runs", a.authorized(a.startRun))
+	mux.HandleFunc("GET /runs", a.authorized(a.listRuns))
+	mux.HandleFunc("GET /runs/{id}", a.authorized(a.getRun))
+	mux.HandleFunc("GET /runs/{id}/patch", a.authorized(a.getPatch))
+	mux.HandleFunc("GET /usage", a.authorized(a.usage))
+}
+
+// authorized serves requests carrying a tenant's bearer token or ID token
+// with next, and refuses the others.
+func (a *tenantAPI) authorized(next func(http.ResponseWriter, *http.Request, *tenant)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := a.authenticate(r)
+		if err != nil {
+			// The reason is for the operator; clients only learn that
+			// they were refused.
+			fmt.Fprintf(os.Stderr, "serve: refused %s %s from %s: %v\n", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="puzldai"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r, t)
+	}
+}
+
+func (a *tenantAPI) authenticate(r *http.Request) (*tenant, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token = strings.TrimSpace(token); !ok || token == "" {
+		return nil, errors.New("no bearer token")
+	}
+	if a.oidc != nil && looksLikeJWT(token) {
+		subject, err := a.oidc.verify(r.Context(), token)
+		if err != nil {
+			return nil, err
+		}
+		// Tenants are tried in name order.
+		for _, t := range a.tenants {
+			if slices.ContainsFunc(t.subjects, func(re *regexp.Regexp) bool { return re.MatchString(subject) }) {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("no tenant for subject %q", subject)
+	}
+	sum := sha256.Sum256([]byte(token))
+	var found *tenant
+	for _, t := range a.tenants {
+		// Every tenant is compared, so the time taken does not tell which
+		// one matched.
+		if t.tokenHash != nil && subtle.ConstantTimeCompare(sum[:], t.tokenHash) == 1 {
+			found = t
+		}
+	}
+	if found == nil {
+		return nil, errors.New("unknown token")
+	}
+	return found, nil
+}
+
+// startRun answers POST /runs: {"repo": ..., "task": ...} queues a run of
+// the task in one of the tenant's repositories. The repository may be left
+// out when the tenant has only one.
+func (a *tenantAPI) startRun(w http.ResponseWriter, r *http.Request, t *tenant) {
+	var req struct {
+		Repo string `json:"repo"`
+		Task string `json:"task"`
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxRunRequest))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Task) == "" {
+		http.Error(w, "no task", http.StatusBadRequest)
+		return
+	}
+	repo := filepath.Clean(req.Repo)
+	if req.Repo == "" && len(t.Repos) == 1 {
+		repo = t.Repos[0]
+	}
+	switch {
+	case req.Repo == "" && len(t.Repos) > 1:
+		http.Error(w, "choose a repo: "+strings.Join(t.Repos, ", "), http.StatusBadRequest)
+		return
+	case !slices.Contains(t.Repos, repo):
+		http.Error(w, fmt.Sprintf("repo %q is not one of %s", req.Repo, strings.Join(t.Repos, ", ")), http.StatusForbidden)
+		return
+	}
+
+	a.mu.Lock()
+	if t.MaxRuns > 0 && t.active >= t.MaxRuns {
+		a.mu.Unlock()
+		http.Error(w, fmt.Sprintf("tenant %s already has %d of its max_runs queued or running", t.name, t.active), http.StatusTooManyRequests)
+		return
+	}
+	t.active++
+	run := &apiRun{ID: newSessionID(), Tenant: t.name, Repo: repo, Task: req.Task, Status: runQueued, Created: time.Now().UTC()}
+	a.runs = append(a.runs, run)
+	a.forgetRuns()
+	resp := *run
+	a.mu.Unlock()
+
+	a.server.start("tenant "+t.name+" run "+run.ID, func(ctx context.Context) error {
+		return a.run(ctx, t, run)
+	})
+	w.Header().Set("Location", "/runs/"+run.ID)
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// run runs the task like a one-task batch: in a worktree of the repository's
+// HEAD, with the changes committed to puzldai/<tenant>/<id>.
+func (a *tenantAPI) run(ctx context.Context, t *tenant, run *apiRun) error {
+	a.mu.Lock()
+	run.Status = runRunning
+	a.mu.Unlock()
+	agentArgs := append(slices.Clone(a.server.agentArgs), t.Args...)
+	if t.Permissions != "" {
+		// Last, so the preset holds whatever the flags before it say.
+		agentArgs = append(agentArgs, "-permissions", t.Permissions)
+	}
+	b := &batchRun{
+		dir:        a.dir,
+		prefix:     "puzldai/" + t.name + "/",
+		push:       t.Push,
+		agentArgs:  agentArgs,
+		commit:     a.commit,
+		env:        t.env,
+		workspaces: map[string]*childWorkspace{},
+	}
+	result := b.run(ctx, batchTask{Name: run.ID, Repo: run.Repo, Task: run.Task})
+	b.cleanup()
+
+	a.mu.Lock()
+	run.Status, run.Result = result.Status, &result
+	t.active--
+	a.mu.Unlock()
+	if result.Status != outcomeSuccess {
+		return fmt.Errorf("%s: %s", result.Status, firstLine(result.Summary))
+	}
+	return nil
+}
+
+// forgetRuns drops the oldest finished runs beyond maxAPIRuns. a.mu must be
+// held.
+func (a *tenantAPI) forgetRuns() {
+	for i := 0; len(a.runs) > maxAPIRuns && i < len(a.runs); {
+		if a.runs[i].Result != nil {
+			a.runs = slices.Delete(a.runs, i, i+1)
+			continue
+		}
+		i++
+	}
+}
+
+// lookup returns a copy of the tenant's run id, or nil.
+func (a *tenantAPI) lookup(t *tenant, id string) *apiRun {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, run := range a.runs {
+		if run.ID == id && run.Tenant == t.name {
+			c := *run
+			return &c
+		}
+	}
+	return nil
+}
+
+// listRuns answers GET /runs with the tenant's runs, newest first.
+func (a *tenantAPI) listRuns(w http.ResponseWriter, r *http.Request, t *tenant) {
+	runs := []apiRun{}
+	a.mu.Lock()
+	for i := len(a.runs) - 1; i >= 0; i-- {
+		if a.runs[i].Tenant == t.name {
+			runs = append(runs, *a.runs[i])
+		}
+	}
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func (a *tenantAPI) getRun(w http.ResponseWriter, r *http.Request, t *tenant) {
+	run := a.lookup(t, r.PathValue("id"))
+	if run == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// getPatch answers GET /runs/{id}/patch with the run's diff, which is empty
+// until it finishes and when nothing changed.
+func (a *tenantAPI) getPatch(w http.ResponseWriter, r *http.Request, t *tenant) {
+	run := a.lookup(t, r.PathValue("id"))
+	if run == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	if run.Result != nil {
+		io.WriteString(w, run.Result.Patch)
+	}
+}
+
+// usage answers GET /usage?since=30d with the tenant's totals from the
+// usage ledger.
+func (a *tenantAPI) usage(w http.ResponseWriter, r *http.Request, t *tenant) {
+	since, err := parseSince(firstNonEmpty(r.URL.Query().Get("since"), "30d"), time.Now())
+	if err != nil {
+		http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := loadLedger(since, "", t.name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	total := &usageGroup{runs: map[string]bool{}}
+	for _, rec := range records {
+		total.add(rec)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tenant":          t.name,
+		"since":           since.UTC(),
+		"runs":            len(total.runs),
+		"input_tokens":    total.input,
+		"output_tokens":   total.output,
+		"cost_usd":        total.cost,
+		"unpriced_tokens": total.unpriced,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const terraformTimeout = 15 * time.Minute
+const terraformOutputLines = 100
+
+var terraformApplyRe = regexp.MustCompile(`\bterraform\b[^|;&\n]*\b(apply|destroy)\b`)
+
+// terraformToolset runs plans into session-owned plan files; applying a plan
+// always goes through explicit operator approval.
+type terraformToolset struct {
+	sess    *session
+	fsys    workspaceFS // where the plan files are kept
+	mu      sync.Mutex
+	planDir string
+	seq     int
+	plans   map[string]terraformPlan
+}
+
+type terraformPlan struct {
+	path    string
+	dir     string
+	summary string
+}
+
+func terraformTools(sess *session) []toolDef {
+	fsys, _ := sess.workspace()
+	if err := fsys.LookPath(context.Background(), "terraform"); err != nil {
+		return nil
+	}
+	tf := &terraformToolset{sess: sess, fsys: fsys, plans: map[string]terraformPlan{}}
+	sess.onClose(func() {
+		if tf.planDir != "" {
+			_ = fsys.RemoveAll(context.Background(), tf.planDir)
+		}
+	})
+	return []toolDef{
+		{
+			name:        "terraform_plan",
+			description: "Run terraform plan and summarize resource adds/changes/destroys (never applies)",
+			params: []toolParam{
+				optional("dir", "string", "configuration directory").withDefault("."),
+				optional("var_file", "string", ""),
+				optional("destroy", "boolean", "plan a destroy"),
+			},
+			fn: tf.plan,
+		},
+		{
+			name:        "terraform_apply",
+			description: "Apply a plan produced by terraform_plan; always requires explicit operator approval. Use this, not bash, to apply",
+			params: []toolParam{
+				required("plan", "string", "plan id returned by terraform_plan"),
+			},
+			fn: tf.apply,
+		},
+	}
+}
+
+type terraformEvent struct {
+	Type    string `json:"type"`
+	Message string `json:"@message"`
+	Change  struct {
+		Resource struct {
+			Addr string `json:"addr"`
+		} `json:"resource"`
+		Action string `json:"action"`
+	} `json:"change"`
+	Changes struct {
+		Add       int    `json:"add"`
+		Change    int    `json:"change"`
+		Remove    int    `json:"remove"`
+		Operation string `json:"operation"`
+	} `json:"changes"`
+	Diagnostic struct {
+		Severity string `json:"severity"`
+		Summary  string `json:"summary"`
+		Detail   string `json:"detail"`
+	} `json:"diagnostic"`
+}
+
+func (tf *terraformToolset) plan(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	dir := cwd
+	if d, _ := argString(args, "dir"); d != "" {
+		dir = resolvePath(cwd, d)
+	}
+
+	tf.mu.Lock()
+	if tf.planDir == "" {
+		planDir, err := tf.fsys.MkdirTemp(ctx, "puzldai-tfplan-")
+		if err != nil {
+			tf.mu.Unlock()
+			return "", err
+		}
+		tf.planDir = planDir
+	}
+	tf.seq++
+	id := fmt.Sprintf("plan-%d", tf.seq)
+	planPath := filepath.Join(tf.planDir, id+".tfplan")
+	tf.mu.Unlock()
+
+	cmdArgs := []string{"plan", "-json", "-input=false", "-out=" + planPath}
+	if varFile, _ := argString(args, "var_file"); varFile != "" {
+		cmdArgs = append(cmdArgs, "-var-file="+commandPath(dir, resolvePath(cwd, varFile)))
+	}
+	if argBool(args, "destroy") {
+		cmdArgs = append(cmdArgs, "-destroy")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, terraformTimeout)
+	defer cancel()
+	cmd, err := workspaceFSFrom(ctx).Command(ctx, dir, "terraform", cmdArgs...)
+	if err != nil {
+		return "", fmt.Errorf("terraform_plan: %w", err)
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+
+	summary, hasErrors := summarizeTerraformPlan(string(output))
+	if err != nil || hasErrors {
+		msg := summary
+		if extra := strings.TrimSpace(stderr.String()); extra != "" {
+			msg += "\n" + extra
+		}
+		if msg == "" && err != nil {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("terraform_plan: %s", msg)
+	}
+
+	tf.mu.Lock()
+	tf.plans[id] = terraformPlan{path: planPath, dir: dir, summary: summary}
+	tf.mu.Unlock()
+	return fmt.Sprintf("%s\nSaved as %s (apply with terraform_apply after review).", summary, id), nil
+}
+
+// summarizeTerraformPlan turns the plan's JSON event stream into a compact
+// list of planned resource actions plus any warnings and errors.
+func summarizeTerraformPlan(stream string) (string, bool) {
+	var changes []string
+	var diags []string
+	var totals string
+	hasErrors := false
+
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var ev terraformEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+		switch ev.Type {
+		case "planned_change":
+			if ev.Change.Action == "noop" || ev.Change.Action == "read" {
+				continue
+			}
+			changes = append(changes, terraformActionSymbol(ev.Change.Action)+" "+ev.Change.Resource.Addr)
+		case "change_summary":
+			totals = fmt.Sprintf("Plan: %d to add, %d to change, %d to destroy.", ev.Changes.Add, ev.Changes.Change, ev.Changes.Remove)
+		case "diagnostic":
+			if ev.Diagnostic.Severity == "error" {
+				hasErrors = true
+			}
+			line := strings.ToUpper(ev.Diagnostic.Severity) + ": " + ev.Diagnostic.Summary
+			if ev.Diagnostic.Detail != "" {
+				line += "\n  " + strings.ReplaceAll(strings.TrimSpace(ev.Diagnostic.Detail), "\n", "\n  ")
+			}
+			diags = append(diags, line)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i][0] < changes[j][0] })
+
+	var sb strings.Builder
+	if totals != "" {
+		sb.WriteString(totals)
+		sb.WriteString("\n")
+	}
+	for _, c := range changes {
+		sb.WriteString(c)
+		sb.WriteString("\n")
+	}
+	if len(diags) > 0 {
+		sb.WriteString("\n")
+		sb.WriteString(strings.Join(diags, "\n"))
+		sb.WriteString("\n")
+	}
+	return strings.TrimRight(sb.String(), "\n"), hasErrors
+}
+
+func terraformActionSymbol(action string) string {
+	switch action {
+	case "create":
+		return "+"
+	case "delete":
+		return "-"
+	case "update":
+		return "~"
+	case "replace":
+		return "-/+"
+	default:
+		return action
+	}
+}
+
+func (tf *terraformToolset) apply(ctx context.Context, cwd string, args map[string]any) (string, error) {
+	id, _ := argString(args, "plan")
+	tf.mu.Lock()
+	plan, ok := tf.plans[id]
+	tf.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("terraform_apply: unknown plan %q (run terraform_plan first)", id)
+	}
+
+	approved, reason := tf.sess.approver.approve("terraform apply "+id+" in "+plan.dir+":\n"+plan.summary, true)
+	if !approved {
+		return "", policyErrorf("terraform_apply: %s", reason)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, terraformTimeout)
+	defer cancel()
+	cmd, err := workspaceFSFrom(ctx).Command(ctx, plan.dir, "terraform", "apply", "-input=false", "-no-color", plan.path)
+	if err != nil {
+		return "", fmt.Errorf("terraform_apply: %w", err)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("terraform_apply: %s", tailLines(string(output), terraformOutputLines))
+	}
+
+	tf.mu.Lock()
+	delete(tf.plans, id)
+	tf.mu.Unlock()
+	return tailLines(string(output), terraformOutputLines), nil
+}
+
+// terraformShim is the terraform that bash commands find first on PATH. It
+// refuses apply and destroy, however the command reached it, and runs the
+// real terraform for everything else.
+const terraformShim = `#!/bin/sh
+for arg do
+	case $arg in
+	-*) ;;
+	apply | destroy)
+		echo "puzldai: terraform $arg is refused in bash; plan with terraform_plan and apply with terraform_apply" >&2
+		exit 1
+		;;
+	*) break ;;
+	esac
+done
+shim=${0%/*}
+path=
+IFS=:
+for dir in $PATH; do
+	[ "$dir" = "$shim" ] || path=$path${path:+:}$dir
+done
+unset IFS
+PATH=$path exec terraform "$@"
+`
+
+// installTerraformShim writes terraformShim into a session temporary
+// directory where the workspace's commands run and returns the directory.
+func installTerraformShim(sess *session) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	fsys, root := sess.workspace()
+	dir, err := fsys.MkdirTemp(ctx, "puzldai-terraform-")
+	if err != nil {
+		return "", err
+	}
+	sess.onClose(func() { _ = fsys.RemoveAll(context.Background(), dir) })
+	shim := shellQuote(dir + "/terraform")
+	cmd, err := fsys.Shell(ctx, root, "cat > "+shim+" && chmod +x "+shim)
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdin = strings.NewReader(terraformShim)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return dir, nil
+}
+
+// guardTerraformBash keeps terraform apply and destroy in bash behind
+// explicit approval while the terraform tools are enabled. A command that
+// plainly runs them asks for approval and, approved, runs as written. Every
+// other command runs with terraformShim first on PATH, so an apply reached
+// through a variable, a script, or make is refused. Where the shim cannot be
+// installed, as without a POSIX shell, every bash command asks instead.
+func guardTerraformBash(sess *session, next toolFunc) toolFunc {
+	shimDir, err := installTerraformShim(sess)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "terraform: every bash command needs approval, the terraform wrapper could not be installed:", err)
+	}
+	return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+		command, _ := argString(args, "command")
+		if terraformApplyRe.MatchString(command) || shimDir == "" {
+			approved, reason := sess.approver.approve("bash: "+command, true)
+			if !approved {
+				return "", policyErrorf("bash: %s", reason)
+			}
+			return next(ctx, cwd, args)
+		}
+		shimmed := maps.Clone(args)
+		shimmed["command"] = "PATH=" + shellQuote(shimDir) + `:"$PATH"; export PATH; ` + command
+		return next(ctx, cwd, shimmed)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTerraformBashGuard(t *testing.T) {
+	bin := t.TempDir()
+	fake := "#!/bin/sh\necho ran terraform \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "terraform"), []byte(fake), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	approver, _ := newApprover(approvalDeny)
+	sess := newSession(t.TempDir(), approver)
+	defer sess.close()
+	// A plain sh, not toolBash's login shell, so the profile cannot reset PATH.
+	bash := guardTerraformBash(sess, func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+		command, _ := argString(args, "command")
+		out, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+		return string(out), err
+	})
+
+	tests := []struct {
+		command string
+		want    string // output, or "" when refused
+	}{
+		{"terraform plan -out=x", "ran terraform plan -out=x"},
+		{"terraform -chdir=infra validate", "ran terraform -chdir=infra validate"},
+		{"terraform apply", ""},
+		{"terraform -chdir=infra destroy", ""},
+		{"cmd=apply; terraform $cmd", ""},
+		{"sh -c 'terraform -chdir=infra apply -auto-approve'", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			out, err := bash(context.Background(), sess.cwd, map[string]any{"command": tt.command})
+			if tt.want == "" {
+				if err == nil && !strings.Contains(out, "is refused in bash") {
+					t.Fatalf("got %q, want refused", out)
+				}
+				return
+			}
+			if err != nil || !strings.Contains(out, tt.want) {
+				t.Fatalf("got %q, %v; want %q", out, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ticketTimeout = 30 * time.Second
+	// maxTicketComments is how many of a ticket's latest comments the task
+	// includes.
+	maxTicketComments  = 20
+	maxTicketComment   = 4000
+	maxTicketReply     = 8000
+	defaultJiraToken   = "JIRA_API_TOKEN"
+	defaultLinearToken = "LINEAR_API_KEY"
+	defaultLinearAPI   = "https://api.linear.app/graphql"
+)
+
+// jiraConfig is the [jira] section. Jira Cloud takes the account's email
+// with an API token; Server and Data Center take a personal access token
+// alone.
+type jiraConfig struct {
+	BaseURL  string `toml:"base_url"`
+	Email    string `toml:"email"`
+	TokenEnv string `toml:"token_env"`
+}
+
+// linearConfig is the [linear] section.
+type linearConfig struct {
+	TokenEnv string `toml:"token_env"`
+	// APIURL defaults to Linear's GraphQL endpoint.
+	APIURL string `toml:"api_url"`
+}
+
+var ticketKeyRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*-[0-9]+$`)
+
+// ticket is a tracker issue used as the task (-task-from). The run's
+// outcome is posted back to it as a comment.
+type ticket struct {
+	ref         string // jira:PROJ-123 or linear:ENG-456
+	title       string
+	description string
+	url         string
+	comments    []ticketComment
+	// post adds a comment to the ticket.
+	post func(ctx context.Context, body string) error
+}
+
+type ticketComment struct {
+	author string
+	time   time.Time
+	body   string
+}
+
+// fetchTicket reads the ticket named by ref, source:key.
+func fetchTicket(ctx context.Context, ref string, cfg *agentConfig) (*ticket, error) {
+	source, key, _ := strings.Cut(ref, ":")
+	if !ticketKeyRe.MatchString(key) {
+		return nil, fmt.Errorf("invalid -task-from %q (jira:PROJ-123, linear:ENG-456)", ref)
+	}
+	client := &http.Client{Timeout: ticketTimeout}
+	var t *ticket
+	var err error
+	switch source {
+	case "jira":
+		t, err = fetchJira(ctx, client, cfg.Jira, strings.ToUpper(key))
+	case "linear":
+		t, err = fetchLinear(ctx, client, cfg.Linear, strings.ToUpper(key))
+	default:
+		return nil, fmt.Errorf("invalid -task-from %q (jira:PROJ-123, linear:ENG-456)", ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ref, err)
+	}
+	t.ref = ref
+	slices.SortStableFunc(t.comments, func(a, b ticketComment) int { return a.time.Compare(b.time) })
+	if len(t.comments) > maxTicketComments {
+		t.comments = t.comments[len(t.comments)-maxTicketComments:]
+	}
+	return t, nil
+}
+
+func fetchJira(ctx context.Context, client *http.Client, cfg jiraConfig, key string) (*ticket, error) {
+	base := strings.TrimSuffix(cfg.BaseURL, "/")
+	if base == "" {
+		return nil, errors.New("set base_url in the [jira] config section")
+	}
+	tokenEnv := firstNonEmpty(cfg.TokenEnv, defaultJiraToken)
+	token := os.Getenv(tokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("%s is not set", tokenEnv)
+	}
+	auth := "Bearer " + token
+	if cfg.Email != "" {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Email+":"+token))
+	}
+	headers := map[string]string{"Authorization": auth, "Accept": "application/json"}
+	// Version 2 of the API returns text fields as text rather than as
+	// documents, on Cloud and Server alike.
+	issue := base + "/rest/api/2/issue/" + url.PathEscape(key)
+	var resp struct {
+		Fields struct {
+			Summary     string `json:"summary"`
+			Description string `json:"description"`
+			Comment     struct {
+				Comments []struct {
+					Author struct {
+						DisplayName string `json:"displayName"`
+					} `json:"author"`
+					Body    string `json:"body"`
+					Created string `json:"created"`
+				} `json:"comments"`
+			} `json:"comment"`
+		} `json:"fields"`
+	}
+	if _, err := callJSON(ctx, client, http.MethodGet, issue+"?fields=summary,description,comment", headers, nil, &resp); err != nil {
+		return nil, err
+	}
+	t := &ticket{title: resp.Fields.Summary, description: resp.Fields.Description, url: base + "/browse/" + key}
+	for _, c := range resp.Fields.Comment.Comments {
+		created, _ := time.Parse("2006-01-02T15:04:05.000-0700", c.Created)
+		t.comments = append(t.comments, ticketComment{author: c.Author.DisplayName, time: created, body: c.Body})
+	}
+	t.post = func(ctx context.Context, body string) error {
+		_, err := callJSON(ctx, client, http.MethodPost, issue+"/comment", headers, map[string]string{"body": body}, nil)
+		return err
+	}
+	return t, nil
+}
+
+func fetchLinear(ctx context.Context, client *http.Client, cfg linearConfig, key string) (*ticket, error) {
+	tokenEnv := firstNonEmpty(cfg.TokenEnv, defaultLinearToken)
+	token := os.Getenv(tokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("%s is not set", tokenEnv)
+	}
+	// Personal API keys go in the header as they are; OAuth tokens are
+	// bearer tokens.
+	auth := token
+	if !strings.HasPrefix(token, "lin_api_") {
+		auth = "Bearer " + token
+	}
+	headers := map[string]string{"Authorization": auth}
+	graphql := func(ctx context.Context, query string, vars map[string]any, data any) error {
+		var resp struct {
+			Data   any `json:"data"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		resp.Data = data
+		if _, err := callJSON(ctx, client, http.MethodPost, firstNonEmpty(cfg.APIURL, defaultLinearAPI), headers, map[string]any{"query": query, "variables": vars}, &resp); err != nil {
+			return err
+		}
+		if len(resp.Errors) > 0 {
+			return errors.New(resp.Errors[0].Message)
+		}
+		return nil
+	}
+	var data struct {
+		Issue struct {
+			ID          string `json:"id"`
+			Title       string `json:"title"`
+			Description string `json:"description"`
+			URL         string `json:"url"`
+			Comments    struct {
+				Nodes []struct {
+					Body      string    `json:"body"`
+					CreatedAt time.Time `json:"createdAt"`
+					User      *struct {
+						Name string `json:"name"`
+					} `json:"user"`
+				} `json:"nodes"`
+			} `json:"comments"`
+		} `json:"issue"`
+	}
+	const query = `query($id: String!) { issue(id: $id) { id title description url comments(last: 50) { nodes { body createdAt user { name } } } } }`
+	if err := graphql(ctx, query, map[string]any{"id": key}, &data); err != nil {
+		return nil, err
+	}
+	t := &ticket{title: data.Issue.Title, description: data.Issue.Description, url: data.Issue.URL}
+	for _, c := range data.Issue.Comments.Nodes {
+		author := "an integration"
+		if c.User != nil {
+			author = c.User.Name
+		}
+		t.comments = append(t.comments, ticketComment{author: author, time: c.CreatedAt, body: c.Body})
+	}
+	t.post = func(ctx context.Context, body string) error {
+		const mutation = `mutation($id: String!, $body: String!) { commentCreate(input: {issueId: $id, body: $body}) { success } }`
+		return graphql(ctx, mutation, map[string]any{"id": data.Issue.ID, "body": body}, &struct{}{})
+	}
+	return t, nil
+}
+
+// task is the ticket as the agent's task: its title and description, then
+// the discussion so far.
+func (t *ticket) task() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Do what ticket %s asks for.\n\n# %s\n\n%s\n", t.ref, t.title, strings.TrimSpace(t.description))
+	if t.url != "" {
+		fmt.Fprintf(&sb, "\n%s\n", t.url)
+	}
+	if len(t.comments) > 0 {
+		sb.WriteString("\n## Comments\n")
+		for _, c := range t.comments {
+			fmt.Fprintf(&sb, "\n%s, %s:\n%s\n", c.author, c.time.Format(time.DateOnly), truncateOutput(strings.TrimSpace(c.body), maxTicketComment))
+		}
+	}
+	return sb.String()
+}
+
+// reply posts the outcome to the ticket. Failures are reported on stderr
+// and never affect the run.
+func (t *ticket) reply(outcome agentOutcome) {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ticketTimeout)
+	defer cancel()
+	body := fmt.Sprintf("puzldai-agent: %s\n\n%s", outcome.Status, truncateOutput(strings.TrimSpace(outcome.Summary), maxTicketReply))
+	if err := t.post(ctx, redactSecrets(body, secretValues())); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to comment on %s: %v\n", t.ref, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// timeoutError is the cause of a run context cut off by -deadline or
+// -turn-timeout.
+type timeoutError struct {
+	limit string
+	after time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s of %s exceeded", e.limit, e.after)
+}
+
+// turnTimer cancels the run when a single turn (the model request, its tool
+// calls, and any review) takes longer than the limit. A nil timer does
+// nothing.
+type turnTimer struct {
+	limit  time.Duration
+	cancel context.CancelCauseFunc
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// withRunLimits bounds ctx by the whole-run deadline and returns the timer
+// for -turn-timeout. Zero durations mean no limit.
+func withRunLimits(ctx context.Context, deadline, turnTimeout time.Duration) (context.Context, *turnTimer, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := func() { cancel(nil) }
+	if deadline > 0 {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithTimeoutCause(ctx, deadline, &timeoutError{limit: "deadline", after: deadline})
+		stop = func() {
+			cancelDeadline()
+			cancel(nil)
+		}
+	}
+	if turnTimeout <= 0 {
+		return ctx, nil, stop
+	}
+	return ctx, &turnTimer{limit: turnTimeout, cancel: cancel}, stop
+}
+
+// start begins a turn, restarting the clock.
+func (t *turnTimer) start() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(t.limit, func() { t.cancel(&timeoutError{limit: "turn timeout", after: t.limit}) })
+}
+
+// interrupted describes a run whose context ended: a limit that expired,
+// or cancellation by a signal.
+func interrupted(ctx context.Context) (agentOutcome, int) {
+	outcome := agentOutcome{Status: outcomeCancelled, Summary: "cancelled"}
+	if te, ok := context.Cause(ctx).(*timeoutError); ok {
+		outcome = agentOutcome{Status: outcomeTimedOut, Summary: te.Error()}
+	}
+	return outcome, exitCode(runFailure(outcome, 0, context.Cause(ctx)))
+}
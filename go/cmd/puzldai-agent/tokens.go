@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// countTokensTimeout bounds a count-tokens request; a slow count falls
+	// back to the estimate rather than delaying the turn.
+	countTokensTimeout = 10 * time.Second
+	// maxToolResultTokens caps a single tool result, so one huge listing or
+	// log cannot crowd the rest of the conversation out of the context.
+	maxToolResultTokens = 25_000
+	// messageOverheadTokens approximates the role and framing tokens each
+	// message adds.
+	messageOverheadTokens = 4
+)
+
+// tokenCountingProvider is implemented by providers that can count a
+// request's input tokens without running it.
+type tokenCountingProvider interface {
+	countTokens(ctx context.Context, req completionRequest) (int, error)
+}
+
+func (p *anthropicProvider) countTokens(ctx context.Context, req completionRequest) (int, error) {
+	res, err := p.client.Messages.CountTokens(ctx, anthropic.MessageCountTokensParams{
+		Model: anthropic.Model(req.model),
+		Messages: []anthropic.MessageParam{{
+			Role: anthropic.MessageParamRoleUser,
+			Content: []anthropic.ContentBlockParamUnion{{
+				OfText: &anthropic.TextBlockParam{Text: buildPrompt(req.system, req.messages)},
+			}},
+		}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.InputTokens), nil
+}
+
+// tokenCounter counts input tokens with the provider's count-tokens endpoint
+// when it has one, and with estimateTextTokens otherwise. After the first
+// failed count it stays on the estimate for the rest of the run. A nil
+// counter estimates.
+type tokenCounter struct {
+	api   tokenCountingProvider
+	model string
+
+	mu      sync.Mutex
+	offline bool
+}
+
+// newTokenCounter takes the unwrapped provider, so counts bypass the rate
+// limiter, the usage ledger, and the response cache.
+func newTokenCounter(p provider, model string) *tokenCounter {
+	api, _ := p.(tokenCountingProvider)
+	return &tokenCounter{api: api, model: model}
+}
+
+type tokenCounterKey struct{}
+
+func withTokenCounter(ctx context.Context, c *tokenCounter) context.Context {
+	return context.WithValue(ctx, tokenCounterKey{}, c)
+}
+
+func tokenCounterFrom(ctx context.Context) *tokenCounter {
+	c, _ := ctx.Value(tokenCounterKey{}).(*tokenCounter)
+	return c
+}
+
+// count returns the request's input tokens.
+func (c *tokenCounter) count(ctx context.Context, req completionRequest) int {
+	if c == nil || c.api == nil {
+		return estimateTokens(req)
+	}
+	c.mu.Lock()
+	offline := c.offline
+	c.mu.Unlock()
+	if offline {
+		return estimateTokens(req)
+	}
+	req.model = firstNonEmpty(req.model, c.model)
+	cctx, cancel := context.WithTimeout(ctx, countTokensTimeout)
+	defer cancel()
+	n, err := c.api.countTokens(cctx, req)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.mu.Lock()
+			if !c.offline {
+				c.offline = true
+				fmt.Fprintln(os.Stderr, "token counting unavailable, estimating instead:", err)
+			}
+			c.mu.Unlock()
+		}
+		return estimateTokens(req)
+	}
+	return n
+}
+
+// countText returns the tokens of text as a message of its own.
+func (c *tokenCounter) countText(ctx context.Context, text string) int {
+	return c.count(ctx, completionRequest{messages: []agentMessage{{role: "user", content: text}}})
+}
+
+// fits reports whether the request's input fits in limit tokens, and its
+// size. Requests the estimate puts well under the limit are not sent to the
+// count-tokens endpoint.
+func (c *tokenCounter) fits(ctx context.Context, req completionRequest, limit int) (int, bool) {
+	if n := estimateTokens(req); n <= limit/2 {
+		return n, true
+	}
+	n := c.count(ctx, req)
+	return n, n <= limit
+}
+
+// truncateTokens cuts s to about limit tokens at a line boundary and notes
+// how much was left out.
+func (c *tokenCounter) truncateTokens(ctx context.Context, s string, limit int) string {
+	if estimateTextTokens(s) <= limit/2 {
+		return s
+	}
+	total := c.countText(ctx, s)
+	if total <= limit {
+		return s
+	}
+	// Token density varies little within one output, so the share of bytes
+	// kept follows the share of tokens; the margin covers the rest.
+	keep := int(float64(len(s)) * float64(limit) / float64(total) * 0.9)
+	for keep > 0 && !utf8.RuneStart(s[keep]) {
+		keep--
+	}
+	if i := strings.LastIndexByte(s[:keep], '\n'); i > keep/2 {
+		keep = i + 1
+	}
+	return s[:keep] + fmt.Sprintf("\n... (truncated at about %d of %d tokens; narrow the request to see the rest)", limit, total)
+}
+
+// estimateTokens estimates the request's input tokens offline.
+func estimateTokens(req completionRequest) int {
+	n := estimateTextTokens(req.system)
+	for _, m := range req.messages {
+		n += messageOverheadTokens + estimateTextTokens(m.content)
+		for _, r := range m.toolResults {
+			n += messageOverheadTokens + estimateTextTokens(r.content)
+		}
+	}
+	return n
+}
+
+// estimateTextTokens approximates BPE tokenizers without their vocabulary.
+// Words cost about one token per four characters, but code is dense in
+// punctuation, indentation, and newlines, which a flat bytes/4 rule counts
+// far too cheaply, and each CJK character is usually a token of its own.
+func estimateTextTokens(s string) int {
+	n := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '\n' || r == '\t':
+			n++
+			i += size
+		case r == ' ':
+			// A single space joins the following word's token; runs of
+			// indentation are merged in groups of about four.
+			j := i
+			for j < len(s) && s[j] == ' ' {
+				j++
+			}
+			n += (j - i + 2) / 4
+			i = j
+		case r < utf8.RuneSelf && isWordByte(byte(r)):
+			j := i
+			for j < len(s) && s[j] < utf8.RuneSelf && isWordByte(s[j]) {
+				j++
+			}
+			n += (j - i + 3) / 4
+			i = j
+		case r < utf8.RuneSelf:
+			// Operators and brackets pair up at best: "()", "{}", ":=".
+			j := i
+			for j < len(s) && s[j] < utf8.RuneSelf && !isWordByte(s[j]) && s[j] != ' ' && s[j] != '\n' && s[j] != '\t' {
+				j++
+			}
+			n += (j - i + 1) / 2
+			i = j
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			n++
+			i += size
+		default:
+			// Other scripts split into about two bytes per token.
+			n += (size + 1) / 2
+			i += size
+		}
+	}
+	return n
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// transcriptMessage accepts the message shapes of the formats -history
+// reads: puzldai sessions, OpenAI chat completions, and Anthropic messages.
+type transcriptMessage struct {
+	Role string `json:"role"`
+	// Content is a string, or an array of typed blocks.
+	Content     json.RawMessage   `json:"content"`
+	ToolCalls   []transcriptCall  `json:"tool_calls"`
+	ToolResults []savedToolResult `json:"tool_results"`
+	// ToolCallID and Name belong to an OpenAI tool message.
+	ToolCallID string `json:"tool_call_id"`
+	Name       string `json:"name"`
+}
+
+type transcriptCall struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+	Function  *struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// transcriptBlock is a content block: text, tool_use, or tool_result in
+// Anthropic's format, or an OpenAI text part.
+type transcriptBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Input     map[string]any  `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+	IsError   bool            `json:"is_error"`
+}
+
+// loadTranscript reads a conversation to continue: a JSON array of
+// messages, or an object with a messages array. System messages are left
+// out; the agent uses its own system prompt.
+func loadTranscript(path string) ([]agentMessage, error) {
+	data, err := readPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw []transcriptMessage
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &raw)
+	} else {
+		var doc struct {
+			Messages []transcriptMessage `json:"messages"`
+		}
+		err = json.Unmarshal(data, &doc)
+		raw = doc.Messages
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var messages []agentMessage
+	for i, m := range raw {
+		converted, err := convertTranscriptMessage(m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: message %d: %w", path, i+1, err)
+		}
+		for _, c := range converted {
+			// OpenAI sends one tool message per result; they form one turn.
+			if n := len(messages); n > 0 && c.role == "tool" && messages[n-1].role == "tool" {
+				messages[n-1].toolResults = append(messages[n-1].toolResults, c.toolResults...)
+				continue
+			}
+			messages = append(messages, c)
+		}
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("%s: no messages", path)
+	}
+	return pairToolCalls(messages), nil
+}
+
+func convertTranscriptMessage(m transcriptMessage) ([]agentMessage, error) {
+	text, blocks, err := transcriptContent(m.Content)
+	if err != nil {
+		return nil, err
+	}
+	switch m.Role {
+	case "system", "developer":
+		return nil, nil
+	case "tool":
+		if len(m.ToolResults) > 0 {
+			// A puzldai session.
+			msg := agentMessage{role: "tool"}
+			for _, r := range m.ToolResults {
+				msg.toolResults = append(msg.toolResults, toolResult{id: r.ID, name: r.Name, content: r.Content, isError: r.IsError})
+			}
+			return []agentMessage{msg}, nil
+		}
+		return []agentMessage{{role: "tool", toolResults: []toolResult{{id: m.ToolCallID, name: m.Name, content: text}}}}, nil
+	case "assistant":
+		msg := agentMessage{role: "assistant", content: text}
+		for _, c := range m.ToolCalls {
+			call, err := c.toolCall()
+			if err != nil {
+				return nil, err
+			}
+			msg.toolCalls = append(msg.toolCalls, call)
+		}
+		for _, b := range blocks {
+			if b.Type == "tool_use" {
+				msg.toolCalls = append(msg.toolCalls, toolCall{id: b.ID, name: b.Name, arguments: b.Input})
+			}
+		}
+		return []agentMessage{msg}, nil
+	case "user", "human":
+		var out []agentMessage
+		var results []toolResult
+		for _, b := range blocks {
+			if b.Type != "tool_result" {
+				continue
+			}
+			content, _, err := transcriptContent(b.Content)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, toolResult{id: b.ToolUseID, content: content, isError: b.IsError})
+		}
+		if len(results) > 0 {
+			out = append(out, agentMessage{role: "tool", toolResults: results})
+		}
+		if strings.TrimSpace(text) != "" {
+			out = append(out, agentMessage{role: "user", content: text})
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown role %q", m.Role)
+	}
+}
+
+func (c transcriptCall) toolCall() (toolCall, error) {
+	call := toolCall{id: c.ID, name: c.Name}
+	raw := []byte(c.Arguments)
+	if c.Function != nil {
+		call.name, raw = c.Function.Name, []byte(c.Function.Arguments)
+	}
+	if len(bytes.TrimSpace(raw)) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &call.arguments); err != nil {
+			return toolCall{}, fmt.Errorf("arguments of %s: %w", call.name, err)
+		}
+	}
+	if call.name == "" {
+		return toolCall{}, errors.New("tool call without a name")
+	}
+	return call, nil
+}
+
+// transcriptContent returns the text of a content field and its blocks.
+func transcriptContent(raw json.RawMessage) (string, []transcriptBlock, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil, nil
+	}
+	var blocks []transcriptBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", nil, errors.New("content is neither text nor an array of blocks")
+	}
+	var parts []string
+	for _, b := range blocks {
+		if b.Type == "text" || b.Type == "input_text" || b.Type == "output_text" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n"), blocks, nil
+}
+
+// pairToolCalls makes the transcript replayable: tool results must follow
+// the assistant message that made the calls. Calls without results are kept
+// as text in the assistant message, and results without calls become user
+// text, so nothing is lost and no provider sees a dangling call.
+func pairToolCalls(messages []agentMessage) []agentMessage {
+	out := make([]agentMessage, 0, len(messages))
+	for i, m := range messages {
+		switch {
+		case m.role == "assistant" && len(m.toolCalls) > 0 && (i+1 == len(messages) || messages[i+1].role != "tool"):
+			m.content = strings.TrimSpace(m.content + "\n\nTool calls: " + describeCalls(m.toolCalls))
+			m.toolCalls = nil
+		case m.role == "tool" && (len(out) == 0 || out[len(out)-1].role != "assistant"):
+			var sb strings.Builder
+			writeToolResults(&sb, m.toolResults)
+			m = agentMessage{role: "user", content: sb.String()}
+		case m.role == "tool":
+			// Formats that leave the tool name off the result have it on
+			// the call.
+			m.toolResults = slices.Clone(m.toolResults)
+			for j, r := range m.toolResults {
+				for _, c := range out[len(out)-1].toolCalls {
+					if r.name == "" && c.id == r.id {
+						m.toolResults[j].name = c.name
+					}
+				}
+			}
+		}
+		out = append(out, m)
+	}
+	return out
+}
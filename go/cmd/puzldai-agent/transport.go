@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultRequestTimeout = 10 * time.Minute
+)
+
+// transportSettings configures the HTTP client shared by all providers.
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY are honoured unless proxy is set.
+type transportSettings struct {
+	proxy          string
+	caCert         string
+	connectTimeout time.Duration
+	requestTimeout time.Duration
+}
+
+func newHTTPClient(t transportSettings) (*http.Client, error) {
+	if t.connectTimeout <= 0 {
+		t.connectTimeout = defaultConnectTimeout
+	}
+	if t.requestTimeout <= 0 {
+		t.requestTimeout = defaultRequestTimeout
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if t.proxy != "" {
+		u, err := url.Parse(t.proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", t.proxy)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.caCert != "" {
+		pem, err := os.ReadFile(t.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("read CA certificate: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s contains no PEM certificates", t.caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: t.connectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   t.connectTimeout,
+		ResponseHeaderTimeout: t.requestTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &http.Client{
+		Transport: explainingTransport{transport},
+		Timeout:   t.requestTimeout,
+	}, nil
+}
+
+// explainingTransport annotates certificate and proxy failures with the flag
+// that usually fixes them; the bare x509 messages give no hint.
+type explainingTransport struct {
+	next http.RoundTripper
+}
+
+func (t explainingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var verification *tls.CertificateVerificationError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &unknownAuthority), errors.As(err, &verification):
+		return nil, fmt.Errorf("%w (if a TLS-intercepting proxy is in the path, pass its root certificate with -ca-cert)", err)
+	case errors.As(err, &opErr) && opErr.Op == "proxyconnect":
+		return nil, fmt.Errorf("%w (check HTTPS_PROXY or -proxy)", err)
+	}
+	return nil, err
+}
+
+// callJSON sends a JSON request to an API and decodes the response into
+// out when it is set. It returns the status code with any error.
+func callJSON(ctx context.Context, client *http.Client, method, target string, headers map[string]string, in, out any) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, target, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(out)
+}
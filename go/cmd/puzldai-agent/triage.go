@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Finding resolutions recorded in the triaged SARIF.
+const (
+	resolutionFixed      = "fixed"
+	resolutionDismissed  = "dismissed"
+	resolutionUnresolved = "unresolved"
+)
+
+var safeNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+const triageInstructions = `You are triaging findings of a security scanner. For each finding below,
+decide whether it is a real problem in this code. If it is, fix it with a
+minimal change that keeps the behavior otherwise the same. If it is not,
+leave the code alone and say why, for example: the input is trusted, the value
+is constant, or the code only runs in tests. Do not dismiss a finding because
+the fix is hard.
+
+End your reply with a JSON block in exactly this shape, one entry per finding:
+` + "```json" + `
+{"findings": [{"id": 1, "resolution": "fixed or dismissed", "justification": "what was changed, or why it is not a problem"}]}
+` + "```"
+
+// finding is one scanner result, pointing into the SARIF document that the
+// resolution is written back to.
+type finding struct {
+	id      int
+	tool    string
+	rule    string
+	level   string
+	message string
+	path    string
+	line    int
+	result  map[string]any
+
+	resolution    string
+	justification string
+	patch         string
+	verified      *bool
+}
+
+// findingGroup is the findings of one rule, triaged by one agent run.
+type findingGroup struct {
+	tool     string
+	rule     string
+	help     string
+	findings []*finding
+}
+
+const triageUsage = "usage: puzldai-agent triage [-cwd dir] [-out file] [-verify cmd] [-apply] <report.sarif|semgrep.json|gosec.json> [-- agent flags]"
+
+// runTriage implements the triage subcommand: findings from a SARIF,
+// semgrep, or gosec report are grouped by rule, an agent fixes or dismisses
+// each group's findings in a worktree of a snapshot of the workspace, and
+// the report is written back as SARIF with every finding's resolution.
+func runTriage(args []string) int {
+	fs := newFlagSet("triage")
+	cwdFlag := fs.String("cwd", "", "Workspace the report is about (default: the current directory)")
+	outFlag := fs.String("out", "", "Write the triaged SARIF to this file (default: stdout)")
+	verifyFlag := fs.String("verify", "", "Shell command that checks each group's fixes (exit 0 = pass) (default: config verify)")
+	applyFlag := fs.Bool("apply", false, "Apply the fixes to the workspace, one group at a time")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, triageUsage)
+		return exitUsage
+	}
+
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "triage:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+	cfg, err := loadConfig(cwd, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "triage: failed to load config:", err)
+		return exitError
+	}
+	verify := firstNonEmpty(*verifyFlag, cfg.Verify)
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "triage:", err)
+		return exitError
+	}
+	doc, err := loadScanReport(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "triage: %s: %v\n", fs.Arg(0), err)
+		return exitError
+	}
+	groups := groupFindings(doc, cwd)
+	if len(groups) == 0 {
+		fmt.Fprintln(os.Stderr, "no findings to triage")
+		return writeTriaged(*outFlag, doc)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ws, err := newChildWorkspace(ctx, cwd, "triage")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "triage:", err)
+		return exitError
+	}
+	// The runs happen in temporary worktrees; book them to this project.
+	os.Setenv(projectEnv, projectName(cwd))
+	var children []*childRun
+	defer func() { ws.removeWorktrees(children) }()
+	var mu sync.Mutex
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "triage:", err)
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		return exitError
+	}
+
+	for i, g := range groups {
+		fmt.Fprintf(os.Stderr, "group %d of %d: %s (%d finding(s))\n", i+1, len(groups), g.rule, len(g.findings))
+		name := fmt.Sprintf("group-%d", i+1)
+		c, err := ws.newChild(ctx, i+1, name, g.rule, "", ws.base)
+		if err != nil {
+			return fail(err)
+		}
+		children = append(children, c)
+		if err := ws.runAgent(ctx, c, name, triageTask(g), agentArgs, &mu); err != nil {
+			return fail(err)
+		}
+		c.collect(ctx, ws.base, verify)
+		var patchFile string
+		if c.patch != "" {
+			patchFile = filepath.Join(ws.work, name+"-"+strings.Trim(safeNameRe.ReplaceAllString(g.rule, "-"), "-")+".patch")
+			if err := os.WriteFile(patchFile, []byte(c.patch), 0o644); err != nil {
+				return fail(err)
+			}
+		}
+		g.resolve(c.answer, patchFile, c.verified)
+	}
+
+	if *applyFlag {
+		for _, g := range groups {
+			patch := g.patch()
+			if patch == "" {
+				continue
+			}
+			if _, err := runGit(ctx, ws.root, "apply", "--binary", "--whitespace=nowarn", patch); err != nil {
+				fmt.Fprintf(os.Stderr, "could not apply the fixes for %s (%v); they are in %s\n", g.rule, err, patch)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "applied the fixes for %s\n", g.rule)
+		}
+	}
+
+	var unresolved int
+	for _, g := range groups {
+		counts := map[string]int{}
+		for _, f := range g.findings {
+			counts[f.resolution]++
+			f.record()
+		}
+		unresolved += counts[resolutionUnresolved]
+		fmt.Fprintf(os.Stderr, "%s: %d fixed, %d dismissed, %d unresolved", g.rule, counts[resolutionFixed], counts[resolutionDismissed], counts[resolutionUnresolved])
+		if p := g.patch(); p != "" {
+			fmt.Fprintf(os.Stderr, "; fix: %s", p)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	if code := writeTriaged(*outFlag, doc); code != exitOK {
+		return code
+	}
+	if unresolved > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// loadScanReport reads a SARIF log, or semgrep or gosec JSON output
+// converted to one.
+func loadScanReport(data []byte) (map[string]any, error) {
+	var probe struct {
+		Runs    json.RawMessage `json:"runs"`
+		Results []struct {
+			CheckID string `json:"check_id"`
+		} `json:"results"`
+		Issues json.RawMessage `json:"Issues"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	switch {
+	case probe.Runs != nil:
+		var doc map[string]any
+		d := json.NewDecoder(bytes.NewReader(data))
+		// Keep large line numbers and other values exactly as they were.
+		d.UseNumber()
+		if err := d.Decode(&doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	case probe.Issues != nil:
+		return gosecToSARIF(data)
+	case probe.Results != nil:
+		return semgrepToSARIF(data)
+	}
+	return nil, errors.New("not a SARIF log or semgrep or gosec JSON output")
+}
+
+func semgrepToSARIF(data []byte) (map[string]any, error) {
+	var report struct {
+		Results []struct {
+			CheckID string `json:"check_id"`
+			Path    string `json:"path"`
+			Start   struct {
+				Line int `json:"line"`
+			} `json:"start"`
+			End struct {
+				Line int `json:"line"`
+			} `json:"end"`
+			Extra struct {
+				Message  string `json:"message"`
+				Severity string `json:"severity"`
+			} `json:"extra"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	levels := map[string]string{"ERROR": "error", "WARNING": "warning", "INFO": "note"}
+	var results []any
+	for _, r := range report.Results {
+		results = append(results, sarifResult(r.CheckID, firstNonEmpty(levels[r.Extra.Severity], "warning"), r.Extra.Message, r.Path, r.Start.Line, r.End.Line))
+	}
+	return sarifLog("semgrep", results), nil
+}
+
+func gosecToSARIF(data []byte) (map[string]any, error) {
+	var report struct {
+		Issues []struct {
+			Severity string `json:"severity"`
+			RuleID   string `json:"rule_id"`
+			Details  string `json:"details"`
+			File     string `json:"file"`
+			// Line is "12" or a range such as "12-14".
+			Line string `json:"line"`
+		} `json:"Issues"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	levels := map[string]string{"HIGH": "error", "MEDIUM": "warning", "LOW": "note"}
+	var results []any
+	for _, r := range report.Issues {
+		from, to, _ := strings.Cut(r.Line, "-")
+		start, _ := strconv.Atoi(from)
+		end, _ := strconv.Atoi(to)
+		results = append(results, sarifResult(r.RuleID, firstNonEmpty(levels[r.Severity], "warning"), r.Details, r.File, start, end))
+	}
+	return sarifLog("gosec", results), nil
+}
+
+func sarifLog(tool string, results []any) map[string]any {
+	if results == nil {
+		results = []any{}
+	}
+	return map[string]any{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs": []any{map[string]any{
+			"tool":    map[string]any{"driver": map[string]any{"name": tool}},
+			"results": results,
+		}},
+	}
+}
+
+func sarifResult(rule, level, message, path string, start, end int) map[string]any {
+	region := map[string]any{}
+	if start > 0 {
+		region["startLine"] = start
+	}
+	if end > start {
+		region["endLine"] = end
+	}
+	return map[string]any{
+		"ruleId":  rule,
+		"level":   level,
+		"message": map[string]any{"text": message},
+		"locations": []any{map[string]any{"physicalLocation": map[string]any{
+			"artifactLocation": map[string]any{"uri": filepath.ToSlash(path)},
+			"region":           region,
+		}}},
+	}
+}
+
+// groupFindings collects the results of every run by tool and rule, with
+// paths made relative to cwd. Results already suppressed are left out.
+func groupFindings(doc map[string]any, cwd string) []*findingGroup {
+	byRule := map[string]*findingGroup{}
+	var groups []*findingGroup
+	n := 0
+	for _, r := range jsonList(doc["runs"]) {
+		run, _ := r.(map[string]any)
+		driver := jsonMap(jsonMap(run["tool"])["driver"])
+		tool, _ := driver["name"].(string)
+		help := map[string]string{}
+		for _, r := range jsonList(driver["rules"]) {
+			rule := jsonMap(r)
+			id, _ := rule["id"].(string)
+			text, _ := jsonMap(rule["shortDescription"])["text"].(string)
+			help[id] = firstNonEmpty(text, jsonString(jsonMap(rule["fullDescription"])["text"]))
+		}
+		for _, res := range jsonList(run["results"]) {
+			result := jsonMap(res)
+			if result == nil || len(jsonList(result["suppressions"])) > 0 {
+				continue
+			}
+			n++
+			f := &finding{id: n, tool: tool, result: result, resolution: resolutionUnresolved}
+			f.rule = firstNonEmpty(jsonString(result["ruleId"]), jsonString(jsonMap(result["rule"])["id"]), "unknown")
+			f.level = firstNonEmpty(jsonString(result["level"]), "warning")
+			f.message = jsonString(jsonMap(result["message"])["text"])
+			if locs := jsonList(result["locations"]); len(locs) > 0 {
+				loc := jsonMap(jsonMap(locs[0])["physicalLocation"])
+				f.path = findingPath(jsonString(jsonMap(loc["artifactLocation"])["uri"]), cwd)
+				f.line = jsonInt(jsonMap(loc["region"])["startLine"])
+			}
+			key := tool + "\x00" + f.rule
+			g := byRule[key]
+			if g == nil {
+				g = &findingGroup{tool: tool, rule: f.rule, help: help[f.rule]}
+				byRule[key] = g
+				groups = append(groups, g)
+			}
+			g.findings = append(g.findings, f)
+		}
+	}
+	// The most severe and most frequent rules first.
+	rank := map[string]int{"error": 0, "warning": 1, "note": 2, "none": 3}
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := rank[groups[i].findings[0].level], rank[groups[j].findings[0].level]
+		if a != b {
+			return a < b
+		}
+		return len(groups[i].findings) > len(groups[j].findings)
+	})
+	// Number findings in the order the agent sees them.
+	n = 0
+	for _, g := range groups {
+		for _, f := range g.findings {
+			n++
+			f.id = n
+		}
+	}
+	return groups
+}
+
+// findingPath turns a SARIF artifact URI into a path relative to cwd where
+// possible.
+func findingPath(uri, cwd string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		uri = u.Path
+	}
+	if filepath.IsAbs(uri) {
+		return displayPath(cwd, uri)
+	}
+	return filepath.ToSlash(uri)
+}
+
+func triageTask(g *findingGroup) string {
+	var sb strings.Builder
+	sb.WriteString(triageInstructions + "\n\n")
+	fmt.Fprintf(&sb, "## Rule\n\n%s (%s)", g.rule, firstNonEmpty(g.tool, "scanner"))
+	if g.help != "" {
+		sb.WriteString(": " + g.help)
+	}
+	sb.WriteString("\n\n## Findings\n\n")
+	for _, f := range g.findings {
+		location := firstNonEmpty(f.path, "(no location)")
+		if f.line > 0 {
+			location += ":" + strconv.Itoa(f.line)
+		}
+		fmt.Fprintf(&sb, "%d. %s [%s] %s\n", f.id, location, f.level, strings.TrimSpace(f.message))
+	}
+	return sb.String()
+}
+
+// resolve reads the agent's verdicts for the group. Findings it did not
+// rule on, and fixes that changed nothing, stay unresolved.
+func (g *findingGroup) resolve(answer, patchFile string, verified *bool) {
+	var verdicts struct {
+		Findings []struct {
+			ID            int    `json:"id"`
+			Resolution    string `json:"resolution"`
+			Justification string `json:"justification"`
+		} `json:"findings"`
+	}
+	if m := jsonBlockRe.FindAllStringSubmatch(answer, -1); len(m) > 0 {
+		_ = json.Unmarshal([]byte(m[len(m)-1][1]), &verdicts)
+	}
+	for _, f := range g.findings {
+		for _, v := range verdicts.Findings {
+			if v.ID != f.id {
+				continue
+			}
+			f.justification = strings.TrimSpace(v.Justification)
+			switch {
+			case v.Resolution == resolutionFixed && patchFile != "":
+				f.resolution, f.patch, f.verified = resolutionFixed, patchFile, verified
+			case v.Resolution == resolutionFixed:
+				f.justification = "reported fixed, but no files changed: " + f.justification
+			case v.Resolution == resolutionDismissed && f.justification != "":
+				f.resolution = resolutionDismissed
+			}
+		}
+	}
+}
+
+// patch is the group's fix, if any finding was fixed.
+func (g *findingGroup) patch() string {
+	for _, f := range g.findings {
+		if f.patch != "" {
+			return f.patch
+		}
+	}
+	return ""
+}
+
+// record writes the resolution into the SARIF result: fixes as a fix
+// description, dismissals as an accepted external suppression, and both in
+// the puzldai/triage property.
+func (f *finding) record() {
+	triage := map[string]any{"resolution": f.resolution}
+	if f.justification != "" {
+		triage["justification"] = f.justification
+	}
+	if f.patch != "" {
+		triage["patch"] = f.patch
+	}
+	if f.verified != nil {
+		triage["verified"] = *f.verified
+	}
+	props := jsonMap(f.result["properties"])
+	if props == nil {
+		props = map[string]any{}
+		f.result["properties"] = props
+	}
+	props["puzldai/triage"] = triage
+	switch f.resolution {
+	case resolutionFixed:
+		f.result["fixes"] = append(jsonList(f.result["fixes"]), map[string]any{
+			"description": map[string]any{"text": firstNonEmpty(f.justification, "fixed")},
+		})
+	case resolutionDismissed:
+		f.result["suppressions"] = append(jsonList(f.result["suppressions"]), map[string]any{
+			"kind": "external", "status": "accepted", "justification": f.justification,
+		})
+	}
+}
+
+func writeTriaged(path string, doc map[string]any) int {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "triage:", err)
+		return exitError
+	}
+	data = append(data, '\n')
+	if path == "" {
+		_, err = answerOut.Write(data)
+	} else {
+		err = os.WriteFile(path, data, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "triage:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func jsonMap(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	return m
+}
+
+func jsonList(v any) []any {
+	l, _ := v.([]any)
+	return l
+}
+
+func jsonString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func jsonInt(v any) int {
+	switch n := v.(type) {
+	case json.Number:
+		i, _ := n.Int64()
+		return int(i)
+	case float64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-runewidth"
+	"github.com/muesli/termenv"
+	"golang.org/x/term"
+)
+
+// tui is the -tui frontend: a Bubble Tea program with panes for the
+// assistant's replies as they stream in, a log of tool calls and stderr
+// messages, and the workspace diff since the run started, under a header of
+// token and cost counters. Approvals and ask_user questions are answered in
+// it, and ctrl+c cancels the run. All methods are no-ops on a nil *tui.
+type tui struct {
+	program *tea.Program
+	exited  chan struct{}
+	stderr  *os.File
+	logW    *os.File
+	// root and baseline feed the diff pane; empty outside a local git
+	// repository.
+	root     string
+	baseline string
+}
+
+// newTUI takes over the terminal. stderr is captured into the log pane
+// until finish restores it.
+func newTUI(model, cwd string, local bool, cancel func()) (*tui, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, errors.New("-tui needs a terminal on stdin and stdout")
+	}
+	u := &tui{exited: make(chan struct{})}
+	if local {
+		ctx, cancelGit := context.WithTimeout(context.Background(), syncTimeout)
+		if root, err := gitRoot(ctx, cwd); err == nil {
+			if base, err := snapshotWorktree(ctx, root, "puzldai tui baseline"); err == nil {
+				u.root, u.baseline = root, base
+			}
+		}
+		cancelGit()
+	}
+
+	m := &tuiModel{model: model, cancel: cancel, start: time.Now(), status: "running", diff: "(no changes yet)"}
+	if u.root == "" {
+		m.diff = "(diff unavailable: the workspace is not a local git repository)"
+	}
+	m.price, m.priced = priceFor(model)
+	for i := range m.panes {
+		m.panes[i] = viewport.New(0, 0)
+	}
+	if noColor {
+		lipgloss.SetColorProfile(termenv.Ascii)
+	}
+	u.program = tea.NewProgram(m, tea.WithAltScreen())
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	u.stderr, u.logW = os.Stderr, w
+	os.Stderr = w
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			u.program.Send(tuiLogMsg(scanner.Text()))
+		}
+	}()
+	go func() {
+		defer close(u.exited)
+		if _, err := u.program.Run(); err != nil {
+			fmt.Fprintln(u.stderr, "tui:", err)
+		}
+	}()
+	return u, nil
+}
+
+func (u *tui) send(msg tea.Msg) {
+	if u != nil {
+		u.program.Send(msg)
+	}
+}
+
+// turn marks the start of a model turn.
+func (u *tui) turn(iteration int) {
+	u.send(tuiTurnMsg(iteration))
+}
+
+// stream returns the completionRequest.onText hook, or nil without a TUI.
+func (u *tui) stream() func(string) {
+	if u == nil {
+		return nil
+	}
+	return func(text string) { u.send(tuiTextMsg(text)) }
+}
+
+// reply shows a finished reply that did not stream, and the turn's usage.
+func (u *tui) reply(text string, usage tokenUsage) {
+	u.send(tuiReplyMsg{text: text, usage: usage})
+}
+
+// refreshDiff recomputes the diff pane after tools ran.
+func (u *tui) refreshDiff(ctx context.Context) {
+	if u == nil || u.root == "" {
+		return
+	}
+	current, err := snapshotWorktree(ctx, u.root, "puzldai tui")
+	if err != nil {
+		return
+	}
+	diff, err := runGit(ctx, u.root, "diff", u.baseline, current)
+	if err != nil {
+		return
+	}
+	u.send(tuiDiffMsg(diff))
+}
+
+// middleware shows each tool call in the tool log.
+func (u *tui) middleware() toolMiddleware {
+	if u == nil {
+		return nil
+	}
+	return func(next toolFunc) toolFunc {
+		return func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			call, _ := toolCallFrom(ctx)
+			raw, _ := json.Marshal(args)
+			u.send(tuiToolMsg{line: "> " + call.name + " " + string(raw)})
+			started := time.Now()
+			out, err := next(ctx, cwd, args)
+			took := time.Since(started).Round(100 * time.Millisecond)
+			if err != nil {
+				first, _, _ := strings.Cut(err.Error(), "\n")
+				u.send(tuiToolMsg{line: fmt.Sprintf("x %s (%s): %s", call.name, took, first), failed: true})
+			} else {
+				u.send(tuiToolMsg{line: fmt.Sprintf("ok %s (%s, %s)", call.name, took, formatSize(int64(len(out))))})
+			}
+			return out, err
+		}
+	}
+}
+
+// approve asks in the TUI; a closed TUI denies.
+func (u *tui) approve(summary string) (bool, string) {
+	reply := make(chan bool, 1)
+	u.send(tuiApprovalMsg{summary: summary, reply: reply})
+	select {
+	case ok := <-reply:
+		if !ok {
+			return false, "action rejected by the operator"
+		}
+		return true, ""
+	case <-u.exited:
+		return false, "approval required but the TUI has exited"
+	}
+}
+
+// ask reads an ask_user answer in the TUI.
+func (u *tui) ask(question string, choices []string) (string, error) {
+	reply := make(chan string, 1)
+	u.send(tuiQuestionMsg{question: question, choices: choices, reply: reply})
+	select {
+	case answer := <-reply:
+		return answer, nil
+	case <-u.exited:
+		return "", errors.New("the TUI has exited")
+	}
+}
+
+// finish shows the outcome, waits for the operator to close the TUI, and
+// restores stderr.
+func (u *tui) finish(outcome agentOutcome) {
+	if u == nil {
+		return
+	}
+	u.send(tuiDoneMsg{status: outcome.Status, answer: outcome.Summary})
+	<-u.exited
+	os.Stderr = u.stderr
+	u.logW.Close()
+}
+
+type (
+	tuiTurnMsg  int
+	tuiTextMsg  string
+	tuiLogMsg   string
+	tuiDiffMsg  string
+	tuiTickMsg  time.Time
+	tuiReplyMsg struct {
+		text  string
+		usage tokenUsage
+	}
+	tuiDoneMsg struct {
+		status string
+		answer string
+	}
+	tuiToolMsg struct {
+		line   string
+		failed bool
+	}
+	tuiApprovalMsg struct {
+		summary string
+		reply   chan bool
+	}
+	tuiQuestionMsg struct {
+		question string
+		choices  []string
+		reply    chan string
+	}
+)
+
+const (
+	paneAssistant = iota
+	paneTools
+	paneDiff
+)
+
+var (
+	tuiFocused   = lipgloss.Color("12")
+	tuiBlurred   = lipgloss.Color("8")
+	tuiAdded     = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	tuiRemoved   = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	tuiHunk      = lipgloss.NewStyle().Foreground(lipgloss.Color("6"))
+	tuiDim       = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	tuiBold      = lipgloss.NewStyle().Bold(true)
+	tuiHighlight = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("11"))
+)
+
+type tuiModel struct {
+	width, height int
+	model         string
+	cancel        func()
+	start         time.Time
+	price         modelPrice
+	priced        bool
+
+	panes     [3]viewport.Model
+	focus     int
+	assistant strings.Builder
+	streamed  bool
+	tools     []tuiLine
+	diff      string
+
+	iteration int
+	usage     tokenUsage
+	status    string
+	cancelled bool
+	done      bool
+	answer    string
+	// notice reports on copying the answer.
+	notice string
+
+	approval *tuiApprovalMsg
+	question *tuiQuestionMsg
+	input    []rune
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return tuiTick()
+}
+
+func tuiTick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg { return tuiTickMsg(t) })
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case tuiTickMsg:
+		if m.done {
+			return m, nil
+		}
+		return m, tuiTick()
+	case tuiTurnMsg:
+		m.iteration, m.streamed = int(msg), false
+		if m.assistant.Len() > 0 {
+			m.assistant.WriteString("\n\n")
+		}
+		m.assistant.WriteString(tuiDim.Render(fmt.Sprintf("-- turn %d --", msg)) + "\n")
+	case tuiTextMsg:
+		m.streamed = true
+		m.assistant.WriteString(string(msg))
+	case tuiReplyMsg:
+		if !m.streamed {
+			m.assistant.WriteString(msg.text)
+		}
+		m.usage.inputTokens += msg.usage.inputTokens
+		m.usage.outputTokens += msg.usage.outputTokens
+	case tuiToolMsg:
+		line := tuiLine{text: msg.line}
+		if msg.failed {
+			line.style = tuiRemoved
+		}
+		m.tools = append(m.tools, line)
+	case tuiLogMsg:
+		m.tools = append(m.tools, tuiLine{text: string(msg), style: tuiDim})
+	case tuiDiffMsg:
+		m.diff = strings.TrimRight(string(msg), "\n")
+		if m.diff == "" {
+			m.diff = "(no changes)"
+		}
+	case tuiApprovalMsg:
+		m.approval = &msg
+	case tuiQuestionMsg:
+		m.question, m.input = &msg, nil
+	case tuiDoneMsg:
+		m.done, m.status, m.answer = true, msg.status, msg.answer
+	case tea.KeyMsg:
+		if cmd, handled := m.key(msg); handled {
+			return m, cmd
+		}
+		var cmd tea.Cmd
+		m.panes[m.focus], cmd = m.panes[m.focus].Update(msg)
+		return m, cmd
+	case tea.MouseMsg:
+		var cmd tea.Cmd
+		m.panes[m.focus], cmd = m.panes[m.focus].Update(msg)
+		return m, cmd
+	}
+	m.layout()
+	return m, nil
+}
+
+// key handles the keys the model owns and reports whether it did; the rest
+// scroll the focused pane.
+func (m *tuiModel) key(msg tea.KeyMsg) (tea.Cmd, bool) {
+	switch {
+	case m.done:
+		switch msg.String() {
+		case "q", "enter", "esc", "ctrl+c":
+			return tea.Quit, true
+		case "c":
+			m.notice = "Answer copied to the clipboard."
+			if err := writeClipboard(m.answer); err != nil {
+				m.notice = "Copy failed: " + err.Error()
+			}
+			m.layout()
+			return nil, true
+		}
+	case msg.String() == "ctrl+c":
+		if !m.cancelled {
+			m.cancelled, m.status = true, "cancelling"
+			m.cancel()
+		}
+		if m.approval != nil {
+			m.approval.reply <- false
+			m.approval = nil
+		}
+		if m.question != nil {
+			m.question.reply <- ""
+			m.question = nil
+		}
+		m.layout()
+		return nil, true
+	case m.approval != nil:
+		switch msg.String() {
+		case "y", "Y":
+			m.approval.reply <- true
+		case "n", "N", "esc":
+			m.approval.reply <- false
+		default:
+			return nil, msg.String() != "tab" && !isScrollKey(msg)
+		}
+		m.approval = nil
+		m.layout()
+		return nil, true
+	case m.question != nil:
+		switch msg.Type {
+		case tea.KeyEnter:
+			m.question.reply <- string(m.input)
+			m.question, m.input = nil, nil
+		case tea.KeyBackspace:
+			if len(m.input) > 0 {
+				m.input = m.input[:len(m.input)-1]
+			}
+		case tea.KeyRunes, tea.KeySpace:
+			m.input = append(m.input, msg.Runes...)
+		default:
+			return nil, false
+		}
+		m.layout()
+		return nil, true
+	}
+	if msg.String() == "tab" {
+		m.focus = (m.focus + 1) % len(m.panes)
+		return nil, true
+	}
+	return nil, false
+}
+
+func isScrollKey(msg tea.KeyMsg) bool {
+	switch msg.String() {
+	case "up", "down", "pgup", "pgdown", "home", "end":
+		return true
+	}
+	return false
+}
+
+// layout sizes the panes and refreshes their content, following the tail
+// of panes that were scrolled to the bottom.
+func (m *tuiModel) layout() {
+	if m.width == 0 || m.height == 0 {
+		return
+	}
+	bodyH := max(m.height-1-len(m.footer()), 6)
+	topH := bodyH * 3 / 5
+	leftW := m.width * 3 / 5
+	sizes := [3][2]int{
+		paneAssistant: {leftW, topH},
+		paneTools:     {m.width - leftW, topH},
+		paneDiff:      {m.width, bodyH - topH},
+	}
+	contents := [3]string{
+		paneAssistant: wrapText(m.assistant.String(), sizes[paneAssistant][0]-2),
+		paneTools:     renderLines(m.tools, sizes[paneTools][0]-2),
+		paneDiff:      colorDiff(m.diff, sizes[paneDiff][0]-2),
+	}
+	for i := range m.panes {
+		follow := m.panes[i].AtBottom() || m.panes[i].Height == 0
+		m.panes[i].Width = max(sizes[i][0]-2, 1)
+		m.panes[i].Height = max(sizes[i][1]-3, 1)
+		m.panes[i].SetContent(contents[i])
+		if follow {
+			m.panes[i].GotoBottom()
+		}
+	}
+}
+
+func (m *tuiModel) View() string {
+	if m.width == 0 {
+		return ""
+	}
+	titles := [3]string{paneAssistant: "Assistant", paneTools: "Tool calls", paneDiff: "Diff since start"}
+	var rendered [3]string
+	for i, p := range m.panes {
+		color := tuiBlurred
+		if i == m.focus {
+			color = tuiFocused
+		}
+		rendered[i] = lipgloss.NewStyle().
+			Border(lipgloss.RoundedBorder()).
+			BorderForeground(color).
+			Width(p.Width).
+			Render(tuiBold.Render(titles[i]) + "\n" + p.View())
+	}
+	top := lipgloss.JoinHorizontal(lipgloss.Top, rendered[paneAssistant], rendered[paneTools])
+	return lipgloss.JoinVertical(lipgloss.Left, m.header(), top, rendered[paneDiff], strings.Join(m.footer(), "\n"))
+}
+
+func (m *tuiModel) header() string {
+	cost := "cost n/a"
+	if m.priced {
+		cost = fmt.Sprintf("~$%.4f", m.price.cost(m.usage))
+	}
+	elapsed := time.Since(m.start).Round(time.Second)
+	line := fmt.Sprintf(" puzldai  %s  turn %d  tokens %s in / %s out  %s  %s  %s",
+		m.model, m.iteration, formatCount(m.usage.inputTokens), formatCount(m.usage.outputTokens), cost, elapsed, m.status)
+	return tuiBold.Render(runewidth.Truncate(line, m.width, "..."))
+}
+
+// footer is the key help, or the pending approval or question.
+func (m *tuiModel) footer() []string {
+	var lines []tuiLine
+	switch {
+	case m.approval != nil:
+		lines = append(lines, tuiLine{text: "Approval needed:", style: tuiHighlight})
+		summary := strings.Split(m.approval.summary, "\n")
+		if len(summary) > 8 {
+			summary = append(summary[:8], "...")
+		}
+		for _, l := range summary {
+			lines = append(lines, tuiLine{text: l})
+		}
+		lines = append(lines, tuiLine{text: "[y] approve  [n] deny", style: tuiHighlight})
+	case m.question != nil:
+		lines = append(lines, tuiLine{text: "The agent asks: " + m.question.question, style: tuiHighlight})
+		for i, c := range m.question.choices {
+			lines = append(lines, tuiLine{text: fmt.Sprintf("  %d) %s", i+1, c)})
+		}
+		lines = append(lines, tuiLine{text: "> " + string(m.input) + "_"})
+	case m.done:
+		if m.notice != "" {
+			lines = append(lines, tuiLine{text: m.notice})
+		}
+		lines = append(lines, tuiLine{text: "Finished: " + m.status + ". Press c to copy the answer, q or enter to exit.", style: tuiHighlight})
+	default:
+		lines = append(lines, tuiLine{text: "tab: focus pane  up/down/pgup/pgdown: scroll  ctrl+c: cancel run", style: tuiDim})
+	}
+	return strings.Split(renderLines(lines, m.width), "\n")
+}
+
+// tuiLine is a line of plain text and the style it is shown in, kept apart
+// so it can be truncated before escape codes are added.
+type tuiLine struct {
+	text  string
+	style lipgloss.Style
+}
+
+func formatCount(n int64) string {
+	if n < 1000 {
+		return fmt.Sprintf("%d", n)
+	}
+	return fmt.Sprintf("%.1fk", float64(n)/1000)
+}
+
+func wrapText(s string, width int) string {
+	if width <= 0 {
+		return s
+	}
+	return lipgloss.NewStyle().Width(width).Render(s)
+}
+
+func renderLines(lines []tuiLine, width int) string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = l.style.Render(runewidth.Truncate(l.text, max(width, 1), "..."))
+	}
+	return strings.Join(out, "\n")
+}
+
+func colorDiff(diff string, width int) string {
+	lines := strings.Split(diff, "\n")
+	for i, l := range lines {
+		l = runewidth.Truncate(l, max(width, 1), "...")
+		switch {
+		case strings.HasPrefix(l, "+++"), strings.HasPrefix(l, "---"), strings.HasPrefix(l, "diff --git"):
+			l = tuiBold.Render(l)
+		case strings.HasPrefix(l, "+"):
+			l = tuiAdded.Render(l)
+		case strings.HasPrefix(l, "-"):
+			l = tuiRemoved.Render(l)
+		case strings.HasPrefix(l, "@@"):
+			l = tuiHunk.Render(l)
+		}
+		lines[i] = l
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultUpgradeRounds = 5
+	// changelogTimeout bounds each request for release notes.
+	changelogTimeout = 20 * time.Second
+	// maxChangelogBytes bounds the release notes put into the fixer's task.
+	maxChangelogBytes = 12_000
+)
+
+var (
+	githubRepoRe   = regexp.MustCompile(`github\.com[/:]([\w.-]+)/([\w.-]+?)(?:\.git)?(?:[/#?]|$)`)
+	requirementRe  = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)(\[[^\]]*\])?\s*((?:[=<>!~]=?|===)\s*[^\s;#,]+(?:\s*,\s*[=<>!~]=?\s*[^\s;#,]+)*)?(.*)$`)
+	branchUnsafeRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+const upgradeFixIntro = "You are finishing a dependency upgrade. The dependency below has been bumped in this workspace, " +
+	"and the build or tests now fail. Read the errors, check the release notes for breaking changes, and update the code " +
+	"to the new API. Do not downgrade or pin the dependency back, and do not disable or delete failing tests to get green. " +
+	"Finish with a short summary of the code changes the upgrade needed."
+
+// depManifest is the file that declares the dependency being upgraded.
+type depManifest struct {
+	// kind is go, npm, or pip.
+	kind    string
+	file    string
+	current string
+	// dev is set for npm devDependencies.
+	dev bool
+}
+
+const upgradeUsage = "usage: puzldai-agent upgrade [-cwd dir] [-verify cmd] [-rounds n] [-branch name] [-changelog=false] <dependency> [version] [-- agent flags]"
+
+// runUpgrade implements the upgrade subcommand: the dependency is bumped
+// on a new branch in a worktree, the build and tests run, and while they
+// fail an agent fixes the code with the errors and the release notes in
+// hand. Everything is committed to the branch; the workspace is untouched.
+func runUpgrade(args []string) int {
+	fs := newFlagSet("upgrade")
+	cwdFlag := fs.String("cwd", "", "Workspace holding go.mod, package.json, or requirements.txt (default: the current directory)")
+	verifyFlag := fs.String("verify", "", "Shell command that checks the upgrade (exit 0 = pass) (default: config verify, else the ecosystem's build and tests)")
+	roundsFlag := fs.Int("rounds", defaultUpgradeRounds, "Times the agent may fix the code before giving up")
+	branchFlag := fs.String("branch", "", "Branch for the upgrade (default: puzldai/upgrade-<dependency>-<version>)")
+	changelogFlag := fs.Bool("changelog", true, "Fetch the dependency's GitHub release notes for the agent")
+	args, agentArgs := splitAgentArgs(args)
+	if err := fs.Parse(args); err != nil || fs.NArg() < 1 || fs.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, upgradeUsage)
+		return exitUsage
+	}
+	dep, version := fs.Arg(0), "latest"
+	if fs.NArg() == 2 {
+		version = fs.Arg(1)
+	}
+	noColor = os.Getenv("NO_COLOR") != ""
+
+	cwd := *cwdFlag
+	if cwd == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "upgrade:", err)
+			return exitError
+		}
+		cwd = wd
+	}
+	cfg, err := loadConfig(cwd, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "upgrade: failed to load config:", err)
+		return exitError
+	}
+	if err := cfg.Commit.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "upgrade:", err)
+		return exitError
+	}
+	manifest, err := findManifest(cwd, dep)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "upgrade:", err)
+		return exitError
+	}
+	if manifest.kind == "pip" && version == "latest" {
+		fmt.Fprintln(os.Stderr, "upgrade: requirements.txt needs an explicit version")
+		return exitUsage
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "upgrade:", err)
+		if ctx.Err() != nil {
+			return exitCancelled
+		}
+		return exitError
+	}
+	ws, err := newChildWorkspace(ctx, cwd, "upgrade")
+	if err != nil {
+		return fail(err)
+	}
+	head, err := runGit(ctx, ws.root, "rev-parse", "HEAD")
+	if err != nil {
+		return fail(err)
+	}
+	head = strings.TrimSpace(head)
+	branch := *branchFlag
+	if branch == "" {
+		branch = "puzldai/upgrade-" + strings.Trim(branchUnsafeRe.ReplaceAllString(dep+"-"+version, "-"), "-.")
+	}
+	if _, err := runGit(ctx, ws.root, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err == nil {
+		return fail(fmt.Errorf("branch %s already exists; pass -branch", branch))
+	}
+	// The runs happen in a temporary worktree; book them to this project.
+	os.Setenv(projectEnv, projectName(cwd))
+
+	// The branch starts from HEAD: uncommitted changes stay out of it.
+	fixer, err := ws.newChild(ctx, 1, "upgrade", "upgrade", "", head)
+	if err != nil {
+		return fail(err)
+	}
+	defer ws.removeWorktrees([]*childRun{fixer})
+	dir := fixer.cwd
+	if out, err := bumpDependency(ctx, dir, manifest, dep, version); err != nil {
+		return fail(fmt.Errorf("bumping %s: %w\n%s", dep, err, truncateOutput(strings.TrimSpace(out), maxVerifyOutput)))
+	}
+	bumped, err := findManifest(dir, dep)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "bumped %s in %s: %s -> %s\n", dep, manifest.file, firstNonEmpty(manifest.current, "unpinned"), firstNonEmpty(bumped.current, version))
+
+	var changelog string
+	if *changelogFlag {
+		changelog, err = fetchChangelog(ctx, manifest.kind, dep, manifest.current, bumped.current)
+		switch {
+		case err != nil:
+			fmt.Fprintln(os.Stderr, "no release notes:", err)
+		case changelog == "":
+			fmt.Fprintln(os.Stderr, "no release notes found between the two versions")
+		}
+	}
+
+	verify := firstNonEmpty(*verifyFlag, cfg.Verify, defaultUpgradeVerify(dir, manifest))
+	fixer.collect(ctx, head, verify)
+	if fixer.patch == "" {
+		return fail(fmt.Errorf("%s is already at %s", dep, firstNonEmpty(bumped.current, version)))
+	}
+	var mu sync.Mutex
+	for round := 1; round <= *roundsFlag && fixer.verified != nil && !*fixer.verified; round++ {
+		fmt.Fprintf(os.Stderr, "%s fails; fix round %d of %d\n", verify, round, *roundsFlag)
+		task := upgradeFixTask(dep, manifest, bumped, verify, fixer.verifyLog, changelog)
+		if err := ws.runAgent(ctx, fixer, fmt.Sprintf("fix-%d", round), task, agentArgs, &mu); err != nil {
+			return fail(err)
+		}
+		fixer.collect(ctx, head, verify)
+	}
+	passed := fixer.verified == nil || *fixer.verified
+
+	message := fmt.Sprintf("Upgrade %s to %s\n\nFrom %s.", dep, firstNonEmpty(bumped.current, version), firstNonEmpty(manifest.current, "an unpinned version"))
+	if passed {
+		message += " Verified with: " + verify
+	} else {
+		message += " Verification still fails: " + verify
+	}
+	if _, err := runGit(ctx, fixer.dir, "add", "-A"); err != nil {
+		return fail(err)
+	}
+	if _, err := runGit(ctx, fixer.dir, "checkout", "-q", "-b", branch); err != nil {
+		return fail(err)
+	}
+	if _, err := gitWithEnv(ctx, fixer.dir, cfg.Commit.env(), "commit", "-q", "-m", cfg.Commit.message(message, "")); err != nil {
+		return fail(err)
+	}
+
+	printPatch(fixer.patch)
+	if stat, err := runGit(ctx, fixer.dir, "diff", "--stat", head, "HEAD"); err == nil {
+		fmt.Fprintf(os.Stderr, "\n%s", stat)
+	}
+	if summary := strings.TrimSpace(fixer.answer); summary != "" {
+		fmt.Fprintf(os.Stderr, "summary:\n%s\n", summary)
+	}
+	if !passed {
+		fmt.Fprintf(os.Stderr, "%s still fails:\n%s\n", verify, strings.TrimSpace(fixer.verifyLog))
+		fmt.Fprintf(os.Stderr, "the upgrade so far is committed to branch %s\n", branch)
+		return exitError
+	}
+	fmt.Fprintf(os.Stderr, "%s passes; the upgrade is committed to branch %s (git merge %s)\n", verify, branch, branch)
+	return exitOK
+}
+
+// findManifest looks in dir for go.mod, package.json, and requirements.txt,
+// in that order, and returns the first that declares dep.
+func findManifest(dir, dep string) (*depManifest, error) {
+	var looked []string
+	for _, name := range []string{"go.mod", "package.json", "requirements.txt"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		looked = append(looked, name)
+		m := &depManifest{file: name}
+		var ok bool
+		switch name {
+		case "go.mod":
+			m.kind = "go"
+			m.current, ok = goModVersion(data, dep)
+		case "package.json":
+			m.kind = "npm"
+			m.current, m.dev, ok = packageJSONVersion(data, dep)
+		case "requirements.txt":
+			m.kind = "pip"
+			m.current, ok = requirementVersion(data, dep)
+		}
+		if ok {
+			return m, nil
+		}
+	}
+	if len(looked) == 0 {
+		return nil, fmt.Errorf("no go.mod, package.json, or requirements.txt in %s", dir)
+	}
+	return nil, fmt.Errorf("%s does not declare %s", strings.Join(looked, ", "), dep)
+}
+
+func goModVersion(data []byte, dep string) (string, bool) {
+	re := regexp.MustCompile(`(?m)^\s*(?:require\s+)?` + regexp.QuoteMeta(dep) + `\s+(v\S+)`)
+	if m := re.FindSubmatch(data); m != nil {
+		return string(m[1]), true
+	}
+	return "", false
+}
+
+func packageJSONVersion(data []byte, dep string) (version string, dev, ok bool) {
+	var pkg struct {
+		Dependencies         map[string]string `json:"dependencies"`
+		DevDependencies      map[string]string `json:"devDependencies"`
+		OptionalDependencies map[string]string `json:"optionalDependencies"`
+		PeerDependencies     map[string]string `json:"peerDependencies"`
+	}
+	if json.Unmarshal(data, &pkg) != nil {
+		return "", false, false
+	}
+	if v, ok := pkg.DevDependencies[dep]; ok {
+		return v, true, true
+	}
+	for _, deps := range []map[string]string{pkg.Dependencies, pkg.OptionalDependencies, pkg.PeerDependencies} {
+		if v, ok := deps[dep]; ok {
+			return v, false, true
+		}
+	}
+	return "", false, false
+}
+
+// requirementVersion finds dep's version specifier in a requirements file;
+// names compare the way pip does, ignoring case and - _ . differences.
+func requirementVersion(data []byte, dep string) (string, bool) {
+	for _, line := range strings.Split(string(data), "\n") {
+		m := requirementRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m != nil && normalizePyName(m[1]) == normalizePyName(dep) {
+			return strings.TrimLeft(strings.TrimSpace(m[3]), "=<>!~ "), true
+		}
+	}
+	return "", false
+}
+
+func normalizePyName(name string) string {
+	return strings.NewReplacer("_", "-", ".", "-").Replace(strings.ToLower(name))
+}
+
+// bumpDependency moves dep to version with the ecosystem's own tool, so
+// lock files and go.sum follow; requirements.txt is rewritten in place.
+func bumpDependency(ctx context.Context, dir string, m *depManifest, dep, version string) (string, error) {
+	switch m.kind {
+	case "go":
+		if out, err := runIn(ctx, dir, "go", "get", dep+"@"+version); err != nil {
+			return out, err
+		}
+		return runIn(ctx, dir, "go", "mod", "tidy")
+	case "npm":
+		pm := nodePackageManager(dir)
+		args := []string{"add", dep + "@" + version}
+		if pm == "npm" {
+			args[0] = "install"
+		}
+		if m.dev {
+			args = append(args, "-D")
+		}
+		return runIn(ctx, dir, pm, args...)
+	}
+	path := filepath.Join(dir, m.file)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		mm := requirementRe.FindStringSubmatch(strings.TrimSpace(line))
+		if mm != nil && normalizePyName(mm[1]) == normalizePyName(dep) {
+			lines[i] = indent + mm[1] + mm[2] + "==" + version + mm[4]
+		}
+	}
+	return "", os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644)
+}
+
+// nodePackageManager picks the package manager whose lock file is present.
+// nodeLockfiles tell the package manager of a Node project, first match
+// wins.
+var nodeLockfiles = []struct{ file, pm string }{
+	{"pnpm-lock.yaml", "pnpm"}, {"yarn.lock", "yarn"}, {"bun.lockb", "bun"}, {"bun.lock", "bun"},
+}
+
+func nodePackageManager(dir string) string {
+	for _, lock := range nodeLockfiles {
+		if _, err := os.Stat(filepath.Join(dir, lock.file)); err == nil {
+			return lock.pm
+		}
+	}
+	return "npm"
+}
+
+// defaultUpgradeVerify builds and tests the project the usual way for its
+// ecosystem.
+func defaultUpgradeVerify(dir string, m *depManifest) string {
+	switch m.kind {
+	case "go":
+		return "go build ./... && go vet ./... && go test ./..."
+	case "npm":
+		pm := nodePackageManager(dir)
+		var pkg struct {
+			Scripts map[string]string `json:"scripts"`
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "package.json"))
+		_ = json.Unmarshal(data, &pkg)
+		var steps []string
+		for _, script := range []string{"build", "typecheck", "test"} {
+			if _, ok := pkg.Scripts[script]; ok {
+				steps = append(steps, pm+" run "+script)
+			}
+		}
+		if len(steps) == 0 {
+			return pm + " test"
+		}
+		return strings.Join(steps, " && ")
+	}
+	return "python -m pip install -q -r " + m.file + " && python -m pytest -q"
+}
+
+func runIn(ctx context.Context, dir, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// fetchChangelog returns the GitHub release notes of dep's repository for
+// the releases after from up to to, newest first. Go modules hosted on
+// GitHub are found by path; npm and PyPI packages by their registry
+// metadata.
+func fetchChangelog(ctx context.Context, kind, dep, from, to string) (string, error) {
+	client := &http.Client{Timeout: changelogTimeout}
+	var repoURL string
+	switch kind {
+	case "go":
+		repoURL = dep
+	case "npm":
+		var meta struct {
+			Repository json.RawMessage `json:"repository"`
+		}
+		if err := getJSON(ctx, client, "https://registry.npmjs.org/"+strings.Replace(url.PathEscape(dep), "%40", "@", 1), &meta); err != nil {
+			return "", err
+		}
+		var repo struct {
+			URL string `json:"url"`
+		}
+		if json.Unmarshal(meta.Repository, &repo) != nil {
+			_ = json.Unmarshal(meta.Repository, &repo.URL)
+		}
+		repoURL = repo.URL
+	case "pip":
+		var meta struct {
+			Info struct {
+				HomePage    string            `json:"home_page"`
+				ProjectURLs map[string]string `json:"project_urls"`
+			} `json:"info"`
+		}
+		if err := getJSON(ctx, client, "https://pypi.org/pypi/"+url.PathEscape(dep)+"/json", &meta); err != nil {
+			return "", err
+		}
+		repoURL = meta.Info.HomePage
+		for _, u := range meta.Info.ProjectURLs {
+			if githubRepoRe.MatchString(u) {
+				repoURL = u
+				break
+			}
+		}
+	}
+	m := githubRepoRe.FindStringSubmatch(repoURL)
+	if m == nil {
+		return "", fmt.Errorf("%s is not hosted on GitHub", dep)
+	}
+	var releases []struct {
+		TagName string `json:"tag_name"`
+		Name    string `json:"name"`
+		Body    string `json:"body"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/repos/"+m[1]+"/"+m[2]+"/releases?per_page=100", &releases); err != nil {
+		return "", err
+	}
+	from, to = releaseVersion(from), releaseVersion(to)
+	var sb strings.Builder
+	started := to == ""
+	for _, r := range releases {
+		v := releaseVersion(r.TagName)
+		if v == to {
+			started = true
+		}
+		if from != "" && v == from {
+			break
+		}
+		if !started {
+			continue
+		}
+		fmt.Fprintf(&sb, "### %s\n\n%s\n\n", firstNonEmpty(r.Name, r.TagName), strings.TrimSpace(r.Body))
+		if sb.Len() > maxChangelogBytes {
+			break
+		}
+	}
+	return truncateOutput(strings.TrimSpace(sb.String()), maxChangelogBytes), nil
+}
+
+// releaseVersion reduces a tag or version specifier such as pkg@v1.2.0,
+// ^1.2.0, or v1.2.0 to 1.2.0.
+func releaseVersion(v string) string {
+	if i := strings.LastIndex(v, "@"); i >= 0 {
+		v = v[i+1:]
+	}
+	if i := strings.LastIndex(v, "/"); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimPrefix(strings.TrimLeft(v, "^~=<>! "), "v")
+}
+
+func getJSON(ctx context.Context, client *http.Client, target string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" && strings.HasPrefix(target, "https://api.github.com/") {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(v)
+}
+
+func upgradeFixTask(dep string, before, after *depManifest, verify, log, changelog string) string {
+	var sb strings.Builder
+	sb.WriteString(upgradeFixIntro + "\n\n")
+	fmt.Fprintf(&sb, "## Upgrade\n\n%s in %s: %s -> %s\n\n", dep, before.file, firstNonEmpty(before.current, "unpinned"), firstNonEmpty(after.current, "latest"))
+	sb.WriteString("## Verification\n\n`" + verify + "` fails:\n```\n" + strings.TrimSpace(log) + "\n```\n")
+	if changelog != "" {
+		sb.WriteString("\n## Release notes\n\n" + changelog + "\n")
+	}
+	return sb.String()
+}
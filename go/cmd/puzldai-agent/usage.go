@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// projectEnv names the project a run's usage is attributed to. The parent of
+// -attempts and -pipeline sets it, so children running in temporary
+// worktrees are booked to the same project.
+const projectEnv = "PUZLDAI_PROJECT"
+
+// tenantEnv names the serve tenant a run's usage is attributed to; serve
+// sets it for the runs a tenant starts.
+const tenantEnv = "PUZLDAI_TENANT"
+
+// usageMeter wraps a provider and counts tokens per model, including the
+// reviewer, judge, and wrap-up turns. It sits below the response cache, so
+// cached replies are not counted as spend.
+type usageMeter struct {
+	next     provider
+	provider string
+	batch    bool
+	project  string
+	tenant   string
+	cwd      string
+	started  time.Time
+
+	mu     sync.Mutex
+	models map[string]tokenUsage
+	order  []string
+}
+
+// usageRecord is one line of the usage ledger: a run's tokens for one model.
+type usageRecord struct {
+	Time         time.Time `json:"time"`
+	Run          string    `json:"run"`
+	Session      string    `json:"session,omitempty"`
+	Project      string    `json:"project"`
+	Tenant       string    `json:"tenant,omitempty"`
+	Cwd          string    `json:"cwd"`
+	Provider     string    `json:"provider"`
+	Model        string    `json:"model"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+	// CostUSD is the estimate at the time of the run; it is missing for
+	// models without a known price.
+	CostUSD    *float64 `json:"cost_usd,omitempty"`
+	Batch      bool     `json:"batch,omitempty"`
+	Status     string   `json:"status"`
+	DurationMS int64    `json:"duration_ms"`
+}
+
+func newUsageMeter(next provider, providerName, cwd string, batch bool) *usageMeter {
+	return &usageMeter{
+		next:     next,
+		provider: providerName,
+		batch:    batch,
+		project:  projectName(cwd),
+		tenant:   os.Getenv(tenantEnv),
+		cwd:      cwd,
+		started:  time.Now(),
+		models:   map[string]tokenUsage{},
+	}
+}
+
+func (m *usageMeter) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	resp, err := m.next.complete(ctx, req)
+	if resp != nil {
+		m.mu.Lock()
+		u, seen := m.models[req.model]
+		if !seen {
+			m.order = append(m.order, req.model)
+		}
+		u.inputTokens += resp.usage.inputTokens
+		u.outputTokens += resp.usage.outputTokens
+		m.models[req.model] = u
+		m.mu.Unlock()
+	}
+	return resp, err
+}
+
+// record appends the run's usage to the ledger. Runs that made no provider
+// request leave no trace; failures are reported and otherwise ignored.
+func (m *usageMeter) record(session, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.order) == 0 {
+		return
+	}
+	run := firstNonEmpty(session, newSessionID())
+	now := time.Now().UTC()
+	var buf strings.Builder
+	for _, model := range m.order {
+		u := m.models[model]
+		rec := usageRecord{
+			Time: now, Run: run, Session: session, Project: m.project, Tenant: m.tenant, Cwd: m.cwd,
+			Provider: m.provider, Model: model, InputTokens: u.inputTokens, OutputTokens: u.outputTokens,
+			Batch: m.batch, Status: status, DurationMS: time.Since(m.started).Milliseconds(),
+		}
+		if price, ok := priceFor(model); ok {
+			cost := price.cost(u)
+			if m.batch {
+				cost /= 2
+			}
+			rec.CostUSD = &cost
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "usage ledger:", err)
+			return
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := appendLedger(buf.String()); err != nil {
+		fmt.Fprintln(os.Stderr, "usage ledger:", err)
+	}
+}
+
+// usage returns the tokens used so far, by model.
+func (m *usageMeter) usage() map[string]tokenUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.models)
+}
+
+// cost estimates the spend so far. It is nil when no request was made, or
+// when a model's price is unknown.
+func (m *usageMeter) cost() *float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.order) == 0 {
+		return nil
+	}
+	var total float64
+	for _, model := range m.order {
+		price, ok := priceFor(model)
+		if !ok {
+			return nil
+		}
+		total += price.cost(m.models[model])
+	}
+	if m.batch {
+		total /= 2
+	}
+	return &total
+}
+
+// ledgerPath is PUZLDAI_HOME/usage.jsonl.
+func ledgerPath() (string, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dir), "usage.jsonl"), nil
+}
+
+// appendLedger adds lines with a single append-mode write, so concurrent
+// runs (parallel attempts, pipeline coders) do not interleave records.
+func appendLedger(lines string) error {
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	return appendLines(path, lines)
+}
+
+// appendLines appends to the file at path in one write, creating it and
+// its directory as needed.
+func appendLines(path, lines string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(lines); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// projectName is PUZLDAI_PROJECT, or the name of the git repository or
+// directory holding cwd.
+func projectName(cwd string) string {
+	if p := os.Getenv(projectEnv); p != "" {
+		return p
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if out, err := runGit(ctx, cwd, "rev-parse", "--show-toplevel"); err == nil {
+		return filepath.Base(strings.TrimSpace(out))
+	}
+	return filepath.Base(cwd)
+}
+
+const usageUsage = "usage: puzldai-agent usage [-since 7d] [-project name] [-tenant name] [-json]"
+
+func runUsage(args []string) int {
+	fs := newFlagSet("usage")
+	sinceFlag := fs.String("since", "30d", "Only count runs since this long ago (e.g. 7d, 12h, 2w) or since a date (2006-01-02)")
+	projectFlag := fs.String("project", "", "Only count runs of this project")
+	tenantFlag := fs.String("tenant", "", "Only count runs of this serve tenant")
+	jsonFlag := fs.Bool("json", false, "Print the matching ledger records as JSON lines instead of a summary")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, usageUsage)
+		return exitUsage
+	}
+	since, err := parseSince(*sinceFlag, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "usage: -since:", err)
+		return exitUsage
+	}
+	records, err := loadLedger(since, *projectFlag, *tenantFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "usage:", err)
+		return exitError
+	}
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				fmt.Fprintln(os.Stderr, "usage:", err)
+				return exitError
+			}
+		}
+		return exitOK
+	}
+	printUsageSummary(records, since)
+	return exitOK
+}
+
+// parseSince accepts a Go duration, a number of days or weeks (7d, 2w), or
+// a date.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); err == nil && strings.HasSuffix(s, suffix) && n >= 0 {
+			return now.Add(-time.Duration(n) * unit), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (e.g. 7d, 12h, 2w, or 2006-01-02)", s)
+}
+
+func loadLedger(since time.Time, project, tenant string) ([]usageRecord, error) {
+	path, err := ledgerPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []usageRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r usageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// A torn line from a crashed run should not hide the rest.
+			fmt.Fprintf(os.Stderr, "%s:%d: skipped: %v\n", path, line, err)
+			continue
+		}
+		if r.Time.Before(since) || (project != "" && r.Project != project) || (tenant != "" && r.Tenant != tenant) {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// usageGroup sums records sharing one key of a summary table.
+type usageGroup struct {
+	key      string
+	runs     map[string]bool
+	input    int64
+	output   int64
+	cost     float64
+	unpriced int64
+}
+
+func (g *usageGroup) add(r usageRecord) {
+	g.runs[r.Run] = true
+	g.input += r.InputTokens
+	g.output += r.OutputTokens
+	if r.CostUSD != nil {
+		g.cost += *r.CostUSD
+	} else {
+		g.unpriced += r.InputTokens + r.OutputTokens
+	}
+}
+
+func printUsageSummary(records []usageRecord, since time.Time) {
+	total := &usageGroup{key: "total", runs: map[string]bool{}}
+	for _, r := range records {
+		total.add(r)
+	}
+	fmt.Printf("usage since %s: %d runs, %s input and %s output tokens, $%.2f\n",
+		since.Local().Format("2006-01-02 15:04"), len(total.runs), formatCount(total.input), formatCount(total.output), total.cost)
+	if total.unpriced > 0 {
+		fmt.Printf("%s tokens of models without a known price are not included in the cost\n", formatCount(total.unpriced))
+	}
+	if len(records) == 0 {
+		return
+	}
+	type table struct {
+		title string
+		key   func(usageRecord) string
+	}
+	tables := []table{
+		{"DAY", func(r usageRecord) string { return r.Time.Local().Format(time.DateOnly) }},
+		{"MODEL", func(r usageRecord) string { return r.Model }},
+		{"PROJECT", func(r usageRecord) string { return r.Project }},
+		{"STATUS", func(r usageRecord) string { return firstNonEmpty(r.Status, "unknown") }},
+	}
+	if slices.ContainsFunc(records, func(r usageRecord) bool { return r.Tenant != "" }) {
+		tables = append(tables, table{"TENANT", func(r usageRecord) string { return firstNonEmpty(r.Tenant, "-") }})
+	}
+	for _, t := range tables {
+		groups := map[string]*usageGroup{}
+		for _, r := range records {
+			k := t.key(r)
+			if groups[k] == nil {
+				groups[k] = &usageGroup{key: k, runs: map[string]bool{}}
+			}
+			groups[k].add(r)
+		}
+		sorted := make([]*usageGroup, 0, len(groups))
+		for _, g := range groups {
+			sorted = append(sorted, g)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if t.title == "DAY" {
+				return sorted[i].key < sorted[j].key
+			}
+			if sorted[i].cost != sorted[j].cost {
+				return sorted[i].cost > sorted[j].cost
+			}
+			return sorted[i].key < sorted[j].key
+		})
+
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "%s\tRUNS\tINPUT\tOUTPUT\tCOST\n", t.title)
+		for _, g := range sorted {
+			cost := fmt.Sprintf("$%.2f", g.cost)
+			if g.unpriced > 0 {
+				cost += "+"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", g.key, len(g.runs), formatCount(g.input), formatCount(g.output), cost)
+		}
+		w.Flush()
+	}
+}
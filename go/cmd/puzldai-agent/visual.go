@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+)
+
+const (
+	visualReviewRounds = 2
+	// maxVisualPages bounds the pages rendered per review; each costs two
+	// screenshots.
+	maxVisualPages    = 3
+	screenshotTimeout = time.Minute
+	screenshotSize    = "1280,1600"
+)
+
+// browserNames are the Chrome and Chromium commands tried, in order, when
+// the config names none.
+var browserNames = []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "chrome", "microsoft-edge"}
+
+const visualReviewInstructions = `You check another agent's changes to web pages and documents. For each page
+below you get a screenshot of it before the change and after, rendered in a
+headless browser; a page without a "before" screenshot is new.
+
+Look for visual regressions the text diff would not show: broken or shifted
+layout, overlapping, cut-off, or missing elements, unstyled content, unreadable
+text or contrast, broken images, and raw markup or rendering errors. Changes
+the task asked for are not regressions.
+
+End your reply with exactly one verdict line:
+VERDICT: approve
+or
+VERDICT: revise
+followed by a numbered list of concrete problems, each naming the page and
+what looks wrong.`
+
+// visualReviewer renders the HTML, CSS, and markdown pages a run changed in
+// a headless browser, before and after, and has the model compare the
+// screenshots. Problems are sent back into the loop, for at most rounds
+// revisions.
+type visualReviewer struct {
+	llm       provider
+	model     string
+	maxTokens int
+	browser   string
+	root      string
+	baseline  string
+	rounds    int
+	used      int
+}
+
+// newVisualReviewer snapshots the workspace so the review sees only this
+// run's changes. It returns nil, with a note, when there is no browser or
+// no local git repository.
+func newVisualReviewer(llm provider, model string, maxTokens int, browser, cwd string) *visualReviewer {
+	bin, err := findBrowser(browser)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "visual review disabled:", err)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	root, err := gitRoot(ctx, cwd)
+	var baseline string
+	if err == nil {
+		baseline, err = snapshotWorktree(ctx, root, "puzldai visual review baseline")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "visual review disabled:", err)
+		return nil
+	}
+	return &visualReviewer{llm: llm, model: model, maxTokens: maxTokens, browser: bin, root: root, baseline: baseline, rounds: visualReviewRounds}
+}
+
+// findBrowser resolves the configured browser, or looks for Chrome or
+// Chromium on PATH.
+func findBrowser(configured string) (string, error) {
+	if configured != "" {
+		bin, err := exec.LookPath(configured)
+		if err != nil {
+			return "", fmt.Errorf("browser %q: %w", configured, err)
+		}
+		return bin, nil
+	}
+	for _, name := range browserNames {
+		if bin, err := exec.LookPath(name); err == nil {
+			return bin, nil
+		}
+	}
+	return "", errors.New("no Chrome or Chromium found on PATH (set browser in the config)")
+}
+
+// review returns the problems the model sees in the screenshots, or ""
+// when it approves, no page changed, the review fails, or the revision
+// rounds are used up.
+func (v *visualReviewer) review(ctx context.Context, task string) string {
+	if v.used >= v.rounds {
+		fmt.Fprintf(os.Stderr, "visual review: %d revision round(s) used; accepting the result\n", v.rounds)
+		return ""
+	}
+	current, err := snapshotWorktree(ctx, v.root, "puzldai visual review")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "visual review: skipped:", err)
+		return ""
+	}
+	pages, err := v.pages(ctx, current)
+	if err != nil || len(pages) == 0 {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "visual review: skipped:", err)
+		}
+		return ""
+	}
+
+	dir, err := os.MkdirTemp("", "puzldai-visual-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "visual review: skipped:", err)
+		return ""
+	}
+	defer os.RemoveAll(dir)
+	before, after := filepath.Join(dir, "before"), filepath.Join(dir, "after")
+	for tree, commit := range map[string]string{before: v.baseline, after: current} {
+		if err := extractCommit(ctx, v.root, commit, tree); err != nil {
+			fmt.Fprintln(os.Stderr, "visual review: skipped:", err)
+			return ""
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "visual review: rendering %s\n", strings.Join(pages, ", "))
+	var images []promptImage
+	for _, page := range pages {
+		for _, side := range []struct{ name, tree string }{{"before", before}, {"after", after}} {
+			if _, err := os.Stat(filepath.Join(side.tree, filepath.FromSlash(page))); err != nil {
+				continue
+			}
+			shot, err := v.screenshot(ctx, side.tree, page)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "visual review: skipped: rendering %s (%s): %v\n", page, side.name, err)
+				return ""
+			}
+			images = append(images, promptImage{label: page + " (" + side.name + "):", mediaType: "image/png", data: shot})
+		}
+	}
+
+	prompt := "## Task\n\n" + task + "\n\n## Pages\n\n- " + strings.Join(pages, "\n- ") + "\n"
+	resp, err := v.llm.complete(ctx, completionRequest{
+		model:     v.model,
+		system:    visualReviewInstructions,
+		messages:  []agentMessage{{role: "user", content: prompt}},
+		maxTokens: v.maxTokens,
+		images:    images,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "visual review: provider error, accepting the result:", err)
+		return ""
+	}
+	return v.verdict(resp.text)
+}
+
+func (v *visualReviewer) verdict(text string) string {
+	m := verdictRe.FindStringSubmatchIndex(text)
+	if m == nil {
+		fmt.Fprintln(os.Stderr, "visual review: no verdict; accepting the result")
+		return ""
+	}
+	if strings.EqualFold(text[m[2]:m[3]], "approve") {
+		fmt.Fprintln(os.Stderr, "visual review: approved")
+		return ""
+	}
+	v.used++
+	problems := strings.TrimSpace(text[m[4]:])
+	if problems == "" {
+		problems = strings.TrimSpace(text[:m[0]])
+	}
+	fmt.Fprintf(os.Stderr, "visual review: revision requested (round %d of %d)\n", v.used, v.rounds)
+	return fmt.Sprintf("[visual review] Screenshots of the pages you changed, before and after, show problems (round %d of %d):\n\n%s\n\n"+
+		"Fix them, or explain why they are intended, then give your final answer again.",
+		v.used, v.rounds, problems)
+}
+
+// pages lists the pages to render: changed HTML, SVG, and markdown files,
+// and for changed stylesheets, the HTML pages that link them.
+func (v *visualReviewer) pages(ctx context.Context, current string) ([]string, error) {
+	out, err := runGit(ctx, v.root, "diff", "--name-only", "--diff-filter=AMR", v.baseline, current)
+	if err != nil {
+		return nil, err
+	}
+	var pages, styles []string
+	for _, name := range strings.Split(strings.TrimSpace(out), "\n") {
+		switch strings.ToLower(path.Ext(name)) {
+		case ".html", ".htm", ".svg", ".md", ".markdown":
+			pages = append(pages, name)
+		case ".css":
+			styles = append(styles, name)
+		}
+	}
+	if len(styles) > 0 && len(pages) < maxVisualPages {
+		files, err := runGit(ctx, v.root, "ls-tree", "-r", "--name-only", current)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range strings.Split(strings.TrimSpace(files), "\n") {
+			if len(pages) >= maxVisualPages {
+				break
+			}
+			ext := strings.ToLower(path.Ext(name))
+			if (ext != ".html" && ext != ".htm") || slices.Contains(pages, name) {
+				continue
+			}
+			content, err := runGit(ctx, v.root, "show", current+":"+name)
+			if err != nil {
+				continue
+			}
+			for _, style := range styles {
+				if strings.Contains(content, path.Base(style)) {
+					pages = append(pages, name)
+					break
+				}
+			}
+		}
+	}
+	if len(pages) > maxVisualPages {
+		fmt.Fprintf(os.Stderr, "visual review: %d pages changed; rendering the first %d\n", len(pages), maxVisualPages)
+		pages = pages[:maxVisualPages]
+	}
+	return pages, nil
+}
+
+// screenshot renders page, relative to tree, to PNG. Markdown is converted
+// to HTML beside it first, so relative links and images resolve.
+func (v *visualReviewer) screenshot(ctx context.Context, tree, page string) ([]byte, error) {
+	file := filepath.Join(tree, filepath.FromSlash(page))
+	if ext := strings.ToLower(path.Ext(page)); ext == ".md" || ext == ".markdown" {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var html bytes.Buffer
+		html.WriteString("<!doctype html>\n<meta charset=\"utf-8\">\n<style>body{font-family:sans-serif;max-width:50em;margin:2em auto;padding:0 1em;line-height:1.5}pre{background:#f4f4f4;padding:1em;overflow:auto}</style>\n")
+		if err := goldmark.Convert(source, &html); err != nil {
+			return nil, err
+		}
+		file += ".puzldai.html"
+		if err := os.WriteFile(file, html.Bytes(), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	out := file + ".png"
+	ctx, cancel := context.WithTimeout(ctx, screenshotTimeout)
+	defer cancel()
+	args := []string{"--headless=new", "--disable-gpu", "--hide-scrollbars", "--window-size=" + screenshotSize, "--screenshot=" + out}
+	if runtime.GOOS != "windows" && os.Geteuid() == 0 {
+		// Chrome refuses to run as root with its sandbox on.
+		args = append(args, "--no-sandbox")
+	}
+	target := filepath.ToSlash(file)
+	if !strings.HasPrefix(target, "/") {
+		target = "/" + target // file:///C:/... on Windows
+	}
+	args = append(args, (&url.URL{Scheme: "file", Path: target}).String())
+	cmd := exec.CommandContext(ctx, v.browser, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, firstLine(strings.TrimSpace(stderr.String())))
+	}
+	return os.ReadFile(out)
+}
+
+// extractCommit writes the files of commit to dir.
+func extractCommit(ctx context.Context, root, commit, dir string) error {
+	cmd := exec.CommandContext(ctx, "git", "archive", "--format=tar", commit)
+	cmd.Dir = root
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	tr := tar.NewReader(stdout)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cmd.Wait()
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(filepath.Separator)) {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0o700)
+		case tar.TypeReg:
+			err = writeTarFile(target, tr)
+		}
+		if err != nil {
+			cmd.Wait()
+			return err
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git archive: %w", err)
+	}
+	return nil
+}
+
+func writeTarFile(target string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// watchSettle is how long after a tool turn events are still attributed
+	// to the agent, since fsnotify delivers them asynchronously.
+	watchSettle      = 200 * time.Millisecond
+	watchNoticeFiles = 10
+)
+
+// workspaceWatcher records files changed outside the agent during a session.
+// Events that arrive while tools run (or just after) are the agent's own and
+// are dropped, so only changes made while the model is thinking remain.
+type workspaceWatcher struct {
+	root    string
+	fsw     *fsnotify.Watcher
+	mu      sync.Mutex
+	busy    bool
+	quiet   time.Time
+	changed map[string]bool
+	read    map[string]bool
+}
+
+func newWorkspaceWatcher(root string) (*workspaceWatcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &workspaceWatcher{root: root, fsw: fsw, changed: map[string]bool{}, read: map[string]bool{}}
+	if err := w.addTree(root); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	go w.loop()
+	return w, nil
+}
+
+// addTree watches dir and its subdirectories; fsnotify is not recursive.
+func (w *workspaceWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if p != w.root && (strings.HasPrefix(d.Name(), ".") || repoMapSkipDirs[d.Name()]) {
+			return filepath.SkipDir
+		}
+		return w.fsw.Add(p)
+	})
+}
+
+func (w *workspaceWatcher) loop() {
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if ev.Has(fsnotify.Create) {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					_ = w.addTree(ev.Name)
+					continue
+				}
+			}
+			if ev.Has(fsnotify.Chmod) && !ev.Has(fsnotify.Write) {
+				continue
+			}
+			rel, err := filepath.Rel(w.root, ev.Name)
+			if err != nil || strings.HasPrefix(filepath.Base(rel), ".") {
+				continue
+			}
+			w.mu.Lock()
+			if !w.busy && time.Now().After(w.quiet) {
+				w.changed[filepath.ToSlash(rel)] = true
+			}
+			w.mu.Unlock()
+		case _, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// toolsStarted marks the start of a tool turn.
+func (w *workspaceWatcher) toolsStarted() {
+	w.mu.Lock()
+	w.busy = true
+	w.mu.Unlock()
+}
+
+// toolsDone ends a tool turn and remembers which files the agent has seen.
+func (w *workspaceWatcher) toolsDone(cwd string, calls []toolCall) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.busy = false
+	w.quiet = time.Now().Add(watchSettle)
+	for _, c := range calls {
+		switch c.name {
+		case "view", "write", "edit":
+			if p, ok := argString(c.arguments, "path"); ok && p != "" {
+				rel := displayPath(w.root, resolvePath(cwd, p))
+				w.read[rel] = true
+				delete(w.changed, rel)
+			}
+		}
+	}
+}
+
+// notice returns a note listing files changed outside the agent since the
+// last call, leading with files it has read, or "" when nothing changed.
+func (w *workspaceWatcher) notice() string {
+	w.mu.Lock()
+	var seen, other []string
+	for p := range w.changed {
+		if w.read[p] {
+			seen = append(seen, p)
+		} else {
+			other = append(other, p)
+		}
+	}
+	w.changed = map[string]bool{}
+	w.mu.Unlock()
+
+	if len(seen) == 0 && len(other) == 0 {
+		return ""
+	}
+	sort.Strings(seen)
+	sort.Strings(other)
+	var sb strings.Builder
+	sb.WriteString("[workspace watcher] Files changed outside the agent")
+	if len(seen) > 0 {
+		sb.WriteString(" since you last read them; view them again before editing:\n")
+		writeFileList(&sb, seen)
+		if len(other) > 0 {
+			sb.WriteString("Other files changed:\n")
+			writeFileList(&sb, other)
+		}
+	} else {
+		sb.WriteString(":\n")
+		writeFileList(&sb, other)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func writeFileList(sb *strings.Builder, files []string) {
+	for _, f := range files[:min(len(files), watchNoticeFiles)] {
+		sb.WriteString("- " + f + "\n")
+	}
+	if len(files) > watchNoticeFiles {
+		fmt.Fprintf(sb, "- ... and %d more\n", len(files)-watchNoticeFiles)
+	}
+}
+
+func (w *workspaceWatcher) close() {
+	w.fsw.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// whatIfBranch is a new session branched from a saved one at an editable
+// entry: entry 0 is the system prompt, and from 1 on the user messages and
+// tool results in the order replay numbers them. The transcript is cut after
+// the entry, whose text is replaced, and the run continues from there.
+type whatIfBranch struct {
+	from  *savedSession
+	entry int
+	// messages is the branched transcript, ending with the edited entry.
+	messages []agentMessage
+	// system replaces the system prompt when entry 0 was edited.
+	system string
+	// task is the session's first user message, the task of the run.
+	task string
+	// replies are the recorded model replies after the edited entry.
+	replies []agentMessage
+}
+
+// loadWhatIfSource loads the session named by ref (id@entry).
+func loadWhatIfSource(ref string) (*savedSession, int, error) {
+	id, n, ok := strings.Cut(ref, "@")
+	entry, err := strconv.Atoi(n)
+	if !ok || err != nil || entry < 0 {
+		return nil, 0, fmt.Errorf("-what-if %q must be session-id@entry (entries are numbered by replay)", ref)
+	}
+	saved, err := loadSession(id)
+	return saved, entry, err
+}
+
+// branchSession cuts saved after entry and replaces the entry with text.
+func branchSession(saved *savedSession, entry int, text string) (*whatIfBranch, error) {
+	id := saved.ID
+	messages := saved.agentMessages()
+	w := &whatIfBranch{from: saved, entry: entry}
+	for _, m := range messages {
+		if m.role == "user" {
+			w.task = m.content
+			break
+		}
+	}
+
+	var cut int
+	switch {
+	case entry == 0:
+		if saved.System == "" {
+			return nil, fmt.Errorf("session %s has no recorded system prompt", id)
+		}
+		// Keep the task; everything the model did with it is re-run.
+		cut = slices.IndexFunc(messages, func(m agentMessage) bool { return m.role == "user" })
+		if cut < 0 {
+			return nil, fmt.Errorf("session %s has no user message", id)
+		}
+		w.system = text
+		w.messages = slices.Clone(messages[:cut+1])
+	default:
+		i, j := entryIndex(messages, entry)
+		if i < 0 {
+			return nil, fmt.Errorf("session %s has no entry %d", id, entry)
+		}
+		cut = i
+		w.messages = slices.Clone(messages[:i+1])
+		edited := &w.messages[i]
+		if j < 0 {
+			edited.content = text
+			if i == slices.IndexFunc(messages, func(m agentMessage) bool { return m.role == "user" }) {
+				w.task = text
+			}
+		} else {
+			// The other results of the turn stay: every call needs one.
+			edited.toolResults = slices.Clone(edited.toolResults)
+			edited.toolResults[j].content = text
+			edited.toolResults[j].isError = false
+		}
+	}
+	for _, m := range messages[cut+1:] {
+		if m.role == "assistant" {
+			w.replies = append(w.replies, m)
+		}
+	}
+	return w, nil
+}
+
+// entryIndex locates editable entry n: the message index, and the result
+// index within a tool message or -1 for a user message.
+func entryIndex(messages []agentMessage, n int) (int, int) {
+	for i, m := range messages {
+		switch m.role {
+		case "user":
+			if n--; n == 0 {
+				return i, -1
+			}
+		case "tool":
+			if n <= len(m.toolResults) {
+				return i, n - 1
+			}
+			n -= len(m.toolResults)
+		}
+	}
+	return -1, -1
+}
+
+// replayProvider answers with recorded replies, in order, before handing
+// over to the live provider, so a what-if run only pays for new turns.
+type replayProvider struct {
+	next provider
+
+	mu      sync.Mutex
+	replies []agentMessage
+	live    bool
+}
+
+func newReplayProvider(next provider, replies []agentMessage) *replayProvider {
+	return &replayProvider{next: next, replies: replies}
+}
+
+func (p *replayProvider) complete(ctx context.Context, req completionRequest) (*completion, error) {
+	p.mu.Lock()
+	if len(p.replies) == 0 {
+		if !p.live {
+			p.live = true
+			fmt.Fprintln(os.Stderr, "recorded replies used up; continuing with the live provider")
+		}
+		p.mu.Unlock()
+		return p.next.complete(ctx, req)
+	}
+	reply := p.replies[0]
+	p.replies = p.replies[1:]
+	p.mu.Unlock()
+	return &completion{text: reply.content, toolCalls: reply.toolCalls}, nil
+}
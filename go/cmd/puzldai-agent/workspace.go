@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// workspace is a set of named roots for tasks that span sibling
+// directories, such as services in a monorepo. The first root is primary:
+// bash, git-based features, and unqualified paths use it. Tools address the
+// others as alias:path.
+type workspace struct {
+	roots []workspaceRoot
+}
+
+type workspaceRoot struct {
+	Alias string `toml:"alias"`
+	Path  string `toml:"path"`
+}
+
+// workspaceFile is the format of a file passed as -cwd:
+//
+//	[[root]]
+//	alias = "api"
+//	path = "services/api"
+//
+// Relative paths are resolved against the file's directory.
+type workspaceFile struct {
+	Roots []workspaceRoot `toml:"root"`
+}
+
+var rootAliasRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]+$`)
+
+// parseWorkspace interprets -cwd: a single directory (nil workspace), a
+// comma-separated list of [alias=]dir, or a workspace file. Aliases default
+// to the directory name.
+func parseWorkspace(spec string) (*workspace, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var roots []workspaceRoot
+	info, err := os.Stat(spec)
+	switch {
+	case err == nil && info.IsDir():
+		return nil, nil
+	case err == nil && info.Mode().IsRegular():
+		var file workspaceFile
+		if _, err := toml.DecodeFile(spec, &file); err != nil {
+			return nil, fmt.Errorf("workspace file %s: %w", spec, err)
+		}
+		if len(file.Roots) == 0 {
+			return nil, fmt.Errorf("workspace file %s lists no [[root]] entries", spec)
+		}
+		for _, r := range file.Roots {
+			if r.Path != "" && !filepath.IsAbs(r.Path) {
+				r.Path = filepath.Join(filepath.Dir(spec), r.Path)
+			}
+			roots = append(roots, r)
+		}
+	case !strings.ContainsAny(spec, ",="):
+		return nil, nil
+	default:
+		for _, part := range strings.Split(spec, ",") {
+			alias, dir, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok {
+				alias, dir = "", alias
+			}
+			roots = append(roots, workspaceRoot{Alias: alias, Path: dir})
+		}
+	}
+
+	ws := &workspace{}
+	seen := map[string]bool{}
+	for _, r := range roots {
+		if r.Path == "" {
+			return nil, fmt.Errorf("workspace root %q has no path", r.Alias)
+		}
+		dir, err := filepath.Abs(r.Path)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("workspace root %s is not a directory", r.Path)
+		}
+		alias := firstNonEmpty(r.Alias, filepath.Base(dir))
+		if !rootAliasRe.MatchString(alias) {
+			return nil, fmt.Errorf("invalid root alias %q (letters, digits, - and _; at least two characters)", alias)
+		}
+		if seen[alias] {
+			return nil, fmt.Errorf("duplicate root alias %q", alias)
+		}
+		seen[alias] = true
+		ws.roots = append(ws.roots, workspaceRoot{Alias: alias, Path: dir})
+	}
+	return ws, nil
+}
+
+// primary is the directory the session runs in.
+func (w *workspace) primary() string {
+	return w.roots[0].Path
+}
+
+func (w *workspace) dirs() []string {
+	dirs := make([]string, 0, len(w.roots))
+	for _, r := range w.roots {
+		dirs = append(dirs, r.Path)
+	}
+	return dirs
+}
+
+// spec renders the roots in -cwd form, so a resumed session gets them back.
+func (w *workspace) spec() string {
+	parts := make([]string, 0, len(w.roots))
+	for _, r := range w.roots {
+		parts = append(parts, r.Alias+"="+r.Path)
+	}
+	return strings.Join(parts, ",")
+}
+
+// resolve turns alias:path into an absolute path. Other paths are returned
+// unchanged for the tool to resolve against the primary root.
+func (w *workspace) resolve(path string) string {
+	alias, rest, ok := strings.Cut(path, ":")
+	if !ok {
+		return path
+	}
+	for _, r := range w.roots {
+		if r.Alias == alias {
+			return filepath.Join(r.Path, filepath.FromSlash(strings.TrimPrefix(rest, "/")))
+		}
+	}
+	return path
+}
+
+// label rewrites absolute root paths in tool output back to alias: form,
+// including the a/ and b/ headers of edit diffs.
+func (w *workspace) label(s string) string {
+	for _, r := range w.roots[1:] {
+		dir := filepath.ToSlash(r.Path) + "/"
+		for _, side := range []string{"a/", "b/"} {
+			s = strings.ReplaceAll(s, side+strings.TrimPrefix(dir, "/"), side+r.Alias+":")
+		}
+		s = strings.ReplaceAll(s, dir, r.Alias+":")
+		s = strings.ReplaceAll(s, r.Path+string(filepath.Separator), r.Alias+":")
+	}
+	return s
+}
+
+// apply wraps the file tools so their path arguments accept root aliases.
+// It must wrap the permission checks, which then see absolute paths.
+func (w *workspace) apply(tools []toolDef) []toolDef {
+	for i := range tools {
+		spec, ok := pathArgs[tools[i].name]
+		if !ok {
+			continue
+		}
+		next := tools[i].fn
+		tools[i].fn = func(ctx context.Context, cwd string, args map[string]any) (string, error) {
+			if path, ok := argString(args, spec.arg); ok && path != "" {
+				resolved := make(map[string]any, len(args))
+				for k, v := range args {
+					resolved[k] = v
+				}
+				resolved[spec.arg] = w.resolve(path)
+				args = resolved
+			}
+			out, err := next(ctx, cwd, args)
+			return w.label(out), err
+		}
+	}
+	return tools
+}
+
+// instructions describes the roots for the system prompt.
+func (w *workspace) instructions() string {
+	var sb strings.Builder
+	sb.WriteString("\n\n# Workspace Roots\n\n")
+	fmt.Fprintf(&sb, "This workspace spans %d directories. Address files in them as alias:path (for example %s:README.md); ", len(w.roots), w.roots[1].Alias)
+	fmt.Fprintf(&sb, "paths without an alias are relative to the primary root %q. bash runs in the primary root; cd to the absolute path to work elsewhere.\n\n", w.roots[0].Alias)
+	for i, r := range w.roots {
+		fmt.Fprintf(&sb, "- %s: %s", r.Alias, r.Path)
+		if i == 0 {
+			sb.WriteString(" (primary)")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// workspaceFS is what the tools read, write, walk, and run commands in the
+// workspace through: the local disk, the in-memory overlay of -emit patch
+// runs, or a -remote host. Paths are absolute in the file system's own
+// terms.
+type workspaceFS interface {
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+	// Open streams a file, for readers such as grep that scan large files
+	// without holding them.
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	// WriteFile creates or replaces a file, creating parent directories.
+	WriteFile(ctx context.Context, path string, data []byte) error
+	// Stat follows symlinks.
+	Stat(ctx context.Context, path string) (fs.FileInfo, error)
+	// Walk visits root and everything below it as filepath.WalkDir does,
+	// honoring fs.SkipDir and fs.SkipAll.
+	Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error
+	// Inside reports whether path is dir or below it once symlinks are
+	// resolved. path need not exist.
+	Inside(ctx context.Context, dir, path string) bool
+
+	// Command prepares a program to run in dir on the machine that holds
+	// the workspace. Workspace paths in args must be relative to dir: the
+	// overlay runs commands in a copy of the workspace.
+	Command(ctx context.Context, dir, name string, args ...string) (*exec.Cmd, error)
+	// Shell prepares a shell command line the same way.
+	Shell(ctx context.Context, dir, command string) (*exec.Cmd, error)
+	// LookPath reports an error when name is not installed where Command
+	// runs it.
+	LookPath(ctx context.Context, name string) error
+	// MkdirTemp creates a scratch directory where Command runs, for files
+	// one command leaves for another, such as a compiled test binary.
+	MkdirTemp(ctx context.Context, pattern string) (string, error)
+	// RemoveAll removes a directory made by MkdirTemp.
+	RemoveAll(ctx context.Context, path string) error
+}
+
+type workspaceFSKey struct{}
+
+func withWorkspaceFS(ctx context.Context, fsys workspaceFS) context.Context {
+	return context.WithValue(ctx, workspaceFSKey{}, fsys)
+}
+
+// workspaceFSFrom returns the file system the tools work on: the one set on
+// ctx, or else the local disk read through the session's file cache.
+func workspaceFSFrom(ctx context.Context) workspaceFS {
+	if fsys, ok := ctx.Value(workspaceFSKey{}).(workspaceFS); ok {
+		return fsys
+	}
+	return diskFS{cache: fileCacheFrom(ctx)}
+}
+
+// diskFS is the local file system. Reads and writes go through the file
+// cache, so the view/edit/view cycles of a session do not re-read files.
+type diskFS struct {
+	cache *fileCache
+}
+
+func (d diskFS) ReadFile(_ context.Context, path string) ([]byte, error) {
+	return d.cache.read(path)
+}
+
+func (d diskFS) Open(_ context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (d diskFS) WriteFile(_ context.Context, path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+	d.cache.wrote(path, data)
+	return nil
+}
+
+func (d diskFS) Stat(_ context.Context, path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (d diskFS) Walk(_ context.Context, root string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(root, fn)
+}
+
+func (d diskFS) Inside(_ context.Context, dir, path string) bool {
+	return insideDir(dir, path)
+}
+
+func (d diskFS) Command(ctx context.Context, dir, name string, args ...string) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	return cmd, nil
+}
+
+func (d diskFS) Shell(ctx context.Context, dir, command string) (*exec.Cmd, error) {
+	if runtime.GOOS == "windows" {
+		return d.Command(ctx, dir, "powershell", "-NoProfile", "-Command", command)
+	}
+	return d.Command(ctx, dir, "bash", "-lc", command)
+}
+
+func (d diskFS) LookPath(_ context.Context, name string) error {
+	_, err := exec.LookPath(name)
+	return err
+}
+
+func (d diskFS) MkdirTemp(_ context.Context, pattern string) (string, error) {
+	return os.MkdirTemp("", pattern)
+}
+
+func (d diskFS) RemoveAll(_ context.Context, path string) error {
+	return os.RemoveAll(path)
+}
+
+// commandPath is how a command running in dir names path: relative when
+// path is inside dir, so that it also names the file in the overlay's copy
+// of the workspace.
+func commandPath(dir, path string) string {
+	if within(dir, path) {
+		if rel, err := filepath.Rel(dir, path); err == nil {
+			return rel
+		}
+	}
+	return path
+}
+
+// memFile is a file read into memory, which can be read at any offset.
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error { return nil }
+
+// fileInfo describes a file that is not on the local disk, such as an
+// overlay file or a remote one.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (f fileInfo) Name() string       { return f.name }
+func (f fileInfo) Size() int64        { return f.size }
+func (f fileInfo) Mode() fs.FileMode  { return f.mode }
+func (f fileInfo) ModTime() time.Time { return f.modTime }
+func (f fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f fileInfo) Sys() any           { return nil }
@@ -0,0 +1,52 @@
+// Package agent holds the parts of puzldai-agent that programs embedding it
+// rely on. It defines the error taxonomy: a run that does not finish is
+// reported as a *RunError, and callers branch on its kind with errors.Is
+// instead of matching messages or exit codes. ReadOutcome and Outcome.Err
+// turn the -outcome-out file of a puzldai-agent run into that error.
+package agent
+
+import "errors"
+
+// Kinds of run failure. A *RunError matches exactly one of them.
+var (
+	ErrBudgetExceeded      = errors.New("token budget exceeded")
+	ErrPolicyViolation     = errors.New("policy violation")
+	ErrProviderUnavailable = errors.New("provider unavailable")
+	ErrMaxIterations       = errors.New("iteration limit reached")
+	ErrCancelled           = errors.New("cancelled")
+	ErrTimedOut            = errors.New("time limit exceeded")
+	ErrStalled             = errors.New("stalled")
+	ErrNeedsInput          = errors.New("needs input")
+)
+
+// RunError describes a run that stopped before finishing. errors.Is matches
+// both its Kind and its cause, so a provider failure can be told apart from
+// the rest and still be inspected as, say, a *net.OpError.
+type RunError struct {
+	Kind error
+	// Status is the outcome status written by -outcome-out, such as
+	// budget_exceeded.
+	Status     string
+	Summary    string
+	Iterations int
+	// Err is the underlying cause, if any.
+	Err error
+}
+
+func (e *RunError) Error() string {
+	msg := e.Kind.Error()
+	if e.Summary != "" && e.Summary != msg {
+		msg += ": " + e.Summary
+	}
+	if e.Err != nil && e.Err.Error() != e.Summary {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *RunError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Outcome is the result puzldai-agent writes with -outcome-out. Fields
+// that only some flags add are left out; decode the file yourself to read
+// them.
+type Outcome struct {
+	Status     string `json:"status"`
+	Summary    string `json:"summary"`
+	Iterations int    `json:"iterations"`
+	// Error is the code of the failure kind of a run that did not finish,
+	// such as policy_violation; see Code.
+	Error   string   `json:"error,omitempty"`
+	CostUSD *float64 `json:"cost_usd,omitempty"`
+}
+
+// codes are the outcome-file names of the failure kinds. Where a kind has
+// a status of its own, the code is that status.
+var codes = []struct {
+	code string
+	kind error
+}{
+	{"budget_exceeded", ErrBudgetExceeded},
+	{"policy_violation", ErrPolicyViolation},
+	{"provider_unavailable", ErrProviderUnavailable},
+	{"max_iterations", ErrMaxIterations},
+	{"cancelled", ErrCancelled},
+	{"timed_out", ErrTimedOut},
+	{"stalled", ErrStalled},
+	{"needs_input", ErrNeedsInput},
+}
+
+// Code returns the code err's failure kind is written as in the outcome
+// file, or "" when err matches none of them.
+func Code(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, c := range codes {
+		if errors.Is(err, c.kind) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+// ReadOutcome reads an outcome file written by -outcome-out.
+func ReadOutcome(path string) (Outcome, error) {
+	var o Outcome
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal(data, &o); err != nil {
+		return o, fmt.Errorf("%s: %w", path, err)
+	}
+	return o, nil
+}
+
+// Err returns nil for a run that finished, a *RunError for one that
+// stopped for a known kind of failure, and a plain error for any other
+// failure, such as a configuration error. Files without an error code,
+// from older versions, are classified by their status.
+func (o Outcome) Err() error {
+	code := o.Error
+	if code == "" {
+		code = o.Status
+	}
+	for _, c := range codes {
+		if c.code == code {
+			return &RunError{Kind: c.kind, Status: o.Status, Summary: o.Summary, Iterations: o.Iterations}
+		}
+	}
+	if o.Status == "error" {
+		return fmt.Errorf("run failed: %s", o.Summary)
+	}
+	return nil
+}
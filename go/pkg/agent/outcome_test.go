@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCodeRoundTrip(t *testing.T) {
+	for _, c := range codes {
+		err := Outcome{Status: "blocked", Error: Code(&RunError{Kind: c.kind})}.Err()
+		if !errors.Is(err, c.kind) {
+			t.Errorf("%s: Err() = %v, want a %v", c.code, err, c.kind)
+		}
+	}
+	if got := Code(errors.New("other")); got != "" {
+		t.Errorf("Code(other) = %q, want empty", got)
+	}
+}
+
+func TestReadOutcome(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outcome.json")
+	data := `{"status": "blocked", "summary": "push refused", "iterations": 3, "error": "policy_violation", "cost_usd": 0.5}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	o, err := ReadOutcome(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != "blocked" || o.Iterations != 3 || o.CostUSD == nil || *o.CostUSD != 0.5 {
+		t.Fatalf("ReadOutcome = %+v", o)
+	}
+	var runErr *RunError
+	if err := o.Err(); !errors.As(err, &runErr) || !errors.Is(err, ErrPolicyViolation) {
+		t.Fatalf("Err() = %v, want a policy violation", err)
+	}
+	if runErr.Status != "blocked" || runErr.Summary != "push refused" || runErr.Iterations != 3 {
+		t.Errorf("RunError = %+v", runErr)
+	}
+}
+
+func TestOutcomeErr(t *testing.T) {
+	tests := []struct {
+		outcome Outcome
+		kind    error // nil for a finished run
+		failed  bool
+	}{
+		{Outcome{Status: "success"}, nil, false},
+		{Outcome{Status: "blocked"}, nil, false},
+		{Outcome{Status: "budget_exceeded"}, ErrBudgetExceeded, true},
+		{Outcome{Status: "timed_out", Error: "timed_out"}, ErrTimedOut, true},
+		{Outcome{Status: "error", Error: "provider_unavailable"}, ErrProviderUnavailable, true},
+		{Outcome{Status: "error", Summary: "bad config"}, nil, true},
+	}
+	for _, tt := range tests {
+		err := tt.outcome.Err()
+		if (err != nil) != tt.failed {
+			t.Errorf("%+v: Err() = %v, want failed %v", tt.outcome, err, tt.failed)
+			continue
+		}
+		var runErr *RunError
+		if tt.kind == nil {
+			if errors.As(err, &runErr) {
+				t.Errorf("%+v: Err() = %v, want no *RunError", tt.outcome, err)
+			}
+		} else if !errors.Is(err, tt.kind) {
+			t.Errorf("%+v: Err() = %v, want %v", tt.outcome, err, tt.kind)
+		}
+	}
+}